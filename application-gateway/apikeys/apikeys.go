@@ -0,0 +1,181 @@
+// Package apikeys authenticates third-party clients of the gateway by API
+// key. Each key is bound to a wallet identity and a role: the role decides
+// which routes the client may call, and each key has its own request quotas.
+// Only the SHA-256 hash of a key is kept in the key file.
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// AllRoutes in a role's route list allows every route
+const AllRoutes = "*"
+
+// ErrUnknownKey is returned for a key that is not in the key file
+var ErrUnknownKey = errors.New("unknown API key")
+
+// Client is a third-party application holding an API key. Requests with the
+// key are submitted as Identity. A quota of zero is unlimited.
+type Client struct {
+	Name              string `json:"name"`
+	KeyHash           string `json:"keyHash"`
+	Identity          string `json:"identity"`
+	Role              string `json:"role"`
+	RequestsPerMinute int    `json:"requestsPerMinute"`
+	RequestsPerDay    int    `json:"requestsPerDay"`
+}
+
+// Config is the content of the key file. Roles maps each role to the routes
+// it may call, written as the gateway registers them, e.g. "GET /trades/{id}".
+type Config struct {
+	Roles   map[string][]string `json:"roles"`
+	Clients []*Client           `json:"clients"`
+}
+
+// usage counts a client's requests in the current minute and day
+type usage struct {
+	minute      time.Time
+	minuteCount int
+	day         time.Time
+	dayCount    int
+}
+
+// Store holds the API keys and the quota usage of their clients. Usage is
+// kept in memory, so it restarts with the gateway and is not shared between
+// gateway instances.
+type Store struct {
+	roles   map[string][]string
+	clients map[string]*Client
+
+	mu    sync.Mutex
+	usage map[string]*usage
+}
+
+// Load reads the key file at path
+func Load(path string) (*Store, error) {
+	configJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API key file: %w", err)
+	}
+	var config Config
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse API key file: %w", err)
+	}
+	return New(&config)
+}
+
+// New checks a key configuration and returns a store for it
+func New(config *Config) (*Store, error) {
+	names := map[string]bool{}
+	clients := map[string]*Client{}
+	for _, client := range config.Clients {
+		if client.Name == "" || client.Identity == "" {
+			return nil, fmt.Errorf("API key clients need a name and an identity")
+		}
+		if names[client.Name] {
+			return nil, fmt.Errorf("client %s is listed twice", client.Name)
+		}
+		names[client.Name] = true
+		if hash, err := hex.DecodeString(client.KeyHash); err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("key hash of client %s must be a hex encoded SHA-256 digest", client.Name)
+		}
+		if _, ok := clients[client.KeyHash]; ok {
+			return nil, fmt.Errorf("key of client %s is already in use", client.Name)
+		}
+		if _, ok := config.Roles[client.Role]; !ok {
+			return nil, fmt.Errorf("client %s has unknown role %q", client.Name, client.Role)
+		}
+		if client.RequestsPerMinute < 0 || client.RequestsPerDay < 0 {
+			return nil, fmt.Errorf("quotas of client %s must not be negative", client.Name)
+		}
+		clients[client.KeyHash] = client
+	}
+	return &Store{roles: config.Roles, clients: clients, usage: map[string]*usage{}}, nil
+}
+
+// GenerateKey returns a new random API key
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// HashKey returns the hash of a key as written in the key file
+func HashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Authenticate returns the client holding a key
+func (s *Store) Authenticate(key string) (*Client, error) {
+	client, ok := s.clients[HashKey(key)]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return client, nil
+}
+
+// Allowed reports whether a client's role may call a route
+func (s *Store) Allowed(client *Client, route string) bool {
+	for _, allowed := range s.roles[client.Role] {
+		if allowed == AllRoutes || allowed == route {
+			return true
+		}
+	}
+	return false
+}
+
+// Take counts a request of a client at now against its quotas. If a quota is
+// used up the request is not counted, and Take returns false with the time
+// until the quota's window ends.
+func (s *Store) Take(client *Client, now time.Time) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.usage[client.Name]
+	if !ok {
+		u = &usage{}
+		s.usage[client.Name] = u
+	}
+	minute, day := now.UTC().Truncate(time.Minute), now.UTC().Truncate(24*time.Hour)
+	if !u.minute.Equal(minute) {
+		u.minute, u.minuteCount = minute, 0
+	}
+	if !u.day.Equal(day) {
+		u.day, u.dayCount = day, 0
+	}
+	if client.RequestsPerDay > 0 && u.dayCount >= client.RequestsPerDay {
+		return day.Add(24 * time.Hour).Sub(now), false
+	}
+	if client.RequestsPerMinute > 0 && u.minuteCount >= client.RequestsPerMinute {
+		return minute.Add(time.Minute).Sub(now), false
+	}
+	u.minuteCount++
+	u.dayCount++
+	return 0, true
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying an authenticated client
+func NewContext(ctx context.Context, client *Client) context.Context {
+	return context.WithValue(ctx, contextKey{}, client)
+}
+
+// FromContext returns the authenticated client carried by ctx, if any
+func FromContext(ctx context.Context) (*Client, bool) {
+	client, ok := ctx.Value(contextKey{}).(*Client)
+	return client, ok
+}
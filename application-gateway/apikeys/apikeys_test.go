@@ -0,0 +1,89 @@
+package apikeys
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	store, err := New(&Config{
+		Roles: map[string][]string{
+			"reader":   {"GET /trades/{id}", "GET /trades"},
+			"operator": {AllRoutes},
+		},
+		Clients: []*Client{
+			{Name: "dashboard", KeyHash: HashKey("key-1"), Identity: "user1@org1", Role: "reader", RequestsPerMinute: 2, RequestsPerDay: 3},
+			{Name: "ops", KeyHash: HashKey("key-2"), Identity: "operator@org1", Role: "operator"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestAuthenticateAndAllowed(t *testing.T) {
+	store := newTestStore(t)
+
+	client, err := store.Authenticate("key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Identity != "user1@org1" {
+		t.Errorf("got identity %s, want user1@org1", client.Identity)
+	}
+	if _, err := store.Authenticate("key-3"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v for an unknown key, want ErrUnknownKey", err)
+	}
+	if !store.Allowed(client, "GET /trades/{id}") || store.Allowed(client, "POST /trades") {
+		t.Error("reader role should only read trades")
+	}
+	ops, _ := store.Authenticate("key-2")
+	if !store.Allowed(ops, "POST /accounts/{id}/mint") {
+		t.Error("operator role should call every route")
+	}
+}
+
+func TestTakeQuotas(t *testing.T) {
+	store := newTestStore(t)
+	client, _ := store.Authenticate("key-1")
+	start := time.Date(2030, 5, 3, 10, 0, 30, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if _, ok := store.Take(client, start); !ok {
+			t.Fatalf("request %d was refused", i+1)
+		}
+	}
+	retryAfter, ok := store.Take(client, start)
+	if ok || retryAfter != 30*time.Second {
+		t.Errorf("got %v, %t over the minute quota, want 30s, false", retryAfter, ok)
+	}
+	if _, ok := store.Take(client, start.Add(time.Minute)); !ok {
+		t.Error("request in the next minute was refused")
+	}
+	retryAfter, ok = store.Take(client, start.Add(2*time.Minute))
+	if ok || retryAfter != 13*time.Hour+57*time.Minute+30*time.Second {
+		t.Errorf("got %v, %t over the daily quota, want the rest of the day, false", retryAfter, ok)
+	}
+
+	ops, _ := store.Authenticate("key-2")
+	for i := 0; i < 10; i++ {
+		if _, ok := store.Take(ops, start); !ok {
+			t.Fatal("client without quotas was refused")
+		}
+	}
+}
+
+func TestLoadRejectsInvalidKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.json")
+	content := `{"roles":{"reader":["GET /trades"]},"clients":[{"name":"app","keyHash":"abc","identity":"user1@org1","role":"reader"}]}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || err.Error() != "key hash of client app must be a hex encoded SHA-256 digest" {
+		t.Errorf("got %v, want a key hash error", err)
+	}
+}
@@ -0,0 +1,252 @@
+// Package audit keeps the gateway's audit log: one entry per API call, each
+// holding the hash of the entry before it, so that changing or removing an
+// entry breaks the chain from there on.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+//go:embed schema.sql
+var schema string
+
+// GenesisHash is the previous hash of the first entry
+const GenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Entry records one API call: who made it, what it was, when, and the
+// transactions it submitted
+type Entry struct {
+	Seq            int64    `json:"seq"`
+	At             string   `json:"at"`
+	Identity       string   `json:"identity"`
+	Client         string   `json:"client,omitempty"`
+	Method         string   `json:"method"`
+	Route          string   `json:"route"`
+	Path           string   `json:"path"`
+	Function       string   `json:"function,omitempty"`
+	Status         int      `json:"status"`
+	TransactionIDs []string `json:"transactionIDs"`
+	PrevHash       string   `json:"prevHash"`
+	Hash           string   `json:"hash"`
+}
+
+// computeHash returns the hash of an entry: SHA-256 over its previous hash
+// and the JSON of its other fields, in the order of Entry
+func (e *Entry) computeHash() (string, error) {
+	content := *e
+	content.Hash = ""
+	if content.TransactionIDs == nil {
+		content.TransactionIDs = []string{}
+	}
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(append([]byte(e.PrevHash+"\n"), contentJSON...))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// Store is the audit log in the gateway database. Appends are serialized
+// within the process, so only one gateway may write to a database.
+type Store struct {
+	db *sql.DB
+	mu sync.Mutex
+}
+
+// Open opens, creating if needed, the audit log in the SQLite database at
+// path
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to apply audit schema: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Append chains an entry to the end of the log, setting its sequence number
+// and hashes
+func (s *Store) Append(e *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	e.Seq, e.PrevHash = 1, GenesisHash
+	err = tx.QueryRow("SELECT seq + 1, hash FROM audit_log ORDER BY seq DESC LIMIT 1").Scan(&e.Seq, &e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if e.Hash, err = e.computeHash(); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO audit_log (seq, at, identity, client, method, route, path, function, status, transaction_ids, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		e.Seq, e.At, e.Identity, e.Client, e.Method, e.Route, e.Path, e.Function, e.Status, strings.Join(e.TransactionIDs, ","), e.PrevHash, e.Hash)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Entries returns up to limit entries from sequence number from on
+func (s *Store) Entries(from int64, limit int) ([]*Entry, error) {
+	rows, err := s.db.Query(`SELECT seq, at, identity, client, method, route, path, function, status, transaction_ids, prev_hash, hash
+		FROM audit_log WHERE seq >= $1 ORDER BY seq LIMIT $2`, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []*Entry{}
+	for rows.Next() {
+		var e Entry
+		var transactionIDs string
+		if err := rows.Scan(&e.Seq, &e.At, &e.Identity, &e.Client, &e.Method, &e.Route, &e.Path, &e.Function, &e.Status, &transactionIDs, &e.PrevHash, &e.Hash); err != nil {
+			return nil, err
+		}
+		e.TransactionIDs = []string{}
+		if transactionIDs != "" {
+			e.TransactionIDs = strings.Split(transactionIDs, ",")
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+// ValidCode is the validation code of a valid transaction
+const ValidCode = "VALID"
+
+// TransactionChecker looks a transaction up on the ledger and returns the
+// code it was validated with, or "" if it is not on the ledger
+type TransactionChecker func(ctx context.Context, transactionID string) (string, error)
+
+// Discrepancy is a transaction ID of an entry that the ledger contradicts:
+// it is missing, or valid for a call that failed, or invalid for one that
+// succeeded
+type Discrepancy struct {
+	Seq           int64  `json:"seq"`
+	TransactionID string `json:"transactionID"`
+	Reason        string `json:"reason"`
+}
+
+// Verification is the outcome of verifying the log. BrokenAt is the first
+// entry whose hash or link to the entry before it does not match, if any;
+// the entries from there on cannot be trusted. Head is the hash of the last
+// entry, which auditors can keep to detect entries later removed from the
+// end.
+type Verification struct {
+	Entries       int64          `json:"entries"`
+	Head          string         `json:"head"`
+	BrokenAt      *int64         `json:"brokenAt,omitempty"`
+	Transactions  int            `json:"transactions"`
+	Discrepancies []*Discrepancy `json:"discrepancies"`
+}
+
+// verifyPageSize is how many entries Verify reads at a time
+const verifyPageSize = 1000
+
+// Verify recomputes the hash chain from the first entry and checks the
+// transaction IDs of the entries from sequence number from to to, 0 for the
+// end, against the ledger with check
+func (s *Store) Verify(ctx context.Context, from, to int64, check TransactionChecker) (*Verification, error) {
+	v := &Verification{Head: GenesisHash, Discrepancies: []*Discrepancy{}}
+	for next := int64(1); ; {
+		entries, err := s.Entries(next, verifyPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			hash, err := e.computeHash()
+			if err != nil {
+				return nil, err
+			}
+			if v.BrokenAt == nil && (e.Seq != v.Entries+1 || e.PrevHash != v.Head || e.Hash != hash) {
+				seq := v.Entries + 1
+				v.BrokenAt = &seq
+			}
+			v.Entries, v.Head = e.Seq, e.Hash
+			if e.Seq < from || (to > 0 && e.Seq > to) {
+				continue
+			}
+			for _, transactionID := range e.TransactionIDs {
+				code, err := check(ctx, transactionID)
+				if err != nil {
+					return nil, fmt.Errorf("failed to look up transaction %s: %w", transactionID, err)
+				}
+				v.Transactions++
+				var reason string
+				switch succeeded := e.Status < 300; {
+				case code == "":
+					reason = "not on the ledger"
+				case succeeded && code != ValidCode:
+					reason = fmt.Sprintf("invalidated with %s, but the call succeeded", code)
+				case !succeeded && code == ValidCode:
+					reason = fmt.Sprintf("valid, but the call failed with status %d", e.Status)
+				}
+				if reason != "" {
+					v.Discrepancies = append(v.Discrepancies, &Discrepancy{Seq: e.Seq, TransactionID: transactionID, Reason: reason})
+				}
+			}
+		}
+		if len(entries) < verifyPageSize {
+			return v, nil
+		}
+		next = entries[len(entries)-1].Seq + 1
+	}
+}
+
+// Record collects what the handler of an API call learns about it
+type Record struct {
+	mu             sync.Mutex
+	transactionIDs []string
+}
+
+// TransactionIDs returns the transactions added to the record
+func (r *Record) TransactionIDs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.transactionIDs...)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying a new record of an API call
+func NewContext(ctx context.Context) (context.Context, *Record) {
+	record := &Record{}
+	return context.WithValue(ctx, contextKey{}, record), record
+}
+
+// AddTransaction adds a submitted transaction to the record carried by ctx,
+// if there is one
+func AddTransaction(ctx context.Context, transactionID string) {
+	if record, ok := ctx.Value(contextKey{}).(*Record); ok {
+		record.mu.Lock()
+		defer record.mu.Unlock()
+		record.transactionIDs = append(record.transactionIDs, transactionID)
+	}
+}
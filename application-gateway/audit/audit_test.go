@@ -0,0 +1,131 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func openTestStore(t *testing.T) *Store {
+	store, err := Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// appendTestEntries appends a query, a settled submission and a submission
+// that failed to commit
+func appendTestEntries(t *testing.T, store *Store) {
+	entries := []*Entry{
+		{At: "2025-05-01T08:00:00Z", Identity: "user1@org1", Method: "GET", Route: "GET /trades/{id}", Path: "/trades/t1", Function: "ReadEnergyAsset", Status: 200},
+		{At: "2025-05-01T08:00:01Z", Identity: "user1@org1", Client: "dashboard", Method: "POST", Route: "POST /trades/{id}/delivery", Path: "/trades/t1/delivery", Function: "ConfirmDelivery", Status: 200, TransactionIDs: []string{"tx-1"}},
+		{At: "2025-05-01T08:00:02Z", Identity: "user1@org1", Method: "POST", Route: "POST /transfers", Path: "/transfers", Function: "TransferTokens", Status: 409, TransactionIDs: []string{"tx-2"}},
+	}
+	for _, e := range entries {
+		if err := store.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// ledger checks transactions against fixed validation codes
+func ledger(codes map[string]string) TransactionChecker {
+	return func(_ context.Context, transactionID string) (string, error) {
+		return codes[transactionID], nil
+	}
+}
+
+func TestAppendChainsEntries(t *testing.T) {
+	store := openTestStore(t)
+	appendTestEntries(t, store)
+
+	entries, err := store.Entries(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	if entries[0].Seq != 1 || entries[0].PrevHash != GenesisHash {
+		t.Errorf("first entry %d links to %s, want 1 linking to the genesis hash", entries[0].Seq, entries[0].PrevHash)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].PrevHash != entries[i-1].Hash {
+			t.Errorf("entry %d does not link to entry %d", entries[i].Seq, entries[i-1].Seq)
+		}
+	}
+	if got := entries[1].TransactionIDs; len(got) != 1 || got[0] != "tx-1" || entries[1].Client != "dashboard" {
+		t.Errorf("got entry %+v, want transaction tx-1 by client dashboard", entries[1])
+	}
+	if page, _ := store.Entries(3, 10); len(page) != 1 || page[0].Seq != 3 {
+		t.Errorf("got page %v, want entry 3 only", page)
+	}
+
+	v, err := store.Verify(context.Background(), 1, 0, ledger(map[string]string{"tx-1": ValidCode, "tx-2": "MVCC_READ_CONFLICT"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.BrokenAt != nil || v.Entries != 3 || v.Head != entries[2].Hash || v.Transactions != 2 || len(v.Discrepancies) != 0 {
+		t.Errorf("got verification %+v, want an intact chain of 3 entries", v)
+	}
+}
+
+func TestVerifyFindsDiscrepancies(t *testing.T) {
+	store := openTestStore(t)
+	appendTestEntries(t, store)
+
+	v, err := store.Verify(context.Background(), 1, 0, ledger(map[string]string{"tx-2": ValidCode}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Discrepancies) != 2 {
+		t.Fatalf("got discrepancies %v, want two", v.Discrepancies)
+	}
+	if d := v.Discrepancies[0]; d.Seq != 2 || d.Reason != "not on the ledger" {
+		t.Errorf("got %+v, want tx-1 missing from the ledger", d)
+	}
+	if d := v.Discrepancies[1]; d.Seq != 3 || d.Reason != "valid, but the call failed with status 409" {
+		t.Errorf("got %+v, want tx-2 valid despite the failed call", d)
+	}
+
+	// Only the transactions of the requested entries are looked up
+	v, err = store.Verify(context.Background(), 3, 3, ledger(map[string]string{"tx-2": "MVCC_READ_CONFLICT"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Transactions != 1 || len(v.Discrepancies) != 0 || v.Entries != 3 {
+		t.Errorf("got verification %+v, want only tx-2 checked", v)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	valid := ledger(map[string]string{"tx-1": ValidCode, "tx-2": "MVCC_READ_CONFLICT"})
+
+	store := openTestStore(t)
+	appendTestEntries(t, store)
+	if _, err := store.db.Exec("UPDATE audit_log SET identity = 'admin@org1' WHERE seq = 2"); err != nil {
+		t.Fatal(err)
+	}
+	v, err := store.Verify(context.Background(), 1, 0, valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.BrokenAt == nil || *v.BrokenAt != 2 {
+		t.Errorf("got broken at %v, want the changed entry 2", v.BrokenAt)
+	}
+
+	store = openTestStore(t)
+	appendTestEntries(t, store)
+	if _, err := store.db.Exec("DELETE FROM audit_log WHERE seq = 2"); err != nil {
+		t.Fatal(err)
+	}
+	v, err = store.Verify(context.Background(), 1, 0, valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.BrokenAt == nil || *v.BrokenAt != 2 {
+		t.Errorf("got broken at %v, want the removed entry 2", v.BrokenAt)
+	}
+}
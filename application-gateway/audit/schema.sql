@@ -0,0 +1,18 @@
+-- audit_log is the gateway's hash-chained audit log. Each entry's hash
+-- covers its fields and prev_hash, the hash of the entry before it.
+-- transaction_ids is a comma separated list of the transactions the call
+-- submitted.
+CREATE TABLE IF NOT EXISTS audit_log (
+    seq             INTEGER PRIMARY KEY,
+    at              TEXT NOT NULL,
+    identity        TEXT NOT NULL,
+    client          TEXT NOT NULL,
+    method          TEXT NOT NULL,
+    route           TEXT NOT NULL,
+    path            TEXT NOT NULL,
+    function        TEXT NOT NULL,
+    status          INTEGER NOT NULL,
+    transaction_ids TEXT NOT NULL,
+    prev_hash       TEXT NOT NULL,
+    hash            TEXT NOT NULL
+);
@@ -0,0 +1,261 @@
+// Package ca registers, enrolls, re-enrolls and revokes identities with a
+// Fabric CA through its REST API, storing the results as wallet identities.
+package ca
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"application-gateway/wallet"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+// Config locates the Fabric CA. TLSCertPath is the CA's TLS root
+// certificate; without it the system roots are trusted. Affiliation, if set,
+// is given to registered identities instead of the registrar's own.
+type Config struct {
+	URL         string
+	TLSCertPath string
+	CAName      string
+	Affiliation string
+}
+
+// Attribute is a certificate attribute of a registered identity
+type Attribute struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	ECert bool   `json:"ecert"`
+}
+
+// Client calls the Fabric CA as a registrar, an identity the CA allows to
+// register and revoke others. Enrolled identities belong to the registrar's
+// MSP.
+type Client struct {
+	config    Config
+	registrar *wallet.Identity
+	client    *http.Client
+}
+
+// New returns a client acting as registrar
+func New(config Config, registrar *wallet.Identity) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.TLSCertPath != "" {
+		certificatePEM, err := os.ReadFile(config.TLSCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA TLS certificate: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(certificatePEM) {
+			return nil, fmt.Errorf("no certificates in %s", config.TLSCertPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	return &Client{config: config, registrar: registrar, client: &http.Client{Transport: transport, Timeout: 30 * time.Second}}, nil
+}
+
+// response is the envelope of every Fabric CA response
+type response struct {
+	Success bool            `json:"success"`
+	Result  json.RawMessage `json:"result"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// Register registers a client identity with attributes and returns the
+// enrollment secret the CA generated for it
+func (c *Client) Register(id string, attributes []Attribute) (string, error) {
+	request := map[string]interface{}{
+		"id":              id,
+		"type":            "client",
+		"max_enrollments": 0,
+		"affiliation":     c.config.Affiliation,
+		"attrs":           attributes,
+		"caname":          c.config.CAName,
+	}
+	var result struct {
+		Secret string `json:"secret"`
+	}
+	if err := c.post("register", request, c.tokenAuth(c.registrar), &result); err != nil {
+		return "", err
+	}
+	return result.Secret, nil
+}
+
+// Enroll enrolls a registered identity with a new key and returns it as a
+// wallet identity under label
+func (c *Client) Enroll(label, id, secret string) (*wallet.Identity, error) {
+	return c.enroll("enroll", label, id, func(r *http.Request, _ []byte) error {
+		r.SetBasicAuth(id, secret)
+		return nil
+	})
+}
+
+// Reenroll issues a wallet identity a certificate for a new key,
+// authenticating with its current one. The current certificate stays valid
+// until it expires or is revoked.
+func (c *Client) Reenroll(current *wallet.Identity) (*wallet.Identity, error) {
+	certificate, err := identity.CertificateFromPEM([]byte(current.Certificate))
+	if err != nil {
+		return nil, err
+	}
+	return c.enroll("reenroll", current.Label, certificate.Subject.CommonName, c.tokenAuth(current))
+}
+
+func (c *Client) enroll(endpoint, label, id string, auth func(*http.Request, []byte) error) (*wallet.Identity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: id}}, key)
+	if err != nil {
+		return nil, err
+	}
+	request := map[string]interface{}{
+		"certificate_request": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+		"caname":              c.config.CAName,
+	}
+	var result struct {
+		Cert string `json:"Cert"`
+	}
+	if err := c.post(endpoint, request, auth, &result); err != nil {
+		return nil, err
+	}
+	certificate, err := base64.StdEncoding.DecodeString(result.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode enrolled certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &wallet.Identity{
+		Label:       label,
+		MSPID:       c.registrar.MSPID,
+		Certificate: string(certificate),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	}, nil
+}
+
+// RevokedCertificate identifies a revoked certificate by its serial number
+// and authority key identifier, in hex
+type RevokedCertificate struct {
+	Serial string `json:"serial"`
+	AKI    string `json:"aki"`
+}
+
+// Revocation is the outcome of a revocation: the certificates revoked and
+// the CA's updated certificate revocation list, PEM encoded
+type Revocation struct {
+	RevokedCerts []RevokedCertificate `json:"revokedCerts"`
+	CRL          string               `json:"crl"`
+}
+
+// Revoke revokes one certificate of an identity, given as PEM, or with no
+// certificate the identity itself and all of its certificates, so that it
+// can no longer enroll. reason is a CRL reason such as "keycompromise" or
+// "superseded".
+func (c *Client) Revoke(id, certificatePEM, reason string) (*Revocation, error) {
+	request := map[string]interface{}{
+		"id":     id,
+		"reason": reason,
+		"caname": c.config.CAName,
+		"gencrl": true,
+	}
+	if certificatePEM != "" {
+		certificate, err := identity.CertificateFromPEM([]byte(certificatePEM))
+		if err != nil {
+			return nil, err
+		}
+		request["serial"] = certificate.SerialNumber.Text(16)
+		request["aki"] = hex.EncodeToString(certificate.AuthorityKeyId)
+	}
+	var result Revocation
+	if err := c.post("revoke", request, c.tokenAuth(c.registrar), &result); err != nil {
+		return nil, err
+	}
+	revocation := &Revocation{RevokedCerts: result.RevokedCerts}
+	if result.CRL != "" {
+		// The CA returns the CRL as base64 DER
+		crl, err := base64.StdEncoding.DecodeString(result.CRL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode CRL: %w", err)
+		}
+		revocation.CRL = string(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}))
+	}
+	return revocation, nil
+}
+
+// tokenAuth authenticates a request as a wallet identity with the Fabric CA
+// token: the base64 certificate and, after a dot, the base64 ECDSA signature
+// of the method, request URI, body and certificate
+func (c *Client) tokenAuth(id *wallet.Identity) func(*http.Request, []byte) error {
+	return func(r *http.Request, body []byte) error {
+		_, sign, err := id.X509Identity()
+		if err != nil {
+			return err
+		}
+		b64 := base64.StdEncoding.EncodeToString
+		certificate := b64([]byte(id.Certificate))
+		payload := r.Method + "." + b64([]byte(r.URL.RequestURI())) + "." + b64(body) + "." + certificate
+		digest := sha256.Sum256([]byte(payload))
+		signature, err := sign(digest[:])
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Authorization", certificate+"."+b64(signature))
+		return nil
+	}
+}
+
+// post sends a request to an endpoint of the CA's API and decodes the
+// result of a successful response
+func (c *Client) post(endpoint string, request interface{}, auth func(*http.Request, []byte) error, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.config.URL+"/api/v1/"+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := auth(req, body); err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var envelope response
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("fabric CA %s returned %s", endpoint, resp.Status)
+	}
+	if !envelope.Success {
+		messages := make([]string, 0, len(envelope.Errors))
+		for _, e := range envelope.Errors {
+			messages = append(messages, fmt.Sprintf("%s (code %d)", e.Message, e.Code))
+		}
+		return fmt.Errorf("fabric CA %s failed: %s", endpoint, strings.Join(messages, "; "))
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
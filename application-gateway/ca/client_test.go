@@ -0,0 +1,287 @@
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"application-gateway/wallet"
+)
+
+// attributesOID is the certificate extension the Fabric CA writes
+// attributes to
+var attributesOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// fakeCA implements the register, enroll, reenroll and revoke endpoints of a
+// Fabric CA, checking the authentication of each request
+type fakeCA struct {
+	t           *testing.T
+	key         *ecdsa.PrivateKey
+	certificate *x509.Certificate
+	serial      int64
+	secrets     map[string]string
+	attributes  map[string][]Attribute
+	revoked     []map[string]interface{}
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca.org1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SubjectKeyId:          []byte{1, 2, 3, 4},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeCA{t: t, key: key, certificate: certificate, serial: 1, secrets: map[string]string{}, attributes: map[string][]Attribute{}}
+}
+
+// issue signs a certificate for a public key with the identity's attributes
+func (ca *fakeCA) issue(id string, publicKey interface{}) string {
+	attrs := map[string]string{}
+	for _, attribute := range ca.attributes[id] {
+		if attribute.ECert {
+			attrs[attribute.Name] = attribute.Value
+		}
+	}
+	attrsJSON, err := json.Marshal(map[string]interface{}{"attrs": attrs})
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(ca.serial),
+		Subject:         pkix.Name{CommonName: id},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: attributesOID, Value: attrsJSON}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, publicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// authenticate checks a token and returns the common name of its certificate
+func (ca *fakeCA) authenticate(r *http.Request, body []byte) (string, error) {
+	parts := strings.Split(r.Header.Get("Authorization"), ".")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed token")
+	}
+	certificatePEM, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil {
+		return "", fmt.Errorf("no certificate in token")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	b64 := base64.StdEncoding.EncodeToString
+	digest := sha256.Sum256([]byte(r.Method + "." + b64([]byte(r.URL.RequestURI())) + "." + b64(body) + "." + parts[0]))
+	if !ecdsa.VerifyASN1(certificate.PublicKey.(*ecdsa.PublicKey), digest[:], signature) {
+		return "", fmt.Errorf("token signature does not verify")
+	}
+	return certificate.Subject.CommonName, nil
+}
+
+func (ca *fakeCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	var request map[string]interface{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		ca.t.Fatal(err)
+	}
+	fail := func(err error) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []map[string]interface{}{{"code": 20, "message": err.Error()}}})
+	}
+	succeed := func(result interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": result})
+	}
+	enroll := func(id string) {
+		block, _ := pem.Decode([]byte(request["certificate_request"].(string)))
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if csr.Subject.CommonName != id {
+			fail(fmt.Errorf("CSR is for %s, not %s", csr.Subject.CommonName, id))
+			return
+		}
+		succeed(map[string]string{"Cert": base64.StdEncoding.EncodeToString([]byte(ca.issue(id, csr.PublicKey)))})
+	}
+
+	switch r.URL.Path {
+	case "/api/v1/register":
+		if caller, err := ca.authenticate(r, body); err != nil || caller != "admin" {
+			fail(fmt.Errorf("registrar authentication failed"))
+			return
+		}
+		id := request["id"].(string)
+		attributesJSON, _ := json.Marshal(request["attrs"])
+		var attributes []Attribute
+		json.Unmarshal(attributesJSON, &attributes)
+		ca.attributes[id] = attributes
+		ca.secrets[id] = "secret-" + id
+		succeed(map[string]string{"secret": ca.secrets[id]})
+	case "/api/v1/enroll":
+		id, secret, ok := r.BasicAuth()
+		if !ok || ca.secrets[id] == "" || ca.secrets[id] != secret {
+			fail(fmt.Errorf("enrollment authentication failed"))
+			return
+		}
+		enroll(id)
+	case "/api/v1/reenroll":
+		id, err := ca.authenticate(r, body)
+		if err != nil {
+			fail(err)
+			return
+		}
+		enroll(id)
+	case "/api/v1/revoke":
+		if caller, err := ca.authenticate(r, body); err != nil || caller != "admin" {
+			fail(fmt.Errorf("registrar authentication failed"))
+			return
+		}
+		ca.revoked = append(ca.revoked, request)
+		crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{Number: big.NewInt(int64(len(ca.revoked))), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}, ca.certificate, ca.key)
+		if err != nil {
+			ca.t.Fatal(err)
+		}
+		succeed(map[string]interface{}{
+			"RevokedCerts": []map[string]interface{}{{"Serial": request["serial"], "AKI": request["aki"]}},
+			"CRL":          base64.StdEncoding.EncodeToString(crl),
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// registrar returns the CA's bootstrap admin as a wallet identity
+func (ca *fakeCA) registrar() *wallet.Identity {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return &wallet.Identity{
+		Label:       "admin@org1",
+		MSPID:       "Org1MSP",
+		Certificate: ca.issue("admin", &key.PublicKey),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func TestEnrollReenrollAndRevoke(t *testing.T) {
+	fake := newFakeCA(t)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	c, err := New(Config{URL: server.URL + "/"}, fake.registrar())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := c.Register("alice", []Attribute{
+		{Name: wallet.RoleAttribute, Value: "prosumer", ECert: true},
+		{Name: wallet.AddressAttribute, Value: "alice-address", ECert: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Enroll("alice@org1", "alice", "wrong"); err == nil || !strings.Contains(err.Error(), "enrollment authentication failed (code 20)") {
+		t.Fatalf("expected a wrong secret to be rejected, got %v", err)
+	}
+	id, err := c.Enroll("alice@org1", "alice", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Label != "alice@org1" || id.MSPID != "Org1MSP" {
+		t.Errorf("unexpected identity %s of %s", id.Label, id.MSPID)
+	}
+	if address, err := id.Address(); err != nil || address != "alice-address" {
+		t.Errorf("expected the address attribute, got %q, %v", address, err)
+	}
+	if _, _, err := id.X509Identity(); err != nil {
+		t.Fatalf("enrolled key does not load: %v", err)
+	}
+
+	rotated, err := c.Reenroll(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Certificate == id.Certificate || rotated.PrivateKey == id.PrivateKey {
+		t.Error("expected a new key and certificate")
+	}
+	if address, err := rotated.Address(); err != nil || address != "alice-address" {
+		t.Errorf("expected the address to survive re-enrollment, got %q, %v", address, err)
+	}
+
+	revocation, err := c.Revoke("alice", id.Certificate, "superseded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := fake.revoked[0]
+	if request["id"] != "alice" || request["reason"] != "superseded" || request["serial"] != "3" || request["aki"] != "01020304" || request["gencrl"] != true {
+		t.Errorf("unexpected revocation request %v", request)
+	}
+	if len(revocation.RevokedCerts) != 1 || revocation.RevokedCerts[0].Serial != "3" {
+		t.Errorf("unexpected revoked certificates %+v", revocation.RevokedCerts)
+	}
+	block, _ := pem.Decode([]byte(revocation.CRL))
+	if block == nil || block.Type != "X509 CRL" {
+		t.Fatalf("expected a PEM CRL, got %q", revocation.CRL)
+	}
+	if _, err := x509.ParseRevocationList(block.Bytes); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Revoke("alice", "", "keycompromise"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.revoked[1]["serial"]; ok {
+		t.Error("expected revoking the identity to name no certificate")
+	}
+}
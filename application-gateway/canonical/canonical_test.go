@@ -0,0 +1,19 @@
+package canonical
+
+import "testing"
+
+func TestMarshal(t *testing.T) {
+	payload, err := Marshal(struct {
+		MeterID       string  `json:"meterID"`
+		IntervalStart string  `json:"intervalStart"`
+		KWhInjected   float64 `json:"kWhInjected"`
+		KWhConsumed   float64 `json:"kWhConsumed"`
+	}{"meter-<1>", "2025-05-03T10:00:00Z", 1e-7, 2.5e21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"intervalStart":"2025-05-03T10:00:00Z","kWhConsumed":2500000000000000000000,"kWhInjected":0.0000001,"meterID":"meter-<1>"}`
+	if string(payload) != want {
+		t.Fatalf("got %s, want %s", payload, want)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"application-gateway/fabric"
+	"application-gateway/wallet"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+func newTradeCommand(opts *options) *cobra.Command {
+	trade := &cobra.Command{Use: "trade", Short: "Create, inspect and settle trades"}
+
+	var price, buyerDeposit, sellerDeposit float64
+	var salt string
+	create := &cobra.Command{
+		Use:   "create <tokenID> <buyer> <seller> <kWh> <deliveryStart> <deliveryEnd> <sourceType>",
+		Short: "Create a trade; the price and deposits are sent privately",
+		Args:  cobra.ExactArgs(7),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := strconv.ParseFloat(args[3], 64); err != nil {
+				return fmt.Errorf("invalid energy amount %q", args[3])
+			}
+			if salt == "" {
+				random := make([]byte, 16)
+				if _, err := rand.Read(random); err != nil {
+					return err
+				}
+				salt = hex.EncodeToString(random)
+			}
+			private, err := json.Marshal(map[string]interface{}{
+				"transactionPrice": price,
+				"buyerDeposit":     buyerDeposit,
+				"sellerDeposit":    sellerDeposit,
+				"salt":             salt,
+			})
+			if err != nil {
+				return err
+			}
+			return opts.submit(cmd.OutOrStdout(), "CreateEnergyAsset", args, map[string][]byte{"trade_private": private})
+		},
+	}
+	create.Flags().Float64Var(&price, "price", 0, "price per kWh")
+	create.Flags().Float64Var(&buyerDeposit, "buyer-deposit", 0, "buyer deposit")
+	create.Flags().Float64Var(&sellerDeposit, "seller-deposit", 0, "seller deposit")
+	create.Flags().StringVar(&salt, "salt", "", "salt for the private details hash (random if empty)")
+	create.MarkFlagRequired("price")
+
+	get := &cobra.Command{
+		Use:   "get <tokenID>",
+		Short: "Show a trade",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.evaluate(cmd.OutOrStdout(), "ReadEnergyAsset", args...)
+		},
+	}
+
+	var from, to, bookmark string
+	var pageSize int32
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List live trades whose delivery starts in [from, to)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.evaluate(cmd.OutOrStdout(), "GetTradesByDeliveryWindow", from, to, strconv.Itoa(int(pageSize)), bookmark)
+		},
+	}
+	list.Flags().StringVar(&from, "from", "", "window start (RFC3339)")
+	list.Flags().StringVar(&to, "to", "", "window end (RFC3339)")
+	list.Flags().Int32Var(&pageSize, "page-size", 50, "page size")
+	list.Flags().StringVar(&bookmark, "bookmark", "", "bookmark from the previous page")
+	list.MarkFlagRequired("from")
+	list.MarkFlagRequired("to")
+
+	var signVersion int64
+	sign := &cobra.Command{
+		Use:   "sign <tokenID> <signatureBase64>",
+		Short: "Submit a party's signature over the trade terms",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.submit(cmd.OutOrStdout(), "SignEnergyAsset", append(args, strconv.FormatInt(signVersion, 10)), nil)
+		},
+	}
+	sign.Flags().Int64Var(&signVersion, "expected-version", 0, "fail unless the trade is at this version (0 skips the check)")
+
+	payload := &cobra.Command{
+		Use:   "payload <tokenID>",
+		Short: "Print the exact bytes a party signs",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.evaluate(cmd.OutOrStdout(), "GetSigningPayload", args...)
+		},
+	}
+
+	var deliverVersion int64
+	deliver := &cobra.Command{
+		Use:   "deliver <tokenID>",
+		Short: "Confirm delivery as the seller",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.submit(cmd.OutOrStdout(), "ConfirmDelivery", append(args, strconv.FormatInt(deliverVersion, 10)), nil)
+		},
+	}
+	deliver.Flags().Int64Var(&deliverVersion, "expected-version", 0, "fail unless the trade is at this version (0 skips the check)")
+
+	settle := &cobra.Command{
+		Use:   "settle <tokenID>",
+		Short: "Settle a trade from reconciled meter data",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.submit(cmd.OutOrStdout(), "ReconcileDelivery", args, nil)
+		},
+	}
+
+	trade.AddCommand(create, get, list, sign, payload, deliver, settle)
+	return trade
+}
+
+func newAccountCommand(opts *options) *cobra.Command {
+	account := &cobra.Command{Use: "account", Short: "Inspect and move token balances"}
+
+	balance := &cobra.Command{
+		Use:   "balance <accountID>",
+		Short: "Show an account balance",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.evaluate(cmd.OutOrStdout(), "ReadTokenAccount", args...)
+		},
+	}
+
+	var transferVersion int64
+	transfer := &cobra.Command{
+		Use:   "transfer <to> <amount>",
+		Short: "Transfer tokens from the caller's account",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.submit(cmd.OutOrStdout(), "TransferTokens", append(args, strconv.FormatInt(transferVersion, 10)), nil)
+		},
+	}
+	transfer.Flags().Int64Var(&transferVersion, "expected-version", 0, "fail unless the caller's account is at this version (0 skips the check)")
+
+	mint := &cobra.Command{
+		Use:   "mint <accountID> <amount>",
+		Short: "Mint tokens into an account (admin)",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.submit(cmd.OutOrStdout(), "MintTokens", args, nil)
+		},
+	}
+
+	account.AddCommand(balance, transfer, mint)
+	return account
+}
+
+// depthLevel is the open volume at one price on one side of an order book
+type depthLevel struct {
+	price  float64
+	volume float64
+	orders int
+}
+
+// depthBook collects open orders into price levels
+type depthBook struct {
+	bids   map[float64]*depthLevel
+	offers map[float64]*depthLevel
+}
+
+func newDepthBook() *depthBook {
+	return &depthBook{bids: map[float64]*depthLevel{}, offers: map[float64]*depthLevel{}}
+}
+
+func (b *depthBook) add(side string, price, volume float64) {
+	levels := b.offers
+	if side == "BID" {
+		levels = b.bids
+	}
+	level, ok := levels[price]
+	if !ok {
+		level = &depthLevel{price: price}
+		levels[price] = level
+	}
+	level.volume += volume
+	level.orders++
+}
+
+// print writes the bids, highest first, and the offers, lowest first, with
+// the volume available at each price or better
+func (b *depthBook) print(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "SIDE\tPRICE\tVOLUME\tCUMULATIVE\tORDERS\t")
+	for _, side := range []struct {
+		name   string
+		levels map[float64]*depthLevel
+		better func(a, b float64) bool
+	}{
+		{"BID", b.bids, func(a, b float64) bool { return a > b }},
+		{"OFFER", b.offers, func(a, b float64) bool { return a < b }},
+	} {
+		levels := make([]*depthLevel, 0, len(side.levels))
+		for _, level := range side.levels {
+			levels = append(levels, level)
+		}
+		sort.Slice(levels, func(i, j int) bool { return side.better(levels[i].price, levels[j].price) })
+		var cumulative float64
+		for _, level := range levels {
+			cumulative += level.volume
+			fmt.Fprintf(w, "%s\t%g\t%g\t%g\t%d\t\n", side.name, level.price, level.volume, cumulative, level.orders)
+		}
+	}
+	return w.Flush()
+}
+
+// evaluatePages runs a paginated query, whose last two arguments are the
+// page size and bookmark, and passes the records of every page to add
+func evaluatePages(contract *client.Contract, pageSize int32, function string, args []string, add func(records json.RawMessage) error) error {
+	bookmark := ""
+	for {
+		result, err := contract.EvaluateTransaction(function, append(args, strconv.Itoa(int(pageSize)), bookmark)...)
+		if err != nil {
+			return fabric.ErrorWithDetails(err)
+		}
+		var page struct {
+			Records  json.RawMessage `json:"records"`
+			Bookmark string          `json:"bookmark"`
+		}
+		if err := json.Unmarshal(result, &page); err != nil {
+			return err
+		}
+		if err := add(page.Records); err != nil {
+			return err
+		}
+		if page.Bookmark == "" {
+			return nil
+		}
+		bookmark = page.Bookmark
+	}
+}
+
+func newMarketCommand(opts *options) *cobra.Command {
+	market := &cobra.Command{Use: "market", Short: "Inspect the order books"}
+
+	var pageSize int32
+	depth := &cobra.Command{Use: "depth", Short: "Show the open volume at each price of an order book"}
+	depth.PersistentFlags().Int32Var(&pageSize, "page-size", 100, "orders fetched per query")
+
+	certificates := &cobra.Command{
+		Use:   "certificates",
+		Short: "Depth of the certificate market, in certificates",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			book := newDepthBook()
+			err := opts.withContract(func(contract *client.Contract) error {
+				for _, side := range []string{"BID", "OFFER"} {
+					err := evaluatePages(contract, pageSize, "GetOpenCertificateOrders", []string{side}, func(records json.RawMessage) error {
+						var orders []struct {
+							Quantity int     `json:"quantity"`
+							Filled   int     `json:"filled"`
+							Price    float64 `json:"price"`
+						}
+						if err := json.Unmarshal(records, &orders); err != nil {
+							return err
+						}
+						for _, order := range orders {
+							book.add(side, order.Price, float64(order.Quantity-order.Filled))
+						}
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return book.print(cmd.OutOrStdout())
+		},
+	}
+
+	var zone string
+	energy := &cobra.Command{
+		Use:   "energy <intervalStart>",
+		Short: "Depth of the community orders of an interval, in kWh",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			book := newDepthBook()
+			err := opts.withContract(func(contract *client.Contract) error {
+				return evaluatePages(contract, pageSize, "GetOpenCommunityOrders", []string{args[0], zone}, func(records json.RawMessage) error {
+					var orders []struct {
+						Side       string  `json:"side"`
+						Energy     float64 `json:"energy"`
+						Filled     float64 `json:"filled"`
+						LimitPrice float64 `json:"limitPrice"`
+					}
+					if err := json.Unmarshal(records, &orders); err != nil {
+						return err
+					}
+					for _, order := range orders {
+						book.add(order.Side, order.LimitPrice, order.Energy-order.Filled)
+					}
+					return nil
+				})
+			})
+			if err != nil {
+				return err
+			}
+			return book.print(cmd.OutOrStdout())
+		},
+	}
+	energy.Flags().StringVar(&zone, "zone", "", "community whose orders to show (all if empty)")
+
+	depth.AddCommand(certificates, energy)
+	market.AddCommand(depth)
+	return market
+}
+
+func newReputationCommand(opts *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "reputation <address>",
+		Short: "Show a participant's reputation score",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.evaluate(cmd.OutOrStdout(), "ReadReputationScore", args...)
+		},
+	}
+}
+
+func newWalletCommand(opts *options) *cobra.Command {
+	walletCmd := &cobra.Command{Use: "wallet", Short: "Manage wallet identities"}
+
+	importCmd := &cobra.Command{
+		Use:   "import <label> <mspID> <certPath> <keystoreDir>",
+		Short: "Import a certificate and private key",
+		Args:  cobra.ExactArgs(4),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			w, err := wallet.New(opts.walletPath)
+			if err != nil {
+				return err
+			}
+			return w.Import(args[0], args[1], args[2], args[3])
+		},
+	}
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List wallet identities",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			w, err := wallet.New(opts.walletPath)
+			if err != nil {
+				return err
+			}
+			labels, err := w.List()
+			if err != nil {
+				return err
+			}
+			for _, label := range labels {
+				fmt.Fprintln(cmd.OutOrStdout(), label)
+			}
+			return nil
+		},
+	}
+
+	walletCmd.AddCommand(importCmd, list)
+	return walletCmd
+}
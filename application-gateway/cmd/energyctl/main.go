@@ -0,0 +1,13 @@
+// Command energyctl drives the energy trading chaincode from the shell through
+// the Fabric Gateway, using identities from the gateway service's wallet.
+package main
+
+import (
+	"os"
+)
+
+func main() {
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
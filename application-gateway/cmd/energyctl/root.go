@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"application-gateway/fabric"
+	"application-gateway/wallet"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+const cryptoPath = "../../test-network/organizations/peerOrganizations/org1.example.com"
+
+// options are the global flags shared by every subcommand
+type options struct {
+	peer           fabric.PeerConfig
+	channelName    string
+	chaincodeName  string
+	walletPath     string
+	identity       string
+	idempotencyKey string
+}
+
+func newRootCommand() *cobra.Command {
+	opts := &options{}
+	root := &cobra.Command{
+		Use:          "energyctl",
+		Short:        "Operate the P2P energy trading chaincode",
+		SilenceUsage: true,
+	}
+	flags := root.PersistentFlags()
+	flags.StringVar(&opts.peer.PeerEndpoint, "peer-endpoint", envOr("PEER_ENDPOINT", "localhost:7051"), "gateway peer endpoint")
+	flags.StringVar(&opts.peer.GatewayPeer, "gateway-peer", envOr("GATEWAY_PEER", "peer0.org1.example.com"), "gateway peer TLS host name")
+	flags.StringVar(&opts.peer.TLSCertPath, "tls-cert", envOr("TLS_CERT_PATH", cryptoPath+"/peers/peer0.org1.example.com/tls/ca.crt"), "gateway peer TLS CA certificate")
+	flags.StringVar(&opts.channelName, "channel", envOr("CHANNEL_NAME", "mychannel"), "channel name")
+	flags.StringVar(&opts.chaincodeName, "chaincode", envOr("CHAINCODE_NAME", "energy"), "chaincode name")
+	flags.StringVar(&opts.walletPath, "wallet", envOr("WALLET_PATH", "identities"), "wallet directory")
+	flags.StringVarP(&opts.identity, "identity", "i", os.Getenv("DEFAULT_IDENTITY"), "wallet identity to act as")
+	flags.StringVar(&opts.idempotencyKey, "idempotency-key", "", "key that makes a retried submission fail instead of running twice")
+
+	root.AddCommand(
+		newTradeCommand(opts),
+		newAccountCommand(opts),
+		newMarketCommand(opts),
+		newReputationCommand(opts),
+		newWalletCommand(opts),
+	)
+	return root
+}
+
+// withContract connects as the selected identity and runs fn against the chaincode
+func (opts *options) withContract(fn func(*client.Contract) error) error {
+	if opts.identity == "" {
+		return fmt.Errorf("--identity is required")
+	}
+	w, err := wallet.New(opts.walletPath)
+	if err != nil {
+		return err
+	}
+	id, err := w.Get(opts.identity)
+	if err != nil {
+		return err
+	}
+	connection, err := fabric.NewGrpcConnection(opts.peer)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	gateway, err := fabric.Connect(connection, id)
+	if err != nil {
+		return err
+	}
+	defer gateway.Close()
+	return fn(gateway.GetNetwork(opts.channelName).GetContract(opts.chaincodeName))
+}
+
+// evaluate runs a query and prints its result
+func (opts *options) evaluate(out io.Writer, function string, args ...string) error {
+	return opts.withContract(func(contract *client.Contract) error {
+		result, err := contract.EvaluateTransaction(function, args...)
+		if err != nil {
+			return fabric.ErrorWithDetails(err)
+		}
+		return printResult(out, result)
+	})
+}
+
+// submit submits a transaction, waits for it to commit and prints its result
+func (opts *options) submit(out io.Writer, function string, args []string, transient map[string][]byte) error {
+	return opts.withContract(func(contract *client.Contract) error {
+		proposalOptions := []client.ProposalOption{client.WithArguments(args...)}
+		transient = fabric.WithIdempotencyKey(transient, opts.idempotencyKey)
+		if transient != nil {
+			proposalOptions = append(proposalOptions, client.WithTransient(transient))
+		}
+		result, commit, err := contract.SubmitAsync(function, proposalOptions...)
+		if err != nil {
+			return fabric.ErrorWithDetails(err)
+		}
+		status, err := commit.Status()
+		if err != nil {
+			return fabric.ErrorWithDetails(err)
+		}
+		if !status.Successful {
+			return fmt.Errorf("transaction %s failed to commit with status %d", status.TransactionID, int32(status.Code))
+		}
+		if len(result) == 0 {
+			fmt.Fprintf(out, "committed %s\n", status.TransactionID)
+			return nil
+		}
+		return printResult(out, result)
+	})
+}
+
+// printResult pretty-prints JSON results and prints anything else as is
+func printResult(out io.Writer, result []byte) error {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, result, "", "  "); err != nil {
+		_, err = fmt.Fprintln(out, string(result))
+		return err
+	}
+	_, err := fmt.Fprintln(out, indented.String())
+	return err
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,73 @@
+// Command forecaster publishes day-ahead clearing price forecasts on-chain,
+// trained on the prices the indexer has recorded.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"application-gateway/fabric"
+	"application-gateway/forecast"
+	"application-gateway/metrics"
+	"application-gateway/wallet"
+)
+
+const cryptoPath = "../../test-network/organizations/peerOrganizations/org1.example.com"
+
+func main() {
+	w, err := wallet.New(envOr("WALLET_PATH", "identities"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if library := os.Getenv("HSM_LIBRARY"); library != "" {
+		if err := w.UseHSM(wallet.HSMConfig{Library: library, Pin: os.Getenv("HSM_PIN")}); err != nil {
+			log.Fatal(err)
+		}
+		defer w.Close()
+	}
+	id, err := w.Get(envOr("FORECASTER_IDENTITY", "oracle"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	connection, err := fabric.NewGrpcConnection(fabric.PeerConfig{
+		PeerEndpoint: envOr("PEER_ENDPOINT", "localhost:7051"),
+		GatewayPeer:  envOr("GATEWAY_PEER", "peer0.org1.example.com"),
+		TLSCertPath:  envOr("TLS_CERT_PATH", cryptoPath+"/peers/peer0.org1.example.com/tls/ca.crt"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connection.Close()
+	gateway, err := fabric.Connect(connection, id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer gateway.Close()
+	contract := gateway.GetNetwork(envOr("CHANNEL_NAME", "mychannel")).GetContract(envOr("CHAINCODE_NAME", "energy"))
+
+	if address := os.Getenv("METRICS_ADDRESS"); address != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(address, metrics.Handler()))
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	indexerURL := envOr("INDEXER_URL", "http://localhost:3001")
+	forecaster := forecast.New(contract, indexerURL, forecast.DefaultConfig())
+	log.Printf("Forecasting from the clearing prices of %s", indexerURL)
+	if err := forecaster.Run(ctx); err != nil && ctx.Err() == nil {
+		log.Fatalf("Forecaster stopped: %v", err)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
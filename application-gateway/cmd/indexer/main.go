@@ -0,0 +1,76 @@
+// Command indexer follows the energy trading chaincode's events into a SQLite
+// database and serves historical queries over HTTP.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"application-gateway/fabric"
+	"application-gateway/indexer"
+	"application-gateway/wallet"
+)
+
+const cryptoPath = "../../test-network/organizations/peerOrganizations/org1.example.com"
+
+func main() {
+	store, err := indexer.Open(envOr("INDEX_DATABASE", "index.db"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	w, err := wallet.New(envOr("WALLET_PATH", "identities"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	id, err := w.Get(envOr("INDEXER_IDENTITY", "indexer"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	connection, err := fabric.NewGrpcConnection(fabric.PeerConfig{
+		PeerEndpoint: envOr("PEER_ENDPOINT", "localhost:7051"),
+		GatewayPeer:  envOr("GATEWAY_PEER", "peer0.org1.example.com"),
+		TLSCertPath:  envOr("TLS_CERT_PATH", cryptoPath+"/peers/peer0.org1.example.com/tls/ca.crt"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connection.Close()
+	gateway, err := fabric.Connect(connection, id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer gateway.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	listener := indexer.NewListener(store, gateway.GetNetwork(envOr("CHANNEL_NAME", "mychannel")), envOr("CHAINCODE_NAME", "energy"))
+	go func() {
+		if err := listener.Run(ctx); err != nil && ctx.Err() == nil {
+			log.Fatalf("Event listener stopped: %v", err)
+		}
+	}()
+
+	address := envOr("LISTEN_ADDRESS", ":3001")
+	server := &http.Server{Addr: address, Handler: indexer.Handler(store)}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("Listening on %s", address)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,91 @@
+// Command meterbridge subscribes to the readings smart meters and their
+// gateways publish over MQTT and submits them to the chaincode, signing
+// those of meters that cannot sign themselves.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"application-gateway/fabric"
+	"application-gateway/meterbridge"
+	"application-gateway/metrics"
+	"application-gateway/wallet"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const cryptoPath = "../../test-network/organizations/peerOrganizations/org1.example.com"
+
+func main() {
+	w, err := wallet.New(envOr("WALLET_PATH", "identities"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	id, err := w.Get(envOr("BRIDGE_IDENTITY", "operator"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys, err := meterbridge.LoadKeys(os.Getenv("METER_KEYS_DIR"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	connection, err := fabric.NewGrpcConnection(fabric.PeerConfig{
+		PeerEndpoint: envOr("PEER_ENDPOINT", "localhost:7051"),
+		GatewayPeer:  envOr("GATEWAY_PEER", "peer0.org1.example.com"),
+		TLSCertPath:  envOr("TLS_CERT_PATH", cryptoPath+"/peers/peer0.org1.example.com/tls/ca.crt"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connection.Close()
+	gateway, err := fabric.Connect(connection, id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer gateway.Close()
+	contract := gateway.GetNetwork(envOr("CHANNEL_NAME", "mychannel")).GetContract(envOr("CHAINCODE_NAME", "energy"))
+
+	if address := os.Getenv("METRICS_ADDRESS"); address != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(address, metrics.Handler()))
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	bridge := meterbridge.New(contract, meterbridge.DefaultConfig(), keys)
+
+	topic := envOr("MQTT_TOPIC", meterbridge.DefaultTopic)
+	options := meterbridge.ClientOptions(mqtt.NewClientOptions()).
+		AddBroker(envOr("MQTT_BROKER", "tcp://localhost:1883")).
+		SetClientID(envOr("MQTT_CLIENT_ID", "meterbridge")).
+		SetUsername(os.Getenv("MQTT_USERNAME")).
+		SetPassword(os.Getenv("MQTT_PASSWORD")).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// QoS 1, so that the broker redelivers readings that were not acknowledged
+			if token := client.Subscribe(topic, 1, bridge.Handler(ctx, topic)); token.Wait() && token.Error() != nil {
+				log.Printf("Failed to subscribe to %s: %v", topic, token.Error())
+			}
+		})
+	client := mqtt.NewClient(options)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatal(token.Error())
+	}
+	defer client.Disconnect(1000)
+
+	log.Printf("Relaying readings from %s with %d meter keys", topic, len(keys))
+	if err := bridge.Run(ctx); err != nil && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
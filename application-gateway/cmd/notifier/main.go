@@ -0,0 +1,104 @@
+// Command notifier sends users push, email and webhook notifications about
+// the chaincode events that concern them.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/signal"
+
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+	"application-gateway/notify"
+	"application-gateway/push"
+	"application-gateway/wallet"
+)
+
+const cryptoPath = "../../test-network/organizations/peerOrganizations/org1.example.com"
+
+func main() {
+	w, err := wallet.New(envOr("WALLET_PATH", "identities"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	id, err := w.Get(envOr("NOTIFIER_IDENTITY", "operator"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := notify.Open(envOr("GATEWAY_DB_PATH", "gateway.db"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	senders := map[string]notify.Sender{
+		notify.ChannelWebhook: &notify.WebhookSender{},
+		notify.ChannelPush:    &notify.PushSender{URL: envOr("PUSH_URL", notify.ExpoPushURL), AccessToken: os.Getenv("PUSH_ACCESS_TOKEN")},
+	}
+	if address := os.Getenv("SMTP_ADDRESS"); address != "" {
+		email := &notify.EmailSender{Address: address, From: envOr("SMTP_FROM", "notifications@localhost")}
+		if username := os.Getenv("SMTP_USERNAME"); username != "" {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				log.Fatal(err)
+			}
+			email.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		senders[notify.ChannelEmail] = email
+	}
+
+	connection, err := fabric.NewGrpcConnection(fabric.PeerConfig{
+		PeerEndpoint: envOr("PEER_ENDPOINT", "localhost:7051"),
+		GatewayPeer:  envOr("GATEWAY_PEER", "peer0.org1.example.com"),
+		TLSCertPath:  envOr("TLS_CERT_PATH", cryptoPath+"/peers/peer0.org1.example.com/tls/ca.crt"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connection.Close()
+	gateway, err := fabric.Connect(connection, id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer gateway.Close()
+	chaincodeName := envOr("CHAINCODE_NAME", "energy")
+	network := gateway.GetNetwork(envOr("CHANNEL_NAME", "mychannel"))
+	contract := network.GetContract(chaincodeName)
+	lookup := func(tokenID string) (*push.TradeInfo, error) {
+		assetJSON, err := contract.EvaluateTransaction("ReadEnergyAsset", tokenID)
+		if err != nil {
+			return nil, fabric.ErrorWithDetails(err)
+		}
+		var trade push.TradeInfo
+		if err := json.Unmarshal(assetJSON, &trade); err != nil {
+			return nil, err
+		}
+		return &trade, nil
+	}
+
+	if address := os.Getenv("METRICS_ADDRESS"); address != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(address, metrics.Handler()))
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	notifier := notify.New(store, lookup, senders, notify.DefaultConfig())
+	log.Printf("Notifying events of chaincode %s", chaincodeName)
+	if err := notifier.Run(ctx, network, chaincodeName); err != nil && ctx.Err() == nil {
+		log.Fatalf("Notifier stopped: %v", err)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
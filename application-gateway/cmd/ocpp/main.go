@@ -0,0 +1,94 @@
+// Command ocpp is an OCPP 1.6J central system that lets public EV chargers
+// with stock firmware serve the market's charging sessions.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"application-gateway/fabric"
+	"application-gateway/meterbridge"
+	"application-gateway/metrics"
+	"application-gateway/ocpp"
+	"application-gateway/wallet"
+)
+
+const cryptoPath = "../../test-network/organizations/peerOrganizations/org1.example.com"
+
+func main() {
+	w, err := wallet.New(envOr("WALLET_PATH", "identities"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	id, err := w.Get(envOr("OCPP_IDENTITY", "cpo"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys, err := meterbridge.LoadKeys(os.Getenv("METER_KEYS_DIR"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	state, err := ocpp.LoadState(envOr("OCPP_STATE_PATH", "ocpp-state.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var passwords map[string]string
+	if path := os.Getenv("OCPP_PASSWORDS_PATH"); path != "" {
+		passwordsJSON, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(passwordsJSON, &passwords); err != nil {
+			log.Fatalf("failed to parse %s: %v", path, err)
+		}
+	}
+
+	connection, err := fabric.NewGrpcConnection(fabric.PeerConfig{
+		PeerEndpoint: envOr("PEER_ENDPOINT", "localhost:7051"),
+		GatewayPeer:  envOr("GATEWAY_PEER", "peer0.org1.example.com"),
+		TLSCertPath:  envOr("TLS_CERT_PATH", cryptoPath+"/peers/peer0.org1.example.com/tls/ca.crt"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connection.Close()
+	gateway, err := fabric.Connect(connection, id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer gateway.Close()
+	contract := gateway.GetNetwork(envOr("CHANNEL_NAME", "mychannel")).GetContract(envOr("CHAINCODE_NAME", "energy"))
+
+	if address := os.Getenv("METRICS_ADDRESS"); address != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(address, metrics.Handler()))
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	adapter := ocpp.New(contract, ocpp.DefaultConfig(), state, keys, passwords)
+	go adapter.Run(ctx)
+
+	address := envOr("LISTEN_ADDRESS", ":9220")
+	server := &http.Server{Addr: address, Handler: adapter.Handler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("Listening for chargers on %s", address)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
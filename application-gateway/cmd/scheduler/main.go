@@ -0,0 +1,77 @@
+// Command scheduler settles due trades after every meter interval. Run one
+// instance per organization; the instances elect a leader through an
+// on-chain lease.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+	"application-gateway/scheduler"
+	"application-gateway/wallet"
+)
+
+const cryptoPath = "../../test-network/organizations/peerOrganizations/org1.example.com"
+
+func main() {
+	w, err := wallet.New(envOr("WALLET_PATH", "identities"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if library := os.Getenv("HSM_LIBRARY"); library != "" {
+		if err := w.UseHSM(wallet.HSMConfig{Library: library, Pin: os.Getenv("HSM_PIN")}); err != nil {
+			log.Fatal(err)
+		}
+		defer w.Close()
+	}
+	id, err := w.Get(envOr("SCHEDULER_IDENTITY", "operator"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	connection, err := fabric.NewGrpcConnection(fabric.PeerConfig{
+		PeerEndpoint: envOr("PEER_ENDPOINT", "localhost:7051"),
+		GatewayPeer:  envOr("GATEWAY_PEER", "peer0.org1.example.com"),
+		TLSCertPath:  envOr("TLS_CERT_PATH", cryptoPath+"/peers/peer0.org1.example.com/tls/ca.crt"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connection.Close()
+	gateway, err := fabric.Connect(connection, id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer gateway.Close()
+	contract := gateway.GetNetwork(envOr("CHANNEL_NAME", "mychannel")).GetContract(envOr("CHAINCODE_NAME", "energy"))
+
+	holder, err := os.Hostname()
+	if err != nil {
+		log.Fatal(err)
+	}
+	holder = envOr("SCHEDULER_HOLDER", holder)
+
+	if address := os.Getenv("METRICS_ADDRESS"); address != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(address, metrics.Handler()))
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	log.Printf("Scheduler %s started", holder)
+	if err := scheduler.New(contract, scheduler.DefaultConfig(holder)).Run(ctx); err != nil && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
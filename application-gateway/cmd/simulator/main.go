@@ -0,0 +1,119 @@
+// Command simulator runs virtual prosumers against a test network and reports
+// throughput and failure rates per chaincode function.
+//
+// Each prosumer acts through its own wallet identity, labelled with the
+// prefix and its number, which must carry the prosumer role.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"application-gateway/fabric"
+	"application-gateway/simulator"
+	"application-gateway/wallet"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"google.golang.org/grpc"
+)
+
+const cryptoPath = "../../test-network/organizations/peerOrganizations/org1.example.com"
+
+func main() {
+	prosumers := flag.Int("prosumers", 10, "number of virtual prosumers")
+	prefix := flag.String("prefix", "sim", "wallet label prefix of the prosumer identities")
+	adminLabel := flag.String("admin", "admin", "wallet label of an admin identity")
+	oracleLabel := flag.String("oracle", "oracle", "wallet label of an oracle identity")
+	rounds := flag.Int("rounds", 4, "trading rounds, one per meter interval")
+	concurrency := flag.Int("concurrency", 8, "invocations in flight")
+	statePath := flag.String("state", "simulator-state.json", "file keeping the prosumers' keys between runs")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random seed for profiles and meter noise")
+	profileOffset := flag.Duration("profile-offset", 0, "shift of the profile clock, e.g. 12h to simulate midday at midnight")
+	flag.Parse()
+
+	w, err := wallet.New(envOr("WALLET_PATH", "identities"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	connection, err := fabric.NewGrpcConnection(fabric.PeerConfig{
+		PeerEndpoint: envOr("PEER_ENDPOINT", "localhost:7051"),
+		GatewayPeer:  envOr("GATEWAY_PEER", "peer0.org1.example.com"),
+		TLSCertPath:  envOr("TLS_CERT_PATH", cryptoPath+"/peers/peer0.org1.example.com/tls/ca.crt"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connection.Close()
+
+	var gateways []*client.Gateway
+	defer func() {
+		for _, gateway := range gateways {
+			gateway.Close()
+		}
+	}()
+	contract := func(label string) *client.Contract {
+		gateway, err := connect(connection, w, label)
+		if err != nil {
+			log.Fatalf("identity %s: %v", label, err)
+		}
+		gateways = append(gateways, gateway)
+		return gateway.GetNetwork(envOr("CHANNEL_NAME", "mychannel")).GetContract(envOr("CHAINCODE_NAME", "energy"))
+	}
+
+	r := rand.New(rand.NewSource(*seed))
+	virtual := make([]*simulator.Prosumer, *prosumers)
+	for i := range virtual {
+		label := *prefix + strconv.Itoa(i+1)
+		virtual[i] = simulator.NewProsumer(label, simulator.RandomProfile(r), contract(label))
+	}
+	state, err := simulator.LoadState(*statePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stats := simulator.NewStats()
+	sim := simulator.New(simulator.Config{
+		RunID:          strconv.FormatInt(time.Now().Unix(), 36),
+		Interval:       15 * time.Minute,
+		Zone:           "zone1",
+		InitialBalance: 1000,
+		Concurrency:    *concurrency,
+		MeterNoise:     0.2,
+		ProfileOffset:  *profileOffset,
+	}, contract(*adminLabel), contract(*oracleLabel), virtual, state, stats, r.Int63())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	defer stats.Report(os.Stdout)
+
+	if err := sim.Setup(); err != nil {
+		log.Print(err)
+		return
+	}
+	fmt.Printf("%d prosumers ready; first round at the next %v boundary\n", *prosumers, 15*time.Minute)
+	if err := sim.Run(ctx, *rounds); err != nil {
+		log.Print(err)
+	}
+}
+
+func connect(connection *grpc.ClientConn, w *wallet.Wallet, label string) (*client.Gateway, error) {
+	id, err := w.Get(label)
+	if err != nil {
+		return nil, err
+	}
+	return fabric.Connect(connection, id)
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
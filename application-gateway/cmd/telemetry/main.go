@@ -0,0 +1,83 @@
+// Command telemetry keeps the chaincode's grid capacity limits in step with
+// the feeder loads and transformer ratings the grid operator measures.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+	"application-gateway/telemetry"
+	"application-gateway/wallet"
+)
+
+const cryptoPath = "../../test-network/organizations/peerOrganizations/org1.example.com"
+
+func main() {
+	w, err := wallet.New(envOr("WALLET_PATH", "identities"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	id, err := w.Get(envOr("TELEMETRY_IDENTITY", "operator"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	pointMap, err := telemetry.LoadPointMap(envOr("TELEMETRY_POINTS_PATH", "telemetry-points.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	connection, err := fabric.NewGrpcConnection(fabric.PeerConfig{
+		PeerEndpoint: envOr("PEER_ENDPOINT", "localhost:7051"),
+		GatewayPeer:  envOr("GATEWAY_PEER", "peer0.org1.example.com"),
+		TLSCertPath:  envOr("TLS_CERT_PATH", cryptoPath+"/peers/peer0.org1.example.com/tls/ca.crt"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connection.Close()
+	gateway, err := fabric.Connect(connection, id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer gateway.Close()
+	contract := gateway.GetNetwork(envOr("CHANNEL_NAME", "mychannel")).GetContract(envOr("CHAINCODE_NAME", "energy"))
+
+	if address := os.Getenv("METRICS_ADDRESS"); address != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(address, metrics.Handler()))
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	adapter := telemetry.New(contract, telemetry.DefaultConfig(), pointMap.Zones)
+	var dnp3 *telemetry.DNP3Client
+	if pointMap.DNP3 != nil {
+		dnp3 = telemetry.NewDNP3Client(*pointMap.DNP3)
+		defer dnp3.Close()
+	}
+	go adapter.Run(ctx, dnp3)
+
+	address := envOr("LISTEN_ADDRESS", ":9230")
+	server := &http.Server{Addr: address, Handler: adapter.Handler(os.Getenv("TELEMETRY_TOKEN"))}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("Listening for IEC 61850 reports on %s", address)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
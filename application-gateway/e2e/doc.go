@@ -0,0 +1,5 @@
+// Package e2e holds the end-to-end tests, which run the energy chaincode on
+// the Fabric test network with one organization on each side of a trade.
+// They are built with the e2e tag; run them with "make e2e", which boots the
+// network, deploys the chaincode and enrolls the test identities first.
+package e2e
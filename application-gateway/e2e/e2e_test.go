@@ -0,0 +1,283 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"application-gateway/canonical"
+	"application-gateway/fabric"
+	"application-gateway/wallet"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"google.golang.org/grpc"
+)
+
+const (
+	channelName   = "mychannel"
+	chaincodeName = "energy"
+	meterInterval = 15 * time.Minute
+)
+
+var testNetwork = envOr("TEST_NETWORK", "../../../test-network")
+
+// party is a test identity connected through its own organization's peer,
+// with the keys it signs trades and meter readings with
+type party struct {
+	address  string
+	contract *client.Contract
+	signing  *ecdsa.PrivateKey
+	meter    *ecdsa.PrivateKey
+}
+
+func (p *party) meterID() string {
+	return "meter-" + p.address
+}
+
+// submit submits a transaction and fails the test if it is not committed
+func (p *party) submit(t *testing.T, function string, options ...client.ProposalOption) []byte {
+	t.Helper()
+	result, err := p.contract.Submit(function, options...)
+	if err != nil {
+		t.Fatalf("%s as %s: %v", function, p.address, fabric.ErrorWithDetails(err))
+	}
+	return result
+}
+
+// submitFails submits a transaction the chaincode must reject with an error containing message
+func (p *party) submitFails(t *testing.T, message, function string, options ...client.ProposalOption) {
+	t.Helper()
+	_, err := p.contract.Submit(function, options...)
+	if err == nil {
+		t.Fatalf("%s as %s succeeded, want error %q", function, p.address, message)
+	}
+	if err := fabric.ErrorWithDetails(err); !strings.Contains(err.Error(), message) {
+		t.Fatalf("%s as %s: got error %v, want %q", function, p.address, err, message)
+	}
+}
+
+// evaluate evaluates a transaction and decodes its JSON result into result
+func (p *party) evaluate(t *testing.T, result interface{}, function string, args ...string) {
+	t.Helper()
+	resultJSON, err := p.contract.Evaluate(function, client.WithArguments(args...))
+	if err != nil {
+		t.Fatalf("%s as %s: %v", function, p.address, fabric.ErrorWithDetails(err))
+	}
+	if err := json.Unmarshal(resultJSON, result); err != nil {
+		t.Fatalf("%s as %s: %v", function, p.address, err)
+	}
+}
+
+// dial connects to peer0 of the organization
+func dial(t *testing.T, org, port string) *grpc.ClientConn {
+	peer := "peer0." + org + ".example.com"
+	connection, err := fabric.NewGrpcConnection(fabric.PeerConfig{
+		PeerEndpoint: "localhost:" + port,
+		GatewayPeer:  peer,
+		TLSCertPath:  testNetwork + "/organizations/peerOrganizations/" + org + ".example.com/peers/" + peer + "/tls/ca.crt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connection.Close() })
+	return connection
+}
+
+// connect opens a Gateway connection for the wallet identity with the given
+// label, whose certificate carries address as its energy.address attribute
+func connect(t *testing.T, connection *grpc.ClientConn, w *wallet.Wallet, label, address string) *party {
+	id, err := w.Get(label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway, err := fabric.Connect(connection, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gateway.Close() })
+	return &party{
+		address:  address,
+		contract: gateway.GetNetwork(channelName).GetContract(chaincodeName),
+		signing:  generateKey(t),
+		meter:    generateKey(t),
+	}
+}
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func publicKeyPEM(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, payload []byte) string {
+	digest := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+// onboard registers a trader with its meter, has the admin approve it and
+// funds its account
+func onboard(t *testing.T, admin, p *party) {
+	meterIDs, _ := json.Marshal([]string{p.meterID()})
+	personal, _ := json.Marshal(map[string]string{"displayName": p.address, "salt": p.address + "-salt"})
+	p.submit(t, "RegisterParticipant",
+		client.WithArguments(string(meterIDs), publicKeyPEM(t, p.signing), "zone1"),
+		client.WithTransient(map[string][]byte{"participant_personal": personal}))
+	admin.submit(t, "ApproveParticipant", client.WithArguments(p.address))
+	p.submit(t, "EnrollDevice", client.WithArguments(p.meterID(), "meter", publicKeyPEM(t, p.meter)))
+	admin.submit(t, "MintTokens", client.WithArguments(p.address, "100"))
+}
+
+// createTrade has the buyer create a trade of 1 kWh and both sides sign it
+func createTrade(t *testing.T, buyer, seller *party, tokenID string, start, end time.Time) {
+	private, _ := json.Marshal(map[string]interface{}{
+		"transactionPrice": 0.2,
+		"buyerDeposit":     0,
+		"sellerDeposit":    1,
+		"salt":             tokenID + "-salt",
+	})
+	buyer.submit(t, "CreateEnergyAsset",
+		client.WithArguments(tokenID, buyer.address, seller.address, "1", start.Format(time.RFC3339), end.Format(time.RFC3339), "grid"),
+		client.WithTransient(map[string][]byte{"trade_private": private}))
+
+	payload, err := buyer.contract.Evaluate("GetSigningPayload", client.WithArguments(tokenID))
+	if err != nil {
+		t.Fatal(fabric.ErrorWithDetails(err))
+	}
+	for _, p := range []*party{buyer, seller} {
+		p.submit(t, "SignEnergyAsset", client.WithArguments(tokenID, sign(t, p.signing, payload), "0"))
+	}
+}
+
+// submitReading submits a signed reading of the party's meter
+func submitReading(t *testing.T, p *party, start time.Time, injected, consumed float64) {
+	intervalStart := start.Format(time.RFC3339)
+	payload, _ := canonical.Marshal(struct {
+		MeterID       string  `json:"meterID"`
+		IntervalStart string  `json:"intervalStart"`
+		KWhInjected   float64 `json:"kWhInjected"`
+		KWhConsumed   float64 `json:"kWhConsumed"`
+	}{p.meterID(), intervalStart, injected, consumed})
+	p.submit(t, "SubmitMeterReading", client.WithArguments(p.meterID(), intervalStart,
+		strconv.FormatFloat(injected, 'f', -1, 64), strconv.FormatFloat(consumed, 'f', -1, 64), sign(t, p.meter, payload)))
+}
+
+type trade struct {
+	TransactionState string `json:"transactionState"`
+}
+
+type settlement struct {
+	DeliveredEnergy float64 `json:"deliveredEnergy"`
+	Shortfall       float64 `json:"shortfall"`
+	Payment         float64 `json:"payment"`
+}
+
+func requireState(t *testing.T, p *party, tokenID, state string) {
+	t.Helper()
+	var asset trade
+	p.evaluate(t, &asset, "ReadEnergyAsset", tokenID)
+	if asset.TransactionState != state {
+		t.Fatalf("asset %s is %s, want %s", tokenID, asset.TransactionState, state)
+	}
+}
+
+// TestTradeLifecycle runs two trades between a buyer in Org1 and a seller in
+// Org2 through creation, signing, delivery and settlement, one of them via a
+// meter reading dispute. The trades deliver in the next meter interval, so
+// the test waits up to half an hour for it to end.
+func TestTradeLifecycle(t *testing.T) {
+	w, err := wallet.New(envOr("WALLET_PATH", "identities"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	org1 := dial(t, "org1", "7051")
+	org2 := dial(t, "org2", "9051")
+	admin := connect(t, org1, w, "admin@org1", "admin1")
+	buyer := connect(t, org1, w, "buyer@org1", "buyer1")
+	oracle := connect(t, org1, w, "oracle@org1", "oracle1")
+	seller := connect(t, org2, w, "seller@org2", "seller1")
+	arbiter := connect(t, org2, w, "arbiter@org2", "arbiter1")
+
+	oracle.submit(t, "RegisterRole")
+	arbiter.submit(t, "RegisterRole")
+	onboard(t, admin, buyer)
+	onboard(t, admin, seller)
+	buyer.submitFails(t, "MintTokens: caller buyer1 with role consumer is not authorized", "MintTokens", client.WithArguments("buyer1", "1000"))
+
+	now := time.Now().UTC()
+	oracle.submit(t, "PostReferencePrice", client.WithArguments(now.Truncate(meterInterval).Format(time.RFC3339), "0.2"))
+	// Leave time for the trades to be signed before the interval starts
+	start := now.Add(2 * time.Minute).Truncate(meterInterval).Add(meterInterval)
+	end := start.Add(meterInterval)
+	runID := strconv.FormatInt(now.Unix(), 36)
+	settled, disputed := "e2e-"+runID+"-1", "e2e-"+runID+"-2"
+	createTrade(t, buyer, seller, settled, start, end)
+	createTrade(t, buyer, seller, disputed, start, end)
+	requireState(t, buyer, settled, "CONFIRMED")
+
+	buyer.submitFails(t, "cannot be signed in state CONFIRMED", "SignEnergyAsset", client.WithArguments(settled, "c2lnbmF0dXJl", "0"))
+	buyer.submitFails(t, "ConfirmDelivery: caller buyer1 with role consumer is not authorized", "ConfirmDelivery", client.WithArguments(settled, "0"))
+	seller.submit(t, "ConfirmDelivery", client.WithArguments(settled, "0"))
+	requireState(t, seller, settled, "DELIVERED")
+	seller.submitFails(t, "delivery window of asset "+settled+" ends at", "ReconcileDelivery", client.WithArguments(settled))
+
+	t.Logf("Waiting until %s for the delivery interval to end", end.Format(time.RFC3339))
+	time.Sleep(time.Until(end.Add(5 * time.Second)))
+	submitReading(t, seller, start, 2, 0)
+	submitReading(t, buyer, start, 0, 2)
+
+	seller.submit(t, "ReconcileDelivery", client.WithArguments(settled))
+	requireState(t, buyer, settled, "SETTLED")
+	var result settlement
+	buyer.evaluate(t, &result, "GetSettlement", settled)
+	if result.DeliveredEnergy != 1 || result.Shortfall != 0 {
+		t.Errorf("got settlement %+v of %s, want 1 kWh delivered", result, settled)
+	}
+	seller.submitFails(t, "cannot be settled in state SETTLED", "ReconcileDelivery", client.WithArguments(settled))
+
+	intervalStart := start.Format(time.RFC3339)
+	buyer.submit(t, "ChallengeMeterReading", client.WithArguments(disputed, seller.meterID(), intervalStart, "injection exceeds inverter rating"))
+	seller.submitFails(t, "is under dispute", "ReconcileDelivery", client.WithArguments(disputed))
+	arbiter.submit(t, "RequestReadingEvidence", client.WithArguments(seller.meterID(), intervalStart))
+	seller.submit(t, "SubmitReadingEvidence", client.WithArguments(seller.meterID(), intervalStart),
+		client.WithTransient(map[string][]byte{"reading_evidence": []byte(`{"raw":"device frame"}`)}))
+	arbiter.submit(t, "ResolveMeterDispute", client.WithArguments(seller.meterID(), intervalStart, "true", "0.5", "0"))
+
+	buyer.submit(t, "ReconcileDelivery", client.WithArguments(disputed))
+	buyer.evaluate(t, &result, "GetSettlement", disputed)
+	if result.DeliveredEnergy != 0.5 || result.Shortfall != 0.5 {
+		t.Errorf("got settlement %+v of %s, want 0.5 kWh delivered", result, disputed)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
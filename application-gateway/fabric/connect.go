@@ -0,0 +1,145 @@
+// Package fabric opens Fabric Gateway connections for wallet identities.
+package fabric
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"application-gateway/wallet"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// PeerConfig locates the gateway peer
+type PeerConfig struct {
+	PeerEndpoint string
+	GatewayPeer  string
+	TLSCertPath  string
+}
+
+// NewGrpcConnection creates a gRPC connection to the Gateway server. It should
+// be shared by all Gateway connections to the same peer.
+func NewGrpcConnection(config PeerConfig) (*grpc.ClientConn, error) {
+	certificatePEM, err := os.ReadFile(config.TLSCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS certificate file: %w", err)
+	}
+	certificate, err := identity.CertificateFromPEM(certificatePEM)
+	if err != nil {
+		return nil, err
+	}
+	certPool := x509.NewCertPool()
+	certPool.AddCert(certificate)
+	transportCredentials := credentials.NewClientTLSFromCert(certPool, config.GatewayPeer)
+
+	connection, err := grpc.Dial(config.PeerEndpoint, grpc.WithTransportCredentials(transportCredentials))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC connection: %w", err)
+	}
+	return connection, nil
+}
+
+// Connect creates a Gateway connection for a wallet identity
+func Connect(connection *grpc.ClientConn, id *wallet.Identity) (*client.Gateway, error) {
+	x509Identity, sign, err := id.X509Identity()
+	if err != nil {
+		return nil, err
+	}
+	return client.Connect(
+		x509Identity,
+		client.WithSign(sign),
+		client.WithClientConnection(connection),
+		client.WithEvaluateTimeout(5*time.Second),
+		client.WithEndorseTimeout(15*time.Second),
+		client.WithSubmitTimeout(5*time.Second),
+		client.WithCommitStatusTimeout(1*time.Minute),
+	)
+}
+
+// ErrorWithDetails flattens a gateway error and the peer details it carries,
+// which hold the chaincode's error messages.
+func ErrorWithDetails(err error) error {
+	details := []string{}
+	for _, detail := range status.Convert(err).Details() {
+		if errorDetail, ok := detail.(*gateway.ErrorDetail); ok {
+			details = append(details, fmt.Sprintf("%s: %s", errorDetail.Address, errorDetail.Message))
+		}
+	}
+	if len(details) == 0 {
+		return err
+	}
+	return fmt.Errorf("%v (%s)", err, strings.Join(details, "; "))
+}
+
+// Transient reports whether an invocation failure may succeed if retried:
+// ordering and commit status failures, read conflicts with concurrent
+// transactions, and unavailable peers.
+func Transient(err error) bool {
+	var commitErr *client.CommitError
+	if errors.As(err, &commitErr) {
+		return commitErr.Code == peer.TxValidationCode_MVCC_READ_CONFLICT || commitErr.Code == peer.TxValidationCode_PHANTOM_READ_CONFLICT
+	}
+	var submitErr *client.SubmitError
+	var commitStatusErr *client.CommitStatusError
+	if errors.As(err, &submitErr) || errors.As(err, &commitStatusErr) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// IdempotencyTransientKey is the transient map entry the chaincode reads a
+// submission's idempotency key from
+const IdempotencyTransientKey = "idempotency_key"
+
+// WithIdempotencyKey adds an idempotency key, if there is one, to a
+// submission's transient map. The chaincode rejects a second submission by
+// the same identity with the same key, so a submission retried after a
+// timeout cannot run twice.
+func WithIdempotencyKey(transient map[string][]byte, key string) map[string][]byte {
+	if key == "" {
+		return transient
+	}
+	if transient == nil {
+		transient = map[string][]byte{}
+	}
+	transient[IdempotencyTransientKey] = []byte(key)
+	return transient
+}
+
+// ErrTransactionNotFound is returned by TransactionValidationCode for a
+// transaction that is not on the channel's ledger
+var ErrTransactionNotFound = errors.New("transaction is not on the ledger")
+
+// TransactionValidationCode looks a transaction up on the channel's ledger
+// with the query system chaincode and returns the code the peers validated
+// it with
+func TransactionValidationCode(network *client.Network, transactionID string) (peer.TxValidationCode, error) {
+	processedBytes, err := network.GetContract("qscc").EvaluateTransaction("GetTransactionByID", network.Name(), transactionID)
+	if err != nil {
+		if strings.Contains(ErrorWithDetails(err).Error(), "no such transaction ID") {
+			return 0, ErrTransactionNotFound
+		}
+		return 0, ErrorWithDetails(err)
+	}
+	var processed peer.ProcessedTransaction
+	if err := proto.Unmarshal(processedBytes, &processed); err != nil {
+		return 0, fmt.Errorf("failed to parse transaction %s: %w", transactionID, err)
+	}
+	return peer.TxValidationCode(processed.GetValidationCode()), nil
+}
@@ -0,0 +1,31 @@
+package fabric
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// EventEnvelope mirrors the chaincode's EventEnvelope, which wraps the payload
+// of every chaincode event. Index is the event's position within its
+// transaction. The chaincode keeps no global order, so Sequence is left zero
+// until the indexer numbers the event in commit order.
+type EventEnvelope struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Sequence      uint64          `json:"sequence,omitempty"`
+	Index         int             `json:"index"`
+	Name          string          `json:"name"`
+	TxID          string          `json:"txID"`
+	Timestamp     string          `json:"timestamp"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// ParseEvent decodes the envelope of a chaincode event
+func ParseEvent(event *client.ChaincodeEvent) (*EventEnvelope, error) {
+	var envelope EventEnvelope
+	if err := json.Unmarshal(event.Payload, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to decode %s event in transaction %s: %w", event.EventName, event.TransactionID, err)
+	}
+	return &envelope, nil
+}
@@ -0,0 +1,107 @@
+package forecast
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeContract records submitted transactions
+type fakeContract struct {
+	name string
+	args []string
+}
+
+func (f *fakeContract) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	f.name, f.args = name, args
+	return nil, nil
+}
+
+// testPrices are two weeks of hourly prices rising through the day, 20%
+// lower at weekends
+func testPrices(start time.Time) []Observation {
+	observations := []Observation{}
+	for at := start; at.Before(start.AddDate(0, 0, 14)); at = at.Add(time.Hour) {
+		price := 0.1 + 0.01*float64(at.Hour())
+		if at.Weekday() == time.Saturday || at.Weekday() == time.Sunday {
+			price *= 0.8
+		}
+		observations = append(observations, Observation{Period: at.Format(time.RFC3339), Price: price, Volume: 10})
+	}
+	return observations
+}
+
+func TestTrain(t *testing.T) {
+	if _, err := Train(nil, 0.3); !errors.Is(err, ErrNoHistory) {
+		t.Fatalf("got error %v, want %v", err, ErrNoHistory)
+	}
+
+	model, err := Train(testPrices(time.Date(2025, 4, 14, 0, 0, 0, 0, time.UTC)), 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Weekday factors are shrunk towards 1, so the forecast lies between
+	// the weekday and weekend prices and nearer the price of its own kind
+	monday, _, _ := model.Predict(time.Date(2025, 4, 28, 0, 0, 0, 0, time.UTC), 1.28)
+	sunday, lows, highs := model.Predict(time.Date(2025, 4, 27, 0, 0, 0, 0, time.UTC), 1.28)
+	if monday[10] <= 0.18 || monday[10] > 0.2 || sunday[10] < 0.16 || sunday[10] >= 0.18 {
+		t.Errorf("got 10:00 forecasts %v on Monday and %v on Sunday", monday[10], sunday[10])
+	}
+	for hour := range sunday {
+		if lows[hour] > sunday[hour] || sunday[hour] > highs[hour] {
+			t.Errorf("hour %d forecast %v is outside its bounds [%v, %v]", hour, sunday[hour], lows[hour], highs[hour])
+		}
+	}
+	if model.MeanAbsoluteError == 0 {
+		t.Error("expected weekend prices to leave a training error")
+	}
+}
+
+func TestTrainNegativePrices(t *testing.T) {
+	// Solar surpluses push midday prices below zero
+	observations := testPrices(time.Date(2025, 4, 14, 0, 0, 0, 0, time.UTC))
+	for i := range observations {
+		if hour := i % 24; hour >= 11 && hour < 15 {
+			observations[i].Price = -0.05
+		}
+	}
+	model, err := Train(observations, 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prices, lows, _ := model.Predict(time.Date(2025, 4, 28, 0, 0, 0, 0, time.UTC), 1.28)
+	if prices[12] >= 0 || lows[12] > prices[12] || prices[10] <= 0 {
+		t.Errorf("got forecasts %v at 10:00 and %v with low %v at 12:00", prices[10], prices[12], lows[12])
+	}
+}
+
+func TestPublish(t *testing.T) {
+	now := time.Date(2025, 4, 28, 10, 0, 0, 0, time.UTC)
+	var query string
+	indexer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		json.NewEncoder(w).Encode(testPrices(now.AddDate(0, 0, -14)))
+	}))
+	defer indexer.Close()
+
+	contract := &fakeContract{}
+	forecaster := New(contract, indexer.URL+"/", DefaultConfig())
+	forecaster.now = func() time.Time { return now }
+	if err := forecaster.Publish(context.Background(), time.Date(2025, 4, 29, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if query != "from=2025-03-31T10%3A00%3A00Z&to=2025-04-28T10%3A00%3A00Z" {
+		t.Errorf("got indexer query %s", query)
+	}
+	if contract.name != "PostPriceForecast" || len(contract.args) != 5 || contract.args[0] != "2025-04-29" || contract.args[1] != ModelName {
+		t.Fatalf("got transaction %s %v", contract.name, contract.args)
+	}
+	var prices []float64
+	if err := json.Unmarshal([]byte(contract.args[2]), &prices); err != nil || len(prices) != 24 {
+		t.Errorf("got prices %s: %v", contract.args[2], err)
+	}
+}
@@ -0,0 +1,162 @@
+package forecast
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+)
+
+// dayLayout is the format of the UTC day a forecast covers
+const dayLayout = "2006-01-02"
+
+// Invoker is the part of *client.Contract the forecaster uses
+type Invoker interface {
+	SubmitTransaction(name string, args ...string) ([]byte, error)
+}
+
+// Config controls what the forecaster trains on and when it publishes
+type Config struct {
+	// History is how far back clearing prices are trained on
+	History time.Duration
+	// Smoothing is the weight of the newest price in each hour's level,
+	// between 0 and 1
+	Smoothing float64
+	// Spread is how many standard deviations of the training error the
+	// bounds lie either side of each forecast price
+	Spread float64
+	// PublishAt is the time of day, UTC, the next day's forecast is published
+	PublishAt time.Duration
+	// RetryInterval is how long a failed publication waits to be retried
+	RetryInterval time.Duration
+}
+
+// DefaultConfig returns a configuration that trains on four weeks of prices
+// and publishes at 10:00 UTC with bounds covering about 80% of outcomes
+func DefaultConfig() Config {
+	return Config{
+		History:       28 * 24 * time.Hour,
+		Smoothing:     0.3,
+		Spread:        1.28,
+		PublishAt:     10 * time.Hour,
+		RetryInterval: 5 * time.Minute,
+	}
+}
+
+// Forecaster retrains every day on the clearing prices served by an indexer
+// and publishes the next day's forecast with PostPriceForecast
+type Forecaster struct {
+	contract   Invoker
+	indexerURL string
+	client     *http.Client
+	config     Config
+	now        func() time.Time
+}
+
+// New returns a forecaster reading prices from the indexer at indexerURL
+func New(contract Invoker, indexerURL string, config Config) *Forecaster {
+	return &Forecaster{
+		contract:   contract,
+		indexerURL: strings.TrimSuffix(indexerURL, "/"),
+		client:     &http.Client{Timeout: 30 * time.Second},
+		config:     config,
+		now:        time.Now,
+	}
+}
+
+// Run publishes the next day's forecast at PublishAt every day until ctx is
+// cancelled. Started after PublishAt, it publishes straight away; a
+// forecast published again replaces the earlier one.
+func (f *Forecaster) Run(ctx context.Context) error {
+	var published time.Time
+	for {
+		now := f.now().UTC()
+		today := now.Truncate(24 * time.Hour)
+		tomorrow := today.AddDate(0, 0, 1)
+		wait := today.Add(f.config.PublishAt).Sub(now)
+		if wait <= 0 && !published.Equal(tomorrow) {
+			if err := f.Publish(ctx, tomorrow); err != nil {
+				log.Printf("Publishing the forecast for %s failed: %v", tomorrow.Format(dayLayout), err)
+				wait = f.config.RetryInterval
+			} else {
+				published = tomorrow
+			}
+		}
+		if wait <= 0 {
+			wait = tomorrow.Add(f.config.PublishAt).Sub(f.now().UTC())
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// Publish trains on the clearing prices of the History before now and posts
+// the forecast for day
+func (f *Forecaster) Publish(ctx context.Context, day time.Time) error {
+	now := f.now().UTC()
+	observations, err := f.ClearingPrices(ctx, now.Add(-f.config.History), now)
+	if err != nil {
+		return err
+	}
+	model, err := Train(observations, f.config.Smoothing)
+	if err != nil {
+		return err
+	}
+	prices, lows, highs := model.Predict(day, f.config.Spread)
+	args := []string{day.Format(dayLayout), ModelName}
+	for _, values := range [][]float64{prices, lows, highs} {
+		valuesJSON, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		args = append(args, string(valuesJSON))
+	}
+	if _, err := f.contract.SubmitTransaction("PostPriceForecast", args...); err != nil {
+		return fabric.ErrorWithDetails(err)
+	}
+	metrics.PriceForecastError(model.MeanAbsoluteError)
+	log.Printf("Published the forecast for %s from %d hourly prices, mean absolute error %.4f", day.Format(dayLayout), len(observations), model.MeanAbsoluteError)
+	return nil
+}
+
+// ClearingPrices fetches the hourly clearing prices of the half-open window
+// [from, to) from the indexer
+func (f *Forecaster) ClearingPrices(ctx context.Context, from, to time.Time) ([]Observation, error) {
+	query := url.Values{"from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.indexerURL+"/clearing-prices?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("indexer returned %s", resp.Status)
+	}
+	var observations []Observation
+	if err := json.NewDecoder(resp.Body).Decode(&observations); err != nil {
+		return nil, err
+	}
+	return observations, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,156 @@
+// Package forecast trains on the clearing prices the indexer has recorded
+// and publishes day-ahead price forecasts on-chain as the oracle, for
+// participants to consult when they bid.
+package forecast
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// ModelName identifies the model in the forecasts it publishes
+const ModelName = "seasonal-ewma"
+
+// ErrNoHistory is returned when there are no clearing prices to train on
+var ErrNoHistory = errors.New("no clearing prices to train on")
+
+// weekdayPrior is how many hours of prices at the overall mean each
+// weekday's factor starts from, so that a weekday seen only a few times
+// barely moves away from 1
+const weekdayPrior = 24
+
+// Observation is the clearing price of the hour starting at Period, as the
+// indexer reports it
+type Observation struct {
+	Period string  `json:"period"`
+	Price  float64 `json:"price"`
+	Volume float64 `json:"volume"`
+}
+
+// Model predicts the clearing price of each hour of a day from a smoothed
+// level per hour of day, scaled by a factor per day of the week
+type Model struct {
+	level   [24]float64
+	weekday [7]float64
+	// deviation is the root mean square error of the one-step predictions
+	// made while training, per hour of day
+	deviation [24]float64
+	// MeanAbsoluteError is the mean absolute error of the one-step
+	// predictions made while training
+	MeanAbsoluteError float64
+}
+
+// Train fits a model to hourly clearing prices. Each hour's level is an
+// exponentially weighted average of the prices seen at that hour, newest
+// weighted by smoothing; before each update the level predicts the price,
+// and the errors of those predictions set the width of the forecast bounds.
+func Train(observations []Observation, smoothing float64) (*Model, error) {
+	type sample struct {
+		at    time.Time
+		price float64
+	}
+	samples := make([]sample, 0, len(observations))
+	var total float64
+	for _, o := range observations {
+		at, err := time.Parse(time.RFC3339, o.Period)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample{at.UTC(), o.Price})
+		total += o.Price
+	}
+	if len(samples) == 0 {
+		return nil, ErrNoHistory
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].at.Before(samples[j].at) })
+	mean := total / float64(len(samples))
+
+	m := &Model{}
+	var weekdaySums [7]float64
+	var weekdayCounts [7]int
+	for _, s := range samples {
+		weekdaySums[s.at.Weekday()] += s.price
+		weekdayCounts[s.at.Weekday()]++
+	}
+	// Factors are only meaningful against a positive mean, and a weekday
+	// whose prices were mostly negative is left unscaled
+	for w := range m.weekday {
+		m.weekday[w] = 1
+		if mean > 0 {
+			if factor := (weekdaySums[w] + weekdayPrior*mean) / (float64(weekdayCounts[w]) + weekdayPrior) / mean; factor > 0 {
+				m.weekday[w] = factor
+			}
+		}
+	}
+
+	var known [24]bool
+	var squared [24]float64
+	var residuals [24]int
+	var squaredTotal, absoluteTotal float64
+	var residualTotal int
+	for _, s := range samples {
+		hour, factor := s.at.Hour(), m.weekday[s.at.Weekday()]
+		price := s.price / factor
+		if !known[hour] {
+			m.level[hour], known[hour] = price, true
+			continue
+		}
+		residual := s.price - m.level[hour]*factor
+		squared[hour] += residual * residual
+		residuals[hour]++
+		squaredTotal += residual * residual
+		absoluteTotal += math.Abs(residual)
+		residualTotal++
+		m.level[hour] += smoothing * (price - m.level[hour])
+	}
+
+	// Hours never traded take the average level, and hours with too few
+	// predictions to judge take the overall error
+	var levels float64
+	var knownHours int
+	for hour := range m.level {
+		if known[hour] {
+			levels += m.level[hour]
+			knownHours++
+		}
+	}
+	var overall float64
+	if residualTotal > 0 {
+		overall = math.Sqrt(squaredTotal / float64(residualTotal))
+		m.MeanAbsoluteError = absoluteTotal / float64(residualTotal)
+	}
+	for hour := range m.level {
+		if !known[hour] {
+			m.level[hour] = levels / float64(knownHours)
+		}
+		m.deviation[hour] = overall
+		if residuals[hour] >= 2 {
+			m.deviation[hour] = math.Sqrt(squared[hour] / float64(residuals[hour]))
+		}
+	}
+	return m, nil
+}
+
+// Predict returns the forecast price of each hour of a UTC day, with bounds
+// spread standard deviations either side. Like clearing prices, forecasts and
+// their bounds may be negative.
+func (m *Model) Predict(day time.Time, spread float64) (prices, lows, highs []float64) {
+	factor := m.weekday[day.UTC().Weekday()]
+	prices = make([]float64, 24)
+	lows = make([]float64, 24)
+	highs = make([]float64, 24)
+	for hour := range prices {
+		price := m.level[hour] * factor
+		prices[hour] = roundPrice(price)
+		lows[hour] = roundPrice(price - spread*m.deviation[hour])
+		highs[hour] = roundPrice(price + spread*m.deviation[hour])
+	}
+	return prices, lows, highs
+}
+
+// roundPrice rounds a price to a hundredth of a cent
+func roundPrice(price float64) float64 {
+	return math.Round(price*10000) / 10000
+}
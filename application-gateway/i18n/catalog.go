@@ -0,0 +1,226 @@
+// Package i18n localizes the messages users see in the gateway's responses
+// and live events. Chaincode errors are plain English sentences, so they are
+// matched against known patterns to a stable code and its parameters, and
+// the code is rendered from a per-language catalog. Chaincode events are
+// rendered from their name and payload fields the same way. Catalogs are
+// embedded JSON files, one per language, and any message a catalog lacks
+// falls back to English.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLanguage is the language of the reference catalog, used when no
+// requested language has a catalog
+const DefaultLanguage = "en"
+
+//go:embed catalogs/*.json
+var catalogFiles embed.FS
+
+// EventText is the title and body templates of an event's message
+type EventText struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// Catalog holds one language's message templates. Templates refer to
+// parameters as {name}. DecimalSeparator replaces the point in numbers taken
+// from event payloads.
+type Catalog struct {
+	Language         string               `json:"language"`
+	DecimalSeparator string               `json:"decimalSeparator,omitempty"`
+	Errors           map[string]string    `json:"errors"`
+	Events           map[string]EventText `json:"events"`
+}
+
+// Message is an event rendered in one language
+type Message struct {
+	Language string `json:"language"`
+	Title    string `json:"title"`
+	Body     string `json:"body"`
+}
+
+var catalogs = mustLoadCatalogs()
+
+func mustLoadCatalogs() map[string]*Catalog {
+	loaded, err := loadCatalogs()
+	if err != nil {
+		panic(err)
+	}
+	return loaded
+}
+
+func loadCatalogs() (map[string]*Catalog, error) {
+	files, err := catalogFiles.ReadDir("catalogs")
+	if err != nil {
+		return nil, err
+	}
+	loaded := map[string]*Catalog{}
+	for _, file := range files {
+		catalogJSON, err := catalogFiles.ReadFile(path.Join("catalogs", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var catalog Catalog
+		if err := json.Unmarshal(catalogJSON, &catalog); err != nil {
+			return nil, fmt.Errorf("failed to parse catalog %s: %w", file.Name(), err)
+		}
+		if catalog.Language+".json" != file.Name() {
+			return nil, fmt.Errorf("catalog %s is for language %q", file.Name(), catalog.Language)
+		}
+		loaded[catalog.Language] = &catalog
+	}
+	if loaded[DefaultLanguage] == nil {
+		return nil, fmt.Errorf("no %s catalog", DefaultLanguage)
+	}
+	return loaded, nil
+}
+
+// Languages returns the languages with a catalog, sorted
+func Languages() []string {
+	languages := make([]string, 0, len(catalogs))
+	for language := range catalogs {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Lookup returns the catalog of a language, or nil if it has none
+func Lookup(language string) *Catalog {
+	return catalogs[language]
+}
+
+// Negotiate picks the language of a response from an Accept-Language header,
+// matching each requested language by its primary subtag, in order of
+// quality. It returns DefaultLanguage if none has a catalog.
+func Negotiate(acceptLanguage string) string {
+	type choice struct {
+		language string
+		quality  float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+		quality := 1.0
+		for _, field := range fields[1:] {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(field), "q="); ok {
+				if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+					quality = parsed
+				}
+			}
+		}
+		primary, _, _ := strings.Cut(tag, "-")
+		if quality > 0 && catalogs[primary] != nil {
+			choices = append(choices, choice{primary, quality})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].quality > choices[j].quality })
+	if len(choices) == 0 {
+		return DefaultLanguage
+	}
+	return choices[0].language
+}
+
+// Error renders the message of an error code in a language. Codes missing
+// from the language's catalog are rendered in English, and codes missing
+// from every catalog as the generic chaincode error.
+func Error(language, code string, params map[string]string) string {
+	template, ok := lookupError(language, code)
+	if !ok {
+		template, _ = lookupError(language, CodeChaincodeError)
+	}
+	return render(template, params)
+}
+
+func lookupError(language, code string) (string, bool) {
+	if catalog := catalogs[language]; catalog != nil {
+		if template, ok := catalog.Errors[code]; ok {
+			return template, true
+		}
+	}
+	template, ok := catalogs[DefaultLanguage].Errors[code]
+	return template, ok
+}
+
+// Event renders the message of a chaincode event in a language from the
+// fields of its payload. It returns nil for events no catalog describes.
+func Event(language, name string, payload json.RawMessage) *Message {
+	catalog := catalogs[language]
+	var text EventText
+	var ok bool
+	if catalog != nil {
+		text, ok = catalog.Events[name]
+	}
+	if !ok {
+		catalog = catalogs[DefaultLanguage]
+		if text, ok = catalog.Events[name]; !ok {
+			return nil
+		}
+	}
+	params := payloadParams(payload, catalog.DecimalSeparator)
+	return &Message{Language: catalog.Language, Title: render(text.Title, params), Body: render(text.Body, params)}
+}
+
+// payloadParams formats the top-level fields of an event payload as
+// template parameters. Nested objects and arrays are left out.
+func payloadParams(payload json.RawMessage, decimalSeparator string) map[string]string {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+	if decoder.Decode(&fields) != nil {
+		return nil
+	}
+	params := map[string]string{}
+	for name, value := range fields {
+		switch v := value.(type) {
+		case string:
+			params[name] = v
+		case json.Number:
+			params[name] = v.String()
+			if decimalSeparator != "" {
+				params[name] = strings.Replace(v.String(), ".", decimalSeparator, 1)
+			}
+		case bool:
+			params[name] = strconv.FormatBool(v)
+		}
+	}
+	return params
+}
+
+// render substitutes the parameters of a template. Placeholders without a
+// parameter are left as they are.
+func render(template string, params map[string]string) string {
+	var b strings.Builder
+	for {
+		open := strings.IndexByte(template, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(template[open:], '}')
+		if end < 0 {
+			break
+		}
+		placeholder := template[open : open+end+1]
+		b.WriteString(template[:open])
+		if value, ok := params[placeholder[1:len(placeholder)-1]]; ok {
+			b.WriteString(value)
+		} else {
+			b.WriteString(placeholder)
+		}
+		template = template[open+end+1:]
+	}
+	b.WriteString(template)
+	return b.String()
+}
@@ -0,0 +1,143 @@
+package i18n
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func placeholders(template string) []string {
+	var names []string
+	for _, match := range placeholder.FindAllStringSubmatch(template, -1) {
+		names = append(names, match[1])
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCatalogsComplete(t *testing.T) {
+	reference := catalogs[DefaultLanguage]
+	codes := []string{CodeChaincodeError, CodeQueueFull, CodeCommitFailed}
+	for _, p := range errorPatterns {
+		codes = append(codes, p.code)
+		for _, name := range placeholders(reference.Errors[p.code]) {
+			if !contains(p.params, name) {
+				t.Errorf("%s message uses parameter %s, which the chaincode message does not have", p.code, name)
+			}
+		}
+	}
+	for _, code := range codes {
+		if _, ok := reference.Errors[code]; !ok {
+			t.Errorf("the %s catalog has no message for %s", DefaultLanguage, code)
+		}
+	}
+
+	for _, language := range Languages() {
+		catalog := catalogs[language]
+		for code, template := range reference.Errors {
+			translated, ok := catalog.Errors[code]
+			if !ok {
+				t.Errorf("the %s catalog has no message for %s", language, code)
+			} else if !reflect.DeepEqual(placeholders(translated), placeholders(template)) {
+				t.Errorf("the %s message for %s has parameters %v, want %v", language, code, placeholders(translated), placeholders(template))
+			}
+		}
+		for name, text := range reference.Events {
+			translated, ok := catalog.Events[name]
+			if !ok {
+				t.Errorf("the %s catalog has no message for event %s", language, name)
+				continue
+			}
+			if !reflect.DeepEqual(placeholders(translated.Body), placeholders(text.Body)) {
+				t.Errorf("the %s message for event %s has parameters %v, want %v", language, name, placeholders(translated.Body), placeholders(text.Body))
+			}
+		}
+		if len(catalog.Errors) != len(reference.Errors) || len(catalog.Events) != len(reference.Events) {
+			t.Errorf("the %s catalog has messages the %s catalog does not", language, DefaultLanguage)
+		}
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClassify(t *testing.T) {
+	for _, test := range []struct {
+		message string
+		code    string
+		params  map[string]string
+	}{
+		{
+			"rpc error: code = Aborted desc = failed to endorse transaction (peer0.org1.example.com:7051: chaincode response 500, account buyer1 has insufficient balance)",
+			CodeInsufficientBalance, map[string]string{"account": "buyer1"},
+		},
+		{
+			"rpc error: code = Unknown desc = evaluate call to endorser returned error: chaincode response 500, TransferTokens: caller u1 with role prosumer is not authorized",
+			CodeNotAuthorized, map[string]string{"caller": "u1", "role": "prosumer"},
+		},
+		{
+			"chaincode response 500, no reference price is in effect at 2030-05-03T10:00:00Z; peer1: chaincode response 500, no reference price is in effect at 2030-05-03T10:00:00Z",
+			CodeNoReferencePrice, map[string]string{"time": "2030-05-03T10:00:00Z"},
+		},
+		{"chaincode response 500, account seller1 does not exist)", CodeAccountNotFound, map[string]string{"account": "seller1"}},
+		{"chaincode response 500, auction a7 does not exist)", CodeNotFound, map[string]string{"id": "a7"}},
+		{"chaincode response 500, trade energy2 is at version 3, not 2", CodeVersionConflict, map[string]string{"id": "energy2", "version": "3", "expected": "2"}},
+		{"chaincode response 500, SubmitOrder: market is paused: storm", CodeMarketPaused, map[string]string{}},
+		{"something else went wrong ", CodeChaincodeError, map[string]string{"detail": "something else went wrong"}},
+	} {
+		code, params := Classify(test.message)
+		if code != test.code || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("Classify(%q) = %s %v, want %s %v", test.message, code, params, test.code, test.params)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                          DefaultLanguage,
+		"de-CH":                     "de",
+		"it, es;q=0.8, fr;q=0.9":    "fr",
+		"fr;q=0, es-MX;q=0.5, *":    "es",
+		"pt-BR, pt;q=0.9":           DefaultLanguage,
+		"DE-de;q=0.7, en-GB;q=0.71": "en",
+	} {
+		if got := Negotiate(header); got != want {
+			t.Errorf("Negotiate(%q) = %s, want %s", header, got, want)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	if got := Error("de", CodeInsufficientBalance, map[string]string{"account": "buyer1"}); got != "Das Guthaben von buyer1 reicht nicht aus." {
+		t.Errorf("got %q", got)
+	}
+	if got := Error("xx", CodeZoneRequired, nil); got != "Please choose a grid zone." {
+		t.Errorf("got %q for a language without a catalog", got)
+	}
+	if got := Error("en", "NO_SUCH_CODE", map[string]string{"detail": "boom"}); got != "The request was rejected: boom" {
+		t.Errorf("got %q for an unknown code", got)
+	}
+}
+
+func TestEvent(t *testing.T) {
+	payload := json.RawMessage(`{"tokenID":"energy2","buyer":"b1","seller":"s1","energyAmount":2.5,"deliveryStart":"2030-05-03T10:00:00Z","nested":{"x":1}}`)
+	message := Event("de", "TradeConfirmed", payload)
+	want := &Message{Language: "de", Title: "Handel bestätigt", Body: "Der Handel energy2 über 2,5 kWh ist für die Lieferung ab 2030-05-03T10:00:00Z bestätigt."}
+	if !reflect.DeepEqual(message, want) {
+		t.Errorf("got %+v, want %+v", message, want)
+	}
+	message = Event("pt", "TokensTransferred", json.RawMessage(`{"to":"b1","amount":10}`))
+	if message == nil || message.Language != "en" || message.Body != "10 tokens were sent from {from} to b1." {
+		t.Errorf("got %+v for a language without a catalog", message)
+	}
+	if message := Event("en", "DailyRollupCreated", payload); message != nil {
+		t.Errorf("got %+v for an event without a message", message)
+	}
+}
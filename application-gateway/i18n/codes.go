@@ -0,0 +1,104 @@
+package i18n
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Error codes. The gateway's own failures have codes too, so that clients
+// handle every error response the same way.
+const (
+	CodeChaincodeError           = "CHAINCODE_ERROR"
+	CodeQueueFull                = "SUBMISSION_QUEUE_FULL"
+	CodeCommitFailed             = "COMMIT_FAILED"
+	CodeNotAuthorized            = "NOT_AUTHORIZED"
+	CodeRoleNotRegistered        = "ROLE_NOT_REGISTERED"
+	CodeMarketPaused             = "MARKET_PAUSED"
+	CodeAccountNotFound          = "ACCOUNT_NOT_FOUND"
+	CodeInsufficientBalance      = "INSUFFICIENT_BALANCE"
+	CodeParticipantNotRegistered = "PARTICIPANT_NOT_REGISTERED"
+	CodeParticipantNotApproved   = "PARTICIPANT_NOT_APPROVED"
+	CodeParticipantErased        = "PARTICIPANT_ERASED"
+	CodeAssetExists              = "ASSET_EXISTS"
+	CodeNotTradeParty            = "NOT_TRADE_PARTY"
+	CodeVersionConflict          = "VERSION_CONFLICT"
+	CodeMeterNotRegistered       = "METER_NOT_REGISTERED"
+	CodeReadingDisputed          = "READING_DISPUTED"
+	CodeNegativeReading          = "NEGATIVE_READING"
+	CodeNoReferencePrice         = "NO_REFERENCE_PRICE"
+	CodeIntervalNotEnded         = "INTERVAL_NOT_ENDED"
+	CodeIntervalStarted          = "INTERVAL_STARTED"
+	CodeZoneRequired             = "ZONE_REQUIRED"
+	CodeZoneIslanded             = "ZONE_ISLANDED"
+	CodeNotFound                 = "NOT_FOUND"
+)
+
+// errorPattern matches the chaincode's message for one error code
+type errorPattern struct {
+	code   string
+	params []string
+	regexp *regexp.Regexp
+}
+
+// placeholder matches a parameter in a chaincode message format
+var placeholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// newErrorPattern compiles a chaincode message with {name} in place of each
+// parameter. A parameter is one word: the gateway wraps chaincode messages
+// in peer details separated by semicolons and closed by a parenthesis.
+func newErrorPattern(code, message string) errorPattern {
+	p := errorPattern{code: code}
+	expr := ""
+	rest := message
+	for _, match := range placeholder.FindAllStringSubmatchIndex(message, -1) {
+		start := len(message) - len(rest)
+		expr += regexp.QuoteMeta(message[start:match[0]]) + `([^\s;)]+)`
+		p.params = append(p.params, message[match[2]:match[3]])
+		rest = message[match[1]:]
+	}
+	p.regexp = regexp.MustCompile(expr + regexp.QuoteMeta(rest))
+	return p
+}
+
+// errorPatterns are tried in order, so specific messages come before the
+// generic ones they would also match
+var errorPatterns = []errorPattern{
+	newErrorPattern(CodeNotAuthorized, "caller {caller} with role {role} is not authorized"),
+	newErrorPattern(CodeRoleNotRegistered, "caller {caller} has no registered role"),
+	newErrorPattern(CodeMarketPaused, "market is paused"),
+	newErrorPattern(CodeAccountNotFound, "account {account} does not exist"),
+	newErrorPattern(CodeInsufficientBalance, "account {account} has insufficient balance"),
+	newErrorPattern(CodeParticipantNotRegistered, "participant {participant} is not registered"),
+	newErrorPattern(CodeParticipantNotApproved, "participant {participant} is not KYC approved"),
+	newErrorPattern(CodeParticipantErased, "participant {participant} has been erased"),
+	newErrorPattern(CodeAssetExists, "asset {tokenID} already exists"),
+	newErrorPattern(CodeNotTradeParty, "caller {caller} is not a party to this trade"),
+	newErrorPattern(CodeVersionConflict, "{id} is at version {version}, not {expected}"),
+	newErrorPattern(CodeMeterNotRegistered, "meter {meterID} is not registered to {participant}"),
+	newErrorPattern(CodeReadingDisputed, "reading of meter {meterID} at {intervalStart} is under dispute"),
+	newErrorPattern(CodeNegativeReading, "meter readings must not be negative"),
+	newErrorPattern(CodeNoReferencePrice, "no reference price is in effect at {time}"),
+	newErrorPattern(CodeIntervalNotEnded, "interval {interval} has not ended"),
+	newErrorPattern(CodeIntervalStarted, "interval {interval} has already started"),
+	newErrorPattern(CodeZoneRequired, "zone must not be empty"),
+	newErrorPattern(CodeZoneIslanded, "zone {zone} is islanded and cannot trade with other zones"),
+	newErrorPattern(CodeNotFound, "{id} does not exist"),
+}
+
+// Classify finds the code of a chaincode error message and its parameters.
+// Messages matching no pattern are CodeChaincodeError, with the message as
+// the detail parameter.
+func Classify(message string) (string, map[string]string) {
+	for _, p := range errorPatterns {
+		match := p.regexp.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+		params := map[string]string{}
+		for i, name := range p.params {
+			params[name] = match[i+1]
+		}
+		return p.code, params
+	}
+	return CodeChaincodeError, map[string]string{"detail": strings.TrimSpace(message)}
+}
@@ -0,0 +1,220 @@
+package indexer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"application-gateway/metrics"
+)
+
+// DefaultLimit and MaxLimit bound the rows returned by list queries
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Handler returns the HTTP routes serving the store's queries. GraphQL
+// queries are posted to /graphql, and subscriptions run over a WebSocket to
+// the same path.
+func Handler(store *Store) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, metrics.Instrument(pattern, handler))
+	}
+	handle("GET /history/{address}/trades", func(w http.ResponseWriter, r *http.Request) {
+		limit, err := limitParam(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		trades, err := store.TradeHistory(r.PathValue("address"), limit)
+		writeResult(w, trades, err)
+	})
+	handle("GET /history/{address}/tokens", func(w http.ResponseWriter, r *http.Request) {
+		limit, err := limitParam(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		movements, err := store.TokenMovements(r.PathValue("address"), limit)
+		writeResult(w, movements, err)
+	})
+	handle("GET /trades/{id}/history", func(w http.ResponseWriter, r *http.Request) {
+		changes, err := store.TradeStateChanges(r.PathValue("id"))
+		writeResult(w, changes, err)
+	})
+	handle("GET /trades/stuck", func(w http.ResponseWriter, r *http.Request) {
+		overdueTrades(w, r, store.StuckTrades)
+	})
+	handle("GET /trades/unsettled", func(w http.ResponseWriter, r *http.Request) {
+		overdueTrades(w, r, store.UnsettledTrades)
+	})
+	handle("GET /oracle-feeds", func(w http.ResponseWriter, r *http.Request) {
+		names := r.URL.Query()["name"]
+		if len(names) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("name is required"))
+			return
+		}
+		feeds, err := store.OracleFeeds(names)
+		writeResult(w, feeds, err)
+	})
+	handle("GET /prices", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("from") == "" || query.Get("to") == "" {
+			writeError(w, http.StatusBadRequest, errors.New("from and to are required"))
+			return
+		}
+		points, err := store.PriceChart(query.Get("from"), query.Get("to"))
+		writeResult(w, points, err)
+	})
+	handle("GET /clearing-prices", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("from") == "" || query.Get("to") == "" {
+			writeError(w, http.StatusBadRequest, errors.New("from and to are required"))
+			return
+		}
+		prices, err := store.ClearingPrices(query.Get("from"), query.Get("to"))
+		writeResult(w, prices, err)
+	})
+	handle("GET /rollups", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("from") == "" || query.Get("to") == "" {
+			writeError(w, http.StatusBadRequest, errors.New("from and to are required"))
+			return
+		}
+		rollups, err := store.DailyRollups(query.Get("from"), query.Get("to"))
+		writeResult(w, rollups, err)
+	})
+	handle("GET /baselines/{address}", func(w http.ResponseWriter, r *http.Request) {
+		request, err := baselineParams(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		baseline, err := store.ComputeBaseline(request)
+		if err == nil && baseline == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s has no readings to compute a baseline from", request.Address))
+			return
+		}
+		writeResult(w, baseline, err)
+	})
+	handle("GET /export/{dataset}", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("from") == "" || query.Get("to") == "" {
+			writeError(w, http.StatusBadRequest, errors.New("from and to are required"))
+			return
+		}
+		dataset, format := r.PathValue("dataset"), query.Get("format")
+		if format == "" {
+			format = FormatCSV
+		}
+		if err := CheckExport(dataset, format); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		contentType := "text/csv"
+		if format == FormatParquet {
+			contentType = "application/vnd.apache.parquet"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", dataset+"."+format))
+		filter := ExportFilter{From: query.Get("from"), To: query.Get("to"), Address: query.Get("address")}
+		// The status is sent with the first page, so a later failure can
+		// only cut the download short
+		if err := store.Export(w, dataset, format, filter); err != nil {
+			log.Printf("Export of %s failed: %v", dataset, err)
+		}
+	})
+	handle("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		sequence, err := store.LastSequence()
+		writeResult(w, map[string]uint64{"lastSequence": sequence}, err)
+	})
+	schema := newGraphQLSchema(store)
+	handle("POST /graphql", serveGraphQL(schema))
+	mux.Handle("GET /graphql", serveGraphQLWebSocket(schema))
+	mux.Handle("GET /metrics", metrics.Handler())
+	return mux
+}
+
+// overdueTrades serves a query of trades overdue at the required "before"
+// time
+func overdueTrades(w http.ResponseWriter, r *http.Request, query func(before string, limit int) ([]*TradeRecord, error)) {
+	before := r.URL.Query().Get("before")
+	if before == "" {
+		writeError(w, http.StatusBadRequest, errors.New("before is required"))
+		return
+	}
+	limit, err := limitParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	trades, err := query(before, limit)
+	writeResult(w, trades, err)
+}
+
+// limitParam parses the optional "limit" query parameter
+func limitParam(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return DefaultLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > MaxLimit {
+		return 0, errors.New("limit must be between 1 and " + strconv.Itoa(MaxLimit))
+	}
+	return limit, nil
+}
+
+// baselineParams parses a baseline request. The window is required; the
+// methodology defaults to the chaincode's default, the average of 5 days.
+func baselineParams(r *http.Request) (BaselineRequest, error) {
+	query := r.URL.Query()
+	request := BaselineRequest{Address: r.PathValue("address"), Quantity: query.Get("quantity"), Methodology: query.Get("methodology"), Days: 5, Lookback: 5}
+	if request.Quantity == "" {
+		request.Quantity = BaselineConsumption
+	}
+	if request.Methodology == "" {
+		request.Methodology = BaselineAverage
+	}
+	var err error
+	if request.Start, err = time.Parse(time.RFC3339, query.Get("start")); err != nil {
+		return request, errors.New("start must be an RFC 3339 timestamp")
+	}
+	if request.End, err = time.Parse(time.RFC3339, query.Get("end")); err != nil {
+		return request, errors.New("end must be an RFC 3339 timestamp")
+	}
+	for name, value := range map[string]*int{"days": &request.Days, "lookback": &request.Lookback} {
+		if query.Get(name) == "" {
+			continue
+		}
+		if *value, err = strconv.Atoi(query.Get(name)); err != nil {
+			return request, errors.New(name + " must be an integer")
+		}
+	}
+	return request, request.check()
+}
+
+// writeResult writes a query's result, or its error
+func writeResult(w http.ResponseWriter, result interface{}, err error) {
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
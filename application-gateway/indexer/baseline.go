@@ -0,0 +1,135 @@
+package indexer
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Baseline methodologies and metered quantities, as in the chaincode
+const (
+	BaselineAverage     = "AVERAGE"
+	BaselineHighest     = "HIGH_X_OF_Y"
+	BaselineConsumption = "CONSUMPTION"
+	BaselineInjection   = "INJECTION"
+)
+
+// BaselineRequest describes a flexibility baseline to compute: a
+// participant's metered quantity over [Start, End), from the same window on
+// each of the Lookback preceding days
+type BaselineRequest struct {
+	Address     string
+	Quantity    string
+	Methodology string
+	Days        int
+	Lookback    int
+	Start       time.Time
+	End         time.Time
+}
+
+// Baseline is a flexibility baseline computed from indexed readings, ready
+// to be committed on-chain with CommitBaseline. Samples are the per-day
+// values of the days with readings, most recent first.
+type Baseline struct {
+	Address     string    `json:"address"`
+	Quantity    string    `json:"quantity"`
+	Methodology string    `json:"methodology"`
+	Days        int       `json:"days"`
+	Lookback    int       `json:"lookback"`
+	Start       string    `json:"start"`
+	End         string    `json:"end"`
+	Value       float64   `json:"value"`
+	Samples     []float64 `json:"samples"`
+}
+
+// check rejects a baseline request the chaincode would not accept
+func (request BaselineRequest) check() error {
+	if request.Quantity != BaselineConsumption && request.Quantity != BaselineInjection {
+		return errors.New("quantity must be CONSUMPTION or INJECTION")
+	}
+	if request.Methodology != BaselineAverage && request.Methodology != BaselineHighest {
+		return errors.New("methodology must be AVERAGE or HIGH_X_OF_Y")
+	}
+	if request.Days < 1 || request.Lookback < request.Days {
+		return errors.New("days must be at least 1 and no more than lookback")
+	}
+	if !request.End.After(request.Start) {
+		return errors.New("end must be after start")
+	}
+	return nil
+}
+
+// ComputeBaseline applies a baseline methodology to a participant's indexed
+// meter readings the way the chaincode's VerifyBaseline does: in each
+// interval the participant's generation is netted against its consumption
+// across its meters, and days without readings are skipped. It returns nil
+// if no preceding day has readings.
+func (s *Store) ComputeBaseline(request BaselineRequest) (*Baseline, error) {
+	if err := request.check(); err != nil {
+		return nil, err
+	}
+	samples := []float64{}
+	for day := 1; day <= request.Lookback; day++ {
+		offset := time.Duration(day) * 24 * time.Hour
+		value, found, err := s.residualEnergy(request.Address, request.Quantity, request.Start.Add(-offset), request.End.Add(-offset))
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			samples = append(samples, value)
+		}
+	}
+	if len(samples) == 0 {
+		return nil, nil
+	}
+	used := append([]float64{}, samples...)
+	if request.Methodology == BaselineHighest {
+		sort.Sort(sort.Reverse(sort.Float64Slice(used)))
+	}
+	if len(used) > request.Days {
+		used = used[:request.Days]
+	}
+	var total float64
+	for _, value := range used {
+		total += value
+	}
+	return &Baseline{
+		Address:     request.Address,
+		Quantity:    request.Quantity,
+		Methodology: request.Methodology,
+		Days:        request.Days,
+		Lookback:    request.Lookback,
+		Start:       request.Start.UTC().Format(time.RFC3339),
+		End:         request.End.UTC().Format(time.RFC3339),
+		Value:       total / float64(len(used)),
+		Samples:     samples,
+	}, nil
+}
+
+// residualEnergy sums a participant's residual export or import over the
+// half-open window [from, to), and reports whether any reading was found
+func (s *Store) residualEnergy(address, quantity string, from, to time.Time) (float64, bool, error) {
+	rows, err := s.db.Query(`SELECT SUM(kwh_injected), SUM(kwh_consumed) FROM meter_readings
+		WHERE owner = $1 AND interval_start >= $2 AND interval_start < $3
+		GROUP BY interval_start`, address, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	var total float64
+	found := false
+	for rows.Next() {
+		var injected, consumed float64
+		if err := rows.Scan(&injected, &consumed); err != nil {
+			return 0, false, err
+		}
+		found = true
+		if quantity == BaselineInjection && injected > consumed {
+			total += injected - consumed
+		} else if quantity == BaselineConsumption && consumed > injected {
+			total += consumed - injected
+		}
+	}
+	return total, found, rows.Err()
+}
@@ -0,0 +1,66 @@
+package indexer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestComputeBaseline(t *testing.T) {
+	store := openTestStore(t)
+	readings := []struct {
+		meterID            string
+		day                int
+		injected, consumed float64
+	}{
+		{"meter1", 1, 0, 4}, {"meter1", 2, 0, 6}, {"meter1", 3, 0, 2}, {"meter1", 4, 0, 8}, {"meter2", 4, 1, 0},
+	}
+	for _, reading := range readings {
+		start := time.Date(2025, 5, reading.day, 10, 0, 0, 0, time.UTC).Format(time.RFC3339)
+		if _, err := store.db.Exec(`INSERT INTO meter_readings (meter_id, interval_start, interval_end, owner, kwh_injected, kwh_consumed, submitted_at)
+			VALUES ($1, $2, $2, 'buyer1', $3, $4, $2)`, reading.meterID, start, reading.injected, reading.consumed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second meter's generation is netted against the first's consumption
+	// on May 4, and the highest 2 of the 3 preceding days are 7 and 6 kWh
+	request := BaselineRequest{
+		Address:     "buyer1",
+		Quantity:    BaselineConsumption,
+		Methodology: BaselineHighest,
+		Days:        2,
+		Lookback:    3,
+		Start:       time.Date(2025, 5, 5, 10, 0, 0, 0, time.UTC),
+		End:         time.Date(2025, 5, 5, 11, 0, 0, 0, time.UTC),
+	}
+	baseline, err := store.ComputeBaseline(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseline.Value != 6.5 || !reflect.DeepEqual(baseline.Samples, []float64{7, 2, 6}) {
+		t.Fatalf("baseline = %v from %v, want 6.5 from [7 2 6]", baseline.Value, baseline.Samples)
+	}
+
+	// 10 of 10 averages the four days that have readings
+	request.Methodology, request.Days, request.Lookback = BaselineAverage, 10, 10
+	if baseline, err = store.ComputeBaseline(request); err != nil {
+		t.Fatal(err)
+	}
+	if baseline.Value != 4.75 {
+		t.Fatalf("baseline = %v, want 4.75", baseline.Value)
+	}
+
+	request.Quantity = BaselineInjection
+	if baseline, err = store.ComputeBaseline(request); err != nil || baseline.Value != 0 {
+		t.Fatalf("injection baseline = %v, %v, want 0", baseline, err)
+	}
+	request.Start, request.End = request.Start.AddDate(0, 1, 0), request.End.AddDate(0, 1, 0)
+	if baseline, err = store.ComputeBaseline(request); err != nil || baseline != nil {
+		t.Fatalf("baseline without readings = %v, %v, want nil", baseline, err)
+	}
+	request.Days = 11
+	if _, err := store.ComputeBaseline(request); err == nil {
+		t.Fatal("more days than lookback accepted")
+	}
+}
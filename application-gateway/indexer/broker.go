@@ -0,0 +1,58 @@
+package indexer
+
+import (
+	"context"
+	"sync"
+
+	"application-gateway/fabric"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind by
+const subscriberBuffer = 64
+
+// broker fans events out to subscribers once they are indexed, so that a
+// subscriber querying the store on an event sees the event's effects. A
+// subscriber that falls behind is dropped, closing its channel, rather than
+// holding up indexing.
+type broker struct {
+	mu          sync.Mutex
+	subscribers map[chan *fabric.EventEnvelope]struct{}
+}
+
+func newBroker() *broker {
+	return &broker{subscribers: map[chan *fabric.EventEnvelope]struct{}{}}
+}
+
+func (b *broker) publish(env *fabric.EventEnvelope) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for events := range b.subscribers {
+		select {
+		case events <- env:
+		default:
+			delete(b.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// Subscribe returns the events indexed from now on until ctx is done, when
+// the channel is closed
+func (s *Store) Subscribe(ctx context.Context) <-chan *fabric.EventEnvelope {
+	b := s.broker
+	events := make(chan *fabric.EventEnvelope, subscriberBuffer)
+	b.mu.Lock()
+	b.subscribers[events] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[events]; ok {
+			delete(b.subscribers, events)
+			close(events)
+		}
+	}()
+	return events
+}
@@ -0,0 +1,295 @@
+package indexer
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Export formats
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// ExportPageSize is how many rows each query of an export reads. The
+// database connection is free between pages, so that indexing carries on
+// during a long export, and each Parquet row group holds one page.
+const ExportPageSize = 5000
+
+// ExportFilter selects the rows of an export: those whose date falls in the
+// half-open window [From, To) and, if Address is set, that concern it
+type ExportFilter struct {
+	From    string
+	To      string
+	Address string
+}
+
+// TradeExportRow is an exported trade, dated by its delivery start
+type TradeExportRow struct {
+	TokenID       string  `parquet:"token_id"`
+	Buyer         string  `parquet:"buyer"`
+	Seller        string  `parquet:"seller"`
+	EnergyAmount  float64 `parquet:"energy_amount"`
+	DeliveryStart string  `parquet:"delivery_start"`
+	DeliveryEnd   string  `parquet:"delivery_end"`
+	State         string  `parquet:"state"`
+	CreatedAt     string  `parquet:"created_at"`
+	UpdatedAt     string  `parquet:"updated_at"`
+}
+
+// SettlementExportRow is an exported settlement with its trade's parties,
+// dated by when it settled
+type SettlementExportRow struct {
+	TokenID          string  `parquet:"token_id"`
+	Buyer            string  `parquet:"buyer"`
+	Seller           string  `parquet:"seller"`
+	DeliveredEnergy  float64 `parquet:"delivered_energy"`
+	Shortfall        float64 `parquet:"shortfall"`
+	Payment          float64 `parquet:"payment"`
+	ImbalancePenalty float64 `parquet:"imbalance_penalty"`
+	SettledAt        string  `parquet:"settled_at"`
+}
+
+// MeterReadingExportRow is an exported meter reading, dated by its interval
+// start
+type MeterReadingExportRow struct {
+	MeterID       string  `parquet:"meter_id"`
+	Owner         string  `parquet:"owner"`
+	IntervalStart string  `parquet:"interval_start"`
+	IntervalEnd   string  `parquet:"interval_end"`
+	KWhInjected   float64 `parquet:"kwh_injected"`
+	KWhConsumed   float64 `parquet:"kwh_consumed"`
+	SubmittedAt   string  `parquet:"submitted_at"`
+}
+
+// InvoiceLineExportRow is an exported invoice line item with its invoice,
+// dated by the start of the billing period
+type InvoiceLineExportRow struct {
+	InvoiceNumber string  `parquet:"invoice_number"`
+	Participant   string  `parquet:"participant"`
+	Period        string  `parquet:"period"`
+	PeriodStart   string  `parquet:"period_start"`
+	PeriodEnd     string  `parquet:"period_end"`
+	Line          int64   `parquet:"line"`
+	Type          string  `parquet:"type"`
+	Reference     string  `parquet:"reference"`
+	Description   string  `parquet:"description"`
+	Quantity      float64 `parquet:"quantity"`
+	Amount        float64 `parquet:"amount"`
+	ClosedAt      string  `parquet:"closed_at"`
+}
+
+// ExportDatasets are the datasets Export writes
+var ExportDatasets = []string{"trades", "settlements", "meter-readings", "invoices"}
+
+// CheckExport returns an error if dataset or format is unknown
+func CheckExport(dataset, format string) error {
+	if format != FormatCSV && format != FormatParquet {
+		return fmt.Errorf("format must be %s or %s", FormatCSV, FormatParquet)
+	}
+	for _, known := range ExportDatasets {
+		if dataset == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown dataset %s, expected one of %s", dataset, strings.Join(ExportDatasets, ", "))
+}
+
+// Export writes a dataset in format to w, reading it a page at a time
+func (s *Store) Export(w io.Writer, dataset, format string, filter ExportFilter) error {
+	if err := CheckExport(dataset, format); err != nil {
+		return err
+	}
+	switch dataset {
+	case "trades":
+		return export(w, format, func(after *TradeExportRow) ([]TradeExportRow, error) {
+			return s.exportTrades(filter, after)
+		})
+	case "settlements":
+		return export(w, format, func(after *SettlementExportRow) ([]SettlementExportRow, error) {
+			return s.exportSettlements(filter, after)
+		})
+	case "meter-readings":
+		return export(w, format, func(after *MeterReadingExportRow) ([]MeterReadingExportRow, error) {
+			return s.exportMeterReadings(filter, after)
+		})
+	case "invoices":
+		return export(w, format, func(after *InvoiceLineExportRow) ([]InvoiceLineExportRow, error) {
+			return s.exportInvoiceLines(filter, after)
+		})
+	}
+	return nil
+}
+
+// export writes the pages that next returns, each after the last row of the
+// page before, until a page comes back short
+func export[T any](w io.Writer, format string, next func(after *T) ([]T, error)) error {
+	var write func(rows []T) error
+	var finish func() error
+	if format == FormatParquet {
+		writer := parquet.NewGenericWriter[T](w)
+		write = func(rows []T) error {
+			if _, err := writer.Write(rows); err != nil {
+				return err
+			}
+			return writer.Flush()
+		}
+		finish = writer.Close
+	} else {
+		writer := csv.NewWriter(w)
+		columns := reflect.TypeOf((*T)(nil)).Elem()
+		header := make([]string, columns.NumField())
+		for i := range header {
+			header[i] = columns.Field(i).Tag.Get("parquet")
+		}
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+		write = func(rows []T) error {
+			for i := range rows {
+				if err := writer.Write(csvRecord(reflect.ValueOf(rows[i]))); err != nil {
+					return err
+				}
+			}
+			writer.Flush()
+			return writer.Error()
+		}
+		finish = func() error { return nil }
+	}
+
+	var after *T
+	for {
+		rows, err := next(after)
+		if err != nil {
+			return err
+		}
+		if len(rows) > 0 {
+			if err := write(rows); err != nil {
+				return err
+			}
+			after = &rows[len(rows)-1]
+		}
+		if len(rows) < ExportPageSize {
+			return finish()
+		}
+	}
+}
+
+// csvRecord formats the fields of a row
+func csvRecord(row reflect.Value) []string {
+	record := make([]string, row.NumField())
+	for i := range record {
+		switch field := row.Field(i); field.Kind() {
+		case reflect.Float64:
+			record[i] = strconv.FormatFloat(field.Float(), 'f', -1, 64)
+		case reflect.Int64:
+			record[i] = strconv.FormatInt(field.Int(), 10)
+		default:
+			record[i] = field.String()
+		}
+	}
+	return record
+}
+
+// addressClause restricts a query to rows concerning the filter's address,
+// in any of columns; n is the number of the address's placeholder
+func addressClause(filter ExportFilter, n int, columns ...string) (string, []interface{}) {
+	if filter.Address == "" {
+		return "", nil
+	}
+	conditions := make([]string, len(columns))
+	for i, column := range columns {
+		conditions[i] = fmt.Sprintf("%s = $%d", column, n)
+	}
+	return " AND (" + strings.Join(conditions, " OR ") + ")", []interface{}{filter.Address}
+}
+
+func (s *Store) exportTrades(filter ExportFilter, after *TradeExportRow) ([]TradeExportRow, error) {
+	var lastStart, lastID string
+	if after != nil {
+		lastStart, lastID = after.DeliveryStart, after.TokenID
+	}
+	clause, args := addressClause(filter, 6, "buyer", "seller")
+	rows, err := s.db.Query(`SELECT token_id, buyer, seller, energy_amount, delivery_start, delivery_end, state, created_at, updated_at
+		FROM trades WHERE delivery_start >= $1 AND delivery_start < $2 AND (delivery_start > $3 OR (delivery_start = $3 AND token_id > $4))`+clause+`
+		ORDER BY delivery_start, token_id LIMIT $5`,
+		append([]interface{}{filter.From, filter.To, lastStart, lastID, ExportPageSize}, args...)...)
+	return scanExport(rows, err, func(rows *sql.Rows, r *TradeExportRow) error {
+		return rows.Scan(&r.TokenID, &r.Buyer, &r.Seller, &r.EnergyAmount, &r.DeliveryStart, &r.DeliveryEnd, &r.State, &r.CreatedAt, &r.UpdatedAt)
+	})
+}
+
+func (s *Store) exportSettlements(filter ExportFilter, after *SettlementExportRow) ([]SettlementExportRow, error) {
+	var lastSettled, lastID string
+	if after != nil {
+		lastSettled, lastID = after.SettledAt, after.TokenID
+	}
+	clause, args := addressClause(filter, 6, "t.buyer", "t.seller")
+	rows, err := s.db.Query(`SELECT s.token_id, COALESCE(t.buyer, ''), COALESCE(t.seller, ''), s.delivered_energy, s.shortfall, s.payment, s.imbalance_penalty, s.settled_at
+		FROM settlements s LEFT JOIN trades t ON t.token_id = s.token_id
+		WHERE s.settled_at >= $1 AND s.settled_at < $2 AND (s.settled_at > $3 OR (s.settled_at = $3 AND s.token_id > $4))`+clause+`
+		ORDER BY s.settled_at, s.token_id LIMIT $5`,
+		append([]interface{}{filter.From, filter.To, lastSettled, lastID, ExportPageSize}, args...)...)
+	return scanExport(rows, err, func(rows *sql.Rows, r *SettlementExportRow) error {
+		return rows.Scan(&r.TokenID, &r.Buyer, &r.Seller, &r.DeliveredEnergy, &r.Shortfall, &r.Payment, &r.ImbalancePenalty, &r.SettledAt)
+	})
+}
+
+func (s *Store) exportMeterReadings(filter ExportFilter, after *MeterReadingExportRow) ([]MeterReadingExportRow, error) {
+	var lastStart, lastID string
+	if after != nil {
+		lastStart, lastID = after.IntervalStart, after.MeterID
+	}
+	clause, args := addressClause(filter, 6, "owner")
+	rows, err := s.db.Query(`SELECT meter_id, owner, interval_start, interval_end, kwh_injected, kwh_consumed, submitted_at
+		FROM meter_readings WHERE interval_start >= $1 AND interval_start < $2 AND (interval_start > $3 OR (interval_start = $3 AND meter_id > $4))`+clause+`
+		ORDER BY interval_start, meter_id LIMIT $5`,
+		append([]interface{}{filter.From, filter.To, lastStart, lastID, ExportPageSize}, args...)...)
+	return scanExport(rows, err, func(rows *sql.Rows, r *MeterReadingExportRow) error {
+		return rows.Scan(&r.MeterID, &r.Owner, &r.IntervalStart, &r.IntervalEnd, &r.KWhInjected, &r.KWhConsumed, &r.SubmittedAt)
+	})
+}
+
+func (s *Store) exportInvoiceLines(filter ExportFilter, after *InvoiceLineExportRow) ([]InvoiceLineExportRow, error) {
+	var lastStart, lastNumber string
+	var lastLine int64
+	if after != nil {
+		lastStart, lastNumber, lastLine = after.PeriodStart, after.InvoiceNumber, after.Line
+	}
+	clause, args := addressClause(filter, 7, "i.participant")
+	rows, err := s.db.Query(`SELECT i.invoice_number, i.participant, i.period, i.period_start, i.period_end,
+			l.line, l.type, l.reference, l.description, l.quantity, l.amount, i.closed_at
+		FROM invoices i JOIN invoice_lines l ON l.invoice_number = i.invoice_number
+		WHERE i.period_start >= $1 AND i.period_start < $2
+			AND (i.period_start > $3 OR (i.period_start = $3 AND (i.invoice_number > $4 OR (i.invoice_number = $4 AND l.line > $5))))`+clause+`
+		ORDER BY i.period_start, i.invoice_number, l.line LIMIT $6`,
+		append([]interface{}{filter.From, filter.To, lastStart, lastNumber, lastLine, ExportPageSize}, args...)...)
+	return scanExport(rows, err, func(rows *sql.Rows, r *InvoiceLineExportRow) error {
+		return rows.Scan(&r.InvoiceNumber, &r.Participant, &r.Period, &r.PeriodStart, &r.PeriodEnd,
+			&r.Line, &r.Type, &r.Reference, &r.Description, &r.Quantity, &r.Amount, &r.ClosedAt)
+	})
+}
+
+// scanExport reads a page of rows and closes them, releasing the connection
+func scanExport[T any](rows *sql.Rows, err error, scan func(*sql.Rows, *T) error) ([]T, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	page := []T{}
+	for rows.Next() {
+		var row T
+		if err := scan(rows, &row); err != nil {
+			return nil, err
+		}
+		page = append(page, row)
+	}
+	return page, rows.Err()
+}
@@ -0,0 +1,133 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestExportPages(t *testing.T) {
+	store := openTestStore(t)
+	tx, err := store.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two readings share every minute so that pages break inside one
+	for i := 0; i < ExportPageSize+3; i++ {
+		start := time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i/2) * time.Minute).Format(time.RFC3339)
+		if _, err := tx.Exec(`INSERT INTO meter_readings (meter_id, interval_start, interval_end, owner, kwh_injected, kwh_consumed, submitted_at)
+			VALUES ($1, $2, $2, $3, 1.5, 0, $2)`, fmt.Sprintf("meter%d", i%2), start, fmt.Sprintf("owner%d", i%2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := store.Export(&out, "meter-readings", FormatCSV, ExportFilter{From: "2025-05-01", To: "2025-05-03"}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != ExportPageSize+4 {
+		t.Fatalf("got %d CSV records, want %d", len(records), ExportPageSize+4)
+	}
+	if records[0][0] != "meter_id" || records[1][0] != "meter0" || records[2][0] != "meter1" || records[1][4] != "1.5" {
+		t.Errorf("got CSV records %v", records[:3])
+	}
+	seen := map[string]bool{}
+	for _, record := range records[1:] {
+		key := record[0] + record[2]
+		if seen[key] {
+			t.Fatalf("reading %s exported twice", key)
+		}
+		seen[key] = true
+	}
+
+	out.Reset()
+	if err := store.Export(&out, "meter-readings", FormatParquet, ExportFilter{From: "2025-05-01", To: "2025-05-03", Address: "owner1"}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := parquet.Read[MeterReadingExportRow](bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != (ExportPageSize+3)/2 || rows[0].Owner != "owner1" || rows[0].KWhInjected != 1.5 {
+		t.Errorf("got %d Parquet rows, the first %+v", len(rows), rows[0])
+	}
+}
+
+func TestExportInvoices(t *testing.T) {
+	store := openTestStore(t)
+	invoice := map[string]interface{}{
+		"invoiceNumber": "INV-2025-04-prosumer1", "participant": "prosumer1", "period": "2025-04",
+		"periodStart": "2025-04-01T00:00:00Z", "periodEnd": "2025-05-01T00:00:00Z", "closedAt": "2025-05-01T01:00:00Z",
+		"lines": []map[string]interface{}{
+			{"type": "SALE", "reference": "asset1", "description": "Energy sold", "quantity": 10, "amount": 2},
+			{"type": "NETWORK_FEE", "reference": "asset1", "description": "Network fee", "quantity": 10, "amount": -0.1},
+		},
+	}
+	events := []*client.ChaincodeEvent{
+		testEvent(t, 5, 1, eventAssetCreated, "2025-04-01T08:00:00Z", tradeEvent{TokenID: "asset1", Buyer: "buyer1", Seller: "prosumer1", EnergyAmount: 10, State: "CREATED", DeliveryStart: "2025-04-02T10:00:00Z"}),
+		testEvent(t, 9, 2, eventInvoiceIssued, "2025-05-01T01:00:00Z", invoice),
+	}
+	for _, event := range events {
+		if err := store.ApplyChaincodeEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(Handler(store))
+	defer server.Close()
+	for _, query := range []string{"/export/invoices?from=2025-04-01", "/export/bids?from=2025-04-01&to=2025-05-01", "/export/trades?from=2025-04-01&to=2025-05-01&format=xlsx"} {
+		response, err := http.Get(server.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("got status %d for %s, want 400", response.StatusCode, query)
+		}
+	}
+
+	response, err := http.Get(server.URL + "/export/invoices?from=2025-04-01&to=2025-05-01&address=prosumer1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "text/csv" || response.Header.Get("Content-Disposition") != `attachment; filename="invoices.csv"` {
+		t.Errorf("got headers %v", response.Header)
+	}
+	records, err := csv.NewReader(response.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[1][5] != "1" || records[2][6] != "NETWORK_FEE" || records[2][10] != "-0.1" {
+		t.Errorf("got CSV records %v", records)
+	}
+
+	// The invoice table is filled from recorded events when it is added
+	if _, err := store.db.Exec("DELETE FROM invoice_lines"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.Exec("DELETE FROM invoices"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.backfill(eventInvoiceIssued); err != nil {
+		t.Fatal(err)
+	}
+	var lines int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM invoice_lines").Scan(&lines); err != nil || lines != 2 {
+		t.Errorf("got %d invoice lines after the backfill: %v", lines, err)
+	}
+}
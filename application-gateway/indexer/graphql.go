@@ -0,0 +1,351 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"application-gateway/fabric"
+
+	"github.com/graph-gophers/graphql-go"
+)
+
+// graphQLSchema lets dashboards walk from a participant to its trades, and
+// from a trade to the meter readings of its delivery window and its
+// settlement, in one query. Lists of trades are paged with cursors.
+// Subscriptions push events as they are indexed.
+const graphQLSchema = `
+schema {
+	query: Query
+	subscription: Subscription
+}
+
+type Query {
+	participant(address: String!): Participant
+	trade(tokenID: String!): Trade
+	trades(first: Int, after: String): TradeConnection!
+}
+
+type Subscription {
+	# events pushes every indexed chaincode event, or those named in names
+	events(names: [String!]): Event!
+	# tradeUpdated pushes a trade each time it changes state, optionally only
+	# the trades the address is buyer or seller in
+	tradeUpdated(address: String): Trade!
+}
+
+type Participant {
+	address: String!
+	kycStatus: String!
+	registeredAt: String!
+	updatedAt: String!
+	trades(first: Int, after: String): TradeConnection!
+	meterReadings(from: String!, to: String!): [MeterReading!]!
+}
+
+type Trade {
+	tokenID: String!
+	buyer: String!
+	seller: String!
+	energyAmount: Float!
+	deliveryStart: String!
+	deliveryEnd: String!
+	state: String!
+	createdAt: String!
+	updatedAt: String!
+	prunedOnChain: Boolean!
+	history: [TradeStateChange!]!
+	# meterReadings are the buyer's and seller's readings in the delivery window
+	meterReadings: [MeterReading!]!
+	settlement: Settlement
+}
+
+type TradeConnection {
+	edges: [TradeEdge!]!
+	pageInfo: PageInfo!
+}
+
+type TradeEdge {
+	cursor: String!
+	node: Trade!
+}
+
+type PageInfo {
+	endCursor: String
+	hasNextPage: Boolean!
+}
+
+type TradeStateChange {
+	sequence: Float!
+	eventName: String!
+	state: String!
+	timestamp: String!
+}
+
+type MeterReading {
+	meterID: String!
+	owner: String!
+	intervalStart: String!
+	intervalEnd: String!
+	kWhInjected: Float!
+	kWhConsumed: Float!
+	submittedAt: String!
+}
+
+type Settlement {
+	deliveredEnergy: Float!
+	shortfall: Float!
+	payment: Float!
+	imbalancePenalty: Float!
+	settledAt: String!
+}
+
+type Event {
+	sequence: Float!
+	name: String!
+	txID: String!
+	timestamp: String!
+	# payload is the event payload as JSON
+	payload: String!
+}
+`
+
+// tradeEventNames are the events that change a trade's state
+var tradeEventNames = map[string]bool{
+	eventAssetCreated:     true,
+	eventTradeSigned:      true,
+	eventTradeConfirmed:   true,
+	eventDeliveryRecorded: true,
+	eventTradeSettled:     true,
+}
+
+// newGraphQLSchema returns the executable GraphQL schema over the store
+func newGraphQLSchema(store *Store) *graphql.Schema {
+	return graphql.MustParseSchema(graphQLSchema, &rootResolver{store: store}, graphql.UseFieldResolvers())
+}
+
+type rootResolver struct {
+	store *Store
+}
+
+type pageArgs struct {
+	First *int32
+	After *string
+}
+
+func (r *rootResolver) Participant(args struct{ Address string }) (*participantResolver, error) {
+	participant, err := r.store.Participant(args.Address)
+	if err != nil || participant == nil {
+		return nil, err
+	}
+	return &participantResolver{r.store, *participant}, nil
+}
+
+func (r *rootResolver) Trade(args struct{ TokenID string }) (*tradeResolver, error) {
+	trade, err := r.store.Trade(args.TokenID)
+	if err != nil || trade == nil {
+		return nil, err
+	}
+	return &tradeResolver{r.store, *trade}, nil
+}
+
+func (r *rootResolver) Trades(args pageArgs) (*tradeConnection, error) {
+	return tradesPage(r.store, "", args)
+}
+
+func (r *rootResolver) Events(ctx context.Context, args struct{ Names *[]string }) <-chan *eventResolver {
+	names := map[string]bool{}
+	if args.Names != nil {
+		for _, name := range *args.Names {
+			names[name] = true
+		}
+	}
+	events := r.store.Subscribe(ctx)
+	results := make(chan *eventResolver)
+	go func() {
+		defer close(results)
+		for env := range events {
+			if len(names) > 0 && !names[env.Name] {
+				continue
+			}
+			select {
+			case results <- &eventResolver{env}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return results
+}
+
+func (r *rootResolver) TradeUpdated(ctx context.Context, args struct{ Address *string }) <-chan *tradeResolver {
+	events := r.store.Subscribe(ctx)
+	results := make(chan *tradeResolver)
+	go func() {
+		defer close(results)
+		for env := range events {
+			if !tradeEventNames[env.Name] {
+				continue
+			}
+			var event struct {
+				TokenID string `json:"tokenID"`
+			}
+			if err := json.Unmarshal(env.Payload, &event); err != nil {
+				continue
+			}
+			trade, err := r.store.Trade(event.TokenID)
+			if err != nil || trade == nil {
+				continue
+			}
+			if args.Address != nil && trade.Buyer != *args.Address && trade.Seller != *args.Address {
+				continue
+			}
+			select {
+			case results <- &tradeResolver{r.store, *trade}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return results
+}
+
+// tradesPage resolves a page of trades, of an address if it is not empty
+func tradesPage(store *Store, address string, args pageArgs) (*tradeConnection, error) {
+	first, after := int32(DefaultLimit), ""
+	if args.First != nil {
+		first = *args.First
+	}
+	if first <= 0 || first > MaxLimit {
+		return nil, fmt.Errorf("first must be between 1 and %d", MaxLimit)
+	}
+	if args.After != nil {
+		after = *args.After
+	}
+	trades, more, err := store.TradesPage(address, int(first), after)
+	if err != nil {
+		return nil, err
+	}
+	connection := &tradeConnection{Edges: []*tradeEdge{}, PageInfo: &pageInfo{HasNextPage: more}}
+	for _, trade := range trades {
+		connection.Edges = append(connection.Edges, &tradeEdge{Cursor: TradeCursor(trade), Node: &tradeResolver{store, *trade}})
+	}
+	if len(trades) > 0 {
+		connection.PageInfo.EndCursor = &connection.Edges[len(trades)-1].Cursor
+	}
+	return connection, nil
+}
+
+// participantResolver embeds the record by value, as graphql-go resolves
+// fields through embedded structs but not through embedded pointers
+type participantResolver struct {
+	store *Store
+	ParticipantRecord
+}
+
+func (r *participantResolver) KycStatus() string {
+	return r.KYCStatus
+}
+
+func (r *participantResolver) Trades(args pageArgs) (*tradeConnection, error) {
+	return tradesPage(r.store, r.Address, args)
+}
+
+func (r *participantResolver) MeterReadings(args struct{ From, To string }) ([]*MeterReadingRecord, error) {
+	return r.store.MeterReadings([]string{r.Address}, args.From, args.To)
+}
+
+type tradeResolver struct {
+	store *Store
+	TradeRecord
+}
+
+func (r *tradeResolver) History() ([]*tradeStateChangeResolver, error) {
+	changes, err := r.store.TradeStateChanges(r.TokenID)
+	if err != nil {
+		return nil, err
+	}
+	resolvers := make([]*tradeStateChangeResolver, 0, len(changes))
+	for _, change := range changes {
+		resolvers = append(resolvers, &tradeStateChangeResolver{*change})
+	}
+	return resolvers, nil
+}
+
+func (r *tradeResolver) MeterReadings() ([]*MeterReadingRecord, error) {
+	return r.store.MeterReadings([]string{r.Buyer, r.Seller}, r.DeliveryStart, r.DeliveryEnd)
+}
+
+func (r *tradeResolver) Settlement() (*SettlementRecord, error) {
+	return r.store.Settlement(r.TokenID)
+}
+
+type tradeConnection struct {
+	Edges    []*tradeEdge
+	PageInfo *pageInfo
+}
+
+type tradeEdge struct {
+	Cursor string
+	Node   *tradeResolver
+}
+
+type pageInfo struct {
+	EndCursor   *string
+	HasNextPage bool
+}
+
+// tradeStateChangeResolver exposes the sequence as a Float, as GraphQL's Int
+// is 32 bits
+type tradeStateChangeResolver struct {
+	TradeStateChange
+}
+
+func (r *tradeStateChangeResolver) Sequence() float64 {
+	return float64(r.TradeStateChange.Sequence)
+}
+
+type eventResolver struct {
+	env *fabric.EventEnvelope
+}
+
+func (r *eventResolver) Sequence() float64 {
+	return float64(r.env.Sequence)
+}
+
+func (r *eventResolver) Name() string {
+	return r.env.Name
+}
+
+func (r *eventResolver) TxID() string {
+	return r.env.TxID
+}
+
+func (r *eventResolver) Timestamp() string {
+	return r.env.Timestamp
+}
+
+func (r *eventResolver) Payload() string {
+	return string(r.env.Payload)
+}
+
+// graphQLRequest is a GraphQL request as sent over HTTP or in a WebSocket
+// subscribe message
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// serveGraphQL executes a query sent as JSON in a POST body
+func serveGraphQL(schema *graphql.Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request graphQLRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid GraphQL request: %w", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, schema.Exec(r.Context(), request.Query, request.OperationName, request.Variables))
+	}
+}
@@ -0,0 +1,230 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+func TestGraphQLNestedQuery(t *testing.T) {
+	store := openTestStore(t)
+	trade := tradeEvent{TokenID: "asset1", State: "CREATED", Buyer: "buyer1", Seller: "seller1", EnergyAmount: 10,
+		DeliveryStart: "2025-05-03T10:00:00Z", DeliveryEnd: "2025-05-03T11:00:00Z"}
+	events := []*client.ChaincodeEvent{
+		testEvent(t, 1, 1, eventParticipantRegistered, "2025-05-01T07:00:00Z", participantEvent{Address: "buyer1", Status: "PENDING"}),
+		testEvent(t, 2, 2, eventParticipantReviewed, "2025-05-01T07:30:00Z", participantEvent{Address: "buyer1", Status: "APPROVED"}),
+		testEvent(t, 3, 3, eventAssetCreated, "2025-05-01T08:00:00Z", trade),
+		testEvent(t, 4, 4, eventMeterReadingSubmitted, "2025-05-03T11:05:00Z", meterReadingEvent{MeterID: "meter1", Owner: "buyer1",
+			IntervalStart: "2025-05-03T10:00:00Z", IntervalEnd: "2025-05-03T10:15:00Z", KWhConsumed: 2.5, SubmittedAt: "2025-05-03T11:05:00Z"}),
+		testEvent(t, 5, 5, eventMeterReadingSubmitted, "2025-05-03T13:05:00Z", meterReadingEvent{MeterID: "meter1", Owner: "buyer1",
+			IntervalStart: "2025-05-03T12:00:00Z", IntervalEnd: "2025-05-03T12:15:00Z", KWhConsumed: 1, SubmittedAt: "2025-05-03T13:05:00Z"}),
+		testEvent(t, 6, 6, eventTradeSettled, "2025-05-03T14:00:00Z",
+			settlementEvent{TokenID: "asset1", DeliveredEnergy: 8, Payment: 1.6, Shortfall: 2, SettledAt: "2025-05-03T14:00:00Z"}),
+	}
+	for _, event := range events {
+		if err := store.ApplyChaincodeEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := `{
+		participant(address: "buyer1") {
+			kycStatus
+			trades(first: 5) {
+				edges { node { tokenID seller deliveryStart history { state } meterReadings { meterID kWhConsumed } settlement { payment } } }
+			}
+		}
+	}`
+	response := newGraphQLSchema(store).Exec(context.Background(), query, "", nil)
+	if len(response.Errors) > 0 {
+		t.Fatal(response.Errors)
+	}
+	var data struct {
+		Participant struct {
+			KycStatus string
+			Trades    struct {
+				Edges []struct {
+					Node struct {
+						TokenID       string
+						Seller        string
+						DeliveryStart string
+						History       []struct{ State string }
+						MeterReadings []struct {
+							MeterID     string
+							KWhConsumed float64
+						}
+						Settlement *struct{ Payment float64 }
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(response.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Participant.KycStatus != "APPROVED" {
+		t.Errorf("got KYC status %q, want APPROVED", data.Participant.KycStatus)
+	}
+	if len(data.Participant.Trades.Edges) != 1 {
+		t.Fatalf("got %d trades, want 1", len(data.Participant.Trades.Edges))
+	}
+	node := data.Participant.Trades.Edges[0].Node
+	if node.TokenID != "asset1" || node.Seller != "seller1" || node.DeliveryStart != "2025-05-03T10:00:00Z" || len(node.History) != 2 {
+		t.Errorf("got trade %+v", node)
+	}
+	// only the reading inside the delivery window belongs to the trade
+	if len(node.MeterReadings) != 1 || node.MeterReadings[0].KWhConsumed != 2.5 {
+		t.Errorf("got meter readings %+v", node.MeterReadings)
+	}
+	if node.Settlement == nil || node.Settlement.Payment != 1.6 {
+		t.Errorf("got settlement %+v", node.Settlement)
+	}
+}
+
+func TestGraphQLTradePagination(t *testing.T) {
+	store := openTestStore(t)
+	for i, tokenID := range []string{"asset1", "asset2", "asset3"} {
+		trade := tradeEvent{TokenID: tokenID, State: "CREATED", Buyer: "buyer1", Seller: "seller1", EnergyAmount: 10}
+		timestamp := time.Date(2025, 5, 1, 8+i, 0, 0, 0, time.UTC).Format(time.RFC3339)
+		if err := store.ApplyChaincodeEvent(testEvent(t, uint64(i+1), uint64(i+1), eventAssetCreated, timestamp, trade)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	schema := newGraphQLSchema(store)
+	query := `query($after: String) {
+		trades(first: 2, after: $after) { edges { node { tokenID } } pageInfo { endCursor hasNextPage } }
+	}`
+	var tokenIDs []string
+	var after interface{}
+	for page := 0; ; page++ {
+		if page > 2 {
+			t.Fatal("pagination did not end")
+		}
+		response := schema.Exec(context.Background(), query, "", map[string]interface{}{"after": after})
+		if len(response.Errors) > 0 {
+			t.Fatal(response.Errors)
+		}
+		var data struct {
+			Trades struct {
+				Edges []struct {
+					Node struct{ TokenID string }
+				}
+				PageInfo struct {
+					EndCursor   *string
+					HasNextPage bool
+				}
+			}
+		}
+		if err := json.Unmarshal(response.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		for _, edge := range data.Trades.Edges {
+			tokenIDs = append(tokenIDs, edge.Node.TokenID)
+		}
+		if !data.Trades.PageInfo.HasNextPage {
+			break
+		}
+		after = *data.Trades.PageInfo.EndCursor
+	}
+	if len(tokenIDs) != 3 || tokenIDs[0] != "asset3" || tokenIDs[2] != "asset1" {
+		t.Errorf("got trades %v, want newest first", tokenIDs)
+	}
+
+	response := schema.Exec(context.Background(), `{ trades(after: "not a cursor") { edges { cursor } } }`, "", nil)
+	if len(response.Errors) == 0 {
+		t.Error("an invalid cursor was accepted")
+	}
+}
+
+func TestGraphQLSubscription(t *testing.T) {
+	store := openTestStore(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	responses, err := newGraphQLSchema(store).Subscribe(ctx, `subscription { tradeUpdated(address: "seller1") { tokenID state } }`, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := tradeEvent{TokenID: "asset1", State: "CREATED", Buyer: "buyer2", Seller: "seller2", EnergyAmount: 5}
+	trade := tradeEvent{TokenID: "asset2", State: "CREATED", Buyer: "buyer1", Seller: "seller1", EnergyAmount: 10}
+	for i, event := range []*client.ChaincodeEvent{
+		testEvent(t, 1, 1, eventAssetCreated, "2025-05-01T08:00:00Z", other),
+		testEvent(t, 2, 2, eventReferencePricePosted, "2025-05-01T08:00:00Z", referencePriceEvent{Period: "2025-05-03T10:00:00Z", Price: 0.2}),
+		testEvent(t, 3, 3, eventAssetCreated, "2025-05-01T09:00:00Z", trade),
+	} {
+		if err := store.ApplyChaincodeEvent(event); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+	}
+
+	select {
+	case response := <-responses:
+		body, err := json.Marshal(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"data":{"tradeUpdated":{"tokenID":"asset2","state":"CREATED"}}}`; string(body) != want {
+			t.Errorf("got %s, want %s", body, want)
+		}
+	case <-ctx.Done():
+		t.Fatal("no trade update was pushed")
+	}
+}
+
+func TestGraphQLWebSocket(t *testing.T) {
+	store := openTestStore(t)
+	server := httptest.NewServer(Handler(store))
+	defer server.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{graphQLWSProtocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/graphql", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var message wsMessage
+	if err := conn.WriteJSON(wsMessage{Type: "connection_init"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&message); err != nil || message.Type != "connection_ack" {
+		t.Fatalf("got %+v, %v, want connection_ack", message, err)
+	}
+	payload, _ := json.Marshal(graphQLRequest{Query: `subscription { events(names: ["ParticipantRegistered"]) { name payload } }`})
+	if err := conn.WriteJSON(wsMessage{ID: "1", Type: "subscribe", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the subscription starts asynchronously, so keep indexing until it pushes
+	pushed := make(chan wsMessage, 1)
+	go func() {
+		var message wsMessage
+		conn.ReadJSON(&message)
+		pushed <- message
+	}()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for sequence := uint64(1); ; sequence++ {
+		select {
+		case message = <-pushed:
+		case <-ticker.C:
+			event := testEvent(t, sequence, sequence, eventParticipantRegistered, time.Now().UTC().Format(time.RFC3339Nano), participantEvent{Address: "buyer1", Status: "PENDING"})
+			if err := store.ApplyChaincodeEvent(event); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		break
+	}
+	if message.ID != "1" || message.Type != "next" || !strings.Contains(string(message.Payload), `"name":"ParticipantRegistered"`) {
+		t.Errorf("got %s %s %s", message.ID, message.Type, message.Payload)
+	}
+}
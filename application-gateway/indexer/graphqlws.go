@@ -0,0 +1,198 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graph-gophers/graphql-go"
+)
+
+// graphQLWSProtocol is the WebSocket subprotocol of the graphql-ws library,
+// which GraphQL clients such as Apollo and urql use for subscriptions
+const graphQLWSProtocol = "graphql-transport-ws"
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+)
+
+// Close codes of the graphql-transport-ws protocol
+const (
+	closeBadRequest    = 4400
+	closeUnauthorized  = 4401
+	closeSubscriberDup = 4409
+)
+
+// wsMessage is a graphql-transport-ws protocol message
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// wsConnection is one client's WebSocket and its running operations. Writes
+// are serialized because every operation pushes from its own goroutine.
+type wsConnection struct {
+	conn   *websocket.Conn
+	schema *graphql.Schema
+
+	mu         sync.Mutex
+	operations map[string]context.CancelFunc
+}
+
+func (c *wsConnection) write(message wsMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(message)
+}
+
+func (c *wsConnection) close(code int, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+}
+
+// serveGraphQLWebSocket runs subscriptions, and any other operation, over a
+// WebSocket speaking the graphql-transport-ws protocol
+func serveGraphQLWebSocket(schema *graphql.Schema) http.HandlerFunc {
+	upgrader := websocket.Upgrader{Subprotocols: []string{graphQLWSProtocol}}
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if conn.Subprotocol() != graphQLWSProtocol {
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, "subprotocol "+graphQLWSProtocol+" is required"),
+				time.Now().Add(wsWriteTimeout))
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		c := &wsConnection{conn: conn, schema: schema, operations: map[string]context.CancelFunc{}}
+		go c.ping(ctx)
+		c.read(ctx)
+	}
+}
+
+// ping keeps the connection alive through proxies until ctx is done
+func (c *wsConnection) ping(ctx context.Context) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			c.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// read handles client messages until the client leaves or breaks the protocol
+func (c *wsConnection) read(ctx context.Context) {
+	acknowledged := false
+	for {
+		var message wsMessage
+		if err := c.conn.ReadJSON(&message); err != nil {
+			return
+		}
+		switch message.Type {
+		case "connection_init":
+			if acknowledged {
+				c.close(closeBadRequest, "too many initialisation requests")
+				return
+			}
+			acknowledged = true
+			if err := c.write(wsMessage{Type: "connection_ack"}); err != nil {
+				return
+			}
+		case "ping":
+			if err := c.write(wsMessage{Type: "pong"}); err != nil {
+				return
+			}
+		case "pong":
+		case "subscribe":
+			if !acknowledged {
+				c.close(closeUnauthorized, "unauthorized")
+				return
+			}
+			var request graphQLRequest
+			if message.ID == "" || json.Unmarshal(message.Payload, &request) != nil {
+				c.close(closeBadRequest, "invalid subscribe message")
+				return
+			}
+			if !c.start(ctx, message.ID, request) {
+				c.close(closeSubscriberDup, "subscriber for "+message.ID+" already exists")
+				return
+			}
+		case "complete":
+			c.mu.Lock()
+			if stop, ok := c.operations[message.ID]; ok {
+				stop()
+				delete(c.operations, message.ID)
+			}
+			c.mu.Unlock()
+		default:
+			c.close(closeBadRequest, "unknown message type "+message.Type)
+			return
+		}
+	}
+}
+
+// start runs an operation, pushing each of its results until it ends or the
+// client completes it. It returns false if the operation ID is in use.
+func (c *wsConnection) start(ctx context.Context, id string, request graphQLRequest) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.operations[id]; ok {
+		return false
+	}
+	opCtx, stop := context.WithCancel(ctx)
+	c.operations[id] = stop
+
+	go func() {
+		defer stop()
+		responses, err := c.schema.Subscribe(opCtx, request.Query, request.OperationName, request.Variables)
+		if err != nil {
+			payload, _ := json.Marshal([]map[string]string{{"message": err.Error()}})
+			c.write(wsMessage{ID: id, Type: "error", Payload: payload})
+			c.finish(id)
+			return
+		}
+		for response := range responses {
+			payload, err := json.Marshal(response)
+			if err != nil {
+				continue
+			}
+			if err := c.write(wsMessage{ID: id, Type: "next", Payload: payload}); err != nil {
+				return
+			}
+		}
+		// An operation the client completed must not be completed again
+		if c.finish(id) {
+			c.write(wsMessage{ID: id, Type: "complete"})
+		}
+	}()
+	return true
+}
+
+// finish forgets an operation, reporting whether it was still running
+func (c *wsConnection) finish(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.operations[id]
+	delete(c.operations, id)
+	return ok
+}
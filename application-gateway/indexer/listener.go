@@ -0,0 +1,85 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"application-gateway/metrics"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// Listener feeds chaincode and filtered block events from a channel into the
+// store, resuming each stream from its stored checkpoint.
+type Listener struct {
+	store         *Store
+	network       *client.Network
+	chaincodeName string
+}
+
+// NewListener returns a listener for the chaincode's events on network
+func NewListener(store *Store, network *client.Network, chaincodeName string) *Listener {
+	return &Listener{store: store, network: network, chaincodeName: chaincodeName}
+}
+
+// Run processes both streams until ctx is cancelled or either stream fails.
+// A stream with no checkpoint starts from the genesis block.
+func (l *Listener) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	go func() { errs <- l.listenChaincodeEvents(ctx) }()
+	go func() { errs <- l.listenBlocks(ctx) }()
+
+	err := <-errs
+	cancel()
+	<-errs
+	return err
+}
+
+func (l *Listener) listenChaincodeEvents(ctx context.Context) error {
+	cp, err := l.store.Checkpoint(ChaincodeStream)
+	if err != nil {
+		return err
+	}
+	events, err := l.network.ChaincodeEvents(ctx, l.chaincodeName, client.WithStartBlock(0), client.WithCheckpoint(cp))
+	if err != nil {
+		return fmt.Errorf("failed to start chaincode event listening: %w", err)
+	}
+	for event := range events {
+		if err := l.store.ApplyChaincodeEvent(event); err != nil {
+			return err
+		}
+		metrics.EventProcessed(ChaincodeStream, event.EventName, event.BlockNumber)
+	}
+	return streamClosed(ctx, ChaincodeStream)
+}
+
+func (l *Listener) listenBlocks(ctx context.Context) error {
+	cp, err := l.store.Checkpoint(BlockStream)
+	if err != nil {
+		return err
+	}
+	blocks, err := l.network.FilteredBlockEvents(ctx, client.WithStartBlock(0), client.WithCheckpoint(cp))
+	if err != nil {
+		return fmt.Errorf("failed to start block event listening: %w", err)
+	}
+	for block := range blocks {
+		if err := l.store.ApplyBlock(block); err != nil {
+			return err
+		}
+		metrics.EventProcessed(BlockStream, "block", block.GetNumber())
+	}
+	return streamClosed(ctx, BlockStream)
+}
+
+// streamClosed reports why an event channel closed: cancellation, or the
+// connection to the peer ending.
+func streamClosed(ctx context.Context, stream string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.New(stream + " event stream closed")
+}
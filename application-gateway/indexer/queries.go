@@ -0,0 +1,423 @@
+package indexer
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// TradeRecord is an indexed trade, with its settlement once settled
+type TradeRecord struct {
+	TokenID         string   `json:"tokenID"`
+	Buyer           string   `json:"buyer"`
+	Seller          string   `json:"seller"`
+	EnergyAmount    float64  `json:"energyAmount"`
+	DeliveryStart   string   `json:"deliveryStart"`
+	DeliveryEnd     string   `json:"deliveryEnd"`
+	State           string   `json:"state"`
+	CreatedAt       string   `json:"createdAt"`
+	UpdatedAt       string   `json:"updatedAt"`
+	DeliveredEnergy *float64 `json:"deliveredEnergy,omitempty"`
+	Payment         *float64 `json:"payment,omitempty"`
+	SettledPrice    *float64 `json:"settledPrice,omitempty"`
+	// PrunedOnChain is set once the trade's detail has been pruned from the
+	// ledger and is only available from the index
+	PrunedOnChain bool `json:"prunedOnChain,omitempty"`
+}
+
+// TradeStateChange is one lifecycle event of a trade
+type TradeStateChange struct {
+	Sequence  uint64 `json:"sequence"`
+	EventName string `json:"eventName"`
+	State     string `json:"state"`
+	Timestamp string `json:"timestamp"`
+}
+
+// PricePoint is a reference price for the period starting at Period
+type PricePoint struct {
+	Period string  `json:"period"`
+	Price  float64 `json:"price"`
+}
+
+// ClearingPrice is the settled price of the energy delivered in the hour
+// starting at Period, weighted by the energy each trade delivered
+type ClearingPrice struct {
+	Period string  `json:"period"`
+	Price  float64 `json:"price"`
+	Volume float64 `json:"volume"`
+}
+
+// DailyRollup is the chaincode's aggregate of the trades delivered on a day
+type DailyRollup struct {
+	Day                string  `json:"day"`
+	TradeCount         int     `json:"tradeCount"`
+	ContractedEnergy   float64 `json:"contractedEnergy"`
+	DeliveredEnergy    float64 `json:"deliveredEnergy"`
+	TradedValue        float64 `json:"tradedValue"`
+	Levies             float64 `json:"levies"`
+	NetworkFees        float64 `json:"networkFees"`
+	Subsidies          float64 `json:"subsidies"`
+	Shortfall          float64 `json:"shortfall"`
+	ImbalancePenalties float64 `json:"imbalancePenalties"`
+	GridImbalance      float64 `json:"gridImbalance"`
+}
+
+// ParticipantRecord is a registered participant and its latest KYC status
+type ParticipantRecord struct {
+	Address      string `json:"address"`
+	KYCStatus    string `json:"kycStatus"`
+	RegisteredAt string `json:"registeredAt"`
+	UpdatedAt    string `json:"updatedAt"`
+}
+
+// MeterReadingRecord is a meter's reading for one interval
+type MeterReadingRecord struct {
+	MeterID       string  `json:"meterID"`
+	Owner         string  `json:"owner"`
+	IntervalStart string  `json:"intervalStart"`
+	IntervalEnd   string  `json:"intervalEnd"`
+	KWhInjected   float64 `json:"kWhInjected"`
+	KWhConsumed   float64 `json:"kWhConsumed"`
+	SubmittedAt   string  `json:"submittedAt"`
+}
+
+// SettlementRecord is the settlement of a trade
+type SettlementRecord struct {
+	TokenID          string  `json:"tokenID"`
+	DeliveredEnergy  float64 `json:"deliveredEnergy"`
+	Shortfall        float64 `json:"shortfall"`
+	Payment          float64 `json:"payment"`
+	ImbalancePenalty float64 `json:"imbalancePenalty"`
+	SettledAt        string  `json:"settledAt"`
+}
+
+// OracleFeed is the latest posting of one oracle event
+type OracleFeed struct {
+	Name         string `json:"name"`
+	LastPostedAt string `json:"lastPostedAt"`
+	Posts        int    `json:"posts"`
+}
+
+// TokenMovement is a mint or transfer; From is empty for mints
+type TokenMovement struct {
+	Sequence  uint64  `json:"sequence"`
+	From      string  `json:"from,omitempty"`
+	To        string  `json:"to"`
+	Amount    float64 `json:"amount"`
+	Timestamp string  `json:"timestamp"`
+}
+
+// tradeColumns selects a trade with its settlement and pruning, in the order
+// scanTrade reads them
+const tradeColumns = `SELECT t.token_id, t.buyer, t.seller, t.energy_amount, t.delivery_start, t.delivery_end, t.state, t.created_at, t.updated_at,
+			s.delivered_energy, s.payment, p.token_id IS NOT NULL
+		FROM trades t LEFT JOIN settlements s ON s.token_id = t.token_id
+			LEFT JOIN pruned_trades p ON p.token_id = t.token_id`
+
+// scanTrade reads a row selected with tradeColumns. The settled price is the
+// payment per delivered kWh.
+func scanTrade(row interface{ Scan(...interface{}) error }) (*TradeRecord, error) {
+	var trade TradeRecord
+	var delivered, payment sql.NullFloat64
+	if err := row.Scan(&trade.TokenID, &trade.Buyer, &trade.Seller, &trade.EnergyAmount, &trade.DeliveryStart, &trade.DeliveryEnd, &trade.State,
+		&trade.CreatedAt, &trade.UpdatedAt, &delivered, &payment, &trade.PrunedOnChain); err != nil {
+		return nil, err
+	}
+	if delivered.Valid && payment.Valid {
+		trade.DeliveredEnergy = &delivered.Float64
+		trade.Payment = &payment.Float64
+		if delivered.Float64 > 0 {
+			price := payment.Float64 / delivered.Float64
+			trade.SettledPrice = &price
+		}
+	}
+	return &trade, nil
+}
+
+func queryTrades(db *sql.DB, query string, args ...interface{}) ([]*TradeRecord, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trades := []*TradeRecord{}
+	for rows.Next() {
+		trade, err := scanTrade(rows)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+	return trades, rows.Err()
+}
+
+// TradeHistory returns the trades an address is buyer or seller in, newest
+// first
+func (s *Store) TradeHistory(address string, limit int) ([]*TradeRecord, error) {
+	return queryTrades(s.db, tradeColumns+`
+		WHERE t.buyer = $1 OR t.seller = $1
+		ORDER BY t.created_at DESC, t.token_id
+		LIMIT $2`, address, limit)
+}
+
+// Trade returns an indexed trade, or nil if it has not been indexed
+func (s *Store) Trade(tokenID string) (*TradeRecord, error) {
+	trade, err := scanTrade(s.db.QueryRow(tradeColumns+" WHERE t.token_id = $1", tokenID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return trade, err
+}
+
+// TradeCursor returns the opaque cursor of a trade's position in TradesPage
+func TradeCursor(trade *TradeRecord) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(trade.CreatedAt + "|" + trade.TokenID))
+}
+
+// TradesPage returns up to first trades, newest first, that follow the trade
+// at cursor after, or from the newest if after is empty. With an address
+// only its trades as buyer or seller are returned. It also reports whether
+// more trades follow the page.
+func (s *Store) TradesPage(address string, first int, after string) ([]*TradeRecord, bool, error) {
+	createdAt, tokenID := "\uffff", ""
+	if after != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(after)
+		position := strings.SplitN(string(decoded), "|", 2)
+		if err != nil || len(position) != 2 {
+			return nil, false, errors.New("invalid cursor")
+		}
+		createdAt, tokenID = position[0], position[1]
+	}
+	trades, err := queryTrades(s.db, tradeColumns+`
+		WHERE ($1 = '' OR t.buyer = $1 OR t.seller = $1)
+			AND (t.created_at < $2 OR (t.created_at = $2 AND t.token_id > $3))
+		ORDER BY t.created_at DESC, t.token_id
+		LIMIT $4`, address, createdAt, tokenID, first+1)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(trades) > first {
+		return trades[:first], true, nil
+	}
+	return trades, false, nil
+}
+
+// StuckTrades returns trades still awaiting confirmation whose delivery
+// started before the given time, longest overdue first
+func (s *Store) StuckTrades(before string, limit int) ([]*TradeRecord, error) {
+	return queryTrades(s.db, tradeColumns+`
+		WHERE t.state = 'CREATED' AND t.delivery_start < $1
+		ORDER BY t.delivery_start, t.token_id
+		LIMIT $2`, before, limit)
+}
+
+// UnsettledTrades returns confirmed or delivered trades whose delivery ended
+// before the given time but which have not settled, longest overdue first
+func (s *Store) UnsettledTrades(before string, limit int) ([]*TradeRecord, error) {
+	return queryTrades(s.db, tradeColumns+`
+		WHERE t.state IN ('CONFIRMED', 'DELIVERED') AND t.delivery_end < $1
+		ORDER BY t.delivery_end, t.token_id
+		LIMIT $2`, before, limit)
+}
+
+// TradeStateChanges returns the lifecycle events of a trade, oldest first
+func (s *Store) TradeStateChanges(tokenID string) ([]*TradeStateChange, error) {
+	rows, err := s.db.Query("SELECT sequence, event_name, state, timestamp FROM trade_history WHERE token_id = $1 ORDER BY sequence", tokenID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*TradeStateChange{}
+	for rows.Next() {
+		var change TradeStateChange
+		if err := rows.Scan(&change.Sequence, &change.EventName, &change.State, &change.Timestamp); err != nil {
+			return nil, err
+		}
+		changes = append(changes, &change)
+	}
+	return changes, rows.Err()
+}
+
+// PriceChart returns the reference prices of periods starting in the
+// half-open window [from, to), oldest first.
+func (s *Store) PriceChart(from, to string) ([]*PricePoint, error) {
+	rows, err := s.db.Query("SELECT period, price FROM reference_prices WHERE period >= $1 AND period < $2 ORDER BY period", from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []*PricePoint{}
+	for rows.Next() {
+		var point PricePoint
+		if err := rows.Scan(&point.Period, &point.Price); err != nil {
+			return nil, err
+		}
+		points = append(points, &point)
+	}
+	return points, rows.Err()
+}
+
+// ClearingPrices returns the hourly clearing prices of trades whose delivery
+// started in the half-open window [from, to), oldest first. Hours in which
+// no energy was delivered are left out.
+func (s *Store) ClearingPrices(from, to string) ([]*ClearingPrice, error) {
+	rows, err := s.db.Query(`SELECT substr(t.delivery_start, 1, 13) AS hour, SUM(s.payment), SUM(s.delivered_energy)
+		FROM trades t JOIN settlements s ON s.token_id = t.token_id
+		WHERE t.delivery_start >= $1 AND t.delivery_start < $2 AND s.delivered_energy > 0
+		GROUP BY hour ORDER BY hour`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := []*ClearingPrice{}
+	for rows.Next() {
+		var price ClearingPrice
+		var payment float64
+		if err := rows.Scan(&price.Period, &payment, &price.Volume); err != nil {
+			return nil, err
+		}
+		price.Period += ":00:00Z"
+		price.Price = payment / price.Volume
+		prices = append(prices, &price)
+	}
+	return prices, rows.Err()
+}
+
+// DailyRollups returns the rollups of days in the half-open window
+// [from, to), oldest first
+func (s *Store) DailyRollups(from, to string) ([]*DailyRollup, error) {
+	rows, err := s.db.Query(`SELECT day, trade_count, contracted_energy, delivered_energy, traded_value, levies, network_fees,
+			subsidies, shortfall, imbalance_penalties, grid_imbalance
+		FROM daily_rollups WHERE day >= $1 AND day < $2 ORDER BY day`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rollups := []*DailyRollup{}
+	for rows.Next() {
+		var rollup DailyRollup
+		if err := rows.Scan(&rollup.Day, &rollup.TradeCount, &rollup.ContractedEnergy, &rollup.DeliveredEnergy, &rollup.TradedValue, &rollup.Levies,
+			&rollup.NetworkFees, &rollup.Subsidies, &rollup.Shortfall, &rollup.ImbalancePenalties, &rollup.GridImbalance); err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, &rollup)
+	}
+	return rollups, rows.Err()
+}
+
+// TokenMovements returns the mints and transfers into or out of an account, newest first
+func (s *Store) TokenMovements(account string, limit int) ([]*TokenMovement, error) {
+	rows, err := s.db.Query(`SELECT sequence, from_account, to_account, amount, timestamp FROM token_movements
+		WHERE from_account = $1 OR to_account = $1
+		ORDER BY sequence DESC
+		LIMIT $2`, account, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movements := []*TokenMovement{}
+	for rows.Next() {
+		var movement TokenMovement
+		if err := rows.Scan(&movement.Sequence, &movement.From, &movement.To, &movement.Amount, &movement.Timestamp); err != nil {
+			return nil, err
+		}
+		movements = append(movements, &movement)
+	}
+	return movements, rows.Err()
+}
+
+// LastSequence returns the highest event sequence number recorded, or 0
+func (s *Store) LastSequence() (uint64, error) {
+	var sequence sql.NullInt64
+	if err := s.db.QueryRow("SELECT MAX(sequence) FROM events").Scan(&sequence); err != nil {
+		return 0, err
+	}
+	return uint64(sequence.Int64), nil
+}
+
+// Participant returns a registered participant, or nil if its registration
+// has not been indexed
+func (s *Store) Participant(address string) (*ParticipantRecord, error) {
+	var participant ParticipantRecord
+	err := s.db.QueryRow("SELECT address, kyc_status, registered_at, updated_at FROM participants WHERE address = $1", address).
+		Scan(&participant.Address, &participant.KYCStatus, &participant.RegisteredAt, &participant.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &participant, nil
+}
+
+// MeterReadings returns the readings of the meters owned by any of owners for
+// intervals starting in the half-open window [from, to), oldest first
+func (s *Store) MeterReadings(owners []string, from, to string) ([]*MeterReadingRecord, error) {
+	readings := []*MeterReadingRecord{}
+	for _, owner := range owners {
+		rows, err := s.db.Query(`SELECT meter_id, owner, interval_start, interval_end, kwh_injected, kwh_consumed, submitted_at
+			FROM meter_readings WHERE owner = $1 AND interval_start >= $2 AND interval_start < $3
+			ORDER BY interval_start, meter_id`, owner, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var reading MeterReadingRecord
+			if err := rows.Scan(&reading.MeterID, &reading.Owner, &reading.IntervalStart, &reading.IntervalEnd,
+				&reading.KWhInjected, &reading.KWhConsumed, &reading.SubmittedAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			readings = append(readings, &reading)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(readings, func(i, j int) bool {
+		return readings[i].IntervalStart < readings[j].IntervalStart
+	})
+	return readings, nil
+}
+
+// Settlement returns the settlement of a trade, or nil if it has not settled
+func (s *Store) Settlement(tokenID string) (*SettlementRecord, error) {
+	var settlement SettlementRecord
+	err := s.db.QueryRow("SELECT token_id, delivered_energy, shortfall, payment, imbalance_penalty, settled_at FROM settlements WHERE token_id = $1", tokenID).
+		Scan(&settlement.TokenID, &settlement.DeliveredEnergy, &settlement.Shortfall, &settlement.Payment, &settlement.ImbalancePenalty, &settlement.SettledAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &settlement, nil
+}
+
+// OracleFeeds returns when each of the named events was last emitted and how
+// often, by name. Events never emitted are left out.
+func (s *Store) OracleFeeds(names []string) ([]*OracleFeed, error) {
+	feeds := []*OracleFeed{}
+	for _, name := range names {
+		feed := OracleFeed{Name: name}
+		var lastPostedAt sql.NullString
+		if err := s.db.QueryRow("SELECT MAX(timestamp), COUNT(*) FROM events WHERE name = $1", name).Scan(&lastPostedAt, &feed.Posts); err != nil {
+			return nil, err
+		}
+		if feed.Posts > 0 {
+			feed.LastPostedAt = lastPostedAt.String
+			feeds = append(feeds, &feed)
+		}
+	}
+	sort.Slice(feeds, func(i, j int) bool { return feeds[i].Name < feeds[j].Name })
+	return feeds, nil
+}
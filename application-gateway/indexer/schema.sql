@@ -0,0 +1,152 @@
+-- Off-chain index of the energy trading chaincode. Every table is derived from
+-- chaincode and block events and can be rebuilt by deleting the database and
+-- replaying from block 0.
+
+-- checkpoints records, per event stream, the block in which the next event is
+-- expected and the last transaction processed within that block.
+CREATE TABLE IF NOT EXISTS checkpoints (
+    stream         TEXT PRIMARY KEY,
+    block_number   INTEGER NOT NULL,
+    transaction_id TEXT NOT NULL
+);
+
+-- events holds every chaincode event envelope. sequence numbers the events in
+-- the order they were indexed, which follows block order. Fabric delivers one
+-- event per transaction, so a replayed event is recognised by its transaction.
+CREATE TABLE IF NOT EXISTS events (
+    sequence       INTEGER PRIMARY KEY,
+    name           TEXT NOT NULL,
+    block_number   INTEGER NOT NULL,
+    transaction_id TEXT NOT NULL,
+    timestamp      TEXT NOT NULL,
+    payload        TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS events_transaction ON events (transaction_id);
+CREATE INDEX IF NOT EXISTS events_name ON events (name, sequence);
+
+-- trades is the latest known state of each trade.
+CREATE TABLE IF NOT EXISTS trades (
+    token_id       TEXT PRIMARY KEY,
+    buyer          TEXT NOT NULL,
+    seller         TEXT NOT NULL,
+    energy_amount  REAL NOT NULL,
+    delivery_start TEXT NOT NULL,
+    delivery_end   TEXT NOT NULL,
+    state          TEXT NOT NULL,
+    created_at     TEXT NOT NULL,
+    updated_at     TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS trades_buyer ON trades (buyer);
+CREATE INDEX IF NOT EXISTS trades_seller ON trades (seller);
+CREATE INDEX IF NOT EXISTS trades_state ON trades (state, delivery_start);
+
+-- trade_history has one row per trade lifecycle event.
+CREATE TABLE IF NOT EXISTS trade_history (
+    sequence   INTEGER PRIMARY KEY REFERENCES events (sequence),
+    token_id   TEXT NOT NULL,
+    event_name TEXT NOT NULL,
+    state      TEXT NOT NULL,
+    timestamp  TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS trade_history_token ON trade_history (token_id, sequence);
+
+-- settlements mirrors the chaincode's settlement records.
+CREATE TABLE IF NOT EXISTS settlements (
+    token_id          TEXT PRIMARY KEY,
+    delivered_energy  REAL NOT NULL,
+    shortfall         REAL NOT NULL,
+    payment           REAL NOT NULL,
+    imbalance_penalty REAL NOT NULL,
+    settled_at        TEXT NOT NULL
+);
+
+-- daily_rollups mirrors the chaincode's per-day aggregates of settled trades.
+CREATE TABLE IF NOT EXISTS daily_rollups (
+    day                 TEXT PRIMARY KEY,
+    trade_count         INTEGER NOT NULL,
+    contracted_energy   REAL NOT NULL,
+    delivered_energy    REAL NOT NULL,
+    traded_value        REAL NOT NULL,
+    levies              REAL NOT NULL,
+    network_fees        REAL NOT NULL,
+    subsidies           REAL NOT NULL,
+    shortfall           REAL NOT NULL,
+    imbalance_penalties REAL NOT NULL,
+    grid_imbalance      REAL NOT NULL
+);
+
+-- pruned_trades lists trades whose detail has been pruned from the ledger;
+-- their history is kept here only.
+CREATE TABLE IF NOT EXISTS pruned_trades (
+    token_id  TEXT PRIMARY KEY,
+    day       TEXT NOT NULL,
+    pruned_at TEXT NOT NULL
+);
+
+-- reference_prices is the oracle price series used for price charts.
+CREATE TABLE IF NOT EXISTS reference_prices (
+    period TEXT PRIMARY KEY,
+    price  REAL NOT NULL
+);
+
+-- token_movements has one row per mint or transfer; from_account is empty for mints.
+CREATE TABLE IF NOT EXISTS token_movements (
+    sequence     INTEGER PRIMARY KEY REFERENCES events (sequence),
+    from_account TEXT NOT NULL,
+    to_account   TEXT NOT NULL,
+    amount       REAL NOT NULL,
+    timestamp    TEXT NOT NULL
+);
+
+-- participants is the latest KYC status of each registered participant.
+CREATE TABLE IF NOT EXISTS participants (
+    address       TEXT PRIMARY KEY,
+    kyc_status    TEXT NOT NULL,
+    registered_at TEXT NOT NULL,
+    updated_at    TEXT NOT NULL
+);
+
+-- meter_readings holds each meter's submitted interval readings.
+CREATE TABLE IF NOT EXISTS meter_readings (
+    meter_id       TEXT NOT NULL,
+    interval_start TEXT NOT NULL,
+    interval_end   TEXT NOT NULL,
+    owner          TEXT NOT NULL,
+    kwh_injected   REAL NOT NULL,
+    kwh_consumed   REAL NOT NULL,
+    submitted_at   TEXT NOT NULL,
+    PRIMARY KEY (meter_id, interval_start)
+);
+CREATE INDEX IF NOT EXISTS meter_readings_owner ON meter_readings (owner, interval_start);
+
+-- invoices mirrors the chaincode's billing period invoices, and
+-- invoice_lines their line items in order.
+CREATE TABLE IF NOT EXISTS invoices (
+    invoice_number TEXT PRIMARY KEY,
+    participant    TEXT NOT NULL,
+    period         TEXT NOT NULL,
+    period_start   TEXT NOT NULL,
+    period_end     TEXT NOT NULL,
+    total_credits  REAL NOT NULL,
+    total_charges  REAL NOT NULL,
+    net_amount     REAL NOT NULL,
+    closed_at      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS invoices_period ON invoices (period_start, invoice_number);
+CREATE TABLE IF NOT EXISTS invoice_lines (
+    invoice_number TEXT NOT NULL REFERENCES invoices (invoice_number),
+    line           INTEGER NOT NULL,
+    type           TEXT NOT NULL,
+    reference      TEXT NOT NULL,
+    description    TEXT NOT NULL,
+    quantity       REAL NOT NULL,
+    amount         REAL NOT NULL,
+    PRIMARY KEY (invoice_number, line)
+);
+
+-- blocks summarizes each committed block from the filtered block stream.
+CREATE TABLE IF NOT EXISTS blocks (
+    number             INTEGER PRIMARY KEY,
+    transaction_count  INTEGER NOT NULL,
+    valid_transactions INTEGER NOT NULL
+);
@@ -0,0 +1,464 @@
+// Package indexer projects chaincode and block events into a SQL database so
+// that historical and analytic queries, such as per-user trade history and
+// price charts, can be answered without range scans of the world state.
+package indexer
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	_ "modernc.org/sqlite"
+)
+
+//go:embed schema.sql
+var schema string
+
+// Checkpoint streams
+const (
+	ChaincodeStream = "chaincode"
+	BlockStream     = "blocks"
+)
+
+// Chaincode event names the store projects into query tables. Every other
+// event is kept in the events table only.
+const (
+	eventAssetCreated          = "AssetCreated"
+	eventTradeSigned           = "TradeSigned"
+	eventTradeConfirmed        = "TradeConfirmed"
+	eventDeliveryRecorded      = "DeliveryRecorded"
+	eventTradeSettled          = "TradeSettled"
+	eventTokensMinted          = "TokensMinted"
+	eventTokensTransferred     = "TokensTransferred"
+	eventReferencePricePosted  = "ReferencePricePosted"
+	eventDailyRollupCreated    = "DailyRollupCreated"
+	eventTradesPruned          = "TradesPruned"
+	eventParticipantRegistered = "ParticipantRegistered"
+	eventParticipantReviewed   = "ParticipantReviewed"
+	eventParticipantErased     = "ParticipantErased"
+	eventMeterReadingSubmitted = "MeterReadingSubmitted"
+	eventInvoiceIssued         = "InvoiceIssued"
+)
+
+const stateSettled = "SETTLED"
+
+type tradeEvent struct {
+	TokenID       string  `json:"tokenID"`
+	State         string  `json:"state"`
+	Buyer         string  `json:"buyer"`
+	Seller        string  `json:"seller"`
+	EnergyAmount  float64 `json:"energyAmount"`
+	DeliveryStart string  `json:"deliveryStart"`
+	DeliveryEnd   string  `json:"deliveryEnd"`
+}
+
+type settlementEvent struct {
+	TokenID          string  `json:"tokenID"`
+	DeliveredEnergy  float64 `json:"deliveredEnergy"`
+	Shortfall        float64 `json:"shortfall"`
+	Payment          float64 `json:"payment"`
+	ImbalancePenalty float64 `json:"imbalancePenalty"`
+	SettledAt        string  `json:"settledAt"`
+}
+
+type tokenEvent struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+}
+
+type referencePriceEvent struct {
+	Period string  `json:"period"`
+	Price  float64 `json:"price"`
+}
+
+type dailyRollupEvent struct {
+	Day                string  `json:"day"`
+	TradeCount         int     `json:"tradeCount"`
+	ContractedEnergy   float64 `json:"contractedEnergy"`
+	DeliveredEnergy    float64 `json:"deliveredEnergy"`
+	TradedValue        float64 `json:"tradedValue"`
+	Levies             float64 `json:"levies"`
+	NetworkFees        float64 `json:"networkFees"`
+	Subsidies          float64 `json:"subsidies"`
+	Shortfall          float64 `json:"shortfall"`
+	ImbalancePenalties float64 `json:"imbalancePenalties"`
+	GridImbalance      float64 `json:"gridImbalance"`
+}
+
+type participantEvent struct {
+	Address string `json:"address"`
+	Status  string `json:"status"`
+}
+
+type meterReadingEvent struct {
+	MeterID       string  `json:"meterID"`
+	Owner         string  `json:"owner"`
+	IntervalStart string  `json:"intervalStart"`
+	IntervalEnd   string  `json:"intervalEnd"`
+	KWhInjected   float64 `json:"kWhInjected"`
+	KWhConsumed   float64 `json:"kWhConsumed"`
+	SubmittedAt   string  `json:"submittedAt"`
+}
+
+type invoiceEvent struct {
+	InvoiceNumber string  `json:"invoiceNumber"`
+	Participant   string  `json:"participant"`
+	Period        string  `json:"period"`
+	PeriodStart   string  `json:"periodStart"`
+	PeriodEnd     string  `json:"periodEnd"`
+	TotalCredits  float64 `json:"totalCredits"`
+	TotalCharges  float64 `json:"totalCharges"`
+	NetAmount     float64 `json:"netAmount"`
+	ClosedAt      string  `json:"closedAt"`
+	Lines         []struct {
+		Type        string  `json:"type"`
+		Reference   string  `json:"reference"`
+		Description string  `json:"description"`
+		Quantity    float64 `json:"quantity"`
+		Amount      float64 `json:"amount"`
+	} `json:"lines"`
+}
+
+type tradesPrunedEvent struct {
+	Day      string   `json:"day"`
+	TokenIDs []string `json:"tokenIDs"`
+}
+
+// Store is the index database. The SQL is kept to the subset shared by SQLite
+// and PostgreSQL.
+type Store struct {
+	db     *sql.DB
+	broker *broker
+}
+
+// Open opens, creating if needed, the SQLite database at path and applies the schema
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer; a single connection also keeps ":memory:"
+	// databases from being opened once per connection.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to apply schema: %w", err)
+	}
+	store := &Store{db: db, broker: newBroker()}
+	if err := store.backfill(eventInvoiceIssued); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to backfill invoices: %w", err)
+	}
+	return store, nil
+}
+
+// backfill projects the recorded events of a name again, filling a table
+// added after they were indexed. Projections ignore rows they already hold.
+func (s *Store) backfill(name string) error {
+	rows, err := s.db.Query("SELECT sequence, timestamp, payload FROM events WHERE name = $1 ORDER BY sequence", name)
+	if err != nil {
+		return err
+	}
+	envs := []*fabric.EventEnvelope{}
+	for rows.Next() {
+		env := &fabric.EventEnvelope{Name: name}
+		var payload string
+		if err := rows.Scan(&env.Sequence, &env.Timestamp, &payload); err != nil {
+			rows.Close()
+			return err
+		}
+		env.Payload = json.RawMessage(payload)
+		envs = append(envs, env)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(envs) == 0 {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, env := range envs {
+		if err := project(tx, env); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// checkpoint is a stored stream position; it implements client.Checkpoint
+type checkpoint struct {
+	blockNumber   uint64
+	transactionID string
+}
+
+func (c checkpoint) BlockNumber() uint64 {
+	return c.blockNumber
+}
+
+func (c checkpoint) TransactionID() string {
+	return c.transactionID
+}
+
+// Checkpoint returns the position to resume a stream from. The zero
+// checkpoint is returned for a stream that has not processed anything.
+func (s *Store) Checkpoint(stream string) (client.Checkpoint, error) {
+	var cp checkpoint
+	err := s.db.QueryRow("SELECT block_number, transaction_id FROM checkpoints WHERE stream = $1", stream).Scan(&cp.blockNumber, &cp.transactionID)
+	if err == sql.ErrNoRows {
+		return checkpoint{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func saveCheckpoint(tx *sql.Tx, stream string, blockNumber uint64, transactionID string) error {
+	_, err := tx.Exec(`INSERT INTO checkpoints (stream, block_number, transaction_id) VALUES ($1, $2, $3)
+		ON CONFLICT (stream) DO UPDATE SET block_number = excluded.block_number, transaction_id = excluded.transaction_id`,
+		stream, blockNumber, transactionID)
+	return err
+}
+
+// ApplyChaincodeEvent records a chaincode event, updates the query tables and
+// advances the chaincode checkpoint in one database transaction. The event is
+// given the next sequence number. Events of a transaction that has already
+// been recorded are skipped, so replaying a stream is harmless.
+func (s *Store) ApplyChaincodeEvent(event *client.ChaincodeEvent) error {
+	env, err := fabric.ParseEvent(event)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO events (name, block_number, transaction_id, timestamp, payload)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (transaction_id) DO NOTHING`,
+		env.Name, event.BlockNumber, event.TransactionID, env.Timestamp, string(env.Payload))
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted > 0 {
+		sequence, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		env.Sequence = uint64(sequence)
+		if err := project(tx, env); err != nil {
+			return fmt.Errorf("failed to index %s event %d: %w", env.Name, env.Sequence, err)
+		}
+	}
+	if err := saveCheckpoint(tx, ChaincodeStream, event.BlockNumber, event.TransactionID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if inserted > 0 {
+		s.broker.publish(env)
+	}
+	return nil
+}
+
+// project updates the query tables for one newly recorded event
+func project(tx *sql.Tx, env *fabric.EventEnvelope) error {
+	switch env.Name {
+	case eventAssetCreated, eventTradeSigned, eventTradeConfirmed, eventDeliveryRecorded:
+		var trade tradeEvent
+		if err := json.Unmarshal(env.Payload, &trade); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO trades (token_id, buyer, seller, energy_amount, delivery_start, delivery_end, state, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+			ON CONFLICT (token_id) DO UPDATE SET state = excluded.state, updated_at = excluded.updated_at`,
+			trade.TokenID, trade.Buyer, trade.Seller, trade.EnergyAmount, trade.DeliveryStart, trade.DeliveryEnd, trade.State, env.Timestamp); err != nil {
+			return err
+		}
+		return addTradeHistory(tx, env, trade.TokenID, trade.State)
+
+	case eventTradeSettled:
+		var settlement settlementEvent
+		if err := json.Unmarshal(env.Payload, &settlement); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO settlements (token_id, delivered_energy, shortfall, payment, imbalance_penalty, settled_at)
+			VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (token_id) DO NOTHING`,
+			settlement.TokenID, settlement.DeliveredEnergy, settlement.Shortfall, settlement.Payment, settlement.ImbalancePenalty, settlement.SettledAt); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE trades SET state = $1, updated_at = $2 WHERE token_id = $3", stateSettled, env.Timestamp, settlement.TokenID); err != nil {
+			return err
+		}
+		if err := recordSettlementLag(tx, &settlement); err != nil {
+			return err
+		}
+		return addTradeHistory(tx, env, settlement.TokenID, stateSettled)
+
+	case eventTokensMinted, eventTokensTransferred:
+		var movement tokenEvent
+		if err := json.Unmarshal(env.Payload, &movement); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO token_movements (sequence, from_account, to_account, amount, timestamp) VALUES ($1, $2, $3, $4, $5)",
+			env.Sequence, movement.From, movement.To, movement.Amount, env.Timestamp)
+		return err
+
+	case eventReferencePricePosted:
+		var price referencePriceEvent
+		if err := json.Unmarshal(env.Payload, &price); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO reference_prices (period, price) VALUES ($1, $2) ON CONFLICT (period) DO NOTHING", price.Period, price.Price)
+		return err
+
+	case eventDailyRollupCreated:
+		var rollup dailyRollupEvent
+		if err := json.Unmarshal(env.Payload, &rollup); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO daily_rollups (day, trade_count, contracted_energy, delivered_energy, traded_value, levies, network_fees,
+				subsidies, shortfall, imbalance_penalties, grid_imbalance)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) ON CONFLICT (day) DO NOTHING`,
+			rollup.Day, rollup.TradeCount, rollup.ContractedEnergy, rollup.DeliveredEnergy, rollup.TradedValue, rollup.Levies, rollup.NetworkFees,
+			rollup.Subsidies, rollup.Shortfall, rollup.ImbalancePenalties, rollup.GridImbalance)
+		return err
+
+	case eventParticipantRegistered, eventParticipantReviewed, eventParticipantErased:
+		var participant participantEvent
+		if err := json.Unmarshal(env.Payload, &participant); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO participants (address, kyc_status, registered_at, updated_at) VALUES ($1, $2, $3, $3)
+			ON CONFLICT (address) DO UPDATE SET kyc_status = excluded.kyc_status, updated_at = excluded.updated_at`,
+			participant.Address, participant.Status, env.Timestamp)
+		return err
+
+	case eventMeterReadingSubmitted:
+		var reading meterReadingEvent
+		if err := json.Unmarshal(env.Payload, &reading); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO meter_readings (meter_id, interval_start, interval_end, owner, kwh_injected, kwh_consumed, submitted_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (meter_id, interval_start) DO NOTHING`,
+			reading.MeterID, reading.IntervalStart, reading.IntervalEnd, reading.Owner, reading.KWhInjected, reading.KWhConsumed, reading.SubmittedAt)
+		return err
+
+	case eventInvoiceIssued:
+		var invoice invoiceEvent
+		if err := json.Unmarshal(env.Payload, &invoice); err != nil {
+			return err
+		}
+		result, err := tx.Exec(`INSERT INTO invoices (invoice_number, participant, period, period_start, period_end, total_credits, total_charges, net_amount, closed_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (invoice_number) DO NOTHING`,
+			invoice.InvoiceNumber, invoice.Participant, invoice.Period, invoice.PeriodStart, invoice.PeriodEnd,
+			invoice.TotalCredits, invoice.TotalCharges, invoice.NetAmount, invoice.ClosedAt)
+		if err != nil {
+			return err
+		}
+		if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+			return err
+		}
+		for i, line := range invoice.Lines {
+			if _, err := tx.Exec(`INSERT INTO invoice_lines (invoice_number, line, type, reference, description, quantity, amount)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+				invoice.InvoiceNumber, i+1, line.Type, line.Reference, line.Description, line.Quantity, line.Amount); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case eventTradesPruned:
+		var pruned tradesPrunedEvent
+		if err := json.Unmarshal(env.Payload, &pruned); err != nil {
+			return err
+		}
+		for _, tokenID := range pruned.TokenIDs {
+			if _, err := tx.Exec("INSERT INTO pruned_trades (token_id, day, pruned_at) VALUES ($1, $2, $3) ON CONFLICT (token_id) DO NOTHING",
+				tokenID, pruned.Day, env.Timestamp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// recordSettlementLag observes the time from the end of the trade's delivery
+// window to its settlement, when the trade's creation has been indexed.
+func recordSettlementLag(tx *sql.Tx, settlement *settlementEvent) error {
+	var deliveryEnd string
+	err := tx.QueryRow("SELECT delivery_end FROM trades WHERE token_id = $1", settlement.TokenID).Scan(&deliveryEnd)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	end, err := time.Parse(time.RFC3339, deliveryEnd)
+	if err != nil {
+		return nil
+	}
+	settledAt, err := time.Parse(time.RFC3339, settlement.SettledAt)
+	if err != nil {
+		return nil
+	}
+	metrics.SettlementLag(settledAt.Sub(end))
+	return nil
+}
+
+func addTradeHistory(tx *sql.Tx, env *fabric.EventEnvelope, tokenID, state string) error {
+	_, err := tx.Exec("INSERT INTO trade_history (sequence, token_id, event_name, state, timestamp) VALUES ($1, $2, $3, $4, $5)",
+		env.Sequence, tokenID, env.Name, state, env.Timestamp)
+	return err
+}
+
+// ApplyBlock records a committed block's transaction counts and advances the
+// block checkpoint past it.
+func (s *Store) ApplyBlock(block *peer.FilteredBlock) error {
+	valid := 0
+	for _, transaction := range block.GetFilteredTransactions() {
+		if transaction.GetTxValidationCode() == peer.TxValidationCode_VALID {
+			valid++
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO blocks (number, transaction_count, valid_transactions) VALUES ($1, $2, $3)
+		ON CONFLICT (number) DO NOTHING`,
+		block.GetNumber(), len(block.GetFilteredTransactions()), valid); err != nil {
+		return err
+	}
+	if err := saveCheckpoint(tx, BlockStream, block.GetNumber()+1, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
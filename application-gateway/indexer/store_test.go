@@ -0,0 +1,270 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"application-gateway/fabric"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+)
+
+func openTestStore(t *testing.T) *Store {
+	store, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func testEvent(t *testing.T, block uint64, tx uint64, name, timestamp string, payload interface{}) *client.ChaincodeEvent {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txID := fmt.Sprintf("tx%d", tx)
+	envelopeJSON, err := json.Marshal(fabric.EventEnvelope{SchemaVersion: 2, Name: name, TxID: txID, Timestamp: timestamp, Payload: payloadJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client.ChaincodeEvent{BlockNumber: block, TransactionID: txID, ChaincodeName: "energy", EventName: name, Payload: envelopeJSON}
+}
+
+func TestTradeHistory(t *testing.T) {
+	store := openTestStore(t)
+	trade := tradeEvent{TokenID: "asset1", Buyer: "buyer1", Seller: "seller1", EnergyAmount: 10}
+	events := []*client.ChaincodeEvent{}
+	trade.State = "CREATED"
+	events = append(events, testEvent(t, 5, 1, eventAssetCreated, "2025-05-01T08:00:00Z", trade))
+	trade.State = "CONFIRMED"
+	events = append(events, testEvent(t, 6, 2, eventTradeConfirmed, "2025-05-01T09:00:00Z", trade))
+	events = append(events, testEvent(t, 7, 3, eventTradeSettled, "2025-05-03T12:00:00Z",
+		settlementEvent{TokenID: "asset1", DeliveredEnergy: 8, Payment: 1.6, Shortfall: 2, SettledAt: "2025-05-03T12:00:00Z"}))
+	for _, event := range events {
+		if err := store.ApplyChaincodeEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// replaying an event must not duplicate it
+	if err := store.ApplyChaincodeEvent(events[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, address := range []string{"buyer1", "seller1"} {
+		trades, err := store.TradeHistory(address, DefaultLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trades) != 1 {
+			t.Fatalf("got %d trades for %s, want 1", len(trades), address)
+		}
+		if trades[0].State != stateSettled || trades[0].CreatedAt != "2025-05-01T08:00:00Z" {
+			t.Errorf("got trade %+v", trades[0])
+		}
+		if trades[0].SettledPrice == nil || *trades[0].SettledPrice != 0.2 {
+			t.Errorf("got settled price %v, want 0.2", trades[0].SettledPrice)
+		}
+	}
+	changes, err := store.TradeStateChanges("asset1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || changes[2].State != stateSettled {
+		t.Errorf("got state changes %+v", changes)
+	}
+
+	cp, err := store.Checkpoint(ChaincodeStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.BlockNumber() != 6 || cp.TransactionID() != events[1].TransactionID {
+		t.Errorf("got checkpoint %d/%s", cp.BlockNumber(), cp.TransactionID())
+	}
+}
+
+func TestPriceChartAndTokenMovements(t *testing.T) {
+	store := openTestStore(t)
+	events := []*client.ChaincodeEvent{
+		testEvent(t, 1, 1, eventReferencePricePosted, "2025-05-01T08:00:00Z", referencePriceEvent{Period: "2025-05-03T10:00:00Z", Price: 0.2}),
+		testEvent(t, 1, 2, eventReferencePricePosted, "2025-05-01T08:01:00Z", referencePriceEvent{Period: "2025-05-03T11:00:00Z", Price: 0.25}),
+		testEvent(t, 2, 3, eventTokensMinted, "2025-05-01T08:02:00Z", tokenEvent{To: "buyer1", Amount: 10}),
+		testEvent(t, 3, 4, eventTokensTransferred, "2025-05-01T08:03:00Z", tokenEvent{From: "buyer1", To: "seller1", Amount: 4}),
+	}
+	for _, event := range events {
+		if err := store.ApplyChaincodeEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	points, err := store.PriceChart("2025-05-03T00:00:00Z", "2025-05-03T11:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || points[0].Price != 0.2 {
+		t.Errorf("got price points %+v", points)
+	}
+	movements, err := store.TokenMovements("buyer1", DefaultLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movements) != 2 || movements[0].To != "seller1" || movements[1].From != "" {
+		t.Errorf("got token movements %+v", movements)
+	}
+	sequence, err := store.LastSequence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence != 4 {
+		t.Errorf("got last sequence %d, want 4", sequence)
+	}
+}
+
+func TestApplyBlock(t *testing.T) {
+	store := openTestStore(t)
+	cp, err := store.Checkpoint(BlockStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.BlockNumber() != 0 || cp.TransactionID() != "" {
+		t.Errorf("got initial checkpoint %d/%s", cp.BlockNumber(), cp.TransactionID())
+	}
+
+	block := &peer.FilteredBlock{
+		Number: 9,
+		FilteredTransactions: []*peer.FilteredTransaction{
+			{Txid: "tx1", TxValidationCode: peer.TxValidationCode_VALID},
+			{Txid: "tx2", TxValidationCode: peer.TxValidationCode_MVCC_READ_CONFLICT},
+		},
+	}
+	if err := store.ApplyBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	cp, err = store.Checkpoint(BlockStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.BlockNumber() != 10 {
+		t.Errorf("got block checkpoint %d, want 10", cp.BlockNumber())
+	}
+	var total, valid int
+	if err := store.db.QueryRow("SELECT transaction_count, valid_transactions FROM blocks WHERE number = 9").Scan(&total, &valid); err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || valid != 1 {
+		t.Errorf("got %d transactions, %d valid", total, valid)
+	}
+}
+
+func TestDailyRollupsAndPrunedTrades(t *testing.T) {
+	store := openTestStore(t)
+	trade := tradeEvent{TokenID: "asset1", Buyer: "buyer1", Seller: "seller1", EnergyAmount: 10, State: "CREATED"}
+	events := []*client.ChaincodeEvent{
+		testEvent(t, 1, 1, eventAssetCreated, "2025-05-01T08:00:00Z", trade),
+		testEvent(t, 2, 2, eventDailyRollupCreated, "2025-05-04T00:30:00Z", dailyRollupEvent{Day: "2025-05-03", TradeCount: 1, DeliveredEnergy: 8, TradedValue: 1.6}),
+		testEvent(t, 3, 3, eventTradesPruned, "2025-05-04T01:00:00Z", tradesPrunedEvent{Day: "2025-05-03", TokenIDs: []string{"asset1"}}),
+	}
+	for _, event := range events {
+		if err := store.ApplyChaincodeEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rollups, err := store.DailyRollups("2025-05-01", "2025-05-04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollups) != 1 || rollups[0].Day != "2025-05-03" || rollups[0].DeliveredEnergy != 8 {
+		t.Errorf("got rollups %+v", rollups)
+	}
+	rollups, err = store.DailyRollups("2025-05-04", "2025-05-05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollups) != 0 {
+		t.Errorf("got rollups %+v, want none", rollups)
+	}
+	trades, err := store.TradeHistory("buyer1", DefaultLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 1 || !trades[0].PrunedOnChain {
+		t.Errorf("got trades %+v, want asset1 pruned on chain", trades)
+	}
+}
+
+func TestClearingPrices(t *testing.T) {
+	store := openTestStore(t)
+	events := []*client.ChaincodeEvent{}
+	for i, trade := range []tradeEvent{
+		{TokenID: "asset1", Buyer: "buyer1", Seller: "seller1", EnergyAmount: 10, State: "CREATED", DeliveryStart: "2025-05-03T10:00:00Z"},
+		{TokenID: "asset2", Buyer: "buyer2", Seller: "seller1", EnergyAmount: 5, State: "CREATED", DeliveryStart: "2025-05-03T10:15:00Z"},
+		{TokenID: "asset3", Buyer: "buyer1", Seller: "seller2", EnergyAmount: 5, State: "CREATED", DeliveryStart: "2025-05-03T11:00:00Z"},
+	} {
+		events = append(events, testEvent(t, 1, uint64(i+1), eventAssetCreated, "2025-05-01T08:00:00Z", trade))
+	}
+	events = append(events,
+		testEvent(t, 2, 4, eventTradeSettled, "2025-05-03T12:00:00Z", settlementEvent{TokenID: "asset1", DeliveredEnergy: 10, Payment: 2, SettledAt: "2025-05-03T12:00:00Z"}),
+		testEvent(t, 2, 5, eventTradeSettled, "2025-05-03T12:01:00Z", settlementEvent{TokenID: "asset2", DeliveredEnergy: 5, Payment: 2.5, SettledAt: "2025-05-03T12:01:00Z"}),
+		testEvent(t, 2, 6, eventTradeSettled, "2025-05-03T12:02:00Z", settlementEvent{TokenID: "asset3", Shortfall: 5, SettledAt: "2025-05-03T12:02:00Z"}),
+	)
+	for _, event := range events {
+		if err := store.ApplyChaincodeEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prices, err := store.ClearingPrices("2025-05-03T00:00:00Z", "2025-05-04T00:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prices) != 1 || prices[0].Period != "2025-05-03T10:00:00Z" || prices[0].Price != 0.3 || prices[0].Volume != 15 {
+		t.Errorf("got clearing prices %+v", prices)
+	}
+}
+
+func TestOverdueTradesAndOracleFeeds(t *testing.T) {
+	store := openTestStore(t)
+	events := []*client.ChaincodeEvent{}
+	for i, trade := range []tradeEvent{
+		{TokenID: "asset1", Buyer: "buyer1", Seller: "seller1", EnergyAmount: 10, State: "CREATED", DeliveryStart: "2025-05-03T10:00:00Z", DeliveryEnd: "2025-05-03T11:00:00Z"},
+		{TokenID: "asset2", Buyer: "buyer1", Seller: "seller1", EnergyAmount: 5, State: "CONFIRMED", DeliveryStart: "2025-05-03T10:00:00Z", DeliveryEnd: "2025-05-03T11:00:00Z"},
+		{TokenID: "asset3", Buyer: "buyer1", Seller: "seller1", EnergyAmount: 5, State: "CONFIRMED", DeliveryStart: "2025-05-03T13:00:00Z", DeliveryEnd: "2025-05-03T14:00:00Z"},
+	} {
+		events = append(events, testEvent(t, 1, uint64(i+1), eventAssetCreated, "2025-05-01T08:00:00Z", trade))
+	}
+	events = append(events,
+		testEvent(t, 2, 4, eventReferencePricePosted, "2025-05-03T09:00:00Z", referencePriceEvent{Period: "2025-05-03T09:00:00Z", Price: 0.2}),
+		testEvent(t, 3, 5, eventReferencePricePosted, "2025-05-03T10:00:00Z", referencePriceEvent{Period: "2025-05-03T10:00:00Z", Price: 0.25}),
+	)
+	for _, event := range events {
+		if err := store.ApplyChaincodeEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stuck, err := store.StuckTrades("2025-05-03T12:00:00Z", DefaultLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stuck) != 1 || stuck[0].TokenID != "asset1" {
+		t.Errorf("got stuck trades %+v", stuck)
+	}
+	unsettled, err := store.UnsettledTrades("2025-05-03T12:00:00Z", DefaultLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unsettled) != 1 || unsettled[0].TokenID != "asset2" {
+		t.Errorf("got unsettled trades %+v", unsettled)
+	}
+
+	feeds, err := store.OracleFeeds([]string{eventReferencePricePosted, "WeatherForecastPosted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feeds) != 1 || feeds[0].LastPostedAt != "2025-05-03T10:00:00Z" || feeds[0].Posts != 2 {
+		t.Errorf("got oracle feeds %+v", feeds)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"application-gateway/apikeys"
+	"application-gateway/ca"
+	"application-gateway/submission"
+	"application-gateway/wallet"
+	"application-gateway/web"
+)
+
+const cryptoPath = "../../test-network/organizations/peerOrganizations/org1.example.com"
+
+func main() {
+	walletPath := envOr("WALLET_PATH", "identities")
+
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if len(os.Args) != 6 {
+			fmt.Fprintln(os.Stderr, "usage: application-gateway import <label> <mspID> <certPath> <keystoreDir>")
+			os.Exit(2)
+		}
+		w, err := wallet.New(walletPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := w.Import(os.Args[2], os.Args[3], os.Args[4], os.Args[5]); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Imported identity %s", os.Args[2])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "import-hsm" {
+		if len(os.Args) != 6 && len(os.Args) != 7 {
+			fmt.Fprintln(os.Stderr, "usage: application-gateway import-hsm <label> <mspID> <certPath> <tokenLabel> [keyID]")
+			os.Exit(2)
+		}
+		w, err := wallet.New(walletPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key := wallet.HSMKey{Label: os.Args[5]}
+		if len(os.Args) == 7 {
+			key.Identifier = os.Args[6]
+		}
+		if err := w.ImportHSM(os.Args[2], os.Args[3], os.Args[4], key); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Imported identity %s with its key in HSM token %s", os.Args[2], os.Args[5])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		key, err := apikeys.GenerateKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("key:     %s\nkeyHash: %s\n", key, apikeys.HashKey(key))
+		return
+	}
+
+	server, err := web.NewServer(web.Config{
+		PeerEndpoint:    envOr("PEER_ENDPOINT", "localhost:7051"),
+		GatewayPeer:     envOr("GATEWAY_PEER", "peer0.org1.example.com"),
+		TLSCertPath:     envOr("TLS_CERT_PATH", cryptoPath+"/peers/peer0.org1.example.com/tls/ca.crt"),
+		ChannelName:     envOr("CHANNEL_NAME", "mychannel"),
+		ChaincodeName:   envOr("CHAINCODE_NAME", "energy"),
+		WalletPath:      walletPath,
+		DefaultIdentity: os.Getenv("DEFAULT_IDENTITY"),
+		ListenAddress:   envOr("LISTEN_ADDRESS", ":3000"),
+		APIKeysPath:     os.Getenv("API_KEYS_PATH"),
+		DBPath:          envOr("GATEWAY_DB_PATH", "gateway.db"),
+		CA: ca.Config{
+			URL:         os.Getenv("CA_URL"),
+			TLSCertPath: os.Getenv("CA_TLS_CERT_PATH"),
+			CAName:      os.Getenv("CA_NAME"),
+			Affiliation: os.Getenv("CA_AFFILIATION"),
+		},
+		RegistrarIdentity: envOr("CA_REGISTRAR_IDENTITY", "admin@org1"),
+		HSM:               wallet.HSMConfig{Library: os.Getenv("HSM_LIBRARY"), Pin: os.Getenv("HSM_PIN")},
+		Submission:        submission.DefaultConfig(),
+		IndexerURL:        os.Getenv("INDEXER_URL"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer server.Close()
+	if err := server.Serve(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
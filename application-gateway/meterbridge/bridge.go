@@ -0,0 +1,232 @@
+// Package meterbridge relays smart meter readings published over MQTT to the
+// chaincode's SubmitMeterReading.
+package meterbridge
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+)
+
+// Invoker is the part of *client.Contract the bridge uses
+type Invoker interface {
+	SubmitTransaction(name string, args ...string) ([]byte, error)
+}
+
+// Config controls how readings are queued and submitted
+type Config struct {
+	// Interval is the meter interval readings must be aligned to
+	Interval time.Duration
+	// QueueSize bounds the readings waiting for submission. While the queue
+	// is full, Enqueue blocks and readings go unacknowledged, so the broker
+	// holds further readings back.
+	QueueSize int
+	// A batch is submitted once it holds BatchSize readings, or FlushInterval
+	// after its first reading was taken from the queue
+	BatchSize     int
+	FlushInterval time.Duration
+	// Concurrency is how many meters' readings are submitted at once. A
+	// meter's own readings are submitted one at a time in interval order, as
+	// the chaincode only accepts readings later than the meter's last one.
+	Concurrency int
+	// Transient failures are retried after Backoff, doubling up to MaxBackoff,
+	// until they succeed or the bridge stops
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultConfig returns the configuration for 15 minute meter intervals
+func DefaultConfig() Config {
+	return Config{
+		Interval:      15 * time.Minute,
+		QueueSize:     1000,
+		BatchSize:     100,
+		FlushInterval: 2 * time.Second,
+		Concurrency:   8,
+		Backoff:       time.Second,
+		MaxBackoff:    time.Minute,
+	}
+}
+
+// queued is a reading waiting for submission and the acknowledgement of the
+// message that carried it
+type queued struct {
+	reading *Reading
+	ack     func()
+}
+
+// Bridge submits meter readings in batches. A reading's message is only
+// acknowledged once the reading is recorded on-chain or rejected for good,
+// so readings in flight when the bridge stops are redelivered by the broker.
+type Bridge struct {
+	contract Invoker
+	config   Config
+	keys     map[string]*ecdsa.PrivateKey
+	queue    chan *queued
+	sleep    func(context.Context, time.Duration) error
+	now      func() time.Time
+}
+
+// New returns a bridge invoking contract, which signs the readings of the
+// meters it holds keys for
+func New(contract Invoker, config Config, keys map[string]*ecdsa.PrivateKey) *Bridge {
+	return &Bridge{
+		contract: contract,
+		config:   config,
+		keys:     keys,
+		queue:    make(chan *queued, config.QueueSize),
+		sleep:    sleep,
+		now:      time.Now,
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Enqueue validates a reading, signs it if the meter did not, and queues it
+// for submission. ack is called once the reading is done with. An invalid
+// reading is returned as an error without calling ack. Enqueue blocks while
+// the queue is full, returning ctx's error if ctx is done first.
+func (b *Bridge) Enqueue(ctx context.Context, reading *Reading, ack func()) error {
+	if err := reading.Validate(b.config.Interval, b.now()); err != nil {
+		return err
+	}
+	if reading.Signature == "" {
+		key, ok := b.keys[reading.MeterID]
+		if !ok {
+			return fmt.Errorf("reading of meter %s is not signed and the bridge holds no key for the meter", reading.MeterID)
+		}
+		if err := reading.Sign(key); err != nil {
+			return err
+		}
+	}
+	select {
+	case b.queue <- &queued{reading: reading, ack: ack}:
+		metrics.BridgeQueueLength(len(b.queue))
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run submits queued readings in batches until ctx is done
+func (b *Bridge) Run(ctx context.Context) error {
+	for {
+		batch, err := b.nextBatch(ctx)
+		if err != nil {
+			return err
+		}
+		b.submitBatch(ctx, batch)
+	}
+}
+
+// nextBatch waits for a reading, then collects more until the batch is full
+// or FlushInterval has passed
+func (b *Bridge) nextBatch(ctx context.Context) ([]*queued, error) {
+	var batch []*queued
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case item := <-b.queue:
+		batch = append(batch, item)
+	}
+	timer := time.NewTimer(b.config.FlushInterval)
+	defer timer.Stop()
+	for len(batch) < b.config.BatchSize {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case item := <-b.queue:
+			batch = append(batch, item)
+		case <-timer.C:
+			metrics.BridgeQueueLength(len(b.queue))
+			return batch, nil
+		}
+	}
+	metrics.BridgeQueueLength(len(b.queue))
+	return batch, nil
+}
+
+// submitBatch submits a batch's readings, meters in parallel and each meter's
+// readings in interval order
+func (b *Bridge) submitBatch(ctx context.Context, batch []*queued) {
+	byMeter := map[string][]*queued{}
+	meters := []string{}
+	for _, item := range batch {
+		if _, ok := byMeter[item.reading.MeterID]; !ok {
+			meters = append(meters, item.reading.MeterID)
+		}
+		byMeter[item.reading.MeterID] = append(byMeter[item.reading.MeterID], item)
+	}
+
+	limit := make(chan struct{}, b.config.Concurrency)
+	var wg sync.WaitGroup
+	for _, meterID := range meters {
+		readings := byMeter[meterID]
+		sort.SliceStable(readings, func(i, j int) bool {
+			return readings[i].reading.IntervalStart < readings[j].reading.IntervalStart
+		})
+		wg.Add(1)
+		limit <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-limit }()
+			for _, item := range readings {
+				outcome, ok := b.submit(ctx, item.reading)
+				if !ok {
+					return
+				}
+				metrics.BridgedReading(outcome)
+				item.ack()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// submit submits one reading, retrying transient failures. It returns false
+// if the bridge stopped before the reading was done with. A reading the
+// chaincode reports as not later than the meter's last one was recorded by
+// an earlier attempt, or by a previous delivery of the message, and counts
+// as a duplicate.
+func (b *Bridge) submit(ctx context.Context, reading *Reading) (string, bool) {
+	backoff := b.config.Backoff
+	for {
+		_, err := b.contract.SubmitTransaction("SubmitMeterReading", reading.Arguments()...)
+		if err == nil {
+			return metrics.OutcomeSubmitted, true
+		}
+		metrics.FabricError("SubmitMeterReading", metrics.StageEndorse, err)
+		detailed := fabric.ErrorWithDetails(err)
+		if strings.Contains(detailed.Error(), "is not after the last reading") {
+			return metrics.OutcomeDuplicate, true
+		}
+		if !fabric.Transient(err) {
+			log.Printf("Reading of meter %s for %s rejected: %v", reading.MeterID, reading.IntervalStart, detailed)
+			return metrics.OutcomeRejected, true
+		}
+		log.Printf("Reading of meter %s for %s failed, retrying in %s: %v", reading.MeterID, reading.IntervalStart, backoff, detailed)
+		if err := b.sleep(ctx, backoff); err != nil {
+			return "", false
+		}
+		if backoff *= 2; backoff > b.config.MaxBackoff {
+			backoff = b.config.MaxBackoff
+		}
+	}
+}
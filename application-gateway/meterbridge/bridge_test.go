@@ -0,0 +1,180 @@
+package meterbridge
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"application-gateway/canonical"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+)
+
+var testNow = time.Date(2025, 5, 3, 12, 0, 0, 0, time.UTC)
+
+// fakeContract records submissions and fails each reading with the queued
+// errors before accepting it
+type fakeContract struct {
+	mu        sync.Mutex
+	failures  map[string][]error
+	submitted []string
+}
+
+func (f *fakeContract) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := args[0] + "@" + args[1]
+	f.submitted = append(f.submitted, key)
+	if queued := f.failures[key]; len(queued) > 0 {
+		f.failures[key] = queued[1:]
+		return nil, queued[0]
+	}
+	return nil, nil
+}
+
+func newTestBridge(contract Invoker, keys map[string]*ecdsa.PrivateKey) *Bridge {
+	b := New(contract, DefaultConfig(), keys)
+	b.sleep = func(context.Context, time.Duration) error { return nil }
+	b.now = func() time.Time { return testNow }
+	return b
+}
+
+func TestParseReading(t *testing.T) {
+	if id := topicMeterID(DefaultTopic, "meters/meter1/readings"); id != "meter1" {
+		t.Errorf("got meter ID %q from topic, want meter1", id)
+	}
+	reading, err := ParseReading("meter1", []byte(`{"intervalStart":"2025-05-03T10:00:00Z","kWhInjected":1.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reading.MeterID != "meter1" || reading.KWhInjected != 1.5 {
+		t.Errorf("got reading %+v", reading)
+	}
+	if _, err := ParseReading("meter1", []byte(`{"meterID":"meter2","intervalStart":"2025-05-03T10:00:00Z"}`)); err == nil {
+		t.Error("a reading published on another meter's topic was accepted")
+	}
+	if _, err := ParseReading("meter1", []byte(`{"intervalStart":"2025-05-03T10:00:00Z","kwh":1}`)); err == nil {
+		t.Error("a reading with an unknown field was accepted")
+	}
+}
+
+func TestEnqueueValidatesAndSigns(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBridge(&fakeContract{}, map[string]*ecdsa.PrivateKey{"meter1": key})
+	ctx := context.Background()
+
+	invalid := map[string]*Reading{
+		"unaligned":   {MeterID: "meter1", IntervalStart: "2025-05-03T10:05:00Z"},
+		"unfinished":  {MeterID: "meter1", IntervalStart: "2025-05-03T11:50:00Z"},
+		"negative":    {MeterID: "meter1", IntervalStart: "2025-05-03T10:00:00Z", KWhConsumed: -1},
+		"unsigned":    {MeterID: "meter2", IntervalStart: "2025-05-03T10:00:00Z"},
+		"no meter ID": {IntervalStart: "2025-05-03T10:00:00Z"},
+	}
+	for name, reading := range invalid {
+		if err := b.Enqueue(ctx, reading, func() {}); err == nil {
+			t.Errorf("%s reading was accepted", name)
+		}
+	}
+
+	reading := &Reading{MeterID: "meter1", IntervalStart: "2025-05-03T12:00:00+02:00", KWhInjected: 0.25, KWhConsumed: 1}
+	if err := b.Enqueue(ctx, reading, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if reading.IntervalStart != "2025-05-03T10:00:00Z" {
+		t.Errorf("got interval start %s, want it in UTC", reading.IntervalStart)
+	}
+	payload, err := canonical.Marshal(signedPayload{"meter1", reading.IntervalStart, 0.25, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(payload)
+	signature, err := base64.StdEncoding.DecodeString(reading.Signature)
+	if err != nil || !ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature) {
+		t.Errorf("signature %q does not verify", reading.Signature)
+	}
+}
+
+func TestSubmitBatch(t *testing.T) {
+	conflict := &client.CommitError{TransactionID: "tx1", Code: peer.TxValidationCode_MVCC_READ_CONFLICT}
+	contract := &fakeContract{failures: map[string][]error{
+		"meter1@2025-05-03T10:00:00Z": {conflict, conflict},
+		"meter1@2025-05-03T10:15:00Z": {errors.New("interval start 2025-05-03T10:15:00Z is not after the last reading 2025-05-03T10:15:00Z of meter meter1")},
+		"meter2@2025-05-03T10:00:00Z": {errors.New("signature does not match the reading of meter meter2")},
+	}}
+	b := newTestBridge(contract, nil)
+	ctx := context.Background()
+
+	acked := map[string]bool{}
+	var mu sync.Mutex
+	// meter1's readings arrive out of order
+	for _, reading := range []*Reading{
+		{MeterID: "meter1", IntervalStart: "2025-05-03T10:30:00Z", Signature: "c2ln"},
+		{MeterID: "meter2", IntervalStart: "2025-05-03T10:00:00Z", Signature: "c2ln"},
+		{MeterID: "meter1", IntervalStart: "2025-05-03T10:00:00Z", Signature: "c2ln"},
+		{MeterID: "meter1", IntervalStart: "2025-05-03T10:15:00Z", Signature: "c2ln"},
+	} {
+		key := reading.MeterID + "@" + reading.IntervalStart
+		if err := b.Enqueue(ctx, reading, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			acked[key] = true
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.config.FlushInterval = time.Millisecond
+	batch, err := b.nextBatch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 4 {
+		t.Fatalf("got a batch of %d readings, want 4", len(batch))
+	}
+	b.submitBatch(ctx, batch)
+
+	if len(acked) != 4 {
+		t.Errorf("got acknowledgements %v, want all 4 readings", acked)
+	}
+	meter1 := []string{}
+	for _, key := range contract.submitted {
+		if strings.HasPrefix(key, "meter1@") {
+			meter1 = append(meter1, strings.TrimPrefix(key, "meter1@"))
+		}
+	}
+	want := "2025-05-03T10:00:00Z 2025-05-03T10:00:00Z 2025-05-03T10:00:00Z 2025-05-03T10:15:00Z 2025-05-03T10:30:00Z"
+	if got := strings.Join(meter1, " "); got != want {
+		t.Errorf("got meter1 submissions %s, want %s", got, want)
+	}
+}
+
+func TestSubmitStopsWithoutAcknowledging(t *testing.T) {
+	contract := &fakeContract{failures: map[string][]error{
+		"meter1@2025-05-03T10:00:00Z": {&client.CommitError{Code: peer.TxValidationCode_MVCC_READ_CONFLICT}},
+	}}
+	b := newTestBridge(contract, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	b.sleep = func(context.Context, time.Duration) error {
+		cancel()
+		return context.Canceled
+	}
+
+	acked := false
+	reading := &Reading{MeterID: "meter1", IntervalStart: "2025-05-03T10:00:00Z", Signature: "c2ln"}
+	b.submitBatch(ctx, []*queued{{reading: reading, ack: func() { acked = true }}})
+	if acked {
+		t.Error("a reading that was never recorded was acknowledged")
+	}
+}
@@ -0,0 +1,59 @@
+package meterbridge
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"application-gateway/metrics"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultTopic is the topic filter meters publish readings on. The level
+// matched by the single-level wildcard is the meter ID.
+const DefaultTopic = "meters/+/readings"
+
+// topicMeterID returns the level of topic matched by the first single-level
+// wildcard of filter, or "" if there is none
+func topicMeterID(filter, topic string) string {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "+" && i < len(topicLevels) {
+			return topicLevels[i]
+		}
+	}
+	return ""
+}
+
+// ClientOptions sets the MQTT client options the bridge relies on: a
+// persistent session, so that the broker keeps unacknowledged readings
+// across reconnects, and manual acknowledgements, so that only readings that
+// are done with are acknowledged. Messages are handled concurrently, as a
+// handler blocks while the queue is full.
+func ClientOptions(options *mqtt.ClientOptions) *mqtt.ClientOptions {
+	return options.
+		SetCleanSession(false).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(false).
+		SetAutoReconnect(true)
+}
+
+// Handler returns the MQTT handler for messages on topics matching filter.
+// Invalid readings are acknowledged and dropped, as a redelivery would not
+// make them valid. Messages still queued when ctx is done are left
+// unacknowledged.
+func (b *Bridge) Handler(ctx context.Context, filter string) mqtt.MessageHandler {
+	return func(_ mqtt.Client, message mqtt.Message) {
+		reading, err := ParseReading(topicMeterID(filter, message.Topic()), message.Payload())
+		if err == nil {
+			err = b.Enqueue(ctx, reading, message.Ack)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Dropping message on %s: %v", message.Topic(), err)
+			metrics.BridgedReading(metrics.OutcomeRejected)
+			message.Ack()
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package meterbridge
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"application-gateway/canonical"
+)
+
+// Reading is the JSON a meter or its gateway publishes for one interval.
+// Signature is the base64 ASN.1 ECDSA signature by the meter's device key
+// over the SHA-256 of the canonical JSON of the other fields. Meters that
+// cannot sign leave it empty and the bridge signs with the key it holds for
+// them.
+type Reading struct {
+	MeterID       string  `json:"meterID"`
+	IntervalStart string  `json:"intervalStart"`
+	KWhInjected   float64 `json:"kWhInjected"`
+	KWhConsumed   float64 `json:"kWhConsumed"`
+	Signature     string  `json:"signature,omitempty"`
+}
+
+// signedPayload mirrors the chaincode's MeterReadingPayload
+type signedPayload struct {
+	MeterID       string  `json:"meterID"`
+	IntervalStart string  `json:"intervalStart"`
+	KWhInjected   float64 `json:"kWhInjected"`
+	KWhConsumed   float64 `json:"kWhConsumed"`
+}
+
+// ParseReading decodes a message published on a meter's topic. The meter ID
+// is taken from the topic if the payload leaves it out, and must match it
+// otherwise, so that a gateway cannot publish for meters it does not serve
+// under topic ACLs.
+func ParseReading(topicMeterID string, payload []byte) (*Reading, error) {
+	var reading Reading
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reading); err != nil {
+		return nil, fmt.Errorf("invalid reading: %w", err)
+	}
+	if reading.MeterID == "" {
+		reading.MeterID = topicMeterID
+	}
+	if topicMeterID != "" && reading.MeterID != topicMeterID {
+		return nil, fmt.Errorf("reading of meter %s was published for meter %s", reading.MeterID, topicMeterID)
+	}
+	return &reading, nil
+}
+
+// Validate checks what the chaincode would reject anyway, so that a bad
+// reading does not cost a transaction: a meter ID, finite non-negative
+// energy, and an interval aligned to interval that has finished by now.
+// The interval start is normalized to RFC 3339 in UTC.
+func (r *Reading) Validate(interval time.Duration, now time.Time) error {
+	if r.MeterID == "" {
+		return errors.New("reading has no meter ID")
+	}
+	for _, value := range []float64{r.KWhInjected, r.KWhConsumed} {
+		if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("reading of meter %s has invalid energy %v", r.MeterID, value)
+		}
+	}
+	start, err := time.Parse(time.RFC3339, r.IntervalStart)
+	if err != nil {
+		return fmt.Errorf("reading of meter %s has invalid interval start: %w", r.MeterID, err)
+	}
+	if !start.Truncate(interval).Equal(start) {
+		return fmt.Errorf("interval start %s of meter %s is not aligned to %s", r.IntervalStart, r.MeterID, interval)
+	}
+	if start.Add(interval).After(now) {
+		return fmt.Errorf("interval starting %s of meter %s has not finished", r.IntervalStart, r.MeterID)
+	}
+	r.IntervalStart = start.UTC().Format(time.RFC3339)
+	return nil
+}
+
+// Sign signs the reading with a meter key held by the bridge
+func (r *Reading) Sign(key *ecdsa.PrivateKey) error {
+	payload, err := canonical.Marshal(signedPayload{r.MeterID, r.IntervalStart, r.KWhInjected, r.KWhConsumed})
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return err
+	}
+	r.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// Arguments returns the SubmitMeterReading arguments
+func (r *Reading) Arguments() []string {
+	return []string{
+		r.MeterID,
+		r.IntervalStart,
+		strconv.FormatFloat(r.KWhInjected, 'f', -1, 64),
+		strconv.FormatFloat(r.KWhConsumed, 'f', -1, 64),
+		r.Signature,
+	}
+}
+
+// LoadKeys reads the meter keys the bridge signs with from dir, one PKCS #8
+// PEM file per meter named <meter ID>.pem. A missing directory holds no keys.
+func LoadKeys(dir string) (map[string]*ecdsa.PrivateKey, error) {
+	keys := map[string]*ecdsa.PrivateKey{}
+	if dir == "" {
+		return keys, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		keyPEM, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data found", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: key is not an ECDSA key", path)
+		}
+		keys[strings.TrimSuffix(filepath.Base(path), ".pem")] = ecKey
+	}
+	return keys, nil
+}
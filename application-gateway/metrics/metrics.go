@@ -0,0 +1,224 @@
+// Package metrics defines the Prometheus metrics of the off-chain services.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "energy_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	fabricErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "energy_fabric_errors_total",
+		Help: "Failed chaincode invocations by function and the stage that failed: evaluate, endorse, submit or commit.",
+	}, []string{"function", "stage"})
+
+	eventsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "energy_events_processed_total",
+		Help: "Chaincode events and blocks processed by stream and event name.",
+	}, []string{"stream", "event"})
+
+	lastBlock = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "energy_last_block_processed",
+		Help: "Number of the last block an event stream processed.",
+	}, []string{"stream"})
+
+	schedulerSettlements = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "energy_scheduler_settlements_total",
+		Help: "Trades the settlement scheduler attempted, by outcome: settled, skipped or failed.",
+	}, []string{"outcome"})
+
+	bridgedReadings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "energy_meter_bridge_readings_total",
+		Help: "Meter readings the MQTT bridge handled, by outcome: submitted, duplicate or rejected.",
+	}, []string{"outcome"})
+
+	bridgeQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "energy_meter_bridge_queue_length",
+		Help: "Meter readings waiting in the MQTT bridge for submission.",
+	})
+
+	notifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "energy_notifications_total",
+		Help: "Notifications the notifier sent, by kind, channel and outcome: sent or failed.",
+	}, []string{"kind", "channel", "outcome"})
+
+	gridHeadroom = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "energy_grid_headroom_kwh",
+		Help: "Capacity per meter interval the telemetry adapter last posted for a zone, by direction: export or import.",
+	}, []string{"zone", "direction"})
+
+	transformerUtilization = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "energy_transformer_utilization",
+		Help: "Share of a zone's transformer rating that confirmed trades schedule in the current interval, as last read by the telemetry adapter.",
+	}, []string{"zone"})
+
+	priceForecastError = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "energy_price_forecast_error",
+		Help: "Mean absolute error, in tokens per kWh, of the price forecaster's predictions over its last training window.",
+	})
+
+	submissionQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "energy_submission_queue_length",
+		Help: "Submissions waiting in the gateway for a free slot, by priority class.",
+	}, []string{"class"})
+
+	submissionRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "energy_submission_retries_total",
+		Help: "Submissions the gateway retried, by priority class and reason: conflict or endorsement.",
+	}, []string{"class", "reason"})
+
+	settlementLag = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "energy_settlement_lag_seconds",
+		Help:    "Time from the end of a trade's delivery window to its settlement.",
+		Buckets: []float64{60, 300, 900, 1800, 3600, 3 * 3600, 6 * 3600, 12 * 3600, 24 * 3600, 48 * 3600},
+	})
+)
+
+// Handler serves the metrics for scraping
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Instrument records the latency of a route's requests. route is the pattern
+// the handler is registered under, so paths with identifiers share a series.
+func Instrument(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		requestDuration.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Fabric invocation stages
+const (
+	StageEvaluate = "evaluate"
+	StageEndorse  = "endorse"
+	StageSubmit   = "submit"
+	StageCommit   = "commit"
+)
+
+// FabricError counts a failed invocation of function. The stage is taken from
+// the Fabric Gateway error type, falling back to fallbackStage.
+func FabricError(function, fallbackStage string, err error) {
+	stage := fallbackStage
+	var endorseErr *client.EndorseError
+	var submitErr *client.SubmitError
+	var commitStatusErr *client.CommitStatusError
+	var commitErr *client.CommitError
+	switch {
+	case errors.As(err, &endorseErr):
+		stage = StageEndorse
+	case errors.As(err, &submitErr):
+		stage = StageSubmit
+	case errors.As(err, &commitStatusErr), errors.As(err, &commitErr):
+		stage = StageCommit
+	}
+	fabricErrors.WithLabelValues(function, stage).Inc()
+}
+
+// EventProcessed counts an event, or a block with event "block", processed by
+// stream in blockNumber.
+func EventProcessed(stream, event string, blockNumber uint64) {
+	eventsProcessed.WithLabelValues(stream, event).Inc()
+	lastBlock.WithLabelValues(stream).Set(float64(blockNumber))
+}
+
+// SettlementLag records how long after the delivery window ended a trade settled
+func SettlementLag(lag time.Duration) {
+	settlementLag.Observe(lag.Seconds())
+}
+
+// Scheduler settlement outcomes
+const (
+	OutcomeSettled = "settled"
+	OutcomeSkipped = "skipped"
+	OutcomeFailed  = "failed"
+)
+
+// SchedulerSettlement counts a trade the scheduler attempted to settle
+func SchedulerSettlement(outcome string) {
+	schedulerSettlements.WithLabelValues(outcome).Inc()
+}
+
+// Meter bridge reading outcomes
+const (
+	OutcomeSubmitted = "submitted"
+	OutcomeDuplicate = "duplicate"
+	OutcomeRejected  = "rejected"
+)
+
+// BridgedReading counts a meter reading the MQTT bridge handled
+func BridgedReading(outcome string) {
+	bridgedReadings.WithLabelValues(outcome).Inc()
+}
+
+// BridgeQueueLength records how many readings wait for submission
+func BridgeQueueLength(length int) {
+	bridgeQueueLength.Set(float64(length))
+}
+
+// Notification outcomes; a failed send is OutcomeFailed
+const OutcomeSent = "sent"
+
+// Notification counts a notification sent, or failed to send, on a channel
+func Notification(kind, channel, outcome string) {
+	notifications.WithLabelValues(kind, channel, outcome).Inc()
+}
+
+// GridHeadroom records the capacity limits posted for a zone
+func GridHeadroom(zone string, exportLimit, importLimit float64) {
+	gridHeadroom.WithLabelValues(zone, "export").Set(exportLimit)
+	gridHeadroom.WithLabelValues(zone, "import").Set(importLimit)
+}
+
+// TransformerUtilization records the scheduled utilization of a zone's transformer
+func TransformerUtilization(zone string, utilization float64) {
+	transformerUtilization.WithLabelValues(zone).Set(utilization)
+}
+
+// PriceForecastError records the training error of a published forecast
+func PriceForecastError(meanAbsoluteError float64) {
+	priceForecastError.Set(meanAbsoluteError)
+}
+
+// Submission retry reasons
+const (
+	RetryConflict    = "conflict"
+	RetryEndorsement = "endorsement"
+)
+
+// SubmissionQueueLength records how many submissions of a class wait for a
+// slot
+func SubmissionQueueLength(class string, length int) {
+	submissionQueueLength.WithLabelValues(class).Set(float64(length))
+}
+
+// SubmissionRetry counts a submission retried for reason
+func SubmissionRetry(class, reason string) {
+	submissionRetries.WithLabelValues(class, reason).Inc()
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestInstrument(t *testing.T) {
+	handler := Instrument("GET /trades/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/trades/energy1", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/trades/energy2", nil))
+
+	var metric dto.Metric
+	if err := requestDuration.WithLabelValues("GET /trades/{id}", http.MethodGet, "404").(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	if got := metric.GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("got %d requests recorded, want 2", got)
+	}
+}
+
+func TestFabricError(t *testing.T) {
+	FabricError("ReadEnergyAsset", StageEvaluate, errors.New("asset energy1 does not exist"))
+	if got := testutil.ToFloat64(fabricErrors.WithLabelValues("ReadEnergyAsset", StageEvaluate)); got != 1 {
+		t.Errorf("got %v evaluate errors, want 1", got)
+	}
+}
@@ -0,0 +1,288 @@
+// Package notify tells users about the chaincode events that concern them,
+// by push, email or webhook, as their preferences in the gateway database
+// ask.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+	"application-gateway/push"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// Chaincode events notifications are made from
+const (
+	eventTradeConfirmed      = "TradeConfirmed"
+	eventTradeSettled        = "TradeSettled"
+	eventTokensTransferred   = "TokensTransferred"
+	eventMeterDisputeChanged = "MeterDisputeChanged"
+)
+
+const disputeOpen = "OPEN"
+
+type tradeEvent struct {
+	TokenID       string  `json:"tokenID"`
+	Buyer         string  `json:"buyer"`
+	Seller        string  `json:"seller"`
+	EnergyAmount  float64 `json:"energyAmount"`
+	DeliveryStart string  `json:"deliveryStart"`
+}
+
+type settlementEvent struct {
+	TokenID          string  `json:"tokenID"`
+	SellerNetPayment float64 `json:"sellerNetPayment"`
+}
+
+type tokenEvent struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+}
+
+type disputeEvent struct {
+	MeterID       string `json:"meterID"`
+	IntervalStart string `json:"intervalStart"`
+	TokenID       string `json:"tokenID"`
+	Challenger    string `json:"challenger"`
+	Reason        string `json:"reason"`
+	Status        string `json:"status"`
+}
+
+// Message is a notification to one user. Webhooks receive it as is.
+type Message struct {
+	Kind    string                 `json:"kind"`
+	Address string                 `json:"address"`
+	Title   string                 `json:"title"`
+	Body    string                 `json:"body"`
+	Data    map[string]interface{} `json:"data"`
+}
+
+// Config controls when reminders are sent
+type Config struct {
+	// ReminderLead is how long before a trade's delivery starts its parties
+	// are reminded
+	ReminderLead time.Duration
+	// ReminderInterval is how often due reminders are sent
+	ReminderInterval time.Duration
+}
+
+// DefaultConfig returns the configuration for 15 minute meter intervals
+func DefaultConfig() Config {
+	return Config{ReminderLead: 15 * time.Minute, ReminderInterval: time.Minute}
+}
+
+// Notifier turns chaincode events into messages and sends them on the
+// channels each user chose. Sending is best effort: a failed send is logged
+// and counted, not retried, so that one unreachable webhook cannot hold up
+// everyone else's notifications.
+type Notifier struct {
+	store   *Store
+	lookup  push.TradeLookup
+	senders map[string]Sender
+	config  Config
+	now     func() time.Time
+}
+
+// New returns a notifier sending on senders, by channel. lookup finds the
+// parties of trades for events that do not name them.
+func New(store *Store, lookup push.TradeLookup, senders map[string]Sender, config Config) *Notifier {
+	return &Notifier{store: store, lookup: lookup, senders: senders, config: config, now: time.Now}
+}
+
+// Run notifies the events of the chaincode on network and sends due
+// reminders until ctx is done or the event stream fails. It resumes after
+// the last event processed; the first run starts with the next block, so
+// that users are not told about the past.
+func (n *Notifier) Run(ctx context.Context, network *client.Network, chaincodeName string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cp, err := n.store.Checkpoint()
+	if err != nil {
+		return err
+	}
+	var options []client.ChaincodeEventsOption
+	if cp != nil {
+		options = append(options, client.WithCheckpoint(cp))
+	}
+	events, err := network.ChaincodeEvents(ctx, chaincodeName, options...)
+	if err != nil {
+		return fmt.Errorf("failed to start chaincode event listening: %w", err)
+	}
+
+	ticker := time.NewTicker(n.config.ReminderInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				return errors.New("chaincode event stream closed")
+			}
+			env, err := fabric.ParseEvent(event)
+			if err != nil {
+				return err
+			}
+			if err := n.HandleEvent(ctx, env); err != nil {
+				return err
+			}
+			if err := n.store.SaveCheckpoint(event.BlockNumber, event.TransactionID); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := n.SendDueReminders(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// HandleEvent sends the notifications of one event and schedules the
+// delivery reminders of confirmed trades. Only database failures are
+// returned.
+func (n *Notifier) HandleEvent(ctx context.Context, env *fabric.EventEnvelope) error {
+	switch env.Name {
+	case eventTradeConfirmed:
+		var trade tradeEvent
+		if err := json.Unmarshal(env.Payload, &trade); err != nil {
+			return nil
+		}
+		deliveryStart, err := time.Parse(time.RFC3339, trade.DeliveryStart)
+		if err != nil {
+			return nil
+		}
+		for _, address := range []string{trade.Buyer, trade.Seller} {
+			if err := n.notify(ctx, &Message{
+				Kind:    KindTradeMatched,
+				Address: address,
+				Title:   "Trade matched",
+				Body:    fmt.Sprintf("Trade %s of %g kWh is confirmed for delivery at %s.", trade.TokenID, trade.EnergyAmount, trade.DeliveryStart),
+				Data:    map[string]interface{}{"tokenID": trade.TokenID, "energyAmount": trade.EnergyAmount, "deliveryStart": trade.DeliveryStart},
+			}); err != nil {
+				return err
+			}
+			if !deliveryStart.After(n.now()) {
+				continue
+			}
+			if err := n.store.AddReminder(Reminder{
+				TokenID:       trade.TokenID,
+				Address:       address,
+				EnergyAmount:  trade.EnergyAmount,
+				DeliveryStart: trade.DeliveryStart,
+				DueAt:         deliveryStart.Add(-n.config.ReminderLead),
+			}); err != nil {
+				return err
+			}
+		}
+
+	case eventTradeSettled:
+		var settlement settlementEvent
+		if err := json.Unmarshal(env.Payload, &settlement); err != nil || settlement.SellerNetPayment <= 0 {
+			return nil
+		}
+		trade, err := n.lookup(settlement.TokenID)
+		if err != nil {
+			log.Printf("Payment notification of trade %s dropped: %v", settlement.TokenID, err)
+			return nil
+		}
+		return n.notify(ctx, &Message{
+			Kind:    KindPaymentReceived,
+			Address: trade.Seller,
+			Title:   "Payment received",
+			Body:    fmt.Sprintf("You received %g tokens for trade %s.", settlement.SellerNetPayment, settlement.TokenID),
+			Data:    map[string]interface{}{"tokenID": settlement.TokenID, "amount": settlement.SellerNetPayment},
+		})
+
+	case eventTokensTransferred:
+		var movement tokenEvent
+		if err := json.Unmarshal(env.Payload, &movement); err != nil || movement.From == "" {
+			return nil
+		}
+		return n.notify(ctx, &Message{
+			Kind:    KindPaymentReceived,
+			Address: movement.To,
+			Title:   "Payment received",
+			Body:    fmt.Sprintf("You received %g tokens from %s.", movement.Amount, movement.From),
+			Data:    map[string]interface{}{"from": movement.From, "amount": movement.Amount},
+		})
+
+	case eventMeterDisputeChanged:
+		var dispute disputeEvent
+		if err := json.Unmarshal(env.Payload, &dispute); err != nil || dispute.Status != disputeOpen {
+			return nil
+		}
+		trade, err := n.lookup(dispute.TokenID)
+		if err != nil {
+			log.Printf("Dispute notification of trade %s dropped: %v", dispute.TokenID, err)
+			return nil
+		}
+		for _, address := range []string{trade.Buyer, trade.Seller} {
+			if address == dispute.Challenger {
+				continue
+			}
+			if err := n.notify(ctx, &Message{
+				Kind:    KindDisputeOpened,
+				Address: address,
+				Title:   "Dispute opened",
+				Body:    fmt.Sprintf("The reading of meter %s for %s behind trade %s is disputed: %s", dispute.MeterID, dispute.IntervalStart, dispute.TokenID, dispute.Reason),
+				Data:    map[string]interface{}{"tokenID": dispute.TokenID, "meterID": dispute.MeterID, "intervalStart": dispute.IntervalStart},
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SendDueReminders sends the delivery reminders that are due
+func (n *Notifier) SendDueReminders(ctx context.Context) error {
+	reminders, err := n.store.DueReminders(n.now())
+	if err != nil {
+		return err
+	}
+	for _, r := range reminders {
+		if err := n.notify(ctx, &Message{
+			Kind:    KindDeliveryDue,
+			Address: r.Address,
+			Title:   "Delivery due",
+			Body:    fmt.Sprintf("Trade %s delivers %g kWh from %s.", r.TokenID, r.EnergyAmount, r.DeliveryStart),
+			Data:    map[string]interface{}{"tokenID": r.TokenID, "energyAmount": r.EnergyAmount, "deliveryStart": r.DeliveryStart},
+		}); err != nil {
+			return err
+		}
+		if err := n.store.DeleteReminder(r.TokenID, r.Address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notify sends a message on the channels its user chose for its kind
+func (n *Notifier) notify(ctx context.Context, m *Message) error {
+	prefs, err := n.store.Preferences(m.Address)
+	if err != nil || prefs == nil {
+		return err
+	}
+	for _, channel := range prefs.Events[m.Kind] {
+		sender, ok := n.senders[channel]
+		if !ok {
+			continue
+		}
+		if err := sender.Send(ctx, prefs, m); err != nil {
+			log.Printf("Sending %s notification to %s by %s failed: %v", m.Kind, m.Address, channel, err)
+			metrics.Notification(m.Kind, channel, metrics.OutcomeFailed)
+			continue
+		}
+		metrics.Notification(m.Kind, channel, metrics.OutcomeSent)
+	}
+	return nil
+}
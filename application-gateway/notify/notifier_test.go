@@ -0,0 +1,202 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"application-gateway/fabric"
+	"application-gateway/push"
+)
+
+func openTestStore(t *testing.T) *Store {
+	store, err := Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func testEnvelope(t *testing.T, name string, payload interface{}) *fabric.EventEnvelope {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fabric.EventEnvelope{SchemaVersion: 1, Sequence: 1, Name: name, Payload: payloadJSON}
+}
+
+// fakeSender records the messages sent on one channel
+type fakeSender struct {
+	channel string
+	sent    *[]string
+}
+
+func (f fakeSender) Send(ctx context.Context, prefs *Preferences, m *Message) error {
+	*f.sent = append(*f.sent, f.channel+" "+m.Kind+" "+m.Address)
+	return nil
+}
+
+func TestSetPreferences(t *testing.T) {
+	store := openTestStore(t)
+	now := time.Date(2025, 5, 1, 8, 0, 0, 0, time.UTC)
+	invalid := []*Preferences{
+		{Address: "prosumer1", WebhookURL: "http://example.com/hook"},
+		{Address: "prosumer1", Email: "Prosumer <prosumer1@example.com>"},
+		{Address: "prosumer1", Events: map[string][]string{KindTradeMatched: {ChannelEmail}}},
+		{Address: "prosumer1", PushToken: "token", Events: map[string][]string{"tradeCancelled": {ChannelPush}}},
+	}
+	for _, prefs := range invalid {
+		if _, err := store.SetPreferences(prefs, now); err == nil {
+			t.Errorf("expected preferences %+v to be rejected", prefs)
+		}
+	}
+
+	prefs := &Preferences{Address: "prosumer1", WebhookURL: "https://example.com/hook", Events: map[string][]string{KindTradeMatched: {ChannelWebhook}}}
+	first, err := store.SetPreferences(prefs, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.WebhookSecret) != 64 {
+		t.Fatalf("got webhook secret %q", first.WebhookSecret)
+	}
+	prefs.Email = "prosumer1@example.com"
+	second, err := store.SetPreferences(prefs, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.WebhookSecret != first.WebhookSecret {
+		t.Error("the webhook secret changed with the URL unchanged")
+	}
+	prefs.WebhookURL = "https://example.org/hook"
+	if third, _ := store.SetPreferences(prefs, now); third.WebhookSecret == first.WebhookSecret {
+		t.Error("the webhook secret was kept for a new URL")
+	}
+
+	stored, err := store.Preferences("prosumer1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Email != "prosumer1@example.com" || !reflect.DeepEqual(stored.Events, prefs.Events) {
+		t.Errorf("got preferences %+v", stored)
+	}
+	if err := store.DeletePreferences("prosumer1"); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := store.Preferences("prosumer1"); stored != nil {
+		t.Errorf("got preferences %+v after deleting them", stored)
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	store := openTestStore(t)
+	now := time.Date(2025, 5, 1, 8, 0, 0, 0, time.UTC)
+	all := []string{ChannelPush, ChannelWebhook}
+	for _, address := range []string{"buyer1", "seller1"} {
+		if _, err := store.SetPreferences(&Preferences{
+			Address:    address,
+			PushToken:  "ExponentPushToken[" + address + "]",
+			WebhookURL: "https://example.com/" + address,
+			Events:     map[string][]string{KindTradeMatched: {ChannelPush}, KindDeliveryDue: all, KindPaymentReceived: all, KindDisputeOpened: {ChannelWebhook}},
+		}, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup := func(tokenID string) (*push.TradeInfo, error) {
+		if tokenID != "energy1" {
+			return nil, errors.New("asset " + tokenID + " does not exist")
+		}
+		return &push.TradeInfo{Buyer: "buyer1", Seller: "seller1", DeliveryStart: "2025-05-01T10:00:00Z"}, nil
+	}
+	var sent []string
+	senders := map[string]Sender{ChannelPush: fakeSender{ChannelPush, &sent}, ChannelWebhook: fakeSender{ChannelWebhook, &sent}}
+	notifier := New(store, lookup, senders, DefaultConfig())
+	notifier.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	events := []*fabric.EventEnvelope{
+		testEnvelope(t, eventTradeConfirmed, tradeEvent{TokenID: "energy1", Buyer: "buyer1", Seller: "seller1", EnergyAmount: 5, DeliveryStart: "2025-05-01T10:00:00Z"}),
+		testEnvelope(t, eventTokensTransferred, tokenEvent{To: "buyer1", Amount: 100}),
+		testEnvelope(t, eventTokensTransferred, tokenEvent{From: "seller1", To: "buyer1", Amount: 2}),
+		testEnvelope(t, eventMeterDisputeChanged, disputeEvent{MeterID: "meter-seller1", TokenID: "energy1", Challenger: "buyer1", Status: disputeOpen}),
+		testEnvelope(t, eventMeterDisputeChanged, disputeEvent{MeterID: "meter-seller1", TokenID: "energy1", Challenger: "buyer1", Status: "UPHELD"}),
+	}
+	for _, env := range events {
+		if err := notifier.HandleEvent(ctx, env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"push tradeMatched buyer1",
+		"push tradeMatched seller1",
+		"push paymentReceived buyer1",
+		"webhook paymentReceived buyer1",
+		"webhook disputeOpened seller1",
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Fatalf("got notifications %v, want %v", sent, want)
+	}
+
+	// Reminders are due 15 minutes before delivery, and are sent once
+	sent = nil
+	now = time.Date(2025, 5, 1, 9, 44, 0, 0, time.UTC)
+	if err := notifier.SendDueReminders(ctx); err != nil || len(sent) != 0 {
+		t.Fatalf("got early reminders %v: %v", sent, err)
+	}
+	now = time.Date(2025, 5, 1, 9, 45, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if err := notifier.SendDueReminders(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want = []string{"push deliveryDue buyer1", "webhook deliveryDue buyer1", "push deliveryDue seller1", "webhook deliveryDue seller1"}
+	if !reflect.DeepEqual(sent, want) {
+		t.Fatalf("got reminders %v, want %v", sent, want)
+	}
+
+	sent = nil
+	if err := notifier.HandleEvent(ctx, testEnvelope(t, eventTradeSettled, settlementEvent{TokenID: "energy1", SellerNetPayment: 1.2})); err != nil {
+		t.Fatal(err)
+	}
+	if want = []string{"push paymentReceived seller1", "webhook paymentReceived seller1"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("got notifications %v, want %v", sent, want)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	secret := "0123456789abcdef"
+	var got Message
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if r.Header.Get(SignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer server.Close()
+
+	sender := &WebhookSender{Client: server.Client()}
+	m := &Message{Kind: KindPaymentReceived, Address: "seller1", Title: "Payment received", Body: "You received 1.2 tokens for trade energy1."}
+	if err := sender.Send(context.Background(), &Preferences{WebhookURL: server.URL, WebhookSecret: secret}, m); err != nil {
+		t.Fatal(err)
+	}
+	if got.Kind != KindPaymentReceived || got.Address != "seller1" {
+		t.Errorf("got message %+v", got)
+	}
+	if err := sender.Send(context.Background(), &Preferences{WebhookURL: server.URL, WebhookSecret: "other"}, m); err == nil {
+		t.Error("expected a rejected webhook request to fail")
+	}
+}
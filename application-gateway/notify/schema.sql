@@ -0,0 +1,35 @@
+-- Gateway database. The gateway writes the notification preferences of its
+-- users; the notifier reads them and keeps its own progress.
+
+-- notification_preferences holds, per address, where the user is reached
+-- and, in events, a JSON object of the channels each kind of notification is
+-- sent on.
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    address        TEXT PRIMARY KEY,
+    email          TEXT NOT NULL,
+    webhook_url    TEXT NOT NULL,
+    webhook_secret TEXT NOT NULL,
+    push_token     TEXT NOT NULL,
+    events         TEXT NOT NULL,
+    updated_at     TEXT NOT NULL
+);
+
+-- notifier_checkpoints records the chaincode event the notifier processed
+-- last.
+CREATE TABLE IF NOT EXISTS notifier_checkpoints (
+    stream         TEXT PRIMARY KEY,
+    block_number   INTEGER NOT NULL,
+    transaction_id TEXT NOT NULL
+);
+
+-- notification_reminders are the delivery reminders still to be sent, one
+-- per party of a confirmed trade.
+CREATE TABLE IF NOT EXISTS notification_reminders (
+    token_id       TEXT NOT NULL,
+    address        TEXT NOT NULL,
+    energy_amount  REAL NOT NULL,
+    delivery_start TEXT NOT NULL,
+    due_at         TEXT NOT NULL,
+    PRIMARY KEY (token_id, address)
+);
+CREATE INDEX IF NOT EXISTS notification_reminders_due ON notification_reminders (due_at);
@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of a webhook request's body under
+// the webhook secret, as sha256=<hex>
+const SignatureHeader = "X-Energy-Signature"
+
+// ExpoPushURL is Expo's push API, which the apps built with Expo and React
+// Native receive push notifications through
+const ExpoPushURL = "https://exp.host/--/api/v2/push/send"
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// Sender delivers a notification on one channel
+type Sender interface {
+	Send(ctx context.Context, prefs *Preferences, m *Message) error
+}
+
+// EmailSender sends notifications as plain text email through an SMTP relay
+type EmailSender struct {
+	Address string
+	From    string
+	Auth    smtp.Auth
+}
+
+// Send mails the notification to the user's email address
+func (s *EmailSender) Send(ctx context.Context, prefs *Preferences, m *Message) error {
+	if prefs.Email == "" {
+		return errors.New("no email address")
+	}
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", s.From, prefs.Email, m.Title)
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", m.Body)
+	return smtp.SendMail(s.Address, s.Auth, s.From, []string{prefs.Email}, []byte(message.String()))
+}
+
+// WebhookSender posts notifications as JSON to the user's webhook, signed
+// with the webhook's secret
+type WebhookSender struct {
+	Client *http.Client
+}
+
+// Send posts the notification to the user's webhook URL
+func (s *WebhookSender) Send(ctx context.Context, prefs *Preferences, m *Message) error {
+	if prefs.WebhookURL == "" {
+		return errors.New("no webhook URL")
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(prefs.WebhookSecret))
+	mac.Write(body)
+	return post(ctx, s.Client, prefs.WebhookURL, body, http.Header{SignatureHeader: {"sha256=" + hex.EncodeToString(mac.Sum(nil))}})
+}
+
+// PushSender sends notifications to the user's device through a push
+// service taking Expo's message format
+type PushSender struct {
+	URL         string
+	AccessToken string
+	Client      *http.Client
+}
+
+// pushMessage is a message in Expo's format
+type pushMessage struct {
+	To    string                 `json:"to"`
+	Title string                 `json:"title"`
+	Body  string                 `json:"body"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+}
+
+// Send pushes the notification to the user's device token
+func (s *PushSender) Send(ctx context.Context, prefs *Preferences, m *Message) error {
+	if prefs.PushToken == "" {
+		return errors.New("no push token")
+	}
+	body, err := json.Marshal(pushMessage{To: prefs.PushToken, Title: m.Title, Body: m.Body, Data: m.Data})
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if s.AccessToken != "" {
+		header.Set("Authorization", "Bearer "+s.AccessToken)
+	}
+	return post(ctx, s.Client, s.URL, body, header)
+}
+
+// post sends a JSON request and fails unless it gets a 2xx response
+func post(ctx context.Context, client *http.Client, url string, body []byte, header http.Header) error {
+	if client == nil {
+		client = defaultClient
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered with status %d", request.URL.Host, response.StatusCode)
+	}
+	return nil
+}
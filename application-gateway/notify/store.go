@@ -0,0 +1,270 @@
+package notify
+
+import (
+	"crypto/rand"
+	"database/sql"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	_ "modernc.org/sqlite"
+)
+
+//go:embed schema.sql
+var schema string
+
+// Notification kinds
+const (
+	KindTradeMatched    = "tradeMatched"
+	KindDeliveryDue     = "deliveryDue"
+	KindPaymentReceived = "paymentReceived"
+	KindDisputeOpened   = "disputeOpened"
+)
+
+// Channels a notification is sent on
+const (
+	ChannelPush    = "push"
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+var kinds = map[string]bool{KindTradeMatched: true, KindDeliveryDue: true, KindPaymentReceived: true, KindDisputeOpened: true}
+
+// Preferences are where a user is reached and, in Events, which channels
+// each kind of notification is sent on. Kinds missing from Events are not
+// sent. WebhookSecret is generated by the store and signs the webhook
+// requests.
+type Preferences struct {
+	Address       string              `json:"address"`
+	Email         string              `json:"email,omitempty"`
+	WebhookURL    string              `json:"webhookURL,omitempty"`
+	WebhookSecret string              `json:"webhookSecret,omitempty"`
+	PushToken     string              `json:"pushToken,omitempty"`
+	Events        map[string][]string `json:"events"`
+	UpdatedAt     string              `json:"updatedAt,omitempty"`
+}
+
+// Validate checks that every kind and channel is known and that every
+// channel used has somewhere to send to
+func (p *Preferences) Validate() error {
+	if p.Email != "" {
+		address, err := mail.ParseAddress(p.Email)
+		if err != nil || address.Name != "" {
+			return fmt.Errorf("invalid email address %q", p.Email)
+		}
+	}
+	if p.WebhookURL != "" {
+		u, err := url.Parse(p.WebhookURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("webhook URL %q must be an absolute https URL", p.WebhookURL)
+		}
+	}
+	destinations := map[string]string{ChannelPush: p.PushToken, ChannelEmail: p.Email, ChannelWebhook: p.WebhookURL}
+	for kind, channels := range p.Events {
+		if !kinds[kind] {
+			return fmt.Errorf("unknown notification kind %s", kind)
+		}
+		for _, channel := range channels {
+			destination, ok := destinations[channel]
+			if !ok {
+				return fmt.Errorf("unknown notification channel %s", channel)
+			}
+			if destination == "" {
+				return fmt.Errorf("%s notifications need a %s destination", kind, channel)
+			}
+		}
+	}
+	return nil
+}
+
+// Store is the gateway database. The gateway and the notifier may share it
+// from separate processes.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens, creating if needed, the SQLite database at path and applies the schema
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	// Wait for the other process's writes rather than failing
+	if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to apply schema: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Preferences returns the preferences of an address, or nil if it has none
+func (s *Store) Preferences(address string) (*Preferences, error) {
+	p := &Preferences{Address: address}
+	var events string
+	err := s.db.QueryRow(`SELECT email, webhook_url, webhook_secret, push_token, events, updated_at
+		FROM notification_preferences WHERE address = $1`, address).
+		Scan(&p.Email, &p.WebhookURL, &p.WebhookSecret, &p.PushToken, &events, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(events), &p.Events); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetPreferences validates and stores the preferences of an address. A
+// webhook keeps its secret while its URL is unchanged and gets a new one
+// otherwise.
+func (s *Store) SetPreferences(p *Preferences, now time.Time) (*Preferences, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	existing, err := s.Preferences(p.Address)
+	if err != nil {
+		return nil, err
+	}
+	stored := *p
+	stored.WebhookSecret = ""
+	if stored.Events == nil {
+		stored.Events = map[string][]string{}
+	}
+	if stored.WebhookURL != "" {
+		if existing != nil && existing.WebhookURL == stored.WebhookURL {
+			stored.WebhookSecret = existing.WebhookSecret
+		} else {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return nil, err
+			}
+			stored.WebhookSecret = hex.EncodeToString(secret)
+		}
+	}
+	stored.UpdatedAt = now.UTC().Format(time.RFC3339)
+	events, err := json.Marshal(stored.Events)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.Exec(`INSERT INTO notification_preferences (address, email, webhook_url, webhook_secret, push_token, events, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (address) DO UPDATE SET email = excluded.email, webhook_url = excluded.webhook_url,
+			webhook_secret = excluded.webhook_secret, push_token = excluded.push_token, events = excluded.events, updated_at = excluded.updated_at`,
+		stored.Address, stored.Email, stored.WebhookURL, stored.WebhookSecret, stored.PushToken, string(events), stored.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// DeletePreferences removes the preferences of an address, which stops all
+// its notifications
+func (s *Store) DeletePreferences(address string) error {
+	_, err := s.db.Exec("DELETE FROM notification_preferences WHERE address = $1", address)
+	return err
+}
+
+// checkpoint is a stored stream position; it implements client.Checkpoint
+type checkpoint struct {
+	blockNumber   uint64
+	transactionID string
+}
+
+func (c checkpoint) BlockNumber() uint64 {
+	return c.blockNumber
+}
+
+func (c checkpoint) TransactionID() string {
+	return c.transactionID
+}
+
+// checkpointStream is the notifier's only stream
+const checkpointStream = "chaincode"
+
+// Checkpoint returns the position to resume the event stream from, or nil
+// if the notifier has not processed anything
+func (s *Store) Checkpoint() (client.Checkpoint, error) {
+	var cp checkpoint
+	err := s.db.QueryRow("SELECT block_number, transaction_id FROM notifier_checkpoints WHERE stream = $1", checkpointStream).
+		Scan(&cp.blockNumber, &cp.transactionID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// SaveCheckpoint records the last event processed
+func (s *Store) SaveCheckpoint(blockNumber uint64, transactionID string) error {
+	_, err := s.db.Exec(`INSERT INTO notifier_checkpoints (stream, block_number, transaction_id) VALUES ($1, $2, $3)
+		ON CONFLICT (stream) DO UPDATE SET block_number = excluded.block_number, transaction_id = excluded.transaction_id`,
+		checkpointStream, blockNumber, transactionID)
+	return err
+}
+
+// Reminder is a delivery reminder for one party of a confirmed trade
+type Reminder struct {
+	TokenID       string
+	Address       string
+	EnergyAmount  float64
+	DeliveryStart string
+	DueAt         time.Time
+}
+
+// AddReminder schedules a reminder, replacing one for the same trade and party
+func (s *Store) AddReminder(r Reminder) error {
+	_, err := s.db.Exec(`INSERT INTO notification_reminders (token_id, address, energy_amount, delivery_start, due_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (token_id, address) DO UPDATE SET energy_amount = excluded.energy_amount,
+			delivery_start = excluded.delivery_start, due_at = excluded.due_at`,
+		r.TokenID, r.Address, r.EnergyAmount, r.DeliveryStart, r.DueAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+// DueReminders returns the reminders due by now, earliest first
+func (s *Store) DueReminders(now time.Time) ([]Reminder, error) {
+	rows, err := s.db.Query(`SELECT token_id, address, energy_amount, delivery_start, due_at FROM notification_reminders
+		WHERE due_at <= $1 ORDER BY due_at, token_id, address`, now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reminders := []Reminder{}
+	for rows.Next() {
+		var r Reminder
+		var dueAt string
+		if err := rows.Scan(&r.TokenID, &r.Address, &r.EnergyAmount, &r.DeliveryStart, &dueAt); err != nil {
+			return nil, err
+		}
+		if r.DueAt, err = time.Parse(time.RFC3339, dueAt); err != nil {
+			return nil, err
+		}
+		reminders = append(reminders, r)
+	}
+	return reminders, rows.Err()
+}
+
+// DeleteReminder removes a reminder that was sent
+func (s *Store) DeleteReminder(tokenID, address string) error {
+	_, err := s.db.Exec("DELETE FROM notification_reminders WHERE token_id = $1 AND address = $2", tokenID, address)
+	return err
+}
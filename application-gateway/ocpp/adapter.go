@@ -0,0 +1,337 @@
+package ocpp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"application-gateway/fabric"
+	"application-gateway/meterbridge"
+)
+
+// Invoker is the part of *client.Contract the adapter uses
+type Invoker interface {
+	EvaluateTransaction(name string, args ...string) ([]byte, error)
+	SubmitTransaction(name string, args ...string) ([]byte, error)
+}
+
+// Config controls how the adapter reports charging to the chaincode
+type Config struct {
+	// Interval is the meter interval deliveries and readings are reported in
+	Interval time.Duration
+	// Grace is how long after an interval ends it is reported, so that the
+	// transaction time is past the interval even with some clock skew
+	Grace time.Duration
+	// FlushInterval is how often due intervals are reported
+	FlushInterval time.Duration
+	// HeartbeatInterval is the heartbeat interval chargers are told at boot
+	HeartbeatInterval time.Duration
+}
+
+// DefaultConfig returns the configuration for 15 minute meter intervals
+func DefaultConfig() Config {
+	return Config{
+		Interval:          15 * time.Minute,
+		Grace:             time.Minute,
+		FlushInterval:     30 * time.Second,
+		HeartbeatInterval: 5 * time.Minute,
+	}
+}
+
+// chargingSession is the part of the chaincode's ChargingSession the adapter
+// reads
+type chargingSession struct {
+	SessionID       string  `json:"sessionID"`
+	ChargerID       string  `json:"chargerID"`
+	Status          string  `json:"status"`
+	Deadline        string  `json:"deadline"`
+	FilledEnergy    float64 `json:"filledEnergy"`
+	DeliveredEnergy float64 `json:"deliveredEnergy"`
+}
+
+const sessionOpen = "OPEN"
+
+// Adapter is the central system. The idTag a driver presents, typically
+// through a remote start from the market app, is the ID of the charging
+// session the driver opened. Each connector is an enrolled meter whose ID
+// is the session's charger ID, <charge point ID>-<connector ID>, owned by
+// the adapter's identity, the charge point operator.
+type Adapter struct {
+	contract  Invoker
+	config    Config
+	state     *State
+	keys      map[string]*ecdsa.PrivateKey
+	passwords map[string]string
+	now       func() time.Time
+}
+
+// New returns an adapter invoking contract. keys are the connector meter keys
+// readings are signed with. passwords, if not nil, are the chargers' HTTP
+// basic authentication passwords by charge point ID, as in OCPP security
+// profile 1.
+func New(contract Invoker, config Config, state *State, keys map[string]*ecdsa.PrivateKey, passwords map[string]string) *Adapter {
+	return &Adapter{contract: contract, config: config, state: state, keys: keys, passwords: passwords, now: time.Now}
+}
+
+// ConnectorMeterID returns the meter and charger ID of a charger's connector
+func ConnectorMeterID(chargePointID string, connectorID int) string {
+	return chargePointID + "-" + strconv.Itoa(connectorID)
+}
+
+// handle answers a charger's request
+func (a *Adapter) handle(chargePointID string, c *call) (interface{}, error) {
+	now := a.now().UTC().Format(time.RFC3339)
+	switch c.Action {
+	case "BootNotification":
+		return bootNotificationResponse{Status: statusAccepted, CurrentTime: now, Interval: int(a.config.HeartbeatInterval.Seconds())}, nil
+	case "Heartbeat":
+		return heartbeatResponse{CurrentTime: now}, nil
+	case "StatusNotification", "DiagnosticsStatusNotification", "FirmwareStatusNotification":
+		return struct{}{}, nil
+	case "DataTransfer":
+		return dataTransferResponse{Status: "UnknownVendorId"}, nil
+	case "Authorize":
+		var request authorizeRequest
+		if err := json.Unmarshal(c.Payload, &request); err != nil {
+			return nil, err
+		}
+		_, status := a.authorize(chargePointID, 0, request.IDTag)
+		return authorizeResponse{IDTagInfo: idTagInfo{Status: status}}, nil
+	case "StartTransaction":
+		var request startTransactionRequest
+		if err := json.Unmarshal(c.Payload, &request); err != nil {
+			return nil, err
+		}
+		return a.startTransaction(chargePointID, request)
+	case "MeterValues":
+		var request meterValuesRequest
+		if err := json.Unmarshal(c.Payload, &request); err != nil {
+			return nil, err
+		}
+		if request.TransactionID != nil {
+			if err := a.meterValues(*request.TransactionID, request.MeterValue, false); err != nil {
+				return nil, err
+			}
+		}
+		return struct{}{}, nil
+	case "StopTransaction":
+		var request stopTransactionRequest
+		if err := json.Unmarshal(c.Payload, &request); err != nil {
+			return nil, err
+		}
+		if err := a.meterValues(request.TransactionID, request.TransactionData, false); err != nil {
+			return nil, err
+		}
+		stop := meterValue{Timestamp: request.Timestamp, SampledValue: []sampledValue{{Value: strconv.Itoa(request.MeterStop)}}}
+		if err := a.meterValues(request.TransactionID, []meterValue{stop}, true); err != nil {
+			return nil, err
+		}
+		return stopTransactionResponse{}, nil
+	}
+	return nil, errNotImplementedAction
+}
+
+// errNotImplementedAction is returned by handle for actions the central
+// system does not support
+var errNotImplementedAction = errors.New("action is not implemented")
+
+// authorize checks that an idTag names an open session at the charger, and
+// at the connector if it is known, that no other transaction uses
+func (a *Adapter) authorize(chargePointID string, connectorID int, idTag string) (*chargingSession, string) {
+	sessionJSON, err := a.contract.EvaluateTransaction("GetChargingSession", idTag)
+	if err != nil {
+		if !strings.Contains(fabric.ErrorWithDetails(err).Error(), "does not exist") {
+			log.Printf("Failed to read charging session %s: %v", idTag, fabric.ErrorWithDetails(err))
+		}
+		return nil, statusInvalid
+	}
+	var session chargingSession
+	if err := json.Unmarshal(sessionJSON, &session); err != nil {
+		return nil, statusInvalid
+	}
+	if connectorID > 0 && session.ChargerID != ConnectorMeterID(chargePointID, connectorID) {
+		return nil, statusInvalid
+	}
+	if connectorID == 0 && !strings.HasPrefix(session.ChargerID, chargePointID+"-") {
+		return nil, statusInvalid
+	}
+	deadline, err := time.Parse(time.RFC3339, session.Deadline)
+	if session.Status != sessionOpen || err != nil || !a.now().Before(deadline) {
+		return nil, statusExpired
+	}
+	if a.state.sessionInUse(session.SessionID) {
+		return nil, statusConcurrentTx
+	}
+	return &session, statusAccepted
+}
+
+func (a *Adapter) startTransaction(chargePointID string, request startTransactionRequest) (interface{}, error) {
+	id := a.state.newTransactionID()
+	session, status := a.authorize(chargePointID, request.ConnectorID, request.IDTag)
+	if status == statusAccepted {
+		at, err := time.Parse(time.RFC3339, request.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp: %w", err)
+		}
+		meterID := ConnectorMeterID(chargePointID, request.ConnectorID)
+		if err := a.state.start(id, session.SessionID, meterID, float64(request.MeterStart), at); err != nil {
+			return nil, err
+		}
+		log.Printf("Transaction %d at %s started for charging session %s", id, meterID, session.SessionID)
+	}
+	return startTransactionResponse{TransactionID: id, IDTagInfo: idTagInfo{Status: status}}, nil
+}
+
+// meterValues adds the energy register samples of a transaction, in time
+// order. stop marks the transaction stopped after the last sample.
+func (a *Adapter) meterValues(transactionID int, values []meterValue, stop bool) error {
+	for i, value := range values {
+		at, err := time.Parse(time.RFC3339, value.Timestamp)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp: %w", err)
+		}
+		last := stop && i == len(values)-1
+		sampled := false
+		for _, sample := range value.SampledValue {
+			if wh, ok := sample.energyWh(); ok {
+				if err := a.state.sample(transactionID, at, wh, a.config.Interval, last); err != nil {
+					return err
+				}
+				sampled = true
+				break
+			}
+		}
+		if last && !sampled {
+			return fmt.Errorf("stop of transaction %d has no energy register value", transactionID)
+		}
+	}
+	return nil
+}
+
+// Run reports due intervals every FlushInterval until ctx is done
+func (a *Adapter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(a.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			a.Flush()
+		}
+	}
+}
+
+// Flush records the deliveries of the intervals that are complete, closes
+// the sessions of stopped transactions once all their deliveries are
+// recorded, and submits the connectors' meter readings. Work that fails
+// transiently stays due, and a transaction or connector whose work failed is
+// not reported further until the next flush, keeping its intervals in order.
+func (a *Adapter) Flush() {
+	cutoff := a.now().Add(-a.config.Grace)
+
+	failed := map[int]bool{}
+	for _, d := range a.state.dueDeliveries(cutoff, a.config.Interval) {
+		if failed[d.TransactionID] {
+			continue
+		}
+		if err := a.recordDelivery(d); err != nil {
+			log.Printf("Delivery of charging session %s for %s failed, retrying: %v", d.SessionID, d.IntervalStart, err)
+			failed[d.TransactionID] = true
+			continue
+		}
+		if err := a.state.delivered(d); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
+	}
+
+	for _, tx := range a.state.dueCloses() {
+		if _, err := a.contract.SubmitTransaction("CloseChargingSession", tx.SessionID); err != nil && fabric.Transient(err) {
+			log.Printf("Closing charging session %s failed, retrying: %v", tx.SessionID, fabric.ErrorWithDetails(err))
+			continue
+		} else if err != nil && !strings.Contains(fabric.ErrorWithDetails(err).Error(), "is closed") {
+			log.Printf("Charging session %s was not closed: %v", tx.SessionID, fabric.ErrorWithDetails(err))
+		}
+		if err := a.state.closed(tx.ID); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
+	}
+
+	failedMeters := map[string]bool{}
+	for _, r := range a.state.dueReadings(cutoff, a.config.Interval) {
+		if failedMeters[r.MeterID] {
+			continue
+		}
+		if err := a.submitReading(r); err != nil {
+			log.Printf("Reading of %s for %s failed, retrying: %v", r.MeterID, r.IntervalStart, err)
+			failedMeters[r.MeterID] = true
+			continue
+		}
+		if err := a.state.submitted(r); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
+	}
+}
+
+// kWh rounds Wh to kWh with Wh precision
+func kWh(wh float64) float64 {
+	return math.Round(wh) / 1000
+}
+
+// recordDelivery records the energy of an interval against the session, up
+// to the energy filled by sellers and not yet delivered; the rest was drawn
+// from the grid. It returns an error only for failures worth retrying.
+func (a *Adapter) recordDelivery(d delivery) error {
+	sessionJSON, err := a.contract.EvaluateTransaction("GetChargingSession", d.SessionID)
+	if err != nil {
+		return fabric.ErrorWithDetails(err)
+	}
+	var session chargingSession
+	if err := json.Unmarshal(sessionJSON, &session); err != nil {
+		return err
+	}
+	energy := math.Min(kWh(d.Wh), kWh((session.FilledEnergy-session.DeliveredEnergy)*1000))
+	if session.Status != sessionOpen || energy <= 0 {
+		return nil
+	}
+	_, err = a.contract.SubmitTransaction("RecordChargingDelivery", d.SessionID, d.IntervalStart, strconv.FormatFloat(energy, 'f', -1, 64))
+	if err == nil || strings.Contains(fabric.ErrorWithDetails(err).Error(), "is already recorded") {
+		return nil
+	}
+	if fabric.Transient(err) {
+		return fabric.ErrorWithDetails(err)
+	}
+	log.Printf("Delivery of charging session %s for %s rejected: %v", d.SessionID, d.IntervalStart, fabric.ErrorWithDetails(err))
+	return nil
+}
+
+// submitReading submits a connector's consumption in an interval, signed
+// with the connector meter's key. It returns an error only for failures
+// worth retrying.
+func (a *Adapter) submitReading(r reading) error {
+	key, ok := a.keys[r.MeterID]
+	if !ok {
+		log.Printf("Reading of %s for %s dropped: the adapter holds no key for the meter", r.MeterID, r.IntervalStart)
+		return nil
+	}
+	signed := &meterbridge.Reading{MeterID: r.MeterID, IntervalStart: r.IntervalStart, KWhConsumed: kWh(r.Wh)}
+	if err := signed.Sign(key); err != nil {
+		return err
+	}
+	_, err := a.contract.SubmitTransaction("SubmitMeterReading", signed.Arguments()...)
+	if err == nil || strings.Contains(fabric.ErrorWithDetails(err).Error(), "is not after the last reading") {
+		return nil
+	}
+	if fabric.Transient(err) {
+		return fabric.ErrorWithDetails(err)
+	}
+	log.Printf("Reading of %s for %s rejected: %v", r.MeterID, r.IntervalStart, fabric.ErrorWithDetails(err))
+	return nil
+}
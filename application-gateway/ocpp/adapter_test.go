@@ -0,0 +1,167 @@
+package ocpp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeContract serves one charging session and records submissions
+type fakeContract struct {
+	mu        sync.Mutex
+	session   chargingSession
+	submitted []string
+}
+
+func (f *fakeContract) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if args[0] != f.session.SessionID {
+		return nil, errors.New("charging session " + args[0] + " does not exist")
+	}
+	return json.Marshal(f.session)
+}
+
+func (f *fakeContract) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch name {
+	case "RecordChargingDelivery":
+		energy, _ := strconv.ParseFloat(args[2], 64)
+		f.session.DeliveredEnergy += energy
+		f.submitted = append(f.submitted, strings.Join([]string{name, args[1], args[2]}, " "))
+	case "SubmitMeterReading":
+		f.submitted = append(f.submitted, strings.Join([]string{name, args[0], args[1], args[2], args[3]}, " "))
+	default:
+		f.submitted = append(f.submitted, strings.Join(append([]string{name}, args...), " "))
+	}
+	return nil, nil
+}
+
+// testCharger is a charger connected to the adapter
+type testCharger struct {
+	t    *testing.T
+	conn *websocket.Conn
+	next int
+}
+
+// call sends a request and returns the response frame
+func (c *testCharger) call(action string, payload interface{}) []json.RawMessage {
+	c.t.Helper()
+	c.next++
+	if err := c.conn.WriteJSON([]interface{}{callMessage, strconv.Itoa(c.next), action, payload}); err != nil {
+		c.t.Fatal(err)
+	}
+	var frame []json.RawMessage
+	if err := c.conn.ReadJSON(&frame); err != nil {
+		c.t.Fatal(err)
+	}
+	return frame
+}
+
+// status returns the idTagInfo status of a response
+func (c *testCharger) status(frame []json.RawMessage) string {
+	c.t.Helper()
+	var payload struct {
+		TransactionID int       `json:"transactionId"`
+		IDTagInfo     idTagInfo `json:"idTagInfo"`
+	}
+	if len(frame) != 3 || json.Unmarshal(frame[2], &payload) != nil {
+		c.t.Fatalf("got response %s", frame)
+	}
+	return payload.IDTagInfo.Status
+}
+
+func TestChargingTransaction(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := &fakeContract{session: chargingSession{
+		SessionID: "session1", ChargerID: "CP1-1", Status: sessionOpen, Deadline: "2025-05-01T12:00:00Z", FilledEnergy: 3,
+	}}
+	now := time.Date(2025, 5, 1, 8, 0, 0, 0, time.UTC)
+	state, err := LoadState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter := New(contract, DefaultConfig(), state, map[string]*ecdsa.PrivateKey{"CP1-1": key}, map[string]string{"CP1": "secret"})
+	adapter.now = func() time.Time { return now }
+
+	server := httptest.NewServer(adapter.Handler())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ocpp/CP1"
+	dialer := websocket.Dialer{Subprotocols: []string{Subprotocol}}
+	if _, response, err := dialer.Dial(url, nil); err == nil || response.StatusCode != 401 {
+		t.Fatalf("a charger without a password connected: %v", err)
+	}
+	header := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("CP1:secret"))}}
+	conn, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	charger := &testCharger{t: t, conn: conn}
+
+	if frame := charger.call("BootNotification", map[string]string{"chargePointVendor": "Acme", "chargePointModel": "AC22"}); !strings.Contains(string(frame[2]), `"status":"Accepted"`) {
+		t.Errorf("got boot response %s", frame[2])
+	}
+	if status := charger.status(charger.call("Authorize", authorizeRequest{IDTag: "session2"})); status != statusInvalid {
+		t.Errorf("got status %s for an unknown session", status)
+	}
+	if frame := charger.call("Reset", map[string]string{"type": "Soft"}); len(frame) != 5 || string(frame[2]) != `"`+errNotImplemented+`"` {
+		t.Errorf("got response %s to an unsupported action", frame)
+	}
+	if status := charger.status(charger.call("StartTransaction", startTransactionRequest{ConnectorID: 2, IDTag: "session1", MeterStart: 1000, Timestamp: "2025-05-01T08:05:00Z"})); status != statusInvalid {
+		t.Errorf("got status %s at another connector", status)
+	}
+	if status := charger.status(charger.call("StartTransaction", startTransactionRequest{ConnectorID: 1, IDTag: "session1", MeterStart: 1000, Timestamp: "2025-05-01T08:05:00Z"})); status != statusAccepted {
+		t.Fatalf("got status %s", status)
+	}
+	if status := charger.status(charger.call("Authorize", authorizeRequest{IDTag: "session1"})); status != statusConcurrentTx {
+		t.Errorf("got status %s for a session in use", status)
+	}
+
+	// 3000 Wh from 08:05 to 08:20 are 2000 Wh in the 08:00 interval and
+	// 1000 Wh in the 08:15 interval, which the stop adds another 1000 Wh to
+	transactionID := 2
+	charger.call("MeterValues", meterValuesRequest{ConnectorID: 1, TransactionID: &transactionID, MeterValue: []meterValue{{
+		Timestamp:    "2025-05-01T08:20:00Z",
+		SampledValue: []sampledValue{{Value: "230", Measurand: "Voltage"}, {Value: "4", Unit: "kWh"}},
+	}}})
+	charger.call("StopTransaction", stopTransactionRequest{TransactionID: transactionID, MeterStop: 5000, Timestamp: "2025-05-01T08:25:00Z"})
+
+	now = time.Date(2025, 5, 1, 8, 26, 0, 0, time.UTC)
+	adapter.Flush()
+	now = time.Date(2025, 5, 1, 8, 31, 0, 0, time.UTC)
+	adapter.Flush()
+
+	// Sellers filled 3 kWh, so only 1 kWh of the 08:15 interval is delivered
+	// against the session
+	want := []string{
+		"RecordChargingDelivery 2025-05-01T08:00:00Z 2",
+		"SubmitMeterReading CP1-1 2025-05-01T08:00:00Z 0 2",
+		"RecordChargingDelivery 2025-05-01T08:15:00Z 1",
+		"CloseChargingSession session1",
+		"SubmitMeterReading CP1-1 2025-05-01T08:15:00Z 0 2",
+	}
+	if !reflect.DeepEqual(contract.submitted, want) {
+		t.Errorf("got submissions\n%s\nwant\n%s", strings.Join(contract.submitted, "\n"), strings.Join(want, "\n"))
+	}
+	if len(state.Transactions) != 0 || len(state.Readings) != 0 {
+		t.Errorf("got state %+v %+v after everything was reported", state.Transactions, state.Readings)
+	}
+}
@@ -0,0 +1,172 @@
+// Package ocpp is an OCPP 1.6J central system for public EV chargers. It
+// links the charging transactions chargers report to on-chain charging
+// sessions and reports the energy each connector delivered as charging
+// deliveries and meter readings, so that chargers join the market with their
+// stock firmware.
+package ocpp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Subprotocol is the WebSocket subprotocol of OCPP 1.6J
+const Subprotocol = "ocpp1.6"
+
+// OCPP-J message types
+const (
+	callMessage       = 2
+	callResultMessage = 3
+	callErrorMessage  = 4
+)
+
+// OCPP-J error codes
+const (
+	errFormationViolation = "FormationViolation"
+	errNotImplemented     = "NotImplemented"
+	errInternalError      = "InternalError"
+)
+
+// Authorization statuses of an idTag
+const (
+	statusAccepted     = "Accepted"
+	statusInvalid      = "Invalid"
+	statusExpired      = "Expired"
+	statusConcurrentTx = "ConcurrentTx"
+)
+
+// call is a request sent by a charger
+type call struct {
+	ID      string
+	Action  string
+	Payload json.RawMessage
+}
+
+// parseCall decodes an OCPP-J message. It returns a nil call for responses,
+// as the central system sends no requests of its own.
+func parseCall(data []byte) (*call, error) {
+	var frame []json.RawMessage
+	if err := json.Unmarshal(data, &frame); err != nil || len(frame) < 3 {
+		return nil, errors.New("message is not an OCPP-J array")
+	}
+	var messageType int
+	if err := json.Unmarshal(frame[0], &messageType); err != nil {
+		return nil, fmt.Errorf("invalid message type: %w", err)
+	}
+	if messageType == callResultMessage || messageType == callErrorMessage {
+		return nil, nil
+	}
+	if messageType != callMessage || len(frame) != 4 {
+		return nil, fmt.Errorf("unknown message type %d", messageType)
+	}
+	c := &call{Payload: frame[3]}
+	if err := json.Unmarshal(frame[1], &c.ID); err != nil {
+		return nil, fmt.Errorf("invalid message ID: %w", err)
+	}
+	if err := json.Unmarshal(frame[2], &c.Action); err != nil {
+		return nil, fmt.Errorf("invalid action: %w", err)
+	}
+	return c, nil
+}
+
+func callResult(id string, payload interface{}) ([]byte, error) {
+	return json.Marshal([]interface{}{callResultMessage, id, payload})
+}
+
+func callError(id, code, description string) ([]byte, error) {
+	return json.Marshal([]interface{}{callErrorMessage, id, code, description, struct{}{}})
+}
+
+type idTagInfo struct {
+	Status string `json:"status"`
+}
+
+type authorizeRequest struct {
+	IDTag string `json:"idTag"`
+}
+
+type authorizeResponse struct {
+	IDTagInfo idTagInfo `json:"idTagInfo"`
+}
+
+type bootNotificationResponse struct {
+	Status      string `json:"status"`
+	CurrentTime string `json:"currentTime"`
+	Interval    int    `json:"interval"`
+}
+
+type heartbeatResponse struct {
+	CurrentTime string `json:"currentTime"`
+}
+
+type startTransactionRequest struct {
+	ConnectorID int    `json:"connectorId"`
+	IDTag       string `json:"idTag"`
+	MeterStart  int    `json:"meterStart"`
+	Timestamp   string `json:"timestamp"`
+}
+
+type startTransactionResponse struct {
+	TransactionID int       `json:"transactionId"`
+	IDTagInfo     idTagInfo `json:"idTagInfo"`
+}
+
+type meterValuesRequest struct {
+	ConnectorID   int          `json:"connectorId"`
+	TransactionID *int         `json:"transactionId,omitempty"`
+	MeterValue    []meterValue `json:"meterValue"`
+}
+
+type meterValue struct {
+	Timestamp    string         `json:"timestamp"`
+	SampledValue []sampledValue `json:"sampledValue"`
+}
+
+type sampledValue struct {
+	Value     string `json:"value"`
+	Context   string `json:"context,omitempty"`
+	Format    string `json:"format,omitempty"`
+	Measurand string `json:"measurand,omitempty"`
+	Phase     string `json:"phase,omitempty"`
+	Location  string `json:"location,omitempty"`
+	Unit      string `json:"unit,omitempty"`
+}
+
+// energyWh returns the value of a sample of the energy register, in Wh. Only
+// the total imported at the outlet counts, not per phase values.
+func (s sampledValue) energyWh() (float64, bool) {
+	if (s.Measurand != "" && s.Measurand != "Energy.Active.Import.Register") || s.Phase != "" ||
+		(s.Format != "" && s.Format != "Raw") || (s.Location != "" && s.Location != "Outlet") {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(s.Value, 64)
+	if err != nil {
+		return 0, false
+	}
+	switch s.Unit {
+	case "", "Wh":
+		return value, true
+	case "kWh":
+		return value * 1000, true
+	}
+	return 0, false
+}
+
+type stopTransactionRequest struct {
+	IDTag           string       `json:"idTag,omitempty"`
+	MeterStop       int          `json:"meterStop"`
+	Timestamp       string       `json:"timestamp"`
+	TransactionID   int          `json:"transactionId"`
+	Reason          string       `json:"reason,omitempty"`
+	TransactionData []meterValue `json:"transactionData,omitempty"`
+}
+
+type stopTransactionResponse struct {
+	IDTagInfo *idTagInfo `json:"idTagInfo,omitempty"`
+}
+
+type dataTransferResponse struct {
+	Status string `json:"status"`
+}
@@ -0,0 +1,91 @@
+package ocpp
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const writeTimeout = 10 * time.Second
+
+// Handler returns the HTTP routes chargers connect to, at
+// /ocpp/{chargePointID}
+func (a *Adapter) Handler() http.Handler {
+	upgrader := websocket.Upgrader{Subprotocols: []string{Subprotocol}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ocpp/{chargePointID}", func(w http.ResponseWriter, r *http.Request) {
+		chargePointID := r.PathValue("chargePointID")
+		if !a.authenticate(chargePointID, r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ocpp"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if conn.Subprotocol() != Subprotocol {
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, "subprotocol "+Subprotocol+" is required"),
+				time.Now().Add(writeTimeout))
+			return
+		}
+		log.Printf("Charger %s connected", chargePointID)
+		a.serve(chargePointID, conn)
+		log.Printf("Charger %s disconnected", chargePointID)
+	})
+	return mux
+}
+
+// authenticate checks a charger's HTTP basic authentication, if passwords
+// are configured
+func (a *Adapter) authenticate(chargePointID string, r *http.Request) bool {
+	if a.passwords == nil {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	want, known := a.passwords[chargePointID]
+	return ok && known && username == chargePointID && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+// serve answers a charger's requests until it disconnects. Chargers wait for
+// each response before sending their next request, so requests are handled
+// in order.
+func (a *Adapter) serve(chargePointID string, conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c, err := parseCall(data)
+		if err != nil {
+			log.Printf("Invalid message from charger %s: %v", chargePointID, err)
+			continue
+		}
+		if c == nil {
+			continue
+		}
+		var response []byte
+		payload, err := a.handle(chargePointID, c)
+		switch {
+		case errors.Is(err, errNotImplementedAction):
+			response, err = callError(c.ID, errNotImplemented, c.Action+" is not supported")
+		case err != nil:
+			log.Printf("%s from charger %s failed: %v", c.Action, chargePointID, err)
+			response, err = callError(c.ID, errFormationViolation, err.Error())
+		default:
+			response, err = callResult(c.ID, payload)
+		}
+		if err != nil {
+			response, _ = callError(c.ID, errInternalError, err.Error())
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := conn.WriteMessage(websocket.TextMessage, response); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package ocpp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Transaction is a charging transaction at a connector, linked to the
+// on-chain session its idTag names. Pending holds the Wh drawn in each meter
+// interval, by interval start, that is not yet recorded on-chain.
+type Transaction struct {
+	ID           int                `json:"id"`
+	SessionID    string             `json:"sessionID"`
+	MeterID      string             `json:"meterID"`
+	LastMeterWh  float64            `json:"lastMeterWh"`
+	LastSampleAt time.Time          `json:"lastSampleAt"`
+	Stopped      bool               `json:"stopped"`
+	Pending      map[string]float64 `json:"pending"`
+}
+
+// State persists the live transactions and the connector readings awaiting
+// submission between runs, as chargers only report a transaction's energy
+// once.
+type State struct {
+	path string
+	mu   sync.Mutex
+
+	NextTransactionID int                  `json:"nextTransactionID"`
+	Transactions      map[int]*Transaction `json:"transactions"`
+	// Readings holds, by connector meter ID and interval start, the Wh whose
+	// meter reading is not yet submitted
+	Readings map[string]map[string]float64 `json:"readings"`
+}
+
+// LoadState reads the state file at path; a missing file is an empty state
+func LoadState(path string) (*State, error) {
+	state := &State{path: path, NextTransactionID: 1, Transactions: map[int]*Transaction{}, Readings: map[string]map[string]float64{}}
+	stateJSON, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(stateJSON, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// save writes the state file. The caller holds the lock.
+func (s *State) save() error {
+	if s.path == "" {
+		return nil
+	}
+	stateJSON, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, stateJSON, 0o600)
+}
+
+// newTransactionID returns the next transaction ID
+func (s *State) newTransactionID() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.NextTransactionID
+	s.NextTransactionID++
+	return id
+}
+
+// sessionInUse reports whether a transaction that has not stopped is linked
+// to the session
+func (s *State) sessionInUse(sessionID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tx := range s.Transactions {
+		if tx.SessionID == sessionID && !tx.Stopped {
+			return true
+		}
+	}
+	return false
+}
+
+// start records a transaction whose idTag was accepted
+func (s *State) start(id int, sessionID, meterID string, meterStartWh float64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Transactions[id] = &Transaction{
+		ID:           id,
+		SessionID:    sessionID,
+		MeterID:      meterID,
+		LastMeterWh:  meterStartWh,
+		LastSampleAt: at,
+		Pending:      map[string]float64{},
+	}
+	return s.save()
+}
+
+// sample spreads the energy drawn since the transaction's last sample over
+// the meter intervals in between. Samples older than the last one are
+// ignored, and a register that went backwards restarts the count.
+func (s *State) sample(id int, at time.Time, registerWh float64, interval time.Duration, stop bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, ok := s.Transactions[id]
+	if !ok || tx.Stopped {
+		return nil
+	}
+	if !at.Before(tx.LastSampleAt) {
+		if registerWh >= tx.LastMeterWh {
+			allocate(tx.Pending, tx.LastSampleAt, at, registerWh-tx.LastMeterWh, interval)
+		}
+		tx.LastMeterWh = registerWh
+		tx.LastSampleAt = at
+	}
+	tx.Stopped = stop
+	return s.save()
+}
+
+// allocate adds wh drawn evenly from from to to to the intervals it spans
+func allocate(pending map[string]float64, from, to time.Time, wh float64, interval time.Duration) {
+	if wh == 0 {
+		return
+	}
+	if !to.After(from) {
+		pending[to.Add(-time.Nanosecond).Truncate(interval).UTC().Format(time.RFC3339)] += wh
+		return
+	}
+	total := to.Sub(from)
+	for t := from; t.Before(to); {
+		start := t.Truncate(interval)
+		end := start.Add(interval)
+		if end.After(to) {
+			end = to
+		}
+		pending[start.UTC().Format(time.RFC3339)] += wh * float64(end.Sub(t)) / float64(total)
+		t = end
+	}
+}
+
+// delivery is an interval of a transaction that is ready to be recorded
+type delivery struct {
+	TransactionID int
+	SessionID     string
+	MeterID       string
+	IntervalStart string
+	Wh            float64
+}
+
+// dueDeliveries returns, in interval order per transaction, the intervals
+// that ended by cutoff and that the transaction's samples have moved past
+func (s *State) dueDeliveries(cutoff time.Time, interval time.Duration) []delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := []delivery{}
+	for _, id := range s.transactionIDs() {
+		tx := s.Transactions[id]
+		for _, start := range sortedIntervals(tx.Pending) {
+			end := parseInterval(start).Add(interval)
+			if end.After(cutoff) || (!tx.Stopped && tx.LastSampleAt.Before(end)) {
+				break
+			}
+			due = append(due, delivery{id, tx.SessionID, tx.MeterID, start, tx.Pending[start]})
+		}
+	}
+	return due
+}
+
+// delivered moves a recorded interval's energy to its connector's reading
+func (s *State) delivered(d delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tx, ok := s.Transactions[d.TransactionID]; ok {
+		delete(tx.Pending, d.IntervalStart)
+	}
+	if s.Readings[d.MeterID] == nil {
+		s.Readings[d.MeterID] = map[string]float64{}
+	}
+	s.Readings[d.MeterID][d.IntervalStart] += d.Wh
+	return s.save()
+}
+
+// dueCloses returns the stopped transactions with nothing left to record
+func (s *State) dueCloses() []*Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := []*Transaction{}
+	for _, id := range s.transactionIDs() {
+		if tx := s.Transactions[id]; tx.Stopped && len(tx.Pending) == 0 {
+			due = append(due, &Transaction{ID: tx.ID, SessionID: tx.SessionID, MeterID: tx.MeterID})
+		}
+	}
+	return due
+}
+
+// closed forgets a transaction whose session was closed
+func (s *State) closed(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Transactions, id)
+	return s.save()
+}
+
+// reading is a connector's energy in an interval, ready to be submitted
+type reading struct {
+	MeterID       string
+	IntervalStart string
+	Wh            float64
+}
+
+// dueReadings returns, in interval order per connector, the intervals that
+// ended by cutoff for which no transaction at the connector can add energy
+func (s *State) dueReadings(cutoff time.Time, interval time.Duration) []reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meterIDs := make([]string, 0, len(s.Readings))
+	for meterID := range s.Readings {
+		meterIDs = append(meterIDs, meterID)
+	}
+	sort.Strings(meterIDs)
+	due := []reading{}
+	for _, meterID := range meterIDs {
+		for _, start := range sortedIntervals(s.Readings[meterID]) {
+			end := parseInterval(start).Add(interval)
+			if end.After(cutoff) || s.mayAdd(meterID, start, end) {
+				break
+			}
+			due = append(due, reading{meterID, start, s.Readings[meterID][start]})
+		}
+	}
+	return due
+}
+
+// mayAdd reports whether a transaction at the connector may still add energy
+// to the interval. The caller holds the lock.
+func (s *State) mayAdd(meterID, start string, end time.Time) bool {
+	for _, tx := range s.Transactions {
+		if tx.MeterID != meterID {
+			continue
+		}
+		if !tx.Stopped && tx.LastSampleAt.Before(end) {
+			return true
+		}
+		for pending := range tx.Pending {
+			if pending <= start {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// submitted forgets a submitted reading
+func (s *State) submitted(r reading) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Readings[r.MeterID], r.IntervalStart)
+	if len(s.Readings[r.MeterID]) == 0 {
+		delete(s.Readings, r.MeterID)
+	}
+	return s.save()
+}
+
+// transactionIDs returns the transaction IDs in order. The caller holds the
+// lock.
+func (s *State) transactionIDs() []int {
+	ids := make([]int, 0, len(s.Transactions))
+	for id := range s.Transactions {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// sortedIntervals returns the interval starts of a map in time order, which
+// is their string order as they are all RFC 3339 in UTC
+func sortedIntervals(energy map[string]float64) []string {
+	starts := make([]string, 0, len(energy))
+	for start := range energy {
+		starts = append(starts, start)
+	}
+	sort.Strings(starts)
+	return starts
+}
+
+func parseInterval(start string) time.Time {
+	t, _ := time.Parse(time.RFC3339, start)
+	return t
+}
@@ -0,0 +1,190 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"application-gateway/fabric"
+	"application-gateway/i18n"
+
+	"github.com/gorilla/websocket"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+const (
+	writeTimeout = 10 * time.Second
+	pingInterval = 30 * time.Second
+)
+
+// Message is one event pushed to a client. A client that reconnects with the
+// blockNumber and transactionID of the last message it processed resumes
+// right after it. Localized is the event's message in the client's language,
+// for the events that have one.
+type Message struct {
+	Topics        []string              `json:"topics"`
+	BlockNumber   uint64                `json:"blockNumber"`
+	TransactionID string                `json:"transactionID"`
+	Event         *fabric.EventEnvelope `json:"event"`
+	Localized     *i18n.Message         `json:"localized,omitempty"`
+}
+
+// Handler serves WebSocket subscriptions to a chaincode's events. Each
+// connection reads its own event stream from the peer, so a client can
+// replay from any block.
+type Handler struct {
+	network       *client.Network
+	chaincodeName string
+	lookup        TradeLookup
+	upgrader      websocket.Upgrader
+}
+
+// NewHandler returns a handler for the events of contract's chaincode on network
+func NewHandler(network *client.Network, contract *client.Contract) *Handler {
+	return &Handler{
+		network:       network,
+		chaincodeName: contract.ChaincodeName(),
+		lookup: func(tokenID string) (*TradeInfo, error) {
+			assetJSON, err := contract.EvaluateTransaction("ReadEnergyAsset", tokenID)
+			if err != nil {
+				return nil, fabric.ErrorWithDetails(err)
+			}
+			var trade TradeInfo
+			if err := json.Unmarshal(assetJSON, &trade); err != nil {
+				return nil, err
+			}
+			return &trade, nil
+		},
+	}
+}
+
+// position is a client's resume point; it implements client.Checkpoint
+type position struct {
+	blockNumber   uint64
+	transactionID string
+}
+
+func (p position) BlockNumber() uint64 {
+	return p.blockNumber
+}
+
+func (p position) TransactionID() string {
+	return p.transactionID
+}
+
+// ServeHTTP upgrades the request to a WebSocket and pushes the events of the
+// topics listed in the "topics" query parameter. With a "block" parameter,
+// events are replayed from that block, skipping those up to and including
+// transaction "tx"; otherwise only newly committed events are pushed. Event
+// messages are localized in the "lang" parameter's language, or else in the
+// one the Accept-Language header prefers.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	topics := parseTopics(query.Get("topics"))
+	if len(topics) == 0 {
+		http.Error(w, "topics is required", http.StatusBadRequest)
+		return
+	}
+	var options []client.ChaincodeEventsOption
+	if block := query.Get("block"); block != "" {
+		blockNumber, err := strconv.ParseUint(block, 10, 64)
+		if err != nil {
+			http.Error(w, "block must be a block number", http.StatusBadRequest)
+			return
+		}
+		options = append(options, client.WithStartBlock(blockNumber), client.WithCheckpoint(position{blockNumber, query.Get("tx")}))
+	}
+	language := query.Get("lang")
+	if i18n.Lookup(language) == nil {
+		language = i18n.Negotiate(r.Header.Get("Accept-Language"))
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := h.network.ChaincodeEvents(ctx, h.chaincodeName, options...)
+	if err != nil {
+		closeWithError(conn, fabric.ErrorWithDetails(err))
+		return
+	}
+
+	// The read loop handles control frames and notices the client leaving
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				closeWithError(conn, errors.New("event stream closed; reconnect to resume"))
+				return
+			}
+			if err := h.push(conn, event, topics, language); err != nil {
+				log.Printf("Push of %s event in transaction %s failed: %v", event.EventName, event.TransactionID, err)
+				closeWithError(conn, err)
+				return
+			}
+		}
+	}
+}
+
+// push writes the event to the client if it is published to a subscribed topic
+func (h *Handler) push(conn *websocket.Conn, event *client.ChaincodeEvent, subscribed map[string]bool, language string) error {
+	envelope, err := fabric.ParseEvent(event)
+	if err != nil {
+		return err
+	}
+	topics, err := eventTopics(envelope, h.lookup)
+	if err != nil {
+		return err
+	}
+	var matched []string
+	for _, topic := range topics {
+		if subscribed[topic] {
+			matched = append(matched, topic)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return conn.WriteJSON(Message{
+		Topics:        matched,
+		BlockNumber:   event.BlockNumber,
+		TransactionID: event.TransactionID,
+		Event:         envelope,
+		Localized:     i18n.Event(language, envelope.Name, envelope.Payload),
+	})
+}
+
+func closeWithError(conn *websocket.Conn, err error) {
+	reason := err.Error()
+	// Close frame payloads are limited to 125 bytes, two of which are the code
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, reason), time.Now().Add(writeTimeout))
+}
@@ -0,0 +1,109 @@
+// Package push streams chaincode events to WebSocket clients by topic.
+package push
+
+import (
+	"encoding/json"
+	"strings"
+
+	"application-gateway/fabric"
+)
+
+// Topics a client can subscribe to. Slot and account topics are formed with
+// SlotTopic and AccountTopic.
+const (
+	TopicTrades = "trades"
+	TopicPrices = "prices"
+
+	slotTopicPrefix    = "slot:"
+	accountTopicPrefix = "account:"
+)
+
+// SlotTopic is the topic of trades delivering in the slot starting at deliveryStart
+func SlotTopic(deliveryStart string) string {
+	return slotTopicPrefix + deliveryStart
+}
+
+// AccountTopic is the topic of events concerning an address: its trades,
+// token movements, reputation and registrations.
+func AccountTopic(address string) string {
+	return accountTopicPrefix + address
+}
+
+// tradeEvents are the events of the trade lifecycle
+var tradeEvents = map[string]bool{
+	"AssetCreated":     true,
+	"TradeSigned":      true,
+	"TradeConfirmed":   true,
+	"DeliveryRecorded": true,
+	"TradeSettled":     true,
+}
+
+const eventReferencePricePosted = "ReferencePricePosted"
+
+// TradeInfo identifies the parties and slot of a trade
+type TradeInfo struct {
+	Buyer         string `json:"buyerAddress"`
+	Seller        string `json:"sellerAddress"`
+	DeliveryStart string `json:"deliveryStart"`
+}
+
+// TradeLookup returns the parties and slot of a trade, for events whose
+// payload does not carry them.
+type TradeLookup func(tokenID string) (*TradeInfo, error)
+
+// eventSubjects are the payload fields that route an event to topics
+type eventSubjects struct {
+	TokenID       string `json:"tokenID"`
+	Buyer         string `json:"buyer"`
+	Seller        string `json:"seller"`
+	DeliveryStart string `json:"deliveryStart"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Address       string `json:"address"`
+	Challenger    string `json:"challenger"`
+}
+
+// eventTopics returns the topics an event is published to
+func eventTopics(event *fabric.EventEnvelope, lookup TradeLookup) ([]string, error) {
+	if event.Name == eventReferencePricePosted {
+		return []string{TopicPrices}, nil
+	}
+	var subjects eventSubjects
+	if err := json.Unmarshal(event.Payload, &subjects); err != nil {
+		return nil, err
+	}
+
+	var topics []string
+	if tradeEvents[event.Name] {
+		if subjects.Buyer == "" && subjects.TokenID != "" {
+			trade, err := lookup(subjects.TokenID)
+			if err != nil {
+				return nil, err
+			}
+			subjects.Buyer, subjects.Seller, subjects.DeliveryStart = trade.Buyer, trade.Seller, trade.DeliveryStart
+		}
+		topics = append(topics, TopicTrades)
+		if subjects.DeliveryStart != "" {
+			topics = append(topics, SlotTopic(subjects.DeliveryStart))
+		}
+	}
+	seen := map[string]bool{}
+	for _, address := range []string{subjects.Buyer, subjects.Seller, subjects.From, subjects.To, subjects.Address, subjects.Challenger} {
+		if address != "" && !seen[address] {
+			seen[address] = true
+			topics = append(topics, AccountTopic(address))
+		}
+	}
+	return topics, nil
+}
+
+// parseTopics splits a comma-separated topic list
+func parseTopics(list string) map[string]bool {
+	topics := map[string]bool{}
+	for _, topic := range strings.Split(list, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics[topic] = true
+		}
+	}
+	return topics
+}
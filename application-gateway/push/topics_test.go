@@ -0,0 +1,86 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"application-gateway/fabric"
+)
+
+func testEnvelope(t *testing.T, name string, payload interface{}) *fabric.EventEnvelope {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fabric.EventEnvelope{SchemaVersion: 1, Sequence: 1, Name: name, Payload: payloadJSON}
+}
+
+func TestEventTopics(t *testing.T) {
+	lookup := func(tokenID string) (*TradeInfo, error) {
+		if tokenID != "energy1" {
+			return nil, errors.New("asset " + tokenID + " does not exist")
+		}
+		return &TradeInfo{Buyer: "buyer1", Seller: "seller1", DeliveryStart: "2025-05-03T10:00:00Z"}, nil
+	}
+	tests := []struct {
+		name    string
+		event   *fabric.EventEnvelope
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "trade event",
+			event: testEnvelope(t, "TradeConfirmed", map[string]interface{}{
+				"tokenID": "energy1", "buyer": "buyer1", "seller": "seller1", "deliveryStart": "2025-05-03T10:00:00Z",
+			}),
+			want: []string{TopicTrades, SlotTopic("2025-05-03T10:00:00Z"), AccountTopic("buyer1"), AccountTopic("seller1")},
+		},
+		{
+			name:  "settlement looks up the trade",
+			event: testEnvelope(t, "TradeSettled", map[string]interface{}{"tokenID": "energy1", "payment": 2}),
+			want:  []string{TopicTrades, SlotTopic("2025-05-03T10:00:00Z"), AccountTopic("buyer1"), AccountTopic("seller1")},
+		},
+		{
+			name:    "settlement of unknown trade",
+			event:   testEnvelope(t, "TradeSettled", map[string]interface{}{"tokenID": "energy2"}),
+			wantErr: true,
+		},
+		{
+			name:  "transfer",
+			event: testEnvelope(t, "TokensTransferred", map[string]interface{}{"from": "buyer1", "to": "seller1", "amount": 2}),
+			want:  []string{AccountTopic("buyer1"), AccountTopic("seller1")},
+		},
+		{
+			name:  "reference price",
+			event: testEnvelope(t, "ReferencePricePosted", map[string]interface{}{"period": "2025-05-03T10:00:00Z", "price": 0.2}),
+			want:  []string{TopicPrices},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			topics, err := eventTopics(test.event, lookup)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(topics, test.want) {
+				t.Errorf("got topics %v, want %v", topics, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTopics(t *testing.T) {
+	got := parseTopics(" trades, ,account:buyer1")
+	want := map[string]bool{"trades": true, "account:buyer1": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,269 @@
+// Package scheduler settles due trades at every meter interval boundary, and
+// the unmatched energy of the interval that just ended at the utility tariff.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// ErrNotLeader is returned by RunOnce when another instance holds the lease
+var ErrNotLeader = errors.New("another scheduler instance holds the lease")
+
+// Trade states the scheduler acts on
+const (
+	stateConfirmed = "CONFIRMED"
+	stateDelivered = "DELIVERED"
+	stateSettled   = "SETTLED"
+)
+
+// Invoker is the part of *client.Contract the scheduler uses
+type Invoker interface {
+	EvaluateTransaction(name string, args ...string) ([]byte, error)
+	SubmitTransaction(name string, args ...string) ([]byte, error)
+}
+
+// Config controls when and how the scheduler settles trades
+type Config struct {
+	// Holder identifies this instance in the on-chain lease
+	Holder string
+	// LeaseName is shared by all instances that compete for leadership
+	LeaseName string
+	// Interval is the meter interval; runs happen Delay after each boundary
+	Interval time.Duration
+	// Delay leaves time for the last interval's readings to be submitted
+	Delay time.Duration
+	// Lookback is how far before the boundary delivery windows are scanned
+	Lookback time.Duration
+	// MaxAttempts and Backoff control retries of transient failures
+	MaxAttempts int
+	Backoff     time.Duration
+	PageSize    int
+}
+
+// DefaultConfig returns the configuration for 15 minute meter intervals
+func DefaultConfig(holder string) Config {
+	return Config{
+		Holder:      holder,
+		LeaseName:   "settlement",
+		Interval:    15 * time.Minute,
+		Delay:       5 * time.Minute,
+		Lookback:    7 * 24 * time.Hour,
+		MaxAttempts: 3,
+		Backoff:     2 * time.Second,
+		PageSize:    100,
+	}
+}
+
+// Result counts the outcomes of one run. TariffSettled and TariffFailed
+// count participants whose unmatched energy was settled at the tariff.
+type Result struct {
+	Settled       int `json:"settled"`
+	Skipped       int `json:"skipped"`
+	Failed        int `json:"failed"`
+	TariffSettled int `json:"tariffSettled"`
+	TariffFailed  int `json:"tariffFailed"`
+}
+
+// Scheduler runs settlement rounds. Several instances may run at once: each
+// round starts by taking an on-chain lease, and only the holder proceeds.
+// ReconcileDelivery refuses to settle a trade twice, so a round that overlaps
+// a former leader's is still safe.
+type Scheduler struct {
+	contract Invoker
+	config   Config
+	sleep    func(context.Context, time.Duration) error
+}
+
+// New returns a scheduler invoking contract
+func New(contract Invoker, config Config) *Scheduler {
+	return &Scheduler{contract: contract, config: config, sleep: sleep}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Run settles trades Delay after each interval boundary until ctx is cancelled
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		boundary := time.Now().Add(-s.config.Delay).Truncate(s.config.Interval).Add(s.config.Interval)
+		if err := s.sleep(ctx, time.Until(boundary.Add(s.config.Delay))); err != nil {
+			return err
+		}
+		result, err := s.RunOnce(ctx, boundary)
+		switch {
+		case errors.Is(err, ErrNotLeader):
+			log.Printf("Skipping round at %s: %v", boundary.Format(time.RFC3339), err)
+		case err != nil:
+			log.Printf("Round at %s failed: %v", boundary.Format(time.RFC3339), err)
+		default:
+			log.Printf("Round at %s: %d settled, %d skipped, %d failed; %d settled and %d failed at the tariff", boundary.Format(time.RFC3339), result.Settled, result.Skipped, result.Failed, result.TariffSettled, result.TariffFailed)
+		}
+	}
+}
+
+// RunOnce settles every live trade whose delivery window ended by boundary,
+// then the unmatched energy of the interval ending at boundary. Trades that
+// cannot be settled yet, for instance because of missing or disputed
+// readings, are counted as failed and retried in the next round.
+func (s *Scheduler) RunOnce(ctx context.Context, boundary time.Time) (*Result, error) {
+	if err := s.acquireLease(); err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	from := boundary.Add(-s.config.Lookback).UTC().Format(time.RFC3339)
+	to := boundary.UTC().Format(time.RFC3339)
+	bookmark := ""
+	for {
+		page, err := s.tradePage(from, to, bookmark)
+		if err != nil {
+			return result, err
+		}
+		for _, trade := range page.Records {
+			if trade.TransactionState != stateConfirmed && trade.TransactionState != stateDelivered {
+				continue
+			}
+			deliveryEnd, err := time.Parse(time.RFC3339, trade.DeliveryEnd)
+			if err != nil || deliveryEnd.After(boundary) {
+				continue
+			}
+			outcome := s.settle(ctx, trade.TokenID)
+			metrics.SchedulerSettlement(outcome)
+			switch outcome {
+			case metrics.OutcomeSettled:
+				result.Settled++
+			case metrics.OutcomeSkipped:
+				result.Skipped++
+			default:
+				result.Failed++
+			}
+		}
+		if page.Bookmark == "" || len(page.Records) == 0 {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+	return result, s.settleUnmatched(boundary.Add(-s.config.Interval), result)
+}
+
+type fallbackBatch struct {
+	Settlements []json.RawMessage `json:"settlements"`
+	Failures    []struct {
+		Participant string `json:"participant"`
+		Reason      string `json:"reason"`
+	} `json:"failures"`
+	Next string `json:"next"`
+}
+
+// settleUnmatched settles the unmatched energy of the interval starting at
+// intervalStart, one batch of participants at a time. Without a tariff
+// season for the interval there is nothing to settle against.
+func (s *Scheduler) settleUnmatched(intervalStart time.Time, result *Result) error {
+	interval := intervalStart.UTC().Format(time.RFC3339)
+	next := ""
+	for {
+		batchJSON, err := s.contract.SubmitTransaction("SettleUnmatchedEnergy", interval, next)
+		if err != nil {
+			detailed := fabric.ErrorWithDetails(err)
+			if strings.Contains(detailed.Error(), "no tariff season covers") {
+				return nil
+			}
+			return fmt.Errorf("failed to settle unmatched energy of %s: %w", interval, detailed)
+		}
+		var batch fallbackBatch
+		if err := json.Unmarshal(batchJSON, &batch); err != nil {
+			return err
+		}
+		result.TariffSettled += len(batch.Settlements)
+		result.TariffFailed += len(batch.Failures)
+		for _, failure := range batch.Failures {
+			log.Printf("Unmatched energy of %s at %s was not settled: %s", failure.Participant, interval, failure.Reason)
+		}
+		if batch.Next == "" {
+			return nil
+		}
+		next = batch.Next
+	}
+}
+
+// acquireLease takes or renews the lease for two intervals, so that a crashed
+// leader is replaced within two rounds.
+func (s *Scheduler) acquireLease() error {
+	ttl := 2 * s.config.Interval
+	_, err := s.contract.SubmitTransaction("AcquireSchedulerLease", s.config.LeaseName, s.config.Holder, strconv.Itoa(int(ttl.Seconds())))
+	if err == nil {
+		return nil
+	}
+	var commitErr *client.CommitError
+	if errors.As(err, &commitErr) || strings.Contains(fabric.ErrorWithDetails(err).Error(), "is held by") {
+		return ErrNotLeader
+	}
+	return fmt.Errorf("failed to acquire lease %s: %w", s.config.LeaseName, fabric.ErrorWithDetails(err))
+}
+
+type tradeRecord struct {
+	TokenID          string `json:"tokenID"`
+	DeliveryEnd      string `json:"deliveryEnd"`
+	TransactionState string `json:"transactionState"`
+}
+
+type tradePage struct {
+	Records  []*tradeRecord `json:"records"`
+	Bookmark string         `json:"bookmark"`
+}
+
+func (s *Scheduler) tradePage(from, to, bookmark string) (*tradePage, error) {
+	pageJSON, err := s.contract.EvaluateTransaction("GetTradesByDeliveryWindow", from, to, strconv.Itoa(s.config.PageSize), bookmark)
+	if err != nil {
+		return nil, fabric.ErrorWithDetails(err)
+	}
+	var page tradePage
+	if err := json.Unmarshal(pageJSON, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// settle reconciles one trade, retrying transient failures with exponential
+// backoff. A trade another instance already settled counts as skipped.
+func (s *Scheduler) settle(ctx context.Context, tokenID string) string {
+	backoff := s.config.Backoff
+	for attempt := 1; ; attempt++ {
+		_, err := s.contract.SubmitTransaction("ReconcileDelivery", tokenID)
+		if err == nil {
+			return metrics.OutcomeSettled
+		}
+		detailed := fabric.ErrorWithDetails(err)
+		if strings.Contains(detailed.Error(), "in state "+stateSettled) {
+			return metrics.OutcomeSkipped
+		}
+		if !fabric.Transient(err) || attempt >= s.config.MaxAttempts {
+			log.Printf("Settlement of %s failed after %d attempts: %v", tokenID, attempt, detailed)
+			return metrics.OutcomeFailed
+		}
+		if err := s.sleep(ctx, backoff); err != nil {
+			return metrics.OutcomeFailed
+		}
+		backoff *= 2
+	}
+}
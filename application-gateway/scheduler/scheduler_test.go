@@ -0,0 +1,124 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+)
+
+// fakeContract serves one page of trades and fails each ReconcileDelivery
+// with the queued errors before succeeding. SettleUnmatchedEnergy returns
+// the queued batches, then fails as if no tariff were set.
+type fakeContract struct {
+	leaseErr   error
+	trades     []*tradeRecord
+	failures   map[string][]error
+	reconciled map[string]int
+	batches    []string
+	unmatched  [][]string
+}
+
+func (f *fakeContract) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	return json.Marshal(tradePage{Records: f.trades})
+}
+
+func (f *fakeContract) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	if name == "AcquireSchedulerLease" {
+		return nil, f.leaseErr
+	}
+	if name == "SettleUnmatchedEnergy" {
+		f.unmatched = append(f.unmatched, args)
+		if len(f.batches) == 0 {
+			return nil, errors.New("chaincode response 500, no tariff season covers " + args[0])
+		}
+		batch := f.batches[0]
+		f.batches = f.batches[1:]
+		return []byte(batch), nil
+	}
+	tokenID := args[0]
+	f.reconciled[tokenID]++
+	if queued := f.failures[tokenID]; len(queued) > 0 {
+		f.failures[tokenID] = queued[1:]
+		return nil, queued[0]
+	}
+	return nil, nil
+}
+
+func newTestScheduler(contract Invoker) *Scheduler {
+	s := New(contract, DefaultConfig("worker-a"))
+	s.sleep = func(context.Context, time.Duration) error { return nil }
+	return s
+}
+
+func TestRunOnce(t *testing.T) {
+	conflict := &client.CommitError{TransactionID: "tx1", Code: peer.TxValidationCode_MVCC_READ_CONFLICT}
+	contract := &fakeContract{
+		trades: []*tradeRecord{
+			{TokenID: "settled-now", DeliveryEnd: "2025-05-03T11:00:00Z", TransactionState: stateConfirmed},
+			{TokenID: "after-conflict", DeliveryEnd: "2025-05-03T10:45:00Z", TransactionState: stateDelivered},
+			{TokenID: "already-settled", DeliveryEnd: "2025-05-03T10:00:00Z", TransactionState: stateConfirmed},
+			{TokenID: "no-readings", DeliveryEnd: "2025-05-03T10:00:00Z", TransactionState: stateConfirmed},
+			{TokenID: "still-delivering", DeliveryEnd: "2025-05-03T11:15:00Z", TransactionState: stateConfirmed},
+			{TokenID: "unsigned", DeliveryEnd: "2025-05-03T10:00:00Z", TransactionState: "CREATED"},
+		},
+		failures: map[string][]error{
+			"after-conflict":  {conflict, conflict},
+			"already-settled": {errors.New("asset already-settled cannot be settled in state SETTLED")},
+			"no-readings":     {errors.New("seller seller1 has no meter readings for asset no-readings")},
+		},
+		reconciled: map[string]int{},
+		batches: []string{
+			`{"settlements":[{"participant":"p1"},{"participant":"p2"}],"failures":[],"next":"p3"}`,
+			`{"settlements":[],"failures":[{"participant":"p4","reason":"account p4 has insufficient balance"}],"next":""}`,
+		},
+	}
+	result, err := newTestScheduler(contract).RunOnce(context.Background(), time.Date(2025, 5, 3, 11, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *result != (Result{Settled: 2, Skipped: 1, Failed: 1, TariffSettled: 2, TariffFailed: 1}) {
+		t.Errorf("got result %+v", result)
+	}
+	want := map[string]int{"settled-now": 1, "after-conflict": 3, "already-settled": 1, "no-readings": 1}
+	for tokenID, attempts := range want {
+		if contract.reconciled[tokenID] != attempts {
+			t.Errorf("got %d attempts for %s, want %d", contract.reconciled[tokenID], tokenID, attempts)
+		}
+	}
+	if len(contract.reconciled) != len(want) {
+		t.Errorf("reconciled trades %v, want only %v", contract.reconciled, want)
+	}
+	wantUnmatched := [][]string{{"2025-05-03T10:45:00Z", ""}, {"2025-05-03T10:45:00Z", "p3"}}
+	if !reflect.DeepEqual(contract.unmatched, wantUnmatched) {
+		t.Errorf("settled unmatched energy with %v, want %v", contract.unmatched, wantUnmatched)
+	}
+}
+
+func TestRunOnceWithoutTariff(t *testing.T) {
+	contract := &fakeContract{reconciled: map[string]int{}}
+	result, err := newTestScheduler(contract).RunOnce(context.Background(), time.Date(2025, 5, 3, 11, 0, 0, 0, time.UTC))
+	if err != nil || *result != (Result{}) {
+		t.Errorf("got %+v, %v without a tariff", result, err)
+	}
+}
+
+func TestRunOnceWithoutLease(t *testing.T) {
+	contract := &fakeContract{
+		leaseErr:   errors.New("lease settlement is held by worker-b until 2025-05-03T11:30:00Z"),
+		trades:     []*tradeRecord{{TokenID: "energy1", DeliveryEnd: "2025-05-03T10:00:00Z", TransactionState: stateConfirmed}},
+		reconciled: map[string]int{},
+	}
+	_, err := newTestScheduler(contract).RunOnce(context.Background(), time.Date(2025, 5, 3, 11, 0, 0, 0, time.UTC))
+	if !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("got error %v, want ErrNotLeader", err)
+	}
+	if len(contract.reconciled) != 0 {
+		t.Errorf("reconciled %v without the lease", contract.reconciled)
+	}
+}
@@ -0,0 +1,110 @@
+package simulator
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Profile is a virtual prosumer's installation. Generation follows a clear-sky
+// solar curve between 06:00 and 18:00 UTC; load is a base plus an evening peak
+// around 19:00 UTC.
+type Profile struct {
+	PeakGenerationKW float64
+	BaseLoadKW       float64
+	EveningPeakKW    float64
+}
+
+// RandomProfile draws a profile; about a third of prosumers have no PV
+func RandomProfile(r *rand.Rand) Profile {
+	profile := Profile{
+		BaseLoadKW:    0.3 + r.Float64()*0.5,
+		EveningPeakKW: 0.5 + r.Float64()*1.5,
+	}
+	if r.Float64() >= 1.0/3 {
+		profile.PeakGenerationKW = 3 + r.Float64()*7
+	}
+	return profile
+}
+
+// midpointHour is the UTC hour of day at the middle of the interval
+func midpointHour(start time.Time, interval time.Duration) float64 {
+	mid := start.UTC().Add(interval / 2)
+	return float64(mid.Hour()) + float64(mid.Minute())/60
+}
+
+// Generation returns the expected kWh generated in the interval
+func (p Profile) Generation(start time.Time, interval time.Duration) float64 {
+	hour := midpointHour(start, interval)
+	if hour <= 6 || hour >= 18 {
+		return 0
+	}
+	return p.PeakGenerationKW * math.Sin(math.Pi*(hour-6)/12) * interval.Hours()
+}
+
+// Consumption returns the expected kWh consumed in the interval
+func (p Profile) Consumption(start time.Time, interval time.Duration) float64 {
+	hour := midpointHour(start, interval)
+	load := p.BaseLoadKW + p.EveningPeakKW*math.Exp(-math.Pow(hour-19, 2)/4)
+	return load * interval.Hours()
+}
+
+// jitter scales value by a random factor in [1-spread, 1+spread]
+func jitter(r *rand.Rand, value, spread float64) float64 {
+	return value * (1 + spread*(2*r.Float64()-1))
+}
+
+// Position is a prosumer's forecast net energy for an interval; positive is surplus
+type Position struct {
+	Prosumer int
+	Net      float64
+}
+
+// Match pairs a seller with a buyer for Amount kWh
+type Match struct {
+	Seller int
+	Buyer  int
+	Amount float64
+}
+
+// MatchPositions pairs the largest surpluses with the largest deficits until
+// either side runs out. Positions are rounded down to 0.01 kWh.
+func MatchPositions(positions []Position) []Match {
+	type side struct {
+		prosumer   int
+		hundredths int64
+	}
+	var sellers, buyers []side
+	for _, position := range positions {
+		hundredths := int64(math.Floor(math.Abs(position.Net) * 100))
+		if hundredths == 0 {
+			continue
+		}
+		if position.Net > 0 {
+			sellers = append(sellers, side{position.Prosumer, hundredths})
+		} else {
+			buyers = append(buyers, side{position.Prosumer, hundredths})
+		}
+	}
+	sort.SliceStable(sellers, func(i, j int) bool { return sellers[i].hundredths > sellers[j].hundredths })
+	sort.SliceStable(buyers, func(i, j int) bool { return buyers[i].hundredths > buyers[j].hundredths })
+
+	var matches []Match
+	for i, j := 0, 0; i < len(sellers) && j < len(buyers); {
+		amount := sellers[i].hundredths
+		if buyers[j].hundredths < amount {
+			amount = buyers[j].hundredths
+		}
+		matches = append(matches, Match{Seller: sellers[i].prosumer, Buyer: buyers[j].prosumer, Amount: float64(amount) / 100})
+		sellers[i].hundredths -= amount
+		buyers[j].hundredths -= amount
+		if sellers[i].hundredths == 0 {
+			i++
+		}
+		if buyers[j].hundredths == 0 {
+			j++
+		}
+	}
+	return matches
+}
@@ -0,0 +1,42 @@
+package simulator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProfile(t *testing.T) {
+	profile := Profile{PeakGenerationKW: 8, BaseLoadKW: 0.4, EveningPeakKW: 1}
+	night := time.Date(2025, 5, 3, 2, 0, 0, 0, time.UTC)
+	noon := time.Date(2025, 5, 3, 11, 45, 0, 0, time.UTC)
+
+	if got := profile.Generation(night, 15*time.Minute); got != 0 {
+		t.Errorf("got %v kWh generated at night, want 0", got)
+	}
+	// The interval 11:45-12:00 has its midpoint just before the solar peak
+	if got := profile.Generation(noon, 15*time.Minute); got < 1.99 || got > 2 {
+		t.Errorf("got %v kWh generated at noon, want about 2", got)
+	}
+	if profile.Consumption(time.Date(2025, 5, 3, 18, 45, 0, 0, time.UTC), 15*time.Minute) <= profile.Consumption(noon, 15*time.Minute) {
+		t.Error("expected evening load to exceed midday load")
+	}
+}
+
+func TestMatchPositions(t *testing.T) {
+	positions := []Position{
+		{Prosumer: 0, Net: 1.5},
+		{Prosumer: 1, Net: -1},
+		{Prosumer: 2, Net: 0.4},
+		{Prosumer: 3, Net: -0.7},
+		{Prosumer: 4, Net: 0},
+	}
+	want := []Match{
+		{Seller: 0, Buyer: 1, Amount: 1},
+		{Seller: 0, Buyer: 3, Amount: 0.5},
+		{Seller: 2, Buyer: 3, Amount: 0.2},
+	}
+	if got := MatchPositions(positions); !reflect.DeepEqual(got, want) {
+		t.Errorf("got matches %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,356 @@
+// Package simulator drives virtual prosumers through the trade lifecycle
+// against a live network to measure throughput and failure rates.
+package simulator
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"application-gateway/canonical"
+	"application-gateway/fabric"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// Contract is the part of *client.Contract the simulator uses
+type Contract interface {
+	Evaluate(transactionName string, options ...client.ProposalOption) ([]byte, error)
+	Submit(transactionName string, options ...client.ProposalOption) ([]byte, error)
+}
+
+// Config controls the simulated market
+type Config struct {
+	// RunID keeps trade IDs of separate runs apart
+	RunID string
+	// Interval must equal the chaincode's meter interval
+	Interval       time.Duration
+	Zone           string
+	InitialBalance float64
+	// Concurrency bounds the invocations in flight
+	Concurrency int
+	// Forecast error applied to actual metered energy, as a fraction
+	MeterNoise float64
+	// ProfileOffset shifts the clock of the generation and load profiles, so
+	// that a daytime market can be simulated at any hour.
+	ProfileOffset time.Duration
+}
+
+// Prosumer is a virtual participant, acting through its own wallet identity
+type Prosumer struct {
+	Label    string
+	Address  string
+	MeterID  string
+	Profile  Profile
+	contract Contract
+	keys     *ProsumerKeys
+}
+
+// pendingTrade is a trade awaiting settlement after its interval
+type pendingTrade struct {
+	tokenID string
+	seller  *Prosumer
+}
+
+// Simulator runs rounds of the market, one per meter interval
+type Simulator struct {
+	config    Config
+	admin     Contract
+	oracle    Contract
+	prosumers []*Prosumer
+	state     *State
+	stats     *Stats
+
+	randMu sync.Mutex
+	rand   *mathrand.Rand
+
+	pending map[time.Time][]pendingTrade
+}
+
+// New creates a simulator for the prosumers, whose keys are kept in state
+func New(config Config, admin, oracle Contract, prosumers []*Prosumer, state *State, stats *Stats, seed int64) *Simulator {
+	return &Simulator{
+		config:    config,
+		admin:     admin,
+		oracle:    oracle,
+		prosumers: prosumers,
+		state:     state,
+		stats:     stats,
+		rand:      mathrand.New(mathrand.NewSource(seed)),
+		pending:   map[time.Time][]pendingTrade{},
+	}
+}
+
+// NewProsumer returns a prosumer acting through contract
+func NewProsumer(label string, profile Profile, contract Contract) *Prosumer {
+	return &Prosumer{Label: label, MeterID: "meter-" + label, Profile: profile, contract: contract}
+}
+
+func (s *Simulator) jitter(value, spread float64) float64 {
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return jitter(s.rand, value, spread)
+}
+
+// invoke submits or evaluates a transaction and records the outcome
+func (s *Simulator) invoke(contract Contract, submit bool, function string, options ...client.ProposalOption) ([]byte, error) {
+	start := time.Now()
+	var result []byte
+	var err error
+	if submit {
+		result, err = contract.Submit(function, options...)
+	} else {
+		result, err = contract.Evaluate(function, options...)
+	}
+	s.stats.Record(function, time.Since(start), err)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", function, fabric.ErrorWithDetails(err))
+	}
+	return result, nil
+}
+
+// parallel runs task for 0..n-1 with at most Concurrency in flight, logging failures
+func (s *Simulator) parallel(n int, task func(i int) error) {
+	limit := make(chan struct{}, max(s.config.Concurrency, 1))
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			if err := task(i); err != nil {
+				log.Print(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func salt() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func sign(key *ecdsa.PrivateKey, payload []byte) (string, error) {
+	digest := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+func formatAmount(value float64) string {
+	return strconv.FormatFloat(math.Round(value*1000)/1000, 'f', -1, 64)
+}
+
+// Setup registers every prosumer not yet in the state, has the admin approve
+// it and fund its account, and enrolls its meter.
+func (s *Simulator) Setup() error {
+	s.parallel(len(s.prosumers), func(i int) error {
+		return s.setupProsumer(s.prosumers[i])
+	})
+	if err := s.state.Save(); err != nil {
+		return err
+	}
+	for _, prosumer := range s.prosumers {
+		if prosumer.Address == "" {
+			return fmt.Errorf("prosumer %s could not be registered", prosumer.Label)
+		}
+	}
+	return nil
+}
+
+func (s *Simulator) setupProsumer(p *Prosumer) error {
+	keys, registered, err := s.state.Keys(p.Label)
+	if err != nil {
+		return err
+	}
+	p.keys = keys
+	if registered {
+		p.Address = keys.Address
+		return nil
+	}
+
+	signingPEM, err := publicKeyPEM(keys.signing)
+	if err != nil {
+		return err
+	}
+	meterIDs, _ := json.Marshal([]string{p.MeterID})
+	personal, _ := json.Marshal(map[string]string{"displayName": p.Label, "salt": salt()})
+	participantJSON, err := s.invoke(p.contract, true, "RegisterParticipant",
+		client.WithArguments(string(meterIDs), signingPEM, s.config.Zone),
+		client.WithTransient(map[string][]byte{"participant_personal": personal}))
+	if err != nil {
+		return fmt.Errorf("prosumer %s: %w", p.Label, err)
+	}
+	var participant struct {
+		Address string `json:"address"`
+	}
+	if err := json.Unmarshal(participantJSON, &participant); err != nil {
+		return err
+	}
+	p.Address = participant.Address
+
+	if _, err := s.invoke(s.admin, true, "ApproveParticipant", client.WithArguments(p.Address)); err != nil {
+		return err
+	}
+	meterPEM, err := publicKeyPEM(keys.meter)
+	if err != nil {
+		return err
+	}
+	if _, err := s.invoke(p.contract, true, "EnrollDevice", client.WithArguments(p.MeterID, "meter", meterPEM)); err != nil {
+		return err
+	}
+	if _, err := s.invoke(s.admin, true, "MintTokens", client.WithArguments(p.Address, formatAmount(s.config.InitialBalance))); err != nil {
+		return err
+	}
+	s.state.MarkRegistered(p.Label, p.Address)
+	return nil
+}
+
+// Run plays rounds market rounds, one at each interval boundary, then two
+// more rounds without trading so that the last trades are metered and settled.
+func (s *Simulator) Run(ctx context.Context, rounds int) error {
+	for round := 0; round < rounds+2; round++ {
+		// Wait until just after the next boundary so the transaction time is past it
+		boundary := time.Now().UTC().Truncate(s.config.Interval).Add(s.config.Interval)
+		timer := time.NewTimer(time.Until(boundary) + 5*time.Second)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		log.Printf("Round %d at %s", round+1, boundary.Format(time.RFC3339))
+		s.Round(boundary, round < rounds)
+	}
+	return nil
+}
+
+// Round meters and settles the interval that just ended and, when trade is
+// set, matches and signs trades for the interval after the current one.
+func (s *Simulator) Round(boundary time.Time, trade bool) {
+	previous := boundary.Add(-s.config.Interval)
+	s.parallel(len(s.prosumers), func(i int) error {
+		return s.submitReading(s.prosumers[i], previous)
+	})
+	pending := s.pending[previous]
+	delete(s.pending, previous)
+	s.parallel(len(pending), func(i int) error {
+		_, err := s.invoke(pending[i].seller.contract, true, "ReconcileDelivery", client.WithArguments(pending[i].tokenID))
+		return err
+	})
+
+	if trade {
+		next := boundary.Add(s.config.Interval)
+		price, err := s.postReferencePrice(next)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		s.trade(next, price)
+	}
+}
+
+// submitReading submits the prosumer's metered energy for the interval, the
+// profile's expectation perturbed by MeterNoise.
+func (s *Simulator) submitReading(p *Prosumer, start time.Time) error {
+	profileStart := start.Add(s.config.ProfileOffset)
+	injected := formatAmount(s.jitter(p.Profile.Generation(profileStart, s.config.Interval), s.config.MeterNoise))
+	consumed := formatAmount(s.jitter(p.Profile.Consumption(profileStart, s.config.Interval), s.config.MeterNoise))
+	intervalStart := start.Format(time.RFC3339)
+	injectedValue, _ := strconv.ParseFloat(injected, 64)
+	consumedValue, _ := strconv.ParseFloat(consumed, 64)
+	payload, err := canonical.Marshal(struct {
+		MeterID       string  `json:"meterID"`
+		IntervalStart string  `json:"intervalStart"`
+		KWhInjected   float64 `json:"kWhInjected"`
+		KWhConsumed   float64 `json:"kWhConsumed"`
+	}{p.MeterID, intervalStart, injectedValue, consumedValue})
+	if err != nil {
+		return err
+	}
+	signature, err := sign(p.keys.meter, payload)
+	if err != nil {
+		return err
+	}
+	_, err = s.invoke(p.contract, true, "SubmitMeterReading", client.WithArguments(p.MeterID, intervalStart, injected, consumed, signature))
+	return err
+}
+
+// postReferencePrice posts a price following the day's demand curve for the
+// interval and returns it. A price already posted by an earlier run is kept.
+func (s *Simulator) postReferencePrice(start time.Time) (float64, error) {
+	hour := midpointHour(start.Add(s.config.ProfileOffset), s.config.Interval)
+	price := math.Round((0.15+0.1*math.Exp(-math.Pow(hour-19, 2)/8))*1000) / 1000
+	period := start.Format(time.RFC3339)
+	_, err := s.invoke(s.oracle, true, "PostReferencePrice", client.WithArguments(period, formatAmount(price)))
+	if err != nil && !strings.Contains(err.Error(), "has already been posted") {
+		return 0, err
+	}
+	return price, nil
+}
+
+// trade matches the prosumers' forecast positions for the interval and has
+// each pair create and sign a trade at a price near the reference price.
+func (s *Simulator) trade(start time.Time, referencePrice float64) {
+	positions := make([]Position, len(s.prosumers))
+	profileStart := start.Add(s.config.ProfileOffset)
+	for i, p := range s.prosumers {
+		net := p.Profile.Generation(profileStart, s.config.Interval) - p.Profile.Consumption(profileStart, s.config.Interval)
+		positions[i] = Position{Prosumer: i, Net: net}
+	}
+	matches := MatchPositions(positions)
+
+	var mu sync.Mutex
+	end := start.Add(s.config.Interval)
+	s.parallel(len(matches), func(i int) error {
+		match := matches[i]
+		seller, buyer := s.prosumers[match.Seller], s.prosumers[match.Buyer]
+		tokenID := fmt.Sprintf("sim-%s-%s-%d", s.config.RunID, start.Format("20060102T1504"), i)
+		price := math.Round(s.jitter(referencePrice, 0.1)*1000) / 1000
+		private, _ := json.Marshal(map[string]interface{}{
+			"transactionPrice": price,
+			"buyerDeposit":     0,
+			"sellerDeposit":    math.Round(match.Amount*price*100) / 100,
+			"salt":             salt(),
+		})
+		if _, err := s.invoke(seller.contract, true, "CreateEnergyAsset",
+			client.WithArguments(tokenID, buyer.Address, seller.Address, formatAmount(match.Amount), start.Format(time.RFC3339), end.Format(time.RFC3339), "grid"),
+			client.WithTransient(map[string][]byte{"trade_private": private})); err != nil {
+			return err
+		}
+		payload, err := s.invoke(seller.contract, false, "GetSigningPayload", client.WithArguments(tokenID))
+		if err != nil {
+			return err
+		}
+		for _, party := range []*Prosumer{seller, buyer} {
+			signature, err := sign(party.keys.signing, payload)
+			if err != nil {
+				return err
+			}
+			if _, err := s.invoke(party.contract, true, "SignEnergyAsset", client.WithArguments(tokenID, signature, "0")); err != nil {
+				return err
+			}
+		}
+		mu.Lock()
+		s.pending[start] = append(s.pending[start], pendingTrade{tokenID: tokenID, seller: seller})
+		mu.Unlock()
+		return nil
+	})
+}
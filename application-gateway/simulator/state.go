@@ -0,0 +1,132 @@
+package simulator
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ProsumerKeys are a prosumer's trade signing key and meter key. Address is
+// set once the prosumer has been registered on-chain.
+type ProsumerKeys struct {
+	Address    string `json:"address,omitempty"`
+	SigningKey string `json:"signingKey"`
+	MeterKey   string `json:"meterKey"`
+
+	signing *ecdsa.PrivateKey
+	meter   *ecdsa.PrivateKey
+}
+
+// State persists the prosumers' keys between runs, since a registered
+// participant's public key cannot be replaced.
+type State struct {
+	path string
+	mu   sync.Mutex
+
+	Prosumers map[string]*ProsumerKeys `json:"prosumers"`
+}
+
+// LoadState reads the state file at path; a missing file is an empty state
+func LoadState(path string) (*State, error) {
+	state := &State{path: path, Prosumers: map[string]*ProsumerKeys{}}
+	stateJSON, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(stateJSON, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for label, keys := range state.Prosumers {
+		if keys.signing, err = parsePrivateKey(keys.SigningKey); err != nil {
+			return nil, fmt.Errorf("signing key of %s: %w", label, err)
+		}
+		if keys.meter, err = parsePrivateKey(keys.MeterKey); err != nil {
+			return nil, fmt.Errorf("meter key of %s: %w", label, err)
+		}
+	}
+	return state, nil
+}
+
+// Keys returns the keys of a prosumer, generating them on first use, and
+// whether it has been registered.
+func (s *State) Keys(label string) (*ProsumerKeys, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if keys, ok := s.Prosumers[label]; ok {
+		return keys, keys.Address != "", nil
+	}
+	keys := &ProsumerKeys{}
+	var err error
+	if keys.signing, keys.SigningKey, err = generateKey(); err != nil {
+		return nil, false, err
+	}
+	if keys.meter, keys.MeterKey, err = generateKey(); err != nil {
+		return nil, false, err
+	}
+	s.Prosumers[label] = keys
+	return keys, false, nil
+}
+
+// MarkRegistered records the on-chain address of a registered prosumer
+func (s *State) MarkRegistered(label, address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Prosumers[label].Address = address
+}
+
+// Save writes the state file, readable by the owner only
+func (s *State) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stateJSON, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, stateJSON, 0o600)
+}
+
+func generateKey() (*ecdsa.PrivateKey, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+func parsePrivateKey(keyPEM string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+func publicKeyPEM(key *ecdsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
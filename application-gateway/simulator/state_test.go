@@ -0,0 +1,40 @@
+package simulator
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	state, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, registered, err := state.Keys("sim1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registered {
+		t.Error("new prosumer reported as registered")
+	}
+	state.MarkRegistered("sim1", "address1")
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, registered, err := loaded.Keys("sim1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !registered || reloaded.Address != "address1" {
+		t.Errorf("got keys %+v, registered %v", reloaded, registered)
+	}
+	if !reloaded.signing.Equal(keys.signing) || !reloaded.meter.Equal(keys.meter) {
+		t.Error("keys changed across save and load")
+	}
+}
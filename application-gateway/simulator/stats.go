@@ -0,0 +1,118 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"google.golang.org/grpc/status"
+)
+
+// functionStats accumulates the outcomes of one chaincode function
+type functionStats struct {
+	Calls    int
+	Failures map[string]int
+	Latency  time.Duration
+	Slowest  time.Duration
+}
+
+// Stats records every invocation the simulator makes. It is safe for
+// concurrent use.
+type Stats struct {
+	mu        sync.Mutex
+	started   time.Time
+	functions map[string]*functionStats
+}
+
+// NewStats starts the clock for throughput
+func NewStats() *Stats {
+	return &Stats{started: time.Now(), functions: map[string]*functionStats{}}
+}
+
+// Record adds an invocation of function that took latency and failed with err, if not nil
+func (s *Stats) Record(function string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.functions[function]
+	if !ok {
+		stats = &functionStats{Failures: map[string]int{}}
+		s.functions[function] = stats
+	}
+	stats.Calls++
+	stats.Latency += latency
+	if latency > stats.Slowest {
+		stats.Slowest = latency
+	}
+	if err != nil {
+		stats.Failures[failureReason(err)]++
+	}
+}
+
+// failureReason classifies an invocation error by the stage that failed and,
+// for commit failures, the validation code.
+func failureReason(err error) string {
+	var endorseErr *client.EndorseError
+	var submitErr *client.SubmitError
+	var commitStatusErr *client.CommitStatusError
+	var commitErr *client.CommitError
+	switch {
+	case errors.As(err, &commitErr):
+		return "commit " + commitErr.Code.String()
+	case errors.As(err, &endorseErr):
+		return "endorse " + status.Code(err).String()
+	case errors.As(err, &submitErr):
+		return "submit " + status.Code(err).String()
+	case errors.As(err, &commitStatusErr):
+		return "commit status " + status.Code(err).String()
+	}
+	return "other"
+}
+
+// Report writes per-function call counts, failure rates and latencies, and
+// the overall throughput of successful transactions.
+func (s *Stats) Report(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.started)
+
+	names := make([]string, 0, len(s.functions))
+	for name := range s.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "FUNCTION\tCALLS\tFAILED\tRATE\tMEAN\tMAX\tFAILURES")
+	var calls, failed int
+	for _, name := range names {
+		stats := s.functions[name]
+		failures := 0
+		reasons := ""
+		for _, reason := range sortedKeys(stats.Failures) {
+			failures += stats.Failures[reason]
+			reasons += fmt.Sprintf("%s=%d ", reason, stats.Failures[reason])
+		}
+		calls += stats.Calls
+		failed += failures
+		fmt.Fprintf(table, "%s\t%d\t%d\t%.1f%%\t%v\t%v\t%s\n", name, stats.Calls, failures,
+			100*float64(failures)/float64(stats.Calls), (stats.Latency / time.Duration(stats.Calls)).Round(time.Millisecond),
+			stats.Slowest.Round(time.Millisecond), reasons)
+	}
+	table.Flush()
+	fmt.Fprintf(w, "\n%d calls, %d failed, %.2f successful transactions/s over %v\n", calls, failed,
+		float64(calls-failed)/elapsed.Seconds(), elapsed.Round(time.Second))
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,256 @@
+// Package submission queues the gateway's transaction submissions. A fixed
+// number of submissions are in flight at once; the rest wait in one queue
+// per priority class, and a free slot always goes to the highest class
+// waiting, so a burst of meter readings cannot hold up settlements.
+// Submissions that fail to endorse for lack of peers are retried with
+// exponential backoff, and those invalidated by a read conflict are
+// endorsed again against the newer state.
+package submission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"application-gateway/metrics"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrQueueFull is returned by Submit when the submission's class already
+// has as many submissions waiting as the queue holds
+var ErrQueueFull = errors.New("the submission queue is full")
+
+// Class is the priority of a submission; lower classes go first
+type Class int
+
+// Priority classes, highest first
+const (
+	Settlement Class = iota
+	MeterData
+	Orders
+	classes
+)
+
+func (c Class) String() string {
+	switch c {
+	case Settlement:
+		return "settlement"
+	case MeterData:
+		return "meter_data"
+	default:
+		return "orders"
+	}
+}
+
+// Config controls the queue's capacity and retries
+type Config struct {
+	// Workers is how many submissions may be in flight at once
+	Workers int
+	// Capacity is how many submissions of each class may wait
+	Capacity int
+	// MaxAttempts, Backoff and MaxBackoff control retries of endorsement
+	// failures
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	// MaxConflicts is how many read conflicts a submission is endorsed
+	// again after, each after a random delay of up to ConflictDelay
+	MaxConflicts  int
+	ConflictDelay time.Duration
+}
+
+// DefaultConfig returns the configuration for a single gateway peer
+func DefaultConfig() Config {
+	return Config{
+		Workers:       8,
+		Capacity:      500,
+		MaxAttempts:   5,
+		Backoff:       250 * time.Millisecond,
+		MaxBackoff:    8 * time.Second,
+		MaxConflicts:  3,
+		ConflictDelay: 100 * time.Millisecond,
+	}
+}
+
+// CommitFailedError is returned by an attempt whose transaction was
+// committed as invalid
+type CommitFailedError struct {
+	TransactionID string
+	Code          peer.TxValidationCode
+}
+
+func (e *CommitFailedError) Error() string {
+	return fmt.Sprintf("transaction %s failed to commit with status %d", e.TransactionID, int32(e.Code))
+}
+
+// conflict reports whether an attempt's transaction was invalidated by a
+// concurrent write to a key it read, and would pass if endorsed again
+func conflict(err error) bool {
+	var commitErr *CommitFailedError
+	return errors.As(err, &commitErr) &&
+		(commitErr.Code == peer.TxValidationCode_MVCC_READ_CONFLICT || commitErr.Code == peer.TxValidationCode_PHANTOM_READ_CONFLICT)
+}
+
+// endorsementUnavailable reports whether an attempt failed to endorse
+// because the peers were unavailable or overloaded. Nothing reached the
+// orderer, so the submission can be retried as is. Failures to submit to
+// the orderer or to learn the commit status are not, since the transaction
+// may yet commit.
+func endorsementUnavailable(err error) bool {
+	var submitErr *client.SubmitError
+	var commitStatusErr *client.CommitStatusError
+	if errors.As(err, &submitErr) || errors.As(err, &commitStatusErr) {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// Queue runs submissions by priority with bounded concurrency
+type Queue struct {
+	config Config
+	sleep  func(ctx context.Context, d time.Duration) error
+
+	mu       sync.Mutex
+	inFlight int
+	waiting  [classes][]chan struct{}
+}
+
+// New returns an empty queue
+func New(config Config) *Queue {
+	return &Queue{config: config, sleep: sleep}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Submit runs attempt once a slot is free, and again while it fails in a
+// way worth retrying. An attempt submits one transaction and waits for it
+// to commit, returning a *CommitFailedError if it was invalidated. The slot
+// is given up between attempts, so a submission backing off does not hold
+// up others. Submit returns ErrQueueFull at once if the class's queue is
+// full, and the last attempt's error if retries are exhausted.
+func (q *Queue) Submit(ctx context.Context, class Class, attempt func(ctx context.Context) error) error {
+	backoff := q.config.Backoff
+	failures, conflicts := 0, 0
+	for {
+		if err := q.acquire(ctx, class, failures+conflicts > 0); err != nil {
+			return err
+		}
+		err := attempt(ctx)
+		q.release()
+		if err == nil {
+			return nil
+		}
+
+		var wait time.Duration
+		switch {
+		case conflict(err) && conflicts < q.config.MaxConflicts:
+			// A conflict is not a failure of the network, so it does not
+			// count towards MaxAttempts
+			conflicts++
+			wait = time.Duration(rand.Int63n(int64(q.config.ConflictDelay) + 1))
+			metrics.SubmissionRetry(class.String(), metrics.RetryConflict)
+		case endorsementUnavailable(err) && failures+1 < q.config.MaxAttempts:
+			failures++
+			wait = backoff
+			if backoff *= 2; backoff > q.config.MaxBackoff {
+				backoff = q.config.MaxBackoff
+			}
+			metrics.SubmissionRetry(class.String(), metrics.RetryEndorsement)
+		default:
+			return err
+		}
+		if q.sleep(ctx, wait) != nil {
+			return err
+		}
+	}
+}
+
+// acquire takes a slot, waiting behind every submission of a higher or the
+// same class. A submission being retried was admitted before and is queued
+// even if the queue is full.
+func (q *Queue) acquire(ctx context.Context, class Class, admitted bool) error {
+	q.mu.Lock()
+	if q.inFlight < q.config.Workers && q.waitingLocked() == 0 {
+		q.inFlight++
+		q.mu.Unlock()
+		return nil
+	}
+	if !admitted && len(q.waiting[class]) >= q.config.Capacity {
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+	ready := make(chan struct{})
+	q.waiting[class] = append(q.waiting[class], ready)
+	metrics.SubmissionQueueLength(class.String(), len(q.waiting[class]))
+	q.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		for i, r := range q.waiting[class] {
+			if r == ready {
+				q.waiting[class] = append(q.waiting[class][:i:i], q.waiting[class][i+1:]...)
+				metrics.SubmissionQueueLength(class.String(), len(q.waiting[class]))
+				q.mu.Unlock()
+				return ctx.Err()
+			}
+		}
+		q.mu.Unlock()
+		// The slot was handed over as the context ended
+		q.release()
+		return ctx.Err()
+	}
+}
+
+// release hands the slot to the first submission of the highest class
+// waiting, or frees it
+func (q *Queue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for class := range q.waiting {
+		if len(q.waiting[class]) > 0 {
+			close(q.waiting[class][0])
+			q.waiting[class] = q.waiting[class][1:]
+			metrics.SubmissionQueueLength(Class(class).String(), len(q.waiting[class]))
+			return
+		}
+	}
+	q.inFlight--
+}
+
+func (q *Queue) waitingLocked() int {
+	n := 0
+	for _, waiting := range q.waiting {
+		n += len(waiting)
+	}
+	return n
+}
+
+// Waiting returns how many submissions of a class are waiting for a slot
+func (q *Queue) Waiting(class Class) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting[class])
+}
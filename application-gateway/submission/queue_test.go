@@ -0,0 +1,134 @@
+package submission
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestQueue(config Config) (*Queue, *[]time.Duration) {
+	q := New(config)
+	slept := &[]time.Duration{}
+	q.sleep = func(_ context.Context, d time.Duration) error {
+		*slept = append(*slept, d)
+		return nil
+	}
+	return q, slept
+}
+
+func TestSubmitPriority(t *testing.T) {
+	q, _ := newTestQueue(Config{Workers: 1, Capacity: 10})
+	started, finish := make(chan struct{}), make(chan struct{})
+	go q.Submit(context.Background(), Orders, func(context.Context) error {
+		close(started)
+		<-finish
+		return nil
+	})
+	<-started
+
+	var mu sync.Mutex
+	var order []Class
+	var wg sync.WaitGroup
+	for _, class := range []Class{Orders, MeterData, Settlement} {
+		wg.Add(1)
+		go func(class Class) {
+			defer wg.Done()
+			q.Submit(context.Background(), class, func(context.Context) error {
+				mu.Lock()
+				defer mu.Unlock()
+				order = append(order, class)
+				return nil
+			})
+		}(class)
+		for q.Waiting(class) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(finish)
+	wg.Wait()
+	if len(order) != 3 || order[0] != Settlement || order[1] != MeterData || order[2] != Orders {
+		t.Errorf("got order %v, want settlement, meter data, orders", order)
+	}
+}
+
+func TestSubmitQueueFull(t *testing.T) {
+	q, _ := newTestQueue(Config{Workers: 1, Capacity: 1})
+	started, finish := make(chan struct{}), make(chan struct{})
+	go q.Submit(context.Background(), Settlement, func(context.Context) error {
+		close(started)
+		<-finish
+		return nil
+	})
+	<-started
+	done := make(chan error)
+	go func() {
+		done <- q.Submit(context.Background(), MeterData, func(context.Context) error { return nil })
+	}()
+	for q.Waiting(MeterData) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err := q.Submit(context.Background(), MeterData, func(context.Context) error { return nil })
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("got %v, want ErrQueueFull", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.Submit(ctx, Orders, func(context.Context) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v for a cancelled submission, want context.Canceled", err)
+	}
+	close(finish)
+	if err := <-done; err != nil {
+		t.Errorf("queued submission failed: %v", err)
+	}
+	if q.Waiting(Orders) != 0 || q.inFlight != 0 {
+		t.Errorf("got %d waiting and %d in flight after the queue drained", q.Waiting(Orders), q.inFlight)
+	}
+}
+
+func TestSubmitRetries(t *testing.T) {
+	config := Config{Workers: 2, Capacity: 10, MaxAttempts: 3, Backoff: time.Second, MaxBackoff: 3 * time.Second, MaxConflicts: 2, ConflictDelay: time.Millisecond}
+
+	q, slept := newTestQueue(config)
+	attempts := 0
+	err := q.Submit(context.Background(), Settlement, func(context.Context) error {
+		if attempts++; attempts <= 2 {
+			return &CommitFailedError{TransactionID: "tx", Code: peer.TxValidationCode_MVCC_READ_CONFLICT}
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 || len(*slept) != 2 {
+		t.Errorf("got %v after %d attempts and %d sleeps, want success after two conflicts", err, attempts, len(*slept))
+	}
+
+	q, slept = newTestQueue(config)
+	attempts = 0
+	unavailable := status.Error(codes.Unavailable, "no peers")
+	err = q.Submit(context.Background(), Orders, func(context.Context) error {
+		attempts++
+		return unavailable
+	})
+	if err != unavailable || attempts != 3 {
+		t.Errorf("got %v after %d attempts, want the endorsement failure after 3", err, attempts)
+	}
+	if len(*slept) != 2 || (*slept)[0] != time.Second || (*slept)[1] != 2*time.Second {
+		t.Errorf("got backoffs %v, want 1s and 2s", *slept)
+	}
+
+	q, _ = newTestQueue(config)
+	attempts = 0
+	rejected := &CommitFailedError{TransactionID: "tx", Code: peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE}
+	err = q.Submit(context.Background(), Orders, func(context.Context) error {
+		attempts++
+		return rejected
+	})
+	if err != rejected || attempts != 1 {
+		t.Errorf("got %v after %d attempts, want an invalid transaction not to be retried", err, attempts)
+	}
+}
@@ -0,0 +1,349 @@
+// Package telemetry turns the grid operator's SCADA telemetry into the
+// capacity limits the chaincode validates trades between zones against.
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+)
+
+// Invoker is the part of *client.Contract the adapter uses
+type Invoker interface {
+	EvaluateTransaction(name string, args ...string) ([]byte, error)
+	SubmitTransaction(name string, args ...string) ([]byte, error)
+}
+
+// Point names a telemetry value: a DNP3 analog input index, or the reference
+// of an IEC 61850 data attribute such as SUB1LD0/MMXU1.TotW.mag.f
+type Point struct {
+	DNP3     *uint16 `json:"dnp3,omitempty"`
+	IEC61850 string  `json:"iec61850,omitempty"`
+	// Scale converts the raw value to kW; zero means 1
+	Scale float64 `json:"scale,omitempty"`
+}
+
+func (p Point) key() string {
+	if p.DNP3 != nil {
+		return "dnp3:" + strconv.Itoa(int(*p.DNP3))
+	}
+	return "iec61850:" + p.IEC61850
+}
+
+// Zone maps a zone's transformer to its telemetry
+type Zone struct {
+	Zone string `json:"zone"`
+	// Load is the active power flowing into the zone through its feeder, in
+	// kW; it is negative while the zone exports
+	Load Point `json:"load"`
+	// Limit is the transformer's dynamic rating in kW. Without it the static
+	// LimitKW is used.
+	Limit   *Point  `json:"limit,omitempty"`
+	LimitKW float64 `json:"limitKW,omitempty"`
+}
+
+// PointMap is the adapter's configuration file: the DNP3 outstation to poll,
+// if any, and the points of each zone
+type PointMap struct {
+	DNP3  *DNP3Config `json:"dnp3,omitempty"`
+	Zones []Zone      `json:"zones"`
+}
+
+// LoadPointMap reads and checks the point map at path
+func LoadPointMap(path string) (*PointMap, error) {
+	pointMapJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pointMap PointMap
+	if err := json.Unmarshal(pointMapJSON, &pointMap); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for _, zone := range pointMap.Zones {
+		points := []Point{zone.Load}
+		if zone.Limit != nil {
+			points = append(points, *zone.Limit)
+		} else if zone.LimitKW <= 0 {
+			return nil, fmt.Errorf("zone %s needs a limit point or a positive limitKW", zone.Zone)
+		}
+		for _, point := range points {
+			if (point.DNP3 == nil) == (point.IEC61850 == "") {
+				return nil, fmt.Errorf("each point of zone %s needs exactly one of dnp3 and iec61850", zone.Zone)
+			}
+			if point.DNP3 != nil && pointMap.DNP3 == nil {
+				return nil, fmt.Errorf("zone %s uses a DNP3 point but no outstation is configured", zone.Zone)
+			}
+		}
+	}
+	return &pointMap, nil
+}
+
+// Config controls how telemetry becomes capacity limits
+type Config struct {
+	// Interval is the meter interval limits are posted for
+	Interval time.Duration
+	// Horizon is how many intervals, from the current one, limits are posted
+	// for. Later intervals get the current conditions too.
+	Horizon int
+	// PollInterval is how often DNP3 is polled and limits are updated
+	PollInterval time.Duration
+	// MaxAge is how old a value may be before a zone's limits are left as
+	// they were
+	MaxAge time.Duration
+	// Margin is the share of a transformer's rating kept in reserve
+	Margin float64
+	// Deadband is the share of the usable rating a limit must move by before
+	// it is posted again
+	Deadband float64
+}
+
+// DefaultConfig returns the configuration for 15 minute meter intervals
+func DefaultConfig() Config {
+	return Config{
+		Interval:     15 * time.Minute,
+		Horizon:      4,
+		PollInterval: 30 * time.Second,
+		MaxAge:       2 * time.Minute,
+		Margin:       0.1,
+		Deadband:     0.05,
+	}
+}
+
+// sample is a telemetry value and when it arrived
+type sample struct {
+	value float64
+	at    time.Time
+}
+
+// Values holds the latest value of each point
+type Values struct {
+	mu      sync.Mutex
+	samples map[string]sample
+}
+
+// SetDNP3 records a DNP3 analog input
+func (v *Values) SetDNP3(index uint16, value float64, at time.Time) {
+	v.set("dnp3:"+strconv.Itoa(int(index)), value, at)
+}
+
+// SetIEC61850 records an IEC 61850 data attribute
+func (v *Values) SetIEC61850(reference string, value float64, at time.Time) {
+	v.set("iec61850:"+reference, value, at)
+}
+
+func (v *Values) set(key string, value float64, at time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.samples == nil {
+		v.samples = map[string]sample{}
+	}
+	if last, ok := v.samples[key]; !ok || !at.Before(last.at) {
+		v.samples[key] = sample{value, at}
+	}
+}
+
+// kW returns a point's scaled value, if one arrived after since
+func (v *Values) kW(p Point, since time.Time) (float64, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.samples[p.key()]
+	if !ok || s.at.Before(since) {
+		return 0, false
+	}
+	if p.Scale != 0 {
+		return s.value * p.Scale, true
+	}
+	return s.value, true
+}
+
+// zoneFlow is the part of the chaincode's ZoneFlow the adapter reads
+type zoneFlow struct {
+	Export float64 `json:"export"`
+	Import float64 `json:"import"`
+}
+
+// transformerLoad is the load the chaincode's confirmed trades schedule on a
+// zone's transformer in one interval, against its registered rating
+type transformerLoad struct {
+	ScheduledLoad float64 `json:"scheduledLoad"`
+	Rating        float64 `json:"rating"`
+	Utilization   float64 `json:"utilization"`
+}
+
+// limits are the capacity limits of a zone in kWh per interval
+type limits struct {
+	Export float64
+	Import float64
+}
+
+// Adapter posts each zone's capacity limits with SetGridCapacity as the
+// grid operator. The measured feeder flow includes the trades scheduled in
+// the current interval, so the adapter backs them out to find the zone's
+// background flow, and leaves the usable rating on either side of it to
+// trades: exports may take the flow from the background down to the rating
+// in reverse, imports from the background up to the rating.
+type Adapter struct {
+	contract Invoker
+	config   Config
+	zones    []Zone
+	values   *Values
+	now      func() time.Time
+	// posted are the limits last posted, by zone and interval start
+	posted map[string]map[string]limits
+}
+
+// New returns an adapter posting the limits of zones to contract
+func New(contract Invoker, config Config, zones []Zone) *Adapter {
+	return &Adapter{
+		contract: contract,
+		config:   config,
+		zones:    zones,
+		values:   &Values{},
+		now:      time.Now,
+		posted:   map[string]map[string]limits{},
+	}
+}
+
+// Values returns the values the adapter's limits are computed from
+func (a *Adapter) Values() *Values {
+	return a.values
+}
+
+// Run polls the DNP3 outstation, if dnp3 is not nil, and updates the limits
+// every PollInterval until ctx is done
+func (a *Adapter) Run(ctx context.Context, dnp3 *DNP3Client) error {
+	ticker := time.NewTicker(a.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		if dnp3 != nil {
+			inputs, err := dnp3.ReadAnalogInputs()
+			if err != nil {
+				log.Printf("Polling DNP3 outstation failed: %v", err)
+			}
+			now := a.now()
+			for index, value := range inputs {
+				a.values.SetDNP3(index, value, now)
+			}
+		}
+		a.Update()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Update posts the limits of every zone whose telemetry is current for the
+// intervals of the horizon. Limits within the deadband of those last posted
+// are not posted again. A zone whose telemetry is stale keeps its limits.
+func (a *Adapter) Update() {
+	now := a.now()
+	current := now.Truncate(a.config.Interval)
+	for _, zone := range a.zones {
+		a.reportLoad(zone, current)
+		background, usable, err := a.measure(zone, now, current)
+		if err != nil {
+			log.Printf("Limits of zone %s not updated: %v", zone.Zone, err)
+			continue
+		}
+		intervalHours := a.config.Interval.Hours()
+		next := limits{
+			Export: roundKWh(math.Max(0, usable+background) * intervalHours),
+			Import: roundKWh(math.Max(0, usable-background) * intervalHours),
+		}
+		deadband := a.config.Deadband * usable * intervalHours
+
+		posted := a.posted[zone.Zone]
+		if posted == nil {
+			posted = map[string]limits{}
+			a.posted[zone.Zone] = posted
+		}
+		for start := range posted {
+			if parseInterval(start).Before(current) {
+				delete(posted, start)
+			}
+		}
+		for i := 0; i < a.config.Horizon; i++ {
+			start := current.Add(time.Duration(i) * a.config.Interval).UTC().Format(time.RFC3339)
+			if last, ok := posted[start]; ok && math.Abs(next.Export-last.Export) <= deadband && math.Abs(next.Import-last.Import) <= deadband {
+				continue
+			}
+			_, err := a.contract.SubmitTransaction("SetGridCapacity", zone.Zone, start,
+				strconv.FormatFloat(next.Export, 'f', -1, 64), strconv.FormatFloat(next.Import, 'f', -1, 64))
+			if err != nil {
+				log.Printf("Limits of zone %s for %s not posted: %v", zone.Zone, start, fabric.ErrorWithDetails(err))
+				continue
+			}
+			posted[start] = next
+		}
+		metrics.GridHeadroom(zone.Zone, next.Export, next.Import)
+	}
+}
+
+// reportLoad exports the utilization of a zone's transformer by the trades
+// scheduled in the current interval, if the zone has a registered transformer
+func (a *Adapter) reportLoad(zone Zone, current time.Time) {
+	loadJSON, err := a.contract.EvaluateTransaction("GetTransformerLoad", zone.Zone, current.UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Printf("Transformer load of zone %s not read: %v", zone.Zone, fabric.ErrorWithDetails(err))
+		return
+	}
+	var load transformerLoad
+	if err := json.Unmarshal(loadJSON, &load); err != nil {
+		log.Printf("Transformer load of zone %s not read: %v", zone.Zone, err)
+		return
+	}
+	if load.Rating > 0 {
+		metrics.TransformerUtilization(zone.Zone, load.Utilization)
+	}
+}
+
+// measure returns a zone's background flow into the zone and its usable
+// rating, both in kW
+func (a *Adapter) measure(zone Zone, now, current time.Time) (background, usable float64, err error) {
+	since := now.Add(-a.config.MaxAge)
+	load, ok := a.values.kW(zone.Load, since)
+	if !ok {
+		return 0, 0, errors.New("no current feeder load")
+	}
+	rating := zone.LimitKW
+	if zone.Limit != nil {
+		if rating, ok = a.values.kW(*zone.Limit, since); !ok {
+			return 0, 0, errors.New("no current transformer rating")
+		}
+	}
+
+	flowJSON, err := a.contract.EvaluateTransaction("GetZoneFlow", zone.Zone, current.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, 0, fabric.ErrorWithDetails(err)
+	}
+	var flow zoneFlow
+	if err := json.Unmarshal(flowJSON, &flow); err != nil {
+		return 0, 0, err
+	}
+	intervalHours := a.config.Interval.Hours()
+	background = load - (flow.Import-flow.Export)/intervalHours
+	return background, math.Max(0, rating*(1-a.config.Margin)), nil
+}
+
+// roundKWh rounds to Wh precision
+func roundKWh(kWh float64) float64 {
+	return math.Round(kWh*1000) / 1000
+}
+
+func parseInterval(start string) time.Time {
+	t, _ := time.Parse(time.RFC3339, start)
+	return t
+}
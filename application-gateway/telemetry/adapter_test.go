@@ -0,0 +1,103 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeContract serves zone flows and transformer loads and records the
+// limits posted
+type fakeContract struct {
+	flows  map[string]zoneFlow
+	loads  map[string]transformerLoad
+	posted []string
+}
+
+func (f *fakeContract) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	if name == "GetTransformerLoad" {
+		return json.Marshal(f.loads[args[0]+" "+args[1]])
+	}
+	return json.Marshal(f.flows[args[0]+" "+args[1]])
+}
+
+func (f *fakeContract) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	f.posted = append(f.posted, strings.Join(args, " "))
+	return nil, nil
+}
+
+func TestUpdate(t *testing.T) {
+	feeder, rating := uint16(0), uint16(1)
+	zones := []Zone{
+		{Zone: "zone1", Load: Point{DNP3: &feeder}, LimitKW: 500},
+		{Zone: "zone2", Load: Point{IEC61850: "SUB2LD0/MMXU1.TotW.mag.f", Scale: 0.001}, Limit: &Point{DNP3: &rating}},
+	}
+	contract := &fakeContract{flows: map[string]zoneFlow{
+		"zone1 2025-05-01T08:00:00Z": {Import: 10},
+	}}
+	now := time.Date(2025, 5, 1, 8, 5, 0, 0, time.UTC)
+	config := DefaultConfig()
+	config.Horizon = 2
+	adapter := New(contract, config, zones)
+	adapter.now = func() time.Time { return now }
+
+	// zone1 draws 100 kW, 40 kW of it traded, so 60 kW is background load
+	// under the 450 kW usable rating. zone2 has no current load.
+	adapter.Values().SetDNP3(feeder, 100, now)
+	adapter.Values().SetDNP3(rating, 800, now)
+	adapter.Update()
+	want := []string{
+		"zone1 2025-05-01T08:00:00Z 127.5 97.5",
+		"zone1 2025-05-01T08:15:00Z 127.5 97.5",
+	}
+	if !reflect.DeepEqual(contract.posted, want) {
+		t.Fatalf("got limits %v, want %v", contract.posted, want)
+	}
+
+	// With no trades in the next interval, a 62 kW load is within the
+	// deadband, so only the interval entering the horizon is posted
+	now = time.Date(2025, 5, 1, 8, 16, 0, 0, time.UTC)
+	adapter.Values().SetDNP3(feeder, 62, now)
+	adapter.Update()
+	if want = append(want, "zone1 2025-05-01T08:30:00Z 128 97"); !reflect.DeepEqual(contract.posted, want) {
+		t.Fatalf("got limits %v, want %v", contract.posted, want)
+	}
+
+	// zone2 exports 200 kW against a 720 kW usable rating
+	server := httptest.NewServer(adapter.Handler("secret"))
+	defer server.Close()
+	body := `[{"reference": "SUB2LD0/MMXU1.TotW.mag.f", "value": -200000}]`
+	response, err := http.Post(server.URL+"/iec61850", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d without the token", response.StatusCode)
+	}
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/iec61850", strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer secret")
+	if response, err = http.DefaultClient.Do(request); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d", response.StatusCode)
+	}
+
+	// The rating read at 08:05 is stale at 08:16
+	adapter.Update()
+	if len(contract.posted) != 3 {
+		t.Fatalf("got limits %v from stale telemetry", contract.posted)
+	}
+	adapter.Values().SetDNP3(rating, 800, now)
+	adapter.Update()
+	want = append(want, "zone2 2025-05-01T08:15:00Z 130 230", "zone2 2025-05-01T08:30:00Z 130 230")
+	if !reflect.DeepEqual(contract.posted, want) {
+		t.Errorf("got limits %v, want %v", contract.posted, want)
+	}
+}
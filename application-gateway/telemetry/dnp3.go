@@ -0,0 +1,325 @@
+package telemetry
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNP3 link layer constants
+const (
+	dnp3Start1       = 0x05
+	dnp3Start2       = 0x64
+	dnp3BlockSize    = 16
+	dnp3LinkHeader   = 10
+	dnp3PrimaryData  = 0xC4 // DIR, PRM, UNCONFIRMED_USER_DATA
+	dnp3FunctionMask = 0x0F
+	dnp3UserData     = 0x04
+)
+
+// DNP3 application layer constants
+const (
+	dnp3Confirm          = 0x00
+	dnp3Read             = 0x01
+	dnp3Response         = 0x81
+	dnp3Unsolicited      = 0x82
+	dnp3FIR              = 0x80
+	dnp3FIN              = 0x40
+	dnp3CON              = 0x20
+	dnp3GroupAnalogInput = 30
+)
+
+// DNP3Config locates an outstation
+type DNP3Config struct {
+	Address    string `json:"address"`
+	Master     uint16 `json:"master"`
+	Outstation uint16 `json:"outstation"`
+}
+
+// DNP3Client is a DNP3 master over TCP that reads analog inputs, such as
+// feeder loads and dynamic transformer ratings, with static reads of group
+// 30. It only supports what polling analog inputs needs: no controls, no
+// event classes and no secure authentication.
+type DNP3Client struct {
+	config  DNP3Config
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	seq  byte
+}
+
+// NewDNP3Client returns a client that connects on first use
+func NewDNP3Client(config DNP3Config) *DNP3Client {
+	return &DNP3Client{config: config, timeout: 10 * time.Second}
+}
+
+// Close closes the connection
+func (c *DNP3Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// ReadAnalogInputs reads all analog inputs of the outstation by index. The
+// connection is dropped after an error and reopened by the next read.
+func (c *DNP3Client) ReadAnalogInputs() (map[uint16]float64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.config.Address, c.timeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	values, err := c.readAnalogInputs()
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return values, err
+}
+
+func (c *DNP3Client) readAnalogInputs() (map[uint16]float64, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	seq := c.seq
+	c.seq = (c.seq + 1) & 0x0F
+	// READ group 30 variation 0 (any), qualifier 0x06 (all points)
+	request := []byte{dnp3FIR | dnp3FIN | seq, dnp3Read, dnp3GroupAnalogInput, 0, 0x06}
+	if err := c.writeFragment(request); err != nil {
+		return nil, err
+	}
+
+	values := map[uint16]float64{}
+	for {
+		fragment, err := c.readFragment()
+		if err != nil {
+			return nil, err
+		}
+		if len(fragment) < 4 {
+			return nil, errors.New("dnp3: short application fragment")
+		}
+		control, function := fragment[0], fragment[1]
+		if function == dnp3Unsolicited {
+			continue
+		}
+		if function != dnp3Response || control&0x0F != seq {
+			return nil, fmt.Errorf("dnp3: unexpected function %#x with sequence %d", function, control&0x0F)
+		}
+		if control&dnp3CON != 0 {
+			if err := c.writeFragment([]byte{dnp3FIR | dnp3FIN | control&0x0F, dnp3Confirm}); err != nil {
+				return nil, err
+			}
+		}
+		// fragment[2:4] are the internal indications
+		if err := parseAnalogInputs(fragment[4:], values); err != nil {
+			return nil, err
+		}
+		if control&dnp3FIN != 0 {
+			return values, nil
+		}
+		seq = (seq + 1) & 0x0F
+	}
+}
+
+// writeFragment sends an application fragment in a single transport segment
+func (c *DNP3Client) writeFragment(fragment []byte) error {
+	segment := append([]byte{dnp3FIR | dnp3FIN}, fragment...)
+	_, err := c.conn.Write(encodeLinkFrame(dnp3PrimaryData, c.config.Outstation, c.config.Master, segment))
+	return err
+}
+
+// readFragment reassembles an application fragment from transport segments
+func (c *DNP3Client) readFragment() ([]byte, error) {
+	var fragment []byte
+	for {
+		control, _, source, data, err := decodeLinkFrame(c.conn)
+		if err != nil {
+			return nil, err
+		}
+		if control&dnp3FunctionMask != dnp3UserData || source != c.config.Outstation || len(data) == 0 {
+			continue
+		}
+		header := data[0]
+		if header&dnp3FIR != 0 {
+			fragment = nil
+		}
+		fragment = append(fragment, data[1:]...)
+		if header&dnp3FIN != 0 {
+			return fragment, nil
+		}
+	}
+}
+
+// analogInputSizes are the sizes of group 30 points by variation
+var analogInputSizes = map[byte]int{1: 5, 2: 3, 3: 4, 4: 2, 5: 5, 6: 9}
+
+// parseAnalogInputs decodes the group 30 objects of a response
+func parseAnalogInputs(objects []byte, values map[uint16]float64) error {
+	for len(objects) > 0 {
+		if len(objects) < 3 {
+			return errors.New("dnp3: truncated object header")
+		}
+		group, variation, qualifier := objects[0], objects[1], objects[2]
+		objects = objects[3:]
+		size, ok := analogInputSizes[variation]
+		if group != dnp3GroupAnalogInput || !ok {
+			return fmt.Errorf("dnp3: unsupported object group %d variation %d", group, variation)
+		}
+
+		var indexes []uint16
+		prefix := 0
+		switch qualifier {
+		case 0x00, 0x01:
+			width := int(qualifier) + 1
+			if len(objects) < 2*width {
+				return errors.New("dnp3: truncated range")
+			}
+			start, stop := readUint(objects[:width]), readUint(objects[width:2*width])
+			objects = objects[2*width:]
+			if stop < start {
+				return errors.New("dnp3: invalid range")
+			}
+			for index := start; index <= stop; index++ {
+				indexes = append(indexes, uint16(index))
+			}
+		case 0x17, 0x28:
+			width := 1
+			if qualifier == 0x28 {
+				width = 2
+			}
+			if len(objects) < width {
+				return errors.New("dnp3: truncated count")
+			}
+			count := readUint(objects[:width])
+			objects = objects[width:]
+			indexes = make([]uint16, count)
+			prefix = width
+		default:
+			return fmt.Errorf("dnp3: unsupported qualifier %#x", qualifier)
+		}
+
+		for i := range indexes {
+			if len(objects) < prefix+size {
+				return errors.New("dnp3: truncated analog input")
+			}
+			if prefix > 0 {
+				indexes[i] = uint16(readUint(objects[:prefix]))
+			}
+			values[indexes[i]] = analogValue(variation, objects[prefix:prefix+size])
+			objects = objects[prefix+size:]
+		}
+	}
+	return nil
+}
+
+// analogValue decodes a point, skipping the flag octet of variations with one
+func analogValue(variation byte, point []byte) float64 {
+	switch variation {
+	case 1:
+		return float64(int32(binary.LittleEndian.Uint32(point[1:])))
+	case 2:
+		return float64(int16(binary.LittleEndian.Uint16(point[1:])))
+	case 3:
+		return float64(int32(binary.LittleEndian.Uint32(point)))
+	case 4:
+		return float64(int16(binary.LittleEndian.Uint16(point)))
+	case 5:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(point[1:])))
+	default:
+		return math.Float64frombits(binary.LittleEndian.Uint64(point[1:]))
+	}
+}
+
+func readUint(b []byte) int {
+	value := 0
+	for i := len(b) - 1; i >= 0; i-- {
+		value = value<<8 | int(b[i])
+	}
+	return value
+}
+
+// encodeLinkFrame wraps user data in a link layer frame, with a CRC after
+// the header and after every 16 octets of data
+func encodeLinkFrame(control byte, destination, source uint16, data []byte) []byte {
+	header := []byte{dnp3Start1, dnp3Start2, byte(5 + len(data)), control, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(header[4:], destination)
+	binary.LittleEndian.PutUint16(header[6:], source)
+	frame := appendCRC(header)
+	for len(data) > 0 {
+		n := min(len(data), dnp3BlockSize)
+		frame = append(frame, appendCRC(append([]byte{}, data[:n]...))...)
+		data = data[n:]
+	}
+	return frame
+}
+
+// decodeLinkFrame reads a link layer frame and checks its CRCs
+func decodeLinkFrame(r io.Reader) (control byte, destination, source uint16, data []byte, err error) {
+	header := make([]byte, dnp3LinkHeader)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	if header[0] != dnp3Start1 || header[1] != dnp3Start2 || header[2] < 5 {
+		err = errors.New("dnp3: invalid link frame header")
+		return
+	}
+	if !checkCRC(header) {
+		err = errors.New("dnp3: link header CRC mismatch")
+		return
+	}
+	control = header[3]
+	destination = binary.LittleEndian.Uint16(header[4:])
+	source = binary.LittleEndian.Uint16(header[6:])
+	remaining := int(header[2]) - 5
+	for remaining > 0 {
+		n := min(remaining, dnp3BlockSize)
+		block := make([]byte, n+2)
+		if _, err = io.ReadFull(r, block); err != nil {
+			return
+		}
+		if !checkCRC(block) {
+			err = errors.New("dnp3: data block CRC mismatch")
+			return
+		}
+		data = append(data, block[:n]...)
+		remaining -= n
+	}
+	return
+}
+
+// crc16 is the DNP3 CRC: polynomial 0x3D65, reflected, complemented
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA6BC
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
+
+func appendCRC(block []byte) []byte {
+	return binary.LittleEndian.AppendUint16(block, crc16(block))
+}
+
+func checkCRC(block []byte) bool {
+	n := len(block) - 2
+	return binary.LittleEndian.Uint16(block[n:]) == crc16(block[:n])
+}
@@ -0,0 +1,80 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestLinkFrameCRC(t *testing.T) {
+	// Reset link states from master 1024 to outstation 1
+	want := []byte{0x05, 0x64, 0x05, 0xC0, 0x01, 0x00, 0x00, 0x04, 0xE9, 0x21}
+	if frame := encodeLinkFrame(0xC0, 1, 1024, nil); !bytes.Equal(frame, want) {
+		t.Errorf("got frame % X, want % X", frame, want)
+	}
+}
+
+// outstation answers one read of analog inputs with two fragments, the first
+// of which asks for confirmation
+func outstation(t *testing.T, listener net.Listener) {
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	_, destination, source, data, err := decodeLinkFrame(conn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if destination != 10 || source != 1 || !bytes.Equal(data[2:], []byte{dnp3Read, 30, 0, 0x06}) {
+		t.Errorf("got request % X from %d to %d", data, source, destination)
+		return
+	}
+	seq := data[1] & 0x0F
+	send := func(transport byte, fragment []byte) {
+		conn.Write(encodeLinkFrame(0x44, 1, 10, append([]byte{transport}, fragment...)))
+	}
+
+	// Float inputs 0 and 1 by range, split over two transport segments
+	first := []byte{dnp3FIR | dnp3CON | seq, dnp3Response, 0, 0, 30, 5, 0x00, 0, 1}
+	for _, value := range []float32{412.5, -80} {
+		first = append(first, 0x01)
+		first = binary.LittleEndian.AppendUint32(first, math.Float32bits(value))
+	}
+	send(dnp3FIR, first[:12])
+	send(dnp3FIN|1, first[12:])
+	_, _, _, confirm, err := decodeLinkFrame(conn)
+	if err != nil || !bytes.Equal(confirm[1:], []byte{dnp3FIR | dnp3FIN | seq, dnp3Confirm}) {
+		t.Errorf("got confirm % X: %v", confirm, err)
+		return
+	}
+
+	// A 32-bit input by index
+	second := []byte{dnp3FIN | (seq+1)&0x0F, dnp3Response, 0, 0, 30, 1, 0x28, 1, 0, 7, 0, 0x01}
+	second = binary.LittleEndian.AppendUint32(second, uint32(630))
+	send(dnp3FIR|dnp3FIN|2, second)
+}
+
+func TestReadAnalogInputs(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go outstation(t, listener)
+
+	client := NewDNP3Client(DNP3Config{Address: listener.Addr().String(), Master: 1, Outstation: 10})
+	defer client.Close()
+	values, err := client.ReadAnalogInputs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[uint16]float64{0: 412.5, 1: -80, 7: 630}; !reflect.DeepEqual(values, want) {
+		t.Errorf("got values %v, want %v", values, want)
+	}
+}
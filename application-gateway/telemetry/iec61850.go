@@ -0,0 +1,52 @@
+package telemetry
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Report is a data attribute value from an IEC 61850 gateway. Substation
+// gateways read the MMS reports of the IEDs and forward the values, keyed by
+// their object reference, as JSON.
+type Report struct {
+	Reference string    `json:"reference"`
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Handler returns the route IEC 61850 gateways post reports to, POST
+// /iec61850, with a JSON array of reports. token, if not empty, is the bearer
+// token gateways must present. Reports without a timestamp are taken as of
+// their arrival.
+func (a *Adapter) Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /iec61850", func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var reports []Report
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&reports); err != nil {
+			http.Error(w, "invalid reports: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := a.now()
+		for _, report := range reports {
+			if report.Reference == "" {
+				http.Error(w, "every report needs a reference", http.StatusBadRequest)
+				return
+			}
+		}
+		for _, report := range reports {
+			at := report.Timestamp
+			if at.IsZero() || at.After(now) {
+				at = now
+			}
+			a.values.SetIEC61850(report.Reference, report.Value, at)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
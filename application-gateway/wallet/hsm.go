@@ -0,0 +1,77 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// HSMKey locates an identity's private key in a PKCS#11 token instead of the
+// wallet. Identifier is the hex CKA_ID of the key; left out, it is the
+// subject key identifier Fabric tools give keys they generate, the SHA-256
+// of the certificate's uncompressed public key point.
+type HSMKey struct {
+	Label      string `json:"label"`
+	Identifier string `json:"identifier,omitempty"`
+}
+
+// HSMConfig is the PKCS#11 library the wallet signs HSM identities with, and
+// the user PIN of its tokens
+type HSMConfig struct {
+	Library string
+	Pin     string
+}
+
+// UseHSM lets identities loaded from the wallet sign with keys in PKCS#11
+// tokens. Without it, identities with an HSM key fail to sign, and
+// identities with their key in the wallet are unaffected. It needs a build
+// with the pkcs11 tag.
+func (w *Wallet) UseHSM(config HSMConfig) error {
+	if config.Library == "" || config.Pin == "" {
+		return fmt.Errorf("the HSM needs a PKCS#11 library and a PIN")
+	}
+	signers, err := newHSMSigners(config)
+	if err != nil {
+		return err
+	}
+	w.hsm = signers
+	return nil
+}
+
+// Close releases the wallet's HSM sessions, if it has any
+func (w *Wallet) Close() {
+	if w.hsm != nil {
+		w.hsm.close()
+	}
+}
+
+// ImportHSM stores a certificate under label with its private key in a
+// PKCS#11 token
+func (w *Wallet) ImportHSM(label, mspID, certPath string, key HSMKey) error {
+	certificate, err := os.ReadFile(certPath)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate file: %w", err)
+	}
+	return w.Put(&Identity{Label: label, MSPID: mspID, Certificate: string(certificate), HSM: &key})
+}
+
+// hsmIdentifier returns the CKA_ID of an HSM key
+func hsmIdentifier(key *HSMKey, certificate *x509.Certificate) (string, error) {
+	if key.Identifier != "" {
+		identifier, err := hex.DecodeString(key.Identifier)
+		if err != nil {
+			return "", fmt.Errorf("HSM key identifier must be hex: %w", err)
+		}
+		return string(identifier), nil
+	}
+	publicKey, ok := certificate.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("HSM keys must be ECDSA keys")
+	}
+	ski := sha256.Sum256(elliptic.Marshal(publicKey.Curve, publicKey.X, publicKey.Y))
+	return string(ski[:]), nil
+}
@@ -0,0 +1,61 @@
+//go:build pkcs11
+
+package wallet
+
+import (
+	"crypto/x509"
+	"sync"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+// hsmSigners opens one signer per HSM key on first use and keeps it, since
+// each holds a logged in session with the token
+type hsmSigners struct {
+	factory *identity.HSMSignerFactory
+	pin     string
+
+	mu      sync.Mutex
+	signers map[HSMKey]hsmSigner
+}
+
+type hsmSigner struct {
+	sign  identity.Sign
+	close identity.HSMSignClose
+}
+
+func newHSMSigners(config HSMConfig) (*hsmSigners, error) {
+	factory, err := identity.NewHSMSignerFactory(config.Library)
+	if err != nil {
+		return nil, err
+	}
+	return &hsmSigners{factory: factory, pin: config.Pin, signers: map[HSMKey]hsmSigner{}}, nil
+}
+
+func (h *hsmSigners) signer(key *HSMKey, certificate *x509.Certificate) (identity.Sign, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if signer, ok := h.signers[*key]; ok {
+		return signer.sign, nil
+	}
+	identifier, err := hsmIdentifier(key, certificate)
+	if err != nil {
+		return nil, err
+	}
+	sign, closeSigner, err := h.factory.NewHSMSigner(identity.HSMSignerOptions{Label: key.Label, Pin: h.pin, Identifier: identifier})
+	if err != nil {
+		return nil, err
+	}
+	h.signers[*key] = hsmSigner{sign: sign, close: closeSigner}
+	return sign, nil
+}
+
+func (h *hsmSigners) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, signer := range h.signers {
+		signer.close() //#nosec G104 -- the sessions are finished with either way
+		delete(h.signers, key)
+	}
+	h.factory.Dispose()
+}
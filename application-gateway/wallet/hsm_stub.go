@@ -0,0 +1,26 @@
+//go:build !pkcs11
+
+package wallet
+
+import (
+	"crypto/x509"
+	"errors"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+// ErrNoPKCS11 is returned by UseHSM in builds without the pkcs11 tag, which
+// need no cgo or PKCS#11 library and sign only with keys in the wallet
+var ErrNoPKCS11 = errors.New("this build has no PKCS#11 support, rebuild with -tags pkcs11")
+
+type hsmSigners struct{}
+
+func newHSMSigners(HSMConfig) (*hsmSigners, error) {
+	return nil, ErrNoPKCS11
+}
+
+func (h *hsmSigners) signer(*HSMKey, *x509.Certificate) (identity.Sign, error) {
+	return nil, ErrNoPKCS11
+}
+
+func (h *hsmSigners) close() {}
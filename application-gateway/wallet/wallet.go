@@ -0,0 +1,254 @@
+// Package wallet stores Fabric client identities as JSON files in a directory,
+// one file per identity label.
+package wallet
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+const fileSuffix = ".id"
+
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]*$`)
+
+// Certificate attributes the chaincode reads: the participant's role and
+// address
+const (
+	RoleAttribute    = "energy.role"
+	AddressAttribute = "energy.address"
+)
+
+// attributesOID is the certificate extension the Fabric CA stores attributes
+// in, as the JSON object {"attrs": {...}}
+var attributesOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// Identity is an X.509 identity with its PEM encoded certificate and either
+// its PEM encoded private key or the location of the key in an HSM
+type Identity struct {
+	Label       string  `json:"label"`
+	MSPID       string  `json:"mspID"`
+	Certificate string  `json:"certificate"`
+	PrivateKey  string  `json:"privateKey,omitempty"`
+	HSM         *HSMKey `json:"hsm,omitempty"`
+
+	hsm *hsmSigners
+}
+
+// Wallet is a directory of identity files
+type Wallet struct {
+	dir string
+	hsm *hsmSigners
+}
+
+// New opens the wallet in dir, creating the directory if needed
+func New(dir string) (*Wallet, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create wallet directory: %w", err)
+	}
+	return &Wallet{dir: dir}, nil
+}
+
+func (w *Wallet) path(label string) (string, error) {
+	if !labelPattern.MatchString(label) {
+		return "", fmt.Errorf("invalid identity label %q", label)
+	}
+	return filepath.Join(w.dir, label+fileSuffix), nil
+}
+
+// Put stores an identity, replacing any identity with the same label
+func (w *Wallet) Put(id *Identity) error {
+	path, err := w.path(id.Label)
+	if err != nil {
+		return err
+	}
+	if _, err := identity.CertificateFromPEM([]byte(id.Certificate)); err != nil {
+		return fmt.Errorf("invalid certificate: %w", err)
+	}
+	if id.HSM != nil {
+		if id.PrivateKey != "" {
+			return fmt.Errorf("identity %s has both a private key and an HSM key", id.Label)
+		}
+		if id.HSM.Label == "" {
+			return fmt.Errorf("HSM key of identity %s has no token label", id.Label)
+		}
+	} else if _, err := identity.PrivateKeyFromPEM([]byte(id.PrivateKey)); err != nil {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+	idJSON, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, idJSON, 0o600)
+}
+
+// Get loads the identity with the given label
+func (w *Wallet) Get(label string) (*Identity, error) {
+	path, err := w.path(label)
+	if err != nil {
+		return nil, err
+	}
+	idJSON, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("identity %s is not in the wallet", label)
+		}
+		return nil, fmt.Errorf("failed to read identity %s: %w", label, err)
+	}
+	var id Identity
+	if err := json.Unmarshal(idJSON, &id); err != nil {
+		return nil, fmt.Errorf("failed to parse identity %s: %w", label, err)
+	}
+	id.hsm = w.hsm
+	return &id, nil
+}
+
+// Exists reports whether an identity is in the wallet
+func (w *Wallet) Exists(label string) (bool, error) {
+	path, err := w.path(label)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete removes an identity from the wallet
+func (w *Wallet) Delete(label string) error {
+	path, err := w.path(label)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("identity %s is not in the wallet", label)
+		}
+		return fmt.Errorf("failed to delete identity %s: %w", label, err)
+	}
+	return nil
+}
+
+// List returns the labels of all identities in the wallet, sorted
+func (w *Wallet) List() ([]string, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wallet directory: %w", err)
+	}
+	labels := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), fileSuffix) {
+			labels = append(labels, strings.TrimSuffix(entry.Name(), fileSuffix))
+		}
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
+
+// Import reads a certificate and the first key in a keystore directory, as
+// laid out by the Fabric CA client and cryptogen, and stores them under label.
+func (w *Wallet) Import(label, mspID, certPath, keystoreDir string) error {
+	certificate, err := os.ReadFile(certPath)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate file: %w", err)
+	}
+	files, err := os.ReadDir(keystoreDir)
+	if err != nil {
+		return fmt.Errorf("failed to read private key directory: %w", err)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("private key directory %s is empty", keystoreDir)
+	}
+	privateKey, err := os.ReadFile(filepath.Join(keystoreDir, files[0].Name()))
+	if err != nil {
+		return fmt.Errorf("failed to read private key file: %w", err)
+	}
+	return w.Put(&Identity{
+		Label:       label,
+		MSPID:       mspID,
+		Certificate: string(certificate),
+		PrivateKey:  string(privateKey),
+	})
+}
+
+// X509Identity returns the gateway identity and signer of a wallet identity.
+// An identity with an HSM key signs in the HSM, which the wallet it was
+// loaded from must use.
+func (id *Identity) X509Identity() (*identity.X509Identity, identity.Sign, error) {
+	certificate, err := identity.CertificateFromPEM([]byte(id.Certificate))
+	if err != nil {
+		return nil, nil, err
+	}
+	x509Identity, err := identity.NewX509Identity(id.MSPID, certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	if id.HSM != nil {
+		if id.hsm == nil {
+			return nil, nil, fmt.Errorf("identity %s keeps its key in an HSM, but the wallet has no HSM configured", id.Label)
+		}
+		sign, err := id.hsm.signer(id.HSM, certificate)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open the HSM key of identity %s: %w", id.Label, err)
+		}
+		return x509Identity, sign, nil
+	}
+	privateKey, err := identity.PrivateKeyFromPEM([]byte(id.PrivateKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	sign, err := identity.NewPrivateKeySign(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return x509Identity, sign, nil
+}
+
+// Address returns the energy.address attribute of the identity's
+// certificate, the address the chaincode knows the identity by
+func (id *Identity) Address() (string, error) {
+	return id.attribute(AddressAttribute)
+}
+
+// Role returns the energy.role attribute of the identity's certificate
+func (id *Identity) Role() (string, error) {
+	return id.attribute(RoleAttribute)
+}
+
+func (id *Identity) attribute(name string) (string, error) {
+	certificate, err := identity.CertificateFromPEM([]byte(id.Certificate))
+	if err != nil {
+		return "", err
+	}
+	return certificateAttribute(certificate, id.Label, name)
+}
+
+func certificateAttribute(certificate *x509.Certificate, label, name string) (string, error) {
+	for _, extension := range certificate.Extensions {
+		if !extension.Id.Equal(attributesOID) {
+			continue
+		}
+		var attributes struct {
+			Attrs map[string]string `json:"attrs"`
+		}
+		if err := json.Unmarshal(extension.Value, &attributes); err != nil {
+			return "", fmt.Errorf("failed to parse certificate attributes of identity %s: %w", label, err)
+		}
+		if value := attributes.Attrs[name]; value != "" {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("certificate of identity %s has no %s attribute", label, name)
+}
@@ -0,0 +1,337 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"application-gateway/apikeys"
+	"application-gateway/fabric"
+	"application-gateway/indexer"
+	"application-gateway/metrics"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+var errIndexerDisabled = errors.New("no indexer is configured on this gateway")
+
+var errAPIKeyRequired = errors.New("an API key is required to act as an operator or on another identity")
+
+// operatorRoles are the certificate roles the admin console is open to
+var operatorRoles = []string{"operator", "admin"}
+
+// settlementGrace is how long after delivery ends a confirmed trade may go
+// unsettled before it counts as a failed settlement. The scheduler
+// reconciles trades five minutes after each 15 minute interval ends, so an
+// hour allows for several failed rounds.
+const settlementGrace = time.Hour
+
+// adminPageSize is the page size the health summary reads chaincode queries
+// with, the chaincode's default limit
+const adminPageSize = 100
+
+// oracleFeed is an event an oracle or telemetry service emits on a schedule,
+// and the age beyond which its latest posting is stale
+type oracleFeed struct {
+	Event  string
+	MaxAge time.Duration
+}
+
+// oracleFeeds are the feeds the admin console watches. Reference prices and
+// grid capacity are posted every 15 minute interval, forecasts once a day.
+var oracleFeeds = []oracleFeed{
+	{"ReferencePricePosted", time.Hour},
+	{"GridCapacitySet", time.Hour},
+	{"PriceForecastPosted", 26 * time.Hour},
+	{"WeatherForecastPosted", 26 * time.Hour},
+}
+
+// oracleStatus is the staleness of one oracle feed. LastPostedAt is empty
+// for a feed never posted, which is stale.
+type oracleStatus struct {
+	Event        string `json:"event"`
+	MaxAge       string `json:"maxAge"`
+	LastPostedAt string `json:"lastPostedAt,omitempty"`
+	Posts        int    `json:"posts"`
+	Stale        bool   `json:"stale"`
+}
+
+// healthSummary counts the problems each admin console list reports. The
+// trade counts stop at the indexer's largest page.
+type healthSummary struct {
+	Healthy              bool     `json:"healthy"`
+	CheckedAt            string   `json:"checkedAt"`
+	StuckTrades          int      `json:"stuckTrades"`
+	FailedSettlements    int      `json:"failedSettlements"`
+	AccountsBelowReserve int      `json:"accountsBelowReserve"`
+	OpenDisputes         int      `json:"openDisputes"`
+	StaleOracleFeeds     []string `json:"staleOracleFeeds"`
+}
+
+var intSchema = map[string]interface{}{"type": "integer"}
+
+// indexedTradesSchema describes the trades the indexer returns
+var indexedTradesSchema = map[string]interface{}{"type": "array", "items": map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"tokenID":       stringSchema,
+		"buyer":         stringSchema,
+		"seller":        stringSchema,
+		"energyAmount":  map[string]interface{}{"type": "number"},
+		"deliveryStart": stringSchema,
+		"deliveryEnd":   stringSchema,
+		"state":         stringSchema,
+		"createdAt":     stringSchema,
+		"updatedAt":     stringSchema,
+	},
+}}
+
+// oracleStatusSchema describes the staleness of the oracle feeds
+var oracleStatusSchema = map[string]interface{}{"type": "array", "items": map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"event":        stringSchema,
+		"maxAge":       stringSchema,
+		"lastPostedAt": stringSchema,
+		"posts":        intSchema,
+		"stale":        map[string]interface{}{"type": "boolean"},
+	},
+}}
+
+// healthSummarySchema describes the health summary
+var healthSummarySchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"healthy":              map[string]interface{}{"type": "boolean"},
+		"checkedAt":            stringSchema,
+		"stuckTrades":          intSchema,
+		"failedSettlements":    intSchema,
+		"accountsBelowReserve": intSchema,
+		"openDisputes":         intSchema,
+		"staleOracleFeeds":     map[string]interface{}{"type": "array", "items": stringSchema},
+	},
+}
+
+// operatorOnly restricts an endpoint to identities whose certificate carries
+// the operator or admin role
+func (s *Server) operatorOnly(e endpoint) endpoint {
+	handler := e.handler
+	e.handler = func(w http.ResponseWriter, r *http.Request) {
+		label, operator, err := s.operatorCaller(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if !operator {
+			writeError(w, http.StatusForbidden, fmt.Errorf("identity %s is not an operator", label))
+			return
+		}
+		handler(w, r)
+	}
+	return e
+}
+
+// operatorCaller returns the label of the request's identity and whether its
+// certificate carries the operator or admin role. Only the identity of an
+// authenticated API key counts: a label the request names itself says
+// nothing about who sent it.
+func (s *Server) operatorCaller(r *http.Request) (string, bool, error) {
+	keyClient, ok := apikeys.FromContext(r.Context())
+	if !ok {
+		return "", false, errAPIKeyRequired
+	}
+	label := keyClient.Identity
+	id, err := s.wallet.Get(label)
+	if err != nil {
+		return label, false, err
+	}
+	role, err := id.Role()
+	return label, err == nil && hasRole(operatorRoles, role), nil
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// indexerGet decodes the JSON result of an indexer query
+func (s *Server) indexerGet(ctx context.Context, path string, query url.Values, result interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.config.IndexerURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	response, err := s.indexerClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("indexer query failed: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(response.Body).Decode(&body)
+		return fmt.Errorf("indexer query %s failed with status %d: %s", path, response.StatusCode, body.Error)
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// overdueTrades queries the indexer for trades overdue at the given time
+func (s *Server) overdueTrades(ctx context.Context, path string, before time.Time, limit int64) ([]json.RawMessage, error) {
+	query := url.Values{"before": {before.UTC().Format(time.RFC3339)}, "limit": {strconv.FormatInt(limit, 10)}}
+	trades := []json.RawMessage{}
+	if err := s.indexerGet(ctx, path, query, &trades); err != nil {
+		return nil, err
+	}
+	return trades, nil
+}
+
+// overdueTradesHandler serves the trades the indexer reports overdue at the
+// current time less grace
+func (s *Server) overdueTradesHandler(path string, grace time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.indexerClient == nil {
+			writeError(w, http.StatusNotFound, errIndexerDisabled)
+			return
+		}
+		limit, err := queryInt(r, "limit", 100)
+		if err != nil || limit < 1 || limit > indexer.MaxLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", indexer.MaxLimit))
+			return
+		}
+		trades, err := s.overdueTrades(r.Context(), path, time.Now().Add(-grace), limit)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, trades)
+	}
+}
+
+// oracleStatuses compares when each oracle feed was last posted, per the
+// indexer, with its maximum age
+func (s *Server) oracleStatuses(ctx context.Context, now time.Time) ([]*oracleStatus, error) {
+	query := url.Values{}
+	for _, feed := range oracleFeeds {
+		query.Add("name", feed.Event)
+	}
+	var posted []*indexer.OracleFeed
+	if err := s.indexerGet(ctx, "/oracle-feeds", query, &posted); err != nil {
+		return nil, err
+	}
+	statuses := make([]*oracleStatus, 0, len(oracleFeeds))
+	for _, feed := range oracleFeeds {
+		status := &oracleStatus{Event: feed.Event, MaxAge: feed.MaxAge.String(), Stale: true}
+		for _, p := range posted {
+			if p.Name != feed.Event {
+				continue
+			}
+			status.LastPostedAt, status.Posts = p.LastPostedAt, p.Posts
+			lastPosted, err := time.Parse(time.RFC3339Nano, p.LastPostedAt)
+			if err != nil {
+				return nil, fmt.Errorf("indexer returned invalid timestamp %q for %s", p.LastPostedAt, feed.Event)
+			}
+			status.Stale = now.Sub(lastPosted) > feed.MaxAge
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// getOracleStatuses reports which oracle feeds have gone stale
+func (s *Server) getOracleStatuses(w http.ResponseWriter, r *http.Request) {
+	if s.indexerClient == nil {
+		writeError(w, http.StatusNotFound, errIndexerDisabled)
+		return
+	}
+	statuses, err := s.oracleStatuses(r.Context(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// countPages evaluates a paged chaincode query page by page and counts the
+// records of every page
+func countPages(contract *client.Contract, function string) (int, error) {
+	count := 0
+	for bookmark := ""; ; {
+		result, err := contract.EvaluateTransaction(function, strconv.Itoa(adminPageSize), bookmark)
+		if err != nil {
+			metrics.FabricError(function, metrics.StageEvaluate, err)
+			return 0, fabric.ErrorWithDetails(err)
+		}
+		var page struct {
+			Records             []json.RawMessage `json:"records"`
+			FetchedRecordsCount int               `json:"fetchedRecordsCount"`
+			Bookmark            string            `json:"bookmark"`
+		}
+		if err := json.Unmarshal(result, &page); err != nil {
+			return 0, err
+		}
+		count += len(page.Records)
+		if page.FetchedRecordsCount < adminPageSize || page.Bookmark == "" {
+			return count, nil
+		}
+		bookmark = page.Bookmark
+	}
+}
+
+// getHealthSummary counts the stuck trades, failed settlements, accounts
+// below reserve and open disputes, and lists the stale oracle feeds. The
+// platform is healthy when every count is zero and no feed is stale.
+func (s *Server) getHealthSummary(w http.ResponseWriter, r *http.Request) {
+	if s.indexerClient == nil {
+		writeError(w, http.StatusNotFound, errIndexerDisabled)
+		return
+	}
+	contract, err := s.contract(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	now := time.Now()
+	summary := &healthSummary{CheckedAt: now.UTC().Format(time.RFC3339), StaleOracleFeeds: []string{}}
+
+	stuck, err := s.overdueTrades(r.Context(), "/trades/stuck", now, indexer.MaxLimit)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	unsettled, err := s.overdueTrades(r.Context(), "/trades/unsettled", now.Add(-settlementGrace), indexer.MaxLimit)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	summary.StuckTrades, summary.FailedSettlements = len(stuck), len(unsettled)
+	if summary.AccountsBelowReserve, err = countPages(contract, "GetAccountsBelowReserve"); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	if summary.OpenDisputes, err = countPages(contract, "GetOpenMeterDisputes"); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	statuses, err := s.oracleStatuses(r.Context(), now)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	for _, status := range statuses {
+		if status.Stale {
+			summary.StaleOracleFeeds = append(summary.StaleOracleFeeds, status.Event)
+		}
+	}
+	summary.Healthy = summary.StuckTrades == 0 && summary.FailedSettlements == 0 && summary.AccountsBelowReserve == 0 &&
+		summary.OpenDisputes == 0 && len(summary.StaleOracleFeeds) == 0
+	writeJSON(w, http.StatusOK, summary)
+}
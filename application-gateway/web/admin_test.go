@@ -0,0 +1,99 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"application-gateway/indexer"
+)
+
+func TestOracleStatuses(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oracle-feeds" || len(r.URL.Query()["name"]) != len(oracleFeeds) {
+			t.Errorf("got indexer query %s", r.URL)
+		}
+		json.NewEncoder(w).Encode([]*indexer.OracleFeed{
+			{Name: "GridCapacitySet", LastPostedAt: "2025-05-03T09:45:00.5Z", Posts: 40},
+			{Name: "ReferencePricePosted", LastPostedAt: "2025-05-03T08:00:00Z", Posts: 12},
+		})
+	}))
+	defer fake.Close()
+	s := &Server{config: Config{IndexerURL: fake.URL}, indexerClient: fake.Client()}
+
+	statuses, err := s.oracleStatuses(context.Background(), time.Date(2025, 5, 3, 10, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"ReferencePricePosted": true, "GridCapacitySet": false, "PriceForecastPosted": true, "WeatherForecastPosted": true}
+	for _, status := range statuses {
+		if status.Stale != want[status.Event] {
+			t.Errorf("got %s stale %v, want %v", status.Event, status.Stale, want[status.Event])
+		}
+	}
+	if statuses[1].Posts != 40 || statuses[2].LastPostedAt != "" {
+		t.Errorf("got statuses %+v %+v", statuses[1], statuses[2])
+	}
+}
+
+func TestOverdueTradesHandler(t *testing.T) {
+	s := &Server{}
+	recorder := httptest.NewRecorder()
+	s.overdueTradesHandler("/trades/unsettled", settlementGrace)(recorder, httptest.NewRequest(http.MethodGet, "/admin/failed-settlements", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("got status %d without an indexer, want 404", recorder.Code)
+	}
+
+	var before string
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		before = r.URL.Query().Get("before")
+		w.Write([]byte(`[{"tokenID":"asset1","state":"CONFIRMED"}]`))
+	}))
+	defer fake.Close()
+	s = &Server{config: Config{IndexerURL: fake.URL}, indexerClient: fake.Client()}
+
+	recorder = httptest.NewRecorder()
+	s.overdueTradesHandler("/trades/unsettled", settlementGrace)(recorder, httptest.NewRequest(http.MethodGet, "/admin/failed-settlements?limit=5000", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a limit over the maximum, want 400", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	s.overdueTradesHandler("/trades/unsettled", settlementGrace)(recorder, httptest.NewRequest(http.MethodGet, "/admin/failed-settlements", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", recorder.Code, recorder.Body)
+	}
+	cutoff, err := time.Parse(time.RFC3339, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age := time.Since(cutoff); age < settlementGrace || age > settlementGrace+time.Minute {
+		t.Errorf("got before %s, want an hour ago", before)
+	}
+	var trades []map[string]string
+	if err := json.Unmarshal(recorder.Body.Bytes(), &trades); err != nil || len(trades) != 1 || trades[0]["tokenID"] != "asset1" {
+		t.Errorf("got trades %s", recorder.Body)
+	}
+}
+
+func TestAdminConsoleRequiresOperatorKey(t *testing.T) {
+	s := newIdentityTestServer(t, "alice")
+	putTestIdentity(t, s.wallet, "root", "admin")
+	req := httptest.NewRequest(http.MethodGet, "/admin/oracles", nil)
+	req.Header.Set(APIKeyHeader, "key-alice")
+	req.Header.Set(IdentityHeader, "root")
+	recorder := httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("got status %d for a prosumer's key naming an admin, want 403", recorder.Code)
+	}
+
+	s.apiKeys = nil
+	recorder = httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/oracles", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("got status %d without API keys, want 404", recorder.Code)
+	}
+}
@@ -0,0 +1,178 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"application-gateway/apikeys"
+	"application-gateway/audit"
+	"application-gateway/fabric"
+)
+
+var errAuditDisabled = errors.New("the audit log is not enabled on this gateway")
+
+// maxAuditPage is the most entries GET /audit returns at once
+const maxAuditPage = 1000
+
+// auditEntrySchema describes an audit log entry
+var auditEntrySchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"seq":            map[string]interface{}{"type": "integer"},
+		"at":             stringSchema,
+		"identity":       stringSchema,
+		"client":         stringSchema,
+		"method":         stringSchema,
+		"route":          stringSchema,
+		"path":           stringSchema,
+		"function":       stringSchema,
+		"status":         map[string]interface{}{"type": "integer"},
+		"transactionIDs": map[string]interface{}{"type": "array", "items": stringSchema},
+		"prevHash":       stringSchema,
+		"hash":           stringSchema,
+	},
+}
+
+// verificationSchema describes the outcome of verifying the audit log
+var verificationSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"entries":      map[string]interface{}{"type": "integer"},
+		"head":         stringSchema,
+		"brokenAt":     map[string]interface{}{"type": "integer"},
+		"transactions": map[string]interface{}{"type": "integer"},
+		"discrepancies": map[string]interface{}{"type": "array", "items": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"seq":           map[string]interface{}{"type": "integer"},
+				"transactionID": stringSchema,
+				"reason":        stringSchema,
+			},
+		}},
+	},
+}
+
+// statusRecorder remembers the status a handler responds with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// audited appends an entry to the audit log for every call of a route once
+// it has been handled, with the transactions the handler submitted. The
+// request body is left out, since it may carry private trade terms.
+func (s *Server) audited(route, function string, handler http.Handler) http.Handler {
+	if s.audit == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, record := audit.NewContext(r.Context())
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r.WithContext(ctx))
+
+		entry := &audit.Entry{
+			At:             time.Now().UTC().Format(time.RFC3339Nano),
+			Method:         r.Method,
+			Route:          route,
+			Path:           r.URL.Path,
+			Function:       function,
+			Status:         recorder.status,
+			TransactionIDs: record.TransactionIDs(),
+		}
+		// A request naming an unknown identity is still recorded, without one
+		entry.Identity, _ = s.identityLabel(r)
+		if keyClient, ok := apikeys.FromContext(r.Context()); ok {
+			entry.Client = keyClient.Name
+		}
+		if err := s.audit.Append(entry); err != nil {
+			log.Printf("Failed to append %s %s to the audit log: %v", r.Method, r.URL.Path, err)
+		}
+	})
+}
+
+// listAuditEntries returns the audit log from the entry numbered "from" on
+func (s *Server) listAuditEntries(w http.ResponseWriter, r *http.Request) {
+	if s.audit == nil {
+		writeError(w, http.StatusNotFound, errAuditDisabled)
+		return
+	}
+	from, err := queryInt(r, "from", 1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := queryInt(r, "limit", 100)
+	if err != nil || limit < 1 || limit > maxAuditPage {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxAuditPage))
+		return
+	}
+	entries, err := s.audit.Entries(from, int(limit))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// verifyAuditLog recomputes the audit log's hash chain and looks up the
+// transactions of the entries numbered from "from" to "to" on the ledger, as
+// the caller
+func (s *Server) verifyAuditLog(w http.ResponseWriter, r *http.Request) {
+	if s.audit == nil {
+		writeError(w, http.StatusNotFound, errAuditDisabled)
+		return
+	}
+	from, err := queryInt(r, "from", 1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := queryInt(r, "to", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	network, err := s.network(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	verification, err := s.audit.Verify(r.Context(), from, to, func(_ context.Context, transactionID string) (string, error) {
+		code, err := fabric.TransactionValidationCode(network, transactionID)
+		if errors.Is(err, fabric.ErrTransactionNotFound) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return code.String(), nil
+	})
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, verification)
+}
+
+// queryInt parses an optional integer query parameter
+func queryInt(r *http.Request, name string, fallback int64) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer", name)
+	}
+	return n, nil
+}
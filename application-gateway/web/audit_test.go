@@ -0,0 +1,88 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"application-gateway/audit"
+)
+
+func TestAuditedRecordsCalls(t *testing.T) {
+	store, err := audit.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	s := &Server{audit: store}
+	handler := s.audited("POST /trades/{id}/delivery", "ConfirmDelivery", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		audit.AddTransaction(r.Context(), "tx-1")
+		writeError(w, http.StatusConflict, http.ErrAbortHandler)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/trades/t1/delivery?apiKey=secret", nil)
+	req.Header.Set(IdentityHeader, "user1@org1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries, err := store.Entries(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.Identity != "user1@org1" || e.Route != "POST /trades/{id}/delivery" || e.Function != "ConfirmDelivery" || e.Status != http.StatusConflict {
+		t.Errorf("got entry %+v", e)
+	}
+	if e.Path != "/trades/t1/delivery" {
+		t.Errorf("got path %s, want it without the query and its API key", e.Path)
+	}
+	if len(e.TransactionIDs) != 1 || e.TransactionIDs[0] != "tx-1" {
+		t.Errorf("got transactions %v, want tx-1", e.TransactionIDs)
+	}
+}
+
+func TestAuditLogRequiresOperator(t *testing.T) {
+	store, err := audit.Open(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	s := newIdentityTestServer(t, "alice", "auditor")
+	s.audit = store
+	putTestIdentity(t, s.wallet, "auditor", "operator")
+	handler := s.Handler()
+
+	for _, path := range []string{"/audit", "/audit/verification"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(APIKeyHeader, "key-alice")
+		req.Header.Set(IdentityHeader, "auditor")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("got status %d for %s as a prosumer, want 403", recorder.Code, path)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/audit", nil)
+	req.Header.Set(APIKeyHeader, "key-auditor")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("got status %d for /audit as an operator: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestAuditLogNeedsAPIKeys(t *testing.T) {
+	s := newIdentityTestServer(t)
+	s.apiKeys = nil
+	putTestIdentity(t, s.wallet, "auditor", "operator")
+	req := httptest.NewRequest(http.MethodGet, "/audit", nil)
+	req.Header.Set(IdentityHeader, "auditor")
+	recorder := httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("got status %d for /audit without API keys, want 404", recorder.Code)
+	}
+}
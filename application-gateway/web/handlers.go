@@ -0,0 +1,288 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"application-gateway/audit"
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+	"application-gateway/submission"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// param describes where a request carries one chaincode argument. In is
+// "path", "query" or "body". A param with a Schema is read by the gateway
+// itself and is not passed to the chaincode as an argument.
+type param struct {
+	In       string
+	Name     string
+	Optional bool
+	Schema   map[string]interface{}
+}
+
+// args extracts chaincode arguments from a request and its decoded JSON
+// body. Params describes the arguments in order for the OpenAPI document.
+type args struct {
+	Params  []param
+	extract func(r *http.Request, body map[string]interface{}) ([]string, error)
+}
+
+func params(in string, optional bool, names []string) []param {
+	ps := make([]param, 0, len(names))
+	for _, name := range names {
+		ps = append(ps, param{In: in, Name: name, Optional: optional})
+	}
+	return ps
+}
+
+// pathArgs takes arguments from path wildcards
+func pathArgs(names ...string) args {
+	return args{params("path", false, names), func(r *http.Request, _ map[string]interface{}) ([]string, error) {
+		values := make([]string, 0, len(names))
+		for _, name := range names {
+			values = append(values, r.PathValue(name))
+		}
+		return values, nil
+	}}
+}
+
+// queryArgs takes arguments from query parameters; missing ones are empty
+func queryArgs(names ...string) args {
+	return args{params("query", true, names), func(r *http.Request, _ map[string]interface{}) ([]string, error) {
+		query := r.URL.Query()
+		values := make([]string, 0, len(names))
+		for _, name := range names {
+			values = append(values, query.Get(name))
+		}
+		return values, nil
+	}}
+}
+
+// bodyArgs takes required arguments from fields of the JSON body
+func bodyArgs(names ...string) args {
+	return args{params("body", false, names), func(_ *http.Request, body map[string]interface{}) ([]string, error) {
+		values := make([]string, 0, len(names))
+		for _, name := range names {
+			value, ok := body[name]
+			if !ok {
+				return nil, fmt.Errorf("field %s is required", name)
+			}
+			arg, err := chaincodeArg(value)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, arg)
+		}
+		return values, nil
+	}}
+}
+
+// expectedVersionArg takes the optional expectedVersion field of the JSON
+// body; without it the chaincode skips its lost-update check
+func expectedVersionArg() args {
+	return args{params("body", true, []string{"expectedVersion"}), func(_ *http.Request, body map[string]interface{}) ([]string, error) {
+		value, ok := body["expectedVersion"]
+		if !ok {
+			return []string{"0"}, nil
+		}
+		arg, err := chaincodeArg(value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{arg}, nil
+	}}
+}
+
+// chaincodeArg converts a JSON value to the string form the contract API
+// parses: strings and numbers as is, anything else as JSON.
+func chaincodeArg(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	default:
+		valueJSON, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(valueJSON), nil
+	}
+}
+
+// collectArgs decodes the body, if any, and extracts each group of arguments
+// in turn
+func collectArgs(r *http.Request, groups []args) ([]string, map[string]interface{}, error) {
+	body := map[string]interface{}{}
+	if r.Body != nil && r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&body); err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON body: %w", err)
+		}
+	}
+	var values []string
+	for _, group := range groups {
+		more, err := group.extract(r, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		values = append(values, more...)
+	}
+	return values, body, nil
+}
+
+// evaluate returns an endpoint that evaluates a chaincode query
+func (s *Server) evaluate(function string, groups ...args) endpoint {
+	return endpoint{Function: function, Params: allParams(groups), handler: func(w http.ResponseWriter, r *http.Request) {
+		args, _, err := collectArgs(r, groups)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		contract, err := s.contract(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		result, err := contract.EvaluateTransaction(function, args...)
+		if err != nil {
+			metrics.FabricError(function, metrics.StageEvaluate, err)
+			writeChaincodeError(w, r, http.StatusBadGateway, fabric.ErrorWithDetails(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}}
+}
+
+// submit returns an endpoint that submits a chaincode transaction
+func (s *Server) submit(function string, groups ...args) endpoint {
+	return endpoint{Function: function, Submit: true, Params: allParams(groups), handler: func(w http.ResponseWriter, r *http.Request) {
+		args, _, err := collectArgs(r, groups)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.submitTransaction(w, r, function, args, nil)
+	}}
+}
+
+// submitTransaction submits a transaction as the request's identity and
+// writes its result. A full submission queue is answered with 503, for the
+// client to retry later.
+func (s *Server) submitTransaction(w http.ResponseWriter, r *http.Request, function string, args []string, transient map[string][]byte) {
+	contract, err := s.contract(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	options := []client.ProposalOption{client.WithArguments(args...)}
+	transient = fabric.WithIdempotencyKey(transient, r.Header.Get("Idempotency-Key"))
+	if transient != nil {
+		options = append(options, client.WithTransient(transient))
+	}
+	result, transactionID, err := s.submitQueued(r.Context(), contract, function, options...)
+	var commitErr *submission.CommitFailedError
+	switch {
+	case errors.Is(err, submission.ErrQueueFull):
+		w.Header().Set("Retry-After", "1")
+		writeChaincodeError(w, r, http.StatusServiceUnavailable, err)
+		return
+	case errors.As(err, &commitErr):
+		writeChaincodeError(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		writeChaincodeError(w, r, http.StatusBadGateway, fabric.ErrorWithDetails(err))
+		return
+	}
+	if len(result) == 0 {
+		writeJSON(w, http.StatusOK, map[string]string{"transactionID": transactionID})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// submissionClasses are the priority classes of the chaincode functions that
+// are not orders
+var submissionClasses = map[string]submission.Class{
+	"ReconcileDelivery":  submission.Settlement,
+	"CloseBillingPeriod": submission.Settlement,
+	"SubmitMeterReading": submission.MeterData,
+}
+
+// submitQueued submits a transaction through the submission queue, in the
+// function's priority class, and waits for it to commit. It returns the
+// result and ID of the transaction that committed, or a
+// *submission.CommitFailedError for one committed as invalid after any
+// retries.
+func (s *Server) submitQueued(ctx context.Context, contract *client.Contract, function string, options ...client.ProposalOption) ([]byte, string, error) {
+	class, ok := submissionClasses[function]
+	if !ok {
+		class = submission.Orders
+	}
+	var result []byte
+	var transactionID string
+	err := s.submissions.Submit(ctx, class, func(ctx context.Context) error {
+		var commit *client.Commit
+		var err error
+		result, commit, err = contract.SubmitAsync(function, options...)
+		if err != nil {
+			metrics.FabricError(function, metrics.StageSubmit, err)
+			return err
+		}
+		transactionID = commit.TransactionID()
+		audit.AddTransaction(ctx, transactionID)
+		commitStatus, err := commit.Status()
+		if err != nil {
+			metrics.FabricError(function, metrics.StageCommit, err)
+			return err
+		}
+		if !commitStatus.Successful {
+			metrics.FabricError(function, metrics.StageCommit, nil)
+			return &submission.CommitFailedError{TransactionID: transactionID, Code: commitStatus.Code}
+		}
+		return nil
+	})
+	return result, transactionID, err
+}
+
+// tradeArgs are the public CreateEnergyAsset arguments
+var tradeArgs = bodyArgs("tokenID", "buyer", "seller", "energyAmount", "deliveryStart", "deliveryEnd", "sourceType")
+
+// privateTermsParam is the body field carrying a trade's private terms
+var privateTermsParam = param{In: "body", Name: "private", Schema: map[string]interface{}{
+	"type":     "object",
+	"required": []string{"transactionPrice", "buyerDeposit", "sellerDeposit", "salt"},
+	"properties": map[string]interface{}{
+		"transactionPrice": map[string]interface{}{"type": "number"},
+		"buyerDeposit":     map[string]interface{}{"type": "number"},
+		"sellerDeposit":    map[string]interface{}{"type": "number"},
+		"salt":             map[string]interface{}{"type": "string"},
+	},
+}}
+
+// createTrade submits CreateEnergyAsset, passing the private terms in the
+// "private" field through the transient map.
+func (s *Server) createTrade(w http.ResponseWriter, r *http.Request) {
+	args, body, err := collectArgs(r, []args{tradeArgs})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	private, ok := body["private"].(map[string]interface{})
+	if !ok {
+		writeError(w, http.StatusBadRequest, errors.New("field private is required"))
+		return
+	}
+	privateJSON, err := json.Marshal(private)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.submitTransaction(w, r, "CreateEnergyAsset", args, map[string][]byte{"trade_private": privateJSON})
+}
@@ -0,0 +1,331 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"application-gateway/ca"
+	"application-gateway/fabric"
+	"application-gateway/wallet"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+var errEnrollmentDisabled = errors.New("enrollment is not enabled on this gateway")
+
+// traderRoles are the roles anyone may enroll an identity with. Other roles
+// carry powers on-chain, so only operators may enroll them.
+var traderRoles = []string{"prosumer", "consumer", "aggregator"}
+
+// personalTransientKey is the transient map entry RegisterParticipant reads
+// the participant's personal data from
+const personalTransientKey = "participant_personal"
+
+// enrollmentRequest is the body of an enrollment. Address defaults to the
+// label, and PublicKey, the key trades are signed with, to the enrolled
+// certificate's key.
+type enrollmentRequest struct {
+	Label       string   `json:"label"`
+	Role        string   `json:"role"`
+	Address     string   `json:"address"`
+	Zone        string   `json:"zone"`
+	MeterIDs    []string `json:"meterIDs"`
+	PublicKey   string   `json:"publicKey"`
+	DisplayName string   `json:"displayName"`
+	Email       string   `json:"email"`
+}
+
+// enrollment describes an enrolled wallet identity
+type enrollment struct {
+	Label       string `json:"label"`
+	MSPID       string `json:"mspID"`
+	Address     string `json:"address"`
+	Certificate string `json:"certificate"`
+}
+
+var stringSchema = map[string]interface{}{"type": "string"}
+
+// enrollmentParams are the body fields of an enrollment
+var enrollmentParams = []param{
+	{In: "body", Name: "label", Schema: stringSchema},
+	{In: "body", Name: "role", Schema: stringSchema},
+	{In: "body", Name: "address", Optional: true, Schema: stringSchema},
+	{In: "body", Name: "zone", Schema: stringSchema},
+	{In: "body", Name: "meterIDs", Optional: true, Schema: map[string]interface{}{"type": "array", "items": stringSchema}},
+	{In: "body", Name: "publicKey", Optional: true, Schema: stringSchema},
+	{In: "body", Name: "displayName", Schema: stringSchema},
+	{In: "body", Name: "email", Optional: true, Schema: stringSchema},
+}
+
+// enrollmentSchema describes an enrolled identity
+var enrollmentSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"label":       stringSchema,
+		"mspID":       stringSchema,
+		"address":     stringSchema,
+		"certificate": stringSchema,
+	},
+}
+
+// revocationSchema describes the outcome of a revocation
+var revocationSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"revokedCerts": map[string]interface{}{"type": "array", "items": map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"serial": stringSchema, "aki": stringSchema},
+		}},
+		"crl": stringSchema,
+	},
+}
+
+func newEnrollment(id *wallet.Identity, address string) *enrollment {
+	return &enrollment{Label: id.Label, MSPID: id.MSPID, Address: address, Certificate: id.Certificate}
+}
+
+// enrollIdentity registers and enrolls a user with the Fabric CA, stores the
+// identity in the wallet, and as that identity registers the participant and
+// opens its token account. Each step is skipped if it was done before, so an
+// enrollment that failed part way is completed by sending it again. Only
+// operators may enroll identities with other than a trader role.
+func (s *Server) enrollIdentity(w http.ResponseWriter, r *http.Request) {
+	if s.enrollment == nil {
+		writeError(w, http.StatusNotFound, errEnrollmentDisabled)
+		return
+	}
+	var req enrollmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %w", err))
+		return
+	}
+	for field, value := range map[string]string{"label": req.Label, "role": req.Role, "zone": req.Zone, "displayName": req.DisplayName} {
+		if value == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("field %s is required", field))
+			return
+		}
+	}
+	if !hasRole(traderRoles, req.Role) {
+		caller, operator, err := s.operatorCaller(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if !operator {
+			writeError(w, http.StatusForbidden, fmt.Errorf("identity %s may not enroll an identity with role %s", caller, req.Role))
+			return
+		}
+	}
+	if req.Address == "" {
+		req.Address = req.Label
+	}
+
+	exists, err := s.wallet.Exists(req.Label)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var id *wallet.Identity
+	if exists {
+		if id, err = s.wallet.Get(req.Label); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if address, err := id.Address(); err != nil || address != req.Address {
+			writeError(w, http.StatusConflict, fmt.Errorf("identity %s is already in the wallet for another address", req.Label))
+			return
+		}
+	} else {
+		secret, err := s.enrollment.Register(req.Label, []ca.Attribute{
+			{Name: wallet.RoleAttribute, Value: req.Role, ECert: true},
+			{Name: wallet.AddressAttribute, Value: req.Address, ECert: true},
+		})
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		if id, err = s.enrollment.Enroll(req.Label, req.Label, secret); err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		if err := s.wallet.Put(id); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if req.PublicKey == "" {
+		if req.PublicKey, err = certificatePublicKey(id.Certificate); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := s.registerParticipant(r.Context(), &req); err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Errorf("identity %s is enrolled, but its on-chain registration failed and can be retried: %w", req.Label, err))
+		return
+	}
+	writeJSON(w, http.StatusCreated, newEnrollment(id, req.Address))
+}
+
+// registerParticipant submits RegisterParticipant as a newly enrolled
+// identity, accepting that it was done before. The token account is opened
+// once the participant is KYC approved.
+func (s *Server) registerParticipant(ctx context.Context, req *enrollmentRequest) error {
+	network, err := s.networkAs(req.Label)
+	if err != nil {
+		return err
+	}
+	contract := network.GetContract(s.config.ChaincodeName)
+	meterIDs := req.MeterIDs
+	if meterIDs == nil {
+		meterIDs = []string{}
+	}
+	meterIDsJSON, err := json.Marshal(meterIDs)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	personalJSON, err := json.Marshal(map[string]string{"displayName": req.DisplayName, "email": req.Email, "salt": hex.EncodeToString(salt)})
+	if err != nil {
+		return err
+	}
+	return s.submitUnlessDone(ctx, contract, "RegisterParticipant", "is already registered",
+		client.WithArguments(string(meterIDsJSON), req.PublicKey, req.Zone),
+		client.WithTransient(map[string][]byte{personalTransientKey: personalJSON}),
+	)
+}
+
+// submitUnlessDone submits a transaction and waits for it to commit. A
+// chaincode error containing done means the transaction's work was done
+// before, and is not a failure.
+func (s *Server) submitUnlessDone(ctx context.Context, contract *client.Contract, function, done string, options ...client.ProposalOption) error {
+	_, _, err := s.submitQueued(ctx, contract, function, options...)
+	if err == nil {
+		return nil
+	}
+	detailed := fabric.ErrorWithDetails(err)
+	if strings.Contains(detailed.Error(), done) {
+		return nil
+	}
+	return detailed
+}
+
+// certificatePublicKey returns the public key of a PEM certificate as PEM
+func certificatePublicKey(certificatePEM string) (string, error) {
+	certificate, err := identity.CertificateFromPEM([]byte(certificatePEM))
+	if err != nil {
+		return "", err
+	}
+	keyDER, err := x509.MarshalPKIXPublicKey(certificate.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keyDER})), nil
+}
+
+// rotateIdentity re-enrolls the caller's identity with a new key, replaces
+// it in the wallet and revokes the certificate it replaced
+func (s *Server) rotateIdentity(w http.ResponseWriter, r *http.Request) {
+	if s.enrollment == nil {
+		writeError(w, http.StatusNotFound, errEnrollmentDisabled)
+		return
+	}
+	label := r.PathValue("label")
+	caller, err := s.identityLabel(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if caller != label {
+		writeError(w, http.StatusForbidden, fmt.Errorf("identity %s may only rotate its own credentials", caller))
+		return
+	}
+	current, err := s.wallet.Get(label)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	address, err := current.Address()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	id, err := s.enrollment.Reenroll(current)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	if err := s.wallet.Put(id); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.disconnect(label)
+	certificate, err := identity.CertificateFromPEM([]byte(current.Certificate))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := s.enrollment.Revoke(certificate.Subject.CommonName, current.Certificate, "superseded"); err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Errorf("identity %s has a new key, but its old certificate could not be revoked: %w", label, err))
+		return
+	}
+	writeJSON(w, http.StatusOK, newEnrollment(id, address))
+}
+
+// revokeIdentity revokes an identity with the Fabric CA, so that neither its
+// certificates nor a new enrollment are accepted, and removes it from the
+// wallet. The participant's on-chain records are kept. Only the identity
+// itself or an operator may revoke it.
+func (s *Server) revokeIdentity(w http.ResponseWriter, r *http.Request) {
+	if s.enrollment == nil {
+		writeError(w, http.StatusNotFound, errEnrollmentDisabled)
+		return
+	}
+	label := r.PathValue("label")
+	caller, operator, err := s.operatorCaller(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if caller != label && !operator {
+		writeError(w, http.StatusForbidden, fmt.Errorf("identity %s may only revoke its own credentials", caller))
+		return
+	}
+	id, err := s.wallet.Get(label)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	certificate, err := identity.CertificateFromPEM([]byte(id.Certificate))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "unspecified"
+	}
+	revocation, err := s.enrollment.Revoke(certificate.Subject.CommonName, "", reason)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	s.disconnect(label)
+	if err := s.wallet.Delete(label); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, revocation)
+}
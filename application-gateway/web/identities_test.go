@@ -0,0 +1,145 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"application-gateway/apikeys"
+	"application-gateway/ca"
+	"application-gateway/wallet"
+)
+
+// putTestIdentity stores a self-signed identity with a role attribute in the
+// wallet
+func putTestIdentity(t *testing.T, w *wallet.Wallet, label, role string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: label},
+		NotBefore:       time.Now(),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: []byte(`{"attrs":{"energy.role":"` + role + `","energy.address":"` + label + `"}}`)}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Put(&wallet.Identity{
+		Label:       label,
+		MSPID:       "Org1MSP",
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newIdentityTestServer returns a server with two prosumers in its wallet and
+// an API key "key-<label>" for each label given, open to every route
+func newIdentityTestServer(t *testing.T, keyLabels ...string) *Server {
+	w, err := wallet.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestIdentity(t, w, "alice", "prosumer")
+	putTestIdentity(t, w, "bob", "prosumer")
+	config := &apikeys.Config{Roles: map[string][]string{"all": {apikeys.AllRoutes}}}
+	for _, label := range keyLabels {
+		config.Clients = append(config.Clients, &apikeys.Client{Name: label, KeyHash: apikeys.HashKey("key-" + label), Identity: label, Role: "all"})
+	}
+	keys, err := apikeys.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{wallet: w, apiKeys: keys, enrollment: &ca.Client{}}
+}
+
+func TestNewServerRequiresAPIKeysForSeveralIdentities(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wallet.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestIdentity(t, w, "alice", "prosumer")
+	putTestIdentity(t, w, "bob", "prosumer")
+
+	_, err = NewServer(Config{WalletPath: dir})
+	if err == nil || !strings.Contains(err.Error(), "API keys are required") {
+		t.Errorf("got error %v starting without API keys, want API keys required", err)
+	}
+}
+
+func TestEnrollPrivilegedRoleRequiresOperator(t *testing.T) {
+	s := newIdentityTestServer(t, "alice")
+	handler := s.Handler()
+	for _, role := range []string{"admin", "oracle", "operator", "arbiter"} {
+		request := httptest.NewRequest(http.MethodPost, "/identities", strings.NewReader(`{"label":"mallory","role":"`+role+`","zone":"zone1","displayName":"Mallory"}`))
+		request.Header.Set(APIKeyHeader, "key-alice")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("got status %d enrolling role %s as a prosumer, want 403", recorder.Code, role)
+		}
+	}
+}
+
+func TestIdentityHeaderDoesNotMakeAnOperator(t *testing.T) {
+	s := newIdentityTestServer(t)
+	putTestIdentity(t, s.wallet, "root", "admin")
+	request := httptest.NewRequest(http.MethodPost, "/identities", strings.NewReader(`{"label":"mallory","role":"admin","zone":"zone1","displayName":"Mallory"}`))
+	request.Header.Set(IdentityHeader, "root")
+	recorder := httptest.NewRecorder()
+	s.enrollIdentity(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d enrolling an admin as a named operator without an API key, want 401", recorder.Code)
+	}
+}
+
+func TestEnrollmentNeedsAPIKeys(t *testing.T) {
+	s := newIdentityTestServer(t)
+	s.apiKeys = nil
+	handler := s.Handler()
+	for _, request := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/identities", strings.NewReader(`{"label":"mallory","role":"prosumer","zone":"zone1","displayName":"Mallory"}`)),
+		httptest.NewRequest(http.MethodDelete, "/identities/bob", nil),
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusNotFound && recorder.Code != http.StatusMethodNotAllowed {
+			t.Errorf("got status %d for %s %s without API keys, want the route missing", recorder.Code, request.Method, request.URL)
+		}
+	}
+}
+
+func TestRevokeIdentityRequiresOwnerOrOperator(t *testing.T) {
+	s := newIdentityTestServer(t, "alice")
+	request := httptest.NewRequest(http.MethodDelete, "/identities/bob", nil)
+	request.Header.Set(APIKeyHeader, "key-alice")
+	request.Header.Set(IdentityHeader, "bob")
+	recorder := httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("got status %d revoking another identity, want 403", recorder.Code)
+	}
+	if exists, err := s.wallet.Exists("bob"); err != nil || !exists {
+		t.Errorf("identity bob was removed from the wallet: %v", err)
+	}
+}
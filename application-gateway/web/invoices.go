@@ -0,0 +1,74 @@
+package web
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+)
+
+// invoice mirrors the chaincode Invoice document
+type invoice struct {
+	InvoiceNumber string        `json:"invoiceNumber"`
+	Participant   string        `json:"participant"`
+	Period        string        `json:"period"`
+	Lines         []invoiceLine `json:"lines"`
+	TotalCredits  float64       `json:"totalCredits"`
+	TotalCharges  float64       `json:"totalCharges"`
+	NetAmount     float64       `json:"netAmount"`
+}
+
+type invoiceLine struct {
+	Type        string  `json:"type"`
+	Reference   string  `json:"reference"`
+	Description string  `json:"description"`
+	Quantity    float64 `json:"quantity"`
+	Amount      float64 `json:"amount"`
+}
+
+// formatParam selects the invoice export format
+var formatParam = param{In: "query", Name: "format", Optional: true, Schema: map[string]interface{}{"type": "string", "enum": []string{"json", "csv"}}}
+
+// exportInvoice returns a participant's invoice for a billing period as JSON,
+// or with ?format=csv as a CSV file of its line items followed by the totals.
+func (s *Server) exportInvoice(w http.ResponseWriter, r *http.Request) {
+	contract, err := s.contract(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	result, err := contract.EvaluateTransaction("GetInvoice", r.PathValue("address"), r.PathValue("period"))
+	if err != nil {
+		metrics.FabricError("GetInvoice", metrics.StageEvaluate, err)
+		writeChaincodeError(w, r, http.StatusBadGateway, fabric.ErrorWithDetails(err))
+		return
+	}
+	if r.URL.Query().Get("format") != "csv" {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	var inv invoice
+	if err := json.Unmarshal(result, &inv); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", inv.InvoiceNumber+".csv"))
+	formatAmount := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	out := csv.NewWriter(w)
+	out.Write([]string{"invoiceNumber", "type", "reference", "description", "quantity", "amount"})
+	for _, line := range inv.Lines {
+		out.Write([]string{inv.InvoiceNumber, line.Type, line.Reference, line.Description, formatAmount(line.Quantity), formatAmount(line.Amount)})
+	}
+	out.Write([]string{inv.InvoiceNumber, "TOTAL_CREDITS", "", "", "", formatAmount(inv.TotalCredits)})
+	out.Write([]string{inv.InvoiceNumber, "TOTAL_CHARGES", "", "", "", formatAmount(-inv.TotalCharges)})
+	out.Write([]string{inv.InvoiceNumber, "NET", "", "", "", formatAmount(inv.NetAmount)})
+	out.Flush()
+}
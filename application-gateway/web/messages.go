@@ -0,0 +1,34 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+
+	"application-gateway/i18n"
+)
+
+// catalogSchema describes a message catalog
+var catalogSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"language":         stringSchema,
+		"decimalSeparator": stringSchema,
+		"errors":           map[string]interface{}{"type": "object", "additionalProperties": stringSchema},
+		"events": map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"title": stringSchema, "body": stringSchema},
+		}},
+	},
+}
+
+// getMessageCatalog returns the message templates of a language, for clients
+// that render error codes and events themselves
+func (s *Server) getMessageCatalog(w http.ResponseWriter, r *http.Request) {
+	language := r.PathValue("language")
+	catalog := i18n.Lookup(language)
+	if catalog == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no messages in language %q; languages are %v", language, i18n.Languages()))
+		return
+	}
+	writeJSON(w, http.StatusOK, catalog)
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"application-gateway/i18n"
+	"application-gateway/submission"
+)
+
+func TestWriteChaincodeError(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		language string
+		code     string
+		message  string
+	}{
+		{errors.New("chaincode response 500, account buyer1 has insufficient balance"), "fr-FR", i18n.CodeInsufficientBalance, "Le solde de buyer1 est insuffisant."},
+		{submission.ErrQueueFull, "es", i18n.CodeQueueFull, "La red está ocupada. Vuelva a intentarlo en un momento."},
+		{&submission.CommitFailedError{TransactionID: "tx1"}, "", i18n.CodeCommitFailed, "Transaction tx1 could not be recorded. Please try again."},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/accounts/buyer1", nil)
+		request.Header.Set("Accept-Language", test.language)
+		recorder := httptest.NewRecorder()
+		writeChaincodeError(recorder, request, http.StatusBadGateway, test.err)
+
+		var body map[string]string
+		if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body["error"] != test.err.Error() || body["code"] != test.code || body["message"] != test.message {
+			t.Errorf("got %v for %v, want code %s and message %q", body, test.err, test.code, test.message)
+		}
+	}
+}
+
+func TestGetMessageCatalog(t *testing.T) {
+	s := &Server{}
+	request := httptest.NewRequest(http.MethodGet, "/messages/de", nil)
+	request.SetPathValue("language", "de")
+	recorder := httptest.NewRecorder()
+	s.getMessageCatalog(recorder, request)
+	var catalog i18n.Catalog
+	if err := json.NewDecoder(recorder.Body).Decode(&catalog); err != nil || catalog.Language != "de" || catalog.Errors[i18n.CodeNotFound] == "" {
+		t.Errorf("got %d %+v, %v", recorder.Code, catalog, err)
+	}
+
+	request.SetPathValue("language", "xx")
+	recorder = httptest.NewRecorder()
+	s.getMessageCatalog(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a language without a catalog, want 404", recorder.Code)
+	}
+}
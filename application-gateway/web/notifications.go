@@ -0,0 +1,124 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"application-gateway/notify"
+)
+
+var errNotificationsDisabled = errors.New("notifications are not enabled on this gateway")
+
+// preferencesSchema describes the notification preferences of a user
+var preferencesSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"address":       map[string]interface{}{"type": "string"},
+		"email":         map[string]interface{}{"type": "string"},
+		"webhookURL":    map[string]interface{}{"type": "string"},
+		"webhookSecret": map[string]interface{}{"type": "string"},
+		"pushToken":     map[string]interface{}{"type": "string"},
+		"events":        eventsSchema,
+		"updatedAt":     map[string]interface{}{"type": "string"},
+	},
+}
+
+// eventsSchema maps notification kinds to the channels they are sent on
+var eventsSchema = map[string]interface{}{
+	"type": "object",
+	"additionalProperties": map[string]interface{}{
+		"type":  "array",
+		"items": map[string]interface{}{"type": "string", "enum": []string{notify.ChannelPush, notify.ChannelEmail, notify.ChannelWebhook}},
+	},
+}
+
+// preferencesParams are the body fields of a preferences update
+var preferencesParams = []param{
+	{In: "body", Name: "email", Optional: true, Schema: map[string]interface{}{"type": "string"}},
+	{In: "body", Name: "webhookURL", Optional: true, Schema: map[string]interface{}{"type": "string"}},
+	{In: "body", Name: "pushToken", Optional: true, Schema: map[string]interface{}{"type": "string"}},
+	{In: "body", Name: "events", Schema: eventsSchema},
+}
+
+// callerAddress returns the address of the identity a request runs as
+func (s *Server) callerAddress(r *http.Request) (string, error) {
+	label, err := s.identityLabel(r)
+	if err != nil {
+		return "", err
+	}
+	id, err := s.wallet.Get(label)
+	if err != nil {
+		return "", err
+	}
+	return id.Address()
+}
+
+// preferencesAddress checks that notifications are enabled and returns the
+// caller's address, writing the error response if it cannot
+func (s *Server) preferencesAddress(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if s.notifications == nil {
+		writeError(w, http.StatusNotFound, errNotificationsDisabled)
+		return "", false
+	}
+	address, err := s.callerAddress(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return "", false
+	}
+	return address, true
+}
+
+func (s *Server) getPreferences(w http.ResponseWriter, r *http.Request) {
+	address, ok := s.preferencesAddress(w, r)
+	if !ok {
+		return
+	}
+	prefs, err := s.notifications.Preferences(address)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if prefs == nil {
+		prefs = &notify.Preferences{Address: address, Events: map[string][]string{}}
+	}
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// putPreferences replaces the caller's notification preferences
+func (s *Server) putPreferences(w http.ResponseWriter, r *http.Request) {
+	address, ok := s.preferencesAddress(w, r)
+	if !ok {
+		return
+	}
+	var prefs notify.Preferences
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	prefs.Address = address
+	if err := prefs.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	stored, err := s.notifications.SetPreferences(&prefs, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stored)
+}
+
+// deletePreferences stops all of the caller's notifications
+func (s *Server) deletePreferences(w http.ResponseWriter, r *http.Request) {
+	address, ok := s.preferencesAddress(w, r)
+	if !ok {
+		return
+	}
+	if err := s.notifications.DeletePreferences(address); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &notify.Preferences{Address: address, Events: map[string][]string{}})
+}
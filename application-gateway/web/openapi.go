@@ -0,0 +1,268 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"application-gateway/fabric"
+	"application-gateway/metrics"
+)
+
+// metadataFunction is the contract API system function that returns the
+// chaincode's contract metadata
+const metadataFunction = "org.hyperledger.fabric:GetMetadata"
+
+// endpoint is a route's handler together with the description its OpenAPI
+// operation is generated from. The arguments and results of chaincode
+// functions are typed from the chaincode's contract metadata; a route the
+// gateway answers itself describes its result in Result.
+type endpoint struct {
+	Function string
+	Submit   bool
+	Name     string
+	Summary  string
+	Params   []param
+	Result   map[string]interface{}
+	CSV      bool
+	handler  http.HandlerFunc
+}
+
+// route is an endpoint registered under a pattern
+type route struct {
+	Pattern string
+	endpoint
+}
+
+func allParams(groups []args) []param {
+	var all []param
+	for _, group := range groups {
+		all = append(all, group.Params...)
+	}
+	return all
+}
+
+// transactionMetadata is the metadata of one chaincode function
+type transactionMetadata struct {
+	Name       string `json:"name"`
+	Parameters []struct {
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+	} `json:"parameters"`
+	Returns json.RawMessage `json:"returns"`
+}
+
+// chaincodeMetadata is the part of the contract API metadata the OpenAPI
+// document is generated from
+type chaincodeMetadata struct {
+	Info struct {
+		Version string `json:"version"`
+	} `json:"info"`
+	Contracts map[string]struct {
+		Default      bool                  `json:"default"`
+		Transactions []transactionMetadata `json:"transactions"`
+	} `json:"contracts"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties           json.RawMessage `json:"properties"`
+			Required             []string        `json:"required"`
+			AdditionalProperties bool            `json:"additionalProperties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func errorResponse(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaRef("Error")}},
+	}
+}
+
+// openAPIDocument generates the OpenAPI 3 document of the registered routes
+// from the metadata of the chaincode's default contract
+func (s *Server) openAPIDocument(metadataJSON []byte) (map[string]interface{}, error) {
+	var metadata chaincodeMetadata
+	if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid chaincode metadata: %w", err)
+	}
+	transactions := map[string]transactionMetadata{}
+	for _, contract := range metadata.Contracts {
+		if !contract.Default {
+			continue
+		}
+		for _, tx := range contract.Transactions {
+			transactions[tx.Name] = tx
+		}
+	}
+
+	schemas := map[string]interface{}{
+		// Failed chaincode calls also carry a message code and the message
+		// in the language of the Accept-Language header
+		"Error": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"error":   map[string]interface{}{"type": "string"},
+				"code":    map[string]interface{}{"type": "string"},
+				"message": map[string]interface{}{"type": "string"},
+			},
+		},
+		"TransactionResult": map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"transactionID": map[string]interface{}{"type": "string"}},
+		},
+	}
+	for name, object := range metadata.Components.Schemas {
+		schema := map[string]interface{}{"type": "object", "properties": object.Properties, "additionalProperties": object.AdditionalProperties}
+		if len(object.Required) > 0 {
+			schema["required"] = object.Required
+		}
+		schemas[name] = schema
+	}
+
+	paths := map[string]map[string]interface{}{}
+	for _, rt := range s.routes {
+		method, path, _ := strings.Cut(rt.Pattern, " ")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(method)] = s.operation(rt.endpoint, transactions[rt.Function])
+	}
+
+	version := metadata.Info.Version
+	if version == "" {
+		version = "latest"
+	}
+	components := map[string]interface{}{"schemas": schemas}
+	document := map[string]interface{}{
+		"openapi":    "3.0.3",
+		"info":       map[string]interface{}{"title": "Energy Trading API", "version": version},
+		"paths":      paths,
+		"components": components,
+	}
+	if s.apiKeys != nil {
+		components["securitySchemes"] = map[string]interface{}{
+			"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": APIKeyHeader},
+		}
+		document["security"] = []map[string][]string{{"apiKey": {}}}
+	}
+	return document, nil
+}
+
+// operation generates the OpenAPI operation of an endpoint. Chaincode
+// arguments are matched to the function's parameters by position.
+func (s *Server) operation(e endpoint, tx transactionMetadata) map[string]interface{} {
+	operationID, summary := e.Name, e.Summary
+	if operationID == "" {
+		operationID = e.Function
+	}
+	if summary == "" && e.Submit {
+		summary = fmt.Sprintf("Submits %s", e.Function)
+	} else if summary == "" {
+		summary = fmt.Sprintf("Evaluates %s", e.Function)
+	}
+
+	stringSchema := map[string]interface{}{"type": "string"}
+	parameters := []map[string]interface{}{}
+	if s.apiKeys == nil {
+		parameters = append(parameters, map[string]interface{}{"name": IdentityHeader, "in": "header", "schema": stringSchema})
+	}
+	if e.Submit {
+		parameters = append(parameters, map[string]interface{}{"name": "Idempotency-Key", "in": "header", "schema": stringSchema})
+	}
+	properties, required := map[string]interface{}{}, []string{}
+	arg := 0
+	for _, p := range e.Params {
+		var schema interface{} = p.Schema
+		if p.Schema == nil {
+			schema = stringSchema
+			if arg < len(tx.Parameters) && len(tx.Parameters[arg].Schema) > 0 {
+				schema = tx.Parameters[arg].Schema
+			}
+			arg++
+		}
+		if p.In == "body" {
+			properties[p.Name] = schema
+			if !p.Optional {
+				required = append(required, p.Name)
+			}
+			continue
+		}
+		parameters = append(parameters, map[string]interface{}{"name": p.Name, "in": p.In, "required": !p.Optional, "schema": schema})
+	}
+
+	var result interface{} = e.Result
+	switch {
+	case e.Result != nil:
+	case len(tx.Returns) > 0:
+		result = tx.Returns
+	case e.Submit:
+		result = schemaRef("TransactionResult")
+	default:
+		result = map[string]interface{}{}
+	}
+	content := map[string]interface{}{"application/json": map[string]interface{}{"schema": result}}
+	if e.CSV {
+		content["text/csv"] = map[string]interface{}{"schema": stringSchema}
+	}
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{"description": "OK", "content": content},
+		"400": errorResponse("Invalid request"),
+		"401": errorResponse("Unknown identity or API key"),
+	}
+	if e.Function != "" {
+		responses["502"] = errorResponse("The chaincode rejected the request or the network failed")
+	}
+	if e.Submit {
+		responses["409"] = errorResponse("The transaction failed to commit")
+		responses["503"] = errorResponse("The submission queue is full")
+	}
+	if s.apiKeys != nil {
+		responses["403"] = errorResponse("The API key's role may not call this route")
+		responses["429"] = errorResponse("The API key's request quota is used up")
+	}
+
+	operation := map[string]interface{}{
+		"operationId": operationID,
+		"summary":     summary,
+		"parameters":  parameters,
+		"responses":   responses,
+	}
+	if len(properties) > 0 {
+		body := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			body["required"] = required
+		}
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": body}},
+		}
+	}
+	return operation
+}
+
+// openAPI serves the OpenAPI document, generated from the metadata of the
+// chaincode currently deployed
+func (s *Server) openAPI(w http.ResponseWriter, r *http.Request) {
+	contract, err := s.contract(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	metadataJSON, err := contract.EvaluateTransaction(metadataFunction)
+	if err != nil {
+		metrics.FabricError(metadataFunction, metrics.StageEvaluate, err)
+		writeError(w, http.StatusBadGateway, fabric.ErrorWithDetails(err))
+		return
+	}
+	document, err := s.openAPIDocument(metadataJSON)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, document)
+}
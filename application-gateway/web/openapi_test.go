@@ -0,0 +1,114 @@
+package web
+
+import (
+	"encoding/json"
+	"testing"
+
+	"application-gateway/apikeys"
+)
+
+const testMetadata = `{
+  "info": {"version": "1.4.0"},
+  "contracts": {
+    "EnergyTradingContract": {
+      "default": true,
+      "transactions": [
+        {"name": "ReadEnergyAsset", "parameters": [{"name": "param0", "schema": {"type": "string"}}],
+         "returns": {"$ref": "#/components/schemas/EnergyAsset"}},
+        {"name": "TransferTokens", "parameters": [
+          {"name": "param0", "schema": {"type": "string"}},
+          {"name": "param1", "schema": {"type": "number", "format": "double"}},
+          {"name": "param2", "schema": {"type": "integer", "format": "int64"}}]}
+      ]
+    }
+  },
+  "components": {"schemas": {"EnergyAsset": {"$id": "EnergyAsset", "required": ["tokenID"],
+    "properties": {"tokenID": {"type": "string"}}, "additionalProperties": false}}}
+}`
+
+// generateTestDocument generates the OpenAPI document of the gateway routes
+// and decodes it back from JSON
+func generateTestDocument(t *testing.T, s *Server) map[string]interface{} {
+	s.Handler()
+	document, err := s.openAPIDocument([]byte(testMetadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	documentJSON, err := json.Marshal(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(documentJSON, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+// lookup follows a path of keys through decoded JSON objects
+func lookup(t *testing.T, value interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			t.Fatalf("no object at %s in %v", key, keys)
+		}
+		value = object[key]
+	}
+	return value
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	document := generateTestDocument(t, &Server{})
+
+	if got := lookup(t, document, "info", "version"); got != "1.4.0" {
+		t.Errorf("got version %v, want the chaincode's 1.4.0", got)
+	}
+	read := lookup(t, document, "paths", "/trades/{id}", "get")
+	if got := lookup(t, read, "operationId"); got != "ReadEnergyAsset" {
+		t.Errorf("got operation %v, want ReadEnergyAsset", got)
+	}
+	if got := lookup(t, read, "responses", "200", "content", "application/json", "schema", "$ref"); got != "#/components/schemas/EnergyAsset" {
+		t.Errorf("got result %v, want an EnergyAsset reference", got)
+	}
+	if got := lookup(t, document, "components", "schemas", "EnergyAsset", "type"); got != "object" {
+		t.Errorf("got component type %v, want object", got)
+	}
+
+	body := lookup(t, document, "paths", "/transfers", "post", "requestBody", "content", "application/json", "schema")
+	if got := lookup(t, body, "properties", "amount", "type"); got != "number" {
+		t.Errorf("got amount type %v, want number", got)
+	}
+	if got := lookup(t, body, "properties", "expectedVersion", "type"); got != "integer" {
+		t.Errorf("got expectedVersion type %v, want integer", got)
+	}
+	if got, ok := lookup(t, body, "required").([]interface{}); !ok || len(got) != 2 {
+		t.Errorf("got required fields %v, want to and amount", got)
+	}
+	if lookup(t, document, "paths", "/transfers", "post", "responses", "503") == nil {
+		t.Error("submissions should document the full submission queue")
+	}
+
+	trade := lookup(t, document, "paths", "/trades", "post", "requestBody", "content", "application/json", "schema")
+	if got := lookup(t, trade, "properties", "private", "type"); got != "object" {
+		t.Errorf("got private terms type %v, want object", got)
+	}
+	if lookup(t, document, "paths", "/identities", "post") != nil {
+		t.Error("document without API keys should not offer enrollment")
+	}
+	if document["security"] != nil {
+		t.Error("document without API keys should not require them")
+	}
+
+	keys, err := apikeys.New(&apikeys.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	document = generateTestDocument(t, &Server{apiKeys: keys})
+	enroll := lookup(t, document, "paths", "/identities", "post", "requestBody", "content", "application/json", "schema")
+	if got := lookup(t, enroll, "properties", "meterIDs", "type"); got != "array" {
+		t.Errorf("got meterIDs type %v, want array", got)
+	}
+	if got, ok := lookup(t, enroll, "required").([]interface{}); !ok || len(got) != 4 {
+		t.Errorf("got required fields %v, want label, role, zone and displayName", got)
+	}
+}
@@ -0,0 +1,543 @@
+// Package web exposes the energy trading chaincode over REST through the
+// Fabric Gateway.
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"application-gateway/apikeys"
+	"application-gateway/audit"
+	"application-gateway/ca"
+	"application-gateway/fabric"
+	"application-gateway/i18n"
+	"application-gateway/metrics"
+	"application-gateway/notify"
+	"application-gateway/push"
+	"application-gateway/submission"
+	"application-gateway/wallet"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"google.golang.org/grpc"
+)
+
+// IdentityHeader selects the wallet identity a request is submitted as
+const IdentityHeader = "X-Wallet-Identity"
+
+// APIKeyHeader carries the client's API key when the gateway requires keys
+const APIKeyHeader = "X-API-Key"
+
+// Config holds the network and wallet settings of the gateway service
+type Config struct {
+	PeerEndpoint    string
+	GatewayPeer     string
+	TLSCertPath     string
+	ChannelName     string
+	ChaincodeName   string
+	WalletPath      string
+	DefaultIdentity string
+	ListenAddress   string
+	APIKeysPath     string
+	DBPath          string
+	// HSM, when HSM.Library is set, signs for wallet identities whose keys
+	// are in PKCS#11 tokens
+	HSM wallet.HSMConfig
+	// CA enrolls new identities when CA.URL is set, acting as the wallet
+	// identity RegistrarIdentity
+	CA                ca.Config
+	RegistrarIdentity string
+	// Submission sets the capacity and retries of the submission queue
+	Submission submission.Config
+	// IndexerURL is the indexer the admin console reads trades and oracle
+	// postings from, if set
+	IndexerURL string
+}
+
+// Server holds one gRPC connection to the gateway peer and a Gateway
+// connection per wallet identity that has been used. With API keys
+// configured, every request needs a key and runs as the key's identity.
+// With a database configured, users keep their notification preferences in
+// it and every API call is recorded in its audit log. With a Fabric CA
+// configured, new users are enrolled through the gateway, and with an
+// indexer configured the admin console reports on overdue trades.
+// Submissions are run through a queue that gives settlements priority.
+type Server struct {
+	config        Config
+	wallet        *wallet.Wallet
+	apiKeys       *apikeys.Store
+	notifications *notify.Store
+	audit         *audit.Store
+	enrollment    *ca.Client
+	indexerClient *http.Client
+	submissions   *submission.Queue
+	connection    *grpc.ClientConn
+
+	routes []route
+
+	mu       sync.Mutex
+	gateways map[string]*client.Gateway
+}
+
+// NewServer connects to the gateway peer and opens the wallet
+func NewServer(config Config) (*Server, error) {
+	w, err := wallet.New(config.WalletPath)
+	if err != nil {
+		return nil, err
+	}
+	if config.HSM.Library != "" {
+		if err := w.UseHSM(config.HSM); err != nil {
+			return nil, err
+		}
+	}
+	var keys *apikeys.Store
+	if config.APIKeysPath != "" {
+		if keys, err = apikeys.Load(config.APIKeysPath); err != nil {
+			return nil, err
+		}
+	} else if err := requireSingleIdentity(w); err != nil {
+		return nil, err
+	}
+	var enrollment *ca.Client
+	if config.CA.URL != "" {
+		registrar, err := w.Get(config.RegistrarIdentity)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the CA registrar: %w", err)
+		}
+		if enrollment, err = ca.New(config.CA, registrar); err != nil {
+			return nil, err
+		}
+	}
+	var notifications *notify.Store
+	var auditLog *audit.Store
+	if config.DBPath != "" {
+		if notifications, err = notify.Open(config.DBPath); err != nil {
+			return nil, err
+		}
+		if auditLog, err = audit.Open(config.DBPath); err != nil {
+			notifications.Close()
+			return nil, err
+		}
+	}
+	connection, err := fabric.NewGrpcConnection(fabric.PeerConfig{
+		PeerEndpoint: config.PeerEndpoint,
+		GatewayPeer:  config.GatewayPeer,
+		TLSCertPath:  config.TLSCertPath,
+	})
+	if err != nil {
+		if notifications != nil {
+			notifications.Close()
+			auditLog.Close()
+		}
+		return nil, err
+	}
+	var indexerClient *http.Client
+	if config.IndexerURL != "" {
+		indexerClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &Server{
+		config:        config,
+		wallet:        w,
+		apiKeys:       keys,
+		notifications: notifications,
+		audit:         auditLog,
+		enrollment:    enrollment,
+		indexerClient: indexerClient,
+		submissions:   submission.New(config.Submission),
+		connection:    connection,
+		gateways:      map[string]*client.Gateway{},
+	}, nil
+}
+
+// requireSingleIdentity refuses a wallet of several identities when API keys
+// are off. Requests then name their identity themselves, so any caller could
+// act as any identity in the wallet.
+func requireSingleIdentity(w *wallet.Wallet) error {
+	labels, err := w.List()
+	if err != nil {
+		return err
+	}
+	if len(labels) > 1 {
+		return fmt.Errorf("the wallet holds %d identities, so API keys are required to tell callers apart", len(labels))
+	}
+	return nil
+}
+
+// Close closes every Gateway connection, the gRPC connection and the database
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, gateway := range s.gateways {
+		gateway.Close()
+	}
+	s.connection.Close()
+	if s.notifications != nil {
+		s.notifications.Close()
+	}
+	if s.audit != nil {
+		s.audit.Close()
+	}
+	s.wallet.Close()
+}
+
+// identityLabel returns the wallet identity a request runs as: the identity
+// of its API key, or else the identity named in the request. Browsers cannot
+// set headers on WebSocket requests, so the identity may also be given in
+// the "identity" query parameter.
+func (s *Server) identityLabel(r *http.Request) (string, error) {
+	if keyClient, ok := apikeys.FromContext(r.Context()); ok {
+		return keyClient.Identity, nil
+	}
+	label := r.Header.Get(IdentityHeader)
+	if label == "" {
+		label = r.URL.Query().Get("identity")
+	}
+	if label == "" {
+		label = s.config.DefaultIdentity
+	}
+	if label == "" {
+		return "", fmt.Errorf("%s header is required", IdentityHeader)
+	}
+	return label, nil
+}
+
+// network returns the channel for the request's identity
+func (s *Server) network(r *http.Request) (*client.Network, error) {
+	label, err := s.identityLabel(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.networkAs(label)
+}
+
+// networkAs returns the channel for a wallet identity, connecting that
+// identity on first use
+func (s *Server) networkAs(label string) (*client.Network, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gateway, ok := s.gateways[label]
+	if !ok {
+		id, err := s.wallet.Get(label)
+		if err != nil {
+			return nil, err
+		}
+		gateway, err = fabric.Connect(s.connection, id)
+		if err != nil {
+			return nil, err
+		}
+		s.gateways[label] = gateway
+	}
+	return gateway.GetNetwork(s.config.ChannelName), nil
+}
+
+// disconnect closes the Gateway connection of a wallet identity whose
+// credentials have changed, so that the next use connects with the new ones
+func (s *Server) disconnect(label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gateway, ok := s.gateways[label]; ok {
+		gateway.Close()
+		delete(s.gateways, label)
+	}
+}
+
+// contract returns the chaincode contract for the identity named in the request
+func (s *Server) contract(r *http.Request) (*client.Contract, error) {
+	network, err := s.network(r)
+	if err != nil {
+		return nil, err
+	}
+	return network.GetContract(s.config.ChaincodeName), nil
+}
+
+// events serves the WebSocket event stream as the request's identity
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	network, err := s.network(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	push.NewHandler(network, network.GetContract(s.config.ChaincodeName)).ServeHTTP(w, r)
+}
+
+// authorize checks the API key of a request to a route against the key's
+// role and quotas, and passes the key's client on to the handler. Without
+// API keys configured every request is passed on as is. Like the identity,
+// the key may be given in the "apiKey" query parameter for WebSockets.
+func (s *Server) authorize(route string, handler http.Handler) http.Handler {
+	if s.apiKeys == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(APIKeyHeader)
+		if key == "" {
+			key = r.URL.Query().Get("apiKey")
+		}
+		if key == "" {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("%s header is required", APIKeyHeader))
+			return
+		}
+		keyClient, err := s.apiKeys.Authenticate(key)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if !s.apiKeys.Allowed(keyClient, route) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("role %s may not call %s", keyClient.Role, route))
+			return
+		}
+		if retryAfter, ok := s.apiKeys.Take(keyClient, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+0.999)))
+			writeError(w, http.StatusTooManyRequests, fmt.Errorf("request quota of %s is used up", keyClient.Name))
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(apikeys.NewContext(r.Context(), keyClient)))
+	})
+}
+
+// Handler returns the HTTP routes of the service. Every route but the
+// long-lived event stream records its latency, and every route but the
+// metrics is subject to API keys. The routes registered with handle make up
+// the OpenAPI document and are recorded in the audit log.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.routes = nil
+	handle := func(pattern string, e endpoint) {
+		s.routes = append(s.routes, route{Pattern: pattern, endpoint: e})
+		mux.Handle(pattern, metrics.Instrument(pattern, s.authorize(pattern, s.audited(pattern, e.Function, e.handler))))
+	}
+	handle("GET /identities", endpoint{
+		Name:    "ListIdentities",
+		Summary: "Lists the identity labels in the wallet",
+		Result:  map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		handler: s.listIdentities,
+	})
+
+	// Enrollment and revocation act on identities other than the caller's,
+	// so they are only served when API keys authenticate the caller
+	if s.apiKeys != nil {
+		handle("POST /identities", endpoint{
+			Name:    "EnrollIdentity",
+			Summary: "Enrolls a user with the Fabric CA and registers its participant record",
+			Params:  enrollmentParams,
+			Result:  enrollmentSchema,
+			handler: s.enrollIdentity,
+		})
+		handle("DELETE /identities/{label}", endpoint{
+			Name:    "RevokeIdentity",
+			Summary: "Revokes an identity and its certificates with the Fabric CA and removes it from the wallet",
+			Params:  append(params("path", false, []string{"label"}), params("query", true, []string{"reason"})...),
+			Result:  revocationSchema,
+			handler: s.revokeIdentity,
+		})
+	}
+	handle("POST /identities/{label}/rotation", endpoint{
+		Name:    "RotateIdentity",
+		Summary: "Re-enrolls the caller's identity with a new key and revokes the old certificate",
+		Params:  params("path", false, []string{"label"}),
+		Result:  enrollmentSchema,
+		handler: s.rotateIdentity,
+	})
+
+	handle("GET /accounts/{id}", s.evaluate("ReadTokenAccount", pathArgs("id")))
+	handle("POST /accounts/{id}/mint", s.submit("MintTokens", pathArgs("id"), bodyArgs("amount")))
+	handle("POST /transfers", s.submit("TransferTokens", bodyArgs("to", "amount"), expectedVersionArg()))
+
+	handle("GET /trades", s.evaluate("GetTradesByDeliveryWindow", queryArgs("from", "to", "pageSize", "bookmark")))
+	handle("POST /trades", endpoint{
+		Function: "CreateEnergyAsset",
+		Submit:   true,
+		Params:   append(tradeArgs.Params, privateTermsParam),
+		handler:  s.createTrade,
+	})
+	handle("GET /trades/{id}", s.evaluate("ReadEnergyAsset", pathArgs("id")))
+	handle("GET /trades/{id}/signing-payload", s.evaluate("GetSigningPayload", pathArgs("id")))
+	handle("POST /trades/{id}/signatures", s.submit("SignEnergyAsset", pathArgs("id"), bodyArgs("signature"), expectedVersionArg()))
+	handle("POST /trades/{id}/delivery", s.submit("ConfirmDelivery", pathArgs("id"), expectedVersionArg()))
+	handle("POST /trades/{id}/reconciliation", s.submit("ReconcileDelivery", pathArgs("id")))
+	handle("GET /trades/{id}/settlement", s.evaluate("GetSettlement", pathArgs("id")))
+
+	handle("POST /community-orders", s.submit("SubmitCommunityOrder", bodyArgs("orderID", "side", "intervalStart", "sourceType", "energy", "limitPrice")))
+	handle("GET /community-orders/{id}", s.evaluate("GetCommunityOrder", pathArgs("id")))
+	handle("DELETE /community-orders/{id}", s.submit("CancelCommunityOrder", pathArgs("id")))
+	handle("POST /clearing/{interval}/communities/{zone}", s.submit("ClearIntraCommunity", pathArgs("zone", "interval")))
+	handle("POST /clearing/{interval}/inter-community", s.submit("ClearInterCommunity", pathArgs("interval")))
+	handle("GET /clearing/{interval}", s.evaluate("GetClearingRounds", pathArgs("interval"), queryArgs("pageSize", "bookmark")))
+
+	handle("POST /meters/{id}/readings", s.submit("SubmitMeterReading", pathArgs("id"), bodyArgs("intervalStart", "kWhInjected", "kWhConsumed", "signature")))
+
+	handle("GET /self-consumption/{address}", s.evaluate("GetSelfConsumptionRecords", pathArgs("address"), queryArgs("from", "to", "pageSize", "bookmark")))
+	handle("GET /self-consumption/{address}/summary", s.evaluate("GetSelfConsumptionSummary", pathArgs("address"), queryArgs("from", "to")))
+
+	handle("GET /reputation/{address}", s.evaluate("ReadReputationScore", pathArgs("address")))
+
+	handle("GET /tariff", s.evaluate("GetTOUTariff", queryArgs("pageSize", "bookmark")))
+	handle("GET /tariff/rate", s.evaluate("GetTariffRate", queryArgs("at")))
+	handle("PUT /tariff/seasons/{season}", s.submit("SetTariffSeason", pathArgs("season"), bodyArgs("months", "peakHours", "peakImportRate", "offPeakImportRate", "peakExportRate", "offPeakExportRate")))
+	handle("DELETE /tariff/seasons/{season}", s.submit("RemoveTariffSeason", pathArgs("season")))
+	handle("GET /tariff/settlements/{address}", s.evaluate("GetFallbackSettlements", pathArgs("address"), queryArgs("from", "to", "pageSize", "bookmark")))
+
+	handle("GET /demand-charges/{zone}/{period}/peak", s.evaluate("GetCommunityPeak", pathArgs("zone", "period")))
+	handle("POST /demand-charges/{zone}/{period}", s.submit("AllocateDemandCharge", pathArgs("zone", "period"), bodyArgs("charge")))
+	handle("GET /demand-charges/{zone}/{period}", s.evaluate("GetDemandChargeAllocation", pathArgs("zone", "period")))
+	handle("POST /demand-charges/{zone}/{period}/payment", s.submit("PayDemandCharge", pathArgs("zone", "period")))
+
+	handle("PUT /transformers/{zone}", s.submit("SetTransformer", pathArgs("zone"), bodyArgs("rating", "warningThreshold")))
+	handle("GET /transformers/{zone}", s.evaluate("GetTransformer", pathArgs("zone")))
+	handle("GET /transformers/{zone}/load/{interval}", s.evaluate("GetTransformerLoad", pathArgs("zone", "interval")))
+
+	handle("GET /baselines/{address}/methodology", s.evaluate("GetBaselineMethodology", pathArgs("address")))
+	handle("PUT /baselines/{address}/methodology", s.submit("SetBaselineMethodology", pathArgs("address"), bodyArgs("methodology", "days", "lookback")))
+	handle("POST /baselines/{address}", s.submit("ComputeBaseline", pathArgs("address"), bodyArgs("quantity", "start", "end")))
+	handle("POST /baselines/{address}/commitments", s.submit("CommitBaseline", pathArgs("address"), bodyArgs("quantity", "start", "end", "value")))
+	handle("GET /baselines/{address}/{quantity}/{start}", s.evaluate("GetBaseline", pathArgs("address", "quantity", "start")))
+	handle("POST /baselines/{address}/{quantity}/{start}/verification", s.submit("VerifyBaseline", pathArgs("address", "quantity", "start")))
+
+	handle("POST /invoices", s.submit("CloseBillingPeriod", bodyArgs("participant", "period")))
+	handle("GET /invoices/{address}", s.evaluate("GetInvoices", pathArgs("address"), queryArgs("pageSize", "bookmark")))
+	handle("GET /invoices/{address}/{period}", endpoint{
+		Function: "GetInvoice",
+		Name:     "ExportInvoice",
+		Summary:  "Evaluates GetInvoice, as JSON or as CSV line items",
+		Params:   append(pathArgs("address", "period").Params, formatParam),
+		CSV:      true,
+		handler:  s.exportInvoice,
+	})
+
+	handle("GET /notifications/preferences", endpoint{
+		Name:    "GetNotificationPreferences",
+		Summary: "Returns the caller's notification preferences",
+		Result:  preferencesSchema,
+		handler: s.getPreferences,
+	})
+	handle("PUT /notifications/preferences", endpoint{
+		Name:    "SetNotificationPreferences",
+		Summary: "Replaces the caller's notification preferences",
+		Params:  preferencesParams,
+		Result:  preferencesSchema,
+		handler: s.putPreferences,
+	})
+	handle("DELETE /notifications/preferences", endpoint{
+		Name:    "DeleteNotificationPreferences",
+		Summary: "Stops all of the caller's notifications",
+		Result:  preferencesSchema,
+		handler: s.deletePreferences,
+	})
+
+	handle("GET /messages/{language}", endpoint{
+		Name:    "GetMessageCatalog",
+		Summary: "Returns the localized messages of the error codes and events in a language",
+		Params:  params("path", false, []string{"language"}),
+		Result:  catalogSchema,
+		handler: s.getMessageCatalog,
+	})
+
+	// Only API keys tell operators apart, so neither the audit log nor the
+	// admin console is served without them
+	if s.apiKeys != nil {
+		handle("GET /audit", s.operatorOnly(endpoint{
+			Name:    "ListAuditEntries",
+			Summary: "Lists the audit log from entry from on",
+			Params:  params("query", true, []string{"from", "limit"}),
+			Result:  map[string]interface{}{"type": "array", "items": auditEntrySchema},
+			handler: s.listAuditEntries,
+		}))
+		handle("GET /audit/verification", s.operatorOnly(endpoint{
+			Name:    "VerifyAuditLog",
+			Summary: "Verifies the audit log's hash chain and the transactions of entries from to to against the ledger",
+			Params:  params("query", true, []string{"from", "to"}),
+			Result:  verificationSchema,
+			handler: s.verifyAuditLog,
+		}))
+
+		handle("GET /admin/health", s.operatorOnly(endpoint{
+			Name:    "GetHealthSummary",
+			Summary: "Counts stuck trades, failed settlements, accounts below reserve and open disputes, and lists stale oracle feeds",
+			Result:  healthSummarySchema,
+			handler: s.getHealthSummary,
+		}))
+		handle("GET /admin/stuck-trades", s.operatorOnly(endpoint{
+			Name:    "ListStuckTrades",
+			Summary: "Lists trades still awaiting confirmation after their delivery started",
+			Params:  params("query", true, []string{"limit"}),
+			Result:  indexedTradesSchema,
+			handler: s.overdueTradesHandler("/trades/stuck", 0),
+		}))
+		handle("GET /admin/failed-settlements", s.operatorOnly(endpoint{
+			Name:    "ListFailedSettlements",
+			Summary: "Lists confirmed trades still unsettled an hour after their delivery ended",
+			Params:  params("query", true, []string{"limit"}),
+			Result:  indexedTradesSchema,
+			handler: s.overdueTradesHandler("/trades/unsettled", settlementGrace),
+		}))
+		handle("GET /admin/accounts-below-reserve", s.operatorOnly(s.evaluate("GetAccountsBelowReserve", queryArgs("pageSize", "bookmark"))))
+		handle("GET /admin/account-reserve", s.operatorOnly(s.evaluate("GetAccountReserve")))
+		handle("PUT /admin/account-reserve", s.operatorOnly(s.submit("SetAccountReserve", bodyArgs("minimumBalance"))))
+		handle("GET /admin/disputes", s.operatorOnly(s.evaluate("GetOpenMeterDisputes", queryArgs("pageSize", "bookmark"))))
+		handle("GET /admin/oracles", s.operatorOnly(endpoint{
+			Name:    "GetOracleStatuses",
+			Summary: "Reports when each oracle feed was last posted and whether it is stale",
+			Result:  oracleStatusSchema,
+			handler: s.getOracleStatuses,
+		}))
+	}
+
+	mux.Handle("GET /openapi.json", metrics.Instrument("GET /openapi.json", s.authorize("GET /openapi.json", http.HandlerFunc(s.openAPI))))
+	mux.Handle("GET /events", s.authorize("GET /events", http.HandlerFunc(s.events)))
+	mux.Handle("GET /metrics", metrics.Handler())
+	return mux
+}
+
+// Serve starts the HTTP server
+func (s *Server) Serve() error {
+	log.Printf("Listening on %s", s.config.ListenAddress)
+	return http.ListenAndServe(s.config.ListenAddress, s.Handler())
+}
+
+func (s *Server) listIdentities(w http.ResponseWriter, r *http.Request) {
+	labels, err := s.wallet.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, labels)
+}
+
+// writeJSON writes a value, or raw JSON returned by the chaincode, as the response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if raw, ok := value.([]byte); ok {
+		if len(raw) == 0 {
+			raw = []byte("null")
+		}
+		w.Write(raw)
+		return
+	}
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeChaincodeError writes a failed chaincode call's error with its
+// message code and, in the language the request accepts, its message
+func writeChaincodeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	code, params := i18n.Classify(err.Error())
+	var commitErr *submission.CommitFailedError
+	switch {
+	case errors.Is(err, submission.ErrQueueFull):
+		code, params = i18n.CodeQueueFull, nil
+	case errors.As(err, &commitErr):
+		code, params = i18n.CodeCommitFailed, map[string]string{"transactionID": commitErr.TransactionID}
+	}
+	language := i18n.Negotiate(r.Header.Get("Accept-Language"))
+	w.Header().Set("Content-Language", language)
+	writeJSON(w, status, map[string]string{"error": err.Error(), "code": code, "message": i18n.Error(language, code, params)})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Certificate attributes issued by the Fabric CA at enrollment, e.g.
+// `fabric-ca-client register --id.attrs 'energy.address=buyer1:ecert,energy.role=admin:ecert'`
+const (
+	AddressAttribute = "energy.address"
+	RoleAttribute    = "energy.role"
+)
+
+// callerAddress returns the trading address of the submitting identity. It is
+// taken from the energy.address certificate attribute, falling back to the
+// unique client ID when the attribute is absent.
+func callerAddress(ctx contractapi.TransactionContextInterface) (string, error) {
+	address, found, err := ctx.GetClientIdentity().GetAttributeValue(AddressAttribute)
+	if err != nil {
+		return "", fmt.Errorf("failed to read client address attribute: %v", err)
+	}
+	if found && address != "" {
+		return address, nil
+	}
+	id, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read client identity: %v", err)
+	}
+	return id, nil
+}
+
+// callerRole returns the energy.role certificate attribute of the submitting
+// identity, or an empty string if it has none.
+func callerRole(ctx contractapi.TransactionContextInterface) (string, error) {
+	role, _, err := ctx.GetClientIdentity().GetAttributeValue(RoleAttribute)
+	if err != nil {
+		return "", fmt.Errorf("failed to read client role attribute: %v", err)
+	}
+	return role, nil
+}
+
+// requireCaller fails unless the submitting identity owns the given address
+func requireCaller(ctx contractapi.TransactionContextInterface, address string) error {
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != address {
+		return fmt.Errorf("caller %s is not authorized to act for %s", caller, address)
+	}
+	return nil
+}
+
+// requireParty fails unless the submitting identity is one of the given
+// addresses, and returns the matching address.
+func requireParty(ctx contractapi.TransactionContextInterface, addresses ...string) (string, error) {
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, address := range addresses {
+		if caller == address {
+			return caller, nil
+		}
+	}
+	return "", fmt.Errorf("caller %s is not a party to this trade", caller)
+}
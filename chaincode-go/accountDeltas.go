@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Accounts credited by most transactions, like the grid operator's, would
+// make concurrent transactions fail MVCC validation if every credit rewrote
+// the account. The balance of a delta account is instead its stored balance
+// plus one delta record per transaction that changed it. Writing a delta
+// reads no shared key, so credits do not conflict with each other; debits
+// still read the deltas to check the balance, and so conflict with any
+// transaction that adds a delta meanwhile. CompactAccount folds the deltas
+// back into the stored balance.
+
+// AccountDelta is the net change a transaction made to a delta account
+type AccountDelta struct {
+	AccountID string  `json:"accountID"`
+	TxID      string  `json:"txID"`
+	Amount    float64 `json:"amount"`
+}
+
+func accountDeltaKey(ctx contractapi.TransactionContextInterface, accountID, txID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("accountdelta", []string{accountID, txID})
+}
+
+func deltaAccountKey(ctx contractapi.TransactionContextInterface, accountID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("deltaaccount", []string{accountID})
+}
+
+// isDeltaAccount reports whether an account is updated through deltas. The
+// grid operator account always is.
+func isDeltaAccount(ctx contractapi.TransactionContextInterface, accountID string) (bool, error) {
+	if accountID == GridOperatorAccount {
+		return true, nil
+	}
+	key, err := deltaAccountKey(ctx, accountID)
+	if err != nil {
+		return false, err
+	}
+	marker, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read account %s: %v", accountID, err)
+	}
+	return marker != nil, nil
+}
+
+// pendingDeltas returns the sum of an account's deltas not yet compacted.
+// Fabric range queries do not return the transaction's own writes, so the
+// current transaction's delta is read by key.
+func pendingDeltas(ctx contractapi.TransactionContextInterface, accountID string) (float64, []string, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("accountdelta", []string{accountID})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resultsIterator.Close()
+
+	ownKey, err := accountDeltaKey(ctx, accountID, ctx.GetStub().GetTxID())
+	if err != nil {
+		return 0, nil, err
+	}
+	var sum float64
+	keys := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, nil, err
+		}
+		if queryResponse.Key == ownKey {
+			continue
+		}
+		var delta AccountDelta
+		if err := json.Unmarshal(queryResponse.Value, &delta); err != nil {
+			return 0, nil, err
+		}
+		sum += delta.Amount
+		keys = append(keys, queryResponse.Key)
+	}
+	own, err := ctx.GetStub().GetState(ownKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	if own != nil {
+		var delta AccountDelta
+		if err := json.Unmarshal(own, &delta); err != nil {
+			return 0, nil, err
+		}
+		sum += delta.Amount
+		keys = append(keys, ownKey)
+	}
+	return sum, keys, nil
+}
+
+// addAccountDelta records a change to a delta account under the current
+// transaction's delta
+func addAccountDelta(ctx contractapi.TransactionContextInterface, accountID string, amount float64) error {
+	txID := ctx.GetStub().GetTxID()
+	key, err := accountDeltaKey(ctx, accountID, txID)
+	if err != nil {
+		return err
+	}
+	delta := AccountDelta{AccountID: accountID, TxID: txID}
+	deltaJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return err
+	}
+	if deltaJSON != nil {
+		if err := json.Unmarshal(deltaJSON, &delta); err != nil {
+			return err
+		}
+	}
+	delta.Amount += amount
+	deltaJSON, err = json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, deltaJSON)
+}
+
+// adjustBalance adds amount, which may be negative, to an existing account.
+// Callers check the balance first.
+func adjustBalance(ctx contractapi.TransactionContextInterface, accountID string, amount float64) error {
+	deltaAccount, err := isDeltaAccount(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	if deltaAccount {
+		return addAccountDelta(ctx, accountID, amount)
+	}
+	account, err := getTokenAccount(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return fmt.Errorf("account %s does not exist", accountID)
+	}
+	account.Balance += amount
+	return putTokenAccount(ctx, account)
+}
+
+// tokenAccountExists reports whether an account has been opened. Unlike
+// getTokenAccount it does not read the deltas of a delta account.
+func tokenAccountExists(ctx contractapi.TransactionContextInterface, accountID string) (bool, error) {
+	key, err := accountKey(ctx, accountID)
+	if err != nil {
+		return false, err
+	}
+	accountJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read account %s: %v", accountID, err)
+	}
+	return accountJSON != nil, nil
+}
+
+// EnableDeltaAccount switches a high-contention account, such as a levy
+// collector or an escrow, to delta updates
+func (e *EnergyTradingContract) EnableDeltaAccount(ctx contractapi.TransactionContextInterface, accountID string) error {
+	exists, err := tokenAccountExists(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("account %s does not exist", accountID)
+	}
+	key, err := deltaAccountKey(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, []byte(accountID))
+}
+
+// DisableDeltaAccount compacts a delta account and returns it to direct
+// balance updates
+func (e *EnergyTradingContract) DisableDeltaAccount(ctx contractapi.TransactionContextInterface, accountID string) error {
+	if accountID == GridOperatorAccount {
+		return fmt.Errorf("account %s always uses delta updates", accountID)
+	}
+	if _, err := e.CompactAccount(ctx, accountID); err != nil {
+		return err
+	}
+	key, err := deltaAccountKey(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// CompactAccount folds the pending deltas of a delta account into its stored
+// balance. It conflicts with transactions updating the account concurrently,
+// so operators run it periodically at quiet times.
+func (e *EnergyTradingContract) CompactAccount(ctx contractapi.TransactionContextInterface, accountID string) (*TokenAccount, error) {
+	deltaAccount, err := isDeltaAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if !deltaAccount {
+		return nil, fmt.Errorf("account %s does not use delta updates", accountID)
+	}
+	account, err := getTokenAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, fmt.Errorf("account %s does not exist", accountID)
+	}
+	_, keys, err := pendingDeltas(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := ctx.GetStub().DelState(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := putTokenAccount(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
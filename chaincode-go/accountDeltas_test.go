@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAccountDeltas(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 10))
+
+	// Each transaction writes its own grid delta instead of the account
+	tc.stub.GetTxIDReturns("tx1")
+	require.NoError(t, settleWithGrid(tc, "buyer1", -1))
+	require.NoError(t, settleWithGrid(tc, "seller1", -0.5))
+	gridKey, err := accountKey(tc, GridOperatorAccount)
+	require.NoError(t, err)
+	stored := tc.state[gridKey]
+	tc.stub.GetTxIDReturns("tx2")
+	require.NoError(t, settleWithGrid(tc, "seller1", 2))
+	require.Equal(t, stored, tc.state[gridKey])
+	deltaKey, err := accountDeltaKey(tc, GridOperatorAccount, "tx1")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"accountID":"grid-operator","txID":"tx1","amount":1.5}`, string(tc.state[deltaKey]))
+	grid, err := e.ReadTokenAccount(tc, GridOperatorAccount)
+	require.NoError(t, err)
+	require.InDelta(t, -0.5, grid.Balance, 1e-9)
+
+	// Compaction folds the deltas into the stored balance
+	grid, err = e.CompactAccount(tc.as("operator1", RoleOperator), GridOperatorAccount)
+	require.NoError(t, err)
+	require.InDelta(t, -0.5, grid.Balance, 1e-9)
+	require.Nil(t, tc.state[deltaKey])
+	_, keys, err := pendingDeltas(tc, GridOperatorAccount)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	// Other accounts can opt in; debits still check the balance
+	_, err = e.CompactAccount(tc, "buyer1")
+	require.EqualError(t, err, "account buyer1 does not use delta updates")
+	require.NoError(t, e.EnableDeltaAccount(tc.as("admin1", RoleAdmin), "buyer1"))
+	tc.stub.GetTxIDReturns("tx3")
+	require.NoError(t, transferTokens(tc, "seller1", "buyer1", 4))
+	require.EqualError(t, transferTokens(tc, "buyer1", "seller1", 13.5), "account buyer1 has insufficient balance")
+	require.NoError(t, transferTokens(tc, "buyer1", "seller1", 13))
+	buyer, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 0, buyer.Balance, 1e-9)
+	require.NoError(t, e.DisableDeltaAccount(tc, "buyer1"))
+	buyer, err = getTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 0, buyer.Balance, 1e-9)
+	require.EqualError(t, e.DisableDeltaAccount(tc, GridOperatorAccount), "account grid-operator always uses delta updates")
+}
+
+func TestGridCreditLine(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "seller1", 1))
+	_, err := e.ProposeConfigChange(tc.as("seller1", ""), "credit", ParamGridCreditLine, 5, WeightByOrg, "2025-05-02T08:00:00Z", "2025-05-02T12:00:00Z")
+	require.NoError(t, err)
+	_, err = e.CastGovernanceVote(tc, "credit", true)
+	require.NoError(t, err)
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 2, 12, 0, 0, 0, time.UTC)), nil)
+	_, err = e.EnactGovernanceProposal(tc, "credit")
+	require.NoError(t, err)
+
+	// Charges fund the grid; payments beyond its balance are issued
+	tc.stub.GetTxIDReturns("tx1")
+	require.NoError(t, settleWithGrid(tc, "seller1", -1))
+	tc.stub.GetTxIDReturns("tx2")
+	require.NoError(t, settleWithGrid(tc, "seller1", 4))
+	tc.stub.GetTxIDReturns("tx3")
+	require.EqualError(t, settleWithGrid(tc, "seller1", 2.5), "paying 2.5 would take the grid operator's balance -3 below its credit line of 5")
+	require.NoError(t, settleWithGrid(tc, "seller1", 2))
+	grid, err := e.ReadTokenAccount(tc, GridOperatorAccount)
+	require.NoError(t, err)
+	require.InDelta(t, -5, grid.Balance, 1e-9)
+
+	issuance, err := e.GetGridIssuance(tc, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, issuance.Records, 2)
+	require.Equal(t, "tx2", issuance.Records[0].TxID)
+	require.InDelta(t, 3, issuance.Records[0].Amount, 1e-9)
+	require.InDelta(t, -3, issuance.Records[0].GridBalance, 1e-9)
+	require.InDelta(t, 2, issuance.Records[1].Amount, 1e-9)
+}
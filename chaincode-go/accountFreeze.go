@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// AccountFreeze records that an account was frozen, by whom and why. A
+// frozen account still receives tokens and still settles what it owes the
+// grid, but cannot send tokens until it is unfrozen.
+type AccountFreeze struct {
+	AccountID string `json:"accountID"`
+	Reason    string `json:"reason"`
+	FrozenBy  string `json:"frozenBy"`
+	FrozenAt  string `json:"frozenAt"`
+}
+
+func accountFreezeKey(ctx contractapi.TransactionContextInterface, accountID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("accountfreeze", []string{accountID})
+}
+
+// getAccountFreeze returns the freeze of an account, or nil if it is not
+// frozen
+func getAccountFreeze(ctx contractapi.TransactionContextInterface, accountID string) (*AccountFreeze, error) {
+	key, err := accountFreezeKey(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	freezeJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read freeze of account %s: %v", accountID, err)
+	}
+	if freezeJSON == nil {
+		return nil, nil
+	}
+	var freeze AccountFreeze
+	if err := json.Unmarshal(freezeJSON, &freeze); err != nil {
+		return nil, err
+	}
+	return &freeze, nil
+}
+
+// FreezeAccount stops an account from sending tokens
+func (e *EnergyTradingContract) FreezeAccount(ctx contractapi.TransactionContextInterface, accountID, reason string) (*AccountFreeze, error) {
+	if reason == "" {
+		return nil, fmt.Errorf("freeze reason must not be empty")
+	}
+	exists, err := tokenAccountExists(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("account %s does not exist", accountID)
+	}
+	existing, err := getAccountFreeze(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("account %s is already frozen", accountID)
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	freeze := &AccountFreeze{AccountID: accountID, Reason: reason, FrozenBy: caller, FrozenAt: now}
+	freezeJSON, err := json.Marshal(freeze)
+	if err != nil {
+		return nil, err
+	}
+	key, err := accountFreezeKey(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, freezeJSON); err != nil {
+		return nil, err
+	}
+	return freeze, nil
+}
+
+// UnfreezeAccount lets a frozen account send tokens again
+func (e *EnergyTradingContract) UnfreezeAccount(ctx contractapi.TransactionContextInterface, accountID string) error {
+	freeze, err := getAccountFreeze(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	if freeze == nil {
+		return fmt.Errorf("account %s is not frozen", accountID)
+	}
+	key, err := accountFreezeKey(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// GetAccountFreeze returns the freeze of a frozen account
+func (e *EnergyTradingContract) GetAccountFreeze(ctx contractapi.TransactionContextInterface, accountID string) (*AccountFreeze, error) {
+	freeze, err := getAccountFreeze(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if freeze == nil {
+		return nil, fmt.Errorf("account %s is not frozen", accountID)
+	}
+	return freeze, nil
+}
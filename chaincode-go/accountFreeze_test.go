@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreezeAccount(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 10))
+
+	_, err := e.FreezeAccount(tc, "nobody", "suspected fraud")
+	require.EqualError(t, err, "account nobody does not exist")
+	_, err = e.FreezeAccount(tc, "buyer1", "")
+	require.EqualError(t, err, "freeze reason must not be empty")
+	freeze, err := e.FreezeAccount(tc, "buyer1", "suspected fraud")
+	require.NoError(t, err)
+	require.Equal(t, "admin1", freeze.FrozenBy)
+	_, err = e.FreezeAccount(tc, "buyer1", "again")
+	require.EqualError(t, err, "account buyer1 is already frozen")
+
+	// A frozen account receives tokens but cannot send them
+	require.EqualError(t, e.TransferTokens(tc.as("buyer1", ""), "seller1", 1, 0), "account buyer1 is frozen: suspected fraud")
+	require.NoError(t, e.TransferTokens(tc.as("seller1", ""), "buyer1", 1, 0))
+	require.NoError(t, settleWithGrid(tc, "buyer1", -1))
+
+	require.NoError(t, e.UnfreezeAccount(tc.as("admin1", RoleAdmin), "buyer1"))
+	require.EqualError(t, e.UnfreezeAccount(tc, "buyer1"), "account buyer1 is not frozen")
+	_, err = e.GetAccountFreeze(tc, "buyer1")
+	require.EqualError(t, err, "account buyer1 is not frozen")
+	require.NoError(t, e.TransferTokens(tc.as("buyer1", ""), "seller1", 1, 0))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// accountReserveKey is the state key of the account reserve
+const accountReserveKey = "accountreserve"
+
+// AccountReserve is the balance operators expect every participant account
+// to hold. It is not enforced on transfers; accounts below it are listed by
+// GetAccountsBelowReserve for follow-up.
+type AccountReserve struct {
+	MinimumBalance float64 `json:"minimumBalance"`
+	UpdatedBy      string  `json:"updatedBy,omitempty"`
+	UpdatedAt      string  `json:"updatedAt,omitempty"`
+}
+
+// PaginatedTokenAccountResult is a page of token accounts
+type PaginatedTokenAccountResult struct {
+	Records             []*TokenAccount `json:"records"`
+	FetchedRecordsCount int32           `json:"fetchedRecordsCount"`
+	Bookmark            string          `json:"bookmark"`
+}
+
+// SetAccountReserve sets the minimum balance participant accounts should hold
+func (e *EnergyTradingContract) SetAccountReserve(ctx contractapi.TransactionContextInterface, minimumBalance float64) (*AccountReserve, error) {
+	if minimumBalance < 0 {
+		return nil, fmt.Errorf("minimum balance must not be negative")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reserve := &AccountReserve{MinimumBalance: minimumBalance, UpdatedBy: caller, UpdatedAt: now}
+	reserveJSON, err := json.Marshal(reserve)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(accountReserveKey, reserveJSON); err != nil {
+		return nil, err
+	}
+	return reserve, nil
+}
+
+// GetAccountReserve returns the account reserve, which is zero until an
+// operator sets it
+func (e *EnergyTradingContract) GetAccountReserve(ctx contractapi.TransactionContextInterface) (*AccountReserve, error) {
+	reserveJSON, err := ctx.GetStub().GetState(accountReserveKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account reserve: %v", err)
+	}
+	if reserveJSON == nil {
+		return &AccountReserve{}, nil
+	}
+	var reserve AccountReserve
+	if err := json.Unmarshal(reserveJSON, &reserve); err != nil {
+		return nil, err
+	}
+	return &reserve, nil
+}
+
+// GetAccountsBelowReserve returns a page of the participant accounts whose
+// balance, including pending deltas, is below the account reserve. Escrow
+// and other system accounts are skipped, as are accounts at or above the
+// reserve, so a page may hold fewer than pageSize accounts.
+func (e *EnergyTradingContract) GetAccountsBelowReserve(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedTokenAccountResult, error) {
+	reserve, err := e.GetAccountReserve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedTokenAccountResult{Records: []*TokenAccount{}}
+	metadata, err := queryPage(ctx, "account", []string{}, pageSize, bookmark, func(value []byte) error {
+		var stored TokenAccount
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+		participant, err := getParticipant(ctx, stored.AccountID)
+		if err != nil || participant == nil {
+			return err
+		}
+		account, err := getTokenAccount(ctx, stored.AccountID)
+		if err != nil {
+			return err
+		}
+		if account.Balance < reserve.MinimumBalance {
+			result.Records = append(result.Records, account)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
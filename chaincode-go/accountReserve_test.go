@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountsBelowReserve(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 2))
+	require.NoError(t, putTokenAccount(tc, &TokenAccount{AccountID: CollateralEscrowAccount}))
+
+	reserve, err := e.GetAccountReserve(tc)
+	require.NoError(t, err)
+	require.Equal(t, 0.0, reserve.MinimumBalance)
+	page, err := e.GetAccountsBelowReserve(tc, 10, "")
+	require.NoError(t, err)
+	require.Empty(t, page.Records)
+
+	_, err = e.SetAccountReserve(tc.as("operator1", RoleOperator), -1)
+	require.EqualError(t, err, "minimum balance must not be negative")
+	reserve, err = e.SetAccountReserve(tc, 5)
+	require.NoError(t, err)
+	require.Equal(t, "operator1", reserve.UpdatedBy)
+
+	page, err = e.GetAccountsBelowReserve(tc, 10, "")
+	require.NoError(t, err)
+	require.Len(t, page.Records, 1)
+	require.Equal(t, "seller1", page.Records[0].AccountID)
+	require.Equal(t, 2.0, page.Records[0].Balance)
+	require.Equal(t, int32(3), page.FetchedRecordsCount)
+}
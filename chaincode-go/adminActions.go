@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// DefaultAdminThreshold is how many admins must approve calls of the
+// protected functions until a policy sets another threshold
+const DefaultAdminThreshold = 2
+
+// defaultApprovedFunctions are the functions the admin policy protects until
+// admins set another list: the ones that move funds out of the platform's
+// accounts, stop participants from trading, change what every trade pays or
+// change who may audit the platform.
+// Minting is left out because onboarding funds each new participant's
+// account; networks that fund accounts another way can add it.
+var defaultApprovedFunctions = []string{
+	"FreezeAccount",
+	"UnfreezeAccount",
+	"WithdrawFees",
+	"SetLevy",
+	"RemoveLevy",
+	"SetAccountReserve",
+	"CreateSubsidyProgram",
+	"SetInsuranceTerms",
+	"RegisterBridgeNetwork",
+	"SetRegulator",
+}
+
+// DefaultAdminActionTTL is how long a proposed admin action stays open for
+// approval until a policy sets another period
+const DefaultAdminActionTTL = 72 * time.Hour
+
+// adminPolicyKey is the state key of the admin approval policy
+const adminPolicyKey = "adminpolicy"
+
+// Admin action statuses. A pending action past its expiry can no longer be
+// approved or executed.
+const (
+	AdminActionPending  = "PENDING"
+	AdminActionExecuted = "EXECUTED"
+)
+
+// AdminPolicy lists the sensitive functions that need Threshold distinct
+// admins to approve each call. While Threshold is above one, the listed
+// functions, SetAdminPolicy itself and the market pause switch can only run
+// through ExecuteAdminAction.
+type AdminPolicy struct {
+	Threshold int      `json:"threshold"`
+	Functions []string `json:"functions"`
+	TTLHours  int      `json:"ttlHours"`
+	UpdatedBy string   `json:"updatedBy,omitempty"`
+	UpdatedAt string   `json:"updatedAt,omitempty"`
+}
+
+// AdminAction is a proposed call of a sensitive function with its arguments,
+// as passed to the chaincode, and the admins who approved it. The proposer
+// is the first approver.
+type AdminAction struct {
+	ActionID   string   `json:"actionID"`
+	Function   string   `json:"function"`
+	Args       []string `json:"args"`
+	Threshold  int      `json:"threshold"`
+	Approvals  []string `json:"approvals"`
+	Status     string   `json:"status"`
+	ProposedBy string   `json:"proposedBy"`
+	ProposedAt string   `json:"proposedAt"`
+	ExpiresAt  string   `json:"expiresAt"`
+	ExecutedBy string   `json:"executedBy,omitempty"`
+	ExecutedAt string   `json:"executedAt,omitempty"`
+}
+
+func adminActionKey(ctx contractapi.TransactionContextInterface, actionID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("adminaction", []string{actionID})
+}
+
+// GetAdminPolicy returns the admin approval policy in force
+func (e *EnergyTradingContract) GetAdminPolicy(ctx contractapi.TransactionContextInterface) (*AdminPolicy, error) {
+	policyJSON, err := ctx.GetStub().GetState(adminPolicyKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin policy: %v", err)
+	}
+	if policyJSON == nil {
+		return &AdminPolicy{Threshold: DefaultAdminThreshold, Functions: defaultApprovedFunctions, TTLHours: int(DefaultAdminActionTTL / time.Hour)}, nil
+	}
+	var policy AdminPolicy
+	if err := json.Unmarshal(policyJSON, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// alwaysApproved are the admin functions that need approvals whenever the
+// policy threshold is above one, whether or not the policy lists them
+var alwaysApproved = []string{"SetAdminPolicy", "PauseMarket", "ResumeMarket"}
+
+// needsApproval reports whether a function needs admin approvals under a
+// policy
+func needsApproval(policy *AdminPolicy, fn string) bool {
+	return policy.Threshold > 1 && (hasRole(alwaysApproved, fn) || hasRole(policy.Functions, fn))
+}
+
+// requireAdminApproval rejects direct calls of functions the admin policy
+// puts behind approvals
+func requireAdminApproval(ctx contractapi.TransactionContextInterface, fn string) error {
+	policy, err := (&EnergyTradingContract{}).GetAdminPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	if needsApproval(policy, fn) {
+		return fmt.Errorf("%s needs %d admin approvals and must be proposed with ProposeAdminAction", fn, policy.Threshold)
+	}
+	return nil
+}
+
+// privilegedFunction reports whether only admins and operators can call a
+// function
+func privilegedFunction(fn string) bool {
+	allowed, ok := functionRoles[fn]
+	if !ok || len(allowed) == 0 {
+		return false
+	}
+	for _, role := range allowed {
+		if role != RoleAdmin && role != RoleOperator {
+			return false
+		}
+	}
+	return true
+}
+
+// SetAdminPolicy sets how many admins must approve calls of the listed
+// functions and how many hours a proposal stays open. Every listed function
+// must be a privileged one, which only admins and operators can call; an
+// operator function listed here is run by the executing admin.
+func (e *EnergyTradingContract) SetAdminPolicy(ctx contractapi.TransactionContextInterface, threshold int, functions []string, ttlHours int) (*AdminPolicy, error) {
+	if threshold < 1 || ttlHours <= 0 {
+		return nil, fmt.Errorf("threshold and TTL hours must be positive")
+	}
+	for _, fn := range functions {
+		if !privilegedFunction(fn) {
+			return nil, fmt.Errorf("%s is not a privileged function", fn)
+		}
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	policy := &AdminPolicy{Threshold: threshold, Functions: functions, TTLHours: ttlHours, UpdatedBy: caller, UpdatedAt: now}
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(adminPolicyKey, policyJSON); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func putAdminAction(ctx contractapi.TransactionContextInterface, action *AdminAction) error {
+	actionJSON, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	key, err := adminActionKey(ctx, action.ActionID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, actionJSON)
+}
+
+// GetAdminAction returns a proposed admin action
+func (e *EnergyTradingContract) GetAdminAction(ctx contractapi.TransactionContextInterface, actionID string) (*AdminAction, error) {
+	key, err := adminActionKey(ctx, actionID)
+	if err != nil {
+		return nil, err
+	}
+	actionJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin action %s: %v", actionID, err)
+	}
+	if actionJSON == nil {
+		return nil, fmt.Errorf("admin action %s does not exist", actionID)
+	}
+	var action AdminAction
+	if err := json.Unmarshal(actionJSON, &action); err != nil {
+		return nil, err
+	}
+	return &action, nil
+}
+
+// PaginatedAdminActionResult is a page of admin actions
+type PaginatedAdminActionResult struct {
+	Records             []*AdminAction `json:"records"`
+	FetchedRecordsCount int32          `json:"fetchedRecordsCount"`
+	Bookmark            string         `json:"bookmark"`
+}
+
+// GetPendingAdminActions returns a page of the admin actions still open for
+// approval or execution. Executed and expired actions are skipped, so a page
+// may hold fewer than pageSize actions.
+func (e *EnergyTradingContract) GetPendingAdminActions(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedAdminActionResult, error) {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedAdminActionResult{Records: []*AdminAction{}}
+	metadata, err := queryPage(ctx, "adminaction", []string{}, pageSize, bookmark, func(value []byte) error {
+		var action AdminAction
+		if err := json.Unmarshal(value, &action); err != nil {
+			return err
+		}
+		if action.Status == AdminActionPending && now < action.ExpiresAt {
+			result.Records = append(result.Records, &action)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// adminActionMethod returns the contract method an admin action calls and
+// the values of its arguments. String parameters take the argument as is;
+// all others are decoded from JSON, as the contract API does.
+func adminActionMethod(e *EnergyTradingContract, ctx contractapi.TransactionContextInterface, fn string, args []string) (reflect.Value, []reflect.Value, error) {
+	method := reflect.ValueOf(e).MethodByName(fn)
+	if !method.IsValid() {
+		return reflect.Value{}, nil, fmt.Errorf("function %s does not exist", fn)
+	}
+	methodType := method.Type()
+	if methodType.NumIn() != len(args)+1 {
+		return reflect.Value{}, nil, fmt.Errorf("%s takes %d arguments, got %d", fn, methodType.NumIn()-1, len(args))
+	}
+	values := []reflect.Value{reflect.ValueOf(ctx)}
+	for i, arg := range args {
+		paramType := methodType.In(i + 1)
+		if paramType.Kind() == reflect.String {
+			values = append(values, reflect.ValueOf(arg).Convert(paramType))
+			continue
+		}
+		value := reflect.New(paramType)
+		if err := json.Unmarshal([]byte(arg), value.Interface()); err != nil {
+			return reflect.Value{}, nil, fmt.Errorf("argument %d of %s: %v", i+1, fn, err)
+		}
+		values = append(values, value.Elem())
+	}
+	return method, values, nil
+}
+
+// ProposeAdminAction proposes a call of a function the admin policy puts
+// behind approvals. The arguments are checked against the function's
+// parameters when proposed.
+func (e *EnergyTradingContract) ProposeAdminAction(ctx contractapi.TransactionContextInterface, actionID, function string, args []string) (*AdminAction, error) {
+	policy, err := e.GetAdminPolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !needsApproval(policy, function) {
+		return nil, fmt.Errorf("%s does not need admin approvals", function)
+	}
+	if _, _, err := adminActionMethod(e, ctx, function, args); err != nil {
+		return nil, err
+	}
+	key, err := adminActionKey(ctx, actionID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin action %s: %v", actionID, err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("admin action %s already exists", actionID)
+	}
+	proposer, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if args == nil {
+		args = []string{}
+	}
+
+	action := &AdminAction{
+		ActionID:   actionID,
+		Function:   function,
+		Args:       args,
+		Threshold:  policy.Threshold,
+		Approvals:  []string{proposer},
+		Status:     AdminActionPending,
+		ProposedBy: proposer,
+		ProposedAt: now.Format(time.RFC3339),
+		ExpiresAt:  now.Add(time.Duration(policy.TTLHours) * time.Hour).Format(time.RFC3339),
+	}
+	if err := putAdminAction(ctx, action); err != nil {
+		return nil, err
+	}
+	return action, emitEvent(ctx, EventAdminActionChanged, action)
+}
+
+// openAdminAction loads an admin action that can still be approved or
+// executed
+func openAdminAction(ctx contractapi.TransactionContextInterface, actionID string) (*AdminAction, error) {
+	action, err := (&EnergyTradingContract{}).GetAdminAction(ctx, actionID)
+	if err != nil {
+		return nil, err
+	}
+	if action.Status != AdminActionPending {
+		return nil, fmt.Errorf("admin action %s is %s", actionID, action.Status)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now >= action.ExpiresAt {
+		return nil, fmt.Errorf("admin action %s expired at %s", actionID, action.ExpiresAt)
+	}
+	return action, nil
+}
+
+// ApproveAdminAction adds the calling admin's approval to a pending action
+func (e *EnergyTradingContract) ApproveAdminAction(ctx contractapi.TransactionContextInterface, actionID string) (*AdminAction, error) {
+	action, err := openAdminAction(ctx, actionID)
+	if err != nil {
+		return nil, err
+	}
+	approver, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if hasRole(action.Approvals, approver) {
+		return nil, fmt.Errorf("admin %s has already approved action %s", approver, actionID)
+	}
+	action.Approvals = append(action.Approvals, approver)
+	if err := putAdminAction(ctx, action); err != nil {
+		return nil, err
+	}
+	return action, emitEvent(ctx, EventAdminActionChanged, action)
+}
+
+// ExecuteAdminAction calls the function of an action that has collected its
+// threshold of approvals. The call runs with the executing admin as caller
+// and fails the transaction if the function fails.
+func (e *EnergyTradingContract) ExecuteAdminAction(ctx contractapi.TransactionContextInterface, actionID string) (*AdminAction, error) {
+	action, err := openAdminAction(ctx, actionID)
+	if err != nil {
+		return nil, err
+	}
+	if len(action.Approvals) < action.Threshold {
+		return nil, fmt.Errorf("admin action %s has %d of %d approvals", actionID, len(action.Approvals), action.Threshold)
+	}
+	method, values, err := adminActionMethod(e, ctx, action.Function, action.Args)
+	if err != nil {
+		return nil, err
+	}
+	results := method.Call(values)
+	if err, ok := results[len(results)-1].Interface().(error); ok && err != nil {
+		return nil, fmt.Errorf("admin action %s: %v", actionID, err)
+	}
+	executor, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	action.Status = AdminActionExecuted
+	action.ExecutedBy = executor
+	action.ExecutedAt = now
+	if err := putAdminAction(ctx, action); err != nil {
+		return nil, err
+	}
+	txLog(ctx).Infof("executed admin action %s calling %s with %d approvals", actionID, action.Function, len(action.Approvals))
+	return action, emitEvent(ctx, EventAdminActionChanged, action)
+}
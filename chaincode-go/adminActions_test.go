@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAdminActionApprovals(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+
+	tc.as("admin1", RoleAdmin)
+	_, err := e.SetAdminPolicy(tc, 2, []string{"MintTokens", "ReconcileDelivery"}, 24)
+	require.EqualError(t, err, "ReconcileDelivery is not a privileged function")
+	_, err = e.SetAdminPolicy(tc, 2, []string{"MintTokens"}, 24)
+	require.NoError(t, err)
+	require.EqualError(t, tc.authorize("MintTokens"), "MintTokens needs 2 admin approvals and must be proposed with ProposeAdminAction")
+	require.EqualError(t, tc.authorize("SetAdminPolicy"), "SetAdminPolicy needs 2 admin approvals and must be proposed with ProposeAdminAction")
+	require.NoError(t, tc.authorize("SetSlotLength"))
+
+	_, err = e.ProposeAdminAction(tc, "mint1", "SetSlotLength", []string{"30"})
+	require.EqualError(t, err, "SetSlotLength does not need admin approvals")
+	_, err = e.ProposeAdminAction(tc, "mint1", "MintTokens", []string{"buyer1"})
+	require.EqualError(t, err, "MintTokens takes 2 arguments, got 1")
+	action, err := e.ProposeAdminAction(tc, "mint1", "MintTokens", []string{"buyer1", "5"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"admin1"}, action.Approvals)
+	require.Equal(t, "2025-05-02T08:00:00Z", action.ExpiresAt)
+
+	_, err = e.ExecuteAdminAction(tc, "mint1")
+	require.EqualError(t, err, "admin action mint1 has 1 of 2 approvals")
+	_, err = e.ApproveAdminAction(tc, "mint1")
+	require.EqualError(t, err, "admin admin1 has already approved action mint1")
+	_, err = e.ApproveAdminAction(tc.as("admin2", RoleAdmin), "mint1")
+	require.NoError(t, err)
+	pending, err := e.GetPendingAdminActions(tc, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, pending.Records, 1)
+
+	action, err = e.ExecuteAdminAction(tc, "mint1")
+	require.NoError(t, err)
+	require.Equal(t, AdminActionExecuted, action.Status)
+	require.Equal(t, "admin2", action.ExecutedBy)
+	balance, err := e.BalanceOf(tc, "buyer1", EnergyTokenID)
+	require.NoError(t, err)
+	require.Equal(t, 5.0, balance)
+	_, err = e.ExecuteAdminAction(tc, "mint1")
+	require.EqualError(t, err, "admin action mint1 is EXECUTED")
+	pending, err = e.GetPendingAdminActions(tc, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Empty(t, pending.Records)
+}
+
+func TestAdminActionExpiry(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.as("admin1", RoleAdmin)
+	_, err := e.SetAdminPolicy(tc, 2, []string{"SetSlotLength"}, 24)
+	require.NoError(t, err)
+	_, err = e.ProposeAdminAction(tc, "slots", "SetSlotLength", []string{"30"})
+	require.NoError(t, err)
+
+	// A failing call fails the execution and leaves the action pending
+	_, err = e.ProposeAdminAction(tc, "bad-slots", "SetSlotLength", []string{"7"})
+	require.NoError(t, err)
+	_, err = e.ApproveAdminAction(tc.as("admin2", RoleAdmin), "bad-slots")
+	require.NoError(t, err)
+	_, err = e.ExecuteAdminAction(tc, "bad-slots")
+	require.EqualError(t, err, "admin action bad-slots: slot length must be one of [15m0s 30m0s 1h0m0s]")
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 2, 8, 0, 0, 0, time.UTC)), nil)
+	_, err = e.ApproveAdminAction(tc, "slots")
+	require.EqualError(t, err, "admin action slots expired at 2025-05-02T08:00:00Z")
+	pending, err := e.GetPendingAdminActions(tc, 1, "")
+	require.NoError(t, err)
+	require.Empty(t, pending.Records)
+	require.NotEmpty(t, pending.Bookmark)
+}
+
+func TestDefaultAdminPolicy(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 5))
+
+	policy, err := e.GetAdminPolicy(tc)
+	require.NoError(t, err)
+	require.Equal(t, DefaultAdminThreshold, policy.Threshold)
+	require.Contains(t, policy.Functions, "FreezeAccount")
+	require.Contains(t, policy.Functions, "WithdrawFees")
+	require.EqualError(t, tc.authorize("FreezeAccount"), "FreezeAccount needs 2 admin approvals and must be proposed with ProposeAdminAction")
+	require.EqualError(t, tc.authorize("SetAdminPolicy"), "SetAdminPolicy needs 2 admin approvals and must be proposed with ProposeAdminAction")
+	require.NoError(t, tc.authorize("MintTokens"))
+
+	_, err = e.ProposeAdminAction(tc, "freeze1", "FreezeAccount", []string{"buyer1", "suspected fraud"})
+	require.NoError(t, err)
+	_, err = e.ApproveAdminAction(tc.as("admin2", RoleAdmin), "freeze1")
+	require.NoError(t, err)
+	_, err = e.ExecuteAdminAction(tc, "freeze1")
+	require.NoError(t, err)
+	freeze, err := e.GetAccountFreeze(tc, "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, "admin2", freeze.FrozenBy)
+
+	// Functions operators can call may be listed too
+	_, err = e.ProposeAdminAction(tc, "policy1", "SetAdminPolicy", []string{"3", `["SetAccountReserve","CompactAccount"]`, "24"})
+	require.NoError(t, err)
+	_, err = e.ApproveAdminAction(tc.as("admin1", RoleAdmin), "policy1")
+	require.NoError(t, err)
+	_, err = e.ExecuteAdminAction(tc, "policy1")
+	require.NoError(t, err)
+	_, err = e.RegisterRole(tc.as("operator1", RoleOperator))
+	require.NoError(t, err)
+	require.EqualError(t, tc.authorize("SetAccountReserve"), "SetAccountReserve needs 3 admin approvals and must be proposed with ProposeAdminAction")
+	require.EqualError(t, tc.as("admin1", RoleAdmin).authorize("CompactAccount"), "CompactAccount needs 3 admin approvals and must be proposed with ProposeAdminAction")
+	require.NoError(t, tc.authorize("FreezeAccount"))
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ArbitrationEscrowAccount holds the fee stakes of disputes referred to an
+// arbitrator panel
+const ArbitrationEscrowAccount = "arbitration-escrow"
+
+// Default arbitration terms, in force until an admin sets others
+const (
+	DefaultArbitrationPanelSize   = 3
+	DefaultArbitrationVotingHours = 72
+	DefaultArbitratorFee          = 1.0
+)
+
+// arbitrationTermsKey is the state key of the arbitration terms
+const arbitrationTermsKey = "arbitrationterms"
+
+// Arbitration panel statuses
+const (
+	PanelVoting     = "VOTING"
+	PanelDecided    = "DECIDED"
+	PanelDeadlocked = "DEADLOCKED"
+)
+
+// ArbitrationTerms holds the size of arbitrator panels, how long their vote
+// stays open and the fee each voting arbitrator earns
+type ArbitrationTerms struct {
+	PanelSize     int     `json:"panelSize"`
+	VotingHours   int     `json:"votingHours"`
+	ArbitratorFee float64 `json:"arbitratorFee"`
+	UpdatedBy     string  `json:"updatedBy,omitempty"`
+	UpdatedAt     string  `json:"updatedAt,omitempty"`
+}
+
+// Arbitrator is an arbiter an admin has admitted to sit on dispute panels
+type Arbitrator struct {
+	Address      string `json:"address"`
+	RegisteredBy string `json:"registeredBy"`
+	RegisteredAt string `json:"registeredAt"`
+}
+
+// ArbitrationPanel decides a meter dispute by majority vote. The challenger
+// claims the corrected reading it wants; each arbitrator votes to uphold or
+// reject that claim before Deadline. Both sides stake the fees of the whole
+// panel in ArbitrationEscrowAccount. The losing side's stake pays the
+// arbitrators who voted and the rest is refunded.
+type ArbitrationPanel struct {
+	MeterID         string          `json:"meterID"`
+	IntervalStart   string          `json:"intervalStart"`
+	TokenID         string          `json:"tokenID"`
+	Challenger      string          `json:"challenger"`
+	Respondent      string          `json:"respondent"`
+	ClaimedInjected float64         `json:"claimedInjected"`
+	ClaimedConsumed float64         `json:"claimedConsumed"`
+	Arbitrators     []string        `json:"arbitrators"`
+	Votes           map[string]bool `json:"votes"`
+	ArbitratorFee   float64         `json:"arbitratorFee"`
+	Stake           float64         `json:"stake"`
+	PriorStatus     string          `json:"priorStatus"`
+	Status          string          `json:"status"`
+	Upheld          bool            `json:"upheld"`
+	Deadline        string          `json:"deadline"`
+	ReferredAt      string          `json:"referredAt"`
+	DecidedAt       string          `json:"decidedAt,omitempty"`
+}
+
+func arbitratorKey(ctx contractapi.TransactionContextInterface, address string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("arbitrator", []string{address})
+}
+
+func arbitrationPanelKey(ctx contractapi.TransactionContextInterface, meterID, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("arbitrationpanel", []string{meterID, intervalStart})
+}
+
+// SetArbitrationTerms sets the panel size, voting period and arbitrator fee
+// of disputes referred afterwards. Panels have an odd size so that a full
+// vote always has a majority.
+func (e *EnergyTradingContract) SetArbitrationTerms(ctx contractapi.TransactionContextInterface, panelSize, votingHours int, arbitratorFee float64) (*ArbitrationTerms, error) {
+	if panelSize < 1 || panelSize%2 == 0 {
+		return nil, fmt.Errorf("panel size must be a positive odd number")
+	}
+	if votingHours <= 0 || arbitratorFee < 0 {
+		return nil, fmt.Errorf("voting hours must be positive and the arbitrator fee must not be negative")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	terms := &ArbitrationTerms{PanelSize: panelSize, VotingHours: votingHours, ArbitratorFee: arbitratorFee, UpdatedBy: caller, UpdatedAt: now}
+	termsJSON, err := json.Marshal(terms)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(arbitrationTermsKey, termsJSON); err != nil {
+		return nil, err
+	}
+	return terms, nil
+}
+
+// GetArbitrationTerms returns the arbitration terms in force
+func (e *EnergyTradingContract) GetArbitrationTerms(ctx contractapi.TransactionContextInterface) (*ArbitrationTerms, error) {
+	termsJSON, err := ctx.GetStub().GetState(arbitrationTermsKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read arbitration terms: %v", err)
+	}
+	if termsJSON == nil {
+		return &ArbitrationTerms{PanelSize: DefaultArbitrationPanelSize, VotingHours: DefaultArbitrationVotingHours, ArbitratorFee: DefaultArbitratorFee}, nil
+	}
+	var terms ArbitrationTerms
+	if err := json.Unmarshal(termsJSON, &terms); err != nil {
+		return nil, err
+	}
+	return &terms, nil
+}
+
+// RegisterArbitrator admits an address registered as an arbiter to dispute
+// panels and opens its token account for fees
+func (e *EnergyTradingContract) RegisterArbitrator(ctx contractapi.TransactionContextInterface, address string) (*Arbitrator, error) {
+	record, err := getRoleRecord(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil || record.Role != RoleArbiter {
+		return nil, fmt.Errorf("address %s is not registered as an arbiter", address)
+	}
+	key, err := arbitratorKey(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read arbitrator %s: %v", address, err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("arbitrator %s is already registered", address)
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := tokenAccountExists(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := putTokenAccount(ctx, &TokenAccount{AccountID: address}); err != nil {
+			return nil, err
+		}
+	}
+	arbitrator := &Arbitrator{Address: address, RegisteredBy: caller, RegisteredAt: now}
+	arbitratorJSON, err := json.Marshal(arbitrator)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, arbitratorJSON); err != nil {
+		return nil, err
+	}
+	return arbitrator, nil
+}
+
+// RemoveArbitrator stops an arbitrator from being drawn onto new panels. It
+// keeps its seat on panels already voting.
+func (e *EnergyTradingContract) RemoveArbitrator(ctx contractapi.TransactionContextInterface, address string) error {
+	key, err := arbitratorKey(ctx, address)
+	if err != nil {
+		return err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read arbitrator %s: %v", address, err)
+	}
+	if existing == nil {
+		return fmt.Errorf("arbitrator %s is not registered", address)
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// PaginatedArbitratorResult is a page of arbitrators
+type PaginatedArbitratorResult struct {
+	Records             []*Arbitrator `json:"records"`
+	FetchedRecordsCount int32         `json:"fetchedRecordsCount"`
+	Bookmark            string        `json:"bookmark"`
+}
+
+// GetArbitrators returns a page of the registered arbitrators
+func (e *EnergyTradingContract) GetArbitrators(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedArbitratorResult, error) {
+	result := &PaginatedArbitratorResult{Records: []*Arbitrator{}}
+	metadata, err := queryPage(ctx, "arbitrator", []string{}, pageSize, bookmark, func(value []byte) error {
+		var arbitrator Arbitrator
+		if err := json.Unmarshal(value, &arbitrator); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &arbitrator)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// getArbitrators returns all the registered arbitrators
+func getArbitrators(ctx contractapi.TransactionContextInterface) ([]*Arbitrator, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("arbitrator", []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	arbitrators := []*Arbitrator{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var arbitrator Arbitrator
+		if err := json.Unmarshal(queryResponse.Value, &arbitrator); err != nil {
+			return nil, err
+		}
+		arbitrators = append(arbitrators, &arbitrator)
+	}
+	return arbitrators, nil
+}
+
+// drawPanel draws size arbitrators, none of them a party to the dispute, in an
+// order seeded by the transaction ID so that every endorser draws the same
+// panel
+func drawPanel(ctx contractapi.TransactionContextInterface, size int, parties ...string) ([]string, error) {
+	arbitrators, err := getArbitrators(ctx)
+	if err != nil {
+		return nil, err
+	}
+	draws := map[string]string{}
+	candidates := []string{}
+	for _, arbitrator := range arbitrators {
+		if hasRole(parties, arbitrator.Address) {
+			continue
+		}
+		digest := sha256.Sum256([]byte(ctx.GetStub().GetTxID() + arbitrator.Address))
+		draws[arbitrator.Address] = hex.EncodeToString(digest[:])
+		candidates = append(candidates, arbitrator.Address)
+	}
+	if len(candidates) < size {
+		return nil, fmt.Errorf("only %d arbitrators are eligible for a panel of %d", len(candidates), size)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return draws[candidates[i]] < draws[candidates[j]]
+	})
+	panel := candidates[:size]
+	sort.Strings(panel)
+	return panel, nil
+}
+
+func putArbitrationPanel(ctx contractapi.TransactionContextInterface, panel *ArbitrationPanel) error {
+	panelJSON, err := json.Marshal(panel)
+	if err != nil {
+		return err
+	}
+	key, err := arbitrationPanelKey(ctx, panel.MeterID, panel.IntervalStart)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, panelJSON)
+}
+
+// GetArbitrationPanel returns the panel a meter dispute was referred to
+func (e *EnergyTradingContract) GetArbitrationPanel(ctx contractapi.TransactionContextInterface, meterID, intervalStart string) (*ArbitrationPanel, error) {
+	intervalStart, err := normalizeTimestamp(intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	key, err := arbitrationPanelKey(ctx, meterID, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	panelJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read arbitration panel: %v", err)
+	}
+	if panelJSON == nil {
+		return nil, fmt.Errorf("dispute of meter %s at %s has no arbitration panel", meterID, intervalStart)
+	}
+	var panel ArbitrationPanel
+	if err := json.Unmarshal(panelJSON, &panel); err != nil {
+		return nil, err
+	}
+	return &panel, nil
+}
+
+// ReferDisputeToPanel refers the caller's open meter dispute to a panel of
+// arbitrators, claiming the corrected reading it wants. The challenger and
+// the meter's owner each stake the fees of the whole panel. A dispute can be
+// referred once.
+func (e *EnergyTradingContract) ReferDisputeToPanel(ctx contractapi.TransactionContextInterface, meterID, intervalStart string, claimedInjected, claimedConsumed float64) (*ArbitrationPanel, error) {
+	if claimedInjected < 0 || claimedConsumed < 0 {
+		return nil, fmt.Errorf("meter readings must not be negative")
+	}
+	dispute, err := e.GetMeterDispute(ctx, meterID, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, dispute.Challenger); err != nil {
+		return nil, err
+	}
+	if dispute.Status == DisputeUpheld || dispute.Status == DisputeRejected || dispute.Status == DisputeReferred {
+		return nil, fmt.Errorf("dispute of meter %s at %s is %s", meterID, dispute.IntervalStart, dispute.Status)
+	}
+	key, err := arbitrationPanelKey(ctx, meterID, dispute.IntervalStart)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read arbitration panel: %v", err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("dispute of meter %s at %s was already referred to a panel", meterID, dispute.IntervalStart)
+	}
+	reading, err := getMeterReading(ctx, meterID, dispute.IntervalStart)
+	if err != nil {
+		return nil, err
+	}
+	terms, err := e.GetArbitrationTerms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	arbitrators, err := drawPanel(ctx, terms.PanelSize, dispute.Challenger, reading.Owner)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	panel := &ArbitrationPanel{
+		MeterID:         meterID,
+		IntervalStart:   dispute.IntervalStart,
+		TokenID:         dispute.TokenID,
+		Challenger:      dispute.Challenger,
+		Respondent:      reading.Owner,
+		ClaimedInjected: claimedInjected,
+		ClaimedConsumed: claimedConsumed,
+		Arbitrators:     arbitrators,
+		Votes:           map[string]bool{},
+		ArbitratorFee:   terms.ArbitratorFee,
+		Stake:           terms.ArbitratorFee * float64(terms.PanelSize),
+		PriorStatus:     dispute.Status,
+		Status:          PanelVoting,
+		Deadline:        now.Add(time.Duration(terms.VotingHours) * time.Hour).Format(time.RFC3339),
+		ReferredAt:      now.Format(time.RFC3339),
+	}
+	if panel.Stake > 0 {
+		exists, err := tokenAccountExists(ctx, ArbitrationEscrowAccount)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			if err := putTokenAccount(ctx, &TokenAccount{AccountID: ArbitrationEscrowAccount}); err != nil {
+				return nil, err
+			}
+		}
+		for _, party := range []string{panel.Challenger, panel.Respondent} {
+			if err := transferTokens(ctx, party, ArbitrationEscrowAccount, panel.Stake); err != nil {
+				return nil, fmt.Errorf("failed to stake arbitration fees of %s: %v", party, err)
+			}
+		}
+	}
+	dispute.Status = DisputeReferred
+	if err := putMeterDispute(ctx, dispute); err != nil {
+		return nil, err
+	}
+	if err := putArbitrationPanel(ctx, panel); err != nil {
+		return nil, err
+	}
+	if err := emitEvent(ctx, EventMeterDisputeChanged, dispute); err != nil {
+		return nil, err
+	}
+	return panel, emitEvent(ctx, EventArbitrationPanelChanged, panel)
+}
+
+// tallyVotes counts the votes to uphold and reject a panel's claim
+func tallyVotes(panel *ArbitrationPanel) (int, int) {
+	uphold, reject := 0, 0
+	for _, vote := range panel.Votes {
+		if vote {
+			uphold++
+		} else {
+			reject++
+		}
+	}
+	return uphold, reject
+}
+
+// closeArbitrationPanel decides a panel by the votes cast. The losing side's
+// stake pays each arbitrator who voted and both sides are refunded the rest.
+// A tied vote deadlocks the panel: both stakes are refunded and the dispute
+// returns to a single arbiter.
+func closeArbitrationPanel(ctx contractapi.TransactionContextInterface, panel *ArbitrationPanel) error {
+	uphold, reject := tallyVotes(panel)
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	panel.DecidedAt = now
+	dispute, err := (&EnergyTradingContract{}).GetMeterDispute(ctx, panel.MeterID, panel.IntervalStart)
+	if err != nil {
+		return err
+	}
+
+	refunds := map[string]float64{panel.Challenger: panel.Stake, panel.Respondent: panel.Stake}
+	if uphold == reject {
+		panel.Status = PanelDeadlocked
+		dispute.Status = panel.PriorStatus
+		if err := putMeterDispute(ctx, dispute); err != nil {
+			return err
+		}
+		if err := emitEvent(ctx, EventMeterDisputeChanged, dispute); err != nil {
+			return err
+		}
+	} else {
+		panel.Status = PanelDecided
+		panel.Upheld = uphold > reject
+		loser := panel.Challenger
+		if panel.Upheld {
+			loser = panel.Respondent
+		}
+		for _, arbitrator := range panel.Arbitrators {
+			if _, voted := panel.Votes[arbitrator]; !voted || panel.ArbitratorFee <= 0 {
+				continue
+			}
+			if err := transferTokens(ctx, ArbitrationEscrowAccount, arbitrator, panel.ArbitratorFee); err != nil {
+				return fmt.Errorf("failed to pay arbitrator %s: %v", arbitrator, err)
+			}
+			refunds[loser] -= panel.ArbitratorFee
+		}
+		if err := resolveMeterDispute(ctx, dispute, "", panel.Upheld, panel.ClaimedInjected, panel.ClaimedConsumed); err != nil {
+			return err
+		}
+	}
+	for _, party := range []string{panel.Challenger, panel.Respondent} {
+		if refunds[party] <= 1e-9 {
+			continue
+		}
+		if err := transferTokens(ctx, ArbitrationEscrowAccount, party, refunds[party]); err != nil {
+			return fmt.Errorf("failed to refund arbitration stake of %s: %v", party, err)
+		}
+	}
+	if err := putArbitrationPanel(ctx, panel); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventArbitrationPanelChanged, panel)
+}
+
+// CastArbitrationVote records the calling arbitrator's vote to uphold or
+// reject the claim of a panel it sits on. The panel is decided as soon as a
+// majority of its seats agree.
+func (e *EnergyTradingContract) CastArbitrationVote(ctx contractapi.TransactionContextInterface, meterID, intervalStart string, uphold bool) (*ArbitrationPanel, error) {
+	panel, err := e.GetArbitrationPanel(ctx, meterID, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if panel.Status != PanelVoting {
+		return nil, fmt.Errorf("arbitration panel of meter %s at %s is %s", meterID, panel.IntervalStart, panel.Status)
+	}
+	arbitrator, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !hasRole(panel.Arbitrators, arbitrator) {
+		return nil, fmt.Errorf("caller %s does not sit on the panel of meter %s at %s", arbitrator, meterID, panel.IntervalStart)
+	}
+	if _, voted := panel.Votes[arbitrator]; voted {
+		return nil, fmt.Errorf("arbitrator %s has already voted", arbitrator)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now > panel.Deadline {
+		return nil, fmt.Errorf("voting on meter %s at %s closed at %s", meterID, panel.IntervalStart, panel.Deadline)
+	}
+
+	panel.Votes[arbitrator] = uphold
+	upholds, rejects := tallyVotes(panel)
+	if 2*upholds > len(panel.Arbitrators) || 2*rejects > len(panel.Arbitrators) {
+		return panel, closeArbitrationPanel(ctx, panel)
+	}
+	if err := putArbitrationPanel(ctx, panel); err != nil {
+		return nil, err
+	}
+	return panel, emitEvent(ctx, EventArbitrationPanelChanged, panel)
+}
+
+// CloseArbitrationVote decides a panel that reached its deadline without a
+// majority by the votes that were cast
+func (e *EnergyTradingContract) CloseArbitrationVote(ctx contractapi.TransactionContextInterface, meterID, intervalStart string) (*ArbitrationPanel, error) {
+	panel, err := e.GetArbitrationPanel(ctx, meterID, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if panel.Status != PanelVoting {
+		return nil, fmt.Errorf("arbitration panel of meter %s at %s is %s", meterID, panel.IntervalStart, panel.Status)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now <= panel.Deadline {
+		return nil, fmt.Errorf("voting on meter %s at %s is open until %s", meterID, panel.IntervalStart, panel.Deadline)
+	}
+	return panel, closeArbitrationPanel(ctx, panel)
+}
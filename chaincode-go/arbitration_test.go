@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const testDisputeInterval = "2025-05-03T10:15:00Z"
+
+// setupTestPanelDispute has buyer1 challenge a reading of seller1's meter and
+// registers four arbitrators
+func setupTestPanelDispute(t *testing.T, e *EnergyTradingContract, tc *testContext) {
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 10))
+	for i := 1; i <= 4; i++ {
+		address := fmt.Sprintf("arb%d", i)
+		_, err := e.RegisterRole(tc.as(address, RoleArbiter))
+		require.NoError(t, err)
+		_, err = e.RegisterArbitrator(tc.as("admin1", RoleAdmin), address)
+		require.NoError(t, err)
+	}
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2.5, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 2.5)
+	require.NoError(t, e.ChallengeMeterReading(tc.as("buyer1", ""), "energy1", "meter-seller1", testDisputeInterval, "injection exceeds inverter rating"))
+}
+
+func TestArbitrationPanelMajority(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	setupTestPanelDispute(t, e, tc)
+	_, err := e.RegisterArbitrator(tc.as("admin1", RoleAdmin), "seller1")
+	require.EqualError(t, err, "address seller1 is not registered as an arbiter")
+	arbitrators, err := e.GetArbitrators(tc, 3, "")
+	require.NoError(t, err)
+	require.Len(t, arbitrators.Records, 3)
+	arbitrators, err = e.GetArbitrators(tc, 3, arbitrators.Bookmark)
+	require.NoError(t, err)
+	require.Len(t, arbitrators.Records, 1)
+	require.Equal(t, "arb4", arbitrators.Records[0].Address)
+
+	_, err = e.ReferDisputeToPanel(tc.as("seller1", ""), "meter-seller1", testDisputeInterval, 0.5, 0)
+	require.EqualError(t, err, "caller seller1 is not authorized to act for buyer1")
+	tc.stub.GetTxIDReturns("tx-refer")
+	panel, err := e.ReferDisputeToPanel(tc.as("buyer1", ""), "meter-seller1", testDisputeInterval, 0.5, 0)
+	require.NoError(t, err)
+	require.Len(t, panel.Arbitrators, 3)
+	require.Equal(t, 3.0, panel.Stake)
+	err = e.ResolveMeterDispute(tc.as("arbiter1", RoleArbiter), "meter-seller1", testDisputeInterval, false, 0, 0)
+	require.EqualError(t, err, "dispute of meter meter-seller1 at 2025-05-03T10:15:00Z is referred to an arbitrator panel")
+
+	outsider := "arb1"
+	for _, address := range []string{"arb1", "arb2", "arb3", "arb4"} {
+		if !hasRole(panel.Arbitrators, address) {
+			outsider = address
+		}
+	}
+	_, err = e.CastArbitrationVote(tc.as(outsider, RoleArbiter), "meter-seller1", testDisputeInterval, true)
+	require.EqualError(t, err, fmt.Sprintf("caller %s does not sit on the panel of meter meter-seller1 at %s", outsider, testDisputeInterval))
+	_, err = e.CastArbitrationVote(tc.as(panel.Arbitrators[0], RoleArbiter), "meter-seller1", testDisputeInterval, true)
+	require.NoError(t, err)
+	_, err = e.CastArbitrationVote(tc, "meter-seller1", testDisputeInterval, false)
+	require.EqualError(t, err, fmt.Sprintf("arbitrator %s has already voted", panel.Arbitrators[0]))
+
+	// The second vote to uphold is a majority of the three seats
+	panel, err = e.CastArbitrationVote(tc.as(panel.Arbitrators[1], RoleArbiter), "meter-seller1", testDisputeInterval, true)
+	require.NoError(t, err)
+	require.Equal(t, PanelDecided, panel.Status)
+	require.True(t, panel.Upheld)
+	dispute, err := e.GetMeterDispute(tc, "meter-seller1", testDisputeInterval)
+	require.NoError(t, err)
+	require.Equal(t, DisputeUpheld, dispute.Status)
+	reading, err := getMeterReading(tc, "meter-seller1", testDisputeInterval)
+	require.NoError(t, err)
+	require.Equal(t, 0.5, reading.KWhInjected)
+
+	// The seller lost: its stake pays the two voters and the rest comes back
+	for address, balance := range map[string]float64{"buyer1": 10, "seller1": 8, panel.Arbitrators[0]: 1, panel.Arbitrators[1]: 1, panel.Arbitrators[2]: 0} {
+		account, err := e.ReadTokenAccount(tc, address)
+		require.NoError(t, err)
+		require.InDeltaf(t, balance, account.Balance, 1e-9, "balance of %s", address)
+	}
+	_, err = e.ReferDisputeToPanel(tc.as("buyer1", ""), "meter-seller1", testDisputeInterval, 0.5, 0)
+	require.EqualError(t, err, "dispute of meter meter-seller1 at 2025-05-03T10:15:00Z is UPHELD")
+}
+
+func TestArbitrationPanelDeadlock(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	setupTestPanelDispute(t, e, tc)
+	panel, err := e.ReferDisputeToPanel(tc.as("buyer1", ""), "meter-seller1", testDisputeInterval, 0.5, 0)
+	require.NoError(t, err)
+	require.Equal(t, "2025-05-06T11:30:00Z", panel.Deadline)
+	_, err = e.CastArbitrationVote(tc.as(panel.Arbitrators[0], RoleArbiter), "meter-seller1", testDisputeInterval, true)
+	require.NoError(t, err)
+	_, err = e.CastArbitrationVote(tc.as(panel.Arbitrators[1], RoleArbiter), "meter-seller1", testDisputeInterval, false)
+	require.NoError(t, err)
+	_, err = e.CloseArbitrationVote(tc.as("buyer1", ""), "meter-seller1", testDisputeInterval)
+	require.EqualError(t, err, "voting on meter meter-seller1 at 2025-05-03T10:15:00Z is open until 2025-05-06T11:30:00Z")
+
+	// The third arbitrator misses the deadline and the tie goes back to an arbiter
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 6, 12, 0, 0, 0, time.UTC)), nil)
+	_, err = e.CastArbitrationVote(tc.as(panel.Arbitrators[2], RoleArbiter), "meter-seller1", testDisputeInterval, true)
+	require.EqualError(t, err, "voting on meter meter-seller1 at 2025-05-03T10:15:00Z closed at 2025-05-06T11:30:00Z")
+	panel, err = e.CloseArbitrationVote(tc.as("buyer1", ""), "meter-seller1", testDisputeInterval)
+	require.NoError(t, err)
+	require.Equal(t, PanelDeadlocked, panel.Status)
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventArbitrationPanelChanged, name)
+	for _, address := range []string{"buyer1", "seller1"} {
+		account, err := e.ReadTokenAccount(tc, address)
+		require.NoError(t, err)
+		require.Equal(t, 10.0, account.Balance)
+	}
+	require.NoError(t, e.ResolveMeterDispute(tc.as("arbiter1", RoleArbiter), "meter-seller1", testDisputeInterval, false, 0, 0))
+	dispute, err := e.GetMeterDispute(tc, "meter-seller1", testDisputeInterval)
+	require.NoError(t, err)
+	require.Equal(t, DisputeRejected, dispute.Status)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// AuditTradeRecord is a trade together with its private terms
+type AuditTradeRecord struct {
+	Asset          *EnergyAsset         `json:"asset"`
+	PrivateDetails *TradePrivateDetails `json:"privateDetails"`
+}
+
+// PaginatedAuditTradeResult is a page of audit trade records
+type PaginatedAuditTradeResult struct {
+	Records             []*AuditTradeRecord `json:"records"`
+	FetchedRecordsCount int32               `json:"fetchedRecordsCount"`
+	Bookmark            string              `json:"bookmark"`
+}
+
+// regulatorKey is the state key of the regulator setting
+const regulatorKey = "regulator"
+
+// Regulator names the organization whose members may call the audit
+// functions and read every participant's personal data
+type Regulator struct {
+	MSPID     string `json:"mspID"`
+	UpdatedBy string `json:"updatedBy,omitempty"`
+	UpdatedAt string `json:"updatedAt,omitempty"`
+}
+
+// GetRegulator returns the regulator organization, which is RegulatorMSPID
+// until an admin sets another
+func (e *EnergyTradingContract) GetRegulator(ctx contractapi.TransactionContextInterface) (*Regulator, error) {
+	regulatorJSON, err := ctx.GetStub().GetState(regulatorKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read regulator: %v", err)
+	}
+	if regulatorJSON == nil {
+		return &Regulator{MSPID: RegulatorMSPID}, nil
+	}
+	var regulator Regulator
+	if err := json.Unmarshal(regulatorJSON, &regulator); err != nil {
+		return nil, err
+	}
+	return &regulator, nil
+}
+
+// SetRegulator hands the audit functions to another organization, for example
+// when a network is overseen by a regulator with its own MSP ID. The
+// organization must also be added to the trade collections in
+// collections_config.json before it can read trade terms.
+func (e *EnergyTradingContract) SetRegulator(ctx contractapi.TransactionContextInterface, mspID string) (*Regulator, error) {
+	if mspID == "" {
+		return nil, fmt.Errorf("regulator MSP ID must not be empty")
+	}
+	admin, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	regulator := &Regulator{MSPID: mspID, UpdatedBy: admin, UpdatedAt: now}
+	regulatorJSON, err := json.Marshal(regulator)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(regulatorKey, regulatorJSON); err != nil {
+		return nil, err
+	}
+	return regulator, nil
+}
+
+// isRegulator reports whether the caller belongs to the regulator organization
+func isRegulator(ctx contractapi.TransactionContextInterface) (bool, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return false, fmt.Errorf("failed to read client MSP ID: %v", err)
+	}
+	regulator, err := (&EnergyTradingContract{}).GetRegulator(ctx)
+	if err != nil {
+		return false, err
+	}
+	return mspID == regulator.MSPID, nil
+}
+
+// requireRegulator fails unless the caller belongs to the regulator organization
+func requireRegulator(ctx contractapi.TransactionContextInterface) error {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read client MSP ID: %v", err)
+	}
+	regulator, err := (&EnergyTradingContract{}).GetRegulator(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != regulator.MSPID {
+		return fmt.Errorf("caller is not authorized: %s membership required", regulator.MSPID)
+	}
+	return nil
+}
+
+// AuditGetTrades returns every live trade, or every archived trade when
+// archived is set, including the private price and deposits. Regulator only.
+func (e *EnergyTradingContract) AuditGetTrades(ctx contractapi.TransactionContextInterface, archived bool, pageSize int32, bookmark string) (*PaginatedAuditTradeResult, error) {
+	if err := requireRegulator(ctx); err != nil {
+		return nil, err
+	}
+	if err := checkPageSize(ctx, pageSize); err != nil {
+		return nil, err
+	}
+	prefix := deliveryIndexPrefix
+	if archived {
+		prefix = archiveIndexPrefix
+	}
+
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByRangeWithPagination(prefix, prefix+string(utf8.MaxRune), pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	result := &PaginatedAuditTradeResult{Records: []*AuditTradeRecord{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		asset, err := e.ReadEnergyAsset(ctx, string(queryResponse.Value))
+		if err != nil {
+			return nil, err
+		}
+		details, err := getPrivateDetails(ctx, asset)
+		if err != nil {
+			return nil, err
+		}
+		result.Records = append(result.Records, &AuditTradeRecord{Asset: asset, PrivateDetails: details})
+	}
+	if metadata != nil {
+		result.FetchedRecordsCount = metadata.FetchedRecordsCount
+		result.Bookmark = metadata.Bookmark
+	}
+	return result, nil
+}
+
+// PaginatedReputationResult is a page of reputations
+type PaginatedReputationResult struct {
+	Records             []*Reputation `json:"records"`
+	FetchedRecordsCount int32         `json:"fetchedRecordsCount"`
+	Bookmark            string        `json:"bookmark"`
+}
+
+// AuditGetAllReputations returns a page of the reputations of every
+// participant. Regulator only.
+func (e *EnergyTradingContract) AuditGetAllReputations(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedReputationResult, error) {
+	if err := requireRegulator(ctx); err != nil {
+		return nil, err
+	}
+	result := &PaginatedReputationResult{Records: []*Reputation{}}
+	metadata, err := queryPage(ctx, "reputation", []string{}, pageSize, bookmark, func(value []byte) error {
+		var rep Reputation
+		if err := json.Unmarshal(value, &rep); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &rep)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// FeeLedgerEntry is what the settlement of a trade charged in fees and
+// levies
+type FeeLedgerEntry struct {
+	TokenID          string        `json:"tokenID"`
+	SettledAt        string        `json:"settledAt"`
+	Payment          float64       `json:"payment"`
+	Levies           []*LevyCharge `json:"levies"`
+	TotalLevies      float64       `json:"totalLevies"`
+	NetworkFee       float64       `json:"networkFee"`
+	InsurancePremium float64       `json:"insurancePremium"`
+}
+
+// PaginatedFeeLedgerResult is a page of fee ledger entries
+type PaginatedFeeLedgerResult struct {
+	Records             []*FeeLedgerEntry `json:"records"`
+	FetchedRecordsCount int32             `json:"fetchedRecordsCount"`
+	Bookmark            string            `json:"bookmark"`
+}
+
+// AuditGetFeeLedger returns a page of the fees and levies charged by every
+// settled trade, in token ID order. Regulator only.
+func (e *EnergyTradingContract) AuditGetFeeLedger(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedFeeLedgerResult, error) {
+	if err := requireRegulator(ctx); err != nil {
+		return nil, err
+	}
+	result := &PaginatedFeeLedgerResult{Records: []*FeeLedgerEntry{}}
+	metadata, err := queryPage(ctx, "settlement", []string{}, pageSize, bookmark, func(value []byte) error {
+		var settlement Settlement
+		if err := json.Unmarshal(value, &settlement); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &FeeLedgerEntry{
+			TokenID:          settlement.TokenID,
+			SettledAt:        settlement.SettledAt,
+			Payment:          settlement.Payment,
+			Levies:           settlement.Levies,
+			TotalLevies:      settlement.TotalLevies,
+			NetworkFee:       settlement.NetworkFee,
+			InsurancePremium: settlement.InsurancePremium,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// canSeePersonalData reports whether the caller is the participant itself, an
+// admin or the regulator.
+func canSeePersonalData(ctx contractapi.TransactionContextInterface, address string) (bool, error) {
+	regulator, err := isRegulator(ctx)
+	if err != nil {
+		return false, err
+	}
+	role, err := callerRole(ctx)
+	if err != nil {
+		return false, err
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return false, err
+	}
+	return regulator || role == RoleAdmin || caller == address, nil
+}
+
+// redactParticipant clears identifying fields unless the caller may see them
+func redactParticipant(ctx contractapi.TransactionContextInterface, participant *Participant) error {
+	allowed, err := canSeePersonalData(ctx, participant.Address)
+	if err != nil || allowed {
+		return err
+	}
+	participant.MeterIDs = nil
+	return nil
+}
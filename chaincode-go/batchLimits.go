@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Default batch limits, in force until an admin sets others. They bound the
+// work a single transaction does, so that an oversized client payload fails
+// fast instead of timing out endorsement on every peer.
+const (
+	DefaultMaxBatchSize     int32 = 50
+	DefaultMaxFillsPerOrder int32 = 20
+)
+
+// batchLimitsKey is the state key of the batch limits
+const batchLimitsKey = "batchlimits"
+
+// BatchLimits bound the work of batch operations. MaxBatchSize caps the
+// items of a batch transfer and the trades archived per call; MaxFillsPerOrder
+// caps the fills a certificate bid takes in one matching pass.
+type BatchLimits struct {
+	MaxBatchSize     int32  `json:"maxBatchSize"`
+	MaxFillsPerOrder int32  `json:"maxFillsPerOrder"`
+	UpdatedBy        string `json:"updatedBy,omitempty"`
+	UpdatedAt        string `json:"updatedAt,omitempty"`
+}
+
+// SetBatchLimits sets the limits of batch operations
+func (e *EnergyTradingContract) SetBatchLimits(ctx contractapi.TransactionContextInterface, maxBatchSize, maxFillsPerOrder int32) (*BatchLimits, error) {
+	if maxBatchSize <= 0 || maxFillsPerOrder <= 0 {
+		return nil, fmt.Errorf("batch limits must be positive")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	limits := &BatchLimits{MaxBatchSize: maxBatchSize, MaxFillsPerOrder: maxFillsPerOrder, UpdatedBy: caller, UpdatedAt: now}
+	limitsJSON, err := json.Marshal(limits)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(batchLimitsKey, limitsJSON); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// GetBatchLimits returns the limits of batch operations
+func (e *EnergyTradingContract) GetBatchLimits(ctx contractapi.TransactionContextInterface) (*BatchLimits, error) {
+	limitsJSON, err := ctx.GetStub().GetState(batchLimitsKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch limits: %v", err)
+	}
+	if limitsJSON == nil {
+		return &BatchLimits{MaxBatchSize: DefaultMaxBatchSize, MaxFillsPerOrder: DefaultMaxFillsPerOrder}, nil
+	}
+	var limits BatchLimits
+	if err := json.Unmarshal(limitsJSON, &limits); err != nil {
+		return nil, err
+	}
+	return &limits, nil
+}
+
+// checkBatchSize fails if a batch holds more items than the batch limit
+func checkBatchSize(ctx contractapi.TransactionContextInterface, items int, noun string) error {
+	limits, err := (&EnergyTradingContract{}).GetBatchLimits(ctx)
+	if err != nil {
+		return err
+	}
+	if items > int(limits.MaxBatchSize) {
+		return fmt.Errorf("batch of %d %s exceeds the limit of %d", items, noun, limits.MaxBatchSize)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestBatchLimits(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "seller1", 10))
+	require.NoError(t, e.MintTokens(tc, "buyer1", 1))
+
+	limits, err := e.GetBatchLimits(tc)
+	require.NoError(t, err)
+	require.Equal(t, DefaultMaxBatchSize, limits.MaxBatchSize)
+	require.Equal(t, DefaultMaxFillsPerOrder, limits.MaxFillsPerOrder)
+	_, err = e.SetBatchLimits(tc, 0, 1)
+	require.EqualError(t, err, "batch limits must be positive")
+	limits, err = e.SetBatchLimits(tc, 2, 1)
+	require.NoError(t, err)
+	require.Equal(t, "admin1", limits.UpdatedBy)
+
+	tc.as("seller1", "")
+	err = e.SafeBatchTransferFrom(tc, "seller1", "buyer1", []string{EnergyTokenID, EnergyTokenID, EnergyTokenID}, []float64{1, 1, 1})
+	require.EqualError(t, err, "batch of 3 transfers exceeds the limit of 2")
+	err = e.SafeBatchTransferFrom(tc, "seller1", "buyer1", []string{EnergyTokenID, EnergyTokenID}, []float64{1, 20})
+	require.EqualError(t, err, "transfer 2 of 2 (ENERGY) rejected: account seller1 has insufficient balance")
+}
+
+func TestCertificateBidFillLimit(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	require.NoError(t, e.SetCertificateEnergy(tc.as("admin1", RoleAdmin), 1))
+	require.NoError(t, e.MintTokens(tc, "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	_, err := e.SetBatchLimits(tc, DefaultMaxBatchSize, 2)
+	require.NoError(t, err)
+	_, err = e.RegisterGenerator(tc.as("seller1", ""), meterID, "solar", 5)
+	require.NoError(t, err)
+	_, err = e.VerifyGenerator(tc.as("operator1", RoleOperator), meterID)
+	require.NoError(t, err)
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 0, 0, 0, time.UTC)), nil)
+	signature := tc.signReading(t, meterID, "2025-05-03T10:00:00Z", 3, 0)
+	require.NoError(t, e.SubmitMeterReading(tc.as("seller1", ""), meterID, "2025-05-03T10:00:00Z", 3, 0, signature))
+	for _, n := range []string{"1", "2", "3"} {
+		_, err := e.PlaceCertificateOffer(tc, "offer"+n, meterID+"-"+n, 1)
+		require.NoError(t, err)
+	}
+
+	// The first pass stops at the fill limit and says so
+	bid, err := e.PlaceCertificateBid(tc.as("buyer1", ""), "bid1", "", 3, 1)
+	require.NoError(t, err)
+	require.Equal(t, 2, bid.Filled)
+	require.Equal(t, OrderOpen, bid.Status)
+	require.Equal(t, "fill limit of 2 reached; call MatchCertificateBid to continue", bid.StopReason)
+
+	_, err = e.MatchCertificateBid(tc.as("seller1", ""), "offer3")
+	require.EqualError(t, err, "certificate order offer3 is not an open bid")
+	_, err = e.MatchCertificateBid(tc, "bid1")
+	require.EqualError(t, err, "caller seller1 is not authorized to act for buyer1")
+	bid, err = e.MatchCertificateBid(tc.as("buyer1", ""), "bid1")
+	require.NoError(t, err)
+	require.Equal(t, 3, bid.Filled)
+	require.Equal(t, OrderFilled, bid.Status)
+	require.Empty(t, bid.StopReason)
+}
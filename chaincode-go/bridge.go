@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// BridgeEscrowAccount holds tokens and certificates locked for transfer to
+// another network
+const BridgeEscrowAccount = "bridge-escrow"
+
+// Bridge network kinds
+const (
+	NetworkFabricChannel = "FABRIC_CHANNEL"
+	NetworkEVM           = "EVM"
+)
+
+// Bridged asset types
+const (
+	BridgeTokens      = "TOKENS"
+	BridgeCertificate = "CERTIFICATE"
+)
+
+// Bridge transfer directions and statuses
+const (
+	BridgeOutbound = "OUTBOUND"
+	BridgeInbound  = "INBOUND"
+
+	BridgeLocked    = "LOCKED"
+	BridgeCompleted = "COMPLETED"
+	BridgeRefunded  = "REFUNDED"
+)
+
+// BridgeNetwork is another Fabric channel or EVM chain of the federation.
+// Locked counts the tokens escrowed here for transfers to the network that it
+// has confirmed; Minted counts the tokens issued here for transfers from it
+// beyond those.
+type BridgeNetwork struct {
+	NetworkID    string  `json:"networkID"`
+	Kind         string  `json:"kind"`
+	Locked       float64 `json:"locked"`
+	Minted       float64 `json:"minted"`
+	RegisteredAt string  `json:"registeredAt"`
+}
+
+// BridgeTransfer is a transfer of tokens or a certificate to or from another
+// network. Outbound transfers lock the asset in escrow until a relayer
+// confirms the network received it, or refunds it. Inbound transfers are
+// recorded under the network and its own transfer ID so a relayer cannot
+// deliver the same transfer twice. Proof holds the relayer's reference to
+// the transaction on the other network.
+type BridgeTransfer struct {
+	TransferID    string  `json:"transferID"`
+	Direction     string  `json:"direction"`
+	NetworkID     string  `json:"networkID"`
+	AssetType     string  `json:"assetType"`
+	Amount        float64 `json:"amount,omitempty"`
+	CertificateID string  `json:"certificateID,omitempty"`
+	Sender        string  `json:"sender"`
+	Recipient     string  `json:"recipient"`
+	Status        string  `json:"status"`
+	Proof         string  `json:"proof,omitempty"`
+	Relayer       string  `json:"relayer,omitempty"`
+	CreatedAt     string  `json:"createdAt"`
+	UpdatedAt     string  `json:"updatedAt"`
+}
+
+func bridgeNetworkKey(ctx contractapi.TransactionContextInterface, networkID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("bridgenetwork", []string{networkID})
+}
+
+func bridgeTransferKey(ctx contractapi.TransactionContextInterface, transferID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("bridgetransfer", []string{transferID})
+}
+
+func putBridgeNetwork(ctx contractapi.TransactionContextInterface, network *BridgeNetwork) error {
+	networkJSON, err := json.Marshal(network)
+	if err != nil {
+		return err
+	}
+	key, err := bridgeNetworkKey(ctx, network.NetworkID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, networkJSON)
+}
+
+func putBridgeTransfer(ctx contractapi.TransactionContextInterface, transfer *BridgeTransfer) error {
+	transferJSON, err := json.Marshal(transfer)
+	if err != nil {
+		return err
+	}
+	key, err := bridgeTransferKey(ctx, transfer.TransferID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, transferJSON)
+}
+
+// getBridgeTransfer returns a bridge transfer, or nil if there is none
+func getBridgeTransfer(ctx contractapi.TransactionContextInterface, transferID string) (*BridgeTransfer, error) {
+	key, err := bridgeTransferKey(ctx, transferID)
+	if err != nil {
+		return nil, err
+	}
+	transferJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bridge transfer %s: %v", transferID, err)
+	}
+	if transferJSON == nil {
+		return nil, nil
+	}
+	var transfer BridgeTransfer
+	if err := json.Unmarshal(transferJSON, &transfer); err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+// RegisterBridgeNetwork admits a Fabric channel or EVM chain as a bridge
+// destination and opens the bridge escrow account if needed
+func (e *EnergyTradingContract) RegisterBridgeNetwork(ctx contractapi.TransactionContextInterface, networkID, kind string) (*BridgeNetwork, error) {
+	if networkID == "" {
+		return nil, fmt.Errorf("network ID must not be empty")
+	}
+	if kind != NetworkFabricChannel && kind != NetworkEVM {
+		return nil, fmt.Errorf("network kind must be %s or %s", NetworkFabricChannel, NetworkEVM)
+	}
+	key, err := bridgeNetworkKey(ctx, networkID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bridge network %s: %v", networkID, err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("bridge network %s already exists", networkID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	escrow, err := getTokenAccount(ctx, BridgeEscrowAccount)
+	if err != nil {
+		return nil, err
+	}
+	if escrow == nil {
+		if err := putTokenAccount(ctx, &TokenAccount{AccountID: BridgeEscrowAccount}); err != nil {
+			return nil, err
+		}
+	}
+	network := &BridgeNetwork{NetworkID: networkID, Kind: kind, RegisteredAt: now}
+	if err := putBridgeNetwork(ctx, network); err != nil {
+		return nil, err
+	}
+	return network, nil
+}
+
+// GetBridgeNetwork returns a registered bridge network
+func (e *EnergyTradingContract) GetBridgeNetwork(ctx contractapi.TransactionContextInterface, networkID string) (*BridgeNetwork, error) {
+	key, err := bridgeNetworkKey(ctx, networkID)
+	if err != nil {
+		return nil, err
+	}
+	networkJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bridge network %s: %v", networkID, err)
+	}
+	if networkJSON == nil {
+		return nil, fmt.Errorf("bridge network %s does not exist", networkID)
+	}
+	var network BridgeNetwork
+	if err := json.Unmarshal(networkJSON, &network); err != nil {
+		return nil, err
+	}
+	return &network, nil
+}
+
+// GetBridgeTransfer returns a bridge transfer
+func (e *EnergyTradingContract) GetBridgeTransfer(ctx contractapi.TransactionContextInterface, transferID string) (*BridgeTransfer, error) {
+	transfer, err := getBridgeTransfer(ctx, transferID)
+	if err != nil {
+		return nil, err
+	}
+	if transfer == nil {
+		return nil, fmt.Errorf("bridge transfer %s does not exist", transferID)
+	}
+	return transfer, nil
+}
+
+// newOutboundTransfer returns a locked outbound transfer from the caller,
+// identified by the transaction ID
+func (e *EnergyTradingContract) newOutboundTransfer(ctx contractapi.TransactionContextInterface, networkID, assetType, recipient string) (*BridgeTransfer, error) {
+	if _, err := e.GetBridgeNetwork(ctx, networkID); err != nil {
+		return nil, err
+	}
+	if recipient == "" {
+		return nil, fmt.Errorf("recipient must not be empty")
+	}
+	sender, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &BridgeTransfer{
+		TransferID: ctx.GetStub().GetTxID(),
+		Direction:  BridgeOutbound,
+		NetworkID:  networkID,
+		AssetType:  assetType,
+		Sender:     sender,
+		Recipient:  recipient,
+		Status:     BridgeLocked,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}, nil
+}
+
+// LockTokensForBridge locks tokens of the caller in the bridge escrow for
+// delivery to a recipient on another network. The transfer ID is the
+// transaction ID.
+func (e *EnergyTradingContract) LockTokensForBridge(ctx contractapi.TransactionContextInterface, networkID, recipient string, amount float64) (*BridgeTransfer, error) {
+	transfer, err := e.newOutboundTransfer(ctx, networkID, BridgeTokens, recipient)
+	if err != nil {
+		return nil, err
+	}
+	if err := transferTokens(ctx, transfer.Sender, BridgeEscrowAccount, amount); err != nil {
+		return nil, fmt.Errorf("failed to lock tokens: %v", err)
+	}
+	transfer.Amount = amount
+	if err := putBridgeTransfer(ctx, transfer); err != nil {
+		return nil, err
+	}
+	return transfer, emitEvent(ctx, EventBridgeTransferChanged, transfer)
+}
+
+// LockCertificateForBridge locks one of the caller's active certificates in
+// the bridge escrow for delivery to a recipient on another network
+func (e *EnergyTradingContract) LockCertificateForBridge(ctx contractapi.TransactionContextInterface, networkID, certificateID, recipient string) (*BridgeTransfer, error) {
+	transfer, err := e.newOutboundTransfer(ctx, networkID, BridgeCertificate, recipient)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := e.GetCertificate(ctx, certificateID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireActiveCertificate(ctx, certificate); err != nil {
+		return nil, err
+	}
+	certificate.Owner = BridgeEscrowAccount
+	if err := putCertificate(ctx, certificate, transfer.Sender); err != nil {
+		return nil, err
+	}
+	transfer.CertificateID = certificateID
+	if err := putBridgeTransfer(ctx, transfer); err != nil {
+		return nil, err
+	}
+	return transfer, emitEvent(ctx, EventBridgeTransferChanged, transfer)
+}
+
+// lockedOutbound returns an outbound transfer still awaiting the relayer
+func (e *EnergyTradingContract) lockedOutbound(ctx contractapi.TransactionContextInterface, transferID string) (*BridgeTransfer, error) {
+	transfer, err := e.GetBridgeTransfer(ctx, transferID)
+	if err != nil {
+		return nil, err
+	}
+	if transfer.Direction != BridgeOutbound || transfer.Status != BridgeLocked {
+		return nil, fmt.Errorf("bridge transfer %s is not a locked outbound transfer", transferID)
+	}
+	return transfer, nil
+}
+
+// ConfirmBridgeTransfer records that the destination network has delivered
+// an outbound transfer. The asset stays in escrow, backing its counterpart
+// on the other network.
+func (e *EnergyTradingContract) ConfirmBridgeTransfer(ctx contractapi.TransactionContextInterface, transferID, proof string) (*BridgeTransfer, error) {
+	if proof == "" {
+		return nil, fmt.Errorf("proof must not be empty")
+	}
+	transfer, err := e.lockedOutbound(ctx, transferID)
+	if err != nil {
+		return nil, err
+	}
+	network, err := e.GetBridgeNetwork(ctx, transfer.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	network.Locked += transfer.Amount
+	if err := putBridgeNetwork(ctx, network); err != nil {
+		return nil, err
+	}
+	return e.updateBridgeTransfer(ctx, transfer, BridgeCompleted, proof)
+}
+
+// RefundBridgeTransfer returns the asset of an outbound transfer the
+// destination network rejected to its sender
+func (e *EnergyTradingContract) RefundBridgeTransfer(ctx contractapi.TransactionContextInterface, transferID, proof string) (*BridgeTransfer, error) {
+	transfer, err := e.lockedOutbound(ctx, transferID)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.releaseBridgedAsset(ctx, transfer, transfer.Sender); err != nil {
+		return nil, err
+	}
+	return e.updateBridgeTransfer(ctx, transfer, BridgeRefunded, proof)
+}
+
+// ReceiveBridgeTransfer delivers a transfer from another network. Tokens are
+// released from escrow up to the amount locked for that network, and any
+// remainder is minted. Only certificates issued on this ledger and bridged
+// out earlier can be received back.
+func (e *EnergyTradingContract) ReceiveBridgeTransfer(ctx contractapi.TransactionContextInterface, networkID, sourceTransferID, assetType, certificateID string, amount float64, sender, recipient, proof string) (*BridgeTransfer, error) {
+	if sourceTransferID == "" || proof == "" {
+		return nil, fmt.Errorf("source transfer ID and proof must not be empty")
+	}
+	network, err := e.GetBridgeNetwork(ctx, networkID)
+	if err != nil {
+		return nil, err
+	}
+	transferID := networkID + ":" + sourceTransferID
+	existing, err := getBridgeTransfer(ctx, transferID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("bridge transfer %s has already been received", transferID)
+	}
+	if _, err := requireApprovedParticipant(ctx, recipient); err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	transfer := &BridgeTransfer{
+		TransferID: transferID,
+		Direction:  BridgeInbound,
+		NetworkID:  networkID,
+		AssetType:  assetType,
+		Sender:     sender,
+		Recipient:  recipient,
+		Status:     BridgeLocked,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	switch assetType {
+	case BridgeTokens:
+		if amount <= 0 {
+			return nil, fmt.Errorf("amount must be positive")
+		}
+		transfer.Amount = amount
+		exists, err := tokenAccountExists(ctx, recipient)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			if err := putTokenAccount(ctx, &TokenAccount{AccountID: recipient}); err != nil {
+				return nil, err
+			}
+		}
+		released := math.Min(amount, network.Locked)
+		if minted := amount - released; minted > 0 {
+			if err := adjustBalance(ctx, recipient, minted); err != nil {
+				return nil, err
+			}
+			network.Minted += minted
+		}
+		if released > 0 {
+			if err := transferTokens(ctx, BridgeEscrowAccount, recipient, released); err != nil {
+				return nil, fmt.Errorf("failed to release tokens: %v", err)
+			}
+			network.Locked -= released
+		}
+	case BridgeCertificate:
+		certificate, err := e.GetCertificate(ctx, certificateID)
+		if err != nil {
+			return nil, err
+		}
+		if certificate.Owner != BridgeEscrowAccount {
+			return nil, fmt.Errorf("certificate %s was not bridged out of this ledger", certificateID)
+		}
+		transfer.CertificateID = certificateID
+		if err := e.releaseBridgedAsset(ctx, transfer, recipient); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("asset type must be %s or %s", BridgeTokens, BridgeCertificate)
+	}
+	if err := putBridgeNetwork(ctx, network); err != nil {
+		return nil, err
+	}
+	return e.updateBridgeTransfer(ctx, transfer, BridgeCompleted, proof)
+}
+
+// releaseBridgedAsset moves the asset of a transfer out of the bridge escrow
+func (e *EnergyTradingContract) releaseBridgedAsset(ctx contractapi.TransactionContextInterface, transfer *BridgeTransfer, to string) error {
+	if transfer.AssetType == BridgeTokens {
+		return transferTokens(ctx, BridgeEscrowAccount, to, transfer.Amount)
+	}
+	certificate, err := e.GetCertificate(ctx, transfer.CertificateID)
+	if err != nil {
+		return err
+	}
+	certificate.Owner = to
+	return putCertificate(ctx, certificate, BridgeEscrowAccount)
+}
+
+// updateBridgeTransfer records the relayer's outcome of a transfer
+func (e *EnergyTradingContract) updateBridgeTransfer(ctx contractapi.TransactionContextInterface, transfer *BridgeTransfer, status, proof string) (*BridgeTransfer, error) {
+	relayer, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	transfer.Status = status
+	transfer.Proof = proof
+	transfer.Relayer = relayer
+	transfer.UpdatedAt = now
+	if err := putBridgeTransfer(ctx, transfer); err != nil {
+		return nil, err
+	}
+	return transfer, emitEvent(ctx, EventBridgeTransferChanged, transfer)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestBridgeTransfers(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "seller1", 10))
+	require.NoError(t, e.SetCertificateEnergy(tc, 1))
+	_, err := e.RegisterBridgeNetwork(tc, "community-b", "BITCOIN")
+	require.EqualError(t, err, "network kind must be FABRIC_CHANNEL or EVM")
+	_, err = e.RegisterBridgeNetwork(tc, "community-b", NetworkEVM)
+	require.NoError(t, err)
+	_, err = e.RegisterGenerator(tc.as("seller1", ""), meterID, "wind", 5)
+	require.NoError(t, err)
+	_, err = e.VerifyGenerator(tc.as("operator1", RoleOperator), meterID)
+	require.NoError(t, err)
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 0, 0, 0, time.UTC)), nil)
+	signature := tc.signReading(t, meterID, "2025-05-03T10:00:00Z", 1, 0)
+	require.NoError(t, e.SubmitMeterReading(tc.as("seller1", ""), meterID, "2025-05-03T10:00:00Z", 1, 0, signature))
+
+	// Outbound tokens stay locked once the other network confirms them
+	tc.stub.GetTxIDReturns("tx-out1")
+	_, err = e.LockTokensForBridge(tc, "community-c", "0xabc", 4)
+	require.EqualError(t, err, "bridge network community-c does not exist")
+	transfer, err := e.LockTokensForBridge(tc, "community-b", "0xabc", 4)
+	require.NoError(t, err)
+	require.Equal(t, "tx-out1", transfer.TransferID)
+	_, err = e.ConfirmBridgeTransfer(tc.as("relayer1", RoleRelayer), "tx-out1", "0xreceipt1")
+	require.NoError(t, err)
+	_, err = e.RefundBridgeTransfer(tc, "tx-out1", "")
+	require.EqualError(t, err, "bridge transfer tx-out1 is not a locked outbound transfer")
+
+	// A rejected certificate transfer is refunded to the sender
+	tc.stub.GetTxIDReturns("tx-out2")
+	_, err = e.LockCertificateForBridge(tc.as("seller1", ""), "community-b", meterID+"-1", "0xabc")
+	require.NoError(t, err)
+	_, err = e.TransferCertificate(tc, meterID+"-1", "buyer1")
+	require.Error(t, err)
+	transfer, err = e.RefundBridgeTransfer(tc.as("relayer1", RoleRelayer), "tx-out2", "recipient rejected")
+	require.NoError(t, err)
+	require.Equal(t, BridgeRefunded, transfer.Status)
+	certificate, err := e.GetCertificate(tc, meterID+"-1")
+	require.NoError(t, err)
+	require.Equal(t, "seller1", certificate.Owner)
+
+	// Inbound tokens release the locked amount and mint the rest
+	transfer, err = e.ReceiveBridgeTransfer(tc, "community-b", "0xdeposit", BridgeTokens, "", 6, "0xdef", "buyer1", "0xreceipt2")
+	require.NoError(t, err)
+	require.Equal(t, "community-b:0xdeposit", transfer.TransferID)
+	_, err = e.ReceiveBridgeTransfer(tc, "community-b", "0xdeposit", BridgeTokens, "", 6, "0xdef", "buyer1", "0xreceipt2")
+	require.EqualError(t, err, "bridge transfer community-b:0xdeposit has already been received")
+	buyer, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, 6.0, buyer.Balance)
+	network, err := e.GetBridgeNetwork(tc, "community-b")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, network.Locked)
+	require.Equal(t, 2.0, network.Minted)
+
+	// Certificates from other ledgers cannot be received
+	_, err = e.ReceiveBridgeTransfer(tc, "community-b", "0xcert", BridgeCertificate, meterID+"-1", 0, "0xdef", "buyer1", "0xreceipt3")
+	require.EqualError(t, err, "certificate "+meterID+"-1 was not bridged out of this ledger")
+}
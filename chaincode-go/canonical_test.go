@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	payload, err := canonicalJSON(MeterReadingPayload{MeterID: "meter-<1>", IntervalStart: "2025-05-03T10:00:00Z", KWhInjected: 1e-7, KWhConsumed: 2.5e21})
+	require.NoError(t, err)
+	require.Equal(t, `{"intervalStart":"2025-05-03T10:00:00Z","kWhConsumed":2500000000000000000000,"kWhInjected":0.0000001,"meterID":"meter-<1>"}`, string(payload))
+
+	// Field order and number formatting of the input do not matter
+	a, err := canonicalJSON(map[string]interface{}{"b": []interface{}{1.0, nil, true}, "a": -0.0})
+	require.NoError(t, err)
+	b, err := canonicalJSON(struct {
+		A float64       `json:"a"`
+		B []interface{} `json:"b"`
+	}{0, []interface{}{1, nil, true}})
+	require.NoError(t, err)
+	require.Equal(t, `{"a":0,"b":[1,null,true]}`, string(a))
+	require.Equal(t, a, b)
+}
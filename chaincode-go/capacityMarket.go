@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Capacity offer statuses
+const (
+	OfferOpen     = "OPEN"
+	OfferAccepted = "ACCEPTED"
+	OfferRejected = "REJECTED"
+)
+
+// Capacity reservation statuses
+const (
+	ReservationReserved = "RESERVED"
+	ReservationSettled  = "SETTLED"
+)
+
+// CapacityOffer offers Capacity kW of standby capability in a zone for one
+// time slot at Price tokens per kW
+type CapacityOffer struct {
+	OfferID       string  `json:"offerID"`
+	Provider      string  `json:"provider"`
+	Zone          string  `json:"zone"`
+	IntervalStart string  `json:"intervalStart"`
+	Capacity      float64 `json:"capacity"`
+	Price         float64 `json:"price"`
+	Status        string  `json:"status"`
+	CreatedAt     string  `json:"createdAt"`
+}
+
+// CapacityClearing is the result of clearing the capacity offers of a zone
+// for one time slot. Every accepted offer is paid the uniform ClearingPrice,
+// the price of the most expensive accepted offer.
+type CapacityClearing struct {
+	Zone          string   `json:"zone"`
+	IntervalStart string   `json:"intervalStart"`
+	Required      float64  `json:"required"`
+	Cleared       float64  `json:"cleared"`
+	ClearingPrice float64  `json:"clearingPrice"`
+	Reservations  []string `json:"reservations"`
+	Operator      string   `json:"operator"`
+	ClearedAt     string   `json:"clearedAt"`
+}
+
+// CapacityReservation is an accepted offer. The grid operator may activate
+// it, calling for energy up to the reserved capacity over the slot. At
+// settlement the provider is paid for the capacity in proportion to its
+// verified availability: having metered the slot at all, and injecting the
+// activated energy if it was activated.
+type CapacityReservation struct {
+	ReservationID   string  `json:"reservationID"`
+	Provider        string  `json:"provider"`
+	Zone            string  `json:"zone"`
+	IntervalStart   string  `json:"intervalStart"`
+	Capacity        float64 `json:"capacity"`
+	ClearingPrice   float64 `json:"clearingPrice"`
+	Status          string  `json:"status"`
+	ActivatedEnergy float64 `json:"activatedEnergy,omitempty"`
+	DeliveredEnergy float64 `json:"deliveredEnergy"`
+	Availability    float64 `json:"availability"`
+	Payment         float64 `json:"payment"`
+	SettledAt       string  `json:"settledAt,omitempty"`
+}
+
+func capacityOfferKey(ctx contractapi.TransactionContextInterface, intervalStart, offerID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("capacityoffer", []string{intervalStart, offerID})
+}
+
+func capacityClearingKey(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("capacityclearing", []string{zone, intervalStart})
+}
+
+func capacityReservationKey(ctx contractapi.TransactionContextInterface, reservationID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("capacityreservation", []string{reservationID})
+}
+
+func putCapacityOffer(ctx contractapi.TransactionContextInterface, offer *CapacityOffer) error {
+	offerJSON, err := json.Marshal(offer)
+	if err != nil {
+		return err
+	}
+	key, err := capacityOfferKey(ctx, offer.IntervalStart, offer.OfferID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, offerJSON)
+}
+
+func putCapacityReservation(ctx contractapi.TransactionContextInterface, reservation *CapacityReservation) error {
+	reservationJSON, err := json.Marshal(reservation)
+	if err != nil {
+		return err
+	}
+	key, err := capacityReservationKey(ctx, reservation.ReservationID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, reservationJSON)
+}
+
+// SubmitCapacityOffer offers the caller's standby capability for a time slot
+// that has not started
+func (e *EnergyTradingContract) SubmitCapacityOffer(ctx contractapi.TransactionContextInterface, offerID, intervalStart string, capacity, price float64) (*CapacityOffer, error) {
+	if capacity <= 0 || price < 0 {
+		return nil, fmt.Errorf("capacity must be positive and price must not be negative")
+	}
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseTimestamp(intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(start) {
+		return nil, fmt.Errorf("interval %s has already started", intervalStart)
+	}
+	provider, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	participant, err := requireApprovedParticipant(ctx, provider)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getCapacityReservation(ctx, offerID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := capacityOfferKey(ctx, intervalStart, offerID)
+	if err != nil {
+		return nil, err
+	}
+	offerJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capacity offer %s: %v", offerID, err)
+	}
+	if existing != nil || offerJSON != nil {
+		return nil, fmt.Errorf("capacity offer %s already exists", offerID)
+	}
+	clearing, err := getCapacityClearing(ctx, participant.Zone, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if clearing != nil {
+		return nil, fmt.Errorf("capacity market of zone %s for %s has already cleared", participant.Zone, intervalStart)
+	}
+
+	offer := &CapacityOffer{
+		OfferID:       offerID,
+		Provider:      provider,
+		Zone:          participant.Zone,
+		IntervalStart: intervalStart,
+		Capacity:      capacity,
+		Price:         price,
+		Status:        OfferOpen,
+		CreatedAt:     now.Format(time.RFC3339),
+	}
+	if err := putCapacityOffer(ctx, offer); err != nil {
+		return nil, err
+	}
+	return offer, emitEvent(ctx, EventCapacityOffered, offer)
+}
+
+// PaginatedCapacityOfferResult is a page of capacity offers
+type PaginatedCapacityOfferResult struct {
+	Records             []*CapacityOffer `json:"records"`
+	FetchedRecordsCount int32            `json:"fetchedRecordsCount"`
+	Bookmark            string           `json:"bookmark"`
+}
+
+// GetCapacityOffers returns a page of the capacity offers for a time slot
+func (e *EnergyTradingContract) GetCapacityOffers(ctx contractapi.TransactionContextInterface, intervalStart string, pageSize int32, bookmark string) (*PaginatedCapacityOfferResult, error) {
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedCapacityOfferResult{Records: []*CapacityOffer{}}
+	metadata, err := queryPage(ctx, "capacityoffer", []string{intervalStart}, pageSize, bookmark, func(value []byte) error {
+		var offer CapacityOffer
+		if err := json.Unmarshal(value, &offer); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &offer)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// getCapacityOffers returns every capacity offer for a time slot
+func getCapacityOffers(ctx contractapi.TransactionContextInterface, intervalStart string) ([]*CapacityOffer, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("capacityoffer", []string{intervalStart})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	offers := []*CapacityOffer{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var offer CapacityOffer
+		if err := json.Unmarshal(queryResponse.Value, &offer); err != nil {
+			return nil, err
+		}
+		offers = append(offers, &offer)
+	}
+	return offers, nil
+}
+
+// ClearCapacityMarket accepts the cheapest open offers of a zone for a time
+// slot until the required capacity is covered, taking only part of the last
+// offer if needed, and reserves the accepted capacity at the uniform clearing
+// price. The remaining offers are rejected. A zone and slot clear only once.
+func (e *EnergyTradingContract) ClearCapacityMarket(ctx contractapi.TransactionContextInterface, zone, intervalStart string, required float64) (*CapacityClearing, error) {
+	if required <= 0 {
+		return nil, fmt.Errorf("required capacity must be positive")
+	}
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getCapacityClearing(ctx, zone, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("capacity market of zone %s for %s has already cleared", zone, intervalStart)
+	}
+	operator, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	offers, err := getCapacityOffers(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	open := []*CapacityOffer{}
+	for _, offer := range offers {
+		if offer.Zone == zone && offer.Status == OfferOpen {
+			open = append(open, offer)
+		}
+	}
+	sort.SliceStable(open, func(i, j int) bool {
+		return open[i].Price < open[j].Price
+	})
+
+	clearing := &CapacityClearing{
+		Zone:          zone,
+		IntervalStart: intervalStart,
+		Required:      required,
+		Reservations:  []string{},
+		Operator:      operator,
+		ClearedAt:     now,
+	}
+	accepted := []*CapacityReservation{}
+	for _, offer := range open {
+		if clearing.Cleared >= required {
+			offer.Status = OfferRejected
+		} else {
+			capacity := math.Min(offer.Capacity, required-clearing.Cleared)
+			clearing.Cleared += capacity
+			clearing.ClearingPrice = offer.Price
+			clearing.Reservations = append(clearing.Reservations, offer.OfferID)
+			accepted = append(accepted, &CapacityReservation{
+				ReservationID: offer.OfferID,
+				Provider:      offer.Provider,
+				Zone:          zone,
+				IntervalStart: intervalStart,
+				Capacity:      capacity,
+				Status:        ReservationReserved,
+			})
+			offer.Status = OfferAccepted
+		}
+		if err := putCapacityOffer(ctx, offer); err != nil {
+			return nil, err
+		}
+	}
+	for _, reservation := range accepted {
+		reservation.ClearingPrice = clearing.ClearingPrice
+		if err := putCapacityReservation(ctx, reservation); err != nil {
+			return nil, err
+		}
+	}
+
+	clearingJSON, err := json.Marshal(clearing)
+	if err != nil {
+		return nil, err
+	}
+	key, err := capacityClearingKey(ctx, zone, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, clearingJSON); err != nil {
+		return nil, err
+	}
+	return clearing, emitEvent(ctx, EventCapacityCleared, clearing)
+}
+
+func getCapacityClearing(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (*CapacityClearing, error) {
+	key, err := capacityClearingKey(ctx, zone, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	clearingJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capacity clearing: %v", err)
+	}
+	if clearingJSON == nil {
+		return nil, nil
+	}
+	var clearing CapacityClearing
+	if err := json.Unmarshal(clearingJSON, &clearing); err != nil {
+		return nil, err
+	}
+	return &clearing, nil
+}
+
+// GetCapacityClearing returns the clearing result of a zone for a time slot
+func (e *EnergyTradingContract) GetCapacityClearing(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (*CapacityClearing, error) {
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	clearing, err := getCapacityClearing(ctx, zone, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if clearing == nil {
+		return nil, fmt.Errorf("capacity market of zone %s for %s has not cleared", zone, intervalStart)
+	}
+	return clearing, nil
+}
+
+// getCapacityReservation returns a reservation, or nil if there is none
+func getCapacityReservation(ctx contractapi.TransactionContextInterface, reservationID string) (*CapacityReservation, error) {
+	key, err := capacityReservationKey(ctx, reservationID)
+	if err != nil {
+		return nil, err
+	}
+	reservationJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capacity reservation %s: %v", reservationID, err)
+	}
+	if reservationJSON == nil {
+		return nil, nil
+	}
+	var reservation CapacityReservation
+	if err := json.Unmarshal(reservationJSON, &reservation); err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// GetCapacityReservation returns a capacity reservation
+func (e *EnergyTradingContract) GetCapacityReservation(ctx contractapi.TransactionContextInterface, reservationID string) (*CapacityReservation, error) {
+	reservation, err := getCapacityReservation(ctx, reservationID)
+	if err != nil {
+		return nil, err
+	}
+	if reservation == nil {
+		return nil, fmt.Errorf("capacity reservation %s does not exist", reservationID)
+	}
+	return reservation, nil
+}
+
+// ActivateCapacityReservation calls for energy from a reservation before its
+// time slot ends. The energy may not exceed the reserved capacity over the slot.
+func (e *EnergyTradingContract) ActivateCapacityReservation(ctx contractapi.TransactionContextInterface, reservationID string, energy float64) (*CapacityReservation, error) {
+	reservation, err := e.GetCapacityReservation(ctx, reservationID)
+	if err != nil {
+		return nil, err
+	}
+	if reservation.Status != ReservationReserved {
+		return nil, fmt.Errorf("capacity reservation %s has already been settled", reservationID)
+	}
+	start, err := parseTimestamp(reservation.IntervalStart)
+	if err != nil {
+		return nil, err
+	}
+	length, err := slotLength(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(start.Add(length)) {
+		return nil, fmt.Errorf("interval %s has already ended", reservation.IntervalStart)
+	}
+	if energy <= 0 || energy > reservation.Capacity*length.Hours() {
+		return nil, fmt.Errorf("activated energy must be positive and within the reserved capacity")
+	}
+	reservation.ActivatedEnergy = energy
+	if err := putCapacityReservation(ctx, reservation); err != nil {
+		return nil, err
+	}
+	return reservation, emitEvent(ctx, EventCapacityActivated, reservation)
+}
+
+// SettleCapacityReservation verifies a reservation's availability against the
+// provider's meter readings once its time slot has ended and has the grid
+// operator pay for it. An activated reservation delivers the injection above
+// the provider's verified injection baseline for the slot, if one was
+// committed. The provider or an operator may settle.
+func (e *EnergyTradingContract) SettleCapacityReservation(ctx contractapi.TransactionContextInterface, reservationID string) (*CapacityReservation, error) {
+	reservation, err := e.GetCapacityReservation(ctx, reservationID)
+	if err != nil {
+		return nil, err
+	}
+	role, err := callerRole(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if role != RoleOperator {
+		if err := requireCaller(ctx, reservation.Provider); err != nil {
+			return nil, err
+		}
+	}
+	if reservation.Status != ReservationReserved {
+		return nil, fmt.Errorf("capacity reservation %s has already been settled", reservationID)
+	}
+	start, err := parseTimestamp(reservation.IntervalStart)
+	if err != nil {
+		return nil, err
+	}
+	length, err := slotLength(ctx)
+	if err != nil {
+		return nil, err
+	}
+	end := start.Add(length)
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(end) {
+		return nil, fmt.Errorf("interval %s has not ended", reservation.IntervalStart)
+	}
+
+	injected, _, found, err := meteredEnergy(ctx, reservation.Provider, reservation.IntervalStart, end.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !found:
+		reservation.Availability = 0
+	case reservation.ActivatedEnergy > 0:
+		baseline, _, err := committedBaseline(ctx, reservation.Provider, BaselineInjection, start, end)
+		if err != nil {
+			return nil, err
+		}
+		reservation.DeliveredEnergy = math.Min(math.Max(0, injected-baseline), reservation.ActivatedEnergy)
+		reservation.Availability = reservation.DeliveredEnergy / reservation.ActivatedEnergy
+	default:
+		reservation.Availability = 1
+	}
+	reservation.Payment = reservation.Capacity * reservation.ClearingPrice * reservation.Availability
+	reservation.Status = ReservationSettled
+	reservation.SettledAt = now.Format(time.RFC3339)
+	if err := settleWithGrid(ctx, reservation.Provider, reservation.Payment); err != nil {
+		return nil, fmt.Errorf("failed to settle capacity reservation %s: %v", reservationID, err)
+	}
+	if err := putCapacityReservation(ctx, reservation); err != nil {
+		return nil, err
+	}
+	return reservation, emitEvent(ctx, EventCapacitySettled, reservation)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCapacityMarket(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	for _, provider := range []string{"seller1", "seller2", "seller3"} {
+		registerTestParticipant(t, e, tc, provider, RoleProsumer)
+		registerTestMeter(t, e, tc, provider)
+		require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), provider, 10))
+	}
+
+	_, err := e.SubmitCapacityOffer(tc.as("seller1", ""), "cap1", "2025-05-03T10:05:00Z", 4, 0.1)
+	require.EqualError(t, err, "interval start 2025-05-03T10:05:00Z is not aligned to 15m0s")
+	_, err = e.SubmitCapacityOffer(tc, "cap1", "2025-05-01T07:45:00Z", 4, 0.1)
+	require.EqualError(t, err, "interval 2025-05-01T07:45:00Z has already started")
+	_, err = e.SubmitCapacityOffer(tc, "cap1", "2025-05-03T10:00:00Z", 4, 0.1)
+	require.NoError(t, err)
+	_, err = e.SubmitCapacityOffer(tc, "cap1", "2025-05-03T10:00:00Z", 4, 0.1)
+	require.EqualError(t, err, "capacity offer cap1 already exists")
+	_, err = e.SubmitCapacityOffer(tc.as("seller2", ""), "cap2", "2025-05-03T10:00:00Z", 5, 0.3)
+	require.NoError(t, err)
+	_, err = e.SubmitCapacityOffer(tc.as("seller3", ""), "cap3", "2025-05-03T10:00:00Z", 5, 0.5)
+	require.NoError(t, err)
+
+	// The cheapest offers cover the requirement and set a uniform price
+	tc.as("operator1", RoleOperator)
+	clearing, err := e.ClearCapacityMarket(tc, "zone1", "2025-05-03T10:00:00Z", 6)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cap1", "cap2"}, clearing.Reservations)
+	require.Equal(t, 6.0, clearing.Cleared)
+	require.Equal(t, 0.3, clearing.ClearingPrice)
+	_, err = e.ClearCapacityMarket(tc, "zone1", "2025-05-03T10:00:00Z", 6)
+	require.EqualError(t, err, "capacity market of zone zone1 for 2025-05-03T10:00:00Z has already cleared")
+	offers, err := e.GetCapacityOffers(tc, "2025-05-03T10:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, offers.Records, 3)
+	require.Equal(t, OfferRejected, offers.Records[2].Status)
+	reservation, err := e.GetCapacityReservation(tc, "cap2")
+	require.NoError(t, err)
+	require.Equal(t, 2.0, reservation.Capacity)
+	_, err = e.GetCapacityReservation(tc, "cap3")
+	require.EqualError(t, err, "capacity reservation cap3 does not exist")
+
+	_, err = e.ActivateCapacityReservation(tc, "cap1", 1.5)
+	require.EqualError(t, err, "activated energy must be positive and within the reserved capacity")
+	_, err = e.ActivateCapacityReservation(tc, "cap1", 1)
+	require.NoError(t, err)
+
+	_, err = e.SettleCapacityReservation(tc, "cap1")
+	require.EqualError(t, err, "interval 2025-05-03T10:00:00Z has not ended")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 10, 15, 0, 0, time.UTC)), nil)
+	signature := tc.signReading(t, "meter-seller1", "2025-05-03T10:00:00Z", 0.5, 0)
+	require.NoError(t, e.SubmitMeterReading(tc.as("seller1", ""), "meter-seller1", "2025-05-03T10:00:00Z", 0.5, 0, signature))
+
+	// Delivering half of the activated energy earns half the capacity payment
+	reservation, err = e.SettleCapacityReservation(tc, "cap1")
+	require.NoError(t, err)
+	require.Equal(t, ReservationSettled, reservation.Status)
+	require.InDelta(t, 0.5, reservation.Availability, 1e-9)
+	require.InDelta(t, 0.6, reservation.Payment, 1e-9)
+	_, err = e.SettleCapacityReservation(tc, "cap1")
+	require.EqualError(t, err, "capacity reservation cap1 has already been settled")
+
+	// Only the provider or an operator may settle, and no readings earn nothing
+	_, err = e.SettleCapacityReservation(tc.as("seller1", ""), "cap2")
+	require.Error(t, err)
+	reservation, err = e.SettleCapacityReservation(tc.as("operator1", RoleOperator), "cap2")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, reservation.Payment)
+	account, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 10.6, account.Balance, 1e-9)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// DefaultGridCarbonIntensity is the kg CO2 per kWh attributed to grid supply
+// in zones whose operator has not set an intensity
+const DefaultGridCarbonIntensity = 0.4
+
+// technologyCarbonIntensities are the life-cycle kg CO2 per kWh of the
+// renewable technologies generators may be registered with
+var technologyCarbonIntensities = map[string]float64{
+	"solar":      0.041,
+	"wind":       0.011,
+	"hydro":      0.024,
+	"biomass":    0.230,
+	"geothermal": 0.038,
+}
+
+// GridCarbonIntensity is the kg CO2 per kWh of grid supply in a zone
+type GridCarbonIntensity struct {
+	Zone      string  `json:"zone"`
+	Intensity float64 `json:"intensity"`
+	Operator  string  `json:"operator"`
+	UpdatedAt string  `json:"updatedAt"`
+}
+
+// CarbonRecord attributes the emissions of the energy a buyer received in a
+// settled trade to the source the seller supplied it from
+type CarbonRecord struct {
+	TokenID       string  `json:"tokenID"`
+	Buyer         string  `json:"buyer"`
+	Seller        string  `json:"seller"`
+	DeliveryStart string  `json:"deliveryStart"`
+	DeliveryEnd   string  `json:"deliveryEnd"`
+	Source        string  `json:"source"`
+	Energy        float64 `json:"energy"`
+	Intensity     float64 `json:"intensity"`
+	Emissions     float64 `json:"emissions"`
+}
+
+// CarbonReport is a participant's emissions statement for the half-open
+// window [From, To). Metered consumption is covered first by the energy it
+// received in settled trades, each listed with its provenance, and the rest
+// by the zone's grid mix. Hash is the SHA-256 of the report's canonical JSON
+// with Hash left empty, so that a copy held off-chain can be checked against
+// the ledger.
+type CarbonReport struct {
+	Address        string          `json:"address"`
+	From           string          `json:"from"`
+	To             string          `json:"to"`
+	ConsumedEnergy float64         `json:"consumedEnergy"`
+	TradedEnergy   float64         `json:"tradedEnergy"`
+	GridEnergy     float64         `json:"gridEnergy"`
+	GridIntensity  float64         `json:"gridIntensity"`
+	Emissions      float64         `json:"emissions"`
+	Intensity      float64         `json:"intensity"`
+	Trades         []*CarbonRecord `json:"trades"`
+	Hash           string          `json:"hash"`
+}
+
+func gridCarbonIntensityKey(ctx contractapi.TransactionContextInterface, zone string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("gridcarbon", []string{zone})
+}
+
+func carbonRecordKey(ctx contractapi.TransactionContextInterface, buyer, deliveryStart, tokenID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("carbonrecord", []string{buyer, deliveryStart, tokenID})
+}
+
+// SetGridCarbonIntensity sets the kg CO2 per kWh of grid supply in a zone
+func (e *EnergyTradingContract) SetGridCarbonIntensity(ctx contractapi.TransactionContextInterface, zone string, intensity float64) error {
+	if zone == "" {
+		return fmt.Errorf("zone must not be empty")
+	}
+	if intensity < 0 {
+		return fmt.Errorf("carbon intensity must not be negative")
+	}
+	operator, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	gridIntensity := GridCarbonIntensity{Zone: zone, Intensity: intensity, Operator: operator, UpdatedAt: now}
+	intensityJSON, err := json.Marshal(gridIntensity)
+	if err != nil {
+		return err
+	}
+	key, err := gridCarbonIntensityKey(ctx, zone)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, intensityJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventGridCarbonIntensitySet, gridIntensity)
+}
+
+// GetGridCarbonIntensity returns the carbon intensity of grid supply in a zone
+func (e *EnergyTradingContract) GetGridCarbonIntensity(ctx contractapi.TransactionContextInterface, zone string) (*GridCarbonIntensity, error) {
+	return getGridCarbonIntensity(ctx, zone)
+}
+
+func getGridCarbonIntensity(ctx contractapi.TransactionContextInterface, zone string) (*GridCarbonIntensity, error) {
+	key, err := gridCarbonIntensityKey(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	intensityJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read carbon intensity of zone %s: %v", zone, err)
+	}
+	if intensityJSON == nil {
+		return &GridCarbonIntensity{Zone: zone, Intensity: DefaultGridCarbonIntensity}, nil
+	}
+	var gridIntensity GridCarbonIntensity
+	if err := json.Unmarshal(intensityJSON, &gridIntensity); err != nil {
+		return nil, err
+	}
+	return &gridIntensity, nil
+}
+
+// putCarbonRecord attributes the energy that reached the buyer's meter in a
+// settled trade to the trade's guarantee-of-origin label. Battery and grid
+// energy carry the intensity of the seller zone's grid mix.
+func putCarbonRecord(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, settlement *Settlement) error {
+	seller, err := getParticipant(ctx, asset.SellerAddress)
+	if err != nil {
+		return err
+	}
+	if seller == nil {
+		return fmt.Errorf("participant %s is not registered", asset.SellerAddress)
+	}
+	source := asset.SourceType
+	if source == "" {
+		source = SourceGrid
+	}
+	intensity, ok := technologyCarbonIntensities[source]
+	if !ok {
+		gridIntensity, err := getGridCarbonIntensity(ctx, seller.Zone)
+		if err != nil {
+			return err
+		}
+		intensity = gridIntensity.Intensity
+	}
+
+	record := CarbonRecord{
+		TokenID:       asset.TokenID,
+		Buyer:         asset.BuyerAddress,
+		Seller:        asset.SellerAddress,
+		DeliveryStart: asset.DeliveryStart,
+		DeliveryEnd:   asset.DeliveryEnd,
+		Source:        source,
+		Energy:        settlement.DeliveredAtMeter,
+		Intensity:     intensity,
+		Emissions:     settlement.DeliveredAtMeter * intensity,
+	}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	key, err := carbonRecordKey(ctx, asset.BuyerAddress, asset.DeliveryStart, asset.TokenID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, recordJSON)
+}
+
+// GetCarbonReport returns a participant's emissions statement for the trades
+// delivering and the consumption metered in the half-open window [from, to)
+func (e *EnergyTradingContract) GetCarbonReport(ctx contractapi.TransactionContextInterface, address, from, to string) (*CarbonReport, error) {
+	from, err := normalizeTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	to, err = normalizeTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	participant, err := getParticipant(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if participant == nil {
+		return nil, fmt.Errorf("participant %s is not registered", address)
+	}
+	_, consumed, _, err := meteredEnergy(ctx, address, from, to)
+	if err != nil {
+		return nil, err
+	}
+	gridIntensity, err := getGridCarbonIntensity(ctx, participant.Zone)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CarbonReport{
+		Address:        address,
+		From:           from,
+		To:             to,
+		ConsumedEnergy: consumed,
+		GridIntensity:  gridIntensity.Intensity,
+		Trades:         []*CarbonRecord{},
+	}
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("carbonrecord", []string{address})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var record CarbonRecord
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			return nil, err
+		}
+		if record.DeliveryStart < from || record.DeliveryStart >= to {
+			continue
+		}
+		report.Trades = append(report.Trades, &record)
+		report.TradedEnergy += record.Energy
+		report.Emissions += record.Emissions
+	}
+	report.GridEnergy = math.Max(0, consumed-report.TradedEnergy)
+	report.Emissions += report.GridEnergy * gridIntensity.Intensity
+	if total := report.TradedEnergy + report.GridEnergy; total > 0 {
+		report.Intensity = report.Emissions / total
+	}
+
+	reportJSON, err := canonicalJSON(report)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(reportJSON)
+	report.Hash = hex.EncodeToString(digest[:])
+	return report, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCarbonReport(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	_, err := e.RegisterGenerator(tc.as("seller1", ""), meterID, "solar", 10)
+	require.NoError(t, err)
+	_, err = e.VerifyGenerator(tc.as("operator1", RoleOperator), meterID)
+	require.NoError(t, err)
+	require.NoError(t, e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceSolar))
+	require.NoError(t, e.SignEnergyAsset(tc, "energy1", tc.sign(t, e, "buyer1", "energy1"), 0))
+	require.NoError(t, e.SignEnergyAsset(tc.as("seller1", ""), "energy1", tc.sign(t, e, "seller1", "energy1"), 0))
+	require.EqualError(t, e.SetGridCarbonIntensity(tc, "zone1", -1), "carbon intensity must not be negative")
+	require.NoError(t, e.SetGridCarbonIntensity(tc, "zone1", 0.5))
+
+	// Before settlement all consumption is attributed to the grid mix
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	report, err := e.GetCarbonReport(tc, "buyer1", "2025-05-03T00:00:00Z", "2025-05-04T00:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 12.0, report.GridEnergy)
+	require.InDelta(t, 6, report.Emissions, 1e-9)
+
+	_, err = e.ReconcileDelivery(tc.as("buyer1", ""), "energy1")
+	require.NoError(t, err)
+	report, err = e.GetCarbonReport(tc, "buyer1", "2025-05-03T00:00:00Z", "2025-05-04T00:00:00Z")
+	require.NoError(t, err)
+	require.Len(t, report.Trades, 1)
+	require.Equal(t, "solar", report.Trades[0].Source)
+	require.Equal(t, "seller1", report.Trades[0].Seller)
+	require.Equal(t, 8.0, report.TradedEnergy)
+	require.Equal(t, 4.0, report.GridEnergy)
+	require.InDelta(t, 8*0.041+4*0.5, report.Emissions, 1e-9)
+	require.InDelta(t, (8*0.041+4*0.5)/12, report.Intensity, 1e-9)
+	require.Len(t, report.Hash, 64)
+
+	// The statement is reproducible
+	again, err := e.GetCarbonReport(tc, "buyer1", "2025-05-03T00:00:00Z", "2025-05-04T00:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, report.Hash, again.Hash)
+	report, err = e.GetCarbonReport(tc, "buyer1", "2025-05-04T00:00:00Z", "2025-05-05T00:00:00Z")
+	require.NoError(t, err)
+	require.Empty(t, report.Trades)
+	require.Equal(t, 0.0, report.Emissions)
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// CertificateEscrowAccount holds the tokens of open certificate bids
+const CertificateEscrowAccount = "certificate-escrow"
+
+// Certificate order sides
+const (
+	OrderBid   = "BID"
+	OrderOffer = "OFFER"
+)
+
+// Certificate order statuses
+const (
+	OrderOpen      = "OPEN"
+	OrderFilled    = "FILLED"
+	OrderCancelled = "CANCELLED"
+)
+
+// CertificateOrder is an order in the certificate market. An offer lists one
+// certificate at Price tokens. A bid asks for Quantity certificates, of the
+// given technology if one is set, at up to Price tokens each and escrows the
+// tokens for them. Orders match as soon as they cross, at the price of the
+// order that was resting in the book.
+type CertificateOrder struct {
+	OrderID       string  `json:"orderID"`
+	Side          string  `json:"side"`
+	Trader        string  `json:"trader"`
+	CertificateID string  `json:"certificateID,omitempty"`
+	Technology    string  `json:"technology,omitempty"`
+	Quantity      int     `json:"quantity"`
+	Filled        int     `json:"filled"`
+	Price         float64 `json:"price"`
+	Status        string  `json:"status"`
+	CreatedAt     string  `json:"createdAt"`
+	// StopReason says why the last matching pass left a crossing bid open
+	StopReason string `json:"stopReason,omitempty"`
+	Version    int64  `json:"version"`
+}
+
+// CertificateFill records the sale of a certificate in the market
+type CertificateFill struct {
+	CertificateID string  `json:"certificateID"`
+	BidID         string  `json:"bidID"`
+	OfferID       string  `json:"offerID"`
+	Buyer         string  `json:"buyer"`
+	Seller        string  `json:"seller"`
+	Price         float64 `json:"price"`
+	FilledAt      string  `json:"filledAt"`
+}
+
+func certificateOrderKey(ctx contractapi.TransactionContextInterface, orderID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("certificateorder", []string{orderID})
+}
+
+func certificateFillKey(ctx contractapi.TransactionContextInterface, certificateID, filledAt string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("certificatefill", []string{certificateID, filledAt})
+}
+
+func putCertificateOrder(ctx contractapi.TransactionContextInterface, order *CertificateOrder) error {
+	order.Version++
+	orderJSON, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	key, err := certificateOrderKey(ctx, order.OrderID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, orderJSON)
+}
+
+// getCertificateOrder returns an order, or nil if there is none
+func getCertificateOrder(ctx contractapi.TransactionContextInterface, orderID string) (*CertificateOrder, error) {
+	key, err := certificateOrderKey(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	orderJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate order %s: %v", orderID, err)
+	}
+	if orderJSON == nil {
+		return nil, nil
+	}
+	var order CertificateOrder
+	if err := json.Unmarshal(orderJSON, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// GetCertificateOrder returns an order of the certificate market
+func (e *EnergyTradingContract) GetCertificateOrder(ctx contractapi.TransactionContextInterface, orderID string) (*CertificateOrder, error) {
+	order, err := getCertificateOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, fmt.Errorf("certificate order %s does not exist", orderID)
+	}
+	return order, nil
+}
+
+// PaginatedCertificateOrderResult is a page of certificate orders
+type PaginatedCertificateOrderResult struct {
+	Records             []*CertificateOrder `json:"records"`
+	FetchedRecordsCount int32               `json:"fetchedRecordsCount"`
+	Bookmark            string              `json:"bookmark"`
+}
+
+// GetOpenCertificateOrders returns a page of the open orders of one side of
+// the book, in order ID order. Orders of the other side and closed orders are
+// skipped, so a page may hold fewer than pageSize orders.
+func (e *EnergyTradingContract) GetOpenCertificateOrders(ctx contractapi.TransactionContextInterface, side string, pageSize int32, bookmark string) (*PaginatedCertificateOrderResult, error) {
+	if side != OrderBid && side != OrderOffer {
+		return nil, fmt.Errorf("order side must be %s or %s", OrderBid, OrderOffer)
+	}
+	result := &PaginatedCertificateOrderResult{Records: []*CertificateOrder{}}
+	metadata, err := queryPage(ctx, "certificateorder", []string{}, pageSize, bookmark, func(value []byte) error {
+		var order CertificateOrder
+		if err := json.Unmarshal(value, &order); err != nil {
+			return err
+		}
+		if order.Side == side && order.Status == OrderOpen {
+			result.Records = append(result.Records, &order)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// openCertificateOrders returns the open orders of one side of the book in
+// matching order: offers cheapest first, bids highest first, then oldest
+func openCertificateOrders(ctx contractapi.TransactionContextInterface, side string) ([]*CertificateOrder, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("certificateorder", []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	orders := []*CertificateOrder{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var order CertificateOrder
+		if err := json.Unmarshal(queryResponse.Value, &order); err != nil {
+			return nil, err
+		}
+		if order.Side == side && order.Status == OrderOpen {
+			orders = append(orders, &order)
+		}
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		if orders[i].Price != orders[j].Price {
+			return (orders[i].Price < orders[j].Price) == (side == OrderOffer)
+		}
+		return orders[i].CreatedAt < orders[j].CreatedAt
+	})
+	return orders, nil
+}
+
+// newCertificateOrder checks the order ID is free and returns an open order
+// of the caller
+func newCertificateOrder(ctx contractapi.TransactionContextInterface, orderID, side string, price float64) (*CertificateOrder, error) {
+	if price < 0 {
+		return nil, fmt.Errorf("price must not be negative")
+	}
+	existing, err := getCertificateOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("certificate order %s already exists", orderID)
+	}
+	trader, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := requireApprovedParticipant(ctx, trader); err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &CertificateOrder{
+		OrderID:   orderID,
+		Side:      side,
+		Trader:    trader,
+		Price:     price,
+		Status:    OrderOpen,
+		CreatedAt: now,
+	}, nil
+}
+
+// PlaceCertificateOffer lists one of the caller's active certificates for
+// sale and sells it to the best crossing bid, if there is one. A listed
+// certificate cannot be transferred or retired until it sells or the offer is
+// cancelled.
+func (e *EnergyTradingContract) PlaceCertificateOffer(ctx contractapi.TransactionContextInterface, orderID, certificateID string, price float64) (*CertificateOrder, error) {
+	offer, err := newCertificateOrder(ctx, orderID, OrderOffer, price)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := e.GetCertificate(ctx, certificateID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireActiveCertificate(ctx, certificate); err != nil {
+		return nil, err
+	}
+	offer.CertificateID = certificateID
+	offer.Technology = certificate.Technology
+	offer.Quantity = 1
+	certificate.ListedIn = orderID
+	if err := putCertificate(ctx, certificate, ""); err != nil {
+		return nil, err
+	}
+
+	bids, err := openCertificateOrders(ctx, OrderBid)
+	if err != nil {
+		return nil, err
+	}
+	for _, bid := range bids {
+		if bid.Price < offer.Price || bid.Trader == offer.Trader || (bid.Technology != "" && bid.Technology != offer.Technology) {
+			continue
+		}
+		if err := fillCertificateOrders(ctx, bid, offer, certificate, bid.Price); err != nil {
+			return nil, err
+		}
+		break
+	}
+	if err := putCertificateOrder(ctx, offer); err != nil {
+		return nil, err
+	}
+	return offer, emitEvent(ctx, EventCertificateOrderChanged, offer)
+}
+
+// PlaceCertificateBid bids for certificates, escrowing quantity times price
+// tokens, and buys from the cheapest crossing offers until it is filled, none
+// are left or it has taken the fill limit of offers
+func (e *EnergyTradingContract) PlaceCertificateBid(ctx contractapi.TransactionContextInterface, orderID, technology string, quantity int, price float64) (*CertificateOrder, error) {
+	if quantity <= 0 {
+		return nil, fmt.Errorf("quantity must be positive")
+	}
+	if technology != "" {
+		renewable := false
+		for _, t := range renewableTechnologies {
+			renewable = renewable || t == technology
+		}
+		if !renewable {
+			return nil, fmt.Errorf("technology must be empty or one of %v", renewableTechnologies)
+		}
+	}
+	bid, err := newCertificateOrder(ctx, orderID, OrderBid, price)
+	if err != nil {
+		return nil, err
+	}
+	bid.Technology = technology
+	bid.Quantity = quantity
+	escrow, err := getTokenAccount(ctx, CertificateEscrowAccount)
+	if err != nil {
+		return nil, err
+	}
+	if escrow == nil {
+		if err := putTokenAccount(ctx, &TokenAccount{AccountID: CertificateEscrowAccount}); err != nil {
+			return nil, err
+		}
+	}
+	if amount := float64(quantity) * price; amount > 0 {
+		if err := transferTokens(ctx, bid.Trader, CertificateEscrowAccount, amount); err != nil {
+			return nil, fmt.Errorf("failed to escrow bid %s: %v", orderID, err)
+		}
+	}
+
+	if err := e.matchCertificateBid(ctx, bid); err != nil {
+		return nil, err
+	}
+	if err := putCertificateOrder(ctx, bid); err != nil {
+		return nil, err
+	}
+	return bid, emitEvent(ctx, EventCertificateOrderChanged, bid)
+}
+
+// MatchCertificateBid runs another matching pass for one of the caller's open
+// bids, after a pass stopped at the fill limit
+func (e *EnergyTradingContract) MatchCertificateBid(ctx contractapi.TransactionContextInterface, orderID string) (*CertificateOrder, error) {
+	bid, err := e.GetCertificateOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, bid.Trader); err != nil {
+		return nil, err
+	}
+	if bid.Side != OrderBid || bid.Status != OrderOpen {
+		return nil, fmt.Errorf("certificate order %s is not an open bid", orderID)
+	}
+	if err := e.matchCertificateBid(ctx, bid); err != nil {
+		return nil, err
+	}
+	if err := putCertificateOrder(ctx, bid); err != nil {
+		return nil, err
+	}
+	return bid, emitEvent(ctx, EventCertificateOrderChanged, bid)
+}
+
+// matchCertificateBid buys from the cheapest crossing offers until the bid is
+// filled, none are left or the pass has taken the fill limit of offers. In
+// the last case StopReason says so and the rest of the bid stays open. The
+// caller stores the bid.
+func (e *EnergyTradingContract) matchCertificateBid(ctx contractapi.TransactionContextInterface, bid *CertificateOrder) error {
+	limits, err := e.GetBatchLimits(ctx)
+	if err != nil {
+		return err
+	}
+	offers, err := openCertificateOrders(ctx, OrderOffer)
+	if err != nil {
+		return err
+	}
+	bid.StopReason = ""
+	fills := int32(0)
+	for _, offer := range offers {
+		if bid.Status != OrderOpen {
+			break
+		}
+		if offer.Price > bid.Price || offer.Trader == bid.Trader || (bid.Technology != "" && bid.Technology != offer.Technology) {
+			continue
+		}
+		if fills == limits.MaxFillsPerOrder {
+			bid.StopReason = fmt.Sprintf("fill limit of %d reached; call MatchCertificateBid to continue", limits.MaxFillsPerOrder)
+			break
+		}
+		certificate, err := e.GetCertificate(ctx, offer.CertificateID)
+		if err != nil {
+			return err
+		}
+		if err := fillCertificateOrders(ctx, bid, offer, certificate, offer.Price); err != nil {
+			return err
+		}
+		if err := putCertificateOrder(ctx, offer); err != nil {
+			return err
+		}
+		fills++
+	}
+	return nil
+}
+
+// fillCertificateOrders sells an offer's certificate to a bid at the given
+// price. The seller is paid from the bid's escrow and any difference to the
+// bid price is refunded to the buyer. The caller stores the orders.
+func fillCertificateOrders(ctx contractapi.TransactionContextInterface, bid, offer *CertificateOrder, certificate *Certificate, price float64) error {
+	if price > 0 {
+		if err := transferTokens(ctx, CertificateEscrowAccount, offer.Trader, price); err != nil {
+			return fmt.Errorf("failed to pay for certificate %s: %v", certificate.CertificateID, err)
+		}
+	}
+	if refund := bid.Price - price; refund > 0 {
+		if err := transferTokens(ctx, CertificateEscrowAccount, bid.Trader, refund); err != nil {
+			return fmt.Errorf("failed to refund bid %s: %v", bid.OrderID, err)
+		}
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	certificate.Owner = bid.Trader
+	certificate.ListedIn = ""
+	if err := putCertificate(ctx, certificate, offer.Trader); err != nil {
+		return err
+	}
+	offer.Filled = 1
+	offer.Status = OrderFilled
+	bid.Filled++
+	if bid.Filled == bid.Quantity {
+		bid.Status = OrderFilled
+	}
+
+	fill := CertificateFill{
+		CertificateID: certificate.CertificateID,
+		BidID:         bid.OrderID,
+		OfferID:       offer.OrderID,
+		Buyer:         bid.Trader,
+		Seller:        offer.Trader,
+		Price:         price,
+		FilledAt:      now,
+	}
+	fillJSON, err := json.Marshal(fill)
+	if err != nil {
+		return err
+	}
+	key, err := certificateFillKey(ctx, certificate.CertificateID, now)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, fillJSON)
+}
+
+// CancelCertificateOrder cancels one of the caller's open orders. A cancelled
+// offer unlists its certificate; a cancelled bid has the escrow for its
+// unfilled quantity refunded.
+func (e *EnergyTradingContract) CancelCertificateOrder(ctx contractapi.TransactionContextInterface, orderID string, expectedVersion int64) (*CertificateOrder, error) {
+	order, err := e.GetCertificateOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion("certificate order", orderID, order.Version, expectedVersion); err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, order.Trader); err != nil {
+		return nil, err
+	}
+	if order.Status != OrderOpen {
+		return nil, fmt.Errorf("certificate order %s is not open", orderID)
+	}
+	if order.Side == OrderOffer {
+		certificate, err := e.GetCertificate(ctx, order.CertificateID)
+		if err != nil {
+			return nil, err
+		}
+		certificate.ListedIn = ""
+		if err := putCertificate(ctx, certificate, ""); err != nil {
+			return nil, err
+		}
+	} else if refund := float64(order.Quantity-order.Filled) * order.Price; refund > 0 {
+		if err := transferTokens(ctx, CertificateEscrowAccount, order.Trader, refund); err != nil {
+			return nil, fmt.Errorf("failed to refund bid %s: %v", orderID, err)
+		}
+	}
+	order.Status = OrderCancelled
+	if err := putCertificateOrder(ctx, order); err != nil {
+		return nil, err
+	}
+	return order, emitEvent(ctx, EventCertificateOrderChanged, order)
+}
+
+// PaginatedCertificateFillResult is a page of certificate fills
+type PaginatedCertificateFillResult struct {
+	Records             []*CertificateFill `json:"records"`
+	FetchedRecordsCount int32              `json:"fetchedRecordsCount"`
+	Bookmark            string             `json:"bookmark"`
+}
+
+// GetCertificateFills returns a page of the market sales of a certificate,
+// oldest first
+func (e *EnergyTradingContract) GetCertificateFills(ctx contractapi.TransactionContextInterface, certificateID string, pageSize int32, bookmark string) (*PaginatedCertificateFillResult, error) {
+	result := &PaginatedCertificateFillResult{Records: []*CertificateFill{}}
+	metadata, err := queryPage(ctx, "certificatefill", []string{certificateID}, pageSize, bookmark, func(value []byte) error {
+		var fill CertificateFill
+		if err := json.Unmarshal(value, &fill); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &fill)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCertificateMarket(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	require.NoError(t, e.SetCertificateEnergy(tc.as("admin1", RoleAdmin), 1))
+	require.NoError(t, e.MintTokens(tc, "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	_, err := e.RegisterGenerator(tc.as("seller1", ""), meterID, "solar", 5)
+	require.NoError(t, err)
+	_, err = e.VerifyGenerator(tc.as("operator1", RoleOperator), meterID)
+	require.NoError(t, err)
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 0, 0, 0, time.UTC)), nil)
+	signature := tc.signReading(t, meterID, "2025-05-03T10:00:00Z", 3, 0)
+	require.NoError(t, e.SubmitMeterReading(tc.as("seller1", ""), meterID, "2025-05-03T10:00:00Z", 3, 0, signature))
+
+	// A listed certificate cannot be transferred
+	offer, err := e.PlaceCertificateOffer(tc.as("seller1", ""), "offer1", meterID+"-1", 2)
+	require.NoError(t, err)
+	require.Equal(t, OrderOpen, offer.Status)
+	require.Equal(t, "solar", offer.Technology)
+	_, err = e.TransferCertificate(tc, meterID+"-1", "buyer1")
+	require.EqualError(t, err, "certificate "+meterID+"-1 is listed in offer offer1")
+	_, err = e.PlaceCertificateOffer(tc, "offer1", meterID+"-2", 2)
+	require.EqualError(t, err, "certificate order offer1 already exists")
+	_, err = e.PlaceCertificateOffer(tc, "offer2", meterID+"-2", 1.5)
+	require.NoError(t, err)
+	_, err = e.PlaceCertificateOffer(tc, "offer3", meterID+"-3", 3)
+	require.NoError(t, err)
+
+	// A bid buys the cheapest crossing offers at their price
+	_, err = e.PlaceCertificateBid(tc.as("buyer1", ""), "bid1", "diesel", 1, 2)
+	require.EqualError(t, err, "technology must be empty or one of [solar wind hydro biomass geothermal]")
+	bid, err := e.PlaceCertificateBid(tc, "bid1", "solar", 3, 2.5)
+	require.NoError(t, err)
+	require.Equal(t, 2, bid.Filled)
+	require.Equal(t, OrderOpen, bid.Status)
+	fills, err := e.GetCertificateFills(tc, meterID+"-2", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, fills.Records, 1)
+	require.Equal(t, 1.5, fills.Records[0].Price)
+	certificate, err := e.GetCertificate(tc, meterID+"-1")
+	require.NoError(t, err)
+	require.Equal(t, "buyer1", certificate.Owner)
+	require.Empty(t, certificate.ListedIn)
+
+	// The rest of the bid stays escrowed until an offer crosses it
+	buyer, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 10-2-1.5-2.5, buyer.Balance, 1e-9)
+	seller, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 1+2+1.5, seller.Balance, 1e-9)
+	bids, err := e.GetOpenCertificateOrders(tc, OrderBid, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, bids.Records, 1)
+
+	// Cancelling unlists the offer and refunds the unfilled bid
+	_, err = e.CancelCertificateOrder(tc, "offer3", 0)
+	require.EqualError(t, err, "caller buyer1 is not authorized to act for seller1")
+	_, err = e.CancelCertificateOrder(tc.as("seller1", ""), "offer3", 2)
+	require.EqualError(t, err, "certificate order offer3 is at version 1, not 2")
+	_, err = e.CancelCertificateOrder(tc, "offer3", 1)
+	require.NoError(t, err)
+	_, err = e.TransferCertificate(tc, meterID+"-3", "buyer1")
+	require.NoError(t, err)
+	bid, err = e.CancelCertificateOrder(tc.as("buyer1", ""), "bid1", 0)
+	require.NoError(t, err)
+	require.Equal(t, OrderCancelled, bid.Status)
+	buyer, err = e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 10-2-1.5, buyer.Balance, 1e-9)
+	escrow, err := e.ReadTokenAccount(tc, CertificateEscrowAccount)
+	require.NoError(t, err)
+	require.InDelta(t, 0, escrow.Balance, 1e-9)
+}
+
+// BenchmarkCertificateBidMatching matches one bid against a book of n offers,
+// with the fill limit raised so that the whole book is taken in one pass
+func BenchmarkCertificateBidMatching(b *testing.B) {
+	for _, n := range []int{10, 100} {
+		b.Run(fmt.Sprintf("offers=%d", n), func(b *testing.B) {
+			e := &EnergyTradingContract{}
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tc := newTestContext()
+				registerTestParticipant(b, e, tc, "seller1", RoleProsumer)
+				registerTestParticipant(b, e, tc, "buyer1", RoleConsumer)
+				require.NoError(b, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", float64(n)))
+				require.NoError(b, e.MintTokens(tc, "seller1", 1))
+				_, err := e.SetBatchLimits(tc, DefaultMaxBatchSize, int32(n))
+				require.NoError(b, err)
+				tc.as("seller1", "")
+				for j := 0; j < n; j++ {
+					certificateID := fmt.Sprintf("cert%d", j)
+					require.NoError(b, putCertificate(tc, &Certificate{CertificateID: certificateID, Technology: "solar", Energy: 1, Owner: "seller1", Status: CertificateActive}, ""))
+					_, err := e.PlaceCertificateOffer(tc, fmt.Sprintf("offer%d", j), certificateID, 1)
+					require.NoError(b, err)
+				}
+				tc.as("buyer1", "")
+				b.StartTimer()
+				bid, err := e.PlaceCertificateBid(tc, "bid1", "", n, 1)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if bid.Filled != n {
+					b.Fatalf("bid filled %d of %d offers", bid.Filled, n)
+				}
+			}
+		})
+	}
+}
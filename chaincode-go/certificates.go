@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// DefaultCertificateEnergy is the kWh of verified renewable generation one
+// certificate stands for until an admin configures another granularity
+const DefaultCertificateEnergy = 1000.0
+
+// Renewable technologies a generator may be registered with
+var renewableTechnologies = []string{"solar", "wind", "hydro", "biomass", "geothermal"}
+
+// Generator statuses
+const (
+	GeneratorPending  = "PENDING"
+	GeneratorVerified = "VERIFIED"
+)
+
+// Certificate statuses
+const (
+	CertificateActive  = "ACTIVE"
+	CertificateRetired = "RETIRED"
+)
+
+const certificateConfigKey = "certificateconfig"
+
+// CertificateConfig holds the energy each certificate stands for
+type CertificateConfig struct {
+	CertificateEnergy float64 `json:"certificateEnergy"`
+	UpdatedBy         string  `json:"updatedBy,omitempty"`
+	UpdatedAt         string  `json:"updatedAt,omitempty"`
+}
+
+// Generator is a renewable generation device behind a registered meter. Once
+// an operator has verified it, the energy its meter injects accrues in
+// PendingEnergy until it adds up to a certificate. PendingSources holds the
+// readings that energy came from.
+type Generator struct {
+	MeterID        string               `json:"meterID"`
+	Owner          string               `json:"owner"`
+	Zone           string               `json:"zone"`
+	Technology     string               `json:"technology"`
+	Capacity       float64              `json:"capacity"`
+	Status         string               `json:"status"`
+	PendingEnergy  float64              `json:"pendingEnergy"`
+	PendingSources []*CertificateSource `json:"pendingSources"`
+	Issued         int                  `json:"issued"`
+	RegisteredAt   string               `json:"registeredAt"`
+	VerifiedBy     string               `json:"verifiedBy,omitempty"`
+	VerifiedAt     string               `json:"verifiedAt,omitempty"`
+}
+
+// CertificateSource links a certificate to the meter reading part of its
+// energy was generated in
+type CertificateSource struct {
+	MeterID       string  `json:"meterID"`
+	IntervalStart string  `json:"intervalStart"`
+	Energy        float64 `json:"energy"`
+}
+
+// Certificate is a non-fungible renewable energy certificate for Energy kWh
+// of verified generation. Retiring it claims the energy for Beneficiary and
+// takes it out of circulation for good.
+type Certificate struct {
+	CertificateID string               `json:"certificateID"`
+	MeterID       string               `json:"meterID"`
+	Technology    string               `json:"technology"`
+	Zone          string               `json:"zone"`
+	Energy        float64              `json:"energy"`
+	Owner         string               `json:"owner"`
+	Status        string               `json:"status"`
+	Sources       []*CertificateSource `json:"sources"`
+	IssuedAt      string               `json:"issuedAt"`
+	ListedIn      string               `json:"listedIn,omitempty"`
+	PledgedFor    string               `json:"pledgedFor,omitempty"`
+	Beneficiary   string               `json:"beneficiary,omitempty"`
+	RetiredAt     string               `json:"retiredAt,omitempty"`
+}
+
+func generatorKey(ctx contractapi.TransactionContextInterface, meterID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("generator", []string{meterID})
+}
+
+func certificateKey(ctx contractapi.TransactionContextInterface, certificateID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("certificate", []string{certificateID})
+}
+
+func certificateOwnerKey(ctx contractapi.TransactionContextInterface, owner, certificateID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("certificateowner", []string{owner, certificateID})
+}
+
+func getCertificateConfig(ctx contractapi.TransactionContextInterface) (*CertificateConfig, error) {
+	configJSON, err := ctx.GetStub().GetState(certificateConfigKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate config: %v", err)
+	}
+	if configJSON == nil {
+		return &CertificateConfig{CertificateEnergy: DefaultCertificateEnergy}, nil
+	}
+	var config CertificateConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// SetCertificateEnergy sets the kWh each certificate stands for. Energy that
+// has already accrued is issued at the new granularity.
+func (e *EnergyTradingContract) SetCertificateEnergy(ctx contractapi.TransactionContextInterface, energy float64) error {
+	if energy <= 0 {
+		return fmt.Errorf("certificate energy must be positive")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	config := CertificateConfig{CertificateEnergy: energy, UpdatedBy: caller, UpdatedAt: now}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(certificateConfigKey, configJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventCertificateConfigSet, config)
+}
+
+// GetCertificateConfig returns the certificate granularity in force
+func (e *EnergyTradingContract) GetCertificateConfig(ctx contractapi.TransactionContextInterface) (*CertificateConfig, error) {
+	return getCertificateConfig(ctx)
+}
+
+func putGenerator(ctx contractapi.TransactionContextInterface, generator *Generator) error {
+	generatorJSON, err := json.Marshal(generator)
+	if err != nil {
+		return err
+	}
+	key, err := generatorKey(ctx, generator.MeterID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, generatorJSON)
+}
+
+// getGenerator returns the generator behind a meter, or nil if there is none
+func getGenerator(ctx contractapi.TransactionContextInterface, meterID string) (*Generator, error) {
+	key, err := generatorKey(ctx, meterID)
+	if err != nil {
+		return nil, err
+	}
+	generatorJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read generator %s: %v", meterID, err)
+	}
+	if generatorJSON == nil {
+		return nil, nil
+	}
+	var generator Generator
+	if err := json.Unmarshal(generatorJSON, &generator); err != nil {
+		return nil, err
+	}
+	return &generator, nil
+}
+
+// RegisterGenerator registers the renewable generator behind one of the
+// caller's enrolled meters. It earns certificates once an operator verifies it.
+func (e *EnergyTradingContract) RegisterGenerator(ctx contractapi.TransactionContextInterface, meterID, technology string, capacity float64) (*Generator, error) {
+	renewable := false
+	for _, t := range renewableTechnologies {
+		renewable = renewable || t == technology
+	}
+	if !renewable {
+		return nil, fmt.Errorf("technology must be one of %v", renewableTechnologies)
+	}
+	if capacity <= 0 {
+		return nil, fmt.Errorf("capacity must be positive")
+	}
+	meter, err := requireActiveDevice(ctx, meterID, DeviceMeter)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, meter.Owner); err != nil {
+		return nil, err
+	}
+	existing, err := getGenerator(ctx, meterID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("generator %s is already registered", meterID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	generator := &Generator{
+		MeterID:        meterID,
+		Owner:          meter.Owner,
+		Zone:           meter.Zone,
+		Technology:     technology,
+		Capacity:       capacity,
+		Status:         GeneratorPending,
+		PendingSources: []*CertificateSource{},
+		RegisteredAt:   now,
+	}
+	if err := putGenerator(ctx, generator); err != nil {
+		return nil, err
+	}
+	return generator, emitEvent(ctx, EventGeneratorChanged, generator)
+}
+
+// VerifyGenerator confirms a registered generator is renewable. Only readings
+// accepted after verification earn certificates.
+func (e *EnergyTradingContract) VerifyGenerator(ctx contractapi.TransactionContextInterface, meterID string) (*Generator, error) {
+	generator, err := e.GetGenerator(ctx, meterID)
+	if err != nil {
+		return nil, err
+	}
+	if generator.Status == GeneratorVerified {
+		return nil, fmt.Errorf("generator %s is already verified", meterID)
+	}
+	operator, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	generator.Status = GeneratorVerified
+	generator.VerifiedBy = operator
+	generator.VerifiedAt = now
+	if err := putGenerator(ctx, generator); err != nil {
+		return nil, err
+	}
+	return generator, emitEvent(ctx, EventGeneratorChanged, generator)
+}
+
+// GetGenerator returns the generator behind a meter
+func (e *EnergyTradingContract) GetGenerator(ctx contractapi.TransactionContextInterface, meterID string) (*Generator, error) {
+	generator, err := getGenerator(ctx, meterID)
+	if err != nil {
+		return nil, err
+	}
+	if generator == nil {
+		return nil, fmt.Errorf("generator %s is not registered", meterID)
+	}
+	return generator, nil
+}
+
+// accrueCertificates credits the energy injected in an accepted reading to
+// the verified generator behind its meter and issues a certificate for every
+// full granularity of energy accrued. A reading whose energy straddles two
+// certificates is a source of both.
+func accrueCertificates(ctx contractapi.TransactionContextInterface, reading *MeterReading) error {
+	if reading.KWhInjected <= 0 {
+		return nil
+	}
+	generator, err := getGenerator(ctx, reading.MeterID)
+	if err != nil {
+		return err
+	}
+	if generator == nil || generator.Status != GeneratorVerified {
+		return nil
+	}
+	config, err := getCertificateConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	remaining := reading.KWhInjected
+	for {
+		if generator.PendingEnergy >= config.CertificateEnergy {
+			if err := issueCertificate(ctx, generator, config.CertificateEnergy, reading.SubmittedAt); err != nil {
+				return err
+			}
+			continue
+		}
+		if remaining <= 0 {
+			break
+		}
+		energy := math.Min(remaining, config.CertificateEnergy-generator.PendingEnergy)
+		generator.PendingEnergy += energy
+		generator.PendingSources = append(generator.PendingSources, &CertificateSource{
+			MeterID:       reading.MeterID,
+			IntervalStart: reading.IntervalStart,
+			Energy:        energy,
+		})
+		remaining -= energy
+	}
+	return putGenerator(ctx, generator)
+}
+
+// issueCertificate mints a certificate to the generator's owner from the
+// generator's pending energy and sources
+func issueCertificate(ctx contractapi.TransactionContextInterface, generator *Generator, energy float64, issuedAt string) error {
+	generator.Issued++
+	certificate := &Certificate{
+		CertificateID: fmt.Sprintf("%s-%d", generator.MeterID, generator.Issued),
+		MeterID:       generator.MeterID,
+		Technology:    generator.Technology,
+		Zone:          generator.Zone,
+		Energy:        energy,
+		Owner:         generator.Owner,
+		Status:        CertificateActive,
+		Sources:       generator.PendingSources,
+		IssuedAt:      issuedAt,
+	}
+	generator.PendingEnergy -= energy
+	generator.PendingSources = []*CertificateSource{}
+	return putCertificate(ctx, certificate, "")
+}
+
+// putCertificate stores a certificate and moves it in the owner index from
+// its previous owner, if any, to its current one
+func putCertificate(ctx contractapi.TransactionContextInterface, certificate *Certificate, previousOwner string) error {
+	certificateJSON, err := json.Marshal(certificate)
+	if err != nil {
+		return err
+	}
+	key, err := certificateKey(ctx, certificate.CertificateID)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, certificateJSON); err != nil {
+		return err
+	}
+	if previousOwner != "" {
+		ownerKey, err := certificateOwnerKey(ctx, previousOwner, certificate.CertificateID)
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().DelState(ownerKey); err != nil {
+			return err
+		}
+	}
+	ownerKey, err := certificateOwnerKey(ctx, certificate.Owner, certificate.CertificateID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(ownerKey, []byte(certificate.CertificateID))
+}
+
+// GetCertificate returns a renewable energy certificate with its provenance
+func (e *EnergyTradingContract) GetCertificate(ctx contractapi.TransactionContextInterface, certificateID string) (*Certificate, error) {
+	key, err := certificateKey(ctx, certificateID)
+	if err != nil {
+		return nil, err
+	}
+	certificateJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate %s: %v", certificateID, err)
+	}
+	if certificateJSON == nil {
+		return nil, fmt.Errorf("certificate %s does not exist", certificateID)
+	}
+	var certificate Certificate
+	if err := json.Unmarshal(certificateJSON, &certificate); err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+// PaginatedCertificateResult is a page of certificates
+type PaginatedCertificateResult struct {
+	Records             []*Certificate `json:"records"`
+	FetchedRecordsCount int32          `json:"fetchedRecordsCount"`
+	Bookmark            string         `json:"bookmark"`
+}
+
+// GetCertificatesByOwner returns a page of the certificates held or retired
+// by a participant
+func (e *EnergyTradingContract) GetCertificatesByOwner(ctx contractapi.TransactionContextInterface, owner string, pageSize int32, bookmark string) (*PaginatedCertificateResult, error) {
+	result := &PaginatedCertificateResult{Records: []*Certificate{}}
+	metadata, err := queryPage(ctx, "certificateowner", []string{owner}, pageSize, bookmark, func(value []byte) error {
+		certificate, err := e.GetCertificate(ctx, string(value))
+		if err != nil {
+			return err
+		}
+		result.Records = append(result.Records, certificate)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// requireActiveCertificate fails unless the caller owns the certificate, it
+// has not been retired and it is neither listed in the certificate market nor
+// pledged as collateral
+func requireActiveCertificate(ctx contractapi.TransactionContextInterface, certificate *Certificate) error {
+	if err := requireCaller(ctx, certificate.Owner); err != nil {
+		return err
+	}
+	return certificateTransferable(certificate)
+}
+
+// certificateTransferable fails if a certificate is retired, listed for sale
+// or pledged as collateral
+func certificateTransferable(certificate *Certificate) error {
+	if certificate.Status != CertificateActive {
+		return fmt.Errorf("certificate %s has been retired", certificate.CertificateID)
+	}
+	if certificate.ListedIn != "" {
+		return fmt.Errorf("certificate %s is listed in offer %s", certificate.CertificateID, certificate.ListedIn)
+	}
+	if certificate.PledgedFor != "" {
+		return fmt.Errorf("certificate %s is pledged as collateral on asset %s", certificate.CertificateID, certificate.PledgedFor)
+	}
+	return nil
+}
+
+// TransferCertificate transfers one of the caller's active certificates to an
+// approved participant
+func (e *EnergyTradingContract) TransferCertificate(ctx contractapi.TransactionContextInterface, certificateID, to string) (*Certificate, error) {
+	certificate, err := e.GetCertificate(ctx, certificateID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, certificate.Owner); err != nil {
+		return nil, err
+	}
+	if err := transferCertificate(ctx, certificate, to); err != nil {
+		return nil, err
+	}
+	return certificate, emitEvent(ctx, EventCertificateChanged, certificate)
+}
+
+// transferCertificate moves a transferable certificate to an approved
+// participant. The caller checks that the transfer is authorized.
+func transferCertificate(ctx contractapi.TransactionContextInterface, certificate *Certificate, to string) error {
+	if err := certificateTransferable(certificate); err != nil {
+		return err
+	}
+	if _, err := requireApprovedParticipant(ctx, to); err != nil {
+		return err
+	}
+	if to == certificate.Owner {
+		return fmt.Errorf("certificate %s is already owned by %s", certificate.CertificateID, to)
+	}
+	previousOwner := certificate.Owner
+	certificate.Owner = to
+	return putCertificate(ctx, certificate, previousOwner)
+}
+
+// RetireCertificate retires one of the caller's certificates, claiming its
+// energy for a beneficiary. Retired certificates cannot be transferred.
+func (e *EnergyTradingContract) RetireCertificate(ctx contractapi.TransactionContextInterface, certificateID, beneficiary string) (*Certificate, error) {
+	if beneficiary == "" {
+		return nil, fmt.Errorf("beneficiary must not be empty")
+	}
+	certificate, err := e.GetCertificate(ctx, certificateID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireActiveCertificate(ctx, certificate); err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	certificate.Status = CertificateRetired
+	certificate.Beneficiary = beneficiary
+	certificate.RetiredAt = now
+	if err := putCertificate(ctx, certificate, ""); err != nil {
+		return nil, err
+	}
+	return certificate, emitEvent(ctx, EventCertificateChanged, certificate)
+}
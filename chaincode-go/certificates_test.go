@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestRenewableCertificates(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	require.NoError(t, e.SetCertificateEnergy(tc.as("admin1", RoleAdmin), 1))
+
+	tc.as("seller1", "")
+	_, err := e.RegisterGenerator(tc, meterID, "diesel", 5)
+	require.EqualError(t, err, "technology must be one of [solar wind hydro biomass geothermal]")
+	_, err = e.RegisterGenerator(tc.as("buyer1", ""), meterID, "solar", 5)
+	require.Error(t, err)
+	generator, err := e.RegisterGenerator(tc.as("seller1", ""), meterID, "solar", 5)
+	require.NoError(t, err)
+	require.Equal(t, GeneratorPending, generator.Status)
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 0, 0, 0, time.UTC)), nil)
+	submit := func(interval string, injected float64) {
+		signature := tc.signReading(t, meterID, interval, injected, 0)
+		require.NoError(t, e.SubmitMeterReading(tc.as("seller1", ""), meterID, interval, injected, 0, signature))
+	}
+
+	// Generation before verification earns nothing
+	submit("2025-05-03T10:00:00Z", 2)
+	_, err = e.VerifyGenerator(tc.as("operator1", RoleOperator), meterID)
+	require.NoError(t, err)
+	submit("2025-05-03T10:15:00Z", 0.6)
+	submit("2025-05-03T10:30:00Z", 1.6)
+
+	generator, err = e.GetGenerator(tc, meterID)
+	require.NoError(t, err)
+	require.Equal(t, 2, generator.Issued)
+	require.InDelta(t, 0.2, generator.PendingEnergy, 1e-9)
+	certificates, err := e.GetCertificatesByOwner(tc, "seller1", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, certificates.Records, 2)
+
+	// A reading straddling certificates is a source of both
+	certificate, err := e.GetCertificate(tc, meterID+"-1")
+	require.NoError(t, err)
+	require.Equal(t, 1.0, certificate.Energy)
+	require.Len(t, certificate.Sources, 2)
+	require.Equal(t, "2025-05-03T10:15:00Z", certificate.Sources[0].IntervalStart)
+	require.InDelta(t, 0.4, certificate.Sources[1].Energy, 1e-9)
+
+	_, err = e.TransferCertificate(tc.as("buyer1", ""), meterID+"-1", "buyer1")
+	require.Error(t, err)
+	_, err = e.TransferCertificate(tc.as("seller1", ""), meterID+"-1", "buyer1")
+	require.NoError(t, err)
+	certificates, err = e.GetCertificatesByOwner(tc, "seller1", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, certificates.Records, 1)
+
+	certificate, err = e.RetireCertificate(tc.as("buyer1", ""), meterID+"-1", "Acme Corp 2025 claim")
+	require.NoError(t, err)
+	require.Equal(t, CertificateRetired, certificate.Status)
+	_, err = e.TransferCertificate(tc, meterID+"-1", "seller1")
+	require.EqualError(t, err, "certificate "+meterID+"-1 has been retired")
+	certificates, err = e.GetCertificatesByOwner(tc, "buyer1", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, certificates.Records, 1)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Charging session statuses
+const (
+	SessionOpen   = "OPEN"
+	SessionClosed = "CLOSED"
+)
+
+// ChargingSession is a buyer's request to charge an electric vehicle at a
+// charger with RequestedEnergy kWh before Deadline, at no more than MaxPrice
+// per kWh. Sellers fill it in parts over time, and the energy delivered in each
+// charging interval is allocated to the fills in the order they were made.
+type ChargingSession struct {
+	SessionID       string          `json:"sessionID"`
+	Buyer           string          `json:"buyer"`
+	ChargerID       string          `json:"chargerID"`
+	RequestedEnergy float64         `json:"requestedEnergy"`
+	MaxPrice        float64         `json:"maxPrice"`
+	Deadline        string          `json:"deadline"`
+	Status          string          `json:"status"`
+	Fills           []*ChargingFill `json:"fills"`
+	FilledEnergy    float64         `json:"filledEnergy"`
+	DeliveredEnergy float64         `json:"deliveredEnergy"`
+	Payment         float64         `json:"payment"`
+	OpenedAt        string          `json:"openedAt"`
+	ClosedAt        string          `json:"closedAt,omitempty"`
+}
+
+// ChargingFill is one seller's share of a charging session
+type ChargingFill struct {
+	Seller          string  `json:"seller"`
+	Energy          float64 `json:"energy"`
+	Price           float64 `json:"price"`
+	DeliveredEnergy float64 `json:"deliveredEnergy"`
+	FilledAt        string  `json:"filledAt"`
+}
+
+// ChargingDelivery is the energy the charger delivered in one meter interval
+type ChargingDelivery struct {
+	SessionID     string  `json:"sessionID"`
+	IntervalStart string  `json:"intervalStart"`
+	Energy        float64 `json:"energy"`
+	RecordedAt    string  `json:"recordedAt"`
+}
+
+func chargingSessionKey(ctx contractapi.TransactionContextInterface, sessionID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("chargingsession", []string{sessionID})
+}
+
+func chargingDeliveryKey(ctx contractapi.TransactionContextInterface, sessionID, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("chargingdelivery", []string{sessionID, intervalStart})
+}
+
+func putChargingSession(ctx contractapi.TransactionContextInterface, session *ChargingSession) error {
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	key, err := chargingSessionKey(ctx, session.SessionID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, sessionJSON)
+}
+
+// OpenChargingSession opens a charging session for the caller
+func (e *EnergyTradingContract) OpenChargingSession(ctx contractapi.TransactionContextInterface, sessionID, chargerID string, requestedEnergy, maxPrice float64, deadline string) (*ChargingSession, error) {
+	if chargerID == "" {
+		return nil, fmt.Errorf("charger ID must not be empty")
+	}
+	if requestedEnergy <= 0 {
+		return nil, fmt.Errorf("requested energy must be positive")
+	}
+	deadline, err := normalizeTimestamp(deadline)
+	if err != nil {
+		return nil, err
+	}
+	deadlineTime, err := parseTimestamp(deadline)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(deadlineTime) {
+		return nil, fmt.Errorf("deadline %s has already passed", deadline)
+	}
+	buyer, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := requireApprovedParticipant(ctx, buyer); err != nil {
+		return nil, err
+	}
+	key, err := chargingSessionKey(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read charging session %s: %v", sessionID, err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("charging session %s already exists", sessionID)
+	}
+
+	session := &ChargingSession{
+		SessionID:       sessionID,
+		Buyer:           buyer,
+		ChargerID:       chargerID,
+		RequestedEnergy: requestedEnergy,
+		MaxPrice:        maxPrice,
+		Deadline:        deadline,
+		Status:          SessionOpen,
+		Fills:           []*ChargingFill{},
+		OpenedAt:        now.Format(time.RFC3339),
+	}
+	if err := putChargingSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, emitEvent(ctx, EventChargingSessionChanged, session)
+}
+
+// GetChargingSession returns a charging session
+func (e *EnergyTradingContract) GetChargingSession(ctx contractapi.TransactionContextInterface, sessionID string) (*ChargingSession, error) {
+	return getChargingSession(ctx, sessionID)
+}
+
+func getChargingSession(ctx contractapi.TransactionContextInterface, sessionID string) (*ChargingSession, error) {
+	key, err := chargingSessionKey(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	sessionJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read charging session %s: %v", sessionID, err)
+	}
+	if sessionJSON == nil {
+		return nil, fmt.Errorf("charging session %s does not exist", sessionID)
+	}
+	var session ChargingSession
+	if err := json.Unmarshal(sessionJSON, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// requireOpenSession returns an open session and the transaction time
+func requireOpenSession(ctx contractapi.TransactionContextInterface, sessionID string) (*ChargingSession, time.Time, error) {
+	session, err := getChargingSession(ctx, sessionID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if session.Status != SessionOpen {
+		return nil, time.Time{}, fmt.Errorf("charging session %s is closed", sessionID)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return session, now, nil
+}
+
+// requireSessionAgent fails unless the caller is the session's buyer or owns
+// the charger. A charger is owned through the meter enrolled under the
+// charger's ID, so that a charge point operator can report the sessions of
+// public chargers on the buyer's behalf.
+func requireSessionAgent(ctx contractapi.TransactionContextInterface, session *ChargingSession) error {
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	if caller == session.Buyer {
+		return nil
+	}
+	charger, err := getDevice(ctx, session.ChargerID)
+	if err != nil {
+		return err
+	}
+	if charger == nil || charger.DeviceType != DeviceMeter || charger.Status != DeviceActive || charger.Owner != caller {
+		return fmt.Errorf("caller %s is neither the buyer of charging session %s nor the owner of charger %s", caller, session.SessionID, session.ChargerID)
+	}
+	return nil
+}
+
+// FillChargingSession offers the caller's energy to an open session at a price
+// within the buyer's maximum. A fill may not exceed the energy still unfilled.
+func (e *EnergyTradingContract) FillChargingSession(ctx contractapi.TransactionContextInterface, sessionID string, energy, price float64) (*ChargingSession, error) {
+	if energy <= 0 {
+		return nil, fmt.Errorf("energy must be positive")
+	}
+	session, now, err := requireOpenSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	deadline, err := parseTimestamp(session.Deadline)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(deadline) {
+		return nil, fmt.Errorf("charging session %s has passed its deadline", sessionID)
+	}
+	seller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if seller == session.Buyer {
+		return nil, fmt.Errorf("buyer cannot fill its own charging session")
+	}
+	if _, err := requireApprovedParticipant(ctx, seller); err != nil {
+		return nil, err
+	}
+	if price > session.MaxPrice {
+		return nil, fmt.Errorf("price %v exceeds the maximum price %v of charging session %s", price, session.MaxPrice, sessionID)
+	}
+	if err := checkTradeIslanding(ctx, seller, session.Buyer, price); err != nil {
+		return nil, err
+	}
+	if energy > session.RequestedEnergy-session.FilledEnergy {
+		return nil, fmt.Errorf("charging session %s has only %v kWh unfilled", sessionID, session.RequestedEnergy-session.FilledEnergy)
+	}
+
+	session.Fills = append(session.Fills, &ChargingFill{
+		Seller:   seller,
+		Energy:   energy,
+		Price:    price,
+		FilledAt: now.Format(time.RFC3339),
+	})
+	session.FilledEnergy += energy
+	if err := putChargingSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, emitEvent(ctx, EventChargingSessionChanged, session)
+}
+
+// RecordChargingDelivery records the energy the buyer's charger delivered in a
+// meter interval that has ended. It is recorded by the buyer or by the owner of
+// the charger. Delivered energy is allocated to the fills in the order they
+// were made and may not exceed the filled energy.
+func (e *EnergyTradingContract) RecordChargingDelivery(ctx contractapi.TransactionContextInterface, sessionID, intervalStart string, energy float64) (*ChargingDelivery, error) {
+	if energy <= 0 {
+		return nil, fmt.Errorf("delivered energy must be positive")
+	}
+	session, now, err := requireOpenSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireSessionAgent(ctx, session); err != nil {
+		return nil, err
+	}
+	intervalStart, length, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseTimestamp(intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	opened, err := parseTimestamp(session.OpenedAt)
+	if err != nil {
+		return nil, err
+	}
+	if !start.Add(length).After(opened) {
+		return nil, fmt.Errorf("interval %s ended before charging session %s was opened", intervalStart, sessionID)
+	}
+	if now.Before(start.Add(length)) {
+		return nil, fmt.Errorf("interval %s has not ended", intervalStart)
+	}
+	if energy > session.FilledEnergy-session.DeliveredEnergy {
+		return nil, fmt.Errorf("charging session %s has only %v kWh filled and undelivered", sessionID, session.FilledEnergy-session.DeliveredEnergy)
+	}
+	key, err := chargingDeliveryKey(ctx, sessionID, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read charging delivery: %v", err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("delivery of charging session %s for %s is already recorded", sessionID, intervalStart)
+	}
+
+	remaining := energy
+	for _, fill := range session.Fills {
+		allocated := math.Min(remaining, fill.Energy-fill.DeliveredEnergy)
+		if allocated <= 0 {
+			continue
+		}
+		fill.DeliveredEnergy += allocated
+		remaining -= allocated
+	}
+	session.DeliveredEnergy += energy
+
+	delivery := &ChargingDelivery{
+		SessionID:     sessionID,
+		IntervalStart: intervalStart,
+		Energy:        energy,
+		RecordedAt:    now.Format(time.RFC3339),
+	}
+	deliveryJSON, err := json.Marshal(delivery)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, deliveryJSON); err != nil {
+		return nil, err
+	}
+	if err := putChargingSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return delivery, emitEvent(ctx, EventChargingDeliveryRecorded, delivery)
+}
+
+// PaginatedChargingDeliveryResult is a page of charging deliveries
+type PaginatedChargingDeliveryResult struct {
+	Records             []*ChargingDelivery `json:"records"`
+	FetchedRecordsCount int32               `json:"fetchedRecordsCount"`
+	Bookmark            string              `json:"bookmark"`
+}
+
+// GetChargingDeliveries returns a page of the deliveries recorded for a
+// charging session
+func (e *EnergyTradingContract) GetChargingDeliveries(ctx contractapi.TransactionContextInterface, sessionID string, pageSize int32, bookmark string) (*PaginatedChargingDeliveryResult, error) {
+	result := &PaginatedChargingDeliveryResult{Records: []*ChargingDelivery{}}
+	metadata, err := queryPage(ctx, "chargingdelivery", []string{sessionID}, pageSize, bookmark, func(value []byte) error {
+		var delivery ChargingDelivery
+		if err := json.Unmarshal(value, &delivery); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &delivery)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// CloseChargingSession closes a session and settles it. The buyer or the owner
+// of the charger may close it at any time, and anyone may close it once the
+// deadline has passed. The buyer
+// pays each seller for the energy delivered against its fill at the fill
+// price, and a seller pays the buyer when its fill price is negative;
+// undelivered fills lapse without payment.
+func (e *EnergyTradingContract) CloseChargingSession(ctx contractapi.TransactionContextInterface, sessionID string) (*ChargingSession, error) {
+	session, now, err := requireOpenSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	deadline, err := parseTimestamp(session.Deadline)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(deadline) {
+		if err := requireSessionAgent(ctx, session); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, fill := range session.Fills {
+		payment := fill.DeliveredEnergy * fill.Price
+		if payment == 0 {
+			continue
+		}
+		payer, payee := session.Buyer, fill.Seller
+		if payment < 0 {
+			payer, payee = payee, payer
+		}
+		if err := transferTokens(ctx, payer, payee, math.Abs(payment)); err != nil {
+			return nil, fmt.Errorf("failed to settle charging session %s: %v", sessionID, err)
+		}
+		session.Payment += payment
+	}
+	session.Status = SessionClosed
+	session.ClosedAt = now.Format(time.RFC3339)
+	if err := putChargingSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, emitEvent(ctx, EventChargingSessionChanged, session)
+}
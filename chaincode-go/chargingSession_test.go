@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestChargingSession(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "seller2", RoleProsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	require.NoError(t, e.MintTokens(tc, "seller2", 1))
+
+	tc.as("buyer1", "")
+	_, err := e.OpenChargingSession(tc, "session1", "charger1", 20, 0.3, "2025-05-01T07:00:00Z")
+	require.EqualError(t, err, "deadline 2025-05-01T07:00:00Z has already passed")
+	_, err = e.OpenChargingSession(tc, "session1", "charger1", 20, 0.3, "2025-05-01T12:00:00Z")
+	require.NoError(t, err)
+
+	_, err = e.FillChargingSession(tc, "session1", 5, 0.25)
+	require.EqualError(t, err, "buyer cannot fill its own charging session")
+	_, err = e.FillChargingSession(tc.as("seller1", ""), "session1", 5, 0.35)
+	require.EqualError(t, err, "price 0.35 exceeds the maximum price 0.3 of charging session session1")
+	_, err = e.FillChargingSession(tc, "session1", 12, 0.25)
+	require.NoError(t, err)
+	_, err = e.FillChargingSession(tc.as("seller2", ""), "session1", 10, 0.2)
+	require.EqualError(t, err, "charging session session1 has only 8 kWh unfilled")
+	session, err := e.FillChargingSession(tc, "session1", 8, 0.2)
+	require.NoError(t, err)
+	require.Len(t, session.Fills, 2)
+
+	tc.as("buyer1", "")
+	_, err = e.RecordChargingDelivery(tc, "session1", "2025-05-01T08:00:00Z", 5)
+	require.EqualError(t, err, "interval 2025-05-01T08:00:00Z has not ended")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 1, 8, 30, 0, 0, time.UTC)), nil)
+	_, err = e.RecordChargingDelivery(tc, "session1", "2025-05-01T07:45:00Z", 5)
+	require.EqualError(t, err, "interval 2025-05-01T07:45:00Z ended before charging session session1 was opened")
+	_, err = e.RecordChargingDelivery(tc.as("seller1", ""), "session1", "2025-05-01T08:00:00Z", 5)
+	require.Error(t, err)
+	tc.as("buyer1", "")
+	_, err = e.RecordChargingDelivery(tc, "session1", "2025-05-01T08:00:00Z", 10)
+	require.NoError(t, err)
+	_, err = e.RecordChargingDelivery(tc, "session1", "2025-05-01T08:00:00Z", 1)
+	require.EqualError(t, err, "delivery of charging session session1 for 2025-05-01T08:00:00Z is already recorded")
+	_, err = e.RecordChargingDelivery(tc, "session1", "2025-05-01T08:15:00Z", 4)
+	require.NoError(t, err)
+	deliveries, err := e.GetChargingDeliveries(tc, "session1", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, deliveries.Records, 2)
+
+	// Only the buyer may close the session before its deadline
+	_, err = e.CloseChargingSession(tc.as("seller1", ""), "session1")
+	require.Error(t, err)
+	session, err = e.CloseChargingSession(tc.as("buyer1", ""), "session1")
+	require.NoError(t, err)
+	require.Equal(t, SessionClosed, session.Status)
+	require.InDelta(t, 12*0.25+2*0.2, session.Payment, 1e-9)
+	seller2, err := e.ReadTokenAccount(tc, "seller2")
+	require.NoError(t, err)
+	require.InDelta(t, 1.4, seller2.Balance, 1e-9)
+	_, err = e.RecordChargingDelivery(tc, "session1", "2025-05-01T08:30:00Z", 1)
+	require.EqualError(t, err, "charging session session1 is closed")
+}
+
+func TestChargingSessionReportedByChargerOwner(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "cpo1", RoleProsumer)
+	chargerID := registerTestMeter(t, e, tc, "cpo1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	_, err := e.OpenChargingSession(tc.as("buyer1", ""), "session1", chargerID, 10, 0.3, "2025-05-01T12:00:00Z")
+	require.NoError(t, err)
+	_, err = e.FillChargingSession(tc.as("seller1", ""), "session1", 10, 0.25)
+	require.NoError(t, err)
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 1, 8, 30, 0, 0, time.UTC)), nil)
+	_, err = e.RecordChargingDelivery(tc.as("seller1", ""), "session1", "2025-05-01T08:00:00Z", 4)
+	require.EqualError(t, err, "caller seller1 is neither the buyer of charging session session1 nor the owner of charger meter-cpo1")
+	_, err = e.RecordChargingDelivery(tc.as("cpo1", ""), "session1", "2025-05-01T08:00:00Z", 4)
+	require.NoError(t, err)
+	session, err := e.CloseChargingSession(tc, "session1")
+	require.NoError(t, err)
+	require.Equal(t, SessionClosed, session.Status)
+	require.InDelta(t, 1.0, session.Payment, 1e-9)
+}
+
+func TestChargingSessionNegativePrice(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 1))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	_, err := e.OpenChargingSession(tc.as("buyer1", ""), "session1", "charger1", 10, -0.05, "2025-05-01T12:00:00Z")
+	require.NoError(t, err)
+	_, err = e.FillChargingSession(tc.as("seller1", ""), "session1", 10, 0)
+	require.EqualError(t, err, "price 0 exceeds the maximum price -0.05 of charging session session1")
+	_, err = e.FillChargingSession(tc, "session1", 10, -0.1)
+	require.NoError(t, err)
+
+	// The seller pays the buyer for the energy it delivered
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 1, 8, 30, 0, 0, time.UTC)), nil)
+	_, err = e.RecordChargingDelivery(tc.as("buyer1", ""), "session1", "2025-05-01T08:00:00Z", 4)
+	require.NoError(t, err)
+	session, err := e.CloseChargingSession(tc, "session1")
+	require.NoError(t, err)
+	require.InDelta(t, -0.4, session.Payment, 1e-9)
+	buyer, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 1.4, buyer.Balance, 1e-9)
+}
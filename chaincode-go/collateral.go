@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// CollateralEscrowAccount holds the tokens posted as trade collateral
+const CollateralEscrowAccount = "collateral-escrow"
+
+// Collateral kinds. Tokens are locked in CollateralEscrowAccount, certificates
+// are pledged and cannot be transferred, listed or retired while pledged, and
+// reputation is an unsecured credit line that locks nothing.
+const (
+	CollateralTokens      = "TOKENS"
+	CollateralCertificate = "CERTIFICATE"
+	CollateralReputation  = "REPUTATION"
+)
+
+// Collateral statuses
+const (
+	CollateralLocked   = "LOCKED"
+	CollateralReleased = "RELEASED"
+	CollateralSeized   = "SEIZED"
+)
+
+// Default collateral terms, in force until an operator sets others
+const (
+	DefaultCollateralCertificatePrice   = 20.0
+	DefaultCollateralCertificateHaircut = 0.3
+	DefaultCollateralReputationCredit   = 10.0
+	DefaultCollateralReputationHaircut  = 0.5
+	DefaultCollateralMinReputation      = 80.0
+)
+
+// collateralTermsKey is the state key of the collateral terms
+const collateralTermsKey = "collateralterms"
+
+// CollateralTerms holds the valuation of non-token collateral. A certificate
+// is worth CertificatePrice less CertificateHaircut. A participant whose
+// reputation score is at least MinReputationScore has a credit line of
+// ReputationCredit scaled by score/100, less ReputationHaircut.
+type CollateralTerms struct {
+	CertificatePrice   float64 `json:"certificatePrice"`
+	CertificateHaircut float64 `json:"certificateHaircut"`
+	ReputationCredit   float64 `json:"reputationCredit"`
+	ReputationHaircut  float64 `json:"reputationHaircut"`
+	MinReputationScore float64 `json:"minReputationScore"`
+	UpdatedBy          string  `json:"updatedBy,omitempty"`
+	UpdatedAt          string  `json:"updatedAt,omitempty"`
+}
+
+// TradeCollateral is the collateral a party posted for its deposit on a
+// trade. Value is the haircut valuation when it was locked or last revalued;
+// Deficit is how far that falls short of Deposit after a revaluation.
+type TradeCollateral struct {
+	TokenID        string   `json:"tokenID"`
+	Party          string   `json:"party"`
+	Kind           string   `json:"kind"`
+	Deposit        float64  `json:"deposit"`
+	Value          float64  `json:"value"`
+	Deficit        float64  `json:"deficit,omitempty"`
+	Amount         float64  `json:"amount,omitempty"`
+	CertificateIDs []string `json:"certificateIDs,omitempty"`
+	Status         string   `json:"status"`
+	LockedAt       string   `json:"lockedAt"`
+	RevaluedAt     string   `json:"revaluedAt,omitempty"`
+	ReleasedAt     string   `json:"releasedAt,omitempty"`
+	Version        int64    `json:"version"`
+}
+
+func tradeCollateralKey(ctx contractapi.TransactionContextInterface, tokenID, party string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("collateral", []string{tokenID, party})
+}
+
+// SetCollateralTerms sets the valuation of certificate and reputation
+// collateral. Changes apply to collateral locked or revalued afterwards.
+func (e *EnergyTradingContract) SetCollateralTerms(ctx contractapi.TransactionContextInterface, certificatePrice, certificateHaircut, reputationCredit, reputationHaircut, minReputationScore float64) (*CollateralTerms, error) {
+	if certificatePrice < 0 || reputationCredit < 0 {
+		return nil, fmt.Errorf("certificate price and reputation credit must not be negative")
+	}
+	if certificateHaircut < 0 || certificateHaircut > 1 || reputationHaircut < 0 || reputationHaircut > 1 {
+		return nil, fmt.Errorf("haircuts must be in [0, 1]")
+	}
+	if minReputationScore < 0 || minReputationScore > 100 {
+		return nil, fmt.Errorf("minimum reputation score must be in [0, 100]")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	terms := &CollateralTerms{
+		CertificatePrice:   certificatePrice,
+		CertificateHaircut: certificateHaircut,
+		ReputationCredit:   reputationCredit,
+		ReputationHaircut:  reputationHaircut,
+		MinReputationScore: minReputationScore,
+		UpdatedBy:          caller,
+		UpdatedAt:          now,
+	}
+	termsJSON, err := json.Marshal(terms)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(collateralTermsKey, termsJSON); err != nil {
+		return nil, err
+	}
+	return terms, nil
+}
+
+// GetCollateralTerms returns the collateral terms in force
+func (e *EnergyTradingContract) GetCollateralTerms(ctx contractapi.TransactionContextInterface) (*CollateralTerms, error) {
+	termsJSON, err := ctx.GetStub().GetState(collateralTermsKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read collateral terms: %v", err)
+	}
+	if termsJSON == nil {
+		return &CollateralTerms{
+			CertificatePrice:   DefaultCollateralCertificatePrice,
+			CertificateHaircut: DefaultCollateralCertificateHaircut,
+			ReputationCredit:   DefaultCollateralReputationCredit,
+			ReputationHaircut:  DefaultCollateralReputationHaircut,
+			MinReputationScore: DefaultCollateralMinReputation,
+		}, nil
+	}
+	var terms CollateralTerms
+	if err := json.Unmarshal(termsJSON, &terms); err != nil {
+		return nil, err
+	}
+	return &terms, nil
+}
+
+// getTradeCollateral returns a party's collateral on a trade, or nil if it
+// posted none
+func getTradeCollateral(ctx contractapi.TransactionContextInterface, tokenID, party string) (*TradeCollateral, error) {
+	key, err := tradeCollateralKey(ctx, tokenID, party)
+	if err != nil {
+		return nil, err
+	}
+	collateralJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read collateral of %s on %s: %v", party, tokenID, err)
+	}
+	if collateralJSON == nil {
+		return nil, nil
+	}
+	var collateral TradeCollateral
+	if err := json.Unmarshal(collateralJSON, &collateral); err != nil {
+		return nil, err
+	}
+	return &collateral, nil
+}
+
+func putTradeCollateral(ctx contractapi.TransactionContextInterface, collateral *TradeCollateral) error {
+	collateral.Version++
+	collateralJSON, err := json.Marshal(collateral)
+	if err != nil {
+		return err
+	}
+	key, err := tradeCollateralKey(ctx, collateral.TokenID, collateral.Party)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, collateralJSON)
+}
+
+// GetTradeCollateral returns the collateral a party posted on a trade
+func (e *EnergyTradingContract) GetTradeCollateral(ctx contractapi.TransactionContextInterface, tokenID, party string) (*TradeCollateral, error) {
+	collateral, err := getTradeCollateral(ctx, tokenID, party)
+	if err != nil {
+		return nil, err
+	}
+	if collateral == nil {
+		return nil, fmt.Errorf("%s has posted no collateral on asset %s", party, tokenID)
+	}
+	return collateral, nil
+}
+
+// valueCollateral values collateral under the terms in force. Token
+// collateral is worth its amount.
+func valueCollateral(ctx contractapi.TransactionContextInterface, collateral *TradeCollateral) (float64, error) {
+	if collateral.Kind == CollateralTokens {
+		return collateral.Amount, nil
+	}
+	terms, err := (&EnergyTradingContract{}).GetCollateralTerms(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if collateral.Kind == CollateralCertificate {
+		return float64(len(collateral.CertificateIDs)) * terms.CertificatePrice * (1 - terms.CertificateHaircut), nil
+	}
+	reputation, err := (&EnergyTradingContract{}).ReadReputationScore(ctx, collateral.Party)
+	if err != nil {
+		return 0, err
+	}
+	if reputation.Score < terms.MinReputationScore {
+		return 0, nil
+	}
+	return terms.ReputationCredit * reputation.Score / 100 * (1 - terms.ReputationHaircut), nil
+}
+
+// pledgeCertificates pledges the caller's certificates for a trade
+func pledgeCertificates(ctx contractapi.TransactionContextInterface, tokenID string, certificateIDs []string) error {
+	if len(certificateIDs) == 0 {
+		return fmt.Errorf("certificate collateral needs at least one certificate")
+	}
+	if err := checkBatchSize(ctx, len(certificateIDs), "certificates"); err != nil {
+		return err
+	}
+	for _, certificateID := range certificateIDs {
+		certificate, err := (&EnergyTradingContract{}).GetCertificate(ctx, certificateID)
+		if err != nil {
+			return err
+		}
+		if err := requireActiveCertificate(ctx, certificate); err != nil {
+			return err
+		}
+		certificate.PledgedFor = tokenID
+		if err := putCertificate(ctx, certificate, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpledgeCertificates lifts the pledge of certificates, transferring the
+// first count of them to the given address
+func unpledgeCertificates(ctx contractapi.TransactionContextInterface, certificateIDs []string, count int, to string) error {
+	for i, certificateID := range certificateIDs {
+		certificate, err := (&EnergyTradingContract{}).GetCertificate(ctx, certificateID)
+		if err != nil {
+			return err
+		}
+		certificate.PledgedFor = ""
+		if i < count {
+			err = transferCertificate(ctx, certificate, to)
+		} else {
+			err = putCertificate(ctx, certificate, "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseCollateral returns locked collateral to its party. Of token
+// collateral, seize is paid to the counterparty first; of certificate
+// collateral, as many certificates as needed to cover seize at their locked
+// value. It returns the amount covered.
+func releaseCollateral(ctx contractapi.TransactionContextInterface, collateral *TradeCollateral, seize float64, counterparty string) (float64, error) {
+	covered := 0.0
+	switch collateral.Kind {
+	case CollateralTokens:
+		covered = math.Min(seize, collateral.Amount)
+		if covered > 0 {
+			if err := transferTokens(ctx, CollateralEscrowAccount, counterparty, covered); err != nil {
+				return 0, err
+			}
+		}
+		if refund := collateral.Amount - covered; refund > 0 {
+			if err := transferTokens(ctx, CollateralEscrowAccount, collateral.Party, refund); err != nil {
+				return 0, err
+			}
+		}
+	case CollateralCertificate:
+		count := 0
+		if seize > 0 && collateral.Value > 0 {
+			unit := collateral.Value / float64(len(collateral.CertificateIDs))
+			count = int(math.Min(math.Ceil(seize/unit), float64(len(collateral.CertificateIDs))))
+			covered = math.Min(seize, float64(count)*unit)
+		}
+		if err := unpledgeCertificates(ctx, collateral.CertificateIDs, count, counterparty); err != nil {
+			return 0, err
+		}
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return 0, err
+	}
+	collateral.Status = CollateralReleased
+	if covered > 0 {
+		collateral.Status = CollateralSeized
+	}
+	collateral.ReleasedAt = now
+	return covered, putTradeCollateral(ctx, collateral)
+}
+
+// PostTradeCollateral posts collateral backing the caller's deposit on a
+// trade that has not settled yet. Token collateral locks the deposit in
+// escrow; certificate collateral pledges the given certificates; reputation
+// collateral relies on the caller's score, so frequent traders with a good
+// record need not tie up tokens. The collateral is valued under the terms in force and
+// must cover the deposit. Posting again substitutes the new collateral for
+// the old, which is released.
+func (e *EnergyTradingContract) PostTradeCollateral(ctx contractapi.TransactionContextInterface, tokenID, kind string, certificateIDs []string) (*TradeCollateral, error) {
+	if kind != CollateralTokens && kind != CollateralCertificate && kind != CollateralReputation {
+		return nil, fmt.Errorf("collateral kind must be %s, %s or %s", CollateralTokens, CollateralCertificate, CollateralReputation)
+	}
+	asset, err := e.ReadEnergyAsset(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	party, err := requireParty(ctx, asset.BuyerAddress, asset.SellerAddress)
+	if err != nil {
+		return nil, err
+	}
+	if asset.TransactionState == StateSettled || asset.TransactionState == StateCancelled {
+		return nil, fmt.Errorf("asset %s cannot take collateral in state %s", tokenID, asset.TransactionState)
+	}
+	details, err := getPrivateDetails(ctx, asset)
+	if err != nil {
+		return nil, err
+	}
+	deposit := details.BuyerDeposit
+	if party == asset.SellerAddress {
+		deposit = details.SellerDeposit
+	}
+	if deposit <= 0 {
+		return nil, fmt.Errorf("%s owes no deposit on asset %s", party, tokenID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collateral := &TradeCollateral{TokenID: tokenID, Party: party, Kind: kind, Deposit: deposit, Status: CollateralLocked, LockedAt: now}
+	switch kind {
+	case CollateralTokens:
+		collateral.Amount = deposit
+	case CollateralCertificate:
+		collateral.CertificateIDs = certificateIDs
+	}
+	if collateral.Value, err = valueCollateral(ctx, collateral); err != nil {
+		return nil, err
+	}
+	if collateral.Value < deposit {
+		return nil, fmt.Errorf("%s collateral worth %g does not cover the deposit of %g", kind, collateral.Value, deposit)
+	}
+
+	previous, err := getTradeCollateral(ctx, tokenID, party)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && previous.Status == CollateralLocked {
+		if _, err := releaseCollateral(ctx, previous, 0, ""); err != nil {
+			return nil, err
+		}
+		collateral.Version = previous.Version
+	}
+	switch kind {
+	case CollateralTokens:
+		exists, err := tokenAccountExists(ctx, CollateralEscrowAccount)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			if err := putTokenAccount(ctx, &TokenAccount{AccountID: CollateralEscrowAccount}); err != nil {
+				return nil, err
+			}
+		}
+		if err := transferTokens(ctx, party, CollateralEscrowAccount, deposit); err != nil {
+			return nil, fmt.Errorf("failed to lock collateral of %s: %v", party, err)
+		}
+	case CollateralCertificate:
+		if err := pledgeCertificates(ctx, tokenID, certificateIDs); err != nil {
+			return nil, err
+		}
+	}
+	if err := putTradeCollateral(ctx, collateral); err != nil {
+		return nil, err
+	}
+	return collateral, emitEvent(ctx, EventCollateralChanged, collateral)
+}
+
+// RevalueTradeCollateral revalues a party's locked collateral under the terms
+// and reputation score in force, for example when the trade is disputed, and
+// records any deficit against the deposit. The party can cure a deficit by
+// substituting other collateral.
+func (e *EnergyTradingContract) RevalueTradeCollateral(ctx contractapi.TransactionContextInterface, tokenID, party string) (*TradeCollateral, error) {
+	collateral, err := e.GetTradeCollateral(ctx, tokenID, party)
+	if err != nil {
+		return nil, err
+	}
+	if collateral.Status != CollateralLocked {
+		return nil, fmt.Errorf("collateral of %s on asset %s is %s", party, tokenID, collateral.Status)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if collateral.Value, err = valueCollateral(ctx, collateral); err != nil {
+		return nil, err
+	}
+	collateral.Deficit = math.Max(0, collateral.Deposit-collateral.Value)
+	collateral.RevaluedAt = now
+	if err := putTradeCollateral(ctx, collateral); err != nil {
+		return nil, err
+	}
+	return collateral, emitEvent(ctx, EventCollateralChanged, collateral)
+}
+
+// settleTradeCollateral releases the collateral of both parties of a trade
+// being settled. The seller's imbalance penalty is seized from its collateral
+// as far as it covers it; the amount covered is returned and the seller pays
+// the rest in tokens.
+func settleTradeCollateral(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, penalty float64) (float64, error) {
+	covered := 0.0
+	for _, party := range []string{asset.BuyerAddress, asset.SellerAddress} {
+		collateral, err := getTradeCollateral(ctx, asset.TokenID, party)
+		if err != nil {
+			return 0, err
+		}
+		if collateral == nil || collateral.Status != CollateralLocked {
+			continue
+		}
+		seize := 0.0
+		if party == asset.SellerAddress {
+			seize = penalty
+		}
+		amount, err := releaseCollateral(ctx, collateral, seize, asset.BuyerAddress)
+		if err != nil {
+			return 0, fmt.Errorf("failed to release collateral of %s: %v", party, err)
+		}
+		covered += amount
+	}
+	return covered, nil
+}
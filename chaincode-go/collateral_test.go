@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCertificateCollateralCoversPenalty(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	require.NoError(t, e.SetCertificateEnergy(tc, 1))
+	_, err := e.RegisterGenerator(tc.as("seller1", ""), meterID, "solar", 5)
+	require.NoError(t, err)
+	_, err = e.VerifyGenerator(tc.as("operator1", RoleOperator), meterID)
+	require.NoError(t, err)
+	_, err = e.SetCollateralTerms(tc, 1, 0.5, 10, 0.5, 80)
+	require.NoError(t, err)
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 9, 30, 0, 0, time.UTC)), nil)
+	signature := tc.signReading(t, meterID, "2025-05-03T09:00:00Z", 3, 0)
+	require.NoError(t, e.SubmitMeterReading(tc.as("seller1", ""), meterID, "2025-05-03T09:00:00Z", 3, 0, signature))
+
+	// Each certificate is worth 0.5 after the haircut against a deposit of 1
+	_, err = e.PostTradeCollateral(tc, "energy1", CollateralCertificate, []string{meterID + "-1"})
+	require.EqualError(t, err, "CERTIFICATE collateral worth 0.5 does not cover the deposit of 1")
+	collateral, err := e.PostTradeCollateral(tc, "energy1", CollateralCertificate, []string{meterID + "-1", meterID + "-2"})
+	require.NoError(t, err)
+	require.Equal(t, 1.0, collateral.Value)
+	_, err = e.TransferCertificate(tc, meterID+"-1", "buyer1")
+	require.EqualError(t, err, "certificate "+meterID+"-1 is pledged as collateral on asset energy1")
+
+	// The penalty of 0.6 is seized as two certificates instead of tokens
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	settlement, err := e.ReconcileDelivery(tc, "energy1")
+	require.NoError(t, err)
+	require.InDelta(t, 0.6, settlement.ImbalancePenalty, 1e-9)
+	require.InDelta(t, 0.6, settlement.CollateralSeized, 1e-9)
+	certificate, err := e.GetCertificate(tc, meterID+"-2")
+	require.NoError(t, err)
+	require.Equal(t, "buyer1", certificate.Owner)
+	require.Empty(t, certificate.PledgedFor)
+	seller, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 2.2, seller.Balance, 1e-9)
+	collateral, err = e.GetTradeCollateral(tc, "energy1", "seller1")
+	require.NoError(t, err)
+	require.Equal(t, CollateralSeized, collateral.Status)
+}
+
+func TestCollateralSubstitutionAndRevaluation(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	confirmTestAsset(t, e, tc, "energy1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 5))
+
+	_, err := e.PostTradeCollateral(tc.as("outsider", ""), "energy1", CollateralTokens, nil)
+	require.EqualError(t, err, "caller outsider is not a party to this trade")
+	collateral, err := e.PostTradeCollateral(tc.as("buyer1", ""), "energy1", CollateralTokens, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1.0, collateral.Amount)
+	balance, err := e.BalanceOf(tc, "buyer1", EnergyTokenID)
+	require.NoError(t, err)
+	require.Equal(t, 4.0, balance)
+
+	// Reputation counts from a score of 80 and substitutes for the tokens
+	_, err = e.PostTradeCollateral(tc, "energy1", CollateralReputation, nil)
+	require.EqualError(t, err, "REPUTATION collateral worth 0 does not cover the deposit of 1")
+	require.NoError(t, e.UpdateReputationScore(tc.as("admin1", RoleAdmin), "buyer1", 40))
+	collateral, err = e.PostTradeCollateral(tc.as("buyer1", ""), "energy1", CollateralReputation, nil)
+	require.NoError(t, err)
+	require.InDelta(t, 4.5, collateral.Value, 1e-9)
+	require.Equal(t, CollateralReputation, collateral.Kind)
+	require.Zero(t, collateral.Amount)
+	balance, err = e.BalanceOf(tc, "buyer1", EnergyTokenID)
+	require.NoError(t, err)
+	require.Equal(t, 5.0, balance)
+
+	// A lower score found in a dispute leaves the deposit uncovered
+	require.NoError(t, e.UpdateReputationScore(tc.as("admin1", RoleAdmin), "buyer1", -20))
+	collateral, err = e.RevalueTradeCollateral(tc.as("arbiter1", RoleArbiter), "energy1", "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, collateral.Value)
+	require.Equal(t, 1.0, collateral.Deficit)
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventCollateralChanged, name)
+}
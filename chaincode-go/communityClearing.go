@@ -0,0 +1,740 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Clearing round tiers. Each zone is a community that first clears its own
+// orders for an interval; the residual orders of all communities are then
+// cleared against each other in one inter-community round.
+const (
+	TierIntraCommunity = "INTRA_COMMUNITY"
+	TierInterCommunity = "INTER_COMMUNITY"
+)
+
+// OrderExpired marks a community order left unfilled by the
+// inter-community round
+const OrderExpired = "EXPIRED"
+
+// CommunityOrder is a bid or offer of energy for one interval in the
+// trader's community. LimitPrice is the most a bidder pays per kWh including
+// the network fee, and the least an offerer accepts per kWh; a negative limit
+// is a payment the trader requires to take or give up the energy. Offers
+// carry the origin label of the energy.
+type CommunityOrder struct {
+	OrderID       string  `json:"orderID"`
+	Side          string  `json:"side"`
+	Trader        string  `json:"trader"`
+	Zone          string  `json:"zone"`
+	IntervalStart string  `json:"intervalStart"`
+	IntervalEnd   string  `json:"intervalEnd"`
+	SourceType    string  `json:"sourceType,omitempty"`
+	Energy        float64 `json:"energy"`
+	Filled        float64 `json:"filled"`
+	LimitPrice    float64 `json:"limitPrice"`
+	Status        string  `json:"status"`
+	CreatedAt     string  `json:"createdAt"`
+	Version       int64   `json:"version"`
+}
+
+// ClearingMatch is one trade created by a clearing round
+type ClearingMatch struct {
+	TokenID    string  `json:"tokenID"`
+	BidID      string  `json:"bidID"`
+	OfferID    string  `json:"offerID"`
+	Buyer      string  `json:"buyer"`
+	Seller     string  `json:"seller"`
+	BuyerZone  string  `json:"buyerZone"`
+	SellerZone string  `json:"sellerZone"`
+	Energy     float64 `json:"energy"`
+	Price      float64 `json:"price"`
+	NetworkFee float64 `json:"networkFee"`
+}
+
+// ClearingRound records the outcome of one tier of clearing for an interval.
+// An intra-community round clears one zone at a uniform price; the
+// inter-community round prices each match separately, since the network fee
+// differs between zone pairs. Rounds are chained: the inter-community round
+// lists the intra-community rounds whose residual it cleared in
+// PreviousRounds, and each of those names it in NextRound.
+type ClearingRound struct {
+	RoundID        string           `json:"roundID"`
+	Tier           string           `json:"tier"`
+	Zone           string           `json:"zone,omitempty"`
+	IntervalStart  string           `json:"intervalStart"`
+	ClearingPrice  float64          `json:"clearingPrice,omitempty"`
+	ClearedEnergy  float64          `json:"clearedEnergy"`
+	Matches        []*ClearingMatch `json:"matches"`
+	ResidualDemand float64          `json:"residualDemand"`
+	ResidualSupply float64          `json:"residualSupply"`
+	PreviousRounds []string         `json:"previousRounds,omitempty"`
+	NextRound      string           `json:"nextRound,omitempty"`
+	ClearedBy      string           `json:"clearedBy"`
+	ClearedAt      string           `json:"clearedAt"`
+}
+
+func communityOrderKey(ctx contractapi.TransactionContextInterface, orderID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("communityorder", []string{orderID})
+}
+
+func intervalOrderKey(ctx contractapi.TransactionContextInterface, intervalStart, zone, orderID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("intervalorder", []string{intervalStart, zone, orderID})
+}
+
+func clearingRoundKey(ctx contractapi.TransactionContextInterface, roundID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("clearinground", []string{roundID})
+}
+
+// intervalRoundKey indexes the rounds of an interval with the
+// intra-community rounds, by zone, ahead of the inter-community round
+func intervalRoundKey(ctx contractapi.TransactionContextInterface, round *ClearingRound) (string, error) {
+	tierOrder := "0"
+	if round.Tier == TierInterCommunity {
+		tierOrder = "1"
+	}
+	return ctx.GetStub().CreateCompositeKey("intervalround", []string{round.IntervalStart, tierOrder, round.RoundID})
+}
+
+func intraRoundID(zone, intervalStart string) string {
+	return "intra-" + zone + "-" + intervalStart
+}
+
+func interRoundID(intervalStart string) string {
+	return "inter-" + intervalStart
+}
+
+func putCommunityOrder(ctx contractapi.TransactionContextInterface, order *CommunityOrder) error {
+	order.Version++
+	orderJSON, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	key, err := communityOrderKey(ctx, order.OrderID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, orderJSON)
+}
+
+// getCommunityOrder returns a community order, or nil if there is none
+func getCommunityOrder(ctx contractapi.TransactionContextInterface, orderID string) (*CommunityOrder, error) {
+	key, err := communityOrderKey(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	orderJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read order %s: %v", orderID, err)
+	}
+	if orderJSON == nil {
+		return nil, nil
+	}
+	var order CommunityOrder
+	if err := json.Unmarshal(orderJSON, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// GetCommunityOrder returns a community order
+func (e *EnergyTradingContract) GetCommunityOrder(ctx contractapi.TransactionContextInterface, orderID string) (*CommunityOrder, error) {
+	order, err := getCommunityOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, fmt.Errorf("order %s does not exist", orderID)
+	}
+	return order, nil
+}
+
+// PaginatedCommunityOrderResult is a page of community orders
+type PaginatedCommunityOrderResult struct {
+	Records             []*CommunityOrder `json:"records"`
+	FetchedRecordsCount int32             `json:"fetchedRecordsCount"`
+	Bookmark            string            `json:"bookmark"`
+}
+
+// GetOpenCommunityOrders returns a page of the open orders of an interval,
+// of one zone if zone is set, in zone and order ID order. Filled, cancelled
+// and expired orders are skipped, so a page may hold fewer than pageSize
+// orders.
+func (e *EnergyTradingContract) GetOpenCommunityOrders(ctx contractapi.TransactionContextInterface, intervalStart, zone string, pageSize int32, bookmark string) (*PaginatedCommunityOrderResult, error) {
+	intervalStart, err := normalizeTimestamp(intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	attributes := []string{intervalStart}
+	if zone != "" {
+		attributes = append(attributes, zone)
+	}
+	result := &PaginatedCommunityOrderResult{Records: []*CommunityOrder{}}
+	metadata, err := queryPage(ctx, "intervalorder", attributes, pageSize, bookmark, func(value []byte) error {
+		order, err := getCommunityOrder(ctx, string(value))
+		if err != nil {
+			return err
+		}
+		if order != nil && order.Status == OrderOpen {
+			result.Records = append(result.Records, order)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+func putClearingRound(ctx contractapi.TransactionContextInterface, round *ClearingRound) error {
+	roundJSON, err := json.Marshal(round)
+	if err != nil {
+		return err
+	}
+	key, err := clearingRoundKey(ctx, round.RoundID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, roundJSON)
+}
+
+// getClearingRound returns a clearing round, or nil if it has not run
+func getClearingRound(ctx contractapi.TransactionContextInterface, roundID string) (*ClearingRound, error) {
+	key, err := clearingRoundKey(ctx, roundID)
+	if err != nil {
+		return nil, err
+	}
+	roundJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read clearing round %s: %v", roundID, err)
+	}
+	if roundJSON == nil {
+		return nil, nil
+	}
+	var round ClearingRound
+	if err := json.Unmarshal(roundJSON, &round); err != nil {
+		return nil, err
+	}
+	return &round, nil
+}
+
+// GetClearingRound returns a clearing round
+func (e *EnergyTradingContract) GetClearingRound(ctx contractapi.TransactionContextInterface, roundID string) (*ClearingRound, error) {
+	round, err := getClearingRound(ctx, roundID)
+	if err != nil {
+		return nil, err
+	}
+	if round == nil {
+		return nil, fmt.Errorf("clearing round %s does not exist", roundID)
+	}
+	return round, nil
+}
+
+// PaginatedClearingRoundResult is a page of clearing rounds
+type PaginatedClearingRoundResult struct {
+	Records             []*ClearingRound `json:"records"`
+	FetchedRecordsCount int32            `json:"fetchedRecordsCount"`
+	Bookmark            string           `json:"bookmark"`
+}
+
+// GetClearingRounds returns a page of the clearing rounds of an interval, the
+// intra-community rounds by zone followed by the inter-community round
+func (e *EnergyTradingContract) GetClearingRounds(ctx contractapi.TransactionContextInterface, intervalStart string, pageSize int32, bookmark string) (*PaginatedClearingRoundResult, error) {
+	intervalStart, err := normalizeTimestamp(intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedClearingRoundResult{Records: []*ClearingRound{}}
+	metadata, err := queryPage(ctx, "intervalround", []string{intervalStart}, pageSize, bookmark, func(value []byte) error {
+		round, err := e.GetClearingRound(ctx, string(value))
+		if err != nil {
+			return err
+		}
+		result.Records = append(result.Records, round)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// intraClearingRounds returns the intra-community rounds of an interval
+func intraClearingRounds(ctx contractapi.TransactionContextInterface, intervalStart string) ([]*ClearingRound, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("intervalround", []string{intervalStart, "0"})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	rounds := []*ClearingRound{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		round, err := getClearingRound(ctx, string(queryResponse.Value))
+		if err != nil {
+			return nil, err
+		}
+		rounds = append(rounds, round)
+	}
+	return rounds, nil
+}
+
+// openCommunitySlot aligns an interval to its time slot and checks that it
+// has not started, returning its start and end
+func openCommunitySlot(ctx contractapi.TransactionContextInterface, intervalStart string) (string, string, error) {
+	intervalStart, length, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return "", "", err
+	}
+	start, err := parseTimestamp(intervalStart)
+	if err != nil {
+		return "", "", err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if !now.Before(start) {
+		return "", "", fmt.Errorf("interval %s has already started", intervalStart)
+	}
+	return intervalStart, start.Add(length).Format(time.RFC3339), nil
+}
+
+// SubmitCommunityOrder places a bid or offer for an interval in the caller's
+// community. Orders are accepted until the community clears the interval.
+// A trader may not bid and offer in the same interval.
+func (e *EnergyTradingContract) SubmitCommunityOrder(ctx contractapi.TransactionContextInterface, orderID, side, intervalStart, sourceType string, energy, limitPrice float64) (*CommunityOrder, error) {
+	if side != OrderBid && side != OrderOffer {
+		return nil, fmt.Errorf("order side must be %s or %s", OrderBid, OrderOffer)
+	}
+	if energy <= 0 {
+		return nil, fmt.Errorf("order energy must be positive")
+	}
+	trader, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	participant, err := requireApprovedParticipant(ctx, trader)
+	if err != nil {
+		return nil, err
+	}
+	if side == OrderOffer {
+		if err := validateSourceType(ctx, trader, sourceType); err != nil {
+			return nil, err
+		}
+	} else {
+		sourceType = ""
+	}
+	intervalStart, intervalEnd, err := openCommunitySlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	round, err := getClearingRound(ctx, intraRoundID(participant.Zone, intervalStart))
+	if err != nil {
+		return nil, err
+	}
+	if round != nil {
+		return nil, fmt.Errorf("zone %s has already cleared interval %s", participant.Zone, intervalStart)
+	}
+	existing, err := getCommunityOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("order %s already exists", orderID)
+	}
+	orders, err := openCommunityOrders(ctx, intervalStart, participant.Zone)
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range orders {
+		if order.Trader == trader && order.Side != side {
+			return nil, fmt.Errorf("trader %s already has a %s order for interval %s", trader, order.Side, intervalStart)
+		}
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order := &CommunityOrder{
+		OrderID:       orderID,
+		Side:          side,
+		Trader:        trader,
+		Zone:          participant.Zone,
+		IntervalStart: intervalStart,
+		IntervalEnd:   intervalEnd,
+		SourceType:    sourceType,
+		Energy:        energy,
+		LimitPrice:    limitPrice,
+		Status:        OrderOpen,
+		CreatedAt:     now,
+	}
+	if err := putCommunityOrder(ctx, order); err != nil {
+		return nil, err
+	}
+	indexKey, err := intervalOrderKey(ctx, intervalStart, participant.Zone, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(indexKey, []byte(orderID)); err != nil {
+		return nil, err
+	}
+	return order, emitEvent(ctx, EventCommunityOrderChanged, order)
+}
+
+// CancelCommunityOrder withdraws an open order; only its trader may call it
+func (e *EnergyTradingContract) CancelCommunityOrder(ctx contractapi.TransactionContextInterface, orderID string) (*CommunityOrder, error) {
+	order, err := e.GetCommunityOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, order.Trader); err != nil {
+		return nil, err
+	}
+	if order.Status != OrderOpen {
+		return nil, fmt.Errorf("order %s is %s", orderID, order.Status)
+	}
+	order.Status = OrderCancelled
+	if err := putCommunityOrder(ctx, order); err != nil {
+		return nil, err
+	}
+	return order, emitEvent(ctx, EventCommunityOrderChanged, order)
+}
+
+// openCommunityOrders returns the open orders of an interval, of one zone if
+// zone is set, in zone and order ID order
+func openCommunityOrders(ctx contractapi.TransactionContextInterface, intervalStart, zone string) ([]*CommunityOrder, error) {
+	attributes := []string{intervalStart}
+	if zone != "" {
+		attributes = append(attributes, zone)
+	}
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("intervalorder", attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	orders := []*CommunityOrder{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		order, err := getCommunityOrder(ctx, string(queryResponse.Value))
+		if err != nil {
+			return nil, err
+		}
+		if order != nil && order.Status == OrderOpen {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+// bookSides splits orders into bids, highest limit first, and offers, lowest
+// limit first. Orders at the same limit keep their order.
+func bookSides(orders []*CommunityOrder) ([]*CommunityOrder, []*CommunityOrder) {
+	var bids, offers []*CommunityOrder
+	for _, order := range orders {
+		if order.Side == OrderBid {
+			bids = append(bids, order)
+		} else {
+			offers = append(offers, order)
+		}
+	}
+	sort.SliceStable(bids, func(i, j int) bool { return bids[i].LimitPrice > bids[j].LimitPrice })
+	sort.SliceStable(offers, func(i, j int) bool { return offers[i].LimitPrice < offers[j].LimitPrice })
+	return bids, offers
+}
+
+func remaining(order *CommunityOrder) float64 {
+	return order.Energy - order.Filled
+}
+
+// zoneFee returns the network fee per kWh between two zones, zero if none is set
+func zoneFee(ctx contractapi.TransactionContextInterface, zoneA, zoneB string) (float64, error) {
+	tariff, err := getNetworkTariff(ctx, zoneA, zoneB)
+	if err != nil || tariff == nil {
+		return 0, err
+	}
+	return tariff.FeePerKWh, nil
+}
+
+// ClearIntraCommunity clears a zone's orders for an interval against each
+// other. Bids and offers are matched in price order while a bid, less the
+// zone's internal network fee, covers an offer; every match trades at one
+// price, halfway between the last matched bid net of the fee and the last
+// matched offer. Each match becomes a confirmed trade. Unmatched energy
+// stays open for the inter-community round.
+func (e *EnergyTradingContract) ClearIntraCommunity(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (*ClearingRound, error) {
+	intervalStart, intervalEnd, err := openCommunitySlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	roundID := intraRoundID(zone, intervalStart)
+	existing, err := getClearingRound(ctx, roundID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("zone %s has already cleared interval %s", zone, intervalStart)
+	}
+	orders, err := openCommunityOrders(ctx, intervalStart, zone)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBatchSize(ctx, len(orders), "orders"); err != nil {
+		return nil, err
+	}
+	fee, err := zoneFee(ctx, zone, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	round := &ClearingRound{RoundID: roundID, Tier: TierIntraCommunity, Zone: zone, IntervalStart: intervalStart, Matches: []*ClearingMatch{}}
+	bids, offers := bookSides(orders)
+	type pair struct {
+		bid, offer *CommunityOrder
+		energy     float64
+	}
+	var pairs []pair
+	var marginalBid, marginalOffer float64
+	for i, j := 0, 0; i < len(bids) && j < len(offers) && bids[i].LimitPrice-fee >= offers[j].LimitPrice; {
+		energy := math.Min(remaining(bids[i]), remaining(offers[j]))
+		pairs = append(pairs, pair{bids[i], offers[j], energy})
+		marginalBid, marginalOffer = bids[i].LimitPrice-fee, offers[j].LimitPrice
+		bids[i].Filled += energy
+		offers[j].Filled += energy
+		if remaining(bids[i]) <= 1e-9 {
+			i++
+		}
+		if remaining(offers[j]) <= 1e-9 {
+			j++
+		}
+	}
+	if len(pairs) > 0 {
+		round.ClearingPrice = (marginalBid + marginalOffer) / 2
+	}
+	for _, p := range pairs {
+		if err := e.matchCommunityOrders(ctx, round, p.bid, p.offer, p.energy, round.ClearingPrice, fee, intervalEnd); err != nil {
+			return nil, err
+		}
+	}
+	return round, e.closeClearingRound(ctx, round, orders)
+}
+
+// ClearInterCommunity clears the residual orders of an interval across
+// communities, once every community with orders has cleared internally.
+// Bids are served in price order, each from the offers of other zones with
+// the lowest cost including the network fee between the two zones, which is
+// usually higher than within a zone. Each match trades halfway between the
+// bid net of that fee and the offer. Orders in islanded zones do not take
+// part. Every order left open afterwards expires.
+func (e *EnergyTradingContract) ClearInterCommunity(ctx contractapi.TransactionContextInterface, intervalStart string) (*ClearingRound, error) {
+	intervalStart, intervalEnd, err := openCommunitySlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	roundID := interRoundID(intervalStart)
+	existing, err := getClearingRound(ctx, roundID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("interval %s has already been cleared across communities", intervalStart)
+	}
+	orders, err := openCommunityOrders(ctx, intervalStart, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBatchSize(ctx, len(orders), "orders"); err != nil {
+		return nil, err
+	}
+
+	round := &ClearingRound{RoundID: roundID, Tier: TierInterCommunity, IntervalStart: intervalStart, Matches: []*ClearingMatch{}}
+	previousRounds, err := intraClearingRounds(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	islanded := map[string]bool{}
+	for _, previous := range previousRounds {
+		round.PreviousRounds = append(round.PreviousRounds, previous.RoundID)
+		status, err := getZoneStatus(ctx, previous.Zone)
+		if err != nil {
+			return nil, err
+		}
+		islanded[previous.Zone] = status.Islanded
+	}
+	for _, order := range orders {
+		if _, cleared := islanded[order.Zone]; !cleared {
+			return nil, fmt.Errorf("zone %s has not cleared interval %s internally", order.Zone, intervalStart)
+		}
+	}
+
+	fees := map[[2]string]float64{}
+	bids, offers := bookSides(orders)
+	for _, bid := range bids {
+		if islanded[bid.Zone] {
+			continue
+		}
+		for remaining(bid) > 1e-9 {
+			var best *CommunityOrder
+			var bestFee float64
+			for _, offer := range offers {
+				if offer.Zone == bid.Zone || islanded[offer.Zone] || remaining(offer) <= 1e-9 {
+					continue
+				}
+				zones := [2]string{offer.Zone, bid.Zone}
+				fee, ok := fees[zones]
+				if !ok {
+					if fee, err = zoneFee(ctx, offer.Zone, bid.Zone); err != nil {
+						return nil, err
+					}
+					fees[zones] = fee
+				}
+				if offer.LimitPrice+fee > bid.LimitPrice {
+					continue
+				}
+				if best == nil || offer.LimitPrice+fee < best.LimitPrice+bestFee {
+					best, bestFee = offer, fee
+				}
+			}
+			if best == nil {
+				break
+			}
+			energy := math.Min(remaining(bid), remaining(best))
+			bid.Filled += energy
+			best.Filled += energy
+			price := (bid.LimitPrice - bestFee + best.LimitPrice) / 2
+			if err := e.matchCommunityOrders(ctx, round, bid, best, energy, price, bestFee, intervalEnd); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, previous := range previousRounds {
+		previous.NextRound = roundID
+		if err := putClearingRound(ctx, previous); err != nil {
+			return nil, err
+		}
+	}
+	for _, order := range orders {
+		if remaining(order) > 1e-9 {
+			order.Status = OrderExpired
+		}
+	}
+	return round, e.closeClearingRound(ctx, round, orders)
+}
+
+// matchCommunityOrders records the confirmed trade of a match, named after
+// its round
+func (e *EnergyTradingContract) matchCommunityOrders(ctx contractapi.TransactionContextInterface, round *ClearingRound, bid, offer *CommunityOrder, energy, price, fee float64, intervalEnd string) error {
+	tokenID := fmt.Sprintf("%s-%d", round.RoundID, len(round.Matches)+1)
+	if err := requireNewTokenID(ctx, tokenID); err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	privateDetailsHash, err := putPrivateDetails(ctx, bid.Trader, offer.Trader, &TradePrivateDetails{
+		TokenID:          tokenID,
+		TransactionPrice: price,
+		Salt:             ctx.GetStub().GetTxID(),
+	})
+	if err != nil {
+		return err
+	}
+	asset := &EnergyAsset{
+		TokenID:            tokenID,
+		BuyerAddress:       bid.Trader,
+		SellerAddress:      offer.Trader,
+		EnergyAmount:       energy,
+		SourceType:         offer.SourceType,
+		Timestamp:          now,
+		DeliveryStart:      round.IntervalStart,
+		DeliveryEnd:        intervalEnd,
+		ClearingRoundID:    round.RoundID,
+		PrivateDetailsHash: privateDetailsHash,
+	}
+	if err := confirmTrade(ctx, asset, price); err != nil {
+		return fmt.Errorf("failed to confirm trade %s: %v", tokenID, err)
+	}
+	if err := recordTrade(ctx, asset); err != nil {
+		return err
+	}
+	round.Matches = append(round.Matches, &ClearingMatch{
+		TokenID:    tokenID,
+		BidID:      bid.OrderID,
+		OfferID:    offer.OrderID,
+		Buyer:      bid.Trader,
+		Seller:     offer.Trader,
+		BuyerZone:  bid.Zone,
+		SellerZone: offer.Zone,
+		Energy:     energy,
+		Price:      price,
+		NetworkFee: fee,
+	})
+	round.ClearedEnergy += energy
+	return emitEvent(ctx, EventTradeConfirmed, newTradeEvent(asset))
+}
+
+// closeClearingRound stores the orders a round filled or expired and the
+// round itself, with the demand and supply it left unmatched
+func (e *EnergyTradingContract) closeClearingRound(ctx contractapi.TransactionContextInterface, round *ClearingRound, orders []*CommunityOrder) error {
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		if order.Filled == 0 && order.Status == OrderOpen {
+			round.addResidual(order)
+			continue
+		}
+		if remaining(order) <= 1e-9 {
+			order.Status = OrderFilled
+		} else {
+			round.addResidual(order)
+		}
+		if err := putCommunityOrder(ctx, order); err != nil {
+			return err
+		}
+	}
+	round.ClearedBy = caller
+	round.ClearedAt = now
+	if err := putClearingRound(ctx, round); err != nil {
+		return err
+	}
+	indexKey, err := intervalRoundKey(ctx, round)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(indexKey, []byte(round.RoundID)); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventClearingRoundCompleted, round)
+}
+
+func (round *ClearingRound) addResidual(order *CommunityOrder) {
+	if order.Side == OrderBid {
+		round.ResidualDemand += remaining(order)
+	} else {
+		round.ResidualSupply += remaining(order)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// registerZoneParticipant registers and approves a participant in a zone
+func registerZoneParticipant(t testing.TB, e *EnergyTradingContract, tc *testContext, address, role, zone string) {
+	_, err := e.RegisterParticipant(tc.as(address, role), []string{"meter-" + address}, tc.publicKeyPEM(t, address), zone)
+	require.NoError(t, err)
+	require.NoError(t, e.ApproveParticipant(tc.as("admin1", RoleAdmin), address))
+}
+
+func TestCommunityClearing(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerZoneParticipant(t, e, tc, "seller1", RoleProsumer, "zone1")
+	registerZoneParticipant(t, e, tc, "buyer1", RoleConsumer, "zone1")
+	registerZoneParticipant(t, e, tc, "buyer2", RoleConsumer, "zone1")
+	registerZoneParticipant(t, e, tc, "seller2", RoleProsumer, "zone2")
+	tc.as("operator1", RoleOperator)
+	require.NoError(t, e.SetNetworkTariff(tc, "zone1", "zone1", 0.01))
+	require.NoError(t, e.SetNetworkTariff(tc, "zone1", "zone2", 0.05))
+	interval := "2025-05-01T10:00:00Z"
+
+	_, err := e.SubmitCommunityOrder(tc.as("seller1", ""), "s1", "SELL", interval, SourceGrid, 5, 0.1)
+	require.EqualError(t, err, "order side must be BID or OFFER")
+	_, err = e.SubmitCommunityOrder(tc, "s1", OrderOffer, "2025-05-01T07:00:00Z", SourceGrid, 5, 0.1)
+	require.EqualError(t, err, "interval 2025-05-01T07:00:00Z has already started")
+	_, err = e.SubmitCommunityOrder(tc, "s1", OrderOffer, interval, SourceGrid, 5, 0.1)
+	require.NoError(t, err)
+	_, err = e.SubmitCommunityOrder(tc, "s1-bid", OrderBid, interval, "", 1, 0.3)
+	require.EqualError(t, err, "trader seller1 already has a OFFER order for interval 2025-05-01T10:00:00Z")
+	_, err = e.SubmitCommunityOrder(tc.as("buyer1", ""), "b1", OrderBid, interval, "", 3, 0.2)
+	require.NoError(t, err)
+	_, err = e.SubmitCommunityOrder(tc.as("buyer2", ""), "b2", OrderBid, interval, "", 4, 0.16)
+	require.NoError(t, err)
+	_, err = e.SubmitCommunityOrder(tc.as("seller2", ""), "s2", OrderOffer, interval, SourceGrid, 6, 0.08)
+	require.NoError(t, err)
+
+	// Within zone1 the seller covers buyer1 and half of buyer2, at the price
+	// between buyer2's bid net of the 0.01 fee and the seller's offer
+	intra1, err := e.ClearIntraCommunity(tc.as("operator1", RoleOperator), "zone1", interval)
+	require.NoError(t, err)
+	require.InDelta(t, 0.125, intra1.ClearingPrice, 1e-9)
+	require.InDelta(t, 5, intra1.ClearedEnergy, 1e-9)
+	require.Len(t, intra1.Matches, 2)
+	require.InDelta(t, 2, intra1.ResidualDemand, 1e-9)
+	require.Zero(t, intra1.ResidualSupply)
+	_, err = e.ClearIntraCommunity(tc, "zone1", interval)
+	require.EqualError(t, err, "zone zone1 has already cleared interval 2025-05-01T10:00:00Z")
+	_, err = e.SubmitCommunityOrder(tc.as("buyer1", ""), "b1-late", OrderBid, interval, "", 1, 0.2)
+	require.EqualError(t, err, "zone zone1 has already cleared interval 2025-05-01T10:00:00Z")
+
+	_, err = e.ClearInterCommunity(tc.as("operator1", RoleOperator), interval)
+	require.EqualError(t, err, "zone zone2 has not cleared interval 2025-05-01T10:00:00Z internally")
+	intra2, err := e.ClearIntraCommunity(tc, "zone2", interval)
+	require.NoError(t, err)
+	require.Empty(t, intra2.Matches)
+	require.InDelta(t, 6, intra2.ResidualSupply, 1e-9)
+
+	// buyer2's residual is served from zone2 at the higher fee between zones
+	inter, err := e.ClearInterCommunity(tc, interval)
+	require.NoError(t, err)
+	require.Equal(t, []string{intra1.RoundID, intra2.RoundID}, inter.PreviousRounds)
+	require.Len(t, inter.Matches, 1)
+	match := inter.Matches[0]
+	require.Equal(t, "b2", match.BidID)
+	require.Equal(t, "s2", match.OfferID)
+	require.InDelta(t, 2, match.Energy, 1e-9)
+	require.InDelta(t, 0.095, match.Price, 1e-9)
+	require.InDelta(t, 0.05, match.NetworkFee, 1e-9)
+	require.Zero(t, inter.ResidualDemand)
+	require.InDelta(t, 4, inter.ResidualSupply, 1e-9)
+
+	asset, err := e.ReadEnergyAsset(tc, match.TokenID)
+	require.NoError(t, err)
+	require.Equal(t, StateConfirmed, asset.TransactionState)
+	require.Equal(t, inter.RoundID, asset.ClearingRoundID)
+	require.InDelta(t, 0.05, asset.NetworkFeeRate, 1e-9)
+
+	rounds, err := e.GetClearingRounds(tc, interval, 2, "")
+	require.NoError(t, err)
+	require.Len(t, rounds.Records, 2)
+	require.Equal(t, inter.RoundID, rounds.Records[0].NextRound)
+	rounds, err = e.GetClearingRounds(tc, interval, 2, rounds.Bookmark)
+	require.NoError(t, err)
+	require.Len(t, rounds.Records, 1)
+	require.Equal(t, inter.RoundID, rounds.Records[0].RoundID)
+	for orderID, status := range map[string]string{"s1": OrderFilled, "b1": OrderFilled, "b2": OrderFilled, "s2": OrderExpired} {
+		order, err := e.GetCommunityOrder(tc, orderID)
+		require.NoError(t, err)
+		require.Equal(t, status, order.Status, orderID)
+	}
+	_, err = e.ClearInterCommunity(tc, interval)
+	require.EqualError(t, err, "interval 2025-05-01T10:00:00Z has already been cleared across communities")
+}
+
+func TestCancelCommunityOrder(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	_, err := e.SubmitCommunityOrder(tc.as("buyer1", ""), "b1", OrderBid, "2025-05-01T10:00:00Z", "", 3, 0.2)
+	require.NoError(t, err)
+	orders, err := e.GetOpenCommunityOrders(tc, "2025-05-01T10:00:00Z", "zone1", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, orders.Records, 1)
+	_, err = e.CancelCommunityOrder(tc.as("seller1", ""), "b1")
+	require.EqualError(t, err, "caller seller1 is not authorized to act for buyer1")
+	order, err := e.CancelCommunityOrder(tc.as("buyer1", ""), "b1")
+	require.NoError(t, err)
+	require.Equal(t, OrderCancelled, order.Status)
+	_, err = e.CancelCommunityOrder(tc, "b1")
+	require.EqualError(t, err, "order b1 is CANCELLED")
+	orders, err = e.GetOpenCommunityOrders(tc, "2025-05-01T10:00:00Z", "", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Empty(t, orders.Records)
+
+	round, err := e.ClearIntraCommunity(tc.as("operator1", RoleOperator), "zone1", "2025-05-01T10:00:00Z")
+	require.NoError(t, err)
+	require.Empty(t, round.Matches)
+	require.Zero(t, round.ResidualDemand)
+}
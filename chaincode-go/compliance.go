@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ComplianceTrade is one trade line of a compliance report. Price is the
+// private transaction price, which only the regulator receives.
+type ComplianceTrade struct {
+	TokenID         string  `json:"tokenID"`
+	Buyer           string  `json:"buyer"`
+	Seller          string  `json:"seller"`
+	SourceType      string  `json:"sourceType"`
+	DeliveryStart   string  `json:"deliveryStart"`
+	DeliveryEnd     string  `json:"deliveryEnd"`
+	State           string  `json:"state"`
+	EnergyAmount    float64 `json:"energyAmount"`
+	DeliveredEnergy float64 `json:"deliveredEnergy"`
+	Price           float64 `json:"price"`
+}
+
+// ComplianceReport assembles the market activity of the half-open window
+// [From, To) for the regulator: the trades delivering in it, their imbalance
+// records, and the certificates retired in it. CSV holds the trade lines in
+// the same order. Hash is the SHA-256 of the report's canonical JSON with Hash
+// left empty; only the hash is committed to the ledger.
+type ComplianceReport struct {
+	ReportID               string             `json:"reportID"`
+	From                   string             `json:"from"`
+	To                     string             `json:"to"`
+	GeneratedBy            string             `json:"generatedBy"`
+	GeneratedAt            string             `json:"generatedAt"`
+	TradeCount             int                `json:"tradeCount"`
+	TotalVolume            float64            `json:"totalVolume"`
+	DeliveredVolume        float64            `json:"deliveredVolume"`
+	AveragePrice           float64            `json:"averagePrice"`
+	Trades                 []*ComplianceTrade `json:"trades"`
+	Imbalances             []*ImbalanceRecord `json:"imbalances"`
+	CertificateRetirements []*Certificate     `json:"certificateRetirements"`
+	CSV                    string             `json:"csv"`
+	Hash                   string             `json:"hash"`
+}
+
+// ComplianceReportRecord is the on-chain commitment to a generated report
+type ComplianceReportRecord struct {
+	ReportID    string `json:"reportID"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Hash        string `json:"hash"`
+	GeneratedBy string `json:"generatedBy"`
+	GeneratedAt string `json:"generatedAt"`
+}
+
+var complianceCSVHeader = []string{"tokenID", "buyer", "seller", "sourceType", "deliveryStart", "deliveryEnd", "state", "energyAmount", "deliveredEnergy", "price"}
+
+func complianceReportKey(ctx contractapi.TransactionContextInterface, reportID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("compliancereport", []string{reportID})
+}
+
+// GenerateComplianceReport assembles the compliance report of a window,
+// commits its hash under the transaction ID and returns the full report to
+// the regulator
+func (e *EnergyTradingContract) GenerateComplianceReport(ctx contractapi.TransactionContextInterface, from, to string) (*ComplianceReport, error) {
+	from, err := normalizeTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	to, err = normalizeTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	if from >= to {
+		return nil, fmt.Errorf("report window start %s must be before end %s", from, to)
+	}
+	regulator, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ComplianceReport{
+		ReportID:               ctx.GetStub().GetTxID(),
+		From:                   from,
+		To:                     to,
+		GeneratedBy:            regulator,
+		GeneratedAt:            now,
+		Trades:                 []*ComplianceTrade{},
+		Imbalances:             []*ImbalanceRecord{},
+		CertificateRetirements: []*Certificate{},
+	}
+	if err := e.addComplianceTrades(ctx, report); err != nil {
+		return nil, err
+	}
+	if err := addComplianceRetirements(ctx, report); err != nil {
+		return nil, err
+	}
+	if report.CSV, err = complianceCSV(report.Trades); err != nil {
+		return nil, err
+	}
+
+	reportJSON, err := canonicalJSON(report)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(reportJSON)
+	report.Hash = hex.EncodeToString(digest[:])
+
+	record := ComplianceReportRecord{
+		ReportID:    report.ReportID,
+		From:        from,
+		To:          to,
+		Hash:        report.Hash,
+		GeneratedBy: regulator,
+		GeneratedAt: now,
+	}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	key, err := complianceReportKey(ctx, report.ReportID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, recordJSON); err != nil {
+		return nil, err
+	}
+	return report, emitEvent(ctx, EventComplianceReportGenerated, record)
+}
+
+// addComplianceTrades adds the live and archived trades delivering in the
+// report window, with the imbalance records of each
+func (e *EnergyTradingContract) addComplianceTrades(ctx contractapi.TransactionContextInterface, report *ComplianceReport) error {
+	var value float64
+	for _, prefix := range []string{deliveryIndexPrefix, archiveIndexPrefix} {
+		resultsIterator, err := ctx.GetStub().GetStateByRange(prefix+report.From, prefix+report.To)
+		if err != nil {
+			return err
+		}
+		defer resultsIterator.Close()
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				return err
+			}
+			asset, err := e.ReadEnergyAsset(ctx, string(queryResponse.Value))
+			if err != nil {
+				return err
+			}
+			details, err := getPrivateDetails(ctx, asset)
+			if err != nil {
+				return err
+			}
+			trade := &ComplianceTrade{
+				TokenID:       asset.TokenID,
+				Buyer:         asset.BuyerAddress,
+				Seller:        asset.SellerAddress,
+				SourceType:    asset.SourceType,
+				DeliveryStart: asset.DeliveryStart,
+				DeliveryEnd:   asset.DeliveryEnd,
+				State:         asset.TransactionState,
+				EnergyAmount:  asset.EnergyAmount,
+				Price:         details.TransactionPrice,
+			}
+			if asset.TransactionState == StateSettled {
+				settlement, err := e.GetSettlement(ctx, asset.TokenID)
+				if err != nil {
+					return err
+				}
+				trade.DeliveredEnergy = settlement.DeliveredEnergy
+				for _, participant := range []string{asset.SellerAddress, asset.BuyerAddress} {
+					if err := addComplianceImbalances(ctx, report, participant, asset); err != nil {
+						return err
+					}
+				}
+			}
+			report.Trades = append(report.Trades, trade)
+			report.TotalVolume += trade.EnergyAmount
+			report.DeliveredVolume += trade.DeliveredEnergy
+			value += trade.EnergyAmount * trade.Price
+		}
+	}
+	sort.SliceStable(report.Trades, func(i, j int) bool {
+		if report.Trades[i].DeliveryStart != report.Trades[j].DeliveryStart {
+			return report.Trades[i].DeliveryStart < report.Trades[j].DeliveryStart
+		}
+		return report.Trades[i].TokenID < report.Trades[j].TokenID
+	})
+	report.TradeCount = len(report.Trades)
+	if report.TotalVolume > 0 {
+		report.AveragePrice = value / report.TotalVolume
+	}
+	return nil
+}
+
+// addComplianceImbalances adds a participant's imbalance records for a trade
+func addComplianceImbalances(ctx contractapi.TransactionContextInterface, report *ComplianceReport, participant string, asset *EnergyAsset) error {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("imbalance", []string{participant})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		var record ImbalanceRecord
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			return err
+		}
+		if record.TokenID == asset.TokenID {
+			report.Imbalances = append(report.Imbalances, &record)
+		}
+	}
+	return nil
+}
+
+// addComplianceRetirements adds the certificates retired in the report window
+func addComplianceRetirements(ctx contractapi.TransactionContextInterface, report *ComplianceReport) error {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("certificate", []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		var certificate Certificate
+		if err := json.Unmarshal(queryResponse.Value, &certificate); err != nil {
+			return err
+		}
+		if certificate.Status != CertificateRetired {
+			continue
+		}
+		retiredAt, err := normalizeTimestamp(certificate.RetiredAt)
+		if err != nil {
+			return err
+		}
+		if retiredAt >= report.From && retiredAt < report.To {
+			report.CertificateRetirements = append(report.CertificateRetirements, &certificate)
+		}
+	}
+	return nil
+}
+
+// complianceCSV renders the trade lines of a report as CSV
+func complianceCSV(trades []*ComplianceTrade) (string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(complianceCSVHeader); err != nil {
+		return "", err
+	}
+	formatFloat := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	for _, trade := range trades {
+		row := []string{
+			trade.TokenID, trade.Buyer, trade.Seller, trade.SourceType, trade.DeliveryStart, trade.DeliveryEnd, trade.State,
+			formatFloat(trade.EnergyAmount), formatFloat(trade.DeliveredEnergy), formatFloat(trade.Price),
+		}
+		if err := w.Write(row); err != nil {
+			return "", err
+		}
+	}
+	w.Flush()
+	return buf.String(), w.Error()
+}
+
+// GetComplianceReportRecord returns the on-chain commitment to a generated
+// compliance report, against which a copy of the report can be verified
+func (e *EnergyTradingContract) GetComplianceReportRecord(ctx contractapi.TransactionContextInterface, reportID string) (*ComplianceReportRecord, error) {
+	key, err := complianceReportKey(ctx, reportID)
+	if err != nil {
+		return nil, err
+	}
+	recordJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compliance report %s: %v", reportID, err)
+	}
+	if recordJSON == nil {
+		return nil, fmt.Errorf("compliance report %s does not exist", reportID)
+	}
+	var record ComplianceReportRecord
+	if err := json.Unmarshal(recordJSON, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestComplianceReport(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	createTestAsset(t, e, tc, "energy2")
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	require.NoError(t, e.SetCertificateEnergy(tc, 5))
+	_, err := e.RegisterGenerator(tc.as("seller1", ""), meterID, "solar", 10)
+	require.NoError(t, err)
+	_, err = e.VerifyGenerator(tc.as("operator1", RoleOperator), meterID)
+	require.NoError(t, err)
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	_, err = e.ReconcileDelivery(tc.as("buyer1", ""), "energy1")
+	require.NoError(t, err)
+	_, err = e.RetireCertificate(tc.as("seller1", ""), meterID+"-1", "seller1")
+	require.NoError(t, err)
+
+	tc.stub.GetTxIDReturns("tx-report")
+	_, err = e.GenerateComplianceReport(tc.as("regulator1", RoleRegulator), "2025-05-04T00:00:00Z", "2025-05-03T00:00:00Z")
+	require.EqualError(t, err, "report window start 2025-05-04T00:00:00Z must be before end 2025-05-03T00:00:00Z")
+	report, err := e.GenerateComplianceReport(tc, "2025-05-03T00:00:00Z", "2025-05-04T00:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 2, report.TradeCount)
+	require.Equal(t, 20.0, report.TotalVolume)
+	require.Equal(t, 8.0, report.DeliveredVolume)
+	require.InDelta(t, 0.2, report.AveragePrice, 1e-9)
+	require.Equal(t, "energy1", report.Trades[0].TokenID)
+	require.Equal(t, StateCreated, report.Trades[1].State)
+	require.Len(t, report.Imbalances, 8)
+	require.Len(t, report.CertificateRetirements, 1)
+	lines := strings.Split(strings.TrimSpace(report.CSV), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, "energy1,buyer1,seller1,grid,2025-05-03T10:00:00Z,2025-05-03T11:00:00Z,SETTLED,10,8,0.2", lines[1])
+
+	// The committed hash verifies the report
+	record, err := e.GetComplianceReportRecord(tc, "tx-report")
+	require.NoError(t, err)
+	require.Equal(t, report.Hash, record.Hash)
+	unhashed := *report
+	unhashed.Hash = ""
+	reportJSON, err := canonicalJSON(unhashed)
+	require.NoError(t, err)
+	digest := sha256.Sum256(reportJSON)
+	require.Equal(t, hex.EncodeToString(digest[:]), record.Hash)
+
+	report, err = e.GenerateComplianceReport(tc, "2025-05-04T00:00:00Z", "2025-05-05T00:00:00Z")
+	require.NoError(t, err)
+	require.Empty(t, report.Trades)
+	require.Empty(t, report.CertificateRetirements)
+}
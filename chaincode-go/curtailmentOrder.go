@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// curtailmentPolicyKey holds the single compensation policy
+const curtailmentPolicyKey = "curtailmentpolicy"
+
+// curtailmentTolerance absorbs rounding when a trade is curtailed in full
+const curtailmentTolerance = 1e-9
+
+// CurtailmentPolicy sets what the grid operator pays, in tokens per curtailed
+// kWh, to the seller and the buyer of a trade it curtails by order. Until a
+// policy is set, curtailment is not compensated.
+type CurtailmentPolicy struct {
+	SellerRate float64 `json:"sellerRate"`
+	BuyerRate  float64 `json:"buyerRate"`
+	UpdatedBy  string  `json:"updatedBy"`
+	UpdatedAt  string  `json:"updatedAt"`
+}
+
+// CurtailmentOrder is a grid operator instruction to remove energy from the
+// trades delivering in a zone during one meter interval
+type CurtailmentOrder struct {
+	OrderID         string   `json:"orderID"`
+	Zone            string   `json:"zone"`
+	IntervalStart   string   `json:"intervalStart"`
+	Requested       float64  `json:"requested"`
+	CurtailedEnergy float64  `json:"curtailedEnergy"`
+	Compensation    float64  `json:"compensation"`
+	Trades          []string `json:"trades"`
+	Operator        string   `json:"operator"`
+	IssuedAt        string   `json:"issuedAt"`
+}
+
+func curtailmentOrderKey(ctx contractapi.TransactionContextInterface, zone, intervalStart, orderID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("curtailmentorder", []string{zone, intervalStart, orderID})
+}
+
+// SetCurtailmentPolicy sets the compensation paid for curtailment orders issued afterwards
+func (e *EnergyTradingContract) SetCurtailmentPolicy(ctx contractapi.TransactionContextInterface, sellerRate, buyerRate float64) error {
+	if sellerRate < 0 || buyerRate < 0 {
+		return fmt.Errorf("compensation rates must not be negative")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	policy := CurtailmentPolicy{SellerRate: sellerRate, BuyerRate: buyerRate, UpdatedBy: caller, UpdatedAt: now}
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(curtailmentPolicyKey, policyJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventCurtailmentPolicySet, policy)
+}
+
+// GetCurtailmentPolicy returns the compensation policy in force
+func (e *EnergyTradingContract) GetCurtailmentPolicy(ctx contractapi.TransactionContextInterface) (*CurtailmentPolicy, error) {
+	policyJSON, err := ctx.GetStub().GetState(curtailmentPolicyKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read curtailment policy: %v", err)
+	}
+	if policyJSON == nil {
+		return &CurtailmentPolicy{}, nil
+	}
+	var policy CurtailmentPolicy
+	if err := json.Unmarshal(policyJSON, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// IssueCurtailmentOrder removes reduction kWh from the unsettled trades that a
+// party in zone delivers or receives during the meter interval starting at
+// intervalStart. Every trade loses the same fraction of its energy in the
+// interval; when reduction covers all of it, the trades lose their whole
+// share of the interval, and trades left with no energy are cancelled. The
+// grid operator compensates both parties of each trade under the curtailment
+// policy.
+func (e *EnergyTradingContract) IssueCurtailmentOrder(ctx contractapi.TransactionContextInterface, zone, intervalStart string, reduction float64) (*CurtailmentOrder, error) {
+	if reduction <= 0 {
+		return nil, fmt.Errorf("curtailment must be positive")
+	}
+	intervalStart, length, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseTimestamp(intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(start.Add(length)) {
+		return nil, fmt.Errorf("interval %s has already ended", intervalStart)
+	}
+	operator, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := e.GetCurtailmentPolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type affectedTrade struct {
+		asset   *EnergyAsset
+		portion float64
+	}
+	affected := []affectedTrade{}
+	total := 0.0
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("zonetrade", []string{zone, intervalStart})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		asset, err := e.ReadEnergyAsset(ctx, string(queryResponse.Value))
+		if err != nil {
+			return nil, err
+		}
+		if asset.TransactionState != StateConfirmed && asset.TransactionState != StateDelivered {
+			continue
+		}
+		curtailments, err := getCurtailments(ctx, asset.TokenID)
+		if err != nil {
+			return nil, err
+		}
+		portion, err := intervalScheduledEnergy(ctx, asset, curtailments, intervalStart)
+		if err != nil {
+			return nil, err
+		}
+		if portion > curtailmentTolerance {
+			affected = append(affected, affectedTrade{asset, portion})
+			total += portion
+		}
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no trades are scheduled in zone %s for %s", zone, intervalStart)
+	}
+
+	fraction := math.Min(1, reduction/total)
+	order := &CurtailmentOrder{
+		OrderID:       ctx.GetStub().GetTxID(),
+		Zone:          zone,
+		IntervalStart: intervalStart,
+		Requested:     reduction,
+		Trades:        []string{},
+		Operator:      operator,
+		IssuedAt:      now.Format(time.RFC3339),
+	}
+	for _, trade := range affected {
+		asset := trade.asset
+		curtailed := trade.portion * fraction
+		asset.CurtailedEnergy += curtailed
+		if scheduledEnergy(asset) <= curtailmentTolerance {
+			asset.CurtailedEnergy = asset.EnergyAmount
+			asset.TransactionState = StateCancelled
+		}
+		if err := releaseZoneFlows(ctx, asset, intervalStart, curtailed); err != nil {
+			return nil, err
+		}
+		compensation := curtailed * (policy.SellerRate + policy.BuyerRate)
+		if err := settleWithGrid(ctx, asset.SellerAddress, curtailed*policy.SellerRate); err != nil {
+			return nil, err
+		}
+		if err := settleWithGrid(ctx, asset.BuyerAddress, curtailed*policy.BuyerRate); err != nil {
+			return nil, err
+		}
+		if err := putEnergyAsset(ctx, asset); err != nil {
+			return nil, err
+		}
+		if err := putCurtailment(ctx, &Curtailment{
+			TokenID:         asset.TokenID,
+			Reason:          CurtailmentOrdered,
+			Zone:            zone,
+			IntervalStart:   intervalStart,
+			CurtailedEnergy: curtailed,
+			Compensation:    compensation,
+			RecordedAt:      order.IssuedAt,
+			TxID:            order.OrderID,
+		}); err != nil {
+			return nil, err
+		}
+		if err := emitEvent(ctx, EventTradeCurtailed, newTradeEvent(asset)); err != nil {
+			return nil, err
+		}
+		order.CurtailedEnergy += curtailed
+		order.Compensation += compensation
+		order.Trades = append(order.Trades, asset.TokenID)
+	}
+
+	orderJSON, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	key, err := curtailmentOrderKey(ctx, zone, intervalStart, order.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, orderJSON); err != nil {
+		return nil, err
+	}
+	return order, emitEvent(ctx, EventCurtailmentOrdered, order)
+}
+
+// PaginatedCurtailmentOrderResult is a page of curtailment orders
+type PaginatedCurtailmentOrderResult struct {
+	Records             []*CurtailmentOrder `json:"records"`
+	FetchedRecordsCount int32               `json:"fetchedRecordsCount"`
+	Bookmark            string              `json:"bookmark"`
+}
+
+// GetCurtailmentOrders returns a page of the orders issued for a zone and
+// meter interval
+func (e *EnergyTradingContract) GetCurtailmentOrders(ctx contractapi.TransactionContextInterface, zone, intervalStart string, pageSize int32, bookmark string) (*PaginatedCurtailmentOrderResult, error) {
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedCurtailmentOrderResult{Records: []*CurtailmentOrder{}}
+	metadata, err := queryPage(ctx, "curtailmentorder", []string{zone, intervalStart}, pageSize, bookmark, func(value []byte) error {
+		var order CurtailmentOrder
+		if err := json.Unmarshal(value, &order); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &order)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// intervalScheduledEnergy returns the energy a trade still delivers in one
+// meter interval. Congestion curtails the trade evenly across its window,
+// while an order only curtails the interval it was issued for.
+func intervalScheduledEnergy(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, curtailments []*Curtailment, intervalStart string) (float64, error) {
+	intervals, err := deliveryIntervals(ctx, asset)
+	if err != nil {
+		return 0, err
+	}
+	share := 0.0
+	for _, interval := range intervals {
+		if interval.start == intervalStart {
+			share = interval.share
+		}
+	}
+	if share == 0 {
+		return 0, nil
+	}
+	energy := asset.EnergyAmount * share
+	for _, curtailment := range curtailments {
+		switch {
+		case curtailment.Reason == CurtailmentCongestion:
+			energy -= curtailment.CurtailedEnergy * share
+		case curtailment.IntervalStart == intervalStart:
+			energy -= curtailment.CurtailedEnergy
+		}
+	}
+	return math.Max(0, energy), nil
+}
+
+// releaseZoneFlows removes curtailed energy of a trade from its zones'
+// transformer loads and, for a trade between two zones, from the zones'
+// scheduled flows in one interval
+func releaseZoneFlows(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, intervalStart string, energy float64) error {
+	seller, err := getParticipant(ctx, asset.SellerAddress)
+	if err != nil {
+		return err
+	}
+	buyer, err := getParticipant(ctx, asset.BuyerAddress)
+	if err != nil {
+		return err
+	}
+	if seller == nil || buyer == nil {
+		return nil
+	}
+	if err := addTransformerLoad(ctx, seller.Zone, intervalStart, asset.TokenID, -energy); err != nil {
+		return err
+	}
+	if seller.Zone == buyer.Zone {
+		return nil
+	}
+	if err := addTransformerLoad(ctx, buyer.Zone, intervalStart, asset.TokenID, -energy); err != nil {
+		return err
+	}
+	exports, err := getZoneFlow(ctx, seller.Zone, intervalStart)
+	if err != nil {
+		return err
+	}
+	exports.Export = math.Max(0, exports.Export-energy)
+	if err := putZoneFlow(ctx, exports); err != nil {
+		return err
+	}
+	imports, err := getZoneFlow(ctx, buyer.Zone, intervalStart)
+	if err != nil {
+		return err
+	}
+	imports.Import = math.Max(0, imports.Import-energy)
+	return putZoneFlow(ctx, imports)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCurtailmentOrder(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	confirmTestAsset(t, e, tc, "energy1")
+	confirmTestAsset(t, e, tc, "energy2")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 10))
+	err := e.SetCurtailmentPolicy(tc, -1, 0)
+	require.EqualError(t, err, "compensation rates must not be negative")
+	require.NoError(t, e.SetCurtailmentPolicy(tc, 0.1, 0.05))
+
+	tc.as("operator1", RoleOperator)
+	_, err = e.IssueCurtailmentOrder(tc, "zone1", "2025-05-01T07:45:00Z", 1)
+	require.EqualError(t, err, "interval 2025-05-01T07:45:00Z has already ended")
+	_, err = e.IssueCurtailmentOrder(tc, "zone9", "2025-05-03T10:00:00Z", 1)
+	require.EqualError(t, err, "no trades are scheduled in zone zone9 for 2025-05-03T10:00:00Z")
+
+	// Both trades schedule 2.5 kWh in the interval; each loses 1 kWh
+	order, err := e.IssueCurtailmentOrder(tc, "zone1", "2025-05-03T10:00:00Z", 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"energy1", "energy2"}, order.Trades)
+	require.InDelta(t, 2, order.CurtailedEnergy, 1e-9)
+	require.InDelta(t, 0.3, order.Compensation, 1e-9)
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventCurtailmentOrdered, name)
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.InDelta(t, 1, asset.CurtailedEnergy, 1e-9)
+	require.Equal(t, StateConfirmed, asset.TransactionState)
+	seller, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 10.2, seller.Balance, 1e-9)
+	buyer, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 10.1, buyer.Balance, 1e-9)
+
+	curtailments, err := e.GetCurtailments(tc, "energy2", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, curtailments.Records, 1)
+	require.Equal(t, CurtailmentOrdered, curtailments.Records[0].Reason)
+	orders, err := e.GetCurtailmentOrders(tc, "zone1", "2025-05-03T10:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, orders.Records, 1)
+
+	// Curtailing every interval in full cancels the trades
+	for _, interval := range []string{"2025-05-03T10:00:00Z", "2025-05-03T10:15:00Z", "2025-05-03T10:30:00Z", "2025-05-03T10:45:00Z"} {
+		_, err = e.IssueCurtailmentOrder(tc, "zone1", interval, 100)
+		require.NoError(t, err)
+	}
+	asset, err = e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, StateCancelled, asset.TransactionState)
+	require.Equal(t, 10.0, asset.CurtailedEnergy)
+	_, err = e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.EqualError(t, err, "asset energy1 cannot be settled in state CANCELLED")
+	_, err = e.IssueCurtailmentOrder(tc.as("operator1", RoleOperator), "zone1", "2025-05-03T10:00:00Z", 1)
+	require.EqualError(t, err, "no trades are scheduled in zone zone1 for 2025-05-03T10:00:00Z")
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Delegation scopes
+const (
+	ScopeCreateTrade = "CREATE_TRADE"
+	ScopeSignTrade   = "SIGN_TRADE"
+)
+
+// TradingAuthorization lets a delegate (an aggregator) act for a principal
+// within the granted scopes until the expiry. MaxEnergyAmount limits the size
+// of each trade the delegate may create; zero means no limit.
+type TradingAuthorization struct {
+	Principal       string   `json:"principal"`
+	Delegate        string   `json:"delegate"`
+	Scope           []string `json:"scope"`
+	MaxEnergyAmount float64  `json:"maxEnergyAmount"`
+	Expiry          string   `json:"expiry"`
+	GrantedAt       string   `json:"grantedAt"`
+	Revoked         bool     `json:"revoked"`
+}
+
+// DelegatedAction records an action a delegate performed for a principal
+type DelegatedAction struct {
+	Principal string `json:"principal"`
+	Delegate  string `json:"delegate"`
+	Scope     string `json:"scope"`
+	TokenID   string `json:"tokenID"`
+	TxID      string `json:"txID"`
+	Timestamp string `json:"timestamp"`
+}
+
+func authorizationKey(ctx contractapi.TransactionContextInterface, principal, delegate string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("delegation", []string{principal, delegate})
+}
+
+func getAuthorization(ctx contractapi.TransactionContextInterface, principal, delegate string) (*TradingAuthorization, error) {
+	key, err := authorizationKey(ctx, principal, delegate)
+	if err != nil {
+		return nil, err
+	}
+	authJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorization: %v", err)
+	}
+	if authJSON == nil {
+		return nil, nil
+	}
+	var auth TradingAuthorization
+	if err := json.Unmarshal(authJSON, &auth); err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
+func putAuthorization(ctx contractapi.TransactionContextInterface, auth *TradingAuthorization) error {
+	authJSON, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+	key, err := authorizationKey(ctx, auth.Principal, auth.Delegate)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, authJSON)
+}
+
+// GrantTradingAuthorization authorizes a registered aggregator to act for the
+// caller within scope until expiry (RFC3339).
+func (e *EnergyTradingContract) GrantTradingAuthorization(ctx contractapi.TransactionContextInterface, delegate string, scope []string, maxEnergyAmount float64, expiry string) error {
+	principal, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := requireApprovedParticipant(ctx, principal); err != nil {
+		return err
+	}
+	record, err := getRoleRecord(ctx, delegate)
+	if err != nil {
+		return err
+	}
+	if record == nil || record.Role != RoleAggregator {
+		return fmt.Errorf("delegate %s is not a registered aggregator", delegate)
+	}
+	if len(scope) == 0 {
+		return fmt.Errorf("scope must not be empty")
+	}
+	for _, s := range scope {
+		if s != ScopeCreateTrade && s != ScopeSignTrade {
+			return fmt.Errorf("unknown scope %s", s)
+		}
+	}
+	if maxEnergyAmount < 0 {
+		return fmt.Errorf("max energy amount must not be negative")
+	}
+	expiryTime, err := parseTimestamp(expiry)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	if !expiryTime.After(now) {
+		return fmt.Errorf("expiry %s is not in the future", expiry)
+	}
+
+	err = putAuthorization(ctx, &TradingAuthorization{
+		Principal:       principal,
+		Delegate:        delegate,
+		Scope:           scope,
+		MaxEnergyAmount: maxEnergyAmount,
+		Expiry:          expiryTime.Format(time.RFC3339),
+		GrantedAt:       now.Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventAuthorizationChanged, ParticipantEvent{Address: principal, Status: "GRANTED", Subject: delegate})
+}
+
+// RevokeTradingAuthorization withdraws the caller's authorization of a delegate
+func (e *EnergyTradingContract) RevokeTradingAuthorization(ctx contractapi.TransactionContextInterface, delegate string) error {
+	principal, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	auth, err := getAuthorization(ctx, principal, delegate)
+	if err != nil {
+		return err
+	}
+	if auth == nil {
+		return fmt.Errorf("%s has not authorized %s", principal, delegate)
+	}
+	auth.Revoked = true
+	if err := putAuthorization(ctx, auth); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventAuthorizationChanged, ParticipantEvent{Address: principal, Status: "REVOKED", Subject: delegate})
+}
+
+// GetTradingAuthorization returns the authorization a principal granted a delegate
+func (e *EnergyTradingContract) GetTradingAuthorization(ctx contractapi.TransactionContextInterface, principal, delegate string) (*TradingAuthorization, error) {
+	auth, err := getAuthorization(ctx, principal, delegate)
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		return nil, fmt.Errorf("%s has not authorized %s", principal, delegate)
+	}
+	return auth, nil
+}
+
+// PaginatedDelegatedActionResult is a page of delegated actions
+type PaginatedDelegatedActionResult struct {
+	Records             []*DelegatedAction `json:"records"`
+	FetchedRecordsCount int32              `json:"fetchedRecordsCount"`
+	Bookmark            string             `json:"bookmark"`
+}
+
+// GetDelegatedActions returns a page of the actions taken on behalf of a
+// principal
+func (e *EnergyTradingContract) GetDelegatedActions(ctx contractapi.TransactionContextInterface, principal string, pageSize int32, bookmark string) (*PaginatedDelegatedActionResult, error) {
+	result := &PaginatedDelegatedActionResult{Records: []*DelegatedAction{}}
+	metadata, err := queryPage(ctx, "delegatedaction", []string{principal}, pageSize, bookmark, func(value []byte) error {
+		var action DelegatedAction
+		if err := json.Unmarshal(value, &action); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &action)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// authorizationAllows reports whether an authorization is live and covers the action
+func authorizationAllows(ctx contractapi.TransactionContextInterface, auth *TradingAuthorization, scope string, energyAmount float64) (bool, error) {
+	if auth == nil || auth.Revoked || !hasRole(auth.Scope, scope) {
+		return false, nil
+	}
+	if auth.MaxEnergyAmount > 0 && energyAmount > auth.MaxEnergyAmount {
+		return false, nil
+	}
+	expiry, err := parseTimestamp(auth.Expiry)
+	if err != nil {
+		return false, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return false, err
+	}
+	return now.Before(expiry), nil
+}
+
+// actFor returns the party the caller acts for: the caller itself when it is
+// one of the parties, otherwise the first party that has authorized the caller
+// for the scope. Delegated actions are recorded for audit.
+func actFor(ctx contractapi.TransactionContextInterface, scope, tokenID string, energyAmount float64, parties ...string) (string, error) {
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return "", err
+	}
+	if hasRole(parties, caller) {
+		return caller, nil
+	}
+
+	for _, party := range parties {
+		auth, err := getAuthorization(ctx, party, caller)
+		if err != nil {
+			return "", err
+		}
+		allowed, err := authorizationAllows(ctx, auth, scope, energyAmount)
+		if err != nil {
+			return "", err
+		}
+		if !allowed {
+			continue
+		}
+		if err := recordDelegatedAction(ctx, party, caller, scope, tokenID); err != nil {
+			return "", err
+		}
+		return party, nil
+	}
+	return "", fmt.Errorf("caller %s is not a party to this trade", caller)
+}
+
+func recordDelegatedAction(ctx contractapi.TransactionContextInterface, principal, delegate, scope, tokenID string) error {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	txID := ctx.GetStub().GetTxID()
+	action := DelegatedAction{
+		Principal: principal,
+		Delegate:  delegate,
+		Scope:     scope,
+		TokenID:   tokenID,
+		TxID:      txID,
+		Timestamp: now,
+	}
+	actionJSON, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey("delegatedaction", []string{principal, txID, scope})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, actionJSON)
+}
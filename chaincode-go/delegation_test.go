@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelegatedTrading(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "agg1", RoleAggregator)
+
+	err := e.GrantTradingAuthorization(tc.as("seller1", ""), "buyer1", []string{ScopeCreateTrade}, 0, "2025-06-01T00:00:00Z")
+	require.EqualError(t, err, "delegate buyer1 is not a registered aggregator")
+	err = e.GrantTradingAuthorization(tc, "agg1", []string{ScopeCreateTrade}, 0, "2025-04-01T00:00:00Z")
+	require.EqualError(t, err, "expiry 2025-04-01T00:00:00Z is not in the future")
+
+	err = e.CreateEnergyAsset(tc.as("agg1", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "caller agg1 is not a party to this trade")
+
+	_, err = e.GetTradingAuthorization(tc, "seller1", "agg1")
+	require.EqualError(t, err, "seller1 has not authorized agg1")
+	require.NoError(t, e.GrantTradingAuthorization(tc.as("seller1", ""), "agg1", []string{ScopeCreateTrade, ScopeSignTrade}, 20, "2025-06-01T00:00:00Z"))
+	auth, err := e.GetTradingAuthorization(tc, "seller1", "agg1")
+	require.NoError(t, err)
+	require.Equal(t, 20.0, auth.MaxEnergyAmount)
+	require.False(t, auth.Revoked)
+	err = e.CreateEnergyAsset(tc.as("agg1", ""), "energy1", "buyer1", "seller1", 50, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "caller agg1 is not a party to this trade")
+	require.NoError(t, e.CreateEnergyAsset(tc, "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid))
+
+	require.NoError(t, e.SignEnergyAsset(tc, "energy1", tc.sign(t, e, "agg1", "energy1"), 0))
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.NotEmpty(t, asset.SellerSignature)
+	require.Empty(t, asset.BuyerSignature)
+
+	actions, err := e.GetDelegatedActions(tc, "seller1", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, actions.Records, 2)
+	require.Equal(t, "agg1", actions.Records[0].Delegate)
+
+	require.NoError(t, e.RevokeTradingAuthorization(tc.as("seller1", ""), "agg1"))
+	auth, err = e.GetTradingAuthorization(tc, "seller1", "agg1")
+	require.NoError(t, err)
+	require.True(t, auth.Revoked)
+	err = e.CreateEnergyAsset(tc.as("agg1", ""), "energy2", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "caller agg1 is not a party to this trade")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// deliveryIndexPrefix namespaces the delivery-time index keys. The index uses
+// simple keys rather than composite keys because Fabric only allows range
+// queries over simple keys, and settlement needs to scan a time window.
+// Archived trades are moved to a separate index so that the hot index only
+// holds live trades.
+const (
+	deliveryIndexPrefix = "delivery~"
+	archiveIndexPrefix  = "archive~"
+)
+
+// PaginatedTradeResult is a page of trades plus the bookmark for the next page
+type PaginatedTradeResult struct {
+	Records             []*EnergyAsset `json:"records"`
+	FetchedRecordsCount int32          `json:"fetchedRecordsCount"`
+	Bookmark            string         `json:"bookmark"`
+}
+
+func deliveryIndexKey(deliveryStart, tokenID string) string {
+	return deliveryIndexPrefix + deliveryStart + "~" + tokenID
+}
+
+func archiveIndexKey(deliveryStart, tokenID string) string {
+	return archiveIndexPrefix + deliveryStart + "~" + tokenID
+}
+
+func putDeliveryIndex(ctx contractapi.TransactionContextInterface, deliveryStart, tokenID string) error {
+	return ctx.GetStub().PutState(deliveryIndexKey(deliveryStart, tokenID), []byte(tokenID))
+}
+
+// GetTradesByDeliveryWindow returns live trades whose delivery starts in [from, to)
+func (e *EnergyTradingContract) GetTradesByDeliveryWindow(ctx contractapi.TransactionContextInterface, from, to string, pageSize int32, bookmark string) (*PaginatedTradeResult, error) {
+	return e.queryTradeIndex(ctx, deliveryIndexPrefix, from, to, pageSize, bookmark)
+}
+
+// GetArchivedTradesByDeliveryWindow returns archived trades whose delivery starts in [from, to)
+func (e *EnergyTradingContract) GetArchivedTradesByDeliveryWindow(ctx contractapi.TransactionContextInterface, from, to string, pageSize int32, bookmark string) (*PaginatedTradeResult, error) {
+	return e.queryTradeIndex(ctx, archiveIndexPrefix, from, to, pageSize, bookmark)
+}
+
+func (e *EnergyTradingContract) queryTradeIndex(ctx contractapi.TransactionContextInterface, prefix, from, to string, pageSize int32, bookmark string) (*PaginatedTradeResult, error) {
+	from, err := normalizeTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	to, err = normalizeTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	if from >= to {
+		return nil, fmt.Errorf("delivery window start %s must be before end %s", from, to)
+	}
+	if err := checkPageSize(ctx, pageSize); err != nil {
+		return nil, err
+	}
+
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByRangeWithPagination(prefix+from, prefix+to, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	result := &PaginatedTradeResult{Records: []*EnergyAsset{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		asset, err := e.ReadEnergyAsset(ctx, string(queryResponse.Value))
+		if err != nil {
+			return nil, err
+		}
+		result.Records = append(result.Records, asset)
+	}
+	if metadata != nil {
+		result.FetchedRecordsCount = metadata.FetchedRecordsCount
+		result.Bookmark = metadata.Bookmark
+	}
+	return result, nil
+}
+
+// ArchiveSettledAssets flags settled trades delivered before beforeDate as
+// archived and moves them from the live delivery index to the archive index.
+// A call archives at most the batch limit of trades and returns the number
+// archived; callers repeat it until it returns 0.
+func (e *EnergyTradingContract) ArchiveSettledAssets(ctx contractapi.TransactionContextInterface, beforeDate string) (int, error) {
+	beforeDate, err := normalizeTimestamp(beforeDate)
+	if err != nil {
+		return 0, err
+	}
+	limits, err := e.GetBatchLimits(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange(deliveryIndexPrefix, deliveryIndexPrefix+beforeDate)
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	archived := 0
+	for resultsIterator.HasNext() && archived < int(limits.MaxBatchSize) {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return archived, err
+		}
+		asset, err := e.ReadEnergyAsset(ctx, string(queryResponse.Value))
+		if err != nil {
+			return archived, err
+		}
+		if asset.TransactionState != StateSettled || asset.Archived {
+			continue
+		}
+
+		asset.Archived = true
+		if err := putEnergyAsset(ctx, asset); err != nil {
+			return archived, err
+		}
+		if err := ctx.GetStub().DelState(queryResponse.Key); err != nil {
+			return archived, err
+		}
+		deliveryStart := strings.TrimPrefix(queryResponse.Key, deliveryIndexPrefix)
+		deliveryStart = strings.TrimSuffix(deliveryStart, "~"+asset.TokenID)
+		if err := ctx.GetStub().PutState(archiveIndexKey(deliveryStart, asset.TokenID), []byte(asset.TokenID)); err != nil {
+			return archived, err
+		}
+		archived++
+	}
+	return archived, emitEvent(ctx, EventTradesArchived, map[string]interface{}{"before": beforeDate, "count": archived})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliveryWindowAndArchive(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	createTestAsset(t, e, tc, "energy1")
+	require.NoError(t, e.CreateEnergyAsset(tc.as("buyer1", ""), "energy2", "buyer1", "seller1", 5, "2025-05-03T11:00:00Z", "2025-05-03T12:00:00Z", SourceGrid))
+	require.NoError(t, e.CreateEnergyAsset(tc, "energy3", "buyer1", "seller1", 5, "2025-05-04T10:00:00Z", "2025-05-04T11:00:00Z", SourceGrid))
+
+	_, err := e.GetTradesByDeliveryWindow(tc, "2025-05-04T00:00:00Z", "2025-05-03T00:00:00Z", 10, "")
+	require.EqualError(t, err, "delivery window start 2025-05-04T00:00:00Z must be before end 2025-05-03T00:00:00Z")
+	_, err = e.GetTradesByDeliveryWindow(tc, "yesterday", "2025-05-03T00:00:00Z", 10, "")
+	require.Error(t, err)
+
+	page, err := e.GetTradesByDeliveryWindow(tc, "2025-05-03T00:00:00Z", "2025-05-04T00:00:00Z", 10, "")
+	require.NoError(t, err)
+	require.Len(t, page.Records, 2)
+	require.Equal(t, "energy1", page.Records[0].TokenID)
+	require.Equal(t, "energy2", page.Records[1].TokenID)
+
+	// Only settled trades are archived
+	for _, tokenID := range []string{"energy1", "energy3"} {
+		asset, err := e.ReadEnergyAsset(tc, tokenID)
+		require.NoError(t, err)
+		asset.TransactionState = StateSettled
+		require.NoError(t, putEnergyAsset(tc, asset))
+	}
+	_, err = e.ArchiveSettledAssets(tc.as("admin1", RoleAdmin), "not a date")
+	require.Error(t, err)
+	archived, err := e.ArchiveSettledAssets(tc, "2025-05-04T00:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 1, archived)
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventTradesArchived, name)
+
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.True(t, asset.Archived)
+	page, err = e.GetTradesByDeliveryWindow(tc, "2025-05-03T00:00:00Z", "2025-05-05T00:00:00Z", 10, "")
+	require.NoError(t, err)
+	require.Len(t, page.Records, 2)
+	require.Equal(t, "energy2", page.Records[0].TokenID)
+	require.Equal(t, "energy3", page.Records[1].TokenID)
+	page, err = e.GetArchivedTradesByDeliveryWindow(tc, "2025-05-03T00:00:00Z", "2025-05-05T00:00:00Z", 10, "")
+	require.NoError(t, err)
+	require.Len(t, page.Records, 1)
+	require.Equal(t, "energy1", page.Records[0].TokenID)
+
+	archived, err = e.ArchiveSettledAssets(tc, "2025-05-04T00:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 0, archived)
+}
+
+// createTestTrades records n trades between buyer1 and seller1, which writes
+// each trade's delivery, slot and source index entries
+func createTestTrades(tb testing.TB, e *EnergyTradingContract, tc *testContext, n int) {
+	registerTestParticipant(tb, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(tb, e, tc, "seller1", RoleProsumer)
+	tc.as("buyer1", "")
+	for i := 0; i < n; i++ {
+		require.NoError(tb, e.CreateEnergyAsset(tc, fmt.Sprintf("energy%d", i), "buyer1", "seller1", 1, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid))
+	}
+}
+
+// BenchmarkCreateEnergyAsset records n trades on a fresh ledger, measuring the
+// trade's state and index writes without participant registration
+func BenchmarkCreateEnergyAsset(b *testing.B) {
+	for _, n := range []int{10, 50} {
+		b.Run(fmt.Sprintf("trades=%d", n), func(b *testing.B) {
+			e := &EnergyTradingContract{}
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tc := newTestContext()
+				registerTestParticipant(b, e, tc, "buyer1", RoleConsumer)
+				registerTestParticipant(b, e, tc, "seller1", RoleProsumer)
+				b.StartTimer()
+				createTestTrades(b, e, tc, n)
+			}
+		})
+	}
+}
+
+// BenchmarkArchiveSettledAssets moves a full batch of settled trades from the
+// delivery index to the archive index
+func BenchmarkArchiveSettledAssets(b *testing.B) {
+	for _, n := range []int{10, 50} {
+		b.Run(fmt.Sprintf("trades=%d", n), func(b *testing.B) {
+			e := &EnergyTradingContract{}
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tc := newTestContext()
+				createTestTrades(b, e, tc, n)
+				for j := 0; j < n; j++ {
+					asset, err := e.ReadEnergyAsset(tc, fmt.Sprintf("energy%d", j))
+					require.NoError(b, err)
+					asset.TransactionState = StateSettled
+					require.NoError(b, putEnergyAsset(tc, asset))
+				}
+				tc.as("admin1", RoleAdmin)
+				b.StartTimer()
+				archived, err := e.ArchiveSettledAssets(tc, "2025-05-04T00:00:00Z")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if archived != n {
+					b.Fatalf("archived %d of %d trades", archived, n)
+				}
+			}
+		})
+	}
+}
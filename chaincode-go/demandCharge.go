@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// PeakContribution is one member's net import in the interval of its
+// community's coincident peak
+type PeakContribution struct {
+	Participant string  `json:"participant"`
+	Demand      float64 `json:"demand"`
+}
+
+// CommunityPeak is the interval of a billing period in which a zone's
+// members together imported the most energy from the grid, after netting
+// each member's own generation, and what each of them imported in it
+type CommunityPeak struct {
+	Zone          string              `json:"zone"`
+	Period        string              `json:"period"`
+	Interval      string              `json:"interval"`
+	Demand        float64             `json:"demand"`
+	Contributions []*PeakContribution `json:"contributions"`
+}
+
+// DemandChargeShare is one member's part of a demand charge. A share that
+// could not be collected when the charge was allocated stays unpaid until
+// the member pays it.
+type DemandChargeShare struct {
+	Participant      string  `json:"participant"`
+	PeakContribution float64 `json:"peakContribution"`
+	Amount           float64 `json:"amount"`
+	Paid             bool    `json:"paid"`
+	PaidAt           string  `json:"paidAt,omitempty"`
+}
+
+// DemandChargeAllocation splits the grid's demand charge on a zone for a
+// billing period among its members in proportion to their contribution to
+// the community's coincident peak
+type DemandChargeAllocation struct {
+	Zone         string               `json:"zone"`
+	Period       string               `json:"period"`
+	PeakInterval string               `json:"peakInterval"`
+	PeakDemand   float64              `json:"peakDemand"`
+	Charge       float64              `json:"charge"`
+	Shares       []*DemandChargeShare `json:"shares"`
+	AllocatedBy  string               `json:"allocatedBy"`
+	AllocatedAt  string               `json:"allocatedAt"`
+}
+
+func demandChargeKey(ctx contractapi.TransactionContextInterface, zone, period string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("demandcharge", []string{zone, period})
+}
+
+func putDemandChargeAllocation(ctx contractapi.TransactionContextInterface, allocation *DemandChargeAllocation) error {
+	allocationJSON, err := json.Marshal(allocation)
+	if err != nil {
+		return err
+	}
+	key, err := demandChargeKey(ctx, allocation.Zone, allocation.Period)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, allocationJSON)
+}
+
+// getDemandChargeAllocation returns the allocation of a zone's demand charge
+// for a period, or nil if it has not been allocated
+func getDemandChargeAllocation(ctx contractapi.TransactionContextInterface, zone, period string) (*DemandChargeAllocation, error) {
+	key, err := demandChargeKey(ctx, zone, period)
+	if err != nil {
+		return nil, err
+	}
+	allocationJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read demand charge: %v", err)
+	}
+	if allocationJSON == nil {
+		return nil, nil
+	}
+	var allocation DemandChargeAllocation
+	if err := json.Unmarshal(allocationJSON, &allocation); err != nil {
+		return nil, err
+	}
+	return &allocation, nil
+}
+
+// GetDemandChargeAllocation returns the allocation of a zone's demand charge
+// for a billing period
+func (e *EnergyTradingContract) GetDemandChargeAllocation(ctx contractapi.TransactionContextInterface, zone, period string) (*DemandChargeAllocation, error) {
+	allocation, err := getDemandChargeAllocation(ctx, zone, period)
+	if err != nil {
+		return nil, err
+	}
+	if allocation == nil {
+		return nil, fmt.Errorf("demand charge of zone %s for %s does not exist", zone, period)
+	}
+	return allocation, nil
+}
+
+// GetCommunityPeak measures a zone's coincident peak in a billing period
+// from its members' self-consumption records
+func (e *EnergyTradingContract) GetCommunityPeak(ctx contractapi.TransactionContextInterface, zone, period string) (*CommunityPeak, error) {
+	start, end, err := billingPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+	return communityPeak(ctx, zone, period, start, end)
+}
+
+// communityPeak sums the residual imports of a zone's members per interval
+// and returns the interval with the highest total, the earliest on a tie
+func communityPeak(ctx contractapi.TransactionContextInterface, zone, period string, start, end time.Time) (*CommunityPeak, error) {
+	members, err := zoneMembers(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBatchSize(ctx, len(members), "members"); err != nil {
+		return nil, err
+	}
+	from, to := start.Format(time.RFC3339), end.Format(time.RFC3339)
+	totals := map[string]float64{}
+	demands := map[string]map[string]float64{}
+	for _, member := range members {
+		demands[member] = map[string]float64{}
+		resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("selfconsumption", []string{member})
+		if err != nil {
+			return nil, err
+		}
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			var record SelfConsumption
+			if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			if record.IntervalStart < from || record.IntervalStart >= to || record.ResidualImport <= 0 {
+				continue
+			}
+			totals[record.IntervalStart] += record.ResidualImport
+			demands[member][record.IntervalStart] = record.ResidualImport
+		}
+		resultsIterator.Close()
+	}
+
+	intervals := make([]string, 0, len(totals))
+	for interval := range totals {
+		intervals = append(intervals, interval)
+	}
+	sort.Strings(intervals)
+	peak := &CommunityPeak{Zone: zone, Period: period, Contributions: []*PeakContribution{}}
+	for _, interval := range intervals {
+		if totals[interval] > peak.Demand {
+			peak.Interval, peak.Demand = interval, totals[interval]
+		}
+	}
+	if peak.Interval == "" {
+		return nil, fmt.Errorf("zone %s imported no energy in %s", zone, period)
+	}
+	for _, member := range members {
+		if demand := demands[member][peak.Interval]; demand > 0 {
+			peak.Contributions = append(peak.Contributions, &PeakContribution{Participant: member, Demand: demand})
+		}
+	}
+	return peak, nil
+}
+
+// zoneMembers returns the addresses of a zone's participants that have not
+// been erased, in address order
+func zoneMembers(ctx contractapi.TransactionContextInterface, zone string) ([]string, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("participant", []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	members := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var participant Participant
+		if err := json.Unmarshal(queryResponse.Value, &participant); err != nil {
+			return nil, err
+		}
+		if participant.Zone == zone && !participant.Erased {
+			members = append(members, participant.Address)
+		}
+	}
+	return members, nil
+}
+
+// AllocateDemandCharge splits the grid's demand charge on a zone for a
+// billing period that has ended among the members who imported energy in
+// the community's coincident peak, in proportion to their import then. Each
+// share is collected into the grid operator's account at once; a member who
+// cannot pay keeps an unpaid share to settle with PayDemandCharge. A charge
+// can be allocated once per zone and period.
+func (e *EnergyTradingContract) AllocateDemandCharge(ctx contractapi.TransactionContextInterface, zone, period string, charge float64) (*DemandChargeAllocation, error) {
+	if charge <= 0 {
+		return nil, fmt.Errorf("demand charge must be positive")
+	}
+	start, end, err := billingPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(end) {
+		return nil, fmt.Errorf("billing period %s has not ended", period)
+	}
+	existing, err := getDemandChargeAllocation(ctx, zone, period)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("demand charge of zone %s for %s is already allocated", zone, period)
+	}
+	peak, err := communityPeak(ctx, zone, period, start, end)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	allocation := &DemandChargeAllocation{
+		Zone:         zone,
+		Period:       period,
+		PeakInterval: peak.Interval,
+		PeakDemand:   peak.Demand,
+		Charge:       charge,
+		Shares:       []*DemandChargeShare{},
+		AllocatedBy:  caller,
+		AllocatedAt:  now.Format(time.RFC3339),
+	}
+	for _, contribution := range peak.Contributions {
+		share := &DemandChargeShare{
+			Participant:      contribution.Participant,
+			PeakContribution: contribution.Demand,
+			Amount:           charge * contribution.Demand / peak.Demand,
+		}
+		if err := settleWithGrid(ctx, share.Participant, -share.Amount); err == nil {
+			share.Paid, share.PaidAt = true, allocation.AllocatedAt
+		} else if !strings.Contains(err.Error(), "insufficient balance") && !strings.Contains(err.Error(), "does not exist") {
+			return nil, err
+		}
+		allocation.Shares = append(allocation.Shares, share)
+	}
+	if err := putDemandChargeAllocation(ctx, allocation); err != nil {
+		return nil, err
+	}
+	return allocation, emitEvent(ctx, EventDemandChargeAllocated, allocation)
+}
+
+// PayDemandCharge pays the caller's unpaid share of a zone's demand charge
+// for a billing period
+func (e *EnergyTradingContract) PayDemandCharge(ctx contractapi.TransactionContextInterface, zone, period string) (*DemandChargeShare, error) {
+	allocation, err := e.GetDemandChargeAllocation(ctx, zone, period)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, share := range allocation.Shares {
+		if share.Participant != caller {
+			continue
+		}
+		if share.Paid {
+			return nil, fmt.Errorf("demand charge share of %s for %s is already paid", caller, period)
+		}
+		if err := settleWithGrid(ctx, caller, -share.Amount); err != nil {
+			return nil, err
+		}
+		now, err := txTimestamp(ctx)
+		if err != nil {
+			return nil, err
+		}
+		share.Paid, share.PaidAt = true, now
+		if err := putDemandChargeAllocation(ctx, allocation); err != nil {
+			return nil, err
+		}
+		return share, emitEvent(ctx, EventDemandChargePaid, share)
+	}
+	return nil, fmt.Errorf("participant %s has no share of the demand charge of zone %s for %s", caller, zone, period)
+}
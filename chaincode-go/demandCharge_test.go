@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// submitTestReading submits one signed reading of a participant's meter
+func submitTestReading(t testing.TB, e *EnergyTradingContract, tc *testContext, address, intervalStart string, injected, consumed float64) {
+	meterID := "meter-" + address
+	signature := tc.signReading(t, meterID, intervalStart, injected, consumed)
+	require.NoError(t, e.SubmitMeterReading(tc.as(address, ""), meterID, intervalStart, injected, consumed, signature))
+}
+
+func TestAllocateDemandCharge(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "consumer3", RoleConsumer)
+	for _, address := range []string{"seller1", "buyer1", "consumer3"} {
+		registerTestMeter(t, e, tc, address)
+	}
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "seller1", 5))
+	require.NoError(t, e.MintTokens(tc, "buyer1", 5))
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReading(t, e, tc, "buyer1", "2025-05-03T10:00:00Z", 0, 2)
+	submitTestReading(t, e, tc, "buyer1", "2025-05-03T10:15:00Z", 0, 1)
+	submitTestReading(t, e, tc, "consumer3", "2025-05-03T10:00:00Z", 0, 1)
+	submitTestReading(t, e, tc, "consumer3", "2025-05-03T10:15:00Z", 0, 3)
+	submitTestReading(t, e, tc, "seller1", "2025-05-03T10:00:00Z", 1, 0.5)
+	submitTestReading(t, e, tc, "seller1", "2025-05-03T10:15:00Z", 0, 1)
+
+	// The seller's own generation covers its consumption at 10:00, so the
+	// community peaks at 10:15
+	peak, err := e.GetCommunityPeak(tc, "zone1", "2025-05")
+	require.NoError(t, err)
+	require.Equal(t, "2025-05-03T10:15:00Z", peak.Interval)
+	require.InDelta(t, 5, peak.Demand, 1e-9)
+	require.Len(t, peak.Contributions, 3)
+	_, err = e.GetCommunityPeak(tc, "zone2", "2025-05")
+	require.EqualError(t, err, "zone zone2 imported no energy in 2025-05")
+
+	tc.as("operator1", RoleOperator)
+	_, err = e.AllocateDemandCharge(tc, "zone1", "2025-05", 10)
+	require.EqualError(t, err, "billing period 2025-05 has not ended")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)), nil)
+	_, err = e.AllocateDemandCharge(tc, "zone1", "2025-05", 0)
+	require.EqualError(t, err, "demand charge must be positive")
+	allocation, err := e.AllocateDemandCharge(tc, "zone1", "2025-05", 10)
+	require.NoError(t, err)
+	require.Equal(t, "2025-05-03T10:15:00Z", allocation.PeakInterval)
+	shares := map[string]*DemandChargeShare{}
+	for _, share := range allocation.Shares {
+		shares[share.Participant] = share
+	}
+	require.InDelta(t, 2, shares["buyer1"].Amount, 1e-9)
+	require.InDelta(t, 6, shares["consumer3"].Amount, 1e-9)
+	require.InDelta(t, 2, shares["seller1"].Amount, 1e-9)
+	require.True(t, shares["buyer1"].Paid)
+	require.False(t, shares["consumer3"].Paid)
+	_, err = e.AllocateDemandCharge(tc, "zone1", "2025-05", 10)
+	require.EqualError(t, err, "demand charge of zone zone1 for 2025-05 is already allocated")
+
+	grid, err := e.ReadTokenAccount(tc, GridOperatorAccount)
+	require.NoError(t, err)
+	require.InDelta(t, 4, grid.Balance, 1e-9)
+
+	// The member who could not pay settles its share later
+	_, err = e.PayDemandCharge(tc.as("buyer1", ""), "zone1", "2025-05")
+	require.EqualError(t, err, "demand charge share of buyer1 for 2025-05 is already paid")
+	_, err = e.PayDemandCharge(tc.as("consumer3", ""), "zone1", "2025-05")
+	require.EqualError(t, err, "account consumer3 does not exist")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "consumer3", 6))
+	share, err := e.PayDemandCharge(tc.as("consumer3", ""), "zone1", "2025-05")
+	require.NoError(t, err)
+	require.True(t, share.Paid)
+	allocation, err = e.GetDemandChargeAllocation(tc, "zone1", "2025-05")
+	require.NoError(t, err)
+	for _, share := range allocation.Shares {
+		require.True(t, share.Paid, share.Participant)
+	}
+}
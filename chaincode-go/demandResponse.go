@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// DRBaselineDays is how many preceding days the consumption baseline of a
+// demand response event is averaged over when the participant has no
+// baseline methodology. Days without readings are skipped.
+const DRBaselineDays = 5
+
+// Demand response enrollment statuses
+const (
+	DREnrolled = "ENROLLED"
+	DRSettled  = "SETTLED"
+)
+
+// DREvent is a grid operator's call to reduce consumption in a zone by
+// Reduction kW between Start and End. Participants are paid IncentiveRate
+// tokens for every kWh they reduce up to their commitment and pay PenaltyRate
+// for every committed kWh they fail to reduce.
+type DREvent struct {
+	EventID       string  `json:"eventID"`
+	Zone          string  `json:"zone"`
+	Reduction     float64 `json:"reduction"`
+	Start         string  `json:"start"`
+	End           string  `json:"end"`
+	IncentiveRate float64 `json:"incentiveRate"`
+	PenaltyRate   float64 `json:"penaltyRate"`
+	Committed     float64 `json:"committed"`
+	Operator      string  `json:"operator"`
+	CreatedAt     string  `json:"createdAt"`
+}
+
+// DREnrollment is a participant's commitment to reduce Commitment kW during a
+// demand response event and, once settled, its measured performance. Energy
+// figures are in kWh over the event window.
+type DREnrollment struct {
+	EventID     string  `json:"eventID"`
+	Participant string  `json:"participant"`
+	Commitment  float64 `json:"commitment"`
+	Status      string  `json:"status"`
+	Baseline    float64 `json:"baseline"`
+	Actual      float64 `json:"actual"`
+	Reduced     float64 `json:"reduced"`
+	Incentive   float64 `json:"incentive"`
+	Penalty     float64 `json:"penalty"`
+	EnrolledAt  string  `json:"enrolledAt"`
+	SettledAt   string  `json:"settledAt,omitempty"`
+}
+
+func drEventKey(ctx contractapi.TransactionContextInterface, eventID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("drevent", []string{eventID})
+}
+
+func drEnrollmentKey(ctx contractapi.TransactionContextInterface, eventID, participant string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("drenrollment", []string{eventID, participant})
+}
+
+func putDREvent(ctx contractapi.TransactionContextInterface, event *DREvent) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	key, err := drEventKey(ctx, event.EventID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, eventJSON)
+}
+
+func putDREnrollment(ctx contractapi.TransactionContextInterface, enrollment *DREnrollment) error {
+	enrollmentJSON, err := json.Marshal(enrollment)
+	if err != nil {
+		return err
+	}
+	key, err := drEnrollmentKey(ctx, enrollment.EventID, enrollment.Participant)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, enrollmentJSON)
+}
+
+// CreateDemandResponseEvent calls a demand response event for a zone. The
+// window must be aligned to time slots and not yet started.
+func (e *EnergyTradingContract) CreateDemandResponseEvent(ctx contractapi.TransactionContextInterface, eventID, zone string, reduction float64, start, end string, incentiveRate, penaltyRate float64) (*DREvent, error) {
+	if zone == "" {
+		return nil, fmt.Errorf("zone must not be empty")
+	}
+	if reduction <= 0 {
+		return nil, fmt.Errorf("reduction must be positive")
+	}
+	if incentiveRate < 0 || penaltyRate < 0 {
+		return nil, fmt.Errorf("incentive and penalty rates must not be negative")
+	}
+	start, _, err := alignedSlot(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+	end, _, err = alignedSlot(ctx, end)
+	if err != nil {
+		return nil, err
+	}
+	startTime, err := parseTimestamp(start)
+	if err != nil {
+		return nil, err
+	}
+	endTime, err := parseTimestamp(end)
+	if err != nil {
+		return nil, err
+	}
+	if !endTime.After(startTime) {
+		return nil, fmt.Errorf("event end must be after its start")
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(startTime) {
+		return nil, fmt.Errorf("event start %s has already passed", start)
+	}
+	key, err := drEventKey(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read demand response event %s: %v", eventID, err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("demand response event %s already exists", eventID)
+	}
+	operator, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &DREvent{
+		EventID:       eventID,
+		Zone:          zone,
+		Reduction:     reduction,
+		Start:         start,
+		End:           end,
+		IncentiveRate: incentiveRate,
+		PenaltyRate:   penaltyRate,
+		Operator:      operator,
+		CreatedAt:     now.Format(time.RFC3339),
+	}
+	if err := putDREvent(ctx, event); err != nil {
+		return nil, err
+	}
+	return event, emitEvent(ctx, EventDemandResponseCalled, event)
+}
+
+// GetDemandResponseEvent returns a demand response event
+func (e *EnergyTradingContract) GetDemandResponseEvent(ctx contractapi.TransactionContextInterface, eventID string) (*DREvent, error) {
+	key, err := drEventKey(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	eventJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read demand response event %s: %v", eventID, err)
+	}
+	if eventJSON == nil {
+		return nil, fmt.Errorf("demand response event %s does not exist", eventID)
+	}
+	var event DREvent
+	if err := json.Unmarshal(eventJSON, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// OptInDemandResponse commits the caller to reduce its consumption by
+// commitment kW during an event in its zone. Opt-ins close when the event
+// starts or when the commitments cover the requested reduction.
+func (e *EnergyTradingContract) OptInDemandResponse(ctx contractapi.TransactionContextInterface, eventID string, commitment float64) (*DREnrollment, error) {
+	if commitment <= 0 {
+		return nil, fmt.Errorf("commitment must be positive")
+	}
+	event, err := e.GetDemandResponseEvent(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseTimestamp(event.Start)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(start) {
+		return nil, fmt.Errorf("demand response event %s has already started", eventID)
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	participant, err := requireApprovedParticipant(ctx, caller)
+	if err != nil {
+		return nil, err
+	}
+	if participant.Zone != event.Zone {
+		return nil, fmt.Errorf("participant %s is not in zone %s", caller, event.Zone)
+	}
+	key, err := drEnrollmentKey(ctx, eventID, caller)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read demand response enrollment: %v", err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("participant %s has already opted in to event %s", caller, eventID)
+	}
+	if commitment > event.Reduction-event.Committed {
+		return nil, fmt.Errorf("demand response event %s needs only %v kW more", eventID, event.Reduction-event.Committed)
+	}
+
+	enrollment := &DREnrollment{
+		EventID:     eventID,
+		Participant: caller,
+		Commitment:  commitment,
+		Status:      DREnrolled,
+		EnrolledAt:  now.Format(time.RFC3339),
+	}
+	if err := putDREnrollment(ctx, enrollment); err != nil {
+		return nil, err
+	}
+	event.Committed += commitment
+	if err := putDREvent(ctx, event); err != nil {
+		return nil, err
+	}
+	return enrollment, emitEvent(ctx, EventDemandResponseOptIn, enrollment)
+}
+
+// SettleDemandResponse measures a participant's performance in an event that
+// has ended and settles it against the grid operator. The baseline is the
+// participant's verified consumption baseline committed for the event's
+// window, or else the one its baseline methodology computes, by default the
+// average over the same window on the preceding DRBaselineDays days. The
+// reduction is the baseline less the consumption metered during the event.
+// The participant or an operator may settle.
+func (e *EnergyTradingContract) SettleDemandResponse(ctx contractapi.TransactionContextInterface, eventID, participant string) (*DREnrollment, error) {
+	role, err := callerRole(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if role != RoleOperator {
+		if err := requireCaller(ctx, participant); err != nil {
+			return nil, err
+		}
+	}
+	event, err := e.GetDemandResponseEvent(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	enrollment, err := e.GetDemandResponseEnrollment(ctx, eventID, participant)
+	if err != nil {
+		return nil, err
+	}
+	if enrollment.Status == DRSettled {
+		return nil, fmt.Errorf("participant %s has already been settled for event %s", participant, eventID)
+	}
+	start, err := parseTimestamp(event.Start)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimestamp(event.End)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(end) {
+		return nil, fmt.Errorf("demand response event %s ends at %s", eventID, event.End)
+	}
+
+	baseline, err := flexibilityBaseline(ctx, participant, BaselineConsumption, start, end)
+	if err != nil {
+		return nil, err
+	}
+	_, actual, found, err := meteredEnergy(ctx, participant, event.Start, event.End)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("participant %s has no meter readings for event %s", participant, eventID)
+	}
+	committed := enrollment.Commitment * end.Sub(start).Hours()
+	reduced := math.Max(0, baseline-actual)
+	enrollment.Baseline = baseline
+	enrollment.Actual = actual
+	enrollment.Reduced = reduced
+	enrollment.Incentive = math.Min(reduced, committed) * event.IncentiveRate
+	enrollment.Penalty = math.Max(0, committed-reduced) * event.PenaltyRate
+	enrollment.Status = DRSettled
+	enrollment.SettledAt = now.Format(time.RFC3339)
+	if err := settleWithGrid(ctx, participant, enrollment.Incentive-enrollment.Penalty); err != nil {
+		return nil, fmt.Errorf("failed to settle demand response of %s: %v", participant, err)
+	}
+	if err := putDREnrollment(ctx, enrollment); err != nil {
+		return nil, err
+	}
+	return enrollment, emitEvent(ctx, EventDemandResponseSettled, enrollment)
+}
+
+// GetDemandResponseEnrollment returns a participant's enrollment in an event
+func (e *EnergyTradingContract) GetDemandResponseEnrollment(ctx contractapi.TransactionContextInterface, eventID, participant string) (*DREnrollment, error) {
+	key, err := drEnrollmentKey(ctx, eventID, participant)
+	if err != nil {
+		return nil, err
+	}
+	enrollmentJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read demand response enrollment: %v", err)
+	}
+	if enrollmentJSON == nil {
+		return nil, fmt.Errorf("participant %s has not opted in to event %s", participant, eventID)
+	}
+	var enrollment DREnrollment
+	if err := json.Unmarshal(enrollmentJSON, &enrollment); err != nil {
+		return nil, err
+	}
+	return &enrollment, nil
+}
+
+// PaginatedDREnrollmentResult is a page of demand response enrollments
+type PaginatedDREnrollmentResult struct {
+	Records             []*DREnrollment `json:"records"`
+	FetchedRecordsCount int32           `json:"fetchedRecordsCount"`
+	Bookmark            string          `json:"bookmark"`
+}
+
+// GetDemandResponseEnrollments returns a page of the enrollments in an event
+func (e *EnergyTradingContract) GetDemandResponseEnrollments(ctx contractapi.TransactionContextInterface, eventID string, pageSize int32, bookmark string) (*PaginatedDREnrollmentResult, error) {
+	result := &PaginatedDREnrollmentResult{Records: []*DREnrollment{}}
+	metadata, err := queryPage(ctx, "drenrollment", []string{eventID}, pageSize, bookmark, func(value []byte) error {
+		var enrollment DREnrollment
+		if err := json.Unmarshal(value, &enrollment); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &enrollment)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
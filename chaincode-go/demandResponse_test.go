@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// submitTestConsumption submits a meter's consumption per interval between
+// 10:00 and 11:00 on the given day of May 2025
+func submitTestConsumption(t *testing.T, e *EnergyTradingContract, tc *testContext, address string, day int, consumed float64) {
+	meterID := "meter-" + address
+	start := time.Date(2025, 5, day, 10, 0, 0, 0, time.UTC)
+	for interval := start; interval.Before(start.Add(time.Hour)); interval = interval.Add(DefaultSlotLength) {
+		intervalStart := interval.Format(time.RFC3339)
+		signature := tc.signReading(t, meterID, intervalStart, 0, consumed)
+		require.NoError(t, e.SubmitMeterReading(tc.as(address, ""), meterID, intervalStart, 0, consumed, signature))
+	}
+}
+
+func TestDemandResponse(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestMeter(t, e, tc, "buyer1")
+	registerTestMeter(t, e, tc, "seller1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 5))
+	require.NoError(t, e.MintTokens(tc, "seller1", 5))
+
+	tc.as("operator1", RoleOperator)
+	_, err := e.CreateDemandResponseEvent(tc, "dr1", "zone1", 5, "2025-05-01T07:00:00Z", "2025-05-01T09:00:00Z", 0.5, 0.25)
+	require.EqualError(t, err, "event start 2025-05-01T07:00:00Z has already passed")
+	_, err = e.CreateDemandResponseEvent(tc, "dr1", "zone1", 5, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", 0.5, 0.25)
+	require.NoError(t, err)
+
+	_, err = e.OptInDemandResponse(tc.as("buyer1", ""), "dr1", 2)
+	require.NoError(t, err)
+	_, err = e.OptInDemandResponse(tc, "dr1", 1)
+	require.EqualError(t, err, "participant buyer1 has already opted in to event dr1")
+	_, err = e.OptInDemandResponse(tc.as("seller1", ""), "dr1", 4)
+	require.EqualError(t, err, "demand response event dr1 needs only 3 kW more")
+	_, err = e.OptInDemandResponse(tc, "dr1", 3)
+	require.NoError(t, err)
+
+	_, err = e.SettleDemandResponse(tc.as("buyer1", ""), "dr1", "buyer1")
+	require.EqualError(t, err, "demand response event dr1 ends at 2025-05-03T11:00:00Z")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestConsumption(t, e, tc, "buyer1", 1, 1)
+	submitTestConsumption(t, e, tc, "buyer1", 2, 1.5)
+	submitTestConsumption(t, e, tc, "buyer1", 3, 0.5)
+	submitTestConsumption(t, e, tc, "seller1", 2, 1)
+	submitTestConsumption(t, e, tc, "seller1", 3, 0.75)
+
+	// Baseline 5 kWh, actual 2 kWh: the 2 kWh commitment is met in full
+	enrollment, err := e.SettleDemandResponse(tc.as("buyer1", ""), "dr1", "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 5, enrollment.Baseline, 1e-9)
+	require.InDelta(t, 3, enrollment.Reduced, 1e-9)
+	require.InDelta(t, 1, enrollment.Incentive, 1e-9)
+	require.Zero(t, enrollment.Penalty)
+	_, err = e.SettleDemandResponse(tc, "dr1", "buyer1")
+	require.EqualError(t, err, "participant buyer1 has already been settled for event dr1")
+	_, err = e.SettleDemandResponse(tc, "dr1", "seller1")
+	require.Error(t, err)
+
+	// Reducing 1 of 3 committed kWh earns the incentive on 1 and a penalty on 2
+	enrollment, err = e.SettleDemandResponse(tc.as("operator1", RoleOperator), "dr1", "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 0.5, enrollment.Incentive, 1e-9)
+	require.InDelta(t, 0.5, enrollment.Penalty, 1e-9)
+
+	buyer, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 6, buyer.Balance, 1e-9)
+	enrollments, err := e.GetDemandResponseEnrollments(tc, "dr1", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, enrollments.Records, 2)
+}
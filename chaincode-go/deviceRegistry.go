@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Device types
+const (
+	DeviceMeter    = "meter"
+	DeviceInverter = "inverter"
+)
+
+// Device statuses
+const (
+	DeviceActive  = "ACTIVE"
+	DeviceRevoked = "REVOKED"
+)
+
+// Device is a physical meter or inverter enrolled with the key it signs data
+// with and bound to the participant that owns it. KeyVersion increases with
+// every rotation. LastIntervalStart tracks a meter's latest accepted reading
+// so that readings can only move forward in time.
+type Device struct {
+	DeviceID          string `json:"deviceID"`
+	DeviceType        string `json:"deviceType"`
+	Owner             string `json:"owner"`
+	PublicKey         string `json:"publicKey"`
+	KeyVersion        int    `json:"keyVersion"`
+	Zone              string `json:"zone"`
+	Status            string `json:"status"`
+	RegisteredAt      string `json:"registeredAt"`
+	RotatedAt         string `json:"rotatedAt,omitempty"`
+	RevokedAt         string `json:"revokedAt,omitempty"`
+	LastIntervalStart string `json:"lastIntervalStart,omitempty"`
+}
+
+func deviceKey(ctx contractapi.TransactionContextInterface, deviceID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("device", []string{deviceID})
+}
+
+func putDevice(ctx contractapi.TransactionContextInterface, device *Device) error {
+	deviceJSON, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+	key, err := deviceKey(ctx, device.DeviceID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, deviceJSON)
+}
+
+// getDevice returns the enrolled device, or nil if it is not enrolled
+func getDevice(ctx contractapi.TransactionContextInterface, deviceID string) (*Device, error) {
+	key, err := deviceKey(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	deviceJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device %s: %v", deviceID, err)
+	}
+	if deviceJSON == nil {
+		return nil, nil
+	}
+	var device Device
+	if err := json.Unmarshal(deviceJSON, &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// requireActiveDevice fails unless the device is enrolled with the given type
+// and has not been revoked.
+func requireActiveDevice(ctx contractapi.TransactionContextInterface, deviceID, deviceType string) (*Device, error) {
+	device, err := getDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil || device.DeviceType != deviceType {
+		return nil, fmt.Errorf("%s %s is not registered", deviceType, deviceID)
+	}
+	if device.Status != DeviceActive {
+		return nil, fmt.Errorf("%s %s has been revoked", deviceType, deviceID)
+	}
+	return device, nil
+}
+
+// EnrollDevice binds a meter or inverter and its public key to the caller.
+// Meters must be listed on the caller's participant record.
+func (e *EnergyTradingContract) EnrollDevice(ctx contractapi.TransactionContextInterface, deviceID, deviceType, publicKeyPEM string) error {
+	if deviceType != DeviceMeter && deviceType != DeviceInverter {
+		return fmt.Errorf("unknown device type %s", deviceType)
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	participant, err := requireApprovedParticipant(ctx, caller)
+	if err != nil {
+		return err
+	}
+	if deviceType == DeviceMeter && !ownsMeter(participant, deviceID) {
+		return fmt.Errorf("meter %s is not registered to %s", deviceID, caller)
+	}
+	existing, err := getDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("device %s is already enrolled", deviceID)
+	}
+	if _, err := parsePublicKey(publicKeyPEM); err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	device := &Device{
+		DeviceID:     deviceID,
+		DeviceType:   deviceType,
+		Owner:        caller,
+		PublicKey:    publicKeyPEM,
+		KeyVersion:   1,
+		Zone:         participant.Zone,
+		Status:       DeviceActive,
+		RegisteredAt: now,
+	}
+	if err := putDevice(ctx, device); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventDeviceChanged, ParticipantEvent{Address: caller, Status: "ENROLLED", Subject: deviceID})
+}
+
+// RotateDeviceKey replaces the key of one of the caller's active devices.
+// Data signed with the old key is no longer accepted.
+func (e *EnergyTradingContract) RotateDeviceKey(ctx contractapi.TransactionContextInterface, deviceID, publicKeyPEM string) error {
+	device, err := e.GetDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if err := requireCaller(ctx, device.Owner); err != nil {
+		return err
+	}
+	if device.Status != DeviceActive {
+		return fmt.Errorf("device %s has been revoked", deviceID)
+	}
+	if _, err := parsePublicKey(publicKeyPEM); err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	device.PublicKey = publicKeyPEM
+	device.KeyVersion++
+	device.RotatedAt = now
+	if err := putDevice(ctx, device); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventDeviceChanged, ParticipantEvent{Address: device.Owner, Status: "ROTATED", Subject: deviceID})
+}
+
+// RevokeDevice permanently revokes a compromised device. The owner or an
+// admin may revoke it.
+func (e *EnergyTradingContract) RevokeDevice(ctx contractapi.TransactionContextInterface, deviceID string) error {
+	device, err := e.GetDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	role, err := callerRole(ctx)
+	if err != nil {
+		return err
+	}
+	if role != RoleAdmin {
+		if err := requireCaller(ctx, device.Owner); err != nil {
+			return err
+		}
+	}
+	if device.Status == DeviceRevoked {
+		return fmt.Errorf("device %s has already been revoked", deviceID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	device.Status = DeviceRevoked
+	device.RevokedAt = now
+	if err := putDevice(ctx, device); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventDeviceChanged, ParticipantEvent{Address: device.Owner, Status: DeviceRevoked, Subject: deviceID})
+}
+
+// GetDevice returns an enrolled device
+func (e *EnergyTradingContract) GetDevice(ctx contractapi.TransactionContextInterface, deviceID string) (*Device, error) {
+	device, err := getDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, fmt.Errorf("device %s is not enrolled", deviceID)
+	}
+	return device, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceKeyRotationAndRevocation(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	meterID := registerTestMeter(t, e, tc, "seller1")
+
+	err := e.EnrollDevice(tc.as("seller1", ""), "inverter-1", "battery", tc.publicKeyPEM(t, "inverter-1"))
+	require.EqualError(t, err, "unknown device type battery")
+	require.NoError(t, e.EnrollDevice(tc, "inverter-1", DeviceInverter, tc.publicKeyPEM(t, "inverter-1")))
+	err = e.EnrollDevice(tc, "inverter-1", DeviceInverter, tc.publicKeyPEM(t, "inverter-1"))
+	require.EqualError(t, err, "device inverter-1 is already enrolled")
+
+	// Readings signed with the old key are rejected after rotation.
+	const interval = "2025-05-01T07:00:00Z"
+	oldSignature := tc.signReading(t, meterID, interval, 1, 0)
+	err = e.RotateDeviceKey(tc.as("buyer1", ""), meterID, tc.publicKeyPEM(t, "new-key"))
+	require.EqualError(t, err, "caller buyer1 is not authorized to act for seller1")
+	require.NoError(t, e.RotateDeviceKey(tc.as("seller1", ""), meterID, tc.publicKeyPEM(t, "new-key")))
+	err = e.SubmitMeterReading(tc, meterID, interval, 1, 0, oldSignature)
+	require.EqualError(t, err, "signature does not match the reading of meter meter-seller1")
+	tc.keys[meterID] = tc.key("new-key")
+	require.NoError(t, e.SubmitMeterReading(tc, meterID, interval, 1, 0, tc.signReading(t, meterID, interval, 1, 0)))
+	device, err := e.GetDevice(tc, meterID)
+	require.NoError(t, err)
+	require.Equal(t, 2, device.KeyVersion)
+
+	require.NoError(t, e.RevokeDevice(tc.as("admin1", RoleAdmin), meterID))
+	const next = "2025-05-01T07:15:00Z"
+	err = e.SubmitMeterReading(tc.as("seller1", ""), meterID, next, 1, 0, tc.signReading(t, meterID, next, 1, 0))
+	require.EqualError(t, err, "meter meter-seller1 has been revoked")
+	err = e.RotateDeviceKey(tc, meterID, tc.publicKeyPEM(t, "seller1"))
+	require.EqualError(t, err, "device meter-seller1 has been revoked")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSubmitDisputeEvidence(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2.5, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 2.5)
+
+	hash := strings.Repeat("ab", 32)
+	_, err := e.SubmitDisputeEvidence(tc.as("buyer1", ""), "energy1", hash, "ipfs://photo", "inverter display")
+	require.EqualError(t, err, "asset energy1 has no open dispute")
+	require.NoError(t, e.ChallengeMeterReading(tc, "energy1", "meter-seller1", "2025-05-03T10:15:00Z", "injection exceeds inverter rating"))
+
+	_, err = e.SubmitDisputeEvidence(tc.as("outsider", ""), "energy1", hash, "ipfs://photo", "inverter display")
+	require.EqualError(t, err, "caller outsider is not a party to this trade")
+	_, err = e.SubmitDisputeEvidence(tc.as("buyer1", ""), "energy1", "abc", "ipfs://photo", "inverter display")
+	require.EqualError(t, err, "evidence hash must be a hex encoded SHA-256 digest")
+	evidence, err := e.SubmitDisputeEvidence(tc, "energy1", strings.ToUpper(hash), "ipfs://photo", "inverter display")
+	require.NoError(t, err)
+	require.Equal(t, hash, evidence.Hash)
+	require.Equal(t, "buyer1", evidence.SubmittedBy)
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventDisputeEvidenceSubmitted, name)
+	_, err = e.SubmitDisputeEvidence(tc.as("seller1", ""), "energy1", hash, "ipfs://other", "copy")
+	require.EqualError(t, err, "evidence "+hash+" was already submitted for asset energy1")
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 12, 0, 0, 0, time.UTC)), nil)
+	_, err = e.SubmitDisputeEvidence(tc, "energy1", strings.Repeat("01", 32), "ipfs://log", "inverter log")
+	require.NoError(t, err)
+	records, err := e.GetDisputeEvidence(tc.as("regulator1", RoleRegulator), "energy1", 1, "")
+	require.NoError(t, err)
+	require.Len(t, records.Records, 1)
+	require.Equal(t, "ipfs://photo", records.Records[0].URI)
+	records, err = e.GetDisputeEvidence(tc, "energy1", 1, records.Bookmark)
+	require.NoError(t, err)
+	require.Len(t, records.Records, 1)
+	require.Equal(t, "seller1", records.Records[0].SubmittedBy)
+
+	// Evidence is closed once the dispute is resolved
+	require.NoError(t, e.ResolveMeterDispute(tc.as("arbiter1", RoleArbiter), "meter-seller1", "2025-05-03T10:15:00Z", false, 0, 0))
+	_, err = e.SubmitDisputeEvidence(tc.as("buyer1", ""), "energy1", strings.Repeat("02", 32), "ipfs://late", "late")
+	require.EqualError(t, err, "asset energy1 has no open dispute")
+}
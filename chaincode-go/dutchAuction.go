@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Dutch auction statuses
+const (
+	AuctionOpen      = "OPEN"
+	AuctionSold      = "SOLD"
+	AuctionCancelled = "CANCELLED"
+)
+
+// DutchAuction is a descending-price offer of surplus energy. The asking
+// price starts at StartPrice and drops by PriceStep every StepMinutes until
+// it reaches FloorPrice; the first buyer to accept buys the whole Energy at
+// the asking price of its transaction. Accepting creates the trade, named
+// after the auction, already confirmed by both sides. The auction closes
+// unsold when delivery starts.
+type DutchAuction struct {
+	AuctionID     string  `json:"auctionID"`
+	Seller        string  `json:"seller"`
+	Energy        float64 `json:"energy"`
+	DeliveryStart string  `json:"deliveryStart"`
+	DeliveryEnd   string  `json:"deliveryEnd"`
+	SourceType    string  `json:"sourceType"`
+	StartPrice    float64 `json:"startPrice"`
+	FloorPrice    float64 `json:"floorPrice"`
+	PriceStep     float64 `json:"priceStep"`
+	StepMinutes   int     `json:"stepMinutes"`
+	Status        string  `json:"status"`
+	Buyer         string  `json:"buyer,omitempty"`
+	SalePrice     float64 `json:"salePrice,omitempty"`
+	StartedAt     string  `json:"startedAt"`
+	ClosedAt      string  `json:"closedAt,omitempty"`
+	Version       int64   `json:"version"`
+}
+
+// PaginatedDutchAuctionResult is a page of Dutch auctions
+type PaginatedDutchAuctionResult struct {
+	Records             []*DutchAuction `json:"records"`
+	FetchedRecordsCount int32           `json:"fetchedRecordsCount"`
+	Bookmark            string          `json:"bookmark"`
+}
+
+func dutchAuctionKey(ctx contractapi.TransactionContextInterface, auctionID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("dutchauction", []string{auctionID})
+}
+
+func putDutchAuction(ctx contractapi.TransactionContextInterface, auction *DutchAuction) error {
+	auction.Version++
+	auctionJSON, err := json.Marshal(auction)
+	if err != nil {
+		return err
+	}
+	key, err := dutchAuctionKey(ctx, auction.AuctionID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, auctionJSON)
+}
+
+// GetDutchAuction returns a Dutch auction
+func (e *EnergyTradingContract) GetDutchAuction(ctx contractapi.TransactionContextInterface, auctionID string) (*DutchAuction, error) {
+	key, err := dutchAuctionKey(ctx, auctionID)
+	if err != nil {
+		return nil, err
+	}
+	auctionJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auction %s: %v", auctionID, err)
+	}
+	if auctionJSON == nil {
+		return nil, fmt.Errorf("auction %s does not exist", auctionID)
+	}
+	var auction DutchAuction
+	if err := json.Unmarshal(auctionJSON, &auction); err != nil {
+		return nil, err
+	}
+	return &auction, nil
+}
+
+// GetOpenDutchAuctions returns a page of the auctions still open. Auctions in
+// other statuses are skipped, so a page may hold fewer than pageSize
+// auctions.
+func (e *EnergyTradingContract) GetOpenDutchAuctions(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedDutchAuctionResult, error) {
+	result := &PaginatedDutchAuctionResult{Records: []*DutchAuction{}}
+	metadata, err := queryPage(ctx, "dutchauction", []string{}, pageSize, bookmark, func(value []byte) error {
+		var auction DutchAuction
+		if err := json.Unmarshal(value, &auction); err != nil {
+			return err
+		}
+		if auction.Status == AuctionOpen {
+			result.Records = append(result.Records, &auction)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// askingPrice returns the price of an auction at the given time
+func askingPrice(auction *DutchAuction, now time.Time) (float64, error) {
+	started, err := parseTimestamp(auction.StartedAt)
+	if err != nil {
+		return 0, err
+	}
+	steps := math.Floor(now.Sub(started).Minutes() / float64(auction.StepMinutes))
+	return math.Max(auction.FloorPrice, auction.StartPrice-math.Max(steps, 0)*auction.PriceStep), nil
+}
+
+// GetDutchAuctionPrice returns the asking price of an open auction at the
+// transaction time
+func (e *EnergyTradingContract) GetDutchAuctionPrice(ctx contractapi.TransactionContextInterface, auctionID string) (float64, error) {
+	auction, err := e.GetDutchAuction(ctx, auctionID)
+	if err != nil {
+		return 0, err
+	}
+	if auction.Status != AuctionOpen {
+		return 0, fmt.Errorf("auction %s is %s", auctionID, auction.Status)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return askingPrice(auction, now)
+}
+
+// StartDutchAuction offers the caller's surplus energy in a Dutch auction.
+// Both the start and floor prices must lie in the band around the reference
+// price in effect, and either may be zero or negative.
+func (e *EnergyTradingContract) StartDutchAuction(ctx contractapi.TransactionContextInterface, auctionID string, energy float64, deliveryStart, deliveryEnd, sourceType string, startPrice, floorPrice, priceStep float64, stepMinutes int) (*DutchAuction, error) {
+	if energy <= 0 || priceStep <= 0 || stepMinutes <= 0 {
+		return nil, fmt.Errorf("energy, price step and step minutes must be positive")
+	}
+	if startPrice < floorPrice {
+		return nil, fmt.Errorf("start price %g is below floor price %g", startPrice, floorPrice)
+	}
+	seller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := requireApprovedParticipant(ctx, seller); err != nil {
+		return nil, err
+	}
+	key, err := dutchAuctionKey(ctx, auctionID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auction %s: %v", auctionID, err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("auction %s already exists", auctionID)
+	}
+	deliveryStart, deliveryEnd, err = validateDeliveryWindow(ctx, deliveryStart, deliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSourceType(ctx, seller, sourceType); err != nil {
+		return nil, err
+	}
+	for _, price := range []float64{startPrice, floorPrice} {
+		if err := validatePriceBand(ctx, price); err != nil {
+			return nil, err
+		}
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	auction := &DutchAuction{
+		AuctionID:     auctionID,
+		Seller:        seller,
+		Energy:        energy,
+		DeliveryStart: deliveryStart,
+		DeliveryEnd:   deliveryEnd,
+		SourceType:    sourceType,
+		StartPrice:    startPrice,
+		FloorPrice:    floorPrice,
+		PriceStep:     priceStep,
+		StepMinutes:   stepMinutes,
+		Status:        AuctionOpen,
+		StartedAt:     now,
+	}
+	if err := putDutchAuction(ctx, auction); err != nil {
+		return nil, err
+	}
+	return auction, emitEvent(ctx, EventDutchAuctionChanged, auction)
+}
+
+// AcceptDutchAuction buys the energy of an open auction at the asking price
+// of the transaction, creating the confirmed trade
+func (e *EnergyTradingContract) AcceptDutchAuction(ctx contractapi.TransactionContextInterface, auctionID string) (*EnergyAsset, error) {
+	auction, err := e.GetDutchAuction(ctx, auctionID)
+	if err != nil {
+		return nil, err
+	}
+	if auction.Status != AuctionOpen {
+		return nil, fmt.Errorf("auction %s is %s", auctionID, auction.Status)
+	}
+	buyer, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if buyer == auction.Seller {
+		return nil, fmt.Errorf("seller %s cannot accept its own auction", buyer)
+	}
+	for _, address := range []string{buyer, auction.Seller} {
+		if _, err := requireApprovedParticipant(ctx, address); err != nil {
+			return nil, err
+		}
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.Format(time.RFC3339) >= auction.DeliveryStart {
+		return nil, fmt.Errorf("auction %s closed at delivery start %s", auctionID, auction.DeliveryStart)
+	}
+	price, err := askingPrice(auction, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireNewTokenID(ctx, auctionID); err != nil {
+		return nil, err
+	}
+	privateDetailsHash, err := putPrivateDetails(ctx, buyer, auction.Seller, &TradePrivateDetails{
+		TokenID:          auctionID,
+		TransactionPrice: price,
+		Salt:             ctx.GetStub().GetTxID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	asset := &EnergyAsset{
+		TokenID:            auctionID,
+		BuyerAddress:       buyer,
+		SellerAddress:      auction.Seller,
+		EnergyAmount:       auction.Energy,
+		SourceType:         auction.SourceType,
+		Timestamp:          now.Format(time.RFC3339),
+		DeliveryStart:      auction.DeliveryStart,
+		DeliveryEnd:        auction.DeliveryEnd,
+		AuctionID:          auctionID,
+		PrivateDetailsHash: privateDetailsHash,
+	}
+	if err := confirmTrade(ctx, asset, price); err != nil {
+		return nil, err
+	}
+	if err := recordTrade(ctx, asset); err != nil {
+		return nil, err
+	}
+	auction.Status = AuctionSold
+	auction.Buyer = buyer
+	auction.SalePrice = price
+	auction.ClosedAt = now.Format(time.RFC3339)
+	if err := putDutchAuction(ctx, auction); err != nil {
+		return nil, err
+	}
+	if err := emitEvent(ctx, EventDutchAuctionChanged, auction); err != nil {
+		return nil, err
+	}
+	return asset, emitEvent(ctx, EventTradeConfirmed, newTradeEvent(asset))
+}
+
+// CancelDutchAuction withdraws an open auction; only its seller may call it
+func (e *EnergyTradingContract) CancelDutchAuction(ctx contractapi.TransactionContextInterface, auctionID string) (*DutchAuction, error) {
+	auction, err := e.GetDutchAuction(ctx, auctionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, auction.Seller); err != nil {
+		return nil, err
+	}
+	if auction.Status != AuctionOpen {
+		return nil, fmt.Errorf("auction %s is %s", auctionID, auction.Status)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	auction.Status = AuctionCancelled
+	auction.ClosedAt = now
+	if err := putDutchAuction(ctx, auction); err != nil {
+		return nil, err
+	}
+	return auction, emitEvent(ctx, EventDutchAuctionChanged, auction)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestDutchAuctionAccept(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	postTestReferencePrice(t, e, tc, 0.2)
+
+	tc.as("seller1", "")
+	_, err := e.StartDutchAuction(tc, "dutch1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid, 0.15, 0.2, 0.05, 30)
+	require.EqualError(t, err, "start price 0.15 is below floor price 0.2")
+	_, err = e.StartDutchAuction(tc, "dutch1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid, 0.4, 0.2, 0.05, 30)
+	require.Error(t, err)
+	auction, err := e.StartDutchAuction(tc, "dutch1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid, 0.3, 0.2, 0.05, 30)
+	require.NoError(t, err)
+	require.Equal(t, AuctionOpen, auction.Status)
+	open, err := e.GetOpenDutchAuctions(tc, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, open.Records, 1)
+
+	// The price drops one step every 30 minutes down to the floor
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 1, 9, 45, 0, 0, time.UTC)), nil)
+	price, err := e.GetDutchAuctionPrice(tc, "dutch1")
+	require.NoError(t, err)
+	require.Equal(t, 0.2, price)
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 1, 8, 45, 0, 0, time.UTC)), nil)
+	price, err = e.GetDutchAuctionPrice(tc, "dutch1")
+	require.NoError(t, err)
+	require.InDelta(t, 0.25, price, 1e-9)
+
+	_, err = e.AcceptDutchAuction(tc, "dutch1")
+	require.EqualError(t, err, "seller seller1 cannot accept its own auction")
+	asset, err := e.AcceptDutchAuction(tc.as("buyer1", ""), "dutch1")
+	require.NoError(t, err)
+	require.Equal(t, StateConfirmed, asset.TransactionState)
+	require.Equal(t, "dutch1", asset.AuctionID)
+	details, err := e.ReadTradePrivateDetails(tc, "dutch1")
+	require.NoError(t, err)
+	require.InDelta(t, 0.25, details.TransactionPrice, 1e-9)
+	auction, err = e.GetDutchAuction(tc, "dutch1")
+	require.NoError(t, err)
+	require.Equal(t, AuctionSold, auction.Status)
+	require.Equal(t, "buyer1", auction.Buyer)
+	_, err = e.AcceptDutchAuction(tc, "dutch1")
+	require.EqualError(t, err, "auction dutch1 is SOLD")
+}
+
+func TestDutchAuctionCancelAndClose(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+
+	tc.as("seller1", "")
+	_, err := e.StartDutchAuction(tc, "dutch1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid, 0.3, 0.2, 0.05, 30)
+	require.NoError(t, err)
+	_, err = e.StartDutchAuction(tc, "dutch2", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid, 0.3, 0.2, 0.05, 30)
+	require.NoError(t, err)
+	_, err = e.CancelDutchAuction(tc.as("buyer1", ""), "dutch1")
+	require.EqualError(t, err, "caller buyer1 is not authorized to act for seller1")
+	auction, err := e.CancelDutchAuction(tc.as("seller1", ""), "dutch1")
+	require.NoError(t, err)
+	require.Equal(t, AuctionCancelled, auction.Status)
+
+	// Nobody can buy once delivery has started
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 10, 0, 0, 0, time.UTC)), nil)
+	_, err = e.AcceptDutchAuction(tc.as("buyer1", ""), "dutch2")
+	require.EqualError(t, err, "auction dutch2 closed at delivery start 2025-05-03T10:00:00Z")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// partyOrgs returns the MSP IDs of the organizations of the given participants
+func partyOrgs(ctx contractapi.TransactionContextInterface, addresses ...string) ([]string, error) {
+	orgs := []string{}
+	for _, address := range addresses {
+		participant, err := getParticipant(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		if participant == nil || participant.MSPID == "" {
+			return nil, fmt.Errorf("organization of participant %s is unknown", address)
+		}
+		orgs = append(orgs, participant.MSPID)
+	}
+	return orgs, nil
+}
+
+// setTradeEndorsementPolicy requires a peer of each party's organization to
+// endorse any later update of the trade, so neither side's organization can
+// alter a bilateral trade on its own.
+func setTradeEndorsementPolicy(ctx contractapi.TransactionContextInterface, asset *EnergyAsset) error {
+	orgs, err := partyOrgs(ctx, asset.BuyerAddress, asset.SellerAddress)
+	if err != nil {
+		return err
+	}
+
+	endorsementPolicy, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return err
+	}
+	if err := endorsementPolicy.AddOrgs(statebased.RoleTypePeer, orgs...); err != nil {
+		return fmt.Errorf("failed to add orgs to endorsement policy: %v", err)
+	}
+	policy, err := endorsementPolicy.Policy()
+	if err != nil {
+		return fmt.Errorf("failed to create endorsement policy bytes: %v", err)
+	}
+	if err := ctx.GetStub().SetStateValidationParameter(asset.TokenID, policy); err != nil {
+		return fmt.Errorf("failed to set validation parameter on asset %s: %v", asset.TokenID, err)
+	}
+	return nil
+}
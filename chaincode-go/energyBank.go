@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// DefaultBankRoundTripLoss is the share of deposited energy lost to the
+// round trip through the energy bank until an admin sets another
+const DefaultBankRoundTripLoss = 0.1
+
+// energyBankConfigKey is the state key of the energy bank configuration
+const energyBankConfigKey = "energybankconfig"
+
+// Energy bank entry kinds
+const (
+	BankDeposit          = "DEPOSIT"
+	BankWithdrawal       = "WITHDRAWAL"
+	BankPoolContribution = "POOL_CONTRIBUTION"
+)
+
+// EnergyBankConfig holds the round-trip loss factor of the energy bank
+type EnergyBankConfig struct {
+	RoundTripLoss float64 `json:"roundTripLoss"`
+	UpdatedBy     string  `json:"updatedBy,omitempty"`
+	UpdatedAt     string  `json:"updatedAt,omitempty"`
+}
+
+// EnergyCreditAccount is a participant's balance of banked energy in kWh.
+// Prosumers deposit the metered surplus of intervals in which they did not
+// trade, for example over the summer, and withdraw it against their net
+// consumption in later intervals, for example over the winter.
+type EnergyCreditAccount struct {
+	Participant string  `json:"participant"`
+	Balance     float64 `json:"balance"`
+	Deposited   float64 `json:"deposited"`
+	Withdrawn   float64 `json:"withdrawn"`
+	Version     int64   `json:"version"`
+}
+
+// EnergyBankEntry records a deposit, withdrawal or pool contribution for one
+// interval. Metered is the participant's net injection (deposits and pool
+// contributions) or net consumption (withdrawals) in the interval; Credit is
+// the change to its balance. Each interval is banked at most once, so the
+// entries let a utility net banked energy off a participant's bill.
+type EnergyBankEntry struct {
+	Participant   string  `json:"participant"`
+	IntervalStart string  `json:"intervalStart"`
+	Kind          string  `json:"kind"`
+	Metered       float64 `json:"metered"`
+	Credit        float64 `json:"credit"`
+	PoolID        string  `json:"poolID,omitempty"`
+	TxID          string  `json:"txID"`
+	RecordedAt    string  `json:"recordedAt"`
+}
+
+// PaginatedEnergyBankResult is a page of energy bank entries
+type PaginatedEnergyBankResult struct {
+	Records             []*EnergyBankEntry `json:"records"`
+	FetchedRecordsCount int32              `json:"fetchedRecordsCount"`
+	Bookmark            string             `json:"bookmark"`
+}
+
+func energyCreditKey(ctx contractapi.TransactionContextInterface, participant string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("energycredit", []string{participant})
+}
+
+func energyBankEntryKey(ctx contractapi.TransactionContextInterface, participant, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("energybank", []string{participant, intervalStart})
+}
+
+// SetEnergyBankLoss sets the share of deposited energy lost to the round trip
+func (e *EnergyTradingContract) SetEnergyBankLoss(ctx contractapi.TransactionContextInterface, roundTripLoss float64) (*EnergyBankConfig, error) {
+	if roundTripLoss < 0 || roundTripLoss >= 1 {
+		return nil, fmt.Errorf("round-trip loss must be in [0, 1)")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config := &EnergyBankConfig{RoundTripLoss: roundTripLoss, UpdatedBy: caller, UpdatedAt: now}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(energyBankConfigKey, configJSON); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// GetEnergyBankConfig returns the energy bank configuration in force
+func (e *EnergyTradingContract) GetEnergyBankConfig(ctx contractapi.TransactionContextInterface) (*EnergyBankConfig, error) {
+	configJSON, err := ctx.GetStub().GetState(energyBankConfigKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read energy bank config: %v", err)
+	}
+	if configJSON == nil {
+		return &EnergyBankConfig{RoundTripLoss: DefaultBankRoundTripLoss}, nil
+	}
+	var config EnergyBankConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// GetEnergyCreditAccount returns a participant's banked energy; a participant
+// that never banked has an empty account
+func (e *EnergyTradingContract) GetEnergyCreditAccount(ctx contractapi.TransactionContextInterface, participant string) (*EnergyCreditAccount, error) {
+	key, err := energyCreditKey(ctx, participant)
+	if err != nil {
+		return nil, err
+	}
+	accountJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read energy credit account: %v", err)
+	}
+	if accountJSON == nil {
+		return &EnergyCreditAccount{Participant: participant}, nil
+	}
+	var account EnergyCreditAccount
+	if err := json.Unmarshal(accountJSON, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func putEnergyCreditAccount(ctx contractapi.TransactionContextInterface, account *EnergyCreditAccount) error {
+	account.Version++
+	accountJSON, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	key, err := energyCreditKey(ctx, account.Participant)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, accountJSON)
+}
+
+// GetEnergyBankEntries returns a page of a participant's deposits and
+// withdrawals in interval order
+func (e *EnergyTradingContract) GetEnergyBankEntries(ctx contractapi.TransactionContextInterface, participant string, pageSize int32, bookmark string) (*PaginatedEnergyBankResult, error) {
+	result := &PaginatedEnergyBankResult{Records: []*EnergyBankEntry{}}
+	metadata, err := queryPage(ctx, "energybank", []string{participant}, pageSize, bookmark, func(value []byte) error {
+		var entry EnergyBankEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// bankableInterval checks that the caller may bank an ended interval: it
+// has not banked the interval yet and has no trades delivering in it, whose
+// deviations settle against the grid instead. It returns the interval's
+// entry, with Metered set to the caller's net injection, and its key.
+func bankableInterval(ctx contractapi.TransactionContextInterface, intervalStart string) (*EnergyBankEntry, string, error) {
+	participant, err := callerAddress(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := requireApprovedParticipant(ctx, participant); err != nil {
+		return nil, "", err
+	}
+	intervalStart, length, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, "", err
+	}
+	start, err := parseTimestamp(intervalStart)
+	if err != nil {
+		return nil, "", err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	intervalEnd := start.Add(length)
+	if now.Before(intervalEnd) {
+		return nil, "", fmt.Errorf("interval %s has not ended", intervalStart)
+	}
+	key, err := energyBankEntryKey(ctx, participant, intervalStart)
+	if err != nil {
+		return nil, "", err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read energy bank entry: %v", err)
+	}
+	if existing != nil {
+		return nil, "", fmt.Errorf("participant %s has already banked interval %s", participant, intervalStart)
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("slottrade", []string{intervalStart})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		asset, err := (&EnergyTradingContract{}).ReadEnergyAsset(ctx, string(queryResponse.Value))
+		if err != nil {
+			return nil, "", err
+		}
+		if asset.BuyerAddress == participant || asset.SellerAddress == participant {
+			return nil, "", fmt.Errorf("participant %s trades in interval %s", participant, intervalStart)
+		}
+	}
+
+	injected, consumed, found, err := meteredEnergy(ctx, participant, intervalStart, intervalEnd.Format(time.RFC3339))
+	if err != nil {
+		return nil, "", err
+	}
+	if !found {
+		return nil, "", fmt.Errorf("participant %s has no meter readings for %s", participant, intervalStart)
+	}
+	return &EnergyBankEntry{Participant: participant, IntervalStart: intervalStart, Metered: injected - consumed}, key, nil
+}
+
+// putEnergyBankEntry records an interval's entry and updates the account
+func putEnergyBankEntry(ctx contractapi.TransactionContextInterface, key string, entry *EnergyBankEntry, account *EnergyCreditAccount) error {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	entry.TxID = ctx.GetStub().GetTxID()
+	entry.RecordedAt = now
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, entryJSON); err != nil {
+		return err
+	}
+	return putEnergyCreditAccount(ctx, account)
+}
+
+// DepositSurplusEnergy banks the caller's metered surplus of an ended
+// interval in which it did not trade. The balance is credited with the
+// surplus less the round-trip loss.
+func (e *EnergyTradingContract) DepositSurplusEnergy(ctx contractapi.TransactionContextInterface, intervalStart string) (*EnergyCreditAccount, error) {
+	entry, key, err := bankableInterval(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Metered <= 0 {
+		return nil, fmt.Errorf("participant %s has no surplus in interval %s", entry.Participant, entry.IntervalStart)
+	}
+	config, err := e.GetEnergyBankConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	account, err := e.GetEnergyCreditAccount(ctx, entry.Participant)
+	if err != nil {
+		return nil, err
+	}
+	entry.Kind = BankDeposit
+	entry.Credit = entry.Metered * (1 - config.RoundTripLoss)
+	account.Balance += entry.Credit
+	account.Deposited += entry.Credit
+	if err := putEnergyBankEntry(ctx, key, entry, account); err != nil {
+		return nil, err
+	}
+	return account, emitEvent(ctx, EventEnergyBanked, entry)
+}
+
+// WithdrawBankedEnergy covers the caller's metered net consumption of an
+// ended interval in which it did not trade from its banked energy, up to its
+// balance
+func (e *EnergyTradingContract) WithdrawBankedEnergy(ctx contractapi.TransactionContextInterface, intervalStart string) (*EnergyCreditAccount, error) {
+	entry, key, err := bankableInterval(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Metered >= 0 {
+		return nil, fmt.Errorf("participant %s has no net consumption in interval %s", entry.Participant, entry.IntervalStart)
+	}
+	account, err := e.GetEnergyCreditAccount(ctx, entry.Participant)
+	if err != nil {
+		return nil, err
+	}
+	if account.Balance <= 0 {
+		return nil, fmt.Errorf("participant %s has no banked energy", entry.Participant)
+	}
+	entry.Kind = BankWithdrawal
+	entry.Metered = -entry.Metered
+	withdrawal := math.Min(entry.Metered, account.Balance)
+	entry.Credit = -withdrawal
+	account.Balance -= withdrawal
+	account.Withdrawn += withdrawal
+	if err := putEnergyBankEntry(ctx, key, entry, account); err != nil {
+		return nil, err
+	}
+	return account, emitEvent(ctx, EventEnergyBanked, entry)
+}
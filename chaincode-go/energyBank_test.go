@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestEnergyBank(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestParticipant(t, e, tc, "seller2", RoleProsumer)
+	meterID := registerTestMeter(t, e, tc, "seller2")
+
+	config, err := e.GetEnergyBankConfig(tc)
+	require.NoError(t, err)
+	require.Equal(t, DefaultBankRoundTripLoss, config.RoundTripLoss)
+	_, err = e.SetEnergyBankLoss(tc.as("admin1", RoleAdmin), 1)
+	require.EqualError(t, err, "round-trip loss must be in [0, 1)")
+	_, err = e.SetEnergyBankLoss(tc, 0.2)
+	require.NoError(t, err)
+
+	_, err = e.DepositSurplusEnergy(tc.as("seller2", ""), "2025-05-03T10:00:00Z")
+	require.EqualError(t, err, "interval 2025-05-03T10:00:00Z has not ended")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	_, err = e.DepositSurplusEnergy(tc, "2025-05-03T10:00:00Z")
+	require.EqualError(t, err, "participant seller2 has no meter readings for 2025-05-03T10:00:00Z")
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "seller2", 2, 0)
+
+	// Surplus of intervals with trades settles against the grid instead
+	_, err = e.DepositSurplusEnergy(tc.as("seller1", ""), "2025-05-03T10:00:00Z")
+	require.EqualError(t, err, "participant seller1 trades in interval 2025-05-03T10:00:00Z")
+	account, err := e.DepositSurplusEnergy(tc.as("seller2", ""), "2025-05-03T10:00:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 1.6, account.Balance, 1e-9)
+	_, err = e.DepositSurplusEnergy(tc, "2025-05-03T10:00:00Z")
+	require.EqualError(t, err, "participant seller2 has already banked interval 2025-05-03T10:00:00Z")
+	_, err = e.WithdrawBankedEnergy(tc, "2025-05-03T10:15:00Z")
+	require.EqualError(t, err, "participant seller2 has no net consumption in interval 2025-05-03T10:15:00Z")
+
+	// Withdrawals cover net consumption up to the balance
+	signature := tc.signReading(t, meterID, "2025-05-03T11:00:00Z", 0, 3)
+	require.NoError(t, e.SubmitMeterReading(tc, meterID, "2025-05-03T11:00:00Z", 0, 3, signature))
+	account, err = e.WithdrawBankedEnergy(tc, "2025-05-03T11:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, account.Balance)
+	require.InDelta(t, 1.6, account.Withdrawn, 1e-9)
+
+	entries, err := e.GetEnergyBankEntries(tc, "seller2", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, entries.Records, 2)
+	require.Equal(t, BankDeposit, entries.Records[0].Kind)
+	require.Equal(t, 2.0, entries.Records[0].Metered)
+	require.Equal(t, BankWithdrawal, entries.Records[1].Kind)
+	require.Equal(t, 3.0, entries.Records[1].Metered)
+	require.InDelta(t, -1.6, entries.Records[1].Credit, 1e-9)
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventEnergyBanked, name)
+}
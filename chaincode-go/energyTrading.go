@@ -3,8 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"os"
 
+	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
@@ -13,25 +14,48 @@ type EnergyTradingContract struct {
 	contractapi.Contract
 }
 
-// EnergyAsset defines the energy trading asset structure
+// EnergyAsset defines the energy trading asset structure. The price and
+// deposits live in the trade collection of the parties' organizations;
+// PrivateDetailsHash commits to them.
 type EnergyAsset struct {
-	TokenID          string  `json:"tokenID"`
-	BuyerAddress     string  `json:"buyerAddress"`
-	SellerAddress    string  `json:"sellerAddress"`
-	EnergyAmount     float64 `json:"energyAmount"`
-	TransactionPrice float64 `json:"transactionPrice"`
-	Timestamp        string  `json:"timestamp"`
-	BuyerDeposit     float64 `json:"buyerDeposit"`
-	SellerDeposit    float64 `json:"sellerDeposit"`
-	TransactionState string  `json:"transactionState"`
-	BuyerSignature   string  `json:"buyerSignature,omitempty"`
-	SellerSignature  string  `json:"sellerSignature,omitempty"`
+	TokenID            string           `json:"tokenID"`
+	BuyerAddress       string           `json:"buyerAddress"`
+	SellerAddress      string           `json:"sellerAddress"`
+	EnergyAmount       float64          `json:"energyAmount"`
+	SourceType         string           `json:"sourceType,omitempty"`
+	Timestamp          string           `json:"timestamp"`
+	DeliveryStart      string           `json:"deliveryStart"`
+	DeliveryEnd        string           `json:"deliveryEnd"`
+	TransactionState   string           `json:"transactionState"`
+	BuyerSignature     string           `json:"buyerSignature,omitempty"`
+	SellerSignature    string           `json:"sellerSignature,omitempty"`
+	Archived           bool             `json:"archived,omitempty"`
+	CurtailedEnergy    float64          `json:"curtailedEnergy,omitempty"`
+	NetworkFeeRate     float64          `json:"networkFeeRate,omitempty"`
+	LossFactor         float64          `json:"lossFactor,omitempty"`
+	ForwardID          string           `json:"forwardID,omitempty"`
+	Indexation         *PriceIndexation `json:"indexation,omitempty"`
+	OptionID           string           `json:"optionID,omitempty"`
+	AuctionID          string           `json:"auctionID,omitempty"`
+	ClearingRoundID    string           `json:"clearingRoundID,omitempty"`
+	PrivateDetailsHash string           `json:"privateDetailsHash"`
+	Version            int64            `json:"version"`
 }
 
+// Trade states
+const (
+	StateCreated   = "CREATED"
+	StateConfirmed = "CONFIRMED"
+	StateDelivered = "DELIVERED"
+	StateSettled   = "SETTLED"
+	StateCancelled = "CANCELLED"
+)
+
 // TokenAccount defines a token account structure
 type TokenAccount struct {
 	AccountID string  `json:"accountID"`
 	Balance   float64 `json:"balance"`
+	Version   int64   `json:"version"`
 }
 
 // Reputation defines the participant's reputation structure
@@ -43,8 +67,115 @@ type Reputation struct {
 // ReputationPenaltyThreshold is the minimum acceptable reputation score
 const ReputationPenaltyThreshold = 40.0
 
-// InitLedger initializes ledger with energy assets and token accounts
-func (e *EnergyTradingContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
+// Ledger environments
+const (
+	EnvironmentProduction = "production"
+	EnvironmentTest       = "test"
+)
+
+// ledgerInfoKey is the state key of the ledger's initialization record
+const ledgerInfoKey = "ledgerinfo"
+
+// LedgerInfo records the one-time initialization of the ledger
+type LedgerInfo struct {
+	Environment    string `json:"environment"`
+	InitializedBy  string `json:"initializedBy"`
+	InitializedAt  string `json:"initializedAt"`
+	DemoDataSeeded bool   `json:"demoDataSeeded,omitempty"`
+}
+
+func putLedgerInfo(ctx contractapi.TransactionContextInterface, info *LedgerInfo) error {
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(ledgerInfoKey, infoJSON)
+}
+
+// GetLedgerInfo returns the ledger's initialization record
+func (e *EnergyTradingContract) GetLedgerInfo(ctx contractapi.TransactionContextInterface) (*LedgerInfo, error) {
+	infoJSON, err := ctx.GetStub().GetState(ledgerInfoKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger info: %v", err)
+	}
+	if infoJSON == nil {
+		return nil, fmt.Errorf("ledger has not been initialized")
+	}
+	var info LedgerInfo
+	if err := json.Unmarshal(infoJSON, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// InitLedger marks the ledger as initialized for an environment, production
+// or test. It runs once; a second call fails instead of resetting state.
+func (e *EnergyTradingContract) InitLedger(ctx contractapi.TransactionContextInterface, environment string) error {
+	if environment != EnvironmentProduction && environment != EnvironmentTest {
+		return fmt.Errorf("environment must be %s or %s", EnvironmentProduction, EnvironmentTest)
+	}
+	existing, err := ctx.GetStub().GetState(ledgerInfoKey)
+	if err != nil {
+		return fmt.Errorf("failed to read ledger info: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("ledger has already been initialized")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	return putLedgerInfo(ctx, &LedgerInfo{Environment: environment, InitializedBy: caller, InitializedAt: now})
+}
+
+// SeedDemoData adds demo participants, token accounts, a trade and
+// reputations. It is only available on a ledger initialized for the test
+// environment, and runs once.
+func (e *EnergyTradingContract) SeedDemoData(ctx contractapi.TransactionContextInterface) error {
+	info, err := e.GetLedgerInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if info.Environment != EnvironmentTest {
+		return fmt.Errorf("demo data can only be seeded in the %s environment", EnvironmentTest)
+	}
+	if info.DemoDataSeeded {
+		return fmt.Errorf("demo data has already been seeded")
+	}
+	info.DemoDataSeeded = true
+	if err := putLedgerInfo(ctx, info); err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// 初始化参与者
+	participants := []Participant{
+		{Address: "buyer1", Zone: "zone1", Role: RoleConsumer, MSPID: "Org1MSP", KYCStatus: KYCApproved, RegisteredAt: now, ReviewedAt: now},
+		{Address: "seller1", Zone: "zone1", Role: RoleProsumer, MSPID: "Org2MSP", KYCStatus: KYCApproved, RegisteredAt: now, ReviewedAt: now},
+	}
+
+	personalData := []ParticipantPersonalData{
+		{Address: "buyer1", DisplayName: "Demo Buyer", Salt: "demo"},
+		{Address: "seller1", DisplayName: "Demo Seller", Salt: "demo"},
+	}
+
+	for i, participant := range participants {
+		participant.PersonalDataHash, err = putPersonalData(ctx, &personalData[i])
+		if err != nil {
+			return err
+		}
+		if err := putParticipant(ctx, &participant); err != nil {
+			return err
+		}
+	}
+
 	// 初始化账户余额
 	accounts := []TokenAccount{
 		{AccountID: "buyer1", Balance: 100.0},
@@ -52,11 +183,7 @@ func (e *EnergyTradingContract) InitLedger(ctx contractapi.TransactionContextInt
 	}
 
 	for _, account := range accounts {
-		accountJSON, err := json.Marshal(account)
-		if err != nil {
-			return err
-		}
-		if err := ctx.GetStub().PutState(account.AccountID, accountJSON); err != nil {
+		if err := putTokenAccount(ctx, &account); err != nil {
 			return err
 		}
 	}
@@ -68,22 +195,28 @@ func (e *EnergyTradingContract) InitLedger(ctx contractapi.TransactionContextInt
 			BuyerAddress:     "buyer1",
 			SellerAddress:    "seller1",
 			EnergyAmount:     100.0,
-			TransactionPrice: 0.25,
-			Timestamp:        "2025-05-03T10:00:00Z",
-			BuyerDeposit:     10.0,
-			SellerDeposit:    10.0,
-			TransactionState: "CREATED",
-			BuyerSignature:   "buyer_signature_example",
-			SellerSignature:  "seller_signature_example",
+			Timestamp:        now,
+			DeliveryStart:    "2025-05-03T10:00:00Z",
+			DeliveryEnd:      "2025-05-03T11:00:00Z",
+			TransactionState: StateCreated,
 		},
 	}
+	privateDetails := []TradePrivateDetails{
+		{TokenID: "energy1", TransactionPrice: 0.25, BuyerDeposit: 10.0, SellerDeposit: 10.0, Salt: "demo"},
+	}
 
-	for _, asset := range assets {
-		assetJSON, err := json.Marshal(asset)
+	for i, asset := range assets {
+		asset.PrivateDetailsHash, err = putPrivateDetails(ctx, asset.BuyerAddress, asset.SellerAddress, &privateDetails[i])
 		if err != nil {
 			return err
 		}
-		if err := ctx.GetStub().PutState(asset.TokenID, assetJSON); err != nil {
+		if err := putEnergyAsset(ctx, &asset); err != nil {
+			return err
+		}
+		if err := putDeliveryIndex(ctx, asset.DeliveryStart, asset.TokenID); err != nil {
+			return err
+		}
+		if err := setTradeEndorsementPolicy(ctx, &asset); err != nil {
 			return err
 		}
 	}
@@ -99,7 +232,11 @@ func (e *EnergyTradingContract) InitLedger(ctx contractapi.TransactionContextInt
 		if err != nil {
 			return err
 		}
-		if err := ctx.GetStub().PutState(rep.ParticipantAddress, repJSON); err != nil {
+		key, err := reputationKey(ctx, rep.ParticipantAddress)
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().PutState(key, repJSON); err != nil {
 			return err
 		}
 	}
@@ -110,12 +247,26 @@ func (e *EnergyTradingContract) InitLedger(ctx contractapi.TransactionContextInt
 // Energy asset methods
 func (e *EnergyTradingContract) ReadEnergyAsset(ctx contractapi.TransactionContextInterface, tokenID string) (*EnergyAsset, error) {
 	assetJSON, err := ctx.GetStub().GetState(tokenID)
-	if err != nil || assetJSON == nil {
+	if err != nil {
+		return nil, fmt.Errorf("failed to read asset %s: %v", tokenID, err)
+	}
+	if assetJSON == nil {
 		return nil, fmt.Errorf("asset %s does not exist", tokenID)
 	}
 	var asset EnergyAsset
-	err = json.Unmarshal(assetJSON, &asset)
-	return &asset, err
+	if err := json.Unmarshal(assetJSON, &asset); err != nil {
+		return nil, err
+	}
+	return &asset, nil
+}
+
+func putEnergyAsset(ctx contractapi.TransactionContextInterface, asset *EnergyAsset) error {
+	asset.Version++
+	assetJSON, err := json.Marshal(asset)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(asset.TokenID, assetJSON)
 }
 
 func (e *EnergyTradingContract) EnergyAssetExists(ctx contractapi.TransactionContextInterface, tokenID string) (bool, error) {
@@ -123,39 +274,224 @@ func (e *EnergyTradingContract) EnergyAssetExists(ctx contractapi.TransactionCon
 	return assetJSON != nil, err
 }
 
-func (e *EnergyTradingContract) CreateEnergyAsset(ctx contractapi.TransactionContextInterface, tokenID, buyerAddress, sellerAddress string, energyAmount, transactionPrice float64, timestamp string, buyerDeposit, sellerDeposit float64) error {
+// requireNewTokenID checks that a token ID names neither an existing asset nor
+// a pruned trade, whose ID stays taken so that its rollups and events keep
+// referring to one trade
+func requireNewTokenID(ctx contractapi.TransactionContextInterface, tokenID string) error {
+	exists, err := (&EnergyTradingContract{}).EnergyAssetExists(ctx, tokenID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("asset %s already exists", tokenID)
+	}
+	pruned, err := tradePruned(ctx, tokenID)
+	if err != nil {
+		return err
+	}
+	if pruned {
+		return fmt.Errorf("token ID %s belonged to a pruned trade", tokenID)
+	}
+	return nil
+}
+
+// CreateEnergyAsset records a bilateral trade. The price and deposits are read
+// from the "trade_private" transient entry and stored in the trade collection
+// of the parties' organizations, with only their hash written to public state.
+// The source type labels the origin of the energy and must be backed by one of
+// the seller's devices.
+func (e *EnergyTradingContract) CreateEnergyAsset(ctx contractapi.TransactionContextInterface, tokenID, buyerAddress, sellerAddress string, energyAmount float64, deliveryStart, deliveryEnd, sourceType string) error {
+	if _, err := actFor(ctx, ScopeCreateTrade, tokenID, energyAmount, buyerAddress, sellerAddress); err != nil {
+		return err
+	}
+	if _, err := requireApprovedParticipant(ctx, buyerAddress); err != nil {
+		return err
+	}
+	if _, err := requireApprovedParticipant(ctx, sellerAddress); err != nil {
+		return err
+	}
 	penalty, err := e.CheckReputationPenalty(ctx, buyerAddress)
-	if penalty || err != nil {
+	if err != nil {
+		return err
+	}
+	if penalty {
 		return fmt.Errorf("buyer %s reputation too low", buyerAddress)
 	}
 	penalty, err = e.CheckReputationPenalty(ctx, sellerAddress)
-	if penalty || err != nil {
+	if err != nil {
+		return err
+	}
+	if penalty {
 		return fmt.Errorf("seller %s reputation too low", sellerAddress)
 	}
-	exists, err := e.EnergyAssetExists(ctx, tokenID)
-	if exists || err != nil {
-		return fmt.Errorf("asset %s already exists", tokenID)
+	if err := requireNewTokenID(ctx, tokenID); err != nil {
+		return err
+	}
+	deliveryStart, deliveryEnd, err = validateDeliveryWindow(ctx, deliveryStart, deliveryEnd)
+	if err != nil {
+		return err
+	}
+	if err := validateSourceType(ctx, sellerAddress, sourceType); err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	privateDetails, err := readTransientPrivateDetails(ctx, tokenID)
+	if err != nil {
+		return err
+	}
+	if err := validatePriceBand(ctx, privateDetails.TransactionPrice); err != nil {
+		return err
+	}
+	if err := checkTradeIslanding(ctx, sellerAddress, buyerAddress, privateDetails.TransactionPrice); err != nil {
+		return err
+	}
+	privateDetailsHash, err := putPrivateDetails(ctx, buyerAddress, sellerAddress, privateDetails)
+	if err != nil {
+		return err
 	}
 
 	asset := EnergyAsset{
-		TokenID:          tokenID,
-		BuyerAddress:     buyerAddress,
-		SellerAddress:    sellerAddress,
-		EnergyAmount:     energyAmount,
-		TransactionPrice: transactionPrice,
-		Timestamp:        timestamp,
-		BuyerDeposit:     buyerDeposit,
-		SellerDeposit:    sellerDeposit,
-		TransactionState: "CREATED",
+		TokenID:            tokenID,
+		BuyerAddress:       buyerAddress,
+		SellerAddress:      sellerAddress,
+		EnergyAmount:       energyAmount,
+		SourceType:         sourceType,
+		Timestamp:          now,
+		DeliveryStart:      deliveryStart,
+		DeliveryEnd:        deliveryEnd,
+		TransactionState:   StateCreated,
+		PrivateDetailsHash: privateDetailsHash,
 	}
-	assetJSON, err := json.Marshal(asset)
+	if err := recordTrade(ctx, &asset); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventAssetCreated, newTradeEvent(&asset))
+}
+
+// recordTrade stores a new trade with its endorsement policy and indexes
+func recordTrade(ctx contractapi.TransactionContextInterface, asset *EnergyAsset) error {
+	if err := putEnergyAsset(ctx, asset); err != nil {
+		return err
+	}
+	if err := setTradeEndorsementPolicy(ctx, asset); err != nil {
+		return err
+	}
+	if err := putDeliveryIndex(ctx, asset.DeliveryStart, asset.TokenID); err != nil {
+		return err
+	}
+	return putSourceTradeIndex(ctx, asset.SourceType, asset.TokenID)
+}
+
+// SignEnergyAsset verifies the caller's ECDSA signature over the trade terms
+// (see GetSigningPayload) against its registered public key and records it on
+// the side of the trade the caller acts for. The side is derived from the
+// caller's identity, so only the buyer (or its authorized delegate) can sign
+// as buyer and only the seller as seller. Once both sides have signed the
+// trade is confirmed.
+func (e *EnergyTradingContract) SignEnergyAsset(ctx contractapi.TransactionContextInterface, tokenID, signatureBase64 string, expectedVersion int64) error {
+	asset, err := e.ReadEnergyAsset(ctx, tokenID)
 	if err != nil {
 		return err
 	}
-	return ctx.GetStub().PutState(tokenID, assetJSON)
+	if err := checkVersion("asset", tokenID, asset.Version, expectedVersion); err != nil {
+		return err
+	}
+	party, err := actFor(ctx, ScopeSignTrade, tokenID, asset.EnergyAmount, asset.BuyerAddress, asset.SellerAddress)
+	if err != nil {
+		return err
+	}
+	if asset.TransactionState != StateCreated {
+		return fmt.Errorf("asset %s cannot be signed in state %s", tokenID, asset.TransactionState)
+	}
+
+	signer, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	participant, err := requireApprovedParticipant(ctx, signer)
+	if err != nil {
+		return err
+	}
+	publicKey, err := parsePublicKey(participant.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err := verifyTradeSignature(publicKey, asset, signatureBase64); err != nil {
+		return err
+	}
+
+	if party == asset.BuyerAddress {
+		asset.BuyerSignature = signatureBase64
+	} else {
+		asset.SellerSignature = signatureBase64
+	}
+	event := EventTradeSigned
+	if asset.BuyerSignature != "" && asset.SellerSignature != "" {
+		details, err := getPrivateDetails(ctx, asset)
+		if err != nil {
+			return err
+		}
+		if err := confirmTrade(ctx, asset, details.TransactionPrice); err != nil {
+			return err
+		}
+		event = EventTradeConfirmed
+	}
+	if err := putEnergyAsset(ctx, asset); err != nil {
+		return err
+	}
+	return emitEvent(ctx, event, newTradeEvent(asset))
+}
+
+// confirmTrade schedules a trade's grid flows, fixes its network fee and loss
+// factor and moves it to CONFIRMED. The caller stores the trade.
+func confirmTrade(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, price float64) error {
+	if err := checkTradeIslanding(ctx, asset.SellerAddress, asset.BuyerAddress, price); err != nil {
+		return err
+	}
+	if err := scheduleGridFlows(ctx, asset); err != nil {
+		return err
+	}
+	var err error
+	if asset.NetworkFeeRate, err = networkFeeRate(ctx, asset); err != nil {
+		return err
+	}
+	if asset.LossFactor, err = tradeLossFactor(ctx, asset); err != nil {
+		return err
+	}
+	asset.TransactionState = StateConfirmed
+	return nil
+}
+
+// ConfirmDelivery marks a confirmed trade as delivered; only the seller may call it
+func (e *EnergyTradingContract) ConfirmDelivery(ctx contractapi.TransactionContextInterface, tokenID string, expectedVersion int64) error {
+	asset, err := e.ReadEnergyAsset(ctx, tokenID)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion("asset", tokenID, asset.Version, expectedVersion); err != nil {
+		return err
+	}
+	if err := requireCaller(ctx, asset.SellerAddress); err != nil {
+		return err
+	}
+	if asset.TransactionState != StateConfirmed {
+		return fmt.Errorf("asset %s cannot be delivered in state %s", tokenID, asset.TransactionState)
+	}
+	asset.TransactionState = StateDelivered
+	if err := putEnergyAsset(ctx, asset); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventDeliveryRecorded, newTradeEvent(asset))
 }
 
 // Reputation methods (已补充)
+func reputationKey(ctx contractapi.TransactionContextInterface, participantAddress string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("reputation", []string{participantAddress})
+}
+
 func (e *EnergyTradingContract) UpdateReputationScore(ctx contractapi.TransactionContextInterface, participantAddress string, delta float64) error {
 	reputation, err := e.ReadReputationScore(ctx, participantAddress)
 	if err != nil {
@@ -168,31 +504,58 @@ func (e *EnergyTradingContract) UpdateReputationScore(ctx contractapi.Transactio
 		reputation.Score = 0
 	}
 	repJSON, err := json.Marshal(reputation)
-	return ctx.GetStub().PutState(participantAddress, repJSON)
+	if err != nil {
+		return err
+	}
+	key, err := reputationKey(ctx, participantAddress)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, repJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventReputationChanged, ReputationEvent{Address: participantAddress, Score: reputation.Score, Delta: delta})
 }
 
 func (e *EnergyTradingContract) ReadReputationScore(ctx contractapi.TransactionContextInterface, participantAddress string) (*Reputation, error) {
-	repJSON, err := ctx.GetStub().GetState(participantAddress)
-	if repJSON == nil || err != nil {
+	key, err := reputationKey(ctx, participantAddress)
+	if err != nil {
+		return nil, err
+	}
+	repJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reputation of %s: %v", participantAddress, err)
+	}
+	if repJSON == nil {
 		return &Reputation{ParticipantAddress: participantAddress, Score: 50}, nil
 	}
 	var rep Reputation
-	err = json.Unmarshal(repJSON, &rep)
-	return &rep, err
+	if err := json.Unmarshal(repJSON, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
 }
 
 func (e *EnergyTradingContract) CheckReputationPenalty(ctx contractapi.TransactionContextInterface, participantAddress string) (bool, error) {
 	reputation, err := e.ReadReputationScore(ctx, participantAddress)
-	return reputation.Score < ReputationPenaltyThreshold, err
+	if err != nil {
+		return false, err
+	}
+	return reputation.Score < ReputationPenaltyThreshold, nil
 }
 
 func main() {
-	cc, err := contractapi.NewChaincode(new(EnergyTradingContract))
+	contract := new(EnergyTradingContract)
+	contract.TransactionContextHandler = new(TransactionContext)
+	contract.BeforeTransaction = beforeTransaction
+	cc, err := contractapi.NewChaincode(contract)
 	if err != nil {
-		log.Panic(err)
+		processLog.Errorf("failed to create chaincode: %v", err)
+		os.Exit(1)
 	}
-	if err := cc.Start(); err != nil {
-		log.Panic(err)
+	processLog.Infof("starting chaincode with log level %s", chaincodeLogLevel)
+	if err := shim.Start(recoveringChaincode{cc}); err != nil {
+		processLog.Errorf("failed to start chaincode: %v", err)
+		os.Exit(1)
 	}
 }
-
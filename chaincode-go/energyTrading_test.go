@@ -0,0 +1,623 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric-samples/asset-transfer-basic/chaincode-go/chaincode/mocks"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//go:generate counterfeiter -o chaincode/mocks/clientidentity.go -fake-name ClientIdentity . clientIdentity
+type clientIdentity interface {
+	cid.ClientIdentity
+}
+
+var testTxTime = time.Date(2025, 5, 1, 8, 0, 0, 0, time.UTC)
+
+// testContext wires the counterfeiter fakes to an in-memory world state so
+// that multi-step flows can be exercised.
+type testContext struct {
+	*mocks.TransactionContext
+	stub     *mocks.ChaincodeStub
+	identity *mocks.ClientIdentity
+	state    map[string][]byte
+	private  map[string][]byte
+	attrs    map[string]string
+	keys     map[string]*ecdsa.PrivateKey
+}
+
+func newTestContext() *testContext {
+	tc := &testContext{
+		TransactionContext: &mocks.TransactionContext{},
+		stub:               &mocks.ChaincodeStub{},
+		identity:           &mocks.ClientIdentity{},
+		state:              map[string][]byte{},
+		private:            map[string][]byte{},
+		attrs:              map[string]string{},
+		keys:               map[string]*ecdsa.PrivateKey{},
+	}
+	tc.GetStubReturns(tc.stub)
+	tc.GetClientIdentityReturns(tc.identity)
+
+	tc.stub.GetStateStub = func(key string) ([]byte, error) {
+		return tc.state[key], nil
+	}
+	tc.stub.PutStateStub = func(key string, value []byte) error {
+		tc.state[key] = value
+		return nil
+	}
+	tc.stub.DelStateStub = func(key string) error {
+		delete(tc.state, key)
+		return nil
+	}
+	tc.stub.GetPrivateDataStub = func(collection, key string) ([]byte, error) {
+		return tc.private[collection+"/"+key], nil
+	}
+	tc.stub.PutPrivateDataStub = func(collection, key string, value []byte) error {
+		tc.private[collection+"/"+key] = value
+		return nil
+	}
+	tc.stub.CreateCompositeKeyStub = shim.CreateCompositeKey
+	tc.stub.SplitCompositeKeyStub = splitCompositeKey
+	tc.stub.GetStateByRangeStub = func(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+		return tc.iterator(startKey, endKey), nil
+	}
+	tc.stub.GetStateByRangeWithPaginationStub = func(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+		iterator, metadata := tc.page(startKey, endKey, pageSize, bookmark)
+		return iterator, metadata, nil
+	}
+	tc.stub.GetStateByPartialCompositeKeyStub = func(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+		prefix, err := shim.CreateCompositeKey(objectType, attributes)
+		if err != nil {
+			return nil, err
+		}
+		return tc.iterator(prefix, prefix+string(utf8.MaxRune)), nil
+	}
+	tc.stub.GetStateByPartialCompositeKeyWithPaginationStub = func(objectType string, attributes []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+		prefix, err := shim.CreateCompositeKey(objectType, attributes)
+		if err != nil {
+			return nil, nil, err
+		}
+		iterator, metadata := tc.page(prefix, prefix+string(utf8.MaxRune), pageSize, bookmark)
+		return iterator, metadata, nil
+	}
+	tc.stub.PurgePrivateDataStub = func(collection, key string) error {
+		delete(tc.private, collection+"/"+key)
+		return nil
+	}
+	tc.stub.GetTransientReturns(map[string][]byte{
+		tradePrivateTransientKey:        []byte(`{"transactionPrice":0.2,"buyerDeposit":1,"sellerDeposit":1,"salt":"s1"}`),
+		participantPersonalTransientKey: []byte(`{"displayName":"Test Participant","salt":"s2"}`),
+	}, nil)
+	tc.stub.GetTxTimestampReturns(timestamppb.New(testTxTime), nil)
+
+	tc.identity.GetIDReturns("x509::CN=test", nil)
+	tc.identity.GetMSPIDReturns("Org1MSP", nil)
+	tc.identity.GetAttributeValueStub = func(name string) (string, bool, error) {
+		value, found := tc.attrs[name]
+		return value, found, nil
+	}
+	return tc
+}
+
+// key returns the signing key of an address, generating it on first use
+func (tc *testContext) key(address string) *ecdsa.PrivateKey {
+	if tc.keys[address] == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		tc.keys[address] = key
+	}
+	return tc.keys[address]
+}
+
+// sign returns the address's base64 signature over the asset's signing payload
+func (tc *testContext) sign(t testing.TB, e *EnergyTradingContract, address, tokenID string) string {
+	payload, err := e.GetSigningPayload(tc, tokenID)
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte(payload))
+	signature, err := ecdsa.SignASN1(rand.Reader, tc.key(address), digest[:])
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+// sliceIterator iterates over a snapshot of world state entries
+type sliceIterator struct {
+	*mocks.StateQueryIterator
+	kvs []*queryresult.KV
+}
+
+func (it *sliceIterator) remaining() int {
+	return len(it.kvs)
+}
+
+// iterator returns the world state entries in [startKey, endKey) in key order
+func (tc *testContext) iterator(startKey, endKey string) *sliceIterator {
+	keys := []string{}
+	for key := range tc.state {
+		if key >= startKey && key < endKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	it := &sliceIterator{StateQueryIterator: &mocks.StateQueryIterator{}}
+	for _, key := range keys {
+		it.kvs = append(it.kvs, &queryresult.KV{Key: key, Value: tc.state[key]})
+	}
+	it.HasNextStub = func() bool {
+		return len(it.kvs) > 0
+	}
+	it.NextStub = func() (*queryresult.KV, error) {
+		kv := it.kvs[0]
+		it.kvs = it.kvs[1:]
+		return kv, nil
+	}
+	return it
+}
+
+// page returns up to pageSize entries in [startKey, endKey) from the bookmark
+// on, and a bookmark naming the first entry of the next page, if any
+func (tc *testContext) page(startKey, endKey string, pageSize int32, bookmark string) (*sliceIterator, *peer.QueryResponseMetadata) {
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	iterator := tc.iterator(startKey, endKey)
+	metadata := &peer.QueryResponseMetadata{}
+	if pageSize > 0 && iterator.remaining() > int(pageSize) {
+		metadata.Bookmark = iterator.kvs[pageSize].Key
+		iterator.kvs = iterator.kvs[:pageSize]
+	}
+	metadata.FetchedRecordsCount = int32(iterator.remaining())
+	return iterator, metadata
+}
+
+func splitCompositeKey(compositeKey string) (string, []string, error) {
+	parts := strings.Split(strings.Trim(compositeKey, "\x00"), "\x00")
+	return parts[0], parts[1:], nil
+}
+
+// as switches the submitting identity to the given address and role
+func (tc *testContext) as(address, role string) *testContext {
+	tc.attrs = map[string]string{AddressAttribute: address}
+	if role != "" {
+		tc.attrs[RoleAttribute] = role
+	}
+	return tc
+}
+
+// publicKeyPEM returns the PEM encoded public key of an address
+func (tc *testContext) publicKeyPEM(t testing.TB, address string) string {
+	der, err := x509.MarshalPKIXPublicKey(&tc.key(address).PublicKey)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// registerTestParticipant registers and KYC-approves an address unless it already is
+func registerTestParticipant(t testing.TB, e *EnergyTradingContract, tc *testContext, address, role string) {
+	if participant, _ := getParticipant(tc, address); participant != nil {
+		return
+	}
+	_, err := e.RegisterParticipant(tc.as(address, role), []string{"meter-" + address}, tc.publicKeyPEM(t, address), "zone1")
+	require.NoError(t, err)
+	require.NoError(t, e.ApproveParticipant(tc.as("admin1", RoleAdmin), address))
+}
+
+func createTestAsset(t testing.TB, e *EnergyTradingContract, tc *testContext, tokenID string) {
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	tc.as("buyer1", "")
+	err := e.CreateEnergyAsset(tc, tokenID, "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.NoError(t, err)
+}
+
+// authorize runs the before-transaction middleware for the given function
+func (tc *testContext) authorize(fn string) error {
+	tc.stub.GetFunctionAndParametersReturns("EnergyTradingContract:"+fn, nil)
+	return authorizeTransaction(tc)
+}
+
+func TestAuthorizeTransaction(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+
+	err := tc.as("buyer1", RoleConsumer).authorize("InitLedger")
+	require.EqualError(t, err, "InitLedger: caller buyer1 has no registered role")
+	require.NoError(t, tc.as("admin1", RoleAdmin).authorize("InitLedger"))
+	require.NoError(t, e.InitLedger(tc, EnvironmentTest))
+
+	err = tc.as("buyer1", RoleConsumer).authorize("CreateEnergyAsset")
+	require.EqualError(t, err, "CreateEnergyAsset: caller buyer1 has no registered role")
+	record, err := e.RegisterRole(tc)
+	require.NoError(t, err)
+	require.Equal(t, RoleConsumer, record.Role)
+	require.NoError(t, tc.authorize("CreateEnergyAsset"))
+
+	err = tc.authorize("ConfirmDelivery")
+	require.EqualError(t, err, "ConfirmDelivery: caller buyer1 with role consumer is not authorized")
+	err = tc.authorize("MintTokens")
+	require.EqualError(t, err, "MintTokens: caller buyer1 with role consumer is not authorized")
+
+	require.NoError(t, tc.authorize("ReadEnergyAsset"))
+}
+
+func TestInitLedgerRunsOnce(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.as("admin1", RoleAdmin)
+
+	err := e.SeedDemoData(tc)
+	require.EqualError(t, err, "ledger has not been initialized")
+	err = e.InitLedger(tc, "staging")
+	require.EqualError(t, err, "environment must be production or test")
+	require.NoError(t, e.InitLedger(tc, EnvironmentProduction))
+	err = e.InitLedger(tc, EnvironmentTest)
+	require.EqualError(t, err, "ledger has already been initialized")
+	info, err := e.GetLedgerInfo(tc)
+	require.NoError(t, err)
+	require.Equal(t, EnvironmentProduction, info.Environment)
+	require.Equal(t, "admin1", info.InitializedBy)
+	err = e.SeedDemoData(tc)
+	require.EqualError(t, err, "demo data can only be seeded in the test environment")
+}
+
+func TestSeedDemoData(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.as("admin1", RoleAdmin)
+	require.NoError(t, e.InitLedger(tc, EnvironmentTest))
+	require.NoError(t, e.SeedDemoData(tc))
+
+	balance, err := e.BalanceOf(tc, "buyer1", EnergyTokenID)
+	require.NoError(t, err)
+	require.Equal(t, 100.0, balance)
+	info, err := e.GetLedgerInfo(tc)
+	require.NoError(t, err)
+	require.True(t, info.DemoDataSeeded)
+	err = e.SeedDemoData(tc)
+	require.EqualError(t, err, "demo data has already been seeded")
+}
+
+func TestRegisterRole(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+
+	_, err := e.RegisterRole(tc.as("admin1", RoleAdmin))
+	require.EqualError(t, err, `certificate role "admin" cannot be registered`)
+
+	_, err = e.RegisterRole(tc.as("seller1", RoleProsumer))
+	require.NoError(t, err)
+	_, err = e.RegisterRole(tc)
+	require.EqualError(t, err, "address seller1 is already registered as prosumer")
+
+	record, err := e.GetRole(tc, "seller1")
+	require.NoError(t, err)
+	require.Equal(t, RoleProsumer, record.Role)
+}
+
+func TestCreateEnergyAssetRequiresParty(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+
+	err := e.CreateEnergyAsset(tc.as("mallory", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "caller mallory is not a party to this trade")
+
+	createTestAsset(t, e, tc, "energy1")
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, StateCreated, asset.TransactionState)
+	require.Equal(t, testTxTime.Format(time.RFC3339), asset.Timestamp)
+
+	require.Equal(t, 1, tc.stub.SetStateValidationParameterCallCount())
+	key, policy := tc.stub.SetStateValidationParameterArgsForCall(0)
+	require.Equal(t, "energy1", key)
+	require.NotEmpty(t, policy)
+}
+
+func TestTradePrivateDetails(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.identity.GetMSPIDReturns("Org2MSP", nil)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	tc.identity.GetMSPIDReturns("Org1MSP", nil)
+	createTestAsset(t, e, tc, "energy1")
+	require.Contains(t, tc.private, TradeCollectionPrefix+"_Org1MSP_Org2MSP/energy1")
+	collection, err := tradeCollection(tc, "buyer1", "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, TradeCollectionPrefix+"_Org1MSP", collection)
+
+	details, err := e.ReadTradePrivateDetails(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+	require.Equal(t, 0.2, details.TransactionPrice)
+	require.Equal(t, 1.0, details.SellerDeposit)
+
+	_, err = e.ReadTradePrivateDetails(tc.as("mallory", ""), "energy1")
+	require.EqualError(t, err, "caller mallory is not a party to this trade")
+
+	tc.identity.GetMSPIDReturns(RegulatorMSPID, nil)
+	_, err = e.ReadTradePrivateDetails(tc, "energy1")
+	require.NoError(t, err)
+
+	tc.private[TradeCollectionPrefix+"_Org1MSP_Org2MSP/energy1"] = []byte(`{"tokenID":"energy1","transactionPrice":0.01,"salt":"s1"}`)
+	_, err = e.ReadTradePrivateDetails(tc, "energy1")
+	require.EqualError(t, err, "private details of energy1 do not match the public hash")
+}
+
+func TestSignEnergyAsset(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	createTestAsset(t, e, tc, "energy1")
+
+	err := e.SignEnergyAsset(tc.as("mallory", ""), "energy1", tc.sign(t, e, "mallory", "energy1"), 0)
+	require.EqualError(t, err, "caller mallory is not a party to this trade")
+
+	err = e.SignEnergyAsset(tc.as("buyer1", ""), "energy1", tc.sign(t, e, "seller1", "energy1"), 0)
+	require.EqualError(t, err, "signature does not match the trade terms of asset energy1")
+	err = e.SignEnergyAsset(tc, "energy1", "not base64!", 0)
+	require.Error(t, err)
+
+	buyerSig := tc.sign(t, e, "buyer1", "energy1")
+	require.NoError(t, e.SignEnergyAsset(tc, "energy1", buyerSig, 0))
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, buyerSig, asset.BuyerSignature)
+	require.Empty(t, asset.SellerSignature)
+	require.Equal(t, StateCreated, asset.TransactionState)
+
+	sellerSig := tc.sign(t, e, "seller1", "energy1")
+	require.NoError(t, e.SignEnergyAsset(tc.as("seller1", ""), "energy1", sellerSig, 0))
+	asset, err = e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, buyerSig, asset.BuyerSignature)
+	require.Equal(t, sellerSig, asset.SellerSignature)
+	require.Equal(t, StateConfirmed, asset.TransactionState)
+}
+
+// confirmTestAsset creates a trade and signs it from both sides
+func confirmTestAsset(t testing.TB, e *EnergyTradingContract, tc *testContext, tokenID string) {
+	createTestAsset(t, e, tc, tokenID)
+	require.NoError(t, e.SignEnergyAsset(tc.as("buyer1", ""), tokenID, tc.sign(t, e, "buyer1", tokenID), 0))
+	require.NoError(t, e.SignEnergyAsset(tc.as("seller1", ""), tokenID, tc.sign(t, e, "seller1", tokenID), 0))
+}
+
+func TestConfirmDeliveryOnlySeller(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	confirmTestAsset(t, e, tc, "energy1")
+
+	err := e.ConfirmDelivery(tc.as("buyer1", ""), "energy1", 0)
+	require.EqualError(t, err, "caller buyer1 is not authorized to act for seller1")
+
+	require.NoError(t, e.ConfirmDelivery(tc.as("seller1", ""), "energy1", 0))
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, StateDelivered, asset.TransactionState)
+}
+
+func TestRegisterParticipant(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+
+	_, err := e.RegisterParticipant(tc.as("buyer1", RoleConsumer), nil, "not a key", "zone1")
+	require.EqualError(t, err, "public key is not PEM encoded")
+
+	participant, err := e.RegisterParticipant(tc, []string{"meter1"}, tc.publicKeyPEM(t, "buyer1"), "zone1")
+	require.NoError(t, err)
+	require.Equal(t, KYCPending, participant.KYCStatus)
+	require.Equal(t, RoleConsumer, participant.Role)
+	record, err := e.GetRole(tc, "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, RoleConsumer, record.Role)
+
+	_, err = e.RegisterParticipant(tc, nil, tc.publicKeyPEM(t, "buyer1"), "zone1")
+	require.EqualError(t, err, "participant buyer1 is already registered")
+	_, err = e.OpenTokenAccount(tc.as("seller1", RoleProsumer))
+	require.EqualError(t, err, "participant seller1 is not registered")
+	_, err = e.OpenTokenAccount(tc.as("buyer1", RoleConsumer))
+	require.EqualError(t, err, "participant buyer1 is not KYC approved")
+
+	err = e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10)
+	require.EqualError(t, err, "participant buyer1 is not KYC approved")
+	require.NoError(t, e.ApproveParticipant(tc, "buyer1"))
+	account, err := e.OpenTokenAccount(tc.as("buyer1", RoleConsumer))
+	require.NoError(t, err)
+	require.Equal(t, &TokenAccount{AccountID: "buyer1", Version: 1}, account)
+	_, err = e.OpenTokenAccount(tc)
+	require.EqualError(t, err, "account buyer1 already exists")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+}
+
+func TestCreateEnergyAssetRequiresKYC(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+
+	err := e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "participant seller1 is not registered")
+}
+
+func TestMintTokens(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+
+	err := e.MintTokens(tc.as("operator", RoleAdmin), "buyer1", 0)
+	require.EqualError(t, err, "mint amount must be positive")
+
+	require.NoError(t, e.MintTokens(tc.as("operator", RoleAdmin), "buyer1", 50))
+	require.NoError(t, e.MintTokens(tc, "buyer1", 25))
+	account, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, 75.0, account.Balance)
+}
+
+func TestCallerAddressFallsBackToClientID(t *testing.T) {
+	tc := newTestContext()
+	address, err := callerAddress(tc)
+	require.NoError(t, err)
+	require.Equal(t, "x509::CN=test", address)
+}
+
+func TestAuditFunctionsRequireRegulator(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	createTestAsset(t, e, tc, "energy1")
+	require.NoError(t, e.UpdateReputationScore(tc.as("admin1", RoleAdmin), "seller1", 5))
+
+	_, err := e.AuditGetAllReputations(tc, DefaultMaxPageSize, "")
+	require.EqualError(t, err, "caller is not authorized: RegulatorMSP membership required")
+	_, err = e.AuditGetTrades(tc, false, 10, "")
+	require.EqualError(t, err, "caller is not authorized: RegulatorMSP membership required")
+
+	tc.identity.GetMSPIDReturns(RegulatorMSPID, nil)
+	reputations, err := e.AuditGetAllReputations(tc, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, reputations.Records, 1)
+	require.Equal(t, 55.0, reputations.Records[0].Score)
+
+	trades, err := e.AuditGetTrades(tc, false, 10, "")
+	require.NoError(t, err)
+	require.Len(t, trades.Records, 1)
+	require.Equal(t, "energy1", trades.Records[0].Asset.TokenID)
+	require.Equal(t, 0.2, trades.Records[0].PrivateDetails.TransactionPrice)
+
+	_, err = e.SetRegulator(tc.as("admin1", RoleAdmin), "")
+	require.EqualError(t, err, "regulator MSP ID must not be empty")
+	regulator, err := e.SetRegulator(tc, "AuditorMSP")
+	require.NoError(t, err)
+	require.Equal(t, &Regulator{MSPID: "AuditorMSP", UpdatedBy: "admin1", UpdatedAt: testTxTime.Format(time.RFC3339)}, regulator)
+	_, err = e.AuditGetTrades(tc, false, 10, "")
+	require.EqualError(t, err, "caller is not authorized: AuditorMSP membership required")
+	tc.identity.GetMSPIDReturns("AuditorMSP", nil)
+	_, err = e.AuditGetTrades(tc, false, 10, "")
+	require.NoError(t, err)
+}
+
+func TestGetParticipantRedactsPersonalFields(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+
+	participant, err := e.GetParticipant(tc.as("buyer1", ""), "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"meter-buyer1"}, participant.MeterIDs)
+
+	participant, err = e.GetParticipant(tc.as("seller1", ""), "buyer1")
+	require.NoError(t, err)
+	require.Empty(t, participant.MeterIDs)
+	require.Equal(t, "zone1", participant.Zone)
+
+	tc.identity.GetMSPIDReturns(RegulatorMSPID, nil)
+	participant, err = e.GetParticipant(tc, "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"meter-buyer1"}, participant.MeterIDs)
+}
+
+func TestTradeStateMachine(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+
+	exists, err := e.EnergyAssetExists(tc, "energy1")
+	require.NoError(t, err)
+	require.False(t, exists)
+	_, err = e.ReadEnergyAsset(tc, "energy1")
+	require.EqualError(t, err, "asset energy1 does not exist")
+	err = e.SignEnergyAsset(tc.as("buyer1", ""), "energy1", "", 0)
+	require.EqualError(t, err, "asset energy1 does not exist")
+
+	createTestAsset(t, e, tc, "energy1")
+	exists, err = e.EnergyAssetExists(tc, "energy1")
+	require.NoError(t, err)
+	require.True(t, exists)
+	err = e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "asset energy1 already exists")
+
+	err = e.ConfirmDelivery(tc.as("seller1", ""), "energy1", 0)
+	require.EqualError(t, err, "asset energy1 cannot be delivered in state CREATED")
+
+	buyerSig := tc.sign(t, e, "buyer1", "energy1")
+	require.NoError(t, e.SignEnergyAsset(tc.as("buyer1", ""), "energy1", buyerSig, 0))
+	require.NoError(t, e.SignEnergyAsset(tc.as("seller1", ""), "energy1", tc.sign(t, e, "seller1", "energy1"), 0))
+	err = e.SignEnergyAsset(tc.as("buyer1", ""), "energy1", buyerSig, 0)
+	require.EqualError(t, err, "asset energy1 cannot be signed in state CONFIRMED")
+
+	require.NoError(t, e.ConfirmDelivery(tc.as("seller1", ""), "energy1", 0))
+	err = e.ConfirmDelivery(tc, "energy1", 0)
+	require.EqualError(t, err, "asset energy1 cannot be delivered in state DELIVERED")
+}
+
+func TestRejectParticipant(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+
+	err := e.RejectParticipant(tc.as("admin1", RoleAdmin), "seller1")
+	require.EqualError(t, err, "participant seller1 is not registered")
+
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	_, err = e.RegisterParticipant(tc.as("seller1", RoleProsumer), []string{"meter-seller1"}, tc.publicKeyPEM(t, "seller1"), "zone1")
+	require.NoError(t, err)
+	require.NoError(t, e.RejectParticipant(tc.as("admin1", RoleAdmin), "seller1"))
+	participant, err := e.GetParticipant(tc, "seller1")
+	require.NoError(t, err)
+	require.Equal(t, KYCRejected, participant.KYCStatus)
+	require.Equal(t, testTxTime.Format(time.RFC3339), participant.ReviewedAt)
+
+	err = e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "participant seller1 is not KYC approved")
+}
+
+func TestReputationPenalty(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+
+	reputation, err := e.ReadReputationScore(tc, "seller1")
+	require.NoError(t, err)
+	require.Equal(t, 50.0, reputation.Score)
+	penalty, err := e.CheckReputationPenalty(tc, "seller1")
+	require.NoError(t, err)
+	require.False(t, penalty)
+
+	require.NoError(t, e.UpdateReputationScore(tc.as("admin1", RoleAdmin), "seller1", -20))
+	penalty, err = e.CheckReputationPenalty(tc, "seller1")
+	require.NoError(t, err)
+	require.True(t, penalty)
+	err = e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "seller seller1 reputation too low")
+
+	require.NoError(t, e.UpdateReputationScore(tc.as("admin1", RoleAdmin), "seller1", -100))
+	reputation, err = e.ReadReputationScore(tc, "seller1")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, reputation.Score)
+}
+
+func TestReputationReadFailure(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.stub.GetStateStub = nil
+	tc.stub.GetStateReturns(nil, errors.New("ledger unavailable"))
+
+	_, err := e.CheckReputationPenalty(tc, "seller1")
+	require.EqualError(t, err, "failed to read reputation of seller1: ledger unavailable")
+	_, err = e.ReadEnergyAsset(tc, "energy1")
+	require.EqualError(t, err, "failed to read asset energy1: ledger unavailable")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// PersonalCollection is the private data collection holding participants'
+// personal data. Keeping it off the public ledger is what makes erasure
+// possible: private data can be purged, public state history cannot.
+const PersonalCollection = "participantPersonalCollection"
+
+// participantPersonalTransientKey is the transient map entry carrying ParticipantPersonalData
+const participantPersonalTransientKey = "participant_personal"
+
+// ParticipantPersonalData holds the personal fields of a participant
+type ParticipantPersonalData struct {
+	Address     string `json:"address"`
+	DisplayName string `json:"displayName"`
+	Email       string `json:"email,omitempty"`
+	Salt        string `json:"salt"`
+}
+
+// readTransientPersonalData reads personal data from the transient map so it
+// is never written into the transaction proposal that is kept in the blocks.
+func readTransientPersonalData(ctx contractapi.TransactionContextInterface, address string) (*ParticipantPersonalData, error) {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transient map: %v", err)
+	}
+	personalJSON, ok := transientMap[participantPersonalTransientKey]
+	if !ok {
+		return nil, fmt.Errorf("%s must be supplied in the transient map", participantPersonalTransientKey)
+	}
+	var personal ParticipantPersonalData
+	if err := json.Unmarshal(personalJSON, &personal); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", participantPersonalTransientKey, err)
+	}
+	if personal.Salt == "" {
+		return nil, fmt.Errorf("%s must include a salt", participantPersonalTransientKey)
+	}
+	personal.Address = address
+	return &personal, nil
+}
+
+// putPersonalData stores a participant's personal data and returns its hash
+func putPersonalData(ctx contractapi.TransactionContextInterface, personal *ParticipantPersonalData) (string, error) {
+	personalJSON, err := json.Marshal(personal)
+	if err != nil {
+		return "", err
+	}
+	if err := ctx.GetStub().PutPrivateData(PersonalCollection, personal.Address, personalJSON); err != nil {
+		return "", fmt.Errorf("failed to put personal data of %s: %v", personal.Address, err)
+	}
+	return hashPrivateDetails(personalJSON), nil
+}
+
+// GetParticipantPersonalData returns a participant's personal data to the
+// participant itself, an admin or the regulator.
+func (e *EnergyTradingContract) GetParticipantPersonalData(ctx contractapi.TransactionContextInterface, address string) (*ParticipantPersonalData, error) {
+	participant, err := e.readParticipant(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := canSeePersonalData(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, fmt.Errorf("caller is not authorized to read personal data of %s", address)
+	}
+	if participant.Erased {
+		return nil, fmt.Errorf("personal data of %s has been erased", address)
+	}
+
+	personalJSON, err := ctx.GetStub().GetPrivateData(PersonalCollection, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read personal data of %s: %v", address, err)
+	}
+	if personalJSON == nil {
+		return nil, fmt.Errorf("personal data of %s is not available on this peer", address)
+	}
+	if hashPrivateDetails(personalJSON) != participant.PersonalDataHash {
+		return nil, fmt.Errorf("personal data of %s does not match the public hash", address)
+	}
+	var personal ParticipantPersonalData
+	if err := json.Unmarshal(personalJSON, &personal); err != nil {
+		return nil, err
+	}
+	return &personal, nil
+}
+
+// EraseParticipantData purges a participant's personal data from the private
+// data collection, including its history on every peer. The pseudonymous
+// public record and the participant's trades are left intact so that existing
+// trades, signatures and hashes still verify.
+func (e *EnergyTradingContract) EraseParticipantData(ctx contractapi.TransactionContextInterface, address string) error {
+	participant, err := e.readParticipant(ctx, address)
+	if err != nil {
+		return err
+	}
+	if participant.Erased {
+		return fmt.Errorf("personal data of %s has already been erased", address)
+	}
+	if err := ctx.GetStub().PurgePrivateData(PersonalCollection, address); err != nil {
+		return fmt.Errorf("failed to purge personal data of %s: %v", address, err)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	participant.Erased = true
+	participant.ErasedAt = now
+	if err := putParticipant(ctx, participant); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventParticipantErased, ParticipantEvent{Address: address, Status: "ERASED"})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEraseParticipantData(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	createTestAsset(t, e, tc, "energy1")
+
+	personal, err := e.GetParticipantPersonalData(tc.as("buyer1", ""), "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, "Test Participant", personal.DisplayName)
+	_, err = e.GetParticipantPersonalData(tc.as("seller1", ""), "buyer1")
+	require.EqualError(t, err, "caller is not authorized to read personal data of buyer1")
+
+	require.NoError(t, e.EraseParticipantData(tc.as("admin1", RoleAdmin), "buyer1"))
+	require.NotContains(t, tc.private, PersonalCollection+"/buyer1")
+	_, err = e.GetParticipantPersonalData(tc, "buyer1")
+	require.EqualError(t, err, "personal data of buyer1 has been erased")
+	err = e.EraseParticipantData(tc, "buyer1")
+	require.EqualError(t, err, "personal data of buyer1 has already been erased")
+
+	participant, err := e.GetParticipant(tc, "buyer1")
+	require.NoError(t, err)
+	require.True(t, participant.Erased)
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, "buyer1", asset.BuyerAddress)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Chaincode event names. Fabric delivers at most one event per transaction, so
+// each transaction function emits the single event describing its outcome.
+// When a transaction emits more than one, only the last is delivered but all
+// are kept in the event log.
+const (
+	EventAssetCreated              = "AssetCreated"
+	EventTradeSigned               = "TradeSigned"
+	EventTradeConfirmed            = "TradeConfirmed"
+	EventDeliveryRecorded          = "DeliveryRecorded"
+	EventTradeSettled              = "TradeSettled"
+	EventTradesArchived            = "TradesArchived"
+	EventReputationChanged         = "ReputationChanged"
+	EventTokensMinted              = "TokensMinted"
+	EventTokensTransferred         = "TokensTransferred"
+	EventParticipantRegistered     = "ParticipantRegistered"
+	EventParticipantReviewed       = "ParticipantReviewed"
+	EventParticipantErased         = "ParticipantErased"
+	EventRoleRegistered            = "RoleRegistered"
+	EventAuthorizationChanged      = "AuthorizationChanged"
+	EventMeterHashCommitted        = "MeterHashCommitted"
+	EventDeviceChanged             = "DeviceChanged"
+	EventMeterReadingSubmitted     = "MeterReadingSubmitted"
+	EventReferencePricePosted      = "ReferencePricePosted"
+	EventWeatherForecastPosted     = "WeatherForecastPosted"
+	EventPriceForecastPosted       = "PriceForecastPosted"
+	EventMeterDisputeChanged       = "MeterDisputeChanged"
+	EventGridCapacitySet           = "GridCapacitySet"
+	EventNetworkTariffSet          = "NetworkTariffSet"
+	EventTradeCurtailed            = "TradeCurtailed"
+	EventCurtailmentOrdered        = "CurtailmentOrdered"
+	EventCurtailmentPolicySet      = "CurtailmentPolicySet"
+	EventStorageRegistered         = "StorageRegistered"
+	EventStorageScheduled          = "StorageScheduled"
+	EventStorageSettled            = "StorageSettled"
+	EventChargingSessionChanged    = "ChargingSessionChanged"
+	EventChargingDeliveryRecorded  = "ChargingDeliveryRecorded"
+	EventDemandResponseCalled      = "DemandResponseCalled"
+	EventDemandResponseOptIn       = "DemandResponseOptIn"
+	EventDemandResponseSettled     = "DemandResponseSettled"
+	EventMarketConfigSet           = "MarketConfigSet"
+	EventZoneStatusChanged         = "ZoneStatusChanged"
+	EventLossFactorSet             = "LossFactorSet"
+	EventCapacityOffered           = "CapacityOffered"
+	EventCapacityCleared           = "CapacityCleared"
+	EventCapacityActivated         = "CapacityActivated"
+	EventCapacitySettled           = "CapacitySettled"
+	EventCertificateConfigSet      = "CertificateConfigSet"
+	EventGeneratorChanged          = "GeneratorChanged"
+	EventCertificateChanged        = "CertificateChanged"
+	EventGridCarbonIntensitySet    = "GridCarbonIntensitySet"
+	EventComplianceReportGenerated = "ComplianceReportGenerated"
+	EventLevyScheduleChanged       = "LevyScheduleChanged"
+	EventInvoiceIssued             = "InvoiceIssued"
+	EventCertificateOrderChanged   = "CertificateOrderChanged"
+	EventSubsidyProgramChanged     = "SubsidyProgramChanged"
+	EventBridgeTransferChanged     = "BridgeTransferChanged"
+	EventTransferSingle            = "TransferSingle"
+	EventTransferBatch             = "TransferBatch"
+	EventApprovalForAll            = "ApprovalForAll"
+	EventDailyRollupCreated        = "DailyRollupCreated"
+	EventTradesPruned              = "TradesPruned"
+	EventForwardChanged            = "ForwardChanged"
+	EventOptionChanged             = "OptionChanged"
+	EventEnergyBanked              = "EnergyBanked"
+	EventPoolChanged               = "PoolChanged"
+	EventPoolSettled               = "PoolSettled"
+	EventInsuranceClaimChanged     = "InsuranceClaimChanged"
+	EventDutchAuctionChanged       = "DutchAuctionChanged"
+	EventCollateralChanged         = "CollateralChanged"
+	EventNettingCompleted          = "NettingCompleted"
+	EventMilestoneEscrowChanged    = "MilestoneEscrowChanged"
+	EventArbitrationPanelChanged   = "ArbitrationPanelChanged"
+	EventDisputeEvidenceSubmitted  = "DisputeEvidenceSubmitted"
+	EventAdminActionChanged        = "AdminActionChanged"
+	EventGovernanceProposalChanged = "GovernanceProposalChanged"
+	EventMarketPauseChanged        = "MarketPauseChanged"
+	EventTariffSeasonChanged       = "TariffSeasonChanged"
+	EventUnmatchedEnergySettled    = "UnmatchedEnergySettled"
+	EventCommunityOrderChanged     = "CommunityOrderChanged"
+	EventClearingRoundCompleted    = "ClearingRoundCompleted"
+	EventDemandChargeAllocated     = "DemandChargeAllocated"
+	EventDemandChargePaid          = "DemandChargePaid"
+	EventBaselineMethodologySet    = "BaselineMethodologySet"
+	EventBaselineCommitted         = "BaselineCommitted"
+	EventBaselineVerified          = "BaselineVerified"
+	EventTransformerSet            = "TransformerSet"
+	EventTransformerLoadWarning    = "TransformerLoadWarning"
+)
+
+// TradeEvent is the payload of trade lifecycle events
+type TradeEvent struct {
+	TokenID         string  `json:"tokenID"`
+	State           string  `json:"state"`
+	Buyer           string  `json:"buyer"`
+	Seller          string  `json:"seller"`
+	EnergyAmount    float64 `json:"energyAmount"`
+	SourceType      string  `json:"sourceType,omitempty"`
+	CurtailedEnergy float64 `json:"curtailedEnergy,omitempty"`
+	DeliveryStart   string  `json:"deliveryStart"`
+	DeliveryEnd     string  `json:"deliveryEnd"`
+}
+
+// TokenEvent is the payload of token events; From is empty for mints
+type TokenEvent struct {
+	From   string  `json:"from,omitempty"`
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+}
+
+// ReputationEvent is the payload of ReputationChanged
+type ReputationEvent struct {
+	Address string  `json:"address"`
+	Score   float64 `json:"score"`
+	Delta   float64 `json:"delta"`
+}
+
+// ParticipantEvent is the payload of participant, role and delegation events
+type ParticipantEvent struct {
+	Address string `json:"address"`
+	Status  string `json:"status"`
+	Subject string `json:"subject,omitempty"`
+}
+
+func newTradeEvent(asset *EnergyAsset) TradeEvent {
+	return TradeEvent{
+		TokenID:         asset.TokenID,
+		State:           asset.TransactionState,
+		Buyer:           asset.BuyerAddress,
+		Seller:          asset.SellerAddress,
+		EnergyAmount:    asset.EnergyAmount,
+		SourceType:      asset.SourceType,
+		CurtailedEnergy: asset.CurtailedEnergy,
+		DeliveryStart:   asset.DeliveryStart,
+		DeliveryEnd:     asset.DeliveryEnd,
+	}
+}
+
+// EventSchemaVersion is the version of the EventEnvelope layout and payloads.
+// It is bumped whenever a payload changes incompatibly.
+const EventSchemaVersion = 2
+
+// eventLogObjectType namespaces the on-chain event log. Entries are keyed by
+// transaction ID and the event's position within the transaction, so
+// transactions never write a shared key just to emit an event and do not
+// conflict with each other. There is no global order on chain; the indexer
+// numbers events in the order their blocks commit.
+const eventLogObjectType = "eventlog"
+
+// EventEnvelope wraps every event payload with the schema version and the
+// event's position within its transaction.
+type EventEnvelope struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Index         int             `json:"index"`
+	Name          string          `json:"name"`
+	TxID          string          `json:"txID"`
+	Timestamp     string          `json:"timestamp"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+func eventLogKey(ctx contractapi.TransactionContextInterface, txID string, index int) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(eventLogObjectType, []string{txID, fmt.Sprintf("%06d", index)})
+}
+
+// nextEventIndex returns the position of the next event in the current
+// transaction. Only keys this transaction writes are read, so the lookup adds
+// nothing to another transaction's read set.
+func nextEventIndex(ctx contractapi.TransactionContextInterface, txID string) (int, string, error) {
+	for index := 0; ; index++ {
+		key, err := eventLogKey(ctx, txID, index)
+		if err != nil {
+			return 0, "", err
+		}
+		existing, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to read event log: %v", err)
+		}
+		if existing == nil {
+			return index, key, nil
+		}
+	}
+}
+
+// emitEvent appends the event to the transaction's event log and sets it as
+// the transaction's chaincode event, wrapped in an EventEnvelope.
+func emitEvent(ctx contractapi.TransactionContextInterface, name string, payload interface{}) error {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	txID := ctx.GetStub().GetTxID()
+	index, key, err := nextEventIndex(ctx, txID)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	envelopeJSON, err := json.Marshal(EventEnvelope{
+		SchemaVersion: EventSchemaVersion,
+		Index:         index,
+		Name:          name,
+		TxID:          txID,
+		Timestamp:     now,
+		Payload:       payloadJSON,
+	})
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, envelopeJSON); err != nil {
+		return err
+	}
+	if err := ctx.GetStub().SetEvent(name, envelopeJSON); err != nil {
+		return fmt.Errorf("failed to emit %s event: %v", name, err)
+	}
+	return nil
+}
+
+// GetTransactionEvents returns every event a transaction emitted, in the
+// order it emitted them. Fabric delivers only the last one, so listeners use
+// this to recover the rest.
+func (e *EnergyTradingContract) GetTransactionEvents(ctx contractapi.TransactionContextInterface, txID string) ([]*EventEnvelope, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(eventLogObjectType, []string{txID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	envelopes := []*EventEnvelope{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var envelope EventEnvelope
+		if err := json.Unmarshal(queryResponse.Value, &envelope); err != nil {
+			return nil, err
+		}
+		envelopes = append(envelopes, &envelope)
+	}
+	return envelopes, nil
+}
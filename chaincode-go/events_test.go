@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lastEvent returns the name and unwrapped payload of the most recent SetEvent call
+func (tc *testContext) lastEvent(t *testing.T) (string, []byte) {
+	require.NotZero(t, tc.stub.SetEventCallCount())
+	name, envelopeJSON := tc.stub.SetEventArgsForCall(tc.stub.SetEventCallCount() - 1)
+	var envelope EventEnvelope
+	require.NoError(t, json.Unmarshal(envelopeJSON, &envelope))
+	require.Equal(t, name, envelope.Name)
+	return name, envelope.Payload
+}
+
+func TestTradeLifecycleEvents(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	createTestAsset(t, e, tc, "energy1")
+
+	name, payload := tc.lastEvent(t)
+	require.Equal(t, EventAssetCreated, name)
+	var event TradeEvent
+	require.NoError(t, json.Unmarshal(payload, &event))
+	require.Equal(t, TradeEvent{TokenID: "energy1", State: StateCreated, Buyer: "buyer1", Seller: "seller1", EnergyAmount: 10, SourceType: SourceGrid, DeliveryStart: "2025-05-03T10:00:00Z", DeliveryEnd: "2025-05-03T11:00:00Z"}, event)
+
+	require.NoError(t, e.SignEnergyAsset(tc.as("buyer1", ""), "energy1", tc.sign(t, e, "buyer1", "energy1"), 0))
+	name, _ = tc.lastEvent(t)
+	require.Equal(t, EventTradeSigned, name)
+	require.NoError(t, e.SignEnergyAsset(tc.as("seller1", ""), "energy1", tc.sign(t, e, "seller1", "energy1"), 0))
+	name, _ = tc.lastEvent(t)
+	require.Equal(t, EventTradeConfirmed, name)
+
+	require.NoError(t, e.ConfirmDelivery(tc.as("seller1", ""), "energy1", 0))
+	name, _ = tc.lastEvent(t)
+	require.Equal(t, EventDeliveryRecorded, name)
+}
+
+func TestTransferTokens(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 20))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	err := e.TransferTokens(tc.as("buyer1", ""), "seller1", 30, 0)
+	require.EqualError(t, err, "account buyer1 has insufficient balance")
+	err = e.TransferTokens(tc, "nobody", 5, 0)
+	require.EqualError(t, err, "account nobody does not exist")
+
+	require.NoError(t, e.TransferTokens(tc, "seller1", 5, 0))
+	name, payload := tc.lastEvent(t)
+	require.Equal(t, EventTokensTransferred, name)
+	var event TokenEvent
+	require.NoError(t, json.Unmarshal(payload, &event))
+	require.Equal(t, TokenEvent{From: "buyer1", To: "seller1", Amount: 5}, event)
+
+	account, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.Equal(t, 6.0, account.Balance)
+}
+
+func TestGetTransactionEvents(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.stub.GetTxIDReturns("tx1")
+	createTestAsset(t, e, tc, "energy1")
+
+	events, err := e.GetTransactionEvents(tc, "tx1")
+	require.NoError(t, err)
+	require.NotEmpty(t, events)
+	for i, envelope := range events {
+		require.Equal(t, i, envelope.Index)
+		require.Equal(t, EventSchemaVersion, envelope.SchemaVersion)
+		require.Equal(t, "tx1", envelope.TxID)
+	}
+	require.Equal(t, EventAssetCreated, events[len(events)-1].Name)
+
+	tc.stub.GetTxIDReturns("tx2")
+	require.NoError(t, e.SignEnergyAsset(tc.as("buyer1", ""), "energy1", tc.sign(t, e, "buyer1", "energy1"), 0))
+	events, err = e.GetTransactionEvents(tc, "tx2")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, EventTradeSigned, events[0].Name)
+	require.Equal(t, 0, events[0].Index)
+
+	// emitting an event writes only keys of the emitting transaction
+	for key := range tc.state {
+		require.NotEqual(t, "eventseq", key)
+	}
+}
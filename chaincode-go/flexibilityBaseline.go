@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Baseline methodologies. AVERAGE averages the most recent Days days with
+// readings among the preceding Lookback days, so 10 of 10 is the plain
+// ten-day average. HIGH_X_OF_Y averages the Days highest of them.
+const (
+	BaselineAverage = "AVERAGE"
+	BaselineHighest = "HIGH_X_OF_Y"
+)
+
+// Metered quantities a baseline can be committed for
+const (
+	BaselineConsumption = "CONSUMPTION"
+	BaselineInjection   = "INJECTION"
+)
+
+// Baseline commitment sources
+const (
+	BaselineOnChain = "ON_CHAIN"
+	BaselineIndexer = "INDEXER"
+)
+
+// baselineTolerance is how far an indexer's baseline may differ from the
+// on-chain recomputation and still be verified
+const baselineTolerance = 1e-6
+
+// BaselineMethodology is how a participant's flexibility baselines are
+// computed. Participants without one use the average of DRBaselineDays days.
+type BaselineMethodology struct {
+	Participant string `json:"participant"`
+	Methodology string `json:"methodology"`
+	Days        int    `json:"days"`
+	Lookback    int    `json:"lookback"`
+	UpdatedBy   string `json:"updatedBy,omitempty"`
+	UpdatedAt   string `json:"updatedAt,omitempty"`
+}
+
+// BaselineCommitment is a participant's baseline for a window, committed
+// before the window starts so that the flexibility delivered in it is
+// measured against a reference fixed in advance. A baseline computed by the
+// indexer counts only once VerifyBaseline has recomputed it on-chain.
+// Samples are the per-day values the last on-chain computation used, most
+// recent day first.
+type BaselineCommitment struct {
+	Participant string    `json:"participant"`
+	Quantity    string    `json:"quantity"`
+	Start       string    `json:"start"`
+	End         string    `json:"end"`
+	Methodology string    `json:"methodology"`
+	Days        int       `json:"days"`
+	Lookback    int       `json:"lookback"`
+	Value       float64   `json:"value"`
+	Source      string    `json:"source"`
+	Samples     []float64 `json:"samples,omitempty"`
+	Recomputed  float64   `json:"recomputed,omitempty"`
+	Verified    bool      `json:"verified"`
+	VerifiedAt  string    `json:"verifiedAt,omitempty"`
+	CommittedBy string    `json:"committedBy"`
+	CommittedAt string    `json:"committedAt"`
+}
+
+func baselineMethodologyKey(ctx contractapi.TransactionContextInterface, participant string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("baselinemethod", []string{participant})
+}
+
+func baselineKey(ctx contractapi.TransactionContextInterface, participant, quantity, start string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("baseline", []string{participant, quantity, start})
+}
+
+// SetBaselineMethodology sets how a participant's flexibility baselines are
+// computed. Lookback is bounded by the batch limit, since each day is a
+// range read of the participant's readings.
+func (e *EnergyTradingContract) SetBaselineMethodology(ctx contractapi.TransactionContextInterface, participant, methodology string, days, lookback int) (*BaselineMethodology, error) {
+	if methodology != BaselineAverage && methodology != BaselineHighest {
+		return nil, fmt.Errorf("baseline methodology must be %s or %s", BaselineAverage, BaselineHighest)
+	}
+	if days < 1 || lookback < days {
+		return nil, fmt.Errorf("baseline must use at least one day and no more than its lookback")
+	}
+	if err := checkBatchSize(ctx, lookback, "baseline days"); err != nil {
+		return nil, err
+	}
+	registered, err := getParticipant(ctx, participant)
+	if err != nil {
+		return nil, err
+	}
+	if registered == nil {
+		return nil, fmt.Errorf("participant %s does not exist", participant)
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	method := &BaselineMethodology{
+		Participant: participant,
+		Methodology: methodology,
+		Days:        days,
+		Lookback:    lookback,
+		UpdatedBy:   caller,
+		UpdatedAt:   now,
+	}
+	methodJSON, err := json.Marshal(method)
+	if err != nil {
+		return nil, err
+	}
+	key, err := baselineMethodologyKey(ctx, participant)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, methodJSON); err != nil {
+		return nil, err
+	}
+	return method, emitEvent(ctx, EventBaselineMethodologySet, method)
+}
+
+// GetBaselineMethodology returns how a participant's baselines are computed
+func (e *EnergyTradingContract) GetBaselineMethodology(ctx contractapi.TransactionContextInterface, participant string) (*BaselineMethodology, error) {
+	key, err := baselineMethodologyKey(ctx, participant)
+	if err != nil {
+		return nil, err
+	}
+	methodJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline methodology: %v", err)
+	}
+	if methodJSON == nil {
+		return &BaselineMethodology{Participant: participant, Methodology: BaselineAverage, Days: DRBaselineDays, Lookback: DRBaselineDays}, nil
+	}
+	var method BaselineMethodology
+	if err := json.Unmarshal(methodJSON, &method); err != nil {
+		return nil, err
+	}
+	return &method, nil
+}
+
+// computeBaseline applies a methodology to a participant's metered quantity
+// over the window [start, end) on each of the preceding days. Days without
+// readings are skipped. It returns the baseline and the per-day values of
+// the days with readings, most recent first.
+func computeBaseline(ctx contractapi.TransactionContextInterface, method *BaselineMethodology, quantity string, start, end time.Time) (float64, []float64, error) {
+	samples := []float64{}
+	for day := 1; day <= method.Lookback; day++ {
+		offset := time.Duration(day) * 24 * time.Hour
+		injected, consumed, found, err := meteredEnergy(ctx, method.Participant, start.Add(-offset).Format(time.RFC3339), end.Add(-offset).Format(time.RFC3339))
+		if err != nil {
+			return 0, nil, err
+		}
+		if !found {
+			continue
+		}
+		if quantity == BaselineInjection {
+			samples = append(samples, injected)
+		} else {
+			samples = append(samples, consumed)
+		}
+	}
+	if len(samples) == 0 {
+		return 0, nil, fmt.Errorf("participant %s has no meter readings to compute a baseline from", method.Participant)
+	}
+	used := append([]float64{}, samples...)
+	if method.Methodology == BaselineHighest {
+		sort.Sort(sort.Reverse(sort.Float64Slice(used)))
+	}
+	if len(used) > method.Days {
+		used = used[:method.Days]
+	}
+	var total float64
+	for _, value := range used {
+		total += value
+	}
+	return total / float64(len(used)), samples, nil
+}
+
+// baselineWindow parses and checks the window of a new baseline commitment
+func baselineWindow(ctx contractapi.TransactionContextInterface, participant, quantity, start, end string) (time.Time, time.Time, error) {
+	if quantity != BaselineConsumption && quantity != BaselineInjection {
+		return time.Time{}, time.Time{}, fmt.Errorf("baseline quantity must be %s or %s", BaselineConsumption, BaselineInjection)
+	}
+	startTime, err := parseTimestamp(start)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	endTime, err := parseTimestamp(end)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !endTime.After(startTime) {
+		return time.Time{}, time.Time{}, fmt.Errorf("baseline window must end after it starts")
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !now.Before(startTime) {
+		return time.Time{}, time.Time{}, fmt.Errorf("baseline window %s has already started", start)
+	}
+	existing, err := getBaseline(ctx, participant, quantity, startTime.Format(time.RFC3339))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if existing != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s baseline of %s for %s is already committed", quantity, participant, start)
+	}
+	return startTime, endTime, nil
+}
+
+// newBaselineCommitment starts a commitment with the participant's methodology
+func newBaselineCommitment(ctx contractapi.TransactionContextInterface, method *BaselineMethodology, quantity string, start, end time.Time, source string) (*BaselineCommitment, error) {
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &BaselineCommitment{
+		Participant: method.Participant,
+		Quantity:    quantity,
+		Start:       start.Format(time.RFC3339),
+		End:         end.Format(time.RFC3339),
+		Methodology: method.Methodology,
+		Days:        method.Days,
+		Lookback:    method.Lookback,
+		Source:      source,
+		CommittedBy: caller,
+		CommittedAt: now,
+	}, nil
+}
+
+// ComputeBaseline computes a participant's baseline for a window that has
+// not started from its metered history and commits it
+func (e *EnergyTradingContract) ComputeBaseline(ctx contractapi.TransactionContextInterface, participant, quantity, start, end string) (*BaselineCommitment, error) {
+	startTime, endTime, err := baselineWindow(ctx, participant, quantity, start, end)
+	if err != nil {
+		return nil, err
+	}
+	method, err := e.GetBaselineMethodology(ctx, participant)
+	if err != nil {
+		return nil, err
+	}
+	commitment, err := newBaselineCommitment(ctx, method, quantity, startTime, endTime, BaselineOnChain)
+	if err != nil {
+		return nil, err
+	}
+	commitment.Value, commitment.Samples, err = computeBaseline(ctx, method, quantity, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	commitment.Recomputed = commitment.Value
+	commitment.Verified, commitment.VerifiedAt = true, commitment.CommittedAt
+	if err := putBaseline(ctx, commitment); err != nil {
+		return nil, err
+	}
+	return commitment, emitEvent(ctx, EventBaselineCommitted, commitment)
+}
+
+// CommitBaseline commits a baseline the indexer computed for a window that
+// has not started with the participant's methodology. It is not used to
+// measure flexibility until VerifyBaseline has confirmed it.
+func (e *EnergyTradingContract) CommitBaseline(ctx contractapi.TransactionContextInterface, participant, quantity, start, end string, value float64) (*BaselineCommitment, error) {
+	if value < 0 {
+		return nil, fmt.Errorf("baseline must not be negative")
+	}
+	startTime, endTime, err := baselineWindow(ctx, participant, quantity, start, end)
+	if err != nil {
+		return nil, err
+	}
+	method, err := e.GetBaselineMethodology(ctx, participant)
+	if err != nil {
+		return nil, err
+	}
+	commitment, err := newBaselineCommitment(ctx, method, quantity, startTime, endTime, BaselineIndexer)
+	if err != nil {
+		return nil, err
+	}
+	commitment.Value = value
+	if err := putBaseline(ctx, commitment); err != nil {
+		return nil, err
+	}
+	return commitment, emitEvent(ctx, EventBaselineCommitted, commitment)
+}
+
+// VerifyBaseline recomputes a committed baseline on-chain with the
+// methodology it was committed under and marks it verified if it matches.
+// A baseline that no longer matches, for example after a disputed reading
+// was corrected, loses its verification.
+func (e *EnergyTradingContract) VerifyBaseline(ctx contractapi.TransactionContextInterface, participant, quantity, start string) (*BaselineCommitment, error) {
+	commitment, err := e.GetBaseline(ctx, participant, quantity, start)
+	if err != nil {
+		return nil, err
+	}
+	startTime, err := parseTimestamp(commitment.Start)
+	if err != nil {
+		return nil, err
+	}
+	endTime, err := parseTimestamp(commitment.End)
+	if err != nil {
+		return nil, err
+	}
+	method := &BaselineMethodology{Participant: participant, Methodology: commitment.Methodology, Days: commitment.Days, Lookback: commitment.Lookback}
+	commitment.Recomputed, commitment.Samples, err = computeBaseline(ctx, method, quantity, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	commitment.Verified = math.Abs(commitment.Recomputed-commitment.Value) <= baselineTolerance
+	commitment.VerifiedAt = now
+	if err := putBaseline(ctx, commitment); err != nil {
+		return nil, err
+	}
+	return commitment, emitEvent(ctx, EventBaselineVerified, commitment)
+}
+
+func putBaseline(ctx contractapi.TransactionContextInterface, commitment *BaselineCommitment) error {
+	commitmentJSON, err := json.Marshal(commitment)
+	if err != nil {
+		return err
+	}
+	key, err := baselineKey(ctx, commitment.Participant, commitment.Quantity, commitment.Start)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, commitmentJSON)
+}
+
+// getBaseline returns a participant's committed baseline for a window
+// starting at start, or nil if none was committed
+func getBaseline(ctx contractapi.TransactionContextInterface, participant, quantity, start string) (*BaselineCommitment, error) {
+	key, err := baselineKey(ctx, participant, quantity, start)
+	if err != nil {
+		return nil, err
+	}
+	commitmentJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline: %v", err)
+	}
+	if commitmentJSON == nil {
+		return nil, nil
+	}
+	var commitment BaselineCommitment
+	if err := json.Unmarshal(commitmentJSON, &commitment); err != nil {
+		return nil, err
+	}
+	return &commitment, nil
+}
+
+// GetBaseline returns a participant's committed baseline of a quantity for
+// the window starting at start
+func (e *EnergyTradingContract) GetBaseline(ctx contractapi.TransactionContextInterface, participant, quantity, start string) (*BaselineCommitment, error) {
+	normalized, err := normalizeTimestamp(start)
+	if err != nil {
+		return nil, err
+	}
+	commitment, err := getBaseline(ctx, participant, quantity, normalized)
+	if err != nil {
+		return nil, err
+	}
+	if commitment == nil {
+		return nil, fmt.Errorf("%s baseline of %s for %s does not exist", quantity, participant, start)
+	}
+	return commitment, nil
+}
+
+// committedBaseline returns the value of a participant's verified baseline
+// for exactly the window [start, end), and whether there is one
+func committedBaseline(ctx contractapi.TransactionContextInterface, participant, quantity string, start, end time.Time) (float64, bool, error) {
+	commitment, err := getBaseline(ctx, participant, quantity, start.Format(time.RFC3339))
+	if err != nil {
+		return 0, false, err
+	}
+	if commitment == nil || !commitment.Verified || commitment.End != end.Format(time.RFC3339) {
+		return 0, false, nil
+	}
+	return commitment.Value, true, nil
+}
+
+// flexibilityBaseline returns a participant's baseline for a window: its
+// verified commitment if there is one, otherwise the baseline its
+// methodology computes now
+func flexibilityBaseline(ctx contractapi.TransactionContextInterface, participant, quantity string, start, end time.Time) (float64, error) {
+	value, found, err := committedBaseline(ctx, participant, quantity, start, end)
+	if err != nil || found {
+		return value, err
+	}
+	method, err := (&EnergyTradingContract{}).GetBaselineMethodology(ctx, participant)
+	if err != nil {
+		return 0, err
+	}
+	value, _, err = computeBaseline(ctx, method, quantity, start, end)
+	return value, err
+}
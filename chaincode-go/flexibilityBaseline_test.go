@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestFlexibilityBaseline(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 5))
+	_, err := e.CreateDemandResponseEvent(tc.as("operator1", RoleOperator), "dr1", "zone1", 5, "2025-05-05T10:00:00Z", "2025-05-05T11:00:00Z", 0.5, 0.25)
+	require.NoError(t, err)
+	_, err = e.OptInDemandResponse(tc.as("buyer1", ""), "dr1", 2)
+	require.NoError(t, err)
+
+	// 4, 6, 2 and 8 kWh between 10:00 and 11:00 on May 1 to 4
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 4, 12, 0, 0, 0, time.UTC)), nil)
+	for day, consumed := range []float64{1, 1.5, 0.5, 2} {
+		submitTestConsumption(t, e, tc, "buyer1", day+1, consumed)
+	}
+
+	tc.as("operator1", RoleOperator)
+	method, err := e.GetBaselineMethodology(tc, "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, BaselineAverage, method.Methodology)
+	require.Equal(t, DRBaselineDays, method.Lookback)
+	_, err = e.SetBaselineMethodology(tc, "buyer1", "MEDIAN", 2, 3)
+	require.EqualError(t, err, "baseline methodology must be AVERAGE or HIGH_X_OF_Y")
+	_, err = e.SetBaselineMethodology(tc, "buyer1", BaselineHighest, 4, 3)
+	require.EqualError(t, err, "baseline must use at least one day and no more than its lookback")
+	_, err = e.SetBaselineMethodology(tc, "buyer2", BaselineHighest, 2, 3)
+	require.EqualError(t, err, "participant buyer2 does not exist")
+	_, err = e.SetBaselineMethodology(tc, "buyer1", BaselineHighest, 2, 3)
+	require.NoError(t, err)
+
+	// The highest 2 of the 3 preceding days are 8 and 6 kWh
+	_, err = e.ComputeBaseline(tc, "buyer1", BaselineConsumption, "2025-05-04T10:00:00Z", "2025-05-04T11:00:00Z")
+	require.EqualError(t, err, "baseline window 2025-05-04T10:00:00Z has already started")
+	baseline, err := e.ComputeBaseline(tc, "buyer1", BaselineConsumption, "2025-05-05T10:00:00Z", "2025-05-05T11:00:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 7, baseline.Value, 1e-9)
+	require.Equal(t, []float64{8, 2, 6}, baseline.Samples)
+	require.True(t, baseline.Verified)
+	_, err = e.ComputeBaseline(tc, "buyer1", BaselineConsumption, "2025-05-05T10:00:00Z", "2025-05-05T11:00:00Z")
+	require.EqualError(t, err, "CONSUMPTION baseline of buyer1 for 2025-05-05T10:00:00Z is already committed")
+
+	// Indexer baselines count once they are recomputed on-chain
+	baseline, err = e.CommitBaseline(tc.as("oracle1", RoleOracle), "buyer1", BaselineConsumption, "2025-05-06T10:00:00Z", "2025-05-06T11:00:00Z", 9)
+	require.NoError(t, err)
+	require.Equal(t, BaselineIndexer, baseline.Source)
+	require.False(t, baseline.Verified)
+	baseline, err = e.VerifyBaseline(tc.as("operator1", RoleOperator), "buyer1", BaselineConsumption, "2025-05-06T10:00:00Z")
+	require.NoError(t, err)
+	require.False(t, baseline.Verified)
+	require.InDelta(t, 5, baseline.Recomputed, 1e-9)
+	_, err = e.CommitBaseline(tc.as("oracle1", RoleOracle), "buyer1", BaselineConsumption, "2025-05-07T10:00:00Z", "2025-05-07T11:00:00Z", 8)
+	require.NoError(t, err)
+	baseline, err = e.VerifyBaseline(tc.as("regulator1", RoleRegulator), "buyer1", BaselineConsumption, "2025-05-07T10:00:00Z")
+	require.NoError(t, err)
+	require.True(t, baseline.Verified)
+	_, err = e.GetBaseline(tc, "buyer1", BaselineInjection, "2025-05-07T10:00:00Z")
+	require.EqualError(t, err, "INJECTION baseline of buyer1 for 2025-05-07T10:00:00Z does not exist")
+
+	// The event is measured against the committed 7 kWh, not a fresh average
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 5, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestConsumption(t, e, tc, "buyer1", 5, 1)
+	enrollment, err := e.SettleDemandResponse(tc.as("buyer1", ""), "dr1", "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 7, enrollment.Baseline, 1e-9)
+	require.InDelta(t, 3, enrollment.Reduced, 1e-9)
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ForwardMarginAccount holds the margin deposits of forward contracts
+const ForwardMarginAccount = "forward-margin"
+
+// Forward margins. Each party deposits ForwardInitialMarginRate of the
+// magnitude of the contract value when the forward is accepted, so that a
+// forward at a negative price is margined like one at a positive price. When marking to market takes a
+// party's deposit below ForwardMaintenanceMarginRate of its initial margin,
+// the party is called to top it back up to the initial margin.
+const (
+	ForwardInitialMarginRate     = 0.2
+	ForwardMaintenanceMarginRate = 0.75
+)
+
+// Forward contract statuses
+const (
+	ForwardProposed    = "PROPOSED"
+	ForwardActive      = "ACTIVE"
+	ForwardMarginCall  = "MARGIN_CALL"
+	ForwardDelivered   = "DELIVERED"
+	ForwardCashSettled = "CASH_SETTLED"
+	ForwardCancelled   = "CANCELLED"
+)
+
+// deliveryMonthLayout is the format of forward delivery months
+const deliveryMonthLayout = "2006-01"
+
+// PriceIndexation is a price clause tracking the oracle reference price: the
+// price of each delivery period is the reference price in effect at its
+// start plus Spread, which may be negative, bounded by Floor and Cap.
+type PriceIndexation struct {
+	Spread float64 `json:"spread"`
+	Floor  float64 `json:"floor"`
+	Cap    float64 `json:"cap"`
+}
+
+// price evaluates the clause against an index value
+func (indexation *PriceIndexation) price(index float64) float64 {
+	return math.Min(indexation.Cap, math.Max(indexation.Floor, index+indexation.Spread))
+}
+
+// ForwardContract commits the seller to deliver DailyEnergy kWh to the buyer
+// on every day of DeliveryMonth at Price tokens per kWh. Until delivery the
+// forward is marked to market daily against the oracle reference price: the
+// change in value of TotalEnergy moves between the parties' margin deposits,
+// which are held in ForwardMarginAccount. At delivery the forward is converted
+// into one confirmed trade per day at the final mark price; together with the
+// variation margin already exchanged, the buyer pays Price overall.
+//
+// An indexed forward has no fixed price: each daily trade is priced by
+// Indexation when it settles, and Price is only the indicative price the
+// margins are sized on. Its margins are a performance bond and it is not
+// marked to market.
+type ForwardContract struct {
+	ForwardID        string           `json:"forwardID"`
+	Buyer            string           `json:"buyer"`
+	Seller           string           `json:"seller"`
+	ProposedBy       string           `json:"proposedBy"`
+	DeliveryMonth    string           `json:"deliveryMonth"`
+	DailyEnergy      float64          `json:"dailyEnergy"`
+	TotalEnergy      float64          `json:"totalEnergy"`
+	Price            float64          `json:"price"`
+	Indexation       *PriceIndexation `json:"indexation,omitempty"`
+	SourceType       string           `json:"sourceType"`
+	InitialMargin    float64          `json:"initialMargin"`
+	BuyerMargin      float64          `json:"buyerMargin"`
+	SellerMargin     float64          `json:"sellerMargin"`
+	BuyerMarginCall  float64          `json:"buyerMarginCall,omitempty"`
+	SellerMarginCall float64          `json:"sellerMarginCall,omitempty"`
+	MarkPrice        float64          `json:"markPrice"`
+	MarkedAt         string           `json:"markedAt,omitempty"`
+	Status           string           `json:"status"`
+	Trades           []string         `json:"trades,omitempty"`
+	CreatedAt        string           `json:"createdAt"`
+	AcceptedAt       string           `json:"acceptedAt,omitempty"`
+	SettledAt        string           `json:"settledAt,omitempty"`
+	Version          int64            `json:"version"`
+}
+
+// PaginatedForwardResult is a page of forward contracts
+type PaginatedForwardResult struct {
+	Records             []*ForwardContract `json:"records"`
+	FetchedRecordsCount int32              `json:"fetchedRecordsCount"`
+	Bookmark            string             `json:"bookmark"`
+}
+
+func forwardKey(ctx contractapi.TransactionContextInterface, forwardID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("forward", []string{forwardID})
+}
+
+func forwardMonthKey(ctx contractapi.TransactionContextInterface, deliveryMonth, forwardID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("forwardmonth", []string{deliveryMonth, forwardID})
+}
+
+func putForward(ctx contractapi.TransactionContextInterface, forward *ForwardContract) error {
+	forward.Version++
+	forwardJSON, err := json.Marshal(forward)
+	if err != nil {
+		return err
+	}
+	key, err := forwardKey(ctx, forward.ForwardID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, forwardJSON)
+}
+
+// getForward returns a forward contract, or nil if there is none
+func getForward(ctx contractapi.TransactionContextInterface, forwardID string) (*ForwardContract, error) {
+	key, err := forwardKey(ctx, forwardID)
+	if err != nil {
+		return nil, err
+	}
+	forwardJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read forward %s: %v", forwardID, err)
+	}
+	if forwardJSON == nil {
+		return nil, nil
+	}
+	var forward ForwardContract
+	if err := json.Unmarshal(forwardJSON, &forward); err != nil {
+		return nil, err
+	}
+	return &forward, nil
+}
+
+// GetForwardContract returns a forward contract with its margin account
+func (e *EnergyTradingContract) GetForwardContract(ctx contractapi.TransactionContextInterface, forwardID string) (*ForwardContract, error) {
+	forward, err := getForward(ctx, forwardID)
+	if err != nil {
+		return nil, err
+	}
+	if forward == nil {
+		return nil, fmt.Errorf("forward %s does not exist", forwardID)
+	}
+	return forward, nil
+}
+
+// GetForwardsByDeliveryMonth returns a page of the forwards delivering in a
+// month, given as YYYY-MM
+func (e *EnergyTradingContract) GetForwardsByDeliveryMonth(ctx contractapi.TransactionContextInterface, deliveryMonth string, pageSize int32, bookmark string) (*PaginatedForwardResult, error) {
+	if _, err := time.Parse(deliveryMonthLayout, deliveryMonth); err != nil {
+		return nil, fmt.Errorf("delivery month %s must be formatted as YYYY-MM", deliveryMonth)
+	}
+	result := &PaginatedForwardResult{Records: []*ForwardContract{}}
+	metadata, err := queryPage(ctx, "forwardmonth", []string{deliveryMonth}, pageSize, bookmark, func(value []byte) error {
+		forward, err := e.GetForwardContract(ctx, string(value))
+		if err != nil {
+			return err
+		}
+		result.Records = append(result.Records, forward)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// deliveryMonthBounds returns the start of a delivery month and of the next
+func deliveryMonthBounds(deliveryMonth string) (time.Time, time.Time, error) {
+	start, err := time.Parse(deliveryMonthLayout, deliveryMonth)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("delivery month %s must be formatted as YYYY-MM", deliveryMonth)
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// ProposeForward proposes a forward to the counterparty. The caller must be
+// the buyer or the seller, the delivery month must not have started and the
+// price must lie in the band around the reference price in effect.
+func (e *EnergyTradingContract) ProposeForward(ctx contractapi.TransactionContextInterface, forwardID, buyer, seller, deliveryMonth string, dailyEnergy, price float64, sourceType string) (*ForwardContract, error) {
+	if dailyEnergy <= 0 {
+		return nil, fmt.Errorf("daily energy must be positive")
+	}
+	return proposeForward(ctx, forwardID, buyer, seller, deliveryMonth, dailyEnergy, price, nil, sourceType)
+}
+
+// ProposeIndexedForward proposes a forward priced at the reference price plus
+// spread, bounded by floor and cap, in each delivery period. Its indicative
+// price is the clause evaluated against the reference price in effect.
+func (e *EnergyTradingContract) ProposeIndexedForward(ctx contractapi.TransactionContextInterface, forwardID, buyer, seller, deliveryMonth string, dailyEnergy, spread, floor, cap float64, sourceType string) (*ForwardContract, error) {
+	if dailyEnergy <= 0 {
+		return nil, fmt.Errorf("daily energy must be positive")
+	}
+	if cap < floor {
+		return nil, fmt.Errorf("price cap %g is below price floor %g", cap, floor)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	index, err := currentReferencePrice(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	indexation := &PriceIndexation{Spread: spread, Floor: floor, Cap: cap}
+	return proposeForward(ctx, forwardID, buyer, seller, deliveryMonth, dailyEnergy, indexation.price(index), indexation, sourceType)
+}
+
+// proposeForward records a proposed forward, indexed if indexation is set
+func proposeForward(ctx contractapi.TransactionContextInterface, forwardID, buyer, seller, deliveryMonth string, dailyEnergy, price float64, indexation *PriceIndexation, sourceType string) (*ForwardContract, error) {
+	if buyer == seller {
+		return nil, fmt.Errorf("buyer and seller must differ")
+	}
+	proposer, err := requireParty(ctx, buyer, seller)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range []string{buyer, seller} {
+		if _, err := requireApprovedParticipant(ctx, address); err != nil {
+			return nil, err
+		}
+	}
+	existing, err := getForward(ctx, forwardID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("forward %s already exists", forwardID)
+	}
+	start, end, err := deliveryMonthBounds(deliveryMonth)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(start) {
+		return nil, fmt.Errorf("delivery month %s has already started", deliveryMonth)
+	}
+	if err := validateSourceType(ctx, seller, sourceType); err != nil {
+		return nil, err
+	}
+	if err := validatePriceBand(ctx, price); err != nil {
+		return nil, err
+	}
+
+	days := end.Sub(start).Hours() / 24
+	forward := &ForwardContract{
+		ForwardID:     forwardID,
+		Buyer:         buyer,
+		Seller:        seller,
+		ProposedBy:    proposer,
+		DeliveryMonth: deliveryMonth,
+		DailyEnergy:   dailyEnergy,
+		TotalEnergy:   dailyEnergy * days,
+		Price:         price,
+		Indexation:    indexation,
+		SourceType:    sourceType,
+		InitialMargin: math.Abs(price) * dailyEnergy * days * ForwardInitialMarginRate,
+		MarkPrice:     price,
+		Status:        ForwardProposed,
+		CreatedAt:     now.Format(time.RFC3339),
+	}
+	if err := putForward(ctx, forward); err != nil {
+		return nil, err
+	}
+	monthKey, err := forwardMonthKey(ctx, deliveryMonth, forwardID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(monthKey, []byte(forwardID)); err != nil {
+		return nil, err
+	}
+	return forward, emitEvent(ctx, EventForwardChanged, forward)
+}
+
+// AcceptForward accepts a proposed forward on behalf of the counterparty.
+// Both parties' initial margins are debited from their token accounts.
+func (e *EnergyTradingContract) AcceptForward(ctx contractapi.TransactionContextInterface, forwardID string) (*ForwardContract, error) {
+	forward, err := e.GetForwardContract(ctx, forwardID)
+	if err != nil {
+		return nil, err
+	}
+	counterparty := forward.Seller
+	if forward.ProposedBy == forward.Seller {
+		counterparty = forward.Buyer
+	}
+	if err := requireCaller(ctx, counterparty); err != nil {
+		return nil, err
+	}
+	if forward.Status != ForwardProposed {
+		return nil, fmt.Errorf("forward %s cannot be accepted in status %s", forwardID, forward.Status)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start, _, err := deliveryMonthBounds(forward.DeliveryMonth)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(start) {
+		return nil, fmt.Errorf("delivery month %s has already started", forward.DeliveryMonth)
+	}
+	escrow, err := getTokenAccount(ctx, ForwardMarginAccount)
+	if err != nil {
+		return nil, err
+	}
+	if escrow == nil {
+		if err := putTokenAccount(ctx, &TokenAccount{AccountID: ForwardMarginAccount}); err != nil {
+			return nil, err
+		}
+	}
+	for _, party := range []string{forward.Buyer, forward.Seller} {
+		if forward.InitialMargin == 0 {
+			break
+		}
+		if err := transferTokens(ctx, party, ForwardMarginAccount, forward.InitialMargin); err != nil {
+			return nil, fmt.Errorf("failed to deposit the initial margin of %s: %v", party, err)
+		}
+	}
+
+	forward.BuyerMargin = forward.InitialMargin
+	forward.SellerMargin = forward.InitialMargin
+	forward.Status = ForwardActive
+	forward.AcceptedAt = now.Format(time.RFC3339)
+	if err := putForward(ctx, forward); err != nil {
+		return nil, err
+	}
+	return forward, emitEvent(ctx, EventForwardChanged, forward)
+}
+
+// CancelForwardProposal withdraws a forward that has not been accepted yet;
+// only its proposer may call it
+func (e *EnergyTradingContract) CancelForwardProposal(ctx contractapi.TransactionContextInterface, forwardID string) (*ForwardContract, error) {
+	forward, err := e.GetForwardContract(ctx, forwardID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, forward.ProposedBy); err != nil {
+		return nil, err
+	}
+	if forward.Status != ForwardProposed {
+		return nil, fmt.Errorf("forward %s cannot be cancelled in status %s", forwardID, forward.Status)
+	}
+	forward.Status = ForwardCancelled
+	if err := putForward(ctx, forward); err != nil {
+		return nil, err
+	}
+	return forward, emitEvent(ctx, EventForwardChanged, forward)
+}
+
+// currentReferencePrice returns the reference price in effect at
+// transaction time, which forwards are marked against
+func currentReferencePrice(ctx contractapi.TransactionContextInterface, now time.Time) (float64, error) {
+	referencePrice, err := referencePriceAt(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	if referencePrice == nil {
+		return 0, fmt.Errorf("no reference price is in effect at %s", now.Format(time.RFC3339))
+	}
+	return referencePrice.Price, nil
+}
+
+// markForward moves the change in value of the forward since its last mark
+// between the parties' margins: the buyer gains when the price rises
+func markForward(forward *ForwardContract, markPrice float64, markedAt time.Time) {
+	variation := (markPrice - forward.MarkPrice) * forward.TotalEnergy
+	forward.BuyerMargin += variation
+	forward.SellerMargin -= variation
+	forward.MarkPrice = markPrice
+	forward.MarkedAt = markedAt.Format(time.RFC3339)
+}
+
+// callMargin tops a party's margin back up to the initial margin once it has
+// fallen below the maintenance level, debiting the party's token account. If
+// the balance does not cover the call, the call stays outstanding until the
+// party posts it with PostForwardMargin.
+func callMargin(ctx contractapi.TransactionContextInterface, forward *ForwardContract, party string, margin, call *float64) error {
+	*call = 0
+	if *margin >= forward.InitialMargin*ForwardMaintenanceMarginRate {
+		return nil
+	}
+	amount := forward.InitialMargin - *margin
+	account, err := getTokenAccount(ctx, party)
+	if err != nil {
+		return err
+	}
+	if account == nil || account.Balance < amount {
+		*call = amount
+		txLog(ctx).Infof("margin call of %g on forward %s outstanding for %s", amount, forward.ForwardID, party)
+		return nil
+	}
+	if err := transferTokens(ctx, party, ForwardMarginAccount, amount); err != nil {
+		return err
+	}
+	*margin += amount
+	return nil
+}
+
+// updateMarginStatus puts the forward in MARGIN_CALL while a call is outstanding
+func updateMarginStatus(forward *ForwardContract) {
+	if forward.BuyerMarginCall > 0 || forward.SellerMarginCall > 0 {
+		forward.Status = ForwardMarginCall
+	} else {
+		forward.Status = ForwardActive
+	}
+}
+
+// MarkForwardToMarket marks an accepted forward against the reference price
+// in effect and calls margin from any party whose deposit fell below the
+// maintenance level. Each forward is marked at most once per UTC day, until
+// its delivery month starts.
+func (e *EnergyTradingContract) MarkForwardToMarket(ctx contractapi.TransactionContextInterface, forwardID string) (*ForwardContract, error) {
+	forward, err := e.GetForwardContract(ctx, forwardID)
+	if err != nil {
+		return nil, err
+	}
+	if forward.Status != ForwardActive && forward.Status != ForwardMarginCall {
+		return nil, fmt.Errorf("forward %s cannot be marked to market in status %s", forwardID, forward.Status)
+	}
+	if forward.Indexation != nil {
+		return nil, fmt.Errorf("forward %s is indexed and is not marked to market", forwardID)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start, _, err := deliveryMonthBounds(forward.DeliveryMonth)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(start) {
+		return nil, fmt.Errorf("delivery month %s has already started", forward.DeliveryMonth)
+	}
+	today := now.Format("2006-01-02")
+	if forward.MarkedAt != "" && forward.MarkedAt[:len(today)] == today {
+		return nil, fmt.Errorf("forward %s was already marked to market on %s", forwardID, today)
+	}
+	markPrice, err := currentReferencePrice(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	markForward(forward, markPrice, now)
+	if err := callMargin(ctx, forward, forward.Buyer, &forward.BuyerMargin, &forward.BuyerMarginCall); err != nil {
+		return nil, err
+	}
+	if err := callMargin(ctx, forward, forward.Seller, &forward.SellerMargin, &forward.SellerMarginCall); err != nil {
+		return nil, err
+	}
+	updateMarginStatus(forward)
+	if err := putForward(ctx, forward); err != nil {
+		return nil, err
+	}
+	return forward, emitEvent(ctx, EventForwardChanged, forward)
+}
+
+// PostForwardMargin pays the caller's outstanding margin call on a forward
+func (e *EnergyTradingContract) PostForwardMargin(ctx contractapi.TransactionContextInterface, forwardID string) (*ForwardContract, error) {
+	forward, err := e.GetForwardContract(ctx, forwardID)
+	if err != nil {
+		return nil, err
+	}
+	party, err := requireParty(ctx, forward.Buyer, forward.Seller)
+	if err != nil {
+		return nil, err
+	}
+	margin, call := &forward.BuyerMargin, &forward.BuyerMarginCall
+	if party == forward.Seller {
+		margin, call = &forward.SellerMargin, &forward.SellerMarginCall
+	}
+	if forward.Status != ForwardMarginCall || *call == 0 {
+		return nil, fmt.Errorf("no margin call is outstanding for %s on forward %s", party, forwardID)
+	}
+	if err := transferTokens(ctx, party, ForwardMarginAccount, *call); err != nil {
+		return nil, err
+	}
+	*margin += *call
+	*call = 0
+	updateMarginStatus(forward)
+	if err := putForward(ctx, forward); err != nil {
+		return nil, err
+	}
+	return forward, emitEvent(ctx, EventForwardChanged, forward)
+}
+
+// releaseMargin pays a party's margin back out of ForwardMarginAccount. A
+// party whose margin went negative at the final mark pays the deficit in.
+func releaseMargin(ctx contractapi.TransactionContextInterface, party string, margin float64) error {
+	switch {
+	case margin > 0:
+		return transferTokens(ctx, ForwardMarginAccount, party, margin)
+	case margin < 0:
+		if err := transferTokens(ctx, party, ForwardMarginAccount, -margin); err != nil {
+			return fmt.Errorf("failed to settle the margin deficit of %s: %v", party, err)
+		}
+	}
+	return nil
+}
+
+// DeliverForward settles an accepted forward without outstanding margin
+// calls; either party may call it. The forward is marked a final time, unless
+// it is indexed, and both margins are released. Before the delivery month
+// starts, the forward is converted into one confirmed trade per delivery day
+// at the final mark price, named <forwardID>-<YYYY-MM-DD>, which then settle
+// like any other trade. Once the month has started the days can no longer be
+// scheduled, so the forward is settled in cash by the margins alone; an
+// indexed forward, whose price would have followed the market, is simply
+// closed.
+func (e *EnergyTradingContract) DeliverForward(ctx contractapi.TransactionContextInterface, forwardID string) (*ForwardContract, error) {
+	forward, err := e.GetForwardContract(ctx, forwardID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := requireParty(ctx, forward.Buyer, forward.Seller); err != nil {
+		return nil, err
+	}
+	if forward.Status == ForwardMarginCall {
+		return nil, fmt.Errorf("forward %s has an outstanding margin call", forwardID)
+	}
+	if forward.Status != ForwardActive {
+		return nil, fmt.Errorf("forward %s cannot be delivered in status %s", forwardID, forward.Status)
+	}
+	start, end, err := deliveryMonthBounds(forward.DeliveryMonth)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if forward.Indexation == nil {
+		markPrice, err := currentReferencePrice(ctx, now)
+		if err != nil {
+			return nil, err
+		}
+		markForward(forward, markPrice, now)
+	}
+	// The smaller margin is released first, so that a deficit is paid in
+	// before the counterparty's gain is paid out
+	parties := []string{forward.Buyer, forward.Seller}
+	margins := []float64{forward.BuyerMargin, forward.SellerMargin}
+	if margins[1] < margins[0] {
+		parties[0], parties[1] = parties[1], parties[0]
+		margins[0], margins[1] = margins[1], margins[0]
+	}
+	for i, party := range parties {
+		if err := releaseMargin(ctx, party, margins[i]); err != nil {
+			return nil, err
+		}
+	}
+	forward.BuyerMargin, forward.SellerMargin = 0, 0
+	forward.SettledAt = now.Format(time.RFC3339)
+	forward.Status = ForwardCashSettled
+	if now.Before(start) {
+		if forward.Trades, err = createForwardTrades(ctx, forward, start, end); err != nil {
+			return nil, err
+		}
+		forward.Status = ForwardDelivered
+	}
+	if err := putForward(ctx, forward); err != nil {
+		return nil, err
+	}
+	return forward, emitEvent(ctx, EventForwardChanged, forward)
+}
+
+// createForwardTrades records the confirmed daily trades of a forward's
+// delivery month at its mark price. The trades of an indexed forward carry
+// its clause and are repriced when they settle.
+func createForwardTrades(ctx contractapi.TransactionContextInterface, forward *ForwardContract, start, end time.Time) ([]string, error) {
+	if err := checkBatchSize(ctx, int(end.Sub(start).Hours()/24), "daily trades"); err != nil {
+		return nil, err
+	}
+	trades := []string{}
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		tokenID := forward.ForwardID + "-" + day.Format("2006-01-02")
+		existing, err := ctx.GetStub().GetState(tokenID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read asset %s: %v", tokenID, err)
+		}
+		if existing != nil {
+			return nil, fmt.Errorf("asset %s already exists", tokenID)
+		}
+		privateDetailsHash, err := putPrivateDetails(ctx, forward.Buyer, forward.Seller, &TradePrivateDetails{
+			TokenID:          tokenID,
+			TransactionPrice: forward.MarkPrice,
+			Salt:             ctx.GetStub().GetTxID(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		asset := &EnergyAsset{
+			TokenID:            tokenID,
+			BuyerAddress:       forward.Buyer,
+			SellerAddress:      forward.Seller,
+			EnergyAmount:       forward.DailyEnergy,
+			SourceType:         forward.SourceType,
+			Timestamp:          forward.SettledAt,
+			DeliveryStart:      day.Format(time.RFC3339),
+			DeliveryEnd:        day.AddDate(0, 0, 1).Format(time.RFC3339),
+			ForwardID:          forward.ForwardID,
+			Indexation:         forward.Indexation,
+			PrivateDetailsHash: privateDetailsHash,
+		}
+		if err := confirmTrade(ctx, asset, forward.MarkPrice); err != nil {
+			return nil, fmt.Errorf("failed to confirm trade %s: %v", tokenID, err)
+		}
+		if err := recordTrade(ctx, asset); err != nil {
+			return nil, err
+		}
+		trades = append(trades, tokenID)
+	}
+	return trades, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestForwardMarginingAndDelivery(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	postTestReferencePrice(t, e, tc, 0.2)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 20))
+	require.NoError(t, e.MintTokens(tc, "seller1", 13))
+
+	_, err := e.ProposeForward(tc.as("outsider", ""), "fwd1", "buyer1", "seller1", "2025-06", 10, 0.2, SourceGrid)
+	require.EqualError(t, err, "caller outsider is not a party to this trade")
+	_, err = e.ProposeForward(tc.as("buyer1", ""), "fwd1", "buyer1", "seller1", "2025-05", 10, 0.2, SourceGrid)
+	require.EqualError(t, err, "delivery month 2025-05 has already started")
+	_, err = e.ProposeForward(tc, "fwd1", "buyer1", "seller1", "June", 10, 0.2, SourceGrid)
+	require.EqualError(t, err, "delivery month June must be formatted as YYYY-MM")
+	_, err = e.ProposeForward(tc, "fwd1", "buyer1", "seller1", "2025-06", 10, 0.5, SourceGrid)
+	require.EqualError(t, err, "price 0.5 is outside the band [0.1, 0.30000000000000004] around reference price 0.2")
+	forward, err := e.ProposeForward(tc, "fwd1", "buyer1", "seller1", "2025-06", 10, 0.2, SourceGrid)
+	require.NoError(t, err)
+	require.Equal(t, 300.0, forward.TotalEnergy)
+	require.InDelta(t, 12, forward.InitialMargin, 1e-9)
+	require.Equal(t, ForwardProposed, forward.Status)
+
+	// Only the counterparty accepts; both initial margins are deposited
+	_, err = e.AcceptForward(tc, "fwd1")
+	require.EqualError(t, err, "caller buyer1 is not authorized to act for seller1")
+	forward, err = e.AcceptForward(tc.as("seller1", ""), "fwd1")
+	require.NoError(t, err)
+	require.Equal(t, ForwardActive, forward.Status)
+	balance, err := e.BalanceOf(tc, "seller1", EnergyTokenID)
+	require.NoError(t, err)
+	require.InDelta(t, 1, balance, 1e-9)
+	_, err = e.CancelForwardProposal(tc.as("buyer1", ""), "fwd1")
+	require.EqualError(t, err, "forward fwd1 cannot be cancelled in status ACTIVE")
+
+	tc.as("operator1", RoleOperator)
+	_, err = e.MarkForwardToMarket(tc, "fwd1")
+	require.NoError(t, err)
+	_, err = e.MarkForwardToMarket(tc, "fwd1")
+	require.EqualError(t, err, "forward fwd1 was already marked to market on 2025-05-01")
+
+	// A price rise moves 9 tokens of variation margin to the buyer and takes
+	// the seller below maintenance; its balance cannot cover the call
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 2, 8, 0, 0, 0, time.UTC)), nil)
+	require.NoError(t, e.PostReferencePrice(tc.as("oracle1", RoleOracle), "2025-05-02T00:00:00Z", 0.23))
+	forward, err = e.MarkForwardToMarket(tc.as("operator1", RoleOperator), "fwd1")
+	require.NoError(t, err)
+	require.InDelta(t, 21, forward.BuyerMargin, 1e-9)
+	require.InDelta(t, 3, forward.SellerMargin, 1e-9)
+	require.InDelta(t, 9, forward.SellerMarginCall, 1e-9)
+	require.Equal(t, ForwardMarginCall, forward.Status)
+
+	_, err = e.DeliverForward(tc.as("buyer1", ""), "fwd1")
+	require.EqualError(t, err, "forward fwd1 has an outstanding margin call")
+	_, err = e.PostForwardMargin(tc, "fwd1")
+	require.EqualError(t, err, "no margin call is outstanding for buyer1 on forward fwd1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "seller1", 10))
+	forward, err = e.PostForwardMargin(tc.as("seller1", ""), "fwd1")
+	require.NoError(t, err)
+	require.InDelta(t, 12, forward.SellerMargin, 1e-9)
+	require.Equal(t, ForwardActive, forward.Status)
+
+	// Delivery releases the margins and converts the forward into daily
+	// trades at the final mark price
+	forward, err = e.DeliverForward(tc, "fwd1")
+	require.NoError(t, err)
+	require.Equal(t, ForwardDelivered, forward.Status)
+	require.Len(t, forward.Trades, 30)
+	require.Equal(t, "fwd1-2025-06-01", forward.Trades[0])
+	balance, err = e.BalanceOf(tc, "buyer1", EnergyTokenID)
+	require.NoError(t, err)
+	require.InDelta(t, 29, balance, 1e-9)
+	balance, err = e.BalanceOf(tc, "seller1", EnergyTokenID)
+	require.NoError(t, err)
+	require.InDelta(t, 14, balance, 1e-9)
+
+	asset, err := e.ReadEnergyAsset(tc, "fwd1-2025-06-30")
+	require.NoError(t, err)
+	require.Equal(t, StateConfirmed, asset.TransactionState)
+	require.Equal(t, "fwd1", asset.ForwardID)
+	require.Equal(t, 10.0, asset.EnergyAmount)
+	require.Equal(t, "2025-06-30T00:00:00Z", asset.DeliveryStart)
+	require.Equal(t, "2025-07-01T00:00:00Z", asset.DeliveryEnd)
+	details, err := e.ReadTradePrivateDetails(tc, "fwd1-2025-06-30")
+	require.NoError(t, err)
+	require.Equal(t, 0.23, details.TransactionPrice)
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventForwardChanged, name)
+	_, err = e.DeliverForward(tc, "fwd1")
+	require.EqualError(t, err, "forward fwd1 cannot be delivered in status DELIVERED")
+}
+
+func TestForwardCashSettlement(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	postTestReferencePrice(t, e, tc, 0.2)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 20))
+	require.NoError(t, e.MintTokens(tc, "seller1", 20))
+
+	_, err := e.ProposeForward(tc.as("seller1", ""), "fwd1", "buyer1", "seller1", "2025-06", 10, 0.2, SourceGrid)
+	require.NoError(t, err)
+	_, err = e.ProposeForward(tc, "fwd2", "buyer1", "seller1", "2025-06", 5, 0.2, SourceGrid)
+	require.NoError(t, err)
+	_, err = e.CancelForwardProposal(tc.as("buyer1", ""), "fwd2")
+	require.EqualError(t, err, "caller buyer1 is not authorized to act for seller1")
+	forward, err := e.CancelForwardProposal(tc.as("seller1", ""), "fwd2")
+	require.NoError(t, err)
+	require.Equal(t, ForwardCancelled, forward.Status)
+	_, err = e.AcceptForward(tc.as("buyer1", ""), "fwd1")
+	require.NoError(t, err)
+
+	page, err := e.GetForwardsByDeliveryMonth(tc, "2025-06", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, page.Records, 2)
+
+	// Once the delivery month has started the forward settles in cash: a
+	// price fall leaves the buyer owing 6 tokens beyond its margin
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 6, 2, 8, 0, 0, 0, time.UTC)), nil)
+	require.NoError(t, e.PostReferencePrice(tc.as("oracle1", RoleOracle), "2025-06-01T00:00:00Z", 0.14))
+	_, err = e.MarkForwardToMarket(tc.as("operator1", RoleOperator), "fwd1")
+	require.EqualError(t, err, "delivery month 2025-06 has already started")
+	forward, err = e.DeliverForward(tc.as("buyer1", ""), "fwd1")
+	require.NoError(t, err)
+	require.Equal(t, ForwardCashSettled, forward.Status)
+	require.Empty(t, forward.Trades)
+	balance, err := e.BalanceOf(tc, "buyer1", EnergyTokenID)
+	require.NoError(t, err)
+	require.InDelta(t, 2, balance, 1e-9)
+	balance, err = e.BalanceOf(tc, "seller1", EnergyTokenID)
+	require.NoError(t, err)
+	require.InDelta(t, 38, balance, 1e-9)
+}
+
+func TestIndexedForward(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	postTestReferencePrice(t, e, tc, 0.2)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 2))
+	require.NoError(t, e.MintTokens(tc, "seller1", 2))
+
+	tc.as("buyer1", "")
+	_, err := e.ProposeIndexedForward(tc, "fwd1", "buyer1", "seller1", "2025-06", 1, -0.02, 0.25, 0.15, SourceGrid)
+	require.EqualError(t, err, "price cap 0.15 is below price floor 0.25")
+	forward, err := e.ProposeIndexedForward(tc, "fwd1", "buyer1", "seller1", "2025-06", 1, -0.02, 0.15, 0.25, SourceGrid)
+	require.NoError(t, err)
+	require.InDelta(t, 0.18, forward.Price, 1e-9)
+	require.InDelta(t, 1.08, forward.InitialMargin, 1e-9)
+	_, err = e.AcceptForward(tc.as("seller1", ""), "fwd1")
+	require.NoError(t, err)
+	_, err = e.MarkForwardToMarket(tc.as("operator1", RoleOperator), "fwd1")
+	require.EqualError(t, err, "forward fwd1 is indexed and is not marked to market")
+
+	// The margins come back unchanged and the daily trades carry the clause
+	forward, err = e.DeliverForward(tc.as("buyer1", ""), "fwd1")
+	require.NoError(t, err)
+	require.Equal(t, ForwardDelivered, forward.Status)
+	balance, err := e.BalanceOf(tc, "seller1", EnergyTokenID)
+	require.NoError(t, err)
+	require.InDelta(t, 2, balance, 1e-9)
+	asset, err := e.ReadEnergyAsset(tc, "fwd1-2025-06-01")
+	require.NoError(t, err)
+	require.Equal(t, forward.Indexation, asset.Indexation)
+}
+
+func TestIndexedTradeSettlesAtIndexedPrice(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	asset.Indexation = &PriceIndexation{Spread: -0.02, Floor: 0.15, Cap: 0.25}
+	require.NoError(t, putEnergyAsset(tc, asset))
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2.5, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 2.5)
+	_, err = e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.EqualError(t, err, "no reference price is in effect at 2025-05-03T10:00:00Z to index asset energy1")
+
+	// Index 0.3 less the spread is capped at 0.25
+	require.NoError(t, e.PostReferencePrice(tc.as("oracle1", RoleOracle), "2025-05-03T00:00:00Z", 0.3))
+	settlement, err := e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+	require.InDelta(t, 0.25, settlement.Price, 1e-9)
+	require.InDelta(t, 2.5, settlement.Payment, 1e-9)
+}
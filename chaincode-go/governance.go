@@ -0,0 +1,552 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Platform parameters that governance proposals can change
+const (
+	ParamPriceBandTolerance   = "priceBandTolerance"
+	ParamMinPriceBandWidth    = "minPriceBandWidth"
+	ParamImbalancePenaltyRate = "imbalancePenaltyRate"
+	ParamGovernanceQuorum     = "governanceQuorum"
+	ParamMinVotingPeriodHours = "minVotingPeriodHours"
+	ParamGridCreditLine       = "gridCreditLine"
+)
+
+// Defaults of the governance parameters. A proposal is only accepted if
+// ballots were cast by at least GovernanceQuorum of its electorate, and it
+// votes for at least MinVotingPeriodHours.
+const (
+	GovernanceQuorum     = 0.2
+	MinVotingPeriodHours = 24.0
+)
+
+// Governance vote weightings. Under stake weighting each participant votes
+// with its token balance, which is locked in GovernanceEscrowAccount until
+// voting ends; under org weighting each organization casts one vote, through
+// whichever of its participants votes first.
+const (
+	WeightByStake = "STAKE"
+	WeightByOrg   = "ORG"
+)
+
+// GovernanceEscrowAccount holds the stake of stake weighted votes until the
+// voters release it after voting ends, so the same tokens cannot vote twice
+const GovernanceEscrowAccount = "governance-escrow"
+
+// Governance proposal statuses. A proposal votes until VotingEnd, is then
+// accepted if it reached its quorum and the weight for it exceeds the weight
+// against it, and an accepted proposal is applied from EffectiveAt once it
+// has been enacted.
+const (
+	ProposalVoting   = "VOTING"
+	ProposalAccepted = "ACCEPTED"
+	ProposalRejected = "REJECTED"
+	ProposalApplied  = "APPLIED"
+)
+
+// platformConfigKey holds the change of every enacted proposal in order of
+// effect, so that trades and settlements read the parameters in force with a
+// single GetState
+const platformConfigKey = "platformconfig"
+
+// PlatformConfig holds the platform parameters in force, starting from their
+// defaults with every applied proposal laid over them in order of effect
+type PlatformConfig struct {
+	PriceBandTolerance   float64  `json:"priceBandTolerance"`
+	MinPriceBandWidth    float64  `json:"minPriceBandWidth"`
+	ImbalancePenaltyRate float64  `json:"imbalancePenaltyRate"`
+	GovernanceQuorum     float64  `json:"governanceQuorum"`
+	MinVotingPeriodHours float64  `json:"minVotingPeriodHours"`
+	GridCreditLine       float64  `json:"gridCreditLine"`
+	ProposalIDs          []string `json:"proposalIDs"`
+}
+
+// ConfigChange is the new parameter value of an enacted proposal and the
+// time from which it applies
+type ConfigChange struct {
+	ProposalID  string  `json:"proposalID"`
+	Parameter   string  `json:"parameter"`
+	Value       float64 `json:"value"`
+	EffectiveAt string  `json:"effectiveAt"`
+}
+
+// GovernanceProposal proposes a new value for a platform parameter.
+// Electorate is the number of ballots the proposal could receive when it was
+// made, and Quorum the number it needs.
+type GovernanceProposal struct {
+	ProposalID   string  `json:"proposalID"`
+	Parameter    string  `json:"parameter"`
+	Value        float64 `json:"value"`
+	Weighting    string  `json:"weighting"`
+	Proposer     string  `json:"proposer"`
+	ProposedAt   string  `json:"proposedAt"`
+	VotingEnd    string  `json:"votingEnd"`
+	EffectiveAt  string  `json:"effectiveAt"`
+	VotesFor     float64 `json:"votesFor"`
+	VotesAgainst float64 `json:"votesAgainst"`
+	Electorate   int     `json:"electorate"`
+	Quorum       int     `json:"quorum"`
+	Ballots      int     `json:"ballots"`
+	EnactedAt    string  `json:"enactedAt,omitempty"`
+	Status       string  `json:"status"`
+}
+
+// GovernanceVote is one participant's or organization's vote on a proposal
+type GovernanceVote struct {
+	ProposalID string  `json:"proposalID"`
+	Voter      string  `json:"voter"`
+	MSPID      string  `json:"mspID"`
+	Support    bool    `json:"support"`
+	Weight     float64 `json:"weight"`
+	CastAt     string  `json:"castAt"`
+	Released   bool    `json:"released,omitempty"`
+}
+
+func governanceProposalKey(ctx contractapi.TransactionContextInterface, proposalID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("govproposal", []string{proposalID})
+}
+
+func governanceVoteKey(ctx contractapi.TransactionContextInterface, proposalID, voter string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("govvote", []string{proposalID, voter})
+}
+
+// validateParameter checks a proposed value of a platform parameter
+func validateParameter(parameter string, value float64) error {
+	switch parameter {
+	case ParamPriceBandTolerance:
+		if value <= 0 || value >= 1 {
+			return fmt.Errorf("%s must be in (0, 1)", parameter)
+		}
+	case ParamMinPriceBandWidth, ParamImbalancePenaltyRate, ParamGridCreditLine:
+		if value < 0 {
+			return fmt.Errorf("%s must not be negative", parameter)
+		}
+	case ParamGovernanceQuorum:
+		if value <= 0 || value > 1 {
+			return fmt.Errorf("%s must be in (0, 1]", parameter)
+		}
+	case ParamMinVotingPeriodHours:
+		if value <= 0 {
+			return fmt.Errorf("%s must be positive", parameter)
+		}
+	default:
+		return fmt.Errorf("unknown platform parameter %s", parameter)
+	}
+	return nil
+}
+
+// proposalStatus returns the status of a proposal at the given time
+func proposalStatus(proposal *GovernanceProposal, now string) string {
+	switch {
+	case now < proposal.VotingEnd:
+		return ProposalVoting
+	case proposal.Ballots < proposal.Quorum || proposal.VotesFor <= proposal.VotesAgainst:
+		return ProposalRejected
+	case proposal.EnactedAt == "" || now < proposal.EffectiveAt:
+		return ProposalAccepted
+	default:
+		return ProposalApplied
+	}
+}
+
+// getConfigChanges returns the changes of the enacted proposals in order of
+// effect
+func getConfigChanges(ctx contractapi.TransactionContextInterface) ([]*ConfigChange, error) {
+	changesJSON, err := ctx.GetStub().GetState(platformConfigKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read platform config: %v", err)
+	}
+	changes := []*ConfigChange{}
+	if changesJSON == nil {
+		return changes, nil
+	}
+	if err := json.Unmarshal(changesJSON, &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// platformConfigAt returns the platform parameters in force at a time
+func platformConfigAt(ctx contractapi.TransactionContextInterface, at time.Time) (*PlatformConfig, error) {
+	changes, err := getConfigChanges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := at.Format(time.RFC3339)
+	config := &PlatformConfig{
+		PriceBandTolerance:   PriceBandTolerance,
+		MinPriceBandWidth:    MinPriceBandWidth,
+		ImbalancePenaltyRate: ImbalancePenaltyRate,
+		GovernanceQuorum:     GovernanceQuorum,
+		MinVotingPeriodHours: MinVotingPeriodHours,
+		GridCreditLine:       GridCreditLine,
+		ProposalIDs:          []string{},
+	}
+	for _, change := range changes {
+		if change.EffectiveAt > now {
+			break
+		}
+		switch change.Parameter {
+		case ParamPriceBandTolerance:
+			config.PriceBandTolerance = change.Value
+		case ParamMinPriceBandWidth:
+			config.MinPriceBandWidth = change.Value
+		case ParamImbalancePenaltyRate:
+			config.ImbalancePenaltyRate = change.Value
+		case ParamGovernanceQuorum:
+			config.GovernanceQuorum = change.Value
+		case ParamMinVotingPeriodHours:
+			config.MinVotingPeriodHours = change.Value
+		case ParamGridCreditLine:
+			config.GridCreditLine = change.Value
+		}
+		config.ProposalIDs = append(config.ProposalIDs, change.ProposalID)
+	}
+	return config, nil
+}
+
+// governanceElectorate counts the ballots a proposal with the given weighting
+// can receive: one per approved participant under stake weighting, one per
+// organization with an approved participant under org weighting
+func governanceElectorate(ctx contractapi.TransactionContextInterface, weighting string) (int, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("participant", []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	ballots := map[string]bool{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		var participant Participant
+		if err := json.Unmarshal(queryResponse.Value, &participant); err != nil {
+			return 0, err
+		}
+		if participant.KYCStatus != KYCApproved || participant.Erased {
+			continue
+		}
+		if weighting == WeightByOrg {
+			ballots[participant.MSPID] = true
+		} else {
+			ballots[participant.Address] = true
+		}
+	}
+	return len(ballots), nil
+}
+
+// GetPlatformConfig returns the platform parameters in force at the
+// transaction time
+func (e *EnergyTradingContract) GetPlatformConfig(ctx contractapi.TransactionContextInterface) (*PlatformConfig, error) {
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return platformConfigAt(ctx, now)
+}
+
+func putGovernanceProposal(ctx contractapi.TransactionContextInterface, proposal *GovernanceProposal) error {
+	proposalJSON, err := json.Marshal(proposal)
+	if err != nil {
+		return err
+	}
+	key, err := governanceProposalKey(ctx, proposal.ProposalID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, proposalJSON)
+}
+
+// GetGovernanceProposal returns a proposal with its status at the
+// transaction time
+func (e *EnergyTradingContract) GetGovernanceProposal(ctx contractapi.TransactionContextInterface, proposalID string) (*GovernanceProposal, error) {
+	key, err := governanceProposalKey(ctx, proposalID)
+	if err != nil {
+		return nil, err
+	}
+	proposalJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proposal %s: %v", proposalID, err)
+	}
+	if proposalJSON == nil {
+		return nil, fmt.Errorf("proposal %s does not exist", proposalID)
+	}
+	var proposal GovernanceProposal
+	if err := json.Unmarshal(proposalJSON, &proposal); err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	proposal.Status = proposalStatus(&proposal, now)
+	return &proposal, nil
+}
+
+// ProposeConfigChange proposes a new value for a platform parameter. Approved
+// participants vote on it until votingEnd, at least the minimum voting period
+// away, with the given weighting. If it is accepted the value applies from
+// effectiveAt, which must not be before votingEnd. The quorum is the share of
+// the electorate in force when the proposal is made.
+func (e *EnergyTradingContract) ProposeConfigChange(ctx contractapi.TransactionContextInterface, proposalID, parameter string, value float64, weighting, votingEnd, effectiveAt string) (*GovernanceProposal, error) {
+	if err := validateParameter(parameter, value); err != nil {
+		return nil, err
+	}
+	if weighting != WeightByStake && weighting != WeightByOrg {
+		return nil, fmt.Errorf("weighting must be %s or %s", WeightByStake, WeightByOrg)
+	}
+	proposer, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := requireApprovedParticipant(ctx, proposer); err != nil {
+		return nil, err
+	}
+	votingEnd, err = normalizeTimestamp(votingEnd)
+	if err != nil {
+		return nil, err
+	}
+	effectiveAt, err = normalizeTimestamp(effectiveAt)
+	if err != nil {
+		return nil, err
+	}
+	nowTime, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := nowTime.Format(time.RFC3339)
+	config, err := platformConfigAt(ctx, nowTime)
+	if err != nil {
+		return nil, err
+	}
+	minVotingEnd := nowTime.Add(time.Duration(config.MinVotingPeriodHours * float64(time.Hour))).Format(time.RFC3339)
+	if votingEnd < minVotingEnd {
+		return nil, fmt.Errorf("voting end %s is before %s, the end of the minimum voting period of %v hours", votingEnd, minVotingEnd, config.MinVotingPeriodHours)
+	}
+	if effectiveAt < votingEnd {
+		return nil, fmt.Errorf("effective time %s is before voting end %s", effectiveAt, votingEnd)
+	}
+	key, err := governanceProposalKey(ctx, proposalID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proposal %s: %v", proposalID, err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("proposal %s already exists", proposalID)
+	}
+	electorate, err := governanceElectorate(ctx, weighting)
+	if err != nil {
+		return nil, err
+	}
+
+	proposal := &GovernanceProposal{
+		ProposalID:  proposalID,
+		Parameter:   parameter,
+		Value:       value,
+		Weighting:   weighting,
+		Proposer:    proposer,
+		ProposedAt:  now,
+		VotingEnd:   votingEnd,
+		EffectiveAt: effectiveAt,
+		Electorate:  electorate,
+		Quorum:      int(math.Ceil(config.GovernanceQuorum*float64(electorate) - 1e-9)),
+		Status:      ProposalVoting,
+	}
+	if err := putGovernanceProposal(ctx, proposal); err != nil {
+		return nil, err
+	}
+	return proposal, emitEvent(ctx, EventGovernanceProposalChanged, proposal)
+}
+
+// CastGovernanceVote records the caller's vote for or against a proposal
+// still voting. Each participant votes once; under org weighting each
+// organization votes once. A stake weighted vote locks the caller's whole
+// balance until ReleaseGovernanceStake after voting ends.
+func (e *EnergyTradingContract) CastGovernanceVote(ctx contractapi.TransactionContextInterface, proposalID string, support bool) (*GovernanceVote, error) {
+	proposal, err := e.GetGovernanceProposal(ctx, proposalID)
+	if err != nil {
+		return nil, err
+	}
+	if proposal.Status != ProposalVoting {
+		return nil, fmt.Errorf("voting on proposal %s closed at %s", proposalID, proposal.VotingEnd)
+	}
+	voter, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	participant, err := requireApprovedParticipant(ctx, voter)
+	if err != nil {
+		return nil, err
+	}
+	ballot, weight := voter, 1.0
+	if proposal.Weighting == WeightByOrg {
+		ballot = participant.MSPID
+	}
+	key, err := governanceVoteKey(ctx, proposalID, ballot)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vote: %v", err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("%s has already voted on proposal %s", ballot, proposalID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if proposal.Weighting == WeightByStake {
+		account, err := getTokenAccount(ctx, voter)
+		if err != nil {
+			return nil, err
+		}
+		if account == nil || account.Balance <= 0 {
+			return nil, fmt.Errorf("%s has no stake to vote with", voter)
+		}
+		weight = account.Balance
+		exists, err := tokenAccountExists(ctx, GovernanceEscrowAccount)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			if err := putTokenAccount(ctx, &TokenAccount{AccountID: GovernanceEscrowAccount}); err != nil {
+				return nil, err
+			}
+		}
+		if err := transferTokens(ctx, voter, GovernanceEscrowAccount, weight); err != nil {
+			return nil, fmt.Errorf("failed to lock the stake of %s: %v", voter, err)
+		}
+	}
+
+	vote := &GovernanceVote{ProposalID: proposalID, Voter: voter, MSPID: participant.MSPID, Support: support, Weight: weight, CastAt: now}
+	if err := putGovernanceVote(ctx, key, vote); err != nil {
+		return nil, err
+	}
+	proposal.Ballots++
+	if support {
+		proposal.VotesFor += weight
+	} else {
+		proposal.VotesAgainst += weight
+	}
+	if err := putGovernanceProposal(ctx, proposal); err != nil {
+		return nil, err
+	}
+	return vote, emitEvent(ctx, EventGovernanceProposalChanged, proposal)
+}
+
+func putGovernanceVote(ctx contractapi.TransactionContextInterface, key string, vote *GovernanceVote) error {
+	voteJSON, err := json.Marshal(vote)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, voteJSON)
+}
+
+// ReleaseGovernanceStake returns the stake the caller locked by voting on a
+// stake weighted proposal, once voting has ended
+func (e *EnergyTradingContract) ReleaseGovernanceStake(ctx contractapi.TransactionContextInterface, proposalID string) (*GovernanceVote, error) {
+	proposal, err := e.GetGovernanceProposal(ctx, proposalID)
+	if err != nil {
+		return nil, err
+	}
+	if proposal.Weighting != WeightByStake {
+		return nil, fmt.Errorf("votes on proposal %s lock no stake", proposalID)
+	}
+	if proposal.Status == ProposalVoting {
+		return nil, fmt.Errorf("voting on proposal %s is open until %s", proposalID, proposal.VotingEnd)
+	}
+	voter, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key, err := governanceVoteKey(ctx, proposalID, voter)
+	if err != nil {
+		return nil, err
+	}
+	voteJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vote: %v", err)
+	}
+	if voteJSON == nil {
+		return nil, fmt.Errorf("%s has not voted on proposal %s", voter, proposalID)
+	}
+	var vote GovernanceVote
+	if err := json.Unmarshal(voteJSON, &vote); err != nil {
+		return nil, err
+	}
+	if vote.Released {
+		return nil, fmt.Errorf("stake of %s on proposal %s is already released", voter, proposalID)
+	}
+	if err := transferTokens(ctx, GovernanceEscrowAccount, voter, vote.Weight); err != nil {
+		return nil, err
+	}
+	vote.Released = true
+	if err := putGovernanceVote(ctx, key, &vote); err != nil {
+		return nil, err
+	}
+	return &vote, nil
+}
+
+// EnactGovernanceProposal records the change of an accepted proposal in the
+// platform config once voting has ended. Anyone may enact it. A proposal
+// enacted after its effective time applies from its enactment, so the
+// parameters in force in the past never change.
+func (e *EnergyTradingContract) EnactGovernanceProposal(ctx contractapi.TransactionContextInterface, proposalID string) (*GovernanceProposal, error) {
+	proposal, err := e.GetGovernanceProposal(ctx, proposalID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case proposal.Status == ProposalVoting:
+		return nil, fmt.Errorf("voting on proposal %s is open until %s", proposalID, proposal.VotingEnd)
+	case proposal.Status == ProposalRejected:
+		return nil, fmt.Errorf("proposal %s was rejected", proposalID)
+	case proposal.EnactedAt != "":
+		return nil, fmt.Errorf("proposal %s was enacted at %s", proposalID, proposal.EnactedAt)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if proposal.EffectiveAt < now {
+		proposal.EffectiveAt = now
+	}
+	proposal.EnactedAt = now
+
+	changes, err := getConfigChanges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, &ConfigChange{ProposalID: proposalID, Parameter: proposal.Parameter, Value: proposal.Value, EffectiveAt: proposal.EffectiveAt})
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].EffectiveAt < changes[j].EffectiveAt
+	})
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(platformConfigKey, changesJSON); err != nil {
+		return nil, err
+	}
+	proposal.Status = proposalStatus(proposal, now)
+	if err := putGovernanceProposal(ctx, proposal); err != nil {
+		return nil, err
+	}
+	return proposal, emitEvent(ctx, EventGovernanceProposalChanged, proposal)
+}
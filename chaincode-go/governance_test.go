@@ -0,0 +1,164 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestGovernanceStakeWeightedProposal(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "carol", RoleConsumer)
+	postTestReferencePrice(t, e, tc, 0.2)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 4))
+
+	tc.as("buyer1", "")
+	_, err := e.ProposeConfigChange(tc, "band", ParamPriceBandTolerance, 1.5, WeightByStake, "2025-05-02T08:00:00Z", "2025-05-03T00:00:00Z")
+	require.EqualError(t, err, "priceBandTolerance must be in (0, 1)")
+	_, err = e.ProposeConfigChange(tc, "band", ParamPriceBandTolerance, 0.2, WeightByStake, "2025-05-02T08:00:00Z", "2025-05-02T00:00:00Z")
+	require.EqualError(t, err, "effective time 2025-05-02T00:00:00Z is before voting end 2025-05-02T08:00:00Z")
+	_, err = e.ProposeConfigChange(tc, "band", ParamPriceBandTolerance, 0.2, WeightByStake, "2025-05-01T20:00:00Z", "2025-05-03T00:00:00Z")
+	require.EqualError(t, err, "voting end 2025-05-01T20:00:00Z is before 2025-05-02T08:00:00Z, the end of the minimum voting period of 24 hours")
+	proposal, err := e.ProposeConfigChange(tc, "band", ParamPriceBandTolerance, 0.2, WeightByStake, "2025-05-02T08:00:00Z", "2025-05-03T00:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, ProposalVoting, proposal.Status)
+	require.Equal(t, 3, proposal.Electorate)
+	require.Equal(t, 1, proposal.Quorum)
+
+	vote, err := e.CastGovernanceVote(tc, "band", true)
+	require.NoError(t, err)
+	require.Equal(t, 10.0, vote.Weight)
+	// The stake is locked, so it cannot be passed on to vote again
+	require.EqualError(t, e.TransferTokens(tc, "carol", 5, 0), "account buyer1 has insufficient balance")
+	_, err = e.ReleaseGovernanceStake(tc, "band")
+	require.EqualError(t, err, "voting on proposal band is open until 2025-05-02T08:00:00Z")
+	_, err = e.CastGovernanceVote(tc.as("seller1", ""), "band", false)
+	require.NoError(t, err)
+	_, err = e.CastGovernanceVote(tc, "band", true)
+	require.EqualError(t, err, "seller1 has already voted on proposal band")
+	_, err = e.CastGovernanceVote(tc.as("carol", ""), "band", false)
+	require.EqualError(t, err, "carol has no stake to vote with")
+	_, err = e.EnactGovernanceProposal(tc, "band")
+	require.EqualError(t, err, "voting on proposal band is open until 2025-05-02T08:00:00Z")
+
+	// Accepted once voting ends, but the old band holds until the effective time
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 2, 9, 0, 0, 0, time.UTC)), nil)
+	_, err = e.CastGovernanceVote(tc.as("carol", ""), "band", false)
+	require.EqualError(t, err, "voting on proposal band closed at 2025-05-02T08:00:00Z")
+	proposal, err = e.GetGovernanceProposal(tc, "band")
+	require.NoError(t, err)
+	require.Equal(t, ProposalAccepted, proposal.Status)
+	require.Equal(t, 4.0, proposal.VotesAgainst)
+	proposal, err = e.EnactGovernanceProposal(tc, "band")
+	require.NoError(t, err)
+	require.Equal(t, "2025-05-02T09:00:00Z", proposal.EnactedAt)
+	require.Equal(t, ProposalAccepted, proposal.Status)
+	_, err = e.EnactGovernanceProposal(tc, "band")
+	require.EqualError(t, err, "proposal band was enacted at 2025-05-02T09:00:00Z")
+	require.NoError(t, validatePriceBand(tc, 0.25))
+
+	vote, err = e.ReleaseGovernanceStake(tc.as("buyer1", ""), "band")
+	require.NoError(t, err)
+	require.True(t, vote.Released)
+	_, err = e.ReleaseGovernanceStake(tc, "band")
+	require.EqualError(t, err, "stake of buyer1 on proposal band is already released")
+	account, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, 10.0, account.Balance)
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 1, 0, 0, 0, time.UTC)), nil)
+	config, err := e.GetPlatformConfig(tc)
+	require.NoError(t, err)
+	require.Equal(t, &PlatformConfig{PriceBandTolerance: 0.2, MinPriceBandWidth: MinPriceBandWidth, ImbalancePenaltyRate: ImbalancePenaltyRate, GovernanceQuorum: GovernanceQuorum, MinVotingPeriodHours: MinVotingPeriodHours, GridCreditLine: GridCreditLine, ProposalIDs: []string{"band"}}, config)
+	require.Error(t, validatePriceBand(tc, 0.28))
+	proposal, err = e.GetGovernanceProposal(tc, "band")
+	require.NoError(t, err)
+	require.Equal(t, ProposalApplied, proposal.Status)
+}
+
+func TestGovernanceOrgWeightedProposal(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	tc.identity.GetMSPIDReturns("Org2MSP", nil)
+	registerTestParticipant(t, e, tc, "carol", RoleConsumer)
+	tc.identity.GetMSPIDReturns("Org1MSP", nil)
+
+	_, err := e.ProposeConfigChange(tc.as("seller1", ""), "penalty", ParamImbalancePenaltyRate, 2, WeightByOrg, "2025-05-02T08:00:00Z", "2025-05-02T08:00:00Z")
+	require.NoError(t, err)
+	_, err = e.CastGovernanceVote(tc.as("buyer1", ""), "penalty", false)
+	require.NoError(t, err)
+	_, err = e.CastGovernanceVote(tc.as("seller1", ""), "penalty", true)
+	require.EqualError(t, err, "Org1MSP has already voted on proposal penalty")
+	vote, err := e.CastGovernanceVote(tc.as("carol", ""), "penalty", true)
+	require.NoError(t, err)
+	require.Equal(t, "Org2MSP", vote.MSPID)
+
+	// A tie rejects the proposal
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 2, 8, 0, 0, 0, time.UTC)), nil)
+	proposal, err := e.GetGovernanceProposal(tc, "penalty")
+	require.NoError(t, err)
+	require.Equal(t, ProposalRejected, proposal.Status)
+	_, err = e.EnactGovernanceProposal(tc, "penalty")
+	require.EqualError(t, err, "proposal penalty was rejected")
+	config, err := e.GetPlatformConfig(tc)
+	require.NoError(t, err)
+	require.Equal(t, ImbalancePenaltyRate, config.ImbalancePenaltyRate)
+}
+
+func TestGovernanceLateEnactment(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	_, err := e.ProposeConfigChange(tc.as("buyer1", ""), "penalty", ParamImbalancePenaltyRate, 2, WeightByOrg, "2025-05-02T08:00:00Z", "2025-05-02T12:00:00Z")
+	require.NoError(t, err)
+	_, err = e.CastGovernanceVote(tc, "penalty", true)
+	require.NoError(t, err)
+
+	// Not enacted by its effective time, the change waits for its enactment
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 2, 14, 0, 0, 0, time.UTC)), nil)
+	proposal, err := e.GetGovernanceProposal(tc, "penalty")
+	require.NoError(t, err)
+	require.Equal(t, ProposalAccepted, proposal.Status)
+	proposal, err = e.EnactGovernanceProposal(tc, "penalty")
+	require.NoError(t, err)
+	require.Equal(t, "2025-05-02T14:00:00Z", proposal.EffectiveAt)
+	require.Equal(t, ProposalApplied, proposal.Status)
+
+	config, err := platformConfigAt(tc, time.Date(2025, 5, 2, 13, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, ImbalancePenaltyRate, config.ImbalancePenaltyRate)
+	config, err = e.GetPlatformConfig(tc)
+	require.NoError(t, err)
+	require.Equal(t, 2.0, config.ImbalancePenaltyRate)
+}
+
+func TestGovernanceQuorum(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	for _, address := range []string{"buyer1", "seller1", "carol", "dave", "erin", "frank"} {
+		registerTestParticipant(t, e, tc, address, RoleConsumer)
+	}
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+
+	proposal, err := e.ProposeConfigChange(tc.as("buyer1", ""), "band", ParamPriceBandTolerance, 0.2, WeightByStake, "2025-05-02T08:00:00Z", "2025-05-02T08:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 6, proposal.Electorate)
+	require.Equal(t, 2, proposal.Quorum)
+	_, err = e.CastGovernanceVote(tc, "band", true)
+	require.NoError(t, err)
+
+	// A unanimous vote by too few voters does not carry the proposal
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 2, 8, 0, 0, 0, time.UTC)), nil)
+	proposal, err = e.GetGovernanceProposal(tc, "band")
+	require.NoError(t, err)
+	require.Equal(t, 1, proposal.Ballots)
+	require.Equal(t, ProposalRejected, proposal.Status)
+}
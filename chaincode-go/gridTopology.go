@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Curtailment reasons
+const (
+	CurtailmentCongestion = "CONGESTION"
+	CurtailmentOrdered    = "ORDER"
+)
+
+// GridCapacity is the energy, in kWh per meter interval, that the feeder and
+// transformer of a zone can carry out of the zone (ExportLimit) and into it
+// (ImportLimit). A zone with no capacity posted for an interval is
+// unconstrained.
+type GridCapacity struct {
+	Zone          string  `json:"zone"`
+	IntervalStart string  `json:"intervalStart"`
+	ExportLimit   float64 `json:"exportLimit"`
+	ImportLimit   float64 `json:"importLimit"`
+	Operator      string  `json:"operator"`
+	UpdatedAt     string  `json:"updatedAt"`
+}
+
+// ZoneFlow is the energy confirmed trades schedule out of and into a zone in
+// one meter interval. Trades within a zone stay behind its transformer, so
+// only trades between zones are counted.
+type ZoneFlow struct {
+	Zone          string  `json:"zone"`
+	IntervalStart string  `json:"intervalStart"`
+	Export        float64 `json:"export"`
+	Import        float64 `json:"import"`
+}
+
+// Curtailment records energy removed from a trade's schedule
+type Curtailment struct {
+	TokenID         string  `json:"tokenID"`
+	Reason          string  `json:"reason"`
+	Zone            string  `json:"zone"`
+	IntervalStart   string  `json:"intervalStart"`
+	CurtailedEnergy float64 `json:"curtailedEnergy"`
+	Compensation    float64 `json:"compensation,omitempty"`
+	RecordedAt      string  `json:"recordedAt"`
+	TxID            string  `json:"txID"`
+}
+
+func gridCapacityKey(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("gridcapacity", []string{zone, intervalStart})
+}
+
+func zoneFlowKey(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("zoneflow", []string{zone, intervalStart})
+}
+
+// zoneTradeKey indexes confirmed trades by the zones and intervals they
+// deliver in, so that curtailment orders can find them
+func zoneTradeKey(ctx contractapi.TransactionContextInterface, zone, intervalStart, tokenID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("zonetrade", []string{zone, intervalStart, tokenID})
+}
+
+func putZoneTradeIndex(ctx contractapi.TransactionContextInterface, zone, intervalStart, tokenID string) error {
+	key, err := zoneTradeKey(ctx, zone, intervalStart, tokenID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, []byte(tokenID))
+}
+
+func curtailmentKey(ctx contractapi.TransactionContextInterface, tokenID, txID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("curtailment", []string{tokenID, txID})
+}
+
+// scheduledEnergy is the energy a trade is still scheduled to deliver after curtailments
+func scheduledEnergy(asset *EnergyAsset) float64 {
+	return asset.EnergyAmount - asset.CurtailedEnergy
+}
+
+// SetGridCapacity records the export and import limits of a zone for one
+// meter interval, replacing any limits set before. Trades already confirmed
+// are not affected.
+func (e *EnergyTradingContract) SetGridCapacity(ctx contractapi.TransactionContextInterface, zone, intervalStart string, exportLimit, importLimit float64) error {
+	if zone == "" {
+		return fmt.Errorf("zone must not be empty")
+	}
+	if exportLimit < 0 || importLimit < 0 {
+		return fmt.Errorf("capacity limits must not be negative")
+	}
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return err
+	}
+	operator, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	capacity := GridCapacity{
+		Zone:          zone,
+		IntervalStart: intervalStart,
+		ExportLimit:   exportLimit,
+		ImportLimit:   importLimit,
+		Operator:      operator,
+		UpdatedAt:     now,
+	}
+	capacityJSON, err := json.Marshal(capacity)
+	if err != nil {
+		return err
+	}
+	key, err := gridCapacityKey(ctx, zone, intervalStart)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, capacityJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventGridCapacitySet, capacity)
+}
+
+// GetGridCapacity returns the limits of a zone for one meter interval
+func (e *EnergyTradingContract) GetGridCapacity(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (*GridCapacity, error) {
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	capacity, err := getGridCapacity(ctx, zone, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if capacity == nil {
+		return nil, fmt.Errorf("zone %s has no capacity limits for %s", zone, intervalStart)
+	}
+	return capacity, nil
+}
+
+// GetZoneFlow returns the energy scheduled out of and into a zone in one meter interval
+func (e *EnergyTradingContract) GetZoneFlow(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (*ZoneFlow, error) {
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	return getZoneFlow(ctx, zone, intervalStart)
+}
+
+// PaginatedCurtailmentResult is a page of curtailments
+type PaginatedCurtailmentResult struct {
+	Records             []*Curtailment `json:"records"`
+	FetchedRecordsCount int32          `json:"fetchedRecordsCount"`
+	Bookmark            string         `json:"bookmark"`
+}
+
+// GetCurtailments returns a page of the curtailments recorded against a trade
+func (e *EnergyTradingContract) GetCurtailments(ctx contractapi.TransactionContextInterface, tokenID string, pageSize int32, bookmark string) (*PaginatedCurtailmentResult, error) {
+	result := &PaginatedCurtailmentResult{Records: []*Curtailment{}}
+	metadata, err := queryPage(ctx, "curtailment", []string{tokenID}, pageSize, bookmark, func(value []byte) error {
+		var curtailment Curtailment
+		if err := json.Unmarshal(value, &curtailment); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &curtailment)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// getCurtailments returns every curtailment recorded against a trade
+func getCurtailments(ctx contractapi.TransactionContextInterface, tokenID string) ([]*Curtailment, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("curtailment", []string{tokenID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	curtailments := []*Curtailment{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var curtailment Curtailment
+		if err := json.Unmarshal(queryResponse.Value, &curtailment); err != nil {
+			return nil, err
+		}
+		curtailments = append(curtailments, &curtailment)
+	}
+	return curtailments, nil
+}
+
+// getGridCapacity returns the limits of a zone for an interval, or nil if none are set
+func getGridCapacity(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (*GridCapacity, error) {
+	key, err := gridCapacityKey(ctx, zone, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	capacityJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read grid capacity: %v", err)
+	}
+	if capacityJSON == nil {
+		return nil, nil
+	}
+	var capacity GridCapacity
+	if err := json.Unmarshal(capacityJSON, &capacity); err != nil {
+		return nil, err
+	}
+	return &capacity, nil
+}
+
+// getZoneFlow returns the scheduled flow of a zone for an interval, zero if nothing is scheduled
+func getZoneFlow(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (*ZoneFlow, error) {
+	key, err := zoneFlowKey(ctx, zone, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	flowJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zone flow: %v", err)
+	}
+	if flowJSON == nil {
+		return &ZoneFlow{Zone: zone, IntervalStart: intervalStart}, nil
+	}
+	var flow ZoneFlow
+	if err := json.Unmarshal(flowJSON, &flow); err != nil {
+		return nil, err
+	}
+	return &flow, nil
+}
+
+func putZoneFlow(ctx contractapi.TransactionContextInterface, flow *ZoneFlow) error {
+	flowJSON, err := json.Marshal(flow)
+	if err != nil {
+		return err
+	}
+	key, err := zoneFlowKey(ctx, flow.Zone, flow.IntervalStart)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, flowJSON)
+}
+
+func putCurtailment(ctx contractapi.TransactionContextInterface, curtailment *Curtailment) error {
+	curtailmentJSON, err := json.Marshal(curtailment)
+	if err != nil {
+		return err
+	}
+	key, err := curtailmentKey(ctx, curtailment.TokenID, curtailment.TxID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, curtailmentJSON)
+}
+
+// deliveryInterval is the part of a trade's delivery window falling in one meter interval
+type deliveryInterval struct {
+	start string
+	share float64
+}
+
+// deliveryIntervals splits a trade's delivery window into time slots, each
+// with the share of the window it covers
+func deliveryIntervals(ctx contractapi.TransactionContextInterface, asset *EnergyAsset) ([]deliveryInterval, error) {
+	length, err := slotLength(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseTimestamp(asset.DeliveryStart)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimestamp(asset.DeliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+	window := end.Sub(start)
+
+	intervals := []deliveryInterval{}
+	for interval := start.Truncate(length); interval.Before(end); interval = interval.Add(length) {
+		overlap := minTime(interval.Add(length), end).Sub(maxTime(interval, start))
+		intervals = append(intervals, deliveryInterval{start: interval.Format(time.RFC3339), share: float64(overlap) / float64(window)})
+	}
+	return intervals, nil
+}
+
+// scheduleGridFlows indexes a trade under its time slots and its parties'
+// zones, adds its scheduled energy to the zones' transformer loads, and adds
+// a trade between two zones to the zones' scheduled flows. When the trade would
+// exceed a limit in some interval, its energy is curtailed uniformly to what
+// the tightest interval can still carry and the curtailment is recorded; when
+// nothing can be carried the trade is rejected.
+func scheduleGridFlows(ctx contractapi.TransactionContextInterface, asset *EnergyAsset) error {
+	seller, err := getParticipant(ctx, asset.SellerAddress)
+	if err != nil {
+		return err
+	}
+	buyer, err := getParticipant(ctx, asset.BuyerAddress)
+	if err != nil {
+		return err
+	}
+	if seller == nil || buyer == nil {
+		return fmt.Errorf("participants of asset %s are not registered", asset.TokenID)
+	}
+	intervals, err := deliveryIntervals(ctx, asset)
+	if err != nil {
+		return err
+	}
+	for _, interval := range intervals {
+		if err := putSlotTradeIndex(ctx, interval.start, asset.TokenID); err != nil {
+			return err
+		}
+		for _, zone := range []string{seller.Zone, buyer.Zone} {
+			if err := putZoneTradeIndex(ctx, zone, interval.start, asset.TokenID); err != nil {
+				return err
+			}
+		}
+	}
+	if seller.Zone == buyer.Zone {
+		return trackTransformerLoads(ctx, asset, seller.Zone, buyer.Zone, intervals)
+	}
+
+	// fraction is the share of the trade the grid can carry
+	fraction := 1.0
+	var bindingZone, bindingInterval string
+	exports := make([]*ZoneFlow, len(intervals))
+	imports := make([]*ZoneFlow, len(intervals))
+	for i, interval := range intervals {
+		portion := asset.EnergyAmount * interval.share
+		for _, side := range []struct {
+			zone   string
+			export bool
+			flows  []*ZoneFlow
+		}{{seller.Zone, true, exports}, {buyer.Zone, false, imports}} {
+			flow, err := getZoneFlow(ctx, side.zone, interval.start)
+			if err != nil {
+				return err
+			}
+			side.flows[i] = flow
+			capacity, err := getGridCapacity(ctx, side.zone, interval.start)
+			if err != nil {
+				return err
+			}
+			if capacity == nil {
+				continue
+			}
+			headroom := capacity.ImportLimit - flow.Import
+			if side.export {
+				headroom = capacity.ExportLimit - flow.Export
+			}
+			if headroom < portion*fraction {
+				fraction = headroom / portion
+				bindingZone, bindingInterval = side.zone, interval.start
+			}
+		}
+	}
+	if fraction <= 0 {
+		return fmt.Errorf("grid capacity of zone %s is exhausted for %s", bindingZone, bindingInterval)
+	}
+
+	for i, interval := range intervals {
+		portion := asset.EnergyAmount * interval.share * fraction
+		exports[i].Export += portion
+		imports[i].Import += portion
+		if err := putZoneFlow(ctx, exports[i]); err != nil {
+			return err
+		}
+		if err := putZoneFlow(ctx, imports[i]); err != nil {
+			return err
+		}
+	}
+	if fraction == 1 {
+		return trackTransformerLoads(ctx, asset, seller.Zone, buyer.Zone, intervals)
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	asset.CurtailedEnergy = asset.EnergyAmount * (1 - fraction)
+	if err := trackTransformerLoads(ctx, asset, seller.Zone, buyer.Zone, intervals); err != nil {
+		return err
+	}
+	return putCurtailment(ctx, &Curtailment{
+		TokenID:         asset.TokenID,
+		Reason:          CurtailmentCongestion,
+		Zone:            bindingZone,
+		IntervalStart:   bindingInterval,
+		CurtailedEnergy: asset.CurtailedEnergy,
+		RecordedAt:      now,
+		TxID:            ctx.GetStub().GetTxID(),
+	})
+}
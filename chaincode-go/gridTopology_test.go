@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// signZoneTrade creates a 10 kWh trade from seller2 in zone2 to buyer1 in
+// zone1 and returns the error of the signature that confirms it
+func signZoneTrade(t *testing.T, e *EnergyTradingContract, tc *testContext, tokenID string) error {
+	require.NoError(t, e.CreateEnergyAsset(tc.as("buyer1", ""), tokenID, "buyer1", "seller2", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid))
+	require.NoError(t, e.SignEnergyAsset(tc, tokenID, tc.sign(t, e, "buyer1", tokenID), 0))
+	return e.SignEnergyAsset(tc.as("seller2", ""), tokenID, tc.sign(t, e, "seller2", tokenID), 0)
+}
+
+func TestGridCapacity(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	_, err := e.RegisterParticipant(tc.as("seller2", RoleProsumer), []string{"meter-seller2"}, tc.publicKeyPEM(t, "seller2"), "zone2")
+	require.NoError(t, err)
+	require.NoError(t, e.ApproveParticipant(tc.as("admin1", RoleAdmin), "seller2"))
+
+	tc.as("operator1", RoleOperator)
+	err = e.SetGridCapacity(tc, "zone2", "2025-05-03T10:05:00Z", 3, 100)
+	require.EqualError(t, err, "interval start 2025-05-03T10:05:00Z is not aligned to 15m0s")
+	err = e.SetGridCapacity(tc, "zone2", "2025-05-03T10:00:00Z", -1, 100)
+	require.EqualError(t, err, "capacity limits must not be negative")
+	require.NoError(t, e.SetGridCapacity(tc, "zone2", "2025-05-03T10:00:00Z", 3, 100))
+	capacity, err := e.GetGridCapacity(tc, "zone2", "2025-05-03T10:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, "operator1", capacity.Operator)
+	_, err = e.GetGridCapacity(tc, "zone1", "2025-05-03T10:00:00Z")
+	require.EqualError(t, err, "zone zone1 has no capacity limits for 2025-05-03T10:00:00Z")
+
+	// 2.5 kWh per interval fits the 3 kWh export limit
+	require.NoError(t, signZoneTrade(t, e, tc, "energy1"))
+	flow, err := e.GetZoneFlow(tc, "zone2", "2025-05-03T10:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 2.5, flow.Export)
+	flow, err = e.GetZoneFlow(tc, "zone1", "2025-05-03T10:45:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 2.5, flow.Import)
+
+	// Only 0.5 kWh is left in the first interval, so the whole trade is cut to a fifth
+	require.NoError(t, signZoneTrade(t, e, tc, "energy2"))
+	asset, err := e.ReadEnergyAsset(tc, "energy2")
+	require.NoError(t, err)
+	require.Equal(t, StateConfirmed, asset.TransactionState)
+	require.InDelta(t, 8, asset.CurtailedEnergy, 1e-9)
+	require.InDelta(t, 2, scheduledEnergy(asset), 1e-9)
+	curtailments, err := e.GetCurtailments(tc, "energy2", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, curtailments.Records, 1)
+	require.Equal(t, CurtailmentCongestion, curtailments.Records[0].Reason)
+	require.Equal(t, "zone2", curtailments.Records[0].Zone)
+	require.Equal(t, "2025-05-03T10:00:00Z", curtailments.Records[0].IntervalStart)
+	flow, err = e.GetZoneFlow(tc, "zone2", "2025-05-03T10:00:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 3, flow.Export, 1e-9)
+
+	err = signZoneTrade(t, e, tc, "energy3")
+	require.EqualError(t, err, "grid capacity of zone zone2 is exhausted for 2025-05-03T10:00:00Z")
+	asset, err = e.ReadEnergyAsset(tc, "energy3")
+	require.NoError(t, err)
+	require.Equal(t, StateCreated, asset.TransactionState)
+
+	// Trades within a zone do not cross its boundary
+	confirmTestAsset(t, e, tc, "energy4")
+	flow, err = e.GetZoneFlow(tc, "zone1", "2025-05-03T10:00:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 3, flow.Import, 1e-9)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// idempotencyTransientKey is the optional transient map entry carrying the
+// client's idempotency key for a submission
+const idempotencyTransientKey = "idempotency_key"
+
+// maxIdempotencyKeyLength bounds the keys clients may choose
+const maxIdempotencyKeyLength = 128
+
+// IdempotencyRecord records the transaction that claimed a client's
+// idempotency key. A gateway that timed out waiting for a commit can resubmit
+// with the same key: if the first submission committed, the retry fails and
+// names the transaction that already carried out the request, instead of
+// creating a second trade or moving tokens twice.
+type IdempotencyRecord struct {
+	Caller    string `json:"caller"`
+	Key       string `json:"key"`
+	Function  string `json:"function"`
+	TxID      string `json:"txID"`
+	ClaimedAt string `json:"claimedAt"`
+}
+
+func idempotencyKey(ctx contractapi.TransactionContextInterface, caller, key string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("idempotency", []string{caller, key})
+}
+
+// claimIdempotencyKey records the transaction's idempotency key, if the
+// client supplied one, and fails if the caller already used it. Keys are
+// scoped to the caller, so clients need not coordinate them. Two concurrent
+// submissions with the same key both write the record, so only one of them
+// passes MVCC validation.
+func claimIdempotencyKey(ctx contractapi.TransactionContextInterface) error {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return err
+	}
+	key, ok := transientMap[idempotencyTransientKey]
+	if !ok {
+		return nil
+	}
+	if len(key) == 0 || len(key) > maxIdempotencyKeyLength {
+		return fmt.Errorf("%s must hold 1 to %d bytes", idempotencyTransientKey, maxIdempotencyKeyLength)
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	stateKey, err := idempotencyKey(ctx, caller, string(key))
+	if err != nil {
+		return err
+	}
+	existingJSON, err := ctx.GetStub().GetState(stateKey)
+	if err != nil {
+		return fmt.Errorf("failed to read idempotency key: %v", err)
+	}
+	if existingJSON != nil {
+		var existing IdempotencyRecord
+		if err := json.Unmarshal(existingJSON, &existing); err != nil {
+			return err
+		}
+		txLog(ctx).Infof("rejected retry of request %s first processed in transaction %s", existing.Key, existing.TxID)
+		return fmt.Errorf("request %s was already processed by %s in transaction %s", existing.Key, existing.Function, existing.TxID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	record := IdempotencyRecord{
+		Caller:    caller,
+		Key:       string(key),
+		Function:  transactionFunction(ctx.GetStub()),
+		TxID:      ctx.GetStub().GetTxID(),
+		ClaimedAt: now,
+	}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(stateKey, recordJSON)
+}
+
+// beforeTransaction runs before every transaction: it enforces functionRoles
+// and then claims the request's idempotency key
+func beforeTransaction(ctx contractapi.TransactionContextInterface) error {
+	if err := authorizeTransaction(ctx); err != nil {
+		return err
+	}
+	return claimIdempotencyKey(ctx)
+}
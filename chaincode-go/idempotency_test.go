@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	tc.stub.GetTxIDReturns("tx1")
+
+	// Without a key nothing is recorded and retries run again
+	require.NoError(t, tc.as("buyer1", "").authorize("TransferTokens"))
+	require.NoError(t, beforeTransaction(tc))
+
+	tc.stub.GetTransientReturns(map[string][]byte{idempotencyTransientKey: []byte("transfer-1")}, nil)
+	require.NoError(t, beforeTransaction(tc))
+	require.NoError(t, e.TransferTokens(tc, "seller1", 1, 0))
+	tc.stub.GetTxIDReturns("tx2")
+	err := beforeTransaction(tc)
+	require.EqualError(t, err, "request transfer-1 was already processed by TransferTokens in transaction tx1")
+
+	// Keys are scoped to the caller
+	require.NoError(t, beforeTransaction(tc.as("seller1", "")))
+
+	tc.stub.GetTransientReturns(map[string][]byte{idempotencyTransientKey: []byte(strings.Repeat("k", 129))}, nil)
+	err = beforeTransaction(tc)
+	require.EqualError(t, err, "idempotency_key must hold 1 to 128 bytes")
+
+	// Unauthorized calls do not burn the key
+	tc.stub.GetTransientReturns(map[string][]byte{idempotencyTransientKey: []byte("mint-1")}, nil)
+	require.Error(t, tc.as("buyer1", RoleConsumer).authorize("MintTokens"))
+	require.Error(t, beforeTransaction(tc))
+	require.NoError(t, tc.as("buyer1", "").authorize("TransferTokens"))
+	require.NoError(t, beforeTransaction(tc))
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// GridOperatorAccount is the token account the grid operator settles
+// imbalances from. It acts as the clearing counterparty and may run a
+// negative balance down to its credit line.
+const GridOperatorAccount = "grid-operator"
+
+// ImbalanceRecord is one participant's deviation from a trade's contracted
+// profile in one meter interval and its settlement against the grid. A
+// positive Imbalance is surplus the grid buys; a negative one is shortfall the
+// participant buys from the grid. Amount is positive when the grid pays.
+type ImbalanceRecord struct {
+	TokenID          string  `json:"tokenID"`
+	Participant      string  `json:"participant"`
+	IntervalStart    string  `json:"intervalStart"`
+	ContractedEnergy float64 `json:"contractedEnergy"`
+	ActualEnergy     float64 `json:"actualEnergy"`
+	Imbalance        float64 `json:"imbalance"`
+	ReferencePrice   float64 `json:"referencePrice"`
+	Amount           float64 `json:"amount"`
+}
+
+func imbalanceKey(ctx contractapi.TransactionContextInterface, participant, intervalStart, tokenID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("imbalance", []string{participant, intervalStart, tokenID})
+}
+
+// settleGridImbalance records the participant's per-interval imbalances for a
+// trade, spreading the contracted energy evenly over the delivery window, and
+// settles their total against the grid operator at the reference price of each
+// interval. It returns the total amount, positive when the grid paid.
+func settleGridImbalance(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, address string, seller bool) (float64, error) {
+	start, err := parseTimestamp(asset.DeliveryStart)
+	if err != nil {
+		return 0, err
+	}
+	end, err := parseTimestamp(asset.DeliveryEnd)
+	if err != nil {
+		return 0, err
+	}
+	window := end.Sub(start)
+	length, err := slotLength(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var total float64
+	for interval := start.Truncate(length); interval.Before(end); interval = interval.Add(length) {
+		intervalEnd := interval.Add(length)
+		overlap := minTime(intervalEnd, end).Sub(maxTime(interval, start))
+		contracted := scheduledEnergy(asset) * float64(overlap) / float64(window)
+		if !seller {
+			// The buyer's profile is what reaches its meter after losses
+			contracted *= 1 - asset.LossFactor
+		}
+		intervalStart := interval.Format(time.RFC3339)
+		injected, consumed, _, err := meteredEnergy(ctx, address, intervalStart, intervalEnd.Format(time.RFC3339))
+		if err != nil {
+			return 0, err
+		}
+		referencePrice, err := referencePriceAt(ctx, interval)
+		if err != nil {
+			return 0, err
+		}
+		if referencePrice == nil {
+			return 0, fmt.Errorf("no reference price is in effect at %s", intervalStart)
+		}
+
+		record := ImbalanceRecord{
+			TokenID:          asset.TokenID,
+			Participant:      address,
+			IntervalStart:    intervalStart,
+			ContractedEnergy: contracted,
+			ReferencePrice:   referencePrice.Price,
+		}
+		if seller {
+			record.ActualEnergy = injected
+			record.Imbalance = injected - contracted
+		} else {
+			record.ActualEnergy = consumed
+			record.Imbalance = contracted - consumed
+		}
+		record.Amount = record.Imbalance * referencePrice.Price
+		total += record.Amount
+
+		recordJSON, err := json.Marshal(record)
+		if err != nil {
+			return 0, err
+		}
+		key, err := imbalanceKey(ctx, address, intervalStart, asset.TokenID)
+		if err != nil {
+			return 0, err
+		}
+		if err := ctx.GetStub().PutState(key, recordJSON); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := settleWithGrid(ctx, address, total); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// GridCreditLine is how far, in tokens, the grid operator's balance may run
+// below zero. Payments beyond its balance create tokens, so the credit line
+// caps what the grid can issue. This is the default; governance proposals can
+// change it.
+const GridCreditLine = 100000.0
+
+// GridIssuance is the part of a transaction's payments from the grid operator
+// that its balance did not cover, and so created tokens
+type GridIssuance struct {
+	TxID        string  `json:"txID"`
+	Amount      float64 `json:"amount"`
+	GridBalance float64 `json:"gridBalance"`
+	IssuedAt    string  `json:"issuedAt"`
+}
+
+func gridIssuanceKey(ctx contractapi.TransactionContextInterface, issuedAt, txID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("gridissuance", []string{issuedAt, txID})
+}
+
+// recordGridIssuance adds amount to the current transaction's grid issuance
+func recordGridIssuance(ctx contractapi.TransactionContextInterface, amount, gridBalance float64) error {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	txID := ctx.GetStub().GetTxID()
+	key, err := gridIssuanceKey(ctx, now, txID)
+	if err != nil {
+		return err
+	}
+	issuance := GridIssuance{TxID: txID, IssuedAt: now}
+	issuanceJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return err
+	}
+	if issuanceJSON != nil {
+		if err := json.Unmarshal(issuanceJSON, &issuance); err != nil {
+			return err
+		}
+	}
+	issuance.Amount += amount
+	issuance.GridBalance = gridBalance
+	issuanceJSON, err = json.Marshal(issuance)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, issuanceJSON)
+}
+
+// settleWithGrid pays amount from the grid operator to the participant, or
+// charges the participant when amount is negative. A payment may take the
+// grid below zero, but not below its credit line, and the part its balance
+// does not cover is recorded as issuance. Checking the credit line reads the
+// grid's deltas, so payments from the grid conflict with each other;
+// charges only write a delta.
+func settleWithGrid(ctx contractapi.TransactionContextInterface, address string, amount float64) error {
+	if amount == 0 {
+		return nil
+	}
+	gridExists, err := tokenAccountExists(ctx, GridOperatorAccount)
+	if err != nil {
+		return err
+	}
+	if !gridExists {
+		if err := putTokenAccount(ctx, &TokenAccount{AccountID: GridOperatorAccount}); err != nil {
+			return err
+		}
+	}
+	account, err := getTokenAccount(ctx, address)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return fmt.Errorf("account %s does not exist", address)
+	}
+	if account.Balance+amount < 0 {
+		return fmt.Errorf("account %s has insufficient balance", address)
+	}
+	if amount > 0 {
+		now, err := txTime(ctx)
+		if err != nil {
+			return err
+		}
+		config, err := platformConfigAt(ctx, now)
+		if err != nil {
+			return err
+		}
+		grid, err := getTokenAccount(ctx, GridOperatorAccount)
+		if err != nil {
+			return err
+		}
+		balance := grid.Balance - amount
+		if balance < -config.GridCreditLine-1e-9 {
+			return fmt.Errorf("paying %v would take the grid operator's balance %v below its credit line of %v", amount, grid.Balance, config.GridCreditLine)
+		}
+		if issued := amount - math.Max(grid.Balance, 0); issued > 0 {
+			if err := recordGridIssuance(ctx, issued, balance); err != nil {
+				return err
+			}
+		}
+	}
+	if err := adjustBalance(ctx, address, amount); err != nil {
+		return err
+	}
+	return adjustBalance(ctx, GridOperatorAccount, -amount)
+}
+
+// PaginatedGridIssuanceResult is a page of grid issuance records
+type PaginatedGridIssuanceResult struct {
+	Records             []*GridIssuance `json:"records"`
+	FetchedRecordsCount int32           `json:"fetchedRecordsCount"`
+	Bookmark            string          `json:"bookmark"`
+}
+
+// GetGridIssuance returns a page of the tokens the grid operator has issued
+// by paying beyond its balance, oldest first
+func (e *EnergyTradingContract) GetGridIssuance(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedGridIssuanceResult, error) {
+	result := &PaginatedGridIssuanceResult{Records: []*GridIssuance{}}
+	metadata, err := queryPage(ctx, "gridissuance", []string{}, pageSize, bookmark, func(value []byte) error {
+		var issuance GridIssuance
+		if err := json.Unmarshal(value, &issuance); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &issuance)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// PaginatedImbalanceResult is a page of imbalance records
+type PaginatedImbalanceResult struct {
+	Records             []*ImbalanceRecord `json:"records"`
+	FetchedRecordsCount int32              `json:"fetchedRecordsCount"`
+	Bookmark            string             `json:"bookmark"`
+}
+
+// GetImbalanceRecords returns a page of a participant's imbalance records for
+// intervals starting in the half-open window [from, to). Records outside the
+// window are skipped, so a page may hold fewer than pageSize records.
+func (e *EnergyTradingContract) GetImbalanceRecords(ctx contractapi.TransactionContextInterface, participant, from, to string, pageSize int32, bookmark string) (*PaginatedImbalanceResult, error) {
+	from, err := normalizeTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	to, err = normalizeTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedImbalanceResult{Records: []*ImbalanceRecord{}}
+	metadata, err := queryPage(ctx, "imbalance", []string{participant}, pageSize, bookmark, func(value []byte) error {
+		var record ImbalanceRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		if record.IntervalStart >= from && record.IntervalStart < to {
+			result.Records = append(result.Records, &record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// getImbalanceRecords returns all of a participant's imbalance records for
+// intervals starting in the half-open window [from, to)
+func getImbalanceRecords(ctx contractapi.TransactionContextInterface, participant, from, to string) ([]*ImbalanceRecord, error) {
+	from, err := normalizeTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	to, err = normalizeTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("imbalance", []string{participant})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	records := []*ImbalanceRecord{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var record ImbalanceRecord
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			return nil, err
+		}
+		if record.IntervalStart < from || record.IntervalStart >= to {
+			continue
+		}
+		records = append(records, &record)
+	}
+	return records, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// InsuranceFundAccount is the token account of the mutual insurance fund
+// against counterparty default
+const InsuranceFundAccount = "insurance-fund"
+
+// Default insurance terms, in force until an admin sets others. Buyers pay
+// DefaultInsurancePremiumRate of each trade's gross payment into the fund at
+// settlement, and a claim pays out at most DefaultInsuranceClaimCap tokens.
+const (
+	DefaultInsurancePremiumRate = 0.01
+	DefaultInsuranceClaimCap    = 50.0
+)
+
+// insuranceTermsKey is the state key of the insurance terms
+const insuranceTermsKey = "insuranceterms"
+
+// Insurance claim statuses
+const (
+	ClaimPending  = "PENDING"
+	ClaimPaid     = "PAID"
+	ClaimRejected = "REJECTED"
+)
+
+// InsuranceTerms holds the premium rate and per-claim cap of the insurance
+// fund
+type InsuranceTerms struct {
+	PremiumRate float64 `json:"premiumRate"`
+	ClaimCap    float64 `json:"claimCap"`
+	UpdatedBy   string  `json:"updatedBy,omitempty"`
+	UpdatedAt   string  `json:"updatedAt,omitempty"`
+}
+
+// InsuranceClaim is a buyer's claim on the insurance fund for the damages of
+// a trade its seller's deposit did not cover. Amount is the uncovered damages
+// capped at the claim cap in force when the claim was filed.
+type InsuranceClaim struct {
+	TokenID   string  `json:"tokenID"`
+	Claimant  string  `json:"claimant"`
+	Uncovered float64 `json:"uncovered"`
+	Amount    float64 `json:"amount"`
+	Status    string  `json:"status"`
+	Reason    string  `json:"reason,omitempty"`
+	FiledAt   string  `json:"filedAt"`
+	DecidedBy string  `json:"decidedBy,omitempty"`
+	DecidedAt string  `json:"decidedAt,omitempty"`
+}
+
+func insuranceClaimKey(ctx contractapi.TransactionContextInterface, tokenID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("insuranceclaim", []string{tokenID})
+}
+
+// openInsuranceFund opens the insurance fund account if it does not exist
+func openInsuranceFund(ctx contractapi.TransactionContextInterface) error {
+	exists, err := tokenAccountExists(ctx, InsuranceFundAccount)
+	if err != nil || exists {
+		return err
+	}
+	return putTokenAccount(ctx, &TokenAccount{AccountID: InsuranceFundAccount})
+}
+
+// SetInsuranceTerms sets the premium rate and per-claim cap of the insurance
+// fund and opens its account, so that it can also take donations. Changes
+// apply to trades settled and claims filed afterwards.
+func (e *EnergyTradingContract) SetInsuranceTerms(ctx contractapi.TransactionContextInterface, premiumRate, claimCap float64) (*InsuranceTerms, error) {
+	if premiumRate < 0 || premiumRate >= 1 {
+		return nil, fmt.Errorf("premium rate must be in [0, 1)")
+	}
+	if claimCap <= 0 {
+		return nil, fmt.Errorf("claim cap must be positive")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	terms := &InsuranceTerms{PremiumRate: premiumRate, ClaimCap: claimCap, UpdatedBy: caller, UpdatedAt: now}
+	termsJSON, err := json.Marshal(terms)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(insuranceTermsKey, termsJSON); err != nil {
+		return nil, err
+	}
+	if err := openInsuranceFund(ctx); err != nil {
+		return nil, err
+	}
+	return terms, nil
+}
+
+// GetInsuranceTerms returns the insurance terms in force
+func (e *EnergyTradingContract) GetInsuranceTerms(ctx contractapi.TransactionContextInterface) (*InsuranceTerms, error) {
+	termsJSON, err := ctx.GetStub().GetState(insuranceTermsKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read insurance terms: %v", err)
+	}
+	if termsJSON == nil {
+		return &InsuranceTerms{PremiumRate: DefaultInsurancePremiumRate, ClaimCap: DefaultInsuranceClaimCap}, nil
+	}
+	var terms InsuranceTerms
+	if err := json.Unmarshal(termsJSON, &terms); err != nil {
+		return nil, err
+	}
+	return &terms, nil
+}
+
+// collectInsurancePremium charges the buyer of a trade the insurance premium
+// on its gross payment
+func collectInsurancePremium(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, payment float64) (float64, error) {
+	terms, err := (&EnergyTradingContract{}).GetInsuranceTerms(ctx)
+	if err != nil {
+		return 0, err
+	}
+	premium := payment * terms.PremiumRate
+	if premium <= 0 {
+		return 0, nil
+	}
+	if err := openInsuranceFund(ctx); err != nil {
+		return 0, err
+	}
+	if err := transferTokens(ctx, asset.BuyerAddress, InsuranceFundAccount, premium); err != nil {
+		return 0, err
+	}
+	return premium, nil
+}
+
+func putInsuranceClaim(ctx contractapi.TransactionContextInterface, claim *InsuranceClaim) error {
+	claimJSON, err := json.Marshal(claim)
+	if err != nil {
+		return err
+	}
+	key, err := insuranceClaimKey(ctx, claim.TokenID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, claimJSON)
+}
+
+// GetInsuranceClaim returns the insurance claim filed for a trade
+func (e *EnergyTradingContract) GetInsuranceClaim(ctx contractapi.TransactionContextInterface, tokenID string) (*InsuranceClaim, error) {
+	key, err := insuranceClaimKey(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	claimJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read insurance claim of %s: %v", tokenID, err)
+	}
+	if claimJSON == nil {
+		return nil, fmt.Errorf("no insurance claim was filed for asset %s", tokenID)
+	}
+	var claim InsuranceClaim
+	if err := json.Unmarshal(claimJSON, &claim); err != nil {
+		return nil, err
+	}
+	return &claim, nil
+}
+
+// ClaimFromInsuranceFund files the buyer's claim for the damages of a settled
+// trade that the seller's deposit did not cover. Each trade can be claimed
+// once; an arbiter approves or rejects the claim.
+func (e *EnergyTradingContract) ClaimFromInsuranceFund(ctx contractapi.TransactionContextInterface, tokenID string) (*InsuranceClaim, error) {
+	asset, err := e.ReadEnergyAsset(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, asset.BuyerAddress); err != nil {
+		return nil, err
+	}
+	settlement, err := e.GetSettlement(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if settlement.UncoveredDamages <= 0 {
+		return nil, fmt.Errorf("asset %s has no damages uncovered by the seller's deposit", tokenID)
+	}
+	key, err := insuranceClaimKey(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read insurance claim of %s: %v", tokenID, err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("an insurance claim was already filed for asset %s", tokenID)
+	}
+	terms, err := e.GetInsuranceTerms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claim := &InsuranceClaim{
+		TokenID:   tokenID,
+		Claimant:  asset.BuyerAddress,
+		Uncovered: settlement.UncoveredDamages,
+		Amount:    math.Min(settlement.UncoveredDamages, terms.ClaimCap),
+		Status:    ClaimPending,
+		FiledAt:   now,
+	}
+	if err := putInsuranceClaim(ctx, claim); err != nil {
+		return nil, err
+	}
+	return claim, emitEvent(ctx, EventInsuranceClaimChanged, claim)
+}
+
+// decideInsuranceClaim loads a pending claim and records the deciding arbiter
+func decideInsuranceClaim(ctx contractapi.TransactionContextInterface, tokenID, status string) (*InsuranceClaim, error) {
+	claim, err := (&EnergyTradingContract{}).GetInsuranceClaim(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if claim.Status != ClaimPending {
+		return nil, fmt.Errorf("insurance claim of asset %s is %s", tokenID, claim.Status)
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claim.Status = status
+	claim.DecidedBy = caller
+	claim.DecidedAt = now
+	return claim, nil
+}
+
+// ApproveInsuranceClaim pays a pending claim from the insurance fund
+func (e *EnergyTradingContract) ApproveInsuranceClaim(ctx contractapi.TransactionContextInterface, tokenID string) (*InsuranceClaim, error) {
+	claim, err := decideInsuranceClaim(ctx, tokenID, ClaimPaid)
+	if err != nil {
+		return nil, err
+	}
+	if err := transferTokens(ctx, InsuranceFundAccount, claim.Claimant, claim.Amount); err != nil {
+		return nil, fmt.Errorf("failed to pay insurance claim of asset %s: %v", tokenID, err)
+	}
+	if err := putInsuranceClaim(ctx, claim); err != nil {
+		return nil, err
+	}
+	return claim, emitEvent(ctx, EventInsuranceClaimChanged, claim)
+}
+
+// RejectInsuranceClaim rejects a pending claim
+func (e *EnergyTradingContract) RejectInsuranceClaim(ctx contractapi.TransactionContextInterface, tokenID, reason string) (*InsuranceClaim, error) {
+	if reason == "" {
+		return nil, fmt.Errorf("a reason must be given")
+	}
+	claim, err := decideInsuranceClaim(ctx, tokenID, ClaimRejected)
+	if err != nil {
+		return nil, err
+	}
+	claim.Reason = reason
+	if err := putInsuranceClaim(ctx, claim); err != nil {
+		return nil, err
+	}
+	return claim, emitEvent(ctx, EventInsuranceClaimChanged, claim)
+}
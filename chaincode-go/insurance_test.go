@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestInsuranceClaim(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "seller1", 5))
+	require.NoError(t, e.MintTokens(tc, "buyer1", 5))
+	_, err := e.SetInsuranceTerms(tc, 0.01, 0)
+	require.EqualError(t, err, "claim cap must be positive")
+	_, err = e.SetInsuranceTerms(tc, 0.01, 1.5)
+	require.NoError(t, err)
+
+	// The seller delivers nothing: damages of 3 exceed its deposit of 1
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 0, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	settlement, err := e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+	require.InDelta(t, 1.0, settlement.ImbalancePenalty, 1e-9)
+	require.InDelta(t, 2.0, settlement.UncoveredDamages, 1e-9)
+
+	_, err = e.ClaimFromInsuranceFund(tc, "energy1")
+	require.EqualError(t, err, "caller seller1 is not authorized to act for buyer1")
+	claim, err := e.ClaimFromInsuranceFund(tc.as("buyer1", ""), "energy1")
+	require.NoError(t, err)
+	require.Equal(t, ClaimPending, claim.Status)
+	require.Equal(t, 1.5, claim.Amount)
+	_, err = e.ClaimFromInsuranceFund(tc, "energy1")
+	require.EqualError(t, err, "an insurance claim was already filed for asset energy1")
+
+	_, err = e.ApproveInsuranceClaim(tc.as("arbiter1", RoleArbiter), "energy1")
+	require.EqualError(t, err, "failed to pay insurance claim of asset energy1: account insurance-fund has insufficient balance")
+	require.NoError(t, e.TransferTokens(tc.as("buyer1", ""), InsuranceFundAccount, 2, 0))
+	claim, err = e.ApproveInsuranceClaim(tc.as("arbiter1", RoleArbiter), "energy1")
+	require.NoError(t, err)
+	require.Equal(t, ClaimPaid, claim.Status)
+	require.Equal(t, "arbiter1", claim.DecidedBy)
+	fund, err := e.ReadTokenAccount(tc, InsuranceFundAccount)
+	require.NoError(t, err)
+	require.InDelta(t, 0.5, fund.Balance, 1e-9)
+	_, err = e.RejectInsuranceClaim(tc, "energy1", "late")
+	require.EqualError(t, err, "insurance claim of asset energy1 is PAID")
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventInsuranceClaimChanged, name)
+}
+
+func TestInsuranceClaimRequiresUncoveredDamages(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	_, err := e.ClaimFromInsuranceFund(tc.as("buyer1", ""), "energy1")
+	require.EqualError(t, err, "asset energy1 has not been settled")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2.5, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 2.5)
+	settlement, err := e.ReconcileDelivery(tc, "energy1")
+	require.NoError(t, err)
+	require.InDelta(t, 0.02, settlement.InsurancePremium, 1e-9)
+	_, err = e.ClaimFromInsuranceFund(tc, "energy1")
+	require.EqualError(t, err, "asset energy1 has no damages uncovered by the seller's deposit")
+	balance, err := e.BalanceOf(tc, InsuranceFundAccount, EnergyTokenID)
+	require.NoError(t, err)
+	require.InDelta(t, 0.02, balance, 1e-9)
+}
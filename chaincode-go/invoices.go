@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// billingPeriodLayout is the layout of a billing period: a calendar month in UTC
+const billingPeriodLayout = "2006-01"
+
+// Invoice line item types
+const (
+	LineEnergySale       = "ENERGY_SALE"
+	LineEnergyPurchase   = "ENERGY_PURCHASE"
+	LineLevy             = "LEVY"
+	LineNetworkFee       = "NETWORK_FEE"
+	LineLossCompensation = "LOSS_COMPENSATION"
+	LineImbalancePenalty = "IMBALANCE_PENALTY"
+	LineImbalance        = "IMBALANCE"
+	LineSubsidy          = "SUBSIDY"
+	LineUtilityExport    = "UTILITY_EXPORT"
+	LineUtilityImport    = "UTILITY_IMPORT"
+)
+
+// InvoiceLine is one charge or credit on an invoice. Amount is positive when
+// the participant was credited and negative when it was charged.
+type InvoiceLine struct {
+	Type        string  `json:"type"`
+	Reference   string  `json:"reference"`
+	Description string  `json:"description"`
+	Quantity    float64 `json:"quantity"`
+	Amount      float64 `json:"amount"`
+}
+
+// Invoice is the immutable statement of a participant's settled activity in
+// a billing period
+type Invoice struct {
+	InvoiceNumber string         `json:"invoiceNumber"`
+	Participant   string         `json:"participant"`
+	Period        string         `json:"period"`
+	PeriodStart   string         `json:"periodStart"`
+	PeriodEnd     string         `json:"periodEnd"`
+	Lines         []*InvoiceLine `json:"lines"`
+	TotalCredits  float64        `json:"totalCredits"`
+	TotalCharges  float64        `json:"totalCharges"`
+	NetAmount     float64        `json:"netAmount"`
+	ClosedBy      string         `json:"closedBy"`
+	ClosedAt      string         `json:"closedAt"`
+}
+
+func invoiceKey(ctx contractapi.TransactionContextInterface, participant, period string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("invoice", []string{participant, period})
+}
+
+// billingPeriod returns the bounds of a billing period
+func billingPeriod(period string) (time.Time, time.Time, error) {
+	start, err := time.Parse(billingPeriodLayout, period)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("billing period %q must be a month formatted as YYYY-MM", period)
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// requireInvoiceAccess fails unless the caller is the participant or an
+// operator, admin or regulator
+func requireInvoiceAccess(ctx contractapi.TransactionContextInterface, participant string) error {
+	role, err := callerRole(ctx)
+	if err != nil {
+		return err
+	}
+	if role == RoleOperator || role == RoleAdmin || role == RoleRegulator {
+		return nil
+	}
+	return requireCaller(ctx, participant)
+}
+
+// CloseBillingPeriod issues a participant's invoice for a billing period that
+// has ended. It aggregates the trades delivering in the period that have
+// settled, with their levies, fees, loss compensation and penalties, and the
+// participant's imbalance charges. A period can be closed only once.
+func (e *EnergyTradingContract) CloseBillingPeriod(ctx contractapi.TransactionContextInterface, participant, period string) (*Invoice, error) {
+	if err := requireInvoiceAccess(ctx, participant); err != nil {
+		return nil, err
+	}
+	start, end, err := billingPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(end) {
+		return nil, fmt.Errorf("billing period %s has not ended", period)
+	}
+	registered, err := getParticipant(ctx, participant)
+	if err != nil {
+		return nil, err
+	}
+	if registered == nil {
+		return nil, fmt.Errorf("participant %s is not registered", participant)
+	}
+	key, err := invoiceKey(ctx, participant, period)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read invoice: %v", err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("billing period %s of %s is already closed", period, participant)
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	invoice := &Invoice{
+		InvoiceNumber: fmt.Sprintf("INV-%s-%s", strings.ReplaceAll(period, "-", ""), participant),
+		Participant:   participant,
+		Period:        period,
+		PeriodStart:   start.Format(time.RFC3339),
+		PeriodEnd:     end.Format(time.RFC3339),
+		Lines:         []*InvoiceLine{},
+		ClosedBy:      caller,
+		ClosedAt:      now.Format(time.RFC3339),
+	}
+	if err := e.addTradeLines(ctx, invoice); err != nil {
+		return nil, err
+	}
+	imbalances, err := getImbalanceRecords(ctx, participant, invoice.PeriodStart, invoice.PeriodEnd)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range imbalances {
+		invoice.addLine(LineImbalance, record.TokenID, "Imbalance at "+record.IntervalStart, record.Imbalance, record.Amount)
+	}
+	fallbacks, err := getFallbackSettlements(ctx, participant, invoice.PeriodStart, invoice.PeriodEnd)
+	if err != nil {
+		return nil, err
+	}
+	for _, settlement := range fallbacks {
+		invoice.addLine(LineUtilityExport, settlement.IntervalStart, "Unmatched export at tariff rate", settlement.Injected, settlement.Injected*settlement.ExportRate)
+		invoice.addLine(LineUtilityImport, settlement.IntervalStart, "Unmatched import at tariff rate", settlement.Consumed, -settlement.Consumed*settlement.ImportRate)
+	}
+
+	invoiceJSON, err := json.Marshal(invoice)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, invoiceJSON); err != nil {
+		return nil, err
+	}
+	return invoice, emitEvent(ctx, EventInvoiceIssued, invoice)
+}
+
+// addLine appends a line item and updates the invoice totals
+func (invoice *Invoice) addLine(lineType, reference, description string, quantity, amount float64) {
+	if amount == 0 {
+		return
+	}
+	invoice.Lines = append(invoice.Lines, &InvoiceLine{
+		Type:        lineType,
+		Reference:   reference,
+		Description: description,
+		Quantity:    quantity,
+		Amount:      amount,
+	})
+	if amount > 0 {
+		invoice.TotalCredits += amount
+	} else {
+		invoice.TotalCharges -= amount
+	}
+	invoice.NetAmount += amount
+}
+
+// addTradeLines adds the line items of the participant's settled trades
+// delivering in the invoice's period
+func (e *EnergyTradingContract) addTradeLines(ctx contractapi.TransactionContextInterface, invoice *Invoice) error {
+	assets := []*EnergyAsset{}
+	for _, prefix := range []string{deliveryIndexPrefix, archiveIndexPrefix} {
+		resultsIterator, err := ctx.GetStub().GetStateByRange(prefix+invoice.PeriodStart, prefix+invoice.PeriodEnd)
+		if err != nil {
+			return err
+		}
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return err
+			}
+			asset, err := e.ReadEnergyAsset(ctx, string(queryResponse.Value))
+			if err != nil {
+				resultsIterator.Close()
+				return err
+			}
+			if asset.TransactionState == StateSettled && (asset.BuyerAddress == invoice.Participant || asset.SellerAddress == invoice.Participant) {
+				assets = append(assets, asset)
+			}
+		}
+		resultsIterator.Close()
+	}
+	sort.SliceStable(assets, func(i, j int) bool {
+		if assets[i].DeliveryStart != assets[j].DeliveryStart {
+			return assets[i].DeliveryStart < assets[j].DeliveryStart
+		}
+		return assets[i].TokenID < assets[j].TokenID
+	})
+
+	for _, asset := range assets {
+		settlement, err := e.GetSettlement(ctx, asset.TokenID)
+		if err != nil {
+			return err
+		}
+		window := asset.DeliveryStart + " to " + asset.DeliveryEnd
+		if asset.SellerAddress == invoice.Participant {
+			invoice.addLine(LineEnergySale, asset.TokenID, "Energy sold to "+asset.BuyerAddress+", "+window, settlement.DeliveredAtMeter, settlement.Payment)
+			for _, charge := range settlement.Levies {
+				invoice.addLine(LineLevy, asset.TokenID, charge.Name, charge.Base, -charge.Amount)
+			}
+			for _, payment := range settlement.Subsidies {
+				invoice.addLine(LineSubsidy, asset.TokenID, "Subsidy program "+payment.ProgramID, payment.Energy, payment.Amount)
+			}
+			invoice.addLine(LineLossCompensation, asset.TokenID, "Network loss compensation", settlement.LossEnergy, settlement.LossCompensation)
+			invoice.addLine(LineImbalancePenalty, asset.TokenID, "Delivery shortfall penalty", settlement.Shortfall, -settlement.ImbalancePenalty)
+		} else {
+			invoice.addLine(LineEnergyPurchase, asset.TokenID, "Energy bought from "+asset.SellerAddress+", "+window, settlement.DeliveredAtMeter, -settlement.Payment)
+			invoice.addLine(LineNetworkFee, asset.TokenID, "Network fee", settlement.DeliveredAtMeter, -settlement.NetworkFee)
+			invoice.addLine(LineImbalancePenalty, asset.TokenID, "Delivery shortfall compensation", settlement.Shortfall, settlement.ImbalancePenalty)
+		}
+	}
+	return nil
+}
+
+// GetInvoice returns a participant's invoice for a billing period
+func (e *EnergyTradingContract) GetInvoice(ctx contractapi.TransactionContextInterface, participant, period string) (*Invoice, error) {
+	if err := requireInvoiceAccess(ctx, participant); err != nil {
+		return nil, err
+	}
+	key, err := invoiceKey(ctx, participant, period)
+	if err != nil {
+		return nil, err
+	}
+	invoiceJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read invoice: %v", err)
+	}
+	if invoiceJSON == nil {
+		return nil, fmt.Errorf("billing period %s of %s is not closed", period, participant)
+	}
+	var invoice Invoice
+	if err := json.Unmarshal(invoiceJSON, &invoice); err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// PaginatedInvoiceResult is a page of invoices
+type PaginatedInvoiceResult struct {
+	Records             []*Invoice `json:"records"`
+	FetchedRecordsCount int32      `json:"fetchedRecordsCount"`
+	Bookmark            string     `json:"bookmark"`
+}
+
+// GetInvoices returns a page of a participant's invoices, oldest period first
+func (e *EnergyTradingContract) GetInvoices(ctx contractapi.TransactionContextInterface, participant string, pageSize int32, bookmark string) (*PaginatedInvoiceResult, error) {
+	if err := requireInvoiceAccess(ctx, participant); err != nil {
+		return nil, err
+	}
+	result := &PaginatedInvoiceResult{Records: []*Invoice{}}
+	metadata, err := queryPage(ctx, "invoice", []string{participant}, pageSize, bookmark, func(value []byte) error {
+		var invoice Invoice
+		if err := json.Unmarshal(value, &invoice); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &invoice)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCloseBillingPeriod(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	_, err := e.SetLevy(tc, "vat", "VAT", LevyPercent, 0.2, "tax-authority")
+	require.NoError(t, err)
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	_, err = e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+
+	_, err = e.CloseBillingPeriod(tc, "seller1", "2025-05")
+	require.EqualError(t, err, "billing period 2025-05 has not ended")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)), nil)
+	_, err = e.CloseBillingPeriod(tc, "seller1", "May 2025")
+	require.EqualError(t, err, `billing period "May 2025" must be a month formatted as YYYY-MM`)
+	_, err = e.CloseBillingPeriod(tc.as("buyer1", ""), "seller1", "2025-05")
+	require.EqualError(t, err, "caller buyer1 is not authorized to act for seller1")
+
+	invoice, err := e.CloseBillingPeriod(tc.as("seller1", ""), "seller1", "2025-05")
+	require.NoError(t, err)
+	require.Equal(t, "INV-202505-seller1", invoice.InvoiceNumber)
+	require.Equal(t, LineEnergySale, invoice.Lines[0].Type)
+	require.InDelta(t, 1.6, invoice.Lines[0].Amount, 1e-9)
+	require.Equal(t, LineLevy, invoice.Lines[1].Type)
+	require.InDelta(t, -0.32, invoice.Lines[1].Amount, 1e-9)
+	require.Equal(t, LineImbalancePenalty, invoice.Lines[2].Type)
+	require.Len(t, invoice.Lines, 7)
+	require.InDelta(t, 1.6, invoice.TotalCredits, 1e-9)
+	require.InDelta(t, 0.32+0.6+0.4, invoice.TotalCharges, 1e-9)
+	require.InDelta(t, 1.6-0.32-0.6-0.4, invoice.NetAmount, 1e-9)
+	_, err = e.CloseBillingPeriod(tc, "seller1", "2025-05")
+	require.EqualError(t, err, "billing period 2025-05 of seller1 is already closed")
+
+	// An operator can close on behalf of a participant
+	invoice, err = e.CloseBillingPeriod(tc.as("operator1", RoleOperator), "buyer1", "2025-05")
+	require.NoError(t, err)
+	require.InDelta(t, -1.6+0.6-0.4, invoice.NetAmount, 1e-9)
+
+	_, err = e.GetInvoice(tc.as("seller1", ""), "buyer1", "2025-05")
+	require.Error(t, err)
+	stored, err := e.GetInvoice(tc.as("buyer1", ""), "buyer1", "2025-05")
+	require.NoError(t, err)
+	require.Equal(t, invoice, stored)
+	invoices, err := e.GetInvoices(tc, "buyer1", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, invoices.Records, 1)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ZoneStatus records whether a zone runs islanded from the rest of the grid.
+// While a zone is islanded, trades may only pair participants within it and
+// are priced at no more than PriceCap tokens per kWh, which may be zero or
+// negative during a surplus.
+type ZoneStatus struct {
+	Zone      string   `json:"zone"`
+	Islanded  bool     `json:"islanded"`
+	PriceCap  *float64 `json:"priceCap,omitempty"`
+	Operator  string   `json:"operator"`
+	UpdatedAt string   `json:"updatedAt"`
+}
+
+func zoneStatusKey(ctx contractapi.TransactionContextInterface, zone string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("zonestatus", []string{zone})
+}
+
+// getZoneStatus returns the status of a zone, which is connected unless an
+// operator has islanded it
+func getZoneStatus(ctx contractapi.TransactionContextInterface, zone string) (*ZoneStatus, error) {
+	key, err := zoneStatusKey(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	statusJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status of zone %s: %v", zone, err)
+	}
+	if statusJSON == nil {
+		return &ZoneStatus{Zone: zone}, nil
+	}
+	var status ZoneStatus
+	if err := json.Unmarshal(statusJSON, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// SetZoneIslanded islands a zone under an emergency price cap, or reconnects
+// it, ignoring the cap. Trades confirmed before the zone was islanded are not
+// affected.
+func (e *EnergyTradingContract) SetZoneIslanded(ctx contractapi.TransactionContextInterface, zone string, islanded bool, priceCap float64) error {
+	if zone == "" {
+		return fmt.Errorf("zone must not be empty")
+	}
+	if islanded && (math.IsNaN(priceCap) || math.IsInf(priceCap, 0)) {
+		return fmt.Errorf("an islanded zone needs a price cap")
+	}
+	operator, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	status := ZoneStatus{Zone: zone, Islanded: islanded, Operator: operator, UpdatedAt: now}
+	if islanded {
+		status.PriceCap = &priceCap
+	}
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	key, err := zoneStatusKey(ctx, zone)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, statusJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventZoneStatusChanged, status)
+}
+
+// GetZoneStatus returns whether a zone is islanded
+func (e *EnergyTradingContract) GetZoneStatus(ctx contractapi.TransactionContextInterface, zone string) (*ZoneStatus, error) {
+	return getZoneStatus(ctx, zone)
+}
+
+// checkIslanding fails when a trade between two zones would cross the boundary
+// of an islanded zone, or when its price exceeds the cap of an islanded zone
+func checkIslanding(ctx contractapi.TransactionContextInterface, sellerZone, buyerZone string, price float64) error {
+	for _, zone := range []string{sellerZone, buyerZone} {
+		status, err := getZoneStatus(ctx, zone)
+		if err != nil {
+			return err
+		}
+		if !status.Islanded {
+			continue
+		}
+		if sellerZone != buyerZone {
+			return fmt.Errorf("zone %s is islanded and cannot trade with other zones", zone)
+		}
+		if status.PriceCap != nil && price > *status.PriceCap {
+			return fmt.Errorf("price %v exceeds the emergency price cap %v of islanded zone %s", price, *status.PriceCap, zone)
+		}
+	}
+	return nil
+}
+
+// checkTradeIslanding applies checkIslanding to the parties of a trade
+func checkTradeIslanding(ctx contractapi.TransactionContextInterface, sellerAddress, buyerAddress string, price float64) error {
+	seller, err := getParticipant(ctx, sellerAddress)
+	if err != nil {
+		return err
+	}
+	buyer, err := getParticipant(ctx, buyerAddress)
+	if err != nil {
+		return err
+	}
+	if seller == nil || buyer == nil {
+		return fmt.Errorf("participants %s and %s are not registered", sellerAddress, buyerAddress)
+	}
+	return checkIslanding(ctx, seller.Zone, buyer.Zone, price)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestZoneIslanding(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	_, err := e.RegisterParticipant(tc.as("seller2", RoleProsumer), []string{"meter-seller2"}, tc.publicKeyPEM(t, "seller2"), "zone2")
+	require.NoError(t, err)
+	require.NoError(t, e.ApproveParticipant(tc.as("admin1", RoleAdmin), "seller2"))
+
+	// A trade created before islanding cannot be confirmed across the boundary
+	require.NoError(t, e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller2", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid))
+	require.NoError(t, e.SignEnergyAsset(tc, "energy1", tc.sign(t, e, "buyer1", "energy1"), 0))
+
+	tc.as("operator1", RoleOperator)
+	err = e.SetZoneIslanded(tc, "zone1", true, math.NaN())
+	require.EqualError(t, err, "an islanded zone needs a price cap")
+	require.NoError(t, e.SetZoneIslanded(tc, "zone1", true, 0.3))
+	status, err := e.GetZoneStatus(tc, "zone1")
+	require.NoError(t, err)
+	require.True(t, status.Islanded)
+
+	err = e.SignEnergyAsset(tc.as("seller2", ""), "energy1", tc.sign(t, e, "seller2", "energy1"), 0)
+	require.EqualError(t, err, "zone zone1 is islanded and cannot trade with other zones")
+	err = e.CreateEnergyAsset(tc.as("buyer1", ""), "energy2", "buyer1", "seller2", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "zone zone1 is islanded and cannot trade with other zones")
+	confirmTestAsset(t, e, tc, "energy3")
+
+	require.NoError(t, e.SetZoneIslanded(tc.as("operator1", RoleOperator), "zone1", true, 0.1))
+	err = e.CreateEnergyAsset(tc.as("buyer1", ""), "energy4", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "price 0.2 exceeds the emergency price cap 0.1 of islanded zone zone1")
+
+	// Reconnecting lifts both restrictions
+	require.NoError(t, e.SetZoneIslanded(tc.as("operator1", RoleOperator), "zone1", false, 0.1))
+	require.NoError(t, e.SignEnergyAsset(tc.as("seller2", ""), "energy1", tc.sign(t, e, "seller2", "energy1"), 0))
+	status, err = e.GetZoneStatus(tc, "zone1")
+	require.NoError(t, err)
+	require.Nil(t, status.PriceCap)
+}
+
+func TestZoneIslandingNegativePriceCap(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+
+	// During a surplus the operator may require sellers to pay for offtake
+	require.NoError(t, e.SetZoneIslanded(tc.as("operator1", RoleOperator), "zone1", true, -0.05))
+	status, err := e.GetZoneStatus(tc, "zone1")
+	require.NoError(t, err)
+	require.Equal(t, -0.05, *status.PriceCap)
+	err = e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "price 0.2 exceeds the emergency price cap -0.05 of islanded zone zone1")
+
+	tc.stub.GetTransientReturns(map[string][]byte{
+		tradePrivateTransientKey: []byte(`{"transactionPrice":-0.1,"buyerDeposit":1,"sellerDeposit":1,"salt":"s1"}`),
+	}, nil)
+	confirmTestAsset(t, e, tc, "energy1")
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Levy bases: a share of the gross trade payment, or an amount per kWh that
+// reached the buyer's meter
+const (
+	LevyPercent = "PERCENT"
+	LevyPerKWh  = "PER_KWH"
+)
+
+// Levy is one entry of the levy schedule, such as VAT, a grid levy or a
+// renewable surcharge, paid to the Collector account
+type Levy struct {
+	LevyID    string  `json:"levyID"`
+	Name      string  `json:"name"`
+	Basis     string  `json:"basis"`
+	Rate      float64 `json:"rate"`
+	Collector string  `json:"collector"`
+	UpdatedBy string  `json:"updatedBy"`
+	UpdatedAt string  `json:"updatedAt"`
+}
+
+// LevyCharge is the amount of one levy withheld from a trade's payment
+type LevyCharge struct {
+	LevyID    string  `json:"levyID"`
+	Name      string  `json:"name"`
+	Basis     string  `json:"basis"`
+	Rate      float64 `json:"rate"`
+	Base      float64 `json:"base"`
+	Amount    float64 `json:"amount"`
+	Collector string  `json:"collector"`
+}
+
+func levyKey(ctx contractapi.TransactionContextInterface, levyID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("levy", []string{levyID})
+}
+
+// SetLevy adds a levy to the schedule or replaces it. The collector account is
+// opened if it does not exist. Changes apply to trades settled afterwards.
+func (e *EnergyTradingContract) SetLevy(ctx contractapi.TransactionContextInterface, levyID, name, basis string, rate float64, collector string) (*Levy, error) {
+	if levyID == "" || name == "" || collector == "" {
+		return nil, fmt.Errorf("levy ID, name and collector must not be empty")
+	}
+	if basis != LevyPercent && basis != LevyPerKWh {
+		return nil, fmt.Errorf("levy basis must be %s or %s", LevyPercent, LevyPerKWh)
+	}
+	if rate < 0 || (basis == LevyPercent && rate > 1) {
+		return nil, fmt.Errorf("levy rate must not be negative, and a percentage at most 1")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	account, err := getTokenAccount(ctx, collector)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		if err := putTokenAccount(ctx, &TokenAccount{AccountID: collector}); err != nil {
+			return nil, err
+		}
+	}
+
+	levy := &Levy{
+		LevyID:    levyID,
+		Name:      name,
+		Basis:     basis,
+		Rate:      rate,
+		Collector: collector,
+		UpdatedBy: caller,
+		UpdatedAt: now,
+	}
+	levyJSON, err := json.Marshal(levy)
+	if err != nil {
+		return nil, err
+	}
+	key, err := levyKey(ctx, levyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, levyJSON); err != nil {
+		return nil, err
+	}
+	return levy, emitEvent(ctx, EventLevyScheduleChanged, levy)
+}
+
+// RemoveLevy removes a levy from the schedule
+func (e *EnergyTradingContract) RemoveLevy(ctx contractapi.TransactionContextInterface, levyID string) error {
+	key, err := levyKey(ctx, levyID)
+	if err != nil {
+		return err
+	}
+	levyJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read levy %s: %v", levyID, err)
+	}
+	if levyJSON == nil {
+		return fmt.Errorf("levy %s does not exist", levyID)
+	}
+	if err := ctx.GetStub().DelState(key); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventLevyScheduleChanged, Levy{LevyID: levyID})
+}
+
+// PaginatedLevyResult is a page of levies
+type PaginatedLevyResult struct {
+	Records             []*Levy `json:"records"`
+	FetchedRecordsCount int32   `json:"fetchedRecordsCount"`
+	Bookmark            string  `json:"bookmark"`
+}
+
+// GetLevySchedule returns a page of the levies in force, ordered by levy ID
+func (e *EnergyTradingContract) GetLevySchedule(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedLevyResult, error) {
+	result := &PaginatedLevyResult{Records: []*Levy{}}
+	metadata, err := queryPage(ctx, "levy", []string{}, pageSize, bookmark, func(value []byte) error {
+		var levy Levy
+		if err := json.Unmarshal(value, &levy); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &levy)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// getLevySchedule returns every levy in force, ordered by levy ID
+func getLevySchedule(ctx contractapi.TransactionContextInterface) ([]*Levy, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("levy", []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	levies := []*Levy{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var levy Levy
+		if err := json.Unmarshal(queryResponse.Value, &levy); err != nil {
+			return nil, err
+		}
+		levies = append(levies, &levy)
+	}
+	return levies, nil
+}
+
+// levyCharges applies the levy schedule to a settlement's gross payment.
+// Levies are withheld in schedule order and together never exceed a positive
+// payment. At a zero or negative price percentage levies lapse, while levies
+// per kWh are still due and deepen what the seller pays the buyer.
+func levyCharges(ctx contractapi.TransactionContextInterface, settlement *Settlement) ([]*LevyCharge, error) {
+	levies, err := getLevySchedule(ctx)
+	if err != nil {
+		return nil, err
+	}
+	charges := []*LevyCharge{}
+	remaining := settlement.Payment
+	for _, levy := range levies {
+		base := settlement.Payment
+		if levy.Basis == LevyPerKWh {
+			base = settlement.DeliveredAtMeter
+		}
+		amount := base * levy.Rate
+		if settlement.Payment > 0 {
+			amount = math.Min(amount, remaining)
+		}
+		if amount <= 0 {
+			continue
+		}
+		remaining -= amount
+		charges = append(charges, &LevyCharge{
+			LevyID:    levy.LevyID,
+			Name:      levy.Name,
+			Basis:     levy.Basis,
+			Rate:      levy.Rate,
+			Base:      base,
+			Amount:    amount,
+			Collector: levy.Collector,
+		})
+	}
+	return charges, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestLevies(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	_, err := e.SetLevy(tc, "vat", "VAT", "FLAT", 0.2, "tax-authority")
+	require.EqualError(t, err, "levy basis must be PERCENT or PER_KWH")
+	_, err = e.SetLevy(tc, "vat", "VAT", LevyPercent, 1.2, "tax-authority")
+	require.EqualError(t, err, "levy rate must not be negative, and a percentage at most 1")
+	_, err = e.SetLevy(tc, "vat", "VAT", LevyPercent, 0.2, "tax-authority")
+	require.NoError(t, err)
+	_, err = e.SetLevy(tc, "grid", "Grid levy", LevyPerKWh, 0.01, "grid-levy")
+	require.NoError(t, err)
+	_, err = e.SetLevy(tc, "surcharge", "Renewable surcharge", LevyPerKWh, 0.05, "grid-levy")
+	require.NoError(t, err)
+	require.NoError(t, e.RemoveLevy(tc, "surcharge"))
+	require.EqualError(t, e.RemoveLevy(tc, "surcharge"), "levy surcharge does not exist")
+	levies, err := e.GetLevySchedule(tc, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, levies.Records, 2)
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	settlement, err := e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+	require.InDelta(t, 1.6, settlement.Payment, 1e-9)
+	require.Len(t, settlement.Levies, 2)
+	require.Equal(t, "grid", settlement.Levies[0].LevyID)
+	require.InDelta(t, 0.08, settlement.Levies[0].Amount, 1e-9)
+	require.InDelta(t, 0.32, settlement.Levies[1].Amount, 1e-9)
+	require.InDelta(t, 0.4, settlement.TotalLevies, 1e-9)
+	require.InDelta(t, 1.2, settlement.SellerNetPayment, 1e-9)
+
+	// The buyer pays the same gross amount and insurance premium; the levies
+	// come out of the seller's share
+	buyer, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 8.584, buyer.Balance, 1e-9)
+	seller, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 1.2, seller.Balance, 1e-9)
+	collector, err := e.ReadTokenAccount(tc, "tax-authority")
+	require.NoError(t, err)
+	require.InDelta(t, 0.32, collector.Balance, 1e-9)
+
+	stored, err := e.GetSettlement(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, settlement.Levies, stored.Levies)
+
+	_, err = e.AuditGetFeeLedger(tc, DefaultMaxPageSize, "")
+	require.EqualError(t, err, "caller is not authorized: RegulatorMSP membership required")
+	tc.identity.GetMSPIDReturns(RegulatorMSPID, nil)
+	ledger, err := e.AuditGetFeeLedger(tc, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, ledger.Records, 1)
+	require.Equal(t, "energy1", ledger.Records[0].TokenID)
+	require.Equal(t, settlement.Levies, ledger.Records[0].Levies)
+	require.InDelta(t, 0.4, ledger.Records[0].TotalLevies, 1e-9)
+	require.InDelta(t, 0.016, ledger.Records[0].InsurancePremium, 1e-9)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Log levels, in increasing severity
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+var logLevelNames = []string{"DEBUG", "INFO", "WARNING", "ERROR"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// logLevelEnv names the environment variable holding the chaincode log level.
+// The peer sets it from its chaincode.logging.level setting.
+const logLevelEnv = "CORE_CHAINCODE_LOGGING_LEVEL"
+
+// parseLogLevel reads a level name, as used by the peer, and falls back to
+// INFO for an empty or unknown name
+func parseLogLevel(name string) logLevel {
+	switch strings.ToUpper(name) {
+	case "DEBUG":
+		return levelDebug
+	case "WARN", "WARNING":
+		return levelWarning
+	case "ERROR", "CRITICAL", "PANIC", "FATAL":
+		return levelError
+	default:
+		return levelInfo
+	}
+}
+
+var (
+	chaincodeLogLevel = parseLogLevel(os.Getenv(logLevelEnv))
+	chaincodeLog      = log.New(os.Stderr, "", 0)
+)
+
+// txLogger writes leveled logfmt lines carrying the transaction ID, the
+// invoked function and the caller's MSP, so that the logs of several
+// organizations' peers can be correlated by transaction.
+type txLogger struct {
+	fields string
+}
+
+// newTxLogger returns the logger of the transaction a stub belongs to
+func newTxLogger(stub shim.ChaincodeStubInterface) *txLogger {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		mspID = "unknown"
+	}
+	return &txLogger{fields: fmt.Sprintf("txID=%s function=%s mspID=%s", stub.GetTxID(), transactionFunction(stub), mspID)}
+}
+
+// txLog returns the logger of a transaction function's transaction
+func txLog(ctx contractapi.TransactionContextInterface) *txLogger {
+	return newTxLogger(ctx.GetStub())
+}
+
+func (l *txLogger) logf(level logLevel, format string, args ...interface{}) {
+	if level < chaincodeLogLevel {
+		return
+	}
+	line := fmt.Sprintf("time=%s level=%s", time.Now().UTC().Format(time.RFC3339Nano), level)
+	if l.fields != "" {
+		line += " " + l.fields
+	}
+	chaincodeLog.Print(line + " msg=" + strconv.Quote(fmt.Sprintf(format, args...)))
+}
+
+func (l *txLogger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, format, args...)
+}
+
+func (l *txLogger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, format, args...)
+}
+
+func (l *txLogger) Warningf(format string, args ...interface{}) {
+	l.logf(levelWarning, format, args...)
+}
+
+func (l *txLogger) Errorf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+}
+
+// processLog logs outside of any transaction, such as at startup
+var processLog = &txLogger{}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-samples/asset-transfer-basic/chaincode-go/chaincode/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	chaincodeLog.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// captureLog collects the log lines written at the given level and above
+func captureLog(t *testing.T, level logLevel) *bytes.Buffer {
+	var buf bytes.Buffer
+	chaincodeLog.SetOutput(&buf)
+	previous := chaincodeLogLevel
+	chaincodeLogLevel = level
+	t.Cleanup(func() {
+		chaincodeLog.SetOutput(io.Discard)
+		chaincodeLogLevel = previous
+	})
+	return &buf
+}
+
+// creatorOf returns a serialized identity of the MSP with a self-signed certificate
+func creatorOf(t *testing.T, mspID string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "user1"},
+		NotBefore:    testTxTime,
+		NotAfter:     testTxTime.Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	creator, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	})
+	require.NoError(t, err)
+	return creator
+}
+
+func TestParseLogLevel(t *testing.T) {
+	require.Equal(t, levelDebug, parseLogLevel("debug"))
+	require.Equal(t, levelWarning, parseLogLevel("WARN"))
+	require.Equal(t, levelError, parseLogLevel("CRITICAL"))
+	require.Equal(t, levelInfo, parseLogLevel(""))
+	require.Equal(t, levelInfo, parseLogLevel("verbose"))
+}
+
+func TestTxLoggerFields(t *testing.T) {
+	buf := captureLog(t, levelInfo)
+	stub := &mocks.ChaincodeStub{}
+	stub.GetTxIDReturns("tx1")
+	stub.GetFunctionAndParametersReturns("EnergyTradingContract:ReconcileDelivery", []string{"energy1"})
+	stub.GetCreatorReturns(creatorOf(t, "Org2MSP"), nil)
+	logger := newTxLogger(stub)
+
+	logger.Debugf("not written")
+	logger.Infof("settled trade %s", "energy1")
+	line := strings.TrimSpace(buf.String())
+	require.Contains(t, line, " level=INFO txID=tx1 function=ReconcileDelivery mspID=Org2MSP msg=\"settled trade energy1\"")
+	require.True(t, strings.HasPrefix(line, "time="))
+	require.Equal(t, 1, strings.Count(buf.String(), "\n"))
+
+	// Failed transactions are logged at WARNING
+	buf.Reset()
+	chaincodeLogLevel = levelWarning
+	stub.GetCreatorReturns(nil, nil)
+	cc := recoveringChaincode{panickingChaincode{}}
+	cc.Invoke(stub)
+	require.Contains(t, buf.String(), "level=ERROR txID=tx1 function=ReconcileDelivery mspID=unknown msg=\"recovered from panic")
+	require.Contains(t, buf.String(), "level=WARNING txID=tx1 function=ReconcileDelivery mspID=unknown msg=\"transaction failed: ReconcileDelivery: internal error")
+}
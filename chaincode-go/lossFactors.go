@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// LossFactor is the share of energy lost in the network on its way between
+// two zones. Like network tariffs, loss factors are symmetric and the diagonal
+// holds the losses within a zone. Zone pairs without a factor are lossless.
+type LossFactor struct {
+	ZoneA     string  `json:"zoneA"`
+	ZoneB     string  `json:"zoneB"`
+	Factor    float64 `json:"factor"`
+	Operator  string  `json:"operator"`
+	UpdatedAt string  `json:"updatedAt"`
+}
+
+// LossRecord reports the network losses of a settled trade in one time slot:
+// the energy credited to the seller at injection, the energy the buyer paid
+// for at its meter, and their difference, which the grid operator pays for.
+type LossRecord struct {
+	TokenID          string  `json:"tokenID"`
+	IntervalStart    string  `json:"intervalStart"`
+	InjectedEnergy   float64 `json:"injectedEnergy"`
+	DeliveredAtMeter float64 `json:"deliveredAtMeter"`
+	LossEnergy       float64 `json:"lossEnergy"`
+	Amount           float64 `json:"amount"`
+}
+
+// lossFactorKey orders the zones so that both directions share one entry
+func lossFactorKey(ctx contractapi.TransactionContextInterface, zoneA, zoneB string) (string, error) {
+	if zoneB < zoneA {
+		zoneA, zoneB = zoneB, zoneA
+	}
+	return ctx.GetStub().CreateCompositeKey("lossfactor", []string{zoneA, zoneB})
+}
+
+func lossRecordKey(ctx contractapi.TransactionContextInterface, tokenID, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("lossrecord", []string{tokenID, intervalStart})
+}
+
+// SetLossFactor sets the technical loss factor between two zones. The factor
+// of a trade is fixed when the trade is confirmed.
+func (e *EnergyTradingContract) SetLossFactor(ctx contractapi.TransactionContextInterface, zoneA, zoneB string, factor float64) error {
+	if zoneA == "" || zoneB == "" {
+		return fmt.Errorf("zone must not be empty")
+	}
+	if factor < 0 || factor >= 1 {
+		return fmt.Errorf("loss factor must be at least 0 and below 1")
+	}
+	if zoneB < zoneA {
+		zoneA, zoneB = zoneB, zoneA
+	}
+	operator, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	lossFactor := LossFactor{
+		ZoneA:     zoneA,
+		ZoneB:     zoneB,
+		Factor:    factor,
+		Operator:  operator,
+		UpdatedAt: now,
+	}
+	lossFactorJSON, err := json.Marshal(lossFactor)
+	if err != nil {
+		return err
+	}
+	key, err := lossFactorKey(ctx, zoneA, zoneB)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, lossFactorJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventLossFactorSet, lossFactor)
+}
+
+// GetLossFactor returns the technical loss factor between two zones
+func (e *EnergyTradingContract) GetLossFactor(ctx contractapi.TransactionContextInterface, zoneA, zoneB string) (*LossFactor, error) {
+	lossFactor, err := getLossFactor(ctx, zoneA, zoneB)
+	if err != nil {
+		return nil, err
+	}
+	if lossFactor == nil {
+		return nil, fmt.Errorf("no loss factor is set between %s and %s", zoneA, zoneB)
+	}
+	return lossFactor, nil
+}
+
+// getLossFactor returns the loss factor between two zones, or nil if none is set
+func getLossFactor(ctx contractapi.TransactionContextInterface, zoneA, zoneB string) (*LossFactor, error) {
+	key, err := lossFactorKey(ctx, zoneA, zoneB)
+	if err != nil {
+		return nil, err
+	}
+	lossFactorJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read loss factor: %v", err)
+	}
+	if lossFactorJSON == nil {
+		return nil, nil
+	}
+	var lossFactor LossFactor
+	if err := json.Unmarshal(lossFactorJSON, &lossFactor); err != nil {
+		return nil, err
+	}
+	return &lossFactor, nil
+}
+
+// tradeLossFactor returns the loss factor between the zones of a trade's parties
+func tradeLossFactor(ctx contractapi.TransactionContextInterface, asset *EnergyAsset) (float64, error) {
+	seller, err := getParticipant(ctx, asset.SellerAddress)
+	if err != nil {
+		return 0, err
+	}
+	buyer, err := getParticipant(ctx, asset.BuyerAddress)
+	if err != nil {
+		return 0, err
+	}
+	if seller == nil || buyer == nil {
+		return 0, fmt.Errorf("participants of asset %s are not registered", asset.TokenID)
+	}
+	lossFactor, err := getLossFactor(ctx, seller.Zone, buyer.Zone)
+	if err != nil {
+		return 0, err
+	}
+	if lossFactor == nil {
+		return 0, nil
+	}
+	return lossFactor.Factor, nil
+}
+
+// putLossRecords spreads a settlement's losses over the trade's time slots by
+// the share of the delivery window each covers
+func putLossRecords(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, settlement *Settlement) error {
+	if settlement.LossEnergy == 0 {
+		return nil
+	}
+	intervals, err := deliveryIntervals(ctx, asset)
+	if err != nil {
+		return err
+	}
+	for _, interval := range intervals {
+		record := LossRecord{
+			TokenID:          asset.TokenID,
+			IntervalStart:    interval.start,
+			InjectedEnergy:   settlement.DeliveredEnergy * interval.share,
+			DeliveredAtMeter: settlement.DeliveredAtMeter * interval.share,
+			LossEnergy:       settlement.LossEnergy * interval.share,
+			Amount:           settlement.LossCompensation * interval.share,
+		}
+		recordJSON, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		key, err := lossRecordKey(ctx, asset.TokenID, interval.start)
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().PutState(key, recordJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PaginatedLossRecordResult is a page of loss records
+type PaginatedLossRecordResult struct {
+	Records             []*LossRecord `json:"records"`
+	FetchedRecordsCount int32         `json:"fetchedRecordsCount"`
+	Bookmark            string        `json:"bookmark"`
+}
+
+// GetLossRecords returns a page of the per-slot loss records of a settled trade
+func (e *EnergyTradingContract) GetLossRecords(ctx contractapi.TransactionContextInterface, tokenID string, pageSize int32, bookmark string) (*PaginatedLossRecordResult, error) {
+	result := &PaginatedLossRecordResult{Records: []*LossRecord{}}
+	metadata, err := queryPage(ctx, "lossrecord", []string{tokenID}, pageSize, bookmark, func(value []byte) error {
+		var record LossRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestLossFactor(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+
+	tc.as("operator1", RoleOperator)
+	err := e.SetLossFactor(tc, "zone1", "zone2", 1)
+	require.EqualError(t, err, "loss factor must be at least 0 and below 1")
+	require.NoError(t, e.SetLossFactor(tc, "zone2", "zone1", 0.05))
+	lossFactor, err := e.GetLossFactor(tc, "zone1", "zone2")
+	require.NoError(t, err)
+	require.Equal(t, "zone1", lossFactor.ZoneA)
+	require.Equal(t, 0.05, lossFactor.Factor)
+	_, err = e.GetLossFactor(tc, "zone1", "zone1")
+	require.EqualError(t, err, "no loss factor is set between zone1 and zone1")
+}
+
+func TestReconcileDeliveryAppliesLossFactor(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	require.NoError(t, e.SetLossFactor(tc.as("operator1", RoleOperator), "zone1", "zone1", 0.1))
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, 0.1, asset.LossFactor)
+
+	// The seller injects 8 kWh, of which 7.2 kWh reach the buyer's meter
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	settlement, err := e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+	require.InDelta(t, 8, settlement.DeliveredEnergy, 1e-9)
+	require.InDelta(t, 7.2, settlement.DeliveredAtMeter, 1e-9)
+	require.InDelta(t, 0.8, settlement.LossEnergy, 1e-9)
+	require.InDelta(t, 1.44, settlement.Payment, 1e-9)
+	require.InDelta(t, 0.16, settlement.LossCompensation, 1e-9)
+
+	records, err := e.GetLossRecords(tc, "energy1", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, records.Records, 4)
+	require.Equal(t, "2025-05-03T10:00:00Z", records.Records[0].IntervalStart)
+	require.InDelta(t, 2, records.Records[0].InjectedEnergy, 1e-9)
+	require.InDelta(t, 0.2, records.Records[0].LossEnergy, 1e-9)
+	require.InDelta(t, 0.04, records.Records[0].Amount, 1e-9)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// marketPauseKey is the state key of the market pause switch
+const marketPauseKey = "marketpause"
+
+// pausableFunctions are the functions that place orders, match them or
+// create trades. They are rejected while the market is paused; settlement,
+// delivery, disputes and queries carry on so that open positions can wind
+// down.
+var pausableFunctions = []string{
+	"CreateEnergyAsset",
+	"SignEnergyAsset",
+	"PlaceCertificateOffer",
+	"PlaceCertificateBid",
+	"MatchCertificateBid",
+	"SubmitCapacityOffer",
+	"ClearCapacityMarket",
+	"OpenChargingSession",
+	"FillChargingSession",
+	"ProposeForward",
+	"ProposeIndexedForward",
+	"AcceptForward",
+	"WriteOption",
+	"BuyOption",
+	"StartDutchAuction",
+	"AcceptDutchAuction",
+	"SubmitCommunityOrder",
+	"ClearIntraCommunity",
+	"ClearInterCommunity",
+}
+
+// MarketPause records whether the market is paused, by whom and why
+type MarketPause struct {
+	Paused    bool   `json:"paused"`
+	Reason    string `json:"reason,omitempty"`
+	UpdatedBy string `json:"updatedBy,omitempty"`
+	UpdatedAt string `json:"updatedAt,omitempty"`
+}
+
+// GetMarketPause returns the market pause switch, which is off until an admin
+// pauses the market
+func (e *EnergyTradingContract) GetMarketPause(ctx contractapi.TransactionContextInterface) (*MarketPause, error) {
+	pauseJSON, err := ctx.GetStub().GetState(marketPauseKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read market pause: %v", err)
+	}
+	if pauseJSON == nil {
+		return &MarketPause{}, nil
+	}
+	var pause MarketPause
+	if err := json.Unmarshal(pauseJSON, &pause); err != nil {
+		return nil, err
+	}
+	return &pause, nil
+}
+
+// requireMarketOpen rejects calls of pausable functions while the market is
+// paused
+func requireMarketOpen(ctx contractapi.TransactionContextInterface, fn string) error {
+	if !hasRole(pausableFunctions, fn) {
+		return nil
+	}
+	pause, err := (&EnergyTradingContract{}).GetMarketPause(ctx)
+	if err != nil {
+		return err
+	}
+	if pause.Paused {
+		return fmt.Errorf("%s: market is paused: %s", fn, pause.Reason)
+	}
+	return nil
+}
+
+func setMarketPause(ctx contractapi.TransactionContextInterface, paused bool, reason string) (*MarketPause, error) {
+	current, err := (&EnergyTradingContract{}).GetMarketPause(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current.Paused == paused {
+		if paused {
+			return nil, fmt.Errorf("market is already paused")
+		}
+		return nil, fmt.Errorf("market is not paused")
+	}
+	admin, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pause := &MarketPause{Paused: paused, Reason: reason, UpdatedBy: admin, UpdatedAt: now}
+	pauseJSON, err := json.Marshal(pause)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(marketPauseKey, pauseJSON); err != nil {
+		return nil, err
+	}
+	txLog(ctx).Infof("market paused=%t by %s: %s", paused, admin, reason)
+	return pause, emitEvent(ctx, EventMarketPauseChanged, pause)
+}
+
+// PauseMarket stops order placement, matching and trade creation across the
+// market, for example while an oracle is failing or an exploit is being
+// contained. Under an admin policy with a threshold above one it needs
+// admin approvals.
+func (e *EnergyTradingContract) PauseMarket(ctx contractapi.TransactionContextInterface, reason string) (*MarketPause, error) {
+	if reason == "" {
+		return nil, fmt.Errorf("a pause needs a reason")
+	}
+	return setMarketPause(ctx, true, reason)
+}
+
+// ResumeMarket lifts a market pause
+func (e *EnergyTradingContract) ResumeMarket(ctx contractapi.TransactionContextInterface) (*MarketPause, error) {
+	return setMarketPause(ctx, false, "")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarketPause(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+
+	_, err := e.PauseMarket(tc.as("admin1", RoleAdmin), "")
+	require.EqualError(t, err, "a pause needs a reason")
+	pause, err := e.PauseMarket(tc, "oracle outage")
+	require.NoError(t, err)
+	require.Equal(t, "admin1", pause.UpdatedBy)
+	_, err = e.PauseMarket(tc, "oracle outage")
+	require.EqualError(t, err, "market is already paused")
+
+	tc.as("buyer1", RoleConsumer)
+	require.EqualError(t, tc.authorize("CreateEnergyAsset"), "CreateEnergyAsset: market is paused: oracle outage")
+	require.EqualError(t, tc.authorize("AcceptDutchAuction"), "AcceptDutchAuction: market is paused: oracle outage")
+	require.NoError(t, tc.authorize("ReconcileDelivery"))
+	require.NoError(t, tc.authorize("TransferTokens"))
+
+	// With approvals required, resuming goes through an admin action
+	tc.as("admin1", RoleAdmin)
+	_, err = e.SetAdminPolicy(tc, 2, []string{}, 24)
+	require.NoError(t, err)
+	require.EqualError(t, tc.authorize("ResumeMarket"), "ResumeMarket needs 2 admin approvals and must be proposed with ProposeAdminAction")
+	_, err = e.ProposeAdminAction(tc, "resume", "ResumeMarket", []string{})
+	require.NoError(t, err)
+	_, err = e.ApproveAdminAction(tc.as("admin2", RoleAdmin), "resume")
+	require.NoError(t, err)
+	_, err = e.ExecuteAdminAction(tc, "resume")
+	require.NoError(t, err)
+	pause, err = e.GetMarketPause(tc)
+	require.NoError(t, err)
+	require.False(t, pause.Paused)
+	require.NoError(t, tc.as("buyer1", RoleConsumer).authorize("CreateEnergyAsset"))
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Meter dispute statuses
+const (
+	DisputeOpen              = "OPEN"
+	DisputeEvidenceRequested = "EVIDENCE_REQUESTED"
+	DisputeEvidenceSubmitted = "EVIDENCE_SUBMITTED"
+	DisputeReferred          = "REFERRED"
+	DisputeUpheld            = "UPHELD"
+	DisputeRejected          = "REJECTED"
+)
+
+// MeterDisputeWindow is how long after submission a reading can be challenged
+const MeterDisputeWindow = 48 * time.Hour
+
+// ReadingDisputePenalty is the reputation deducted from a meter's owner when a
+// challenge to one of its readings is upheld.
+const ReadingDisputePenalty = -10.0
+
+// readingEvidenceTransientKey is the transient map entry holding the meter's
+// raw signed payload submitted as evidence.
+const readingEvidenceTransientKey = "reading_evidence"
+
+// MeterDispute is a counterparty's challenge to a meter reading used by one of
+// its trades. The challenged reading is frozen until an arbiter resolves it.
+type MeterDispute struct {
+	MeterID           string  `json:"meterID"`
+	IntervalStart     string  `json:"intervalStart"`
+	TokenID           string  `json:"tokenID"`
+	Challenger        string  `json:"challenger"`
+	Reason            string  `json:"reason"`
+	Status            string  `json:"status"`
+	OpenedAt          string  `json:"openedAt"`
+	EvidenceHash      string  `json:"evidenceHash,omitempty"`
+	Arbiter           string  `json:"arbiter,omitempty"`
+	CorrectedInjected float64 `json:"correctedInjected,omitempty"`
+	CorrectedConsumed float64 `json:"correctedConsumed,omitempty"`
+	ResolvedAt        string  `json:"resolvedAt,omitempty"`
+}
+
+func meterDisputeKey(ctx contractapi.TransactionContextInterface, meterID, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("meterdispute", []string{meterID, intervalStart})
+}
+
+func putMeterDispute(ctx contractapi.TransactionContextInterface, dispute *MeterDispute) error {
+	disputeJSON, err := json.Marshal(dispute)
+	if err != nil {
+		return err
+	}
+	key, err := meterDisputeKey(ctx, dispute.MeterID, dispute.IntervalStart)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, disputeJSON)
+}
+
+// ChallengeMeterReading disputes a reading from the counterparty's meter that
+// falls in the delivery window of a trade the caller is party to. The trade
+// must not be settled yet and the reading must be younger than
+// MeterDisputeWindow. The reading is frozen, which blocks ReconcileDelivery
+// until the dispute is resolved.
+func (e *EnergyTradingContract) ChallengeMeterReading(ctx contractapi.TransactionContextInterface, tokenID, meterID, intervalStart, reason string) error {
+	asset, err := e.ReadEnergyAsset(ctx, tokenID)
+	if err != nil {
+		return err
+	}
+	challenger, err := requireParty(ctx, asset.BuyerAddress, asset.SellerAddress)
+	if err != nil {
+		return err
+	}
+	if asset.TransactionState == StateSettled {
+		return fmt.Errorf("asset %s has already been settled", tokenID)
+	}
+	reading, err := getMeterReading(ctx, meterID, intervalStart)
+	if err != nil {
+		return err
+	}
+	counterparty := asset.SellerAddress
+	if challenger == asset.SellerAddress {
+		counterparty = asset.BuyerAddress
+	}
+	if reading.Owner != counterparty {
+		return fmt.Errorf("meter %s does not belong to the counterparty of asset %s", meterID, tokenID)
+	}
+	if reading.IntervalStart < asset.DeliveryStart || reading.IntervalStart >= asset.DeliveryEnd {
+		return fmt.Errorf("reading at %s is outside the delivery window of asset %s", reading.IntervalStart, tokenID)
+	}
+	key, err := meterDisputeKey(ctx, meterID, reading.IntervalStart)
+	if err != nil {
+		return err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read meter dispute: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("reading of meter %s at %s has already been disputed", meterID, reading.IntervalStart)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	submittedAt, err := parseTimestamp(reading.SubmittedAt)
+	if err != nil {
+		return err
+	}
+	if now.After(submittedAt.Add(MeterDisputeWindow)) {
+		return fmt.Errorf("dispute window for the reading of meter %s at %s has closed", meterID, reading.IntervalStart)
+	}
+
+	reading.Disputed = true
+	if err := putMeterReading(ctx, reading); err != nil {
+		return err
+	}
+	dispute := &MeterDispute{
+		MeterID:       meterID,
+		IntervalStart: reading.IntervalStart,
+		TokenID:       tokenID,
+		Challenger:    challenger,
+		Reason:        reason,
+		Status:        DisputeOpen,
+		OpenedAt:      now.Format(time.RFC3339),
+	}
+	if err := putMeterDispute(ctx, dispute); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventMeterDisputeChanged, dispute)
+}
+
+// RequestReadingEvidence asks the meter's owner to submit the raw signed
+// payload of a disputed reading.
+func (e *EnergyTradingContract) RequestReadingEvidence(ctx contractapi.TransactionContextInterface, meterID, intervalStart string) error {
+	dispute, err := e.GetMeterDispute(ctx, meterID, intervalStart)
+	if err != nil {
+		return err
+	}
+	if dispute.Status != DisputeOpen {
+		return fmt.Errorf("dispute of meter %s at %s is %s", meterID, dispute.IntervalStart, dispute.Status)
+	}
+	arbiter, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	dispute.Status = DisputeEvidenceRequested
+	dispute.Arbiter = arbiter
+	if err := putMeterDispute(ctx, dispute); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventMeterDisputeChanged, dispute)
+}
+
+// SubmitReadingEvidence stores the raw signed payload of a disputed reading,
+// passed in the "reading_evidence" transient entry, in the trade collection of
+// the meter owner's organization.
+// Only its hash is recorded on the dispute.
+func (e *EnergyTradingContract) SubmitReadingEvidence(ctx contractapi.TransactionContextInterface, meterID, intervalStart string) error {
+	dispute, err := e.GetMeterDispute(ctx, meterID, intervalStart)
+	if err != nil {
+		return err
+	}
+	reading, err := getMeterReading(ctx, meterID, intervalStart)
+	if err != nil {
+		return err
+	}
+	if err := requireCaller(ctx, reading.Owner); err != nil {
+		return err
+	}
+	if dispute.Status != DisputeEvidenceRequested {
+		return fmt.Errorf("no evidence has been requested for meter %s at %s", meterID, dispute.IntervalStart)
+	}
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return fmt.Errorf("failed to read transient map: %v", err)
+	}
+	evidence, ok := transientMap[readingEvidenceTransientKey]
+	if !ok || len(evidence) == 0 {
+		return fmt.Errorf("%s must be supplied in the transient map", readingEvidenceTransientKey)
+	}
+	collection, err := tradeCollection(ctx, reading.Owner)
+	if err != nil {
+		return err
+	}
+	key, err := meterDisputeKey(ctx, meterID, dispute.IntervalStart)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutPrivateData(collection, key, evidence); err != nil {
+		return err
+	}
+
+	dispute.Status = DisputeEvidenceSubmitted
+	dispute.EvidenceHash = hashPrivateDetails(evidence)
+	if err := putMeterDispute(ctx, dispute); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventMeterDisputeChanged, dispute)
+}
+
+// GetReadingEvidence returns the raw signed payload submitted for a dispute
+func (e *EnergyTradingContract) GetReadingEvidence(ctx contractapi.TransactionContextInterface, meterID, intervalStart string) (string, error) {
+	dispute, err := e.GetMeterDispute(ctx, meterID, intervalStart)
+	if err != nil {
+		return "", err
+	}
+	reading, err := getMeterReading(ctx, meterID, dispute.IntervalStart)
+	if err != nil {
+		return "", err
+	}
+	collection, err := tradeCollection(ctx, reading.Owner)
+	if err != nil {
+		return "", err
+	}
+	key, err := meterDisputeKey(ctx, meterID, dispute.IntervalStart)
+	if err != nil {
+		return "", err
+	}
+	evidence, err := ctx.GetStub().GetPrivateData(collection, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read evidence: %v", err)
+	}
+	if evidence == nil {
+		return "", fmt.Errorf("no evidence is available for meter %s at %s", meterID, dispute.IntervalStart)
+	}
+	if hashPrivateDetails(evidence) != dispute.EvidenceHash {
+		return "", fmt.Errorf("evidence for meter %s at %s does not match its hash", meterID, dispute.IntervalStart)
+	}
+	return string(evidence), nil
+}
+
+// ResolveMeterDispute closes a dispute and unfreezes the reading. When the
+// challenge is upheld the reading is replaced by the arbiter's corrected values
+// and the meter's owner loses ReadingDisputePenalty reputation; settlement then
+// uses the corrected reading.
+// A dispute referred to an arbitrator panel is resolved by the panel's vote.
+func (e *EnergyTradingContract) ResolveMeterDispute(ctx contractapi.TransactionContextInterface, meterID, intervalStart string, upheld bool, correctedInjected, correctedConsumed float64) error {
+	dispute, err := e.GetMeterDispute(ctx, meterID, intervalStart)
+	if err != nil {
+		return err
+	}
+	if dispute.Status == DisputeUpheld || dispute.Status == DisputeRejected {
+		return fmt.Errorf("dispute of meter %s at %s is already resolved", meterID, dispute.IntervalStart)
+	}
+	if dispute.Status == DisputeReferred {
+		return fmt.Errorf("dispute of meter %s at %s is referred to an arbitrator panel", meterID, dispute.IntervalStart)
+	}
+	arbiter, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	return resolveMeterDispute(ctx, dispute, arbiter, upheld, correctedInjected, correctedConsumed)
+}
+
+// resolveMeterDispute applies the decision on a dispute for ResolveMeterDispute
+// and arbitrator panels
+func resolveMeterDispute(ctx contractapi.TransactionContextInterface, dispute *MeterDispute, arbiter string, upheld bool, correctedInjected, correctedConsumed float64) error {
+	reading, err := getMeterReading(ctx, dispute.MeterID, dispute.IntervalStart)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	reading.Disputed = false
+	dispute.Arbiter = arbiter
+	dispute.ResolvedAt = now
+	dispute.Status = DisputeRejected
+	if upheld {
+		if correctedInjected < 0 || correctedConsumed < 0 {
+			return fmt.Errorf("meter readings must not be negative")
+		}
+		dispute.Status = DisputeUpheld
+		dispute.CorrectedInjected = correctedInjected
+		dispute.CorrectedConsumed = correctedConsumed
+		reading.KWhInjected = correctedInjected
+		reading.KWhConsumed = correctedConsumed
+		reading.Corrected = true
+		if err := (&EnergyTradingContract{}).UpdateReputationScore(ctx, reading.Owner, ReadingDisputePenalty); err != nil {
+			return err
+		}
+	}
+	if err := putMeterReading(ctx, reading); err != nil {
+		return err
+	}
+	if upheld {
+		if err := recordSelfConsumption(ctx, reading.Owner, reading.IntervalStart, reading.IntervalEnd); err != nil {
+			return err
+		}
+	}
+	if err := putMeterDispute(ctx, dispute); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventMeterDisputeChanged, dispute)
+}
+
+// GetMeterDispute returns the dispute of a meter reading
+func (e *EnergyTradingContract) GetMeterDispute(ctx contractapi.TransactionContextInterface, meterID, intervalStart string) (*MeterDispute, error) {
+	intervalStart, err := normalizeTimestamp(intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	key, err := meterDisputeKey(ctx, meterID, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	disputeJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meter dispute: %v", err)
+	}
+	if disputeJSON == nil {
+		return nil, fmt.Errorf("reading of meter %s at %s is not disputed", meterID, intervalStart)
+	}
+	var dispute MeterDispute
+	if err := json.Unmarshal(disputeJSON, &dispute); err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
+// PaginatedMeterDisputeResult is a page of meter disputes
+type PaginatedMeterDisputeResult struct {
+	Records             []*MeterDispute `json:"records"`
+	FetchedRecordsCount int32           `json:"fetchedRecordsCount"`
+	Bookmark            string          `json:"bookmark"`
+}
+
+// GetOpenMeterDisputes returns a page of the meter disputes not yet resolved.
+// Upheld and rejected disputes are skipped, so a page may hold fewer than
+// pageSize disputes.
+func (e *EnergyTradingContract) GetOpenMeterDisputes(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedMeterDisputeResult, error) {
+	result := &PaginatedMeterDisputeResult{Records: []*MeterDispute{}}
+	metadata, err := queryPage(ctx, "meterdispute", []string{}, pageSize, bookmark, func(value []byte) error {
+		var dispute MeterDispute
+		if err := json.Unmarshal(value, &dispute); err != nil {
+			return err
+		}
+		if dispute.Status != DisputeUpheld && dispute.Status != DisputeRejected {
+			result.Records = append(result.Records, &dispute)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
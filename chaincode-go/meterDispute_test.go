@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestMeterReadingDispute(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 10))
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2.5, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 2.5)
+
+	const interval = "2025-05-03T10:15:00Z"
+	err := e.ChallengeMeterReading(tc.as("seller1", ""), "energy1", "meter-seller1", interval, "own meter")
+	require.EqualError(t, err, "meter meter-seller1 does not belong to the counterparty of asset energy1")
+	require.NoError(t, e.ChallengeMeterReading(tc.as("buyer1", ""), "energy1", "meter-seller1", interval, "injection exceeds inverter rating"))
+	err = e.ChallengeMeterReading(tc, "energy1", "meter-seller1", interval, "again")
+	require.EqualError(t, err, "reading of meter meter-seller1 at 2025-05-03T10:15:00Z has already been disputed")
+
+	_, err = e.ReconcileDelivery(tc, "energy1")
+	require.EqualError(t, err, "reading of meter meter-seller1 at 2025-05-03T10:15:00Z is under dispute")
+
+	open, err := e.GetOpenMeterDisputes(tc, 10, "")
+	require.NoError(t, err)
+	require.Len(t, open.Records, 1)
+	require.Equal(t, "meter-seller1", open.Records[0].MeterID)
+
+	tc.as("arbiter1", RoleArbiter)
+	require.NoError(t, e.RequestReadingEvidence(tc, "meter-seller1", interval))
+	err = e.SubmitReadingEvidence(tc.as("buyer1", ""), "meter-seller1", interval)
+	require.EqualError(t, err, "caller buyer1 is not authorized to act for seller1")
+	transient, err := tc.stub.GetTransient()
+	require.NoError(t, err)
+	transient[readingEvidenceTransientKey] = []byte(`{"raw":"device frame"}`)
+	require.NoError(t, e.SubmitReadingEvidence(tc.as("seller1", ""), "meter-seller1", interval))
+	evidence, err := e.GetReadingEvidence(tc.as("arbiter1", RoleArbiter), "meter-seller1", interval)
+	require.NoError(t, err)
+	require.Equal(t, `{"raw":"device frame"}`, evidence)
+
+	require.NoError(t, e.ResolveMeterDispute(tc, "meter-seller1", interval, true, 0.5, 0))
+	dispute, err := e.GetMeterDispute(tc, "meter-seller1", interval)
+	require.NoError(t, err)
+	require.Equal(t, DisputeUpheld, dispute.Status)
+	open, err = e.GetOpenMeterDisputes(tc, 10, "")
+	require.NoError(t, err)
+	require.Empty(t, open.Records)
+	reputation, err := e.ReadReputationScore(tc, "seller1")
+	require.NoError(t, err)
+	require.Equal(t, 40.0, reputation.Score)
+
+	settlement, err := e.ReconcileDelivery(tc.as("buyer1", ""), "energy1")
+	require.NoError(t, err)
+	require.Equal(t, 8.0, settlement.DeliveredEnergy)
+}
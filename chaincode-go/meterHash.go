@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// MeterHashCommitment anchors an off-chain meter reading to a delivery. Only
+// the SHA-256 of the reading is stored on-chain; the reading itself stays with
+// the parties and can later be checked with VerifyMeterReading.
+type MeterHashCommitment struct {
+	TokenID     string `json:"tokenID"`
+	MeterID     string `json:"meterID"`
+	Submitter   string `json:"submitter"`
+	ReadingHash string `json:"readingHash"`
+	CommittedAt string `json:"committedAt"`
+}
+
+func meterHashKey(ctx contractapi.TransactionContextInterface, tokenID, meterID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("meterhash", []string{tokenID, meterID})
+}
+
+func ownsMeter(participant *Participant, meterID string) bool {
+	for _, id := range participant.MeterIDs {
+		if id == meterID {
+			return true
+		}
+	}
+	return false
+}
+
+// CommitMeterHash records the hex SHA-256 hash of an off-chain reading from
+// one of the caller's meters for a trade it is party to. A commitment cannot be
+// overwritten.
+func (e *EnergyTradingContract) CommitMeterHash(ctx contractapi.TransactionContextInterface, tokenID, meterID, readingHash string) error {
+	asset, err := e.ReadEnergyAsset(ctx, tokenID)
+	if err != nil {
+		return err
+	}
+	caller, err := requireParty(ctx, asset.BuyerAddress, asset.SellerAddress)
+	if err != nil {
+		return err
+	}
+	participant, err := requireApprovedParticipant(ctx, caller)
+	if err != nil {
+		return err
+	}
+	if !ownsMeter(participant, meterID) {
+		return fmt.Errorf("meter %s is not registered to %s", meterID, caller)
+	}
+	readingHash = strings.ToLower(readingHash)
+	if decoded, err := hex.DecodeString(readingHash); err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("reading hash must be a hex encoded SHA-256 digest")
+	}
+
+	key, err := meterHashKey(ctx, tokenID, meterID)
+	if err != nil {
+		return err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read meter hash commitment: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("meter %s already has a commitment for asset %s", meterID, tokenID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	commitment := MeterHashCommitment{
+		TokenID:     tokenID,
+		MeterID:     meterID,
+		Submitter:   caller,
+		ReadingHash: readingHash,
+		CommittedAt: now,
+	}
+	commitmentJSON, err := json.Marshal(commitment)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, commitmentJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventMeterHashCommitted, commitment)
+}
+
+// GetMeterHashCommitment returns the commitment for a trade's meter
+func (e *EnergyTradingContract) GetMeterHashCommitment(ctx contractapi.TransactionContextInterface, tokenID, meterID string) (*MeterHashCommitment, error) {
+	key, err := meterHashKey(ctx, tokenID, meterID)
+	if err != nil {
+		return nil, err
+	}
+	commitmentJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meter hash commitment: %v", err)
+	}
+	if commitmentJSON == nil {
+		return nil, fmt.Errorf("meter %s has no commitment for asset %s", meterID, tokenID)
+	}
+	var commitment MeterHashCommitment
+	if err := json.Unmarshal(commitmentJSON, &commitment); err != nil {
+		return nil, err
+	}
+	return &commitment, nil
+}
+
+// VerifyMeterReading reports whether an off-chain reading matches the hash
+// committed for the trade's meter. The reading must be passed byte for byte as
+// it was hashed.
+func (e *EnergyTradingContract) VerifyMeterReading(ctx contractapi.TransactionContextInterface, tokenID, meterID, reading string) (bool, error) {
+	commitment, err := e.GetMeterHashCommitment(ctx, tokenID, meterID)
+	if err != nil {
+		return false, err
+	}
+	digest := sha256.Sum256([]byte(reading))
+	return hex.EncodeToString(digest[:]) == commitment.ReadingHash, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeterHashCommitment(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	createTestAsset(t, e, tc, "energy1")
+
+	reading := `{"meterID":"meter-seller1","kWh":10}`
+	digest := sha256.Sum256([]byte(reading))
+	readingHash := hex.EncodeToString(digest[:])
+
+	err := e.CommitMeterHash(tc.as("seller1", ""), "energy1", "meter-buyer1", readingHash)
+	require.EqualError(t, err, "meter meter-buyer1 is not registered to seller1")
+	err = e.CommitMeterHash(tc, "energy1", "meter-seller1", "abc")
+	require.EqualError(t, err, "reading hash must be a hex encoded SHA-256 digest")
+
+	_, err = e.GetMeterHashCommitment(tc, "energy1", "meter-seller1")
+	require.EqualError(t, err, "meter meter-seller1 has no commitment for asset energy1")
+	require.NoError(t, e.CommitMeterHash(tc, "energy1", "meter-seller1", readingHash))
+	commitment, err := e.GetMeterHashCommitment(tc, "energy1", "meter-seller1")
+	require.NoError(t, err)
+	require.Equal(t, readingHash, commitment.ReadingHash)
+	require.Equal(t, "seller1", commitment.Submitter)
+	err = e.CommitMeterHash(tc, "energy1", "meter-seller1", readingHash)
+	require.EqualError(t, err, "meter meter-seller1 already has a commitment for asset energy1")
+
+	ok, err := e.VerifyMeterReading(tc, "energy1", "meter-seller1", reading)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = e.VerifyMeterReading(tc, "energy1", "meter-seller1", `{"meterID":"meter-seller1","kWh":12}`)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// MeterReadingPayload is the data a meter signs for one interval. Fields are
+// listed in a fixed order so the JSON encoding is stable across devices.
+type MeterReadingPayload struct {
+	MeterID       string  `json:"meterID"`
+	IntervalStart string  `json:"intervalStart"`
+	KWhInjected   float64 `json:"kWhInjected"`
+	KWhConsumed   float64 `json:"kWhConsumed"`
+}
+
+// MeterReading is an accepted, signature-verified reading for one interval
+type MeterReading struct {
+	MeterID       string  `json:"meterID"`
+	Owner         string  `json:"owner"`
+	IntervalStart string  `json:"intervalStart"`
+	IntervalEnd   string  `json:"intervalEnd"`
+	KWhInjected   float64 `json:"kWhInjected"`
+	KWhConsumed   float64 `json:"kWhConsumed"`
+	Signature     string  `json:"signature"`
+	KeyVersion    int     `json:"keyVersion"`
+	Submitter     string  `json:"submitter"`
+	SubmittedAt   string  `json:"submittedAt"`
+	Disputed      bool    `json:"disputed,omitempty"`
+	Corrected     bool    `json:"corrected,omitempty"`
+}
+
+func meterReadingKey(ctx contractapi.TransactionContextInterface, meterID, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("meterreading", []string{meterID, intervalStart})
+}
+
+func putMeterReading(ctx contractapi.TransactionContextInterface, reading *MeterReading) error {
+	readingJSON, err := json.Marshal(reading)
+	if err != nil {
+		return err
+	}
+	key, err := meterReadingKey(ctx, reading.MeterID, reading.IntervalStart)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, readingJSON)
+}
+
+// getMeterReading returns a meter's reading for an interval
+func getMeterReading(ctx contractapi.TransactionContextInterface, meterID, intervalStart string) (*MeterReading, error) {
+	intervalStart, err := normalizeTimestamp(intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	key, err := meterReadingKey(ctx, meterID, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	readingJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meter reading: %v", err)
+	}
+	if readingJSON == nil {
+		return nil, fmt.Errorf("meter %s has no reading for %s", meterID, intervalStart)
+	}
+	var reading MeterReading
+	if err := json.Unmarshal(readingJSON, &reading); err != nil {
+		return nil, err
+	}
+	return &reading, nil
+}
+
+// SubmitMeterReading records a meter's signed reading for one interval. The
+// meter must be an active device in the registry and the signature an ASN.1
+// ECDSA signature by its current device key over the SHA-256 of the
+// MeterReadingPayload JSON. Intervals must be aligned to time slots,
+// already finished at transaction time, and strictly later than the meter's
+// last accepted reading. Readings may be submitted by the meter's owner or by
+// an operator relaying them from a head-end system. Each reading updates the
+// owner's self-consumption record for the interval.
+func (e *EnergyTradingContract) SubmitMeterReading(ctx contractapi.TransactionContextInterface, meterID, intervalStart string, kWhInjected, kWhConsumed float64, signatureBase64 string) error {
+	meter, err := requireActiveDevice(ctx, meterID, DeviceMeter)
+	if err != nil {
+		return err
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	role, err := callerRole(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != meter.Owner && role != RoleOperator {
+		return fmt.Errorf("caller %s cannot submit readings for meter %s", caller, meterID)
+	}
+	if _, err := requireApprovedParticipant(ctx, meter.Owner); err != nil {
+		return err
+	}
+	if kWhInjected < 0 || kWhConsumed < 0 {
+		return fmt.Errorf("meter readings must not be negative")
+	}
+
+	intervalStart, length, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return err
+	}
+	start, err := parseTimestamp(intervalStart)
+	if err != nil {
+		return err
+	}
+	end := start.Add(length)
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	if end.After(now) {
+		return fmt.Errorf("interval starting %s has not finished at transaction time %s", intervalStart, now.Format(time.RFC3339))
+	}
+	if meter.LastIntervalStart != "" {
+		last, err := parseTimestamp(meter.LastIntervalStart)
+		if err != nil {
+			return err
+		}
+		if !start.After(last) {
+			return fmt.Errorf("interval start %s is not after the last reading %s of meter %s", intervalStart, meter.LastIntervalStart, meterID)
+		}
+	}
+
+	payload := MeterReadingPayload{
+		MeterID:       meterID,
+		IntervalStart: start.Format(time.RFC3339),
+		KWhInjected:   kWhInjected,
+		KWhConsumed:   kWhConsumed,
+	}
+	if err := verifyMeterSignature(meter, payload, signatureBase64); err != nil {
+		return err
+	}
+
+	reading := MeterReading{
+		MeterID:       meterID,
+		Owner:         meter.Owner,
+		IntervalStart: payload.IntervalStart,
+		IntervalEnd:   end.Format(time.RFC3339),
+		KWhInjected:   kWhInjected,
+		KWhConsumed:   kWhConsumed,
+		Signature:     signatureBase64,
+		KeyVersion:    meter.KeyVersion,
+		Submitter:     caller,
+		SubmittedAt:   now.Format(time.RFC3339),
+	}
+	if err := putMeterReading(ctx, &reading); err != nil {
+		return err
+	}
+	meter.LastIntervalStart = reading.IntervalStart
+	if err := putDevice(ctx, meter); err != nil {
+		return err
+	}
+	if err := recordSelfConsumption(ctx, reading.Owner, reading.IntervalStart, reading.IntervalEnd); err != nil {
+		return err
+	}
+	if err := accrueCertificates(ctx, &reading); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventMeterReadingSubmitted, reading)
+}
+
+// verifyMeterSignature checks a reading signature against the meter's device key
+func verifyMeterSignature(meter *Device, payload MeterReadingPayload, signatureBase64 string) error {
+	publicKey, err := parsePublicKey(meter.PublicKey)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(signatureBase64)
+	if err != nil {
+		return fmt.Errorf("signature is not valid base64: %v", err)
+	}
+	payloadJSON, err := canonicalJSON(payload)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(payloadJSON)
+	if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+		return fmt.Errorf("signature does not match the reading of meter %s", meter.DeviceID)
+	}
+	return nil
+}
+
+// PaginatedMeterReadingResult is a page of meter readings
+type PaginatedMeterReadingResult struct {
+	Records             []*MeterReading `json:"records"`
+	FetchedRecordsCount int32           `json:"fetchedRecordsCount"`
+	Bookmark            string          `json:"bookmark"`
+}
+
+// GetMeterReadings returns a page of a meter's readings whose intervals start
+// in the half-open window [from, to). Readings outside the window are
+// skipped, so a page may hold fewer than pageSize readings.
+func (e *EnergyTradingContract) GetMeterReadings(ctx contractapi.TransactionContextInterface, meterID, from, to string, pageSize int32, bookmark string) (*PaginatedMeterReadingResult, error) {
+	fromTime, err := parseTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	toTime, err := parseTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedMeterReadingResult{Records: []*MeterReading{}}
+	metadata, err := queryPage(ctx, "meterreading", []string{meterID}, pageSize, bookmark, func(value []byte) error {
+		var reading MeterReading
+		if err := json.Unmarshal(value, &reading); err != nil {
+			return err
+		}
+		start, err := parseTimestamp(reading.IntervalStart)
+		if err != nil {
+			return err
+		}
+		if !start.Before(fromTime) && start.Before(toTime) {
+			result.Records = append(result.Records, &reading)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// getMeterReadings returns every reading of a meter whose interval starts
+// in the half-open window [from, to)
+func getMeterReadings(ctx contractapi.TransactionContextInterface, meterID, from, to string) ([]*MeterReading, error) {
+	fromTime, err := parseTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	toTime, err := parseTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("meterreading", []string{meterID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	readings := []*MeterReading{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var reading MeterReading
+		if err := json.Unmarshal(queryResponse.Value, &reading); err != nil {
+			return nil, err
+		}
+		start, err := parseTimestamp(reading.IntervalStart)
+		if err != nil {
+			return nil, err
+		}
+		if start.Before(fromTime) || !start.Before(toTime) {
+			continue
+		}
+		readings = append(readings, &reading)
+	}
+	return readings, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// registerTestMeter enrolls the address's test meter with its device key
+func registerTestMeter(t testing.TB, e *EnergyTradingContract, tc *testContext, address string) string {
+	meterID := "meter-" + address
+	der, err := x509.MarshalPKIXPublicKey(&tc.key(meterID).PublicKey)
+	require.NoError(t, err)
+	publicKeyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	require.NoError(t, e.EnrollDevice(tc.as(address, ""), meterID, DeviceMeter, publicKeyPEM))
+	return meterID
+}
+
+// signReading returns the meter's base64 signature over a reading payload
+func (tc *testContext) signReading(t testing.TB, meterID, intervalStart string, injected, consumed float64) string {
+	payload, err := canonicalJSON(MeterReadingPayload{MeterID: meterID, IntervalStart: intervalStart, KWhInjected: injected, KWhConsumed: consumed})
+	require.NoError(t, err)
+	digest := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, tc.key(meterID), digest[:])
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestSubmitMeterReading(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+
+	err := e.EnrollDevice(tc.as("buyer1", ""), "meter-seller1", DeviceMeter, tc.publicKeyPEM(t, "buyer1"))
+	require.EqualError(t, err, "meter meter-seller1 is not registered to buyer1")
+	meterID := registerTestMeter(t, e, tc, "seller1")
+
+	const interval = "2025-05-01T07:00:00Z"
+	signature := tc.signReading(t, meterID, interval, 2.5, 0.1)
+	err = e.SubmitMeterReading(tc.as("buyer1", ""), meterID, interval, 2.5, 0.1, signature)
+	require.EqualError(t, err, "caller buyer1 cannot submit readings for meter meter-seller1")
+	tc.as("seller1", "")
+	err = e.SubmitMeterReading(tc, meterID, interval, 3, 0.1, signature)
+	require.EqualError(t, err, "signature does not match the reading of meter meter-seller1")
+	err = e.SubmitMeterReading(tc, meterID, "2025-05-01T07:05:00Z", 2.5, 0.1, signature)
+	require.EqualError(t, err, "interval start 2025-05-01T07:05:00Z is not aligned to 15m0s")
+	err = e.SubmitMeterReading(tc, meterID, "2025-05-01T08:00:00Z", 2.5, 0.1, signature)
+	require.EqualError(t, err, "interval starting 2025-05-01T08:00:00Z has not finished at transaction time 2025-05-01T08:00:00Z")
+
+	require.NoError(t, e.SubmitMeterReading(tc, meterID, interval, 2.5, 0.1, signature))
+	err = e.SubmitMeterReading(tc, meterID, interval, 2.5, 0.1, signature)
+	require.EqualError(t, err, "interval start 2025-05-01T07:00:00Z is not after the last reading 2025-05-01T07:00:00Z of meter meter-seller1")
+
+	const next = "2025-05-01T07:15:00Z"
+	require.NoError(t, e.SubmitMeterReading(tc, meterID, next, 1, 0, tc.signReading(t, meterID, next, 1, 0)))
+	readings, err := e.GetMeterReadings(tc, meterID, "2025-05-01T07:00:00Z", "2025-05-01T07:15:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, readings.Records, 1)
+	require.Equal(t, 2.5, readings.Records[0].KWhInjected)
+	require.Equal(t, "2025-05-01T07:15:00Z", readings.Records[0].IntervalEnd)
+}
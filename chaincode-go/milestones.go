@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// MilestoneEscrowAccount holds the payments buyers escrow for release in
+// delivery milestones
+const MilestoneEscrowAccount = "milestone-escrow"
+
+// Milestone escrow statuses
+const (
+	EscrowFunded = "FUNDED"
+	EscrowClosed = "CLOSED"
+)
+
+// MilestoneEscrow is a buyer's payment for a large trade held in escrow and
+// released to the seller in equal parts, one for each milestone of the
+// contracted energy the meters verify as delivered. With four milestones,
+// a quarter of the payment is released after each verified quarter of the
+// delivery. Whatever is still held when the trade settles is refunded to the
+// buyer and the settlement pays the balance.
+type MilestoneEscrow struct {
+	TokenID            string  `json:"tokenID"`
+	Buyer              string  `json:"buyer"`
+	Seller             string  `json:"seller"`
+	Milestones         int     `json:"milestones"`
+	Amount             float64 `json:"amount"`
+	Released           float64 `json:"released"`
+	MilestonesReleased int     `json:"milestonesReleased"`
+	VerifiedEnergy     float64 `json:"verifiedEnergy"`
+	Status             string  `json:"status"`
+	FundedAt           string  `json:"fundedAt"`
+	ClosedAt           string  `json:"closedAt,omitempty"`
+	Version            int64   `json:"version"`
+}
+
+func milestoneEscrowKey(ctx contractapi.TransactionContextInterface, tokenID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("milestoneescrow", []string{tokenID})
+}
+
+func putMilestoneEscrow(ctx contractapi.TransactionContextInterface, escrow *MilestoneEscrow) error {
+	escrow.Version++
+	escrowJSON, err := json.Marshal(escrow)
+	if err != nil {
+		return err
+	}
+	key, err := milestoneEscrowKey(ctx, escrow.TokenID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, escrowJSON)
+}
+
+// getMilestoneEscrow returns the milestone escrow of a trade, or nil if it has
+// none
+func getMilestoneEscrow(ctx contractapi.TransactionContextInterface, tokenID string) (*MilestoneEscrow, error) {
+	key, err := milestoneEscrowKey(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	escrowJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read milestone escrow of %s: %v", tokenID, err)
+	}
+	if escrowJSON == nil {
+		return nil, nil
+	}
+	var escrow MilestoneEscrow
+	if err := json.Unmarshal(escrowJSON, &escrow); err != nil {
+		return nil, err
+	}
+	return &escrow, nil
+}
+
+// GetMilestoneEscrow returns the milestone escrow of a trade
+func (e *EnergyTradingContract) GetMilestoneEscrow(ctx contractapi.TransactionContextInterface, tokenID string) (*MilestoneEscrow, error) {
+	escrow, err := getMilestoneEscrow(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if escrow == nil {
+		return nil, fmt.Errorf("asset %s has no milestone escrow", tokenID)
+	}
+	return escrow, nil
+}
+
+// FundMilestoneEscrow escrows the buyer's full payment for a confirmed trade
+// before its delivery starts, to be released in the given number of
+// milestones. A trade at a zero or negative price has no payment to escrow.
+func (e *EnergyTradingContract) FundMilestoneEscrow(ctx contractapi.TransactionContextInterface, tokenID string, milestones int) (*MilestoneEscrow, error) {
+	if milestones < 2 {
+		return nil, fmt.Errorf("a milestone escrow needs at least 2 milestones")
+	}
+	asset, err := e.ReadEnergyAsset(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, asset.BuyerAddress); err != nil {
+		return nil, err
+	}
+	if asset.TransactionState != StateConfirmed {
+		return nil, fmt.Errorf("asset %s cannot be escrowed in state %s", tokenID, asset.TransactionState)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.Format(time.RFC3339) >= asset.DeliveryStart {
+		return nil, fmt.Errorf("delivery of asset %s started at %s", tokenID, asset.DeliveryStart)
+	}
+	existing, err := getMilestoneEscrow(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("asset %s already has a milestone escrow", tokenID)
+	}
+	details, err := getPrivateDetails(ctx, asset)
+	if err != nil {
+		return nil, err
+	}
+	amount := scheduledEnergy(asset) * details.TransactionPrice
+	if amount <= 0 {
+		return nil, fmt.Errorf("asset %s at price %v has no payment to escrow", tokenID, details.TransactionPrice)
+	}
+	exists, err := tokenAccountExists(ctx, MilestoneEscrowAccount)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := putTokenAccount(ctx, &TokenAccount{AccountID: MilestoneEscrowAccount}); err != nil {
+			return nil, err
+		}
+	}
+	escrow := &MilestoneEscrow{
+		TokenID:    tokenID,
+		Buyer:      asset.BuyerAddress,
+		Seller:     asset.SellerAddress,
+		Milestones: milestones,
+		Amount:     amount,
+		Status:     EscrowFunded,
+		FundedAt:   now.Format(time.RFC3339),
+	}
+	if err := transferTokens(ctx, asset.BuyerAddress, MilestoneEscrowAccount, escrow.Amount); err != nil {
+		return nil, fmt.Errorf("failed to fund milestone escrow of asset %s: %v", tokenID, err)
+	}
+	if err := putMilestoneEscrow(ctx, escrow); err != nil {
+		return nil, err
+	}
+	return escrow, emitEvent(ctx, EventMilestoneEscrowChanged, escrow)
+}
+
+// closeMilestoneEscrow refunds what is still held in escrow to the buyer
+func closeMilestoneEscrow(ctx contractapi.TransactionContextInterface, escrow *MilestoneEscrow, closedAt string) error {
+	if refund := escrow.Amount - escrow.Released; refund > 0 {
+		if err := transferTokens(ctx, MilestoneEscrowAccount, escrow.Buyer, refund); err != nil {
+			return fmt.Errorf("failed to refund milestone escrow of asset %s: %v", escrow.TokenID, err)
+		}
+	}
+	escrow.Status = EscrowClosed
+	escrow.ClosedAt = closedAt
+	return putMilestoneEscrow(ctx, escrow)
+}
+
+// ReleaseMilestones releases to the seller the payment for every milestone
+// the meters have verified since the last release. Delivered energy is
+// measured as at settlement over the time slots of the delivery window that
+// have ended. If the trade was cancelled, the escrow is refunded to the
+// buyer instead.
+func (e *EnergyTradingContract) ReleaseMilestones(ctx contractapi.TransactionContextInterface, tokenID string) (*MilestoneEscrow, error) {
+	asset, err := e.ReadEnergyAsset(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	role, err := callerRole(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if role != RoleOperator {
+		if _, err := requireParty(ctx, asset.BuyerAddress, asset.SellerAddress); err != nil {
+			return nil, err
+		}
+	}
+	escrow, err := e.GetMilestoneEscrow(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if escrow.Status != EscrowFunded {
+		return nil, fmt.Errorf("milestone escrow of asset %s is %s", tokenID, escrow.Status)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if asset.TransactionState == StateCancelled {
+		if err := closeMilestoneEscrow(ctx, escrow, now.Format(time.RFC3339)); err != nil {
+			return nil, err
+		}
+		return escrow, emitEvent(ctx, EventMilestoneEscrowChanged, escrow)
+	}
+
+	length, err := slotLength(ctx)
+	if err != nil {
+		return nil, err
+	}
+	upTo := now.Truncate(length).Format(time.RFC3339)
+	if upTo > asset.DeliveryEnd {
+		upTo = asset.DeliveryEnd
+	}
+	if upTo <= asset.DeliveryStart {
+		return nil, fmt.Errorf("delivery of asset %s has not started", tokenID)
+	}
+	injected, _, _, err := meteredEnergy(ctx, asset.SellerAddress, asset.DeliveryStart, upTo)
+	if err != nil {
+		return nil, err
+	}
+	_, consumed, _, err := meteredEnergy(ctx, asset.BuyerAddress, asset.DeliveryStart, upTo)
+	if err != nil {
+		return nil, err
+	}
+	contracted := scheduledEnergy(asset)
+	escrow.VerifiedEnergy = math.Min(contracted, math.Min(injected, consumed/(1-asset.LossFactor)))
+	// The tolerance keeps rounding from holding back a milestone delivered in full
+	reached := int(math.Floor(escrow.VerifiedEnergy/contracted*float64(escrow.Milestones) + 1e-9))
+	if reached <= escrow.MilestonesReleased {
+		return nil, fmt.Errorf("asset %s has no newly verified milestone: %g of %g kWh delivered", tokenID, escrow.VerifiedEnergy, contracted)
+	}
+	amount := escrow.Amount * float64(reached-escrow.MilestonesReleased) / float64(escrow.Milestones)
+	if err := transferTokens(ctx, MilestoneEscrowAccount, escrow.Seller, amount); err != nil {
+		return nil, fmt.Errorf("failed to release milestones of asset %s: %v", tokenID, err)
+	}
+	escrow.Released += amount
+	escrow.MilestonesReleased = reached
+	if err := putMilestoneEscrow(ctx, escrow); err != nil {
+		return nil, err
+	}
+	return escrow, emitEvent(ctx, EventMilestoneEscrowChanged, escrow)
+}
+
+// settleMilestoneEscrow closes the milestone escrow of a trade being settled
+// and returns how much of the payment it already released to the seller
+func settleMilestoneEscrow(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, settledAt string) (float64, error) {
+	escrow, err := getMilestoneEscrow(ctx, asset.TokenID)
+	if err != nil || escrow == nil || escrow.Status != EscrowFunded {
+		return 0, err
+	}
+	if err := closeMilestoneEscrow(ctx, escrow, settledAt); err != nil {
+		return 0, err
+	}
+	return escrow.Released, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// submitTestInterval submits one meter reading of a party for a slot
+func submitTestInterval(t *testing.T, e *EnergyTradingContract, tc *testContext, address, intervalStart string, injected, consumed float64) {
+	meterID := "meter-" + address
+	signature := tc.signReading(t, meterID, intervalStart, injected, consumed)
+	require.NoError(t, e.SubmitMeterReading(tc.as(address, ""), meterID, intervalStart, injected, consumed, signature))
+}
+
+func TestMilestoneEscrow(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	_, err := e.FundMilestoneEscrow(tc.as("seller1", ""), "energy1", 4)
+	require.EqualError(t, err, "caller seller1 is not authorized to act for buyer1")
+	escrow, err := e.FundMilestoneEscrow(tc.as("buyer1", ""), "energy1", 4)
+	require.NoError(t, err)
+	require.InDelta(t, 2.0, escrow.Amount, 1e-9)
+	_, err = e.FundMilestoneEscrow(tc, "energy1", 4)
+	require.EqualError(t, err, "asset energy1 already has a milestone escrow")
+
+	// Half of the energy is verified after two slots, releasing two quarters
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 10, 0, 0, 0, time.UTC)), nil)
+	_, err = e.ReleaseMilestones(tc, "energy1")
+	require.EqualError(t, err, "delivery of asset energy1 has not started")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 10, 30, 0, 0, time.UTC)), nil)
+	for _, interval := range []string{"2025-05-03T10:00:00Z", "2025-05-03T10:15:00Z"} {
+		submitTestInterval(t, e, tc, "seller1", interval, 2.5, 0)
+		submitTestInterval(t, e, tc, "buyer1", interval, 0, 2.5)
+	}
+	escrow, err = e.ReleaseMilestones(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+	require.Equal(t, 2, escrow.MilestonesReleased)
+	require.InDelta(t, 1.0, escrow.Released, 1e-9)
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventMilestoneEscrowChanged, name)
+	_, err = e.ReleaseMilestones(tc, "energy1")
+	require.EqualError(t, err, "asset energy1 has no newly verified milestone: 5 of 10 kWh delivered")
+	seller, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 2.0, seller.Balance, 1e-9)
+
+	// The seller falls short afterwards: settlement refunds the unreleased
+	// half and the seller repays what the milestones overpaid
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	for _, interval := range []string{"2025-05-03T10:30:00Z", "2025-05-03T10:45:00Z"} {
+		submitTestInterval(t, e, tc, "seller1", interval, 0.5, 0)
+		submitTestInterval(t, e, tc, "buyer1", interval, 0, 2.5)
+	}
+	settlement, err := e.ReconcileDelivery(tc, "energy1")
+	require.NoError(t, err)
+	require.InDelta(t, 1.2, settlement.Payment, 1e-9)
+	require.InDelta(t, 1.0, settlement.EscrowReleased, 1e-9)
+	escrow, err = e.GetMilestoneEscrow(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, EscrowClosed, escrow.Status)
+	account, err := e.ReadTokenAccount(tc, MilestoneEscrowAccount)
+	require.NoError(t, err)
+	require.InDelta(t, 0.0, account.Balance, 1e-9)
+	// 2 after the milestones, less 0.8 repaid and 0.8 for a grid imbalance of 4 kWh
+	seller, err = e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 0.4, seller.Balance, 1e-9)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// EnergyTokenID is the multi-token ID of the fungible energy token. Every
+// other token ID is a certificate ID, a non-fungible token with a supply of
+// one.
+const EnergyTokenID = "ENERGY"
+
+// multiTokenURIKey is the state key of the token metadata URI template
+const multiTokenURIKey = "multitokenuri"
+
+// TransferSingle is the payload of the TransferSingle event, mirroring
+// ERC-1155. Amounts of certificates are always 1.
+type TransferSingle struct {
+	Operator string  `json:"operator"`
+	From     string  `json:"from"`
+	To       string  `json:"to"`
+	ID       string  `json:"id"`
+	Amount   float64 `json:"amount"`
+}
+
+// TransferBatch is the payload of the TransferBatch event
+type TransferBatch struct {
+	Operator string    `json:"operator"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	IDs      []string  `json:"ids"`
+	Amounts  []float64 `json:"amounts"`
+}
+
+// ApprovalForAll is the payload of the ApprovalForAll event
+type ApprovalForAll struct {
+	Owner    string `json:"owner"`
+	Operator string `json:"operator"`
+	Approved bool   `json:"approved"`
+}
+
+// TokenMetadataURI is the URI template of token metadata. Clients substitute
+// the token ID for {id}, as in ERC-1155.
+type TokenMetadataURI struct {
+	URI       string `json:"uri"`
+	UpdatedBy string `json:"updatedBy"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+func multiTokenApprovalKey(ctx contractapi.TransactionContextInterface, owner, operator string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("multitokenapproval", []string{owner, operator})
+}
+
+// BalanceOf returns an account's balance of a token: its energy token
+// balance, or 1 if it holds the active certificate with the given ID
+func (e *EnergyTradingContract) BalanceOf(ctx contractapi.TransactionContextInterface, account, id string) (float64, error) {
+	if id == EnergyTokenID {
+		tokenAccount, err := getTokenAccount(ctx, account)
+		if err != nil || tokenAccount == nil {
+			return 0, err
+		}
+		return tokenAccount.Balance, nil
+	}
+	certificate, err := e.GetCertificate(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if certificate.Owner != account || certificate.Status != CertificateActive {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// BalanceOfBatch returns the balance of each account for the token ID at the
+// same position. A batch holds at most the maximum page size of queries.
+func (e *EnergyTradingContract) BalanceOfBatch(ctx contractapi.TransactionContextInterface, accounts, ids []string) ([]float64, error) {
+	if len(accounts) != len(ids) {
+		return nil, fmt.Errorf("accounts and ids must have the same length")
+	}
+	limits, err := e.GetQueryLimits(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > int(limits.MaxPageSize) {
+		return nil, fmt.Errorf("batch may hold at most %d balances", limits.MaxPageSize)
+	}
+	balances := make([]float64, len(ids))
+	for i := range ids {
+		balance, err := e.BalanceOf(ctx, accounts[i], ids[i])
+		if err != nil {
+			return nil, err
+		}
+		balances[i] = balance
+	}
+	return balances, nil
+}
+
+// SetApprovalForAll allows or stops an operator transferring all of the
+// caller's tokens
+func (e *EnergyTradingContract) SetApprovalForAll(ctx contractapi.TransactionContextInterface, operator string, approved bool) error {
+	owner, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	if operator == owner {
+		return fmt.Errorf("cannot set approval for the caller")
+	}
+	key, err := multiTokenApprovalKey(ctx, owner, operator)
+	if err != nil {
+		return err
+	}
+	if approved {
+		err = ctx.GetStub().PutState(key, []byte(operator))
+	} else {
+		err = ctx.GetStub().DelState(key)
+	}
+	if err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventApprovalForAll, ApprovalForAll{Owner: owner, Operator: operator, Approved: approved})
+}
+
+// IsApprovedForAll reports whether an operator may transfer all of an
+// owner's tokens
+func (e *EnergyTradingContract) IsApprovedForAll(ctx contractapi.TransactionContextInterface, owner, operator string) (bool, error) {
+	key, err := multiTokenApprovalKey(ctx, owner, operator)
+	if err != nil {
+		return false, err
+	}
+	approval, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read approval: %v", err)
+	}
+	return approval != nil, nil
+}
+
+// requireTransferAuthority returns the caller if it is the owner of the
+// tokens or an operator the owner approved
+func (e *EnergyTradingContract) requireTransferAuthority(ctx contractapi.TransactionContextInterface, from string) (string, error) {
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return "", err
+	}
+	if caller == from {
+		return caller, nil
+	}
+	approved, err := e.IsApprovedForAll(ctx, from, caller)
+	if err != nil {
+		return "", err
+	}
+	if !approved {
+		return "", fmt.Errorf("caller %s is not approved to transfer tokens of %s", caller, from)
+	}
+	return caller, nil
+}
+
+// multiTokenTransfer moves an amount of one token between accounts
+func (e *EnergyTradingContract) multiTokenTransfer(ctx contractapi.TransactionContextInterface, from, to, id string, amount float64) error {
+	if id == EnergyTokenID {
+		return transferTokens(ctx, from, to, amount)
+	}
+	if amount != 1 {
+		return fmt.Errorf("amount of certificate %s must be 1", id)
+	}
+	certificate, err := e.GetCertificate(ctx, id)
+	if err != nil {
+		return err
+	}
+	if certificate.Owner != from {
+		return fmt.Errorf("certificate %s is not owned by %s", id, from)
+	}
+	return transferCertificate(ctx, certificate, to)
+}
+
+// SafeTransferFrom transfers an amount of a token from an account the caller
+// owns or is approved for
+func (e *EnergyTradingContract) SafeTransferFrom(ctx contractapi.TransactionContextInterface, from, to, id string, amount float64) error {
+	operator, err := e.requireTransferAuthority(ctx, from)
+	if err != nil {
+		return err
+	}
+	if err := e.multiTokenTransfer(ctx, from, to, id, amount); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventTransferSingle, TransferSingle{Operator: operator, From: from, To: to, ID: id, Amount: amount})
+}
+
+// SafeBatchTransferFrom transfers several tokens in one transaction. Either
+// all transfers succeed or none do; the error names the first transfer that
+// was rejected. A batch holds at most the batch limit of transfers.
+func (e *EnergyTradingContract) SafeBatchTransferFrom(ctx contractapi.TransactionContextInterface, from, to string, ids []string, amounts []float64) error {
+	if len(ids) != len(amounts) {
+		return fmt.Errorf("ids and amounts must have the same length")
+	}
+	if err := checkBatchSize(ctx, len(ids), "transfers"); err != nil {
+		return err
+	}
+	operator, err := e.requireTransferAuthority(ctx, from)
+	if err != nil {
+		return err
+	}
+	for i := range ids {
+		if err := e.multiTokenTransfer(ctx, from, to, ids[i], amounts[i]); err != nil {
+			return fmt.Errorf("transfer %d of %d (%s) rejected: %v", i+1, len(ids), ids[i], err)
+		}
+	}
+	return emitEvent(ctx, EventTransferBatch, TransferBatch{Operator: operator, From: from, To: to, IDs: ids, Amounts: amounts})
+}
+
+// SetTokenURI sets the metadata URI template, such as
+// https://example.org/tokens/{id}.json
+func (e *EnergyTradingContract) SetTokenURI(ctx contractapi.TransactionContextInterface, uri string) error {
+	if !strings.Contains(uri, "{id}") {
+		return fmt.Errorf("token URI must contain the {id} placeholder")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	metadataJSON, err := json.Marshal(TokenMetadataURI{URI: uri, UpdatedBy: caller, UpdatedAt: now})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(multiTokenURIKey, metadataJSON)
+}
+
+// URI returns the metadata URI template of a token. As in ERC-1155 the {id}
+// placeholder is returned unsubstituted.
+func (e *EnergyTradingContract) URI(ctx contractapi.TransactionContextInterface, id string) (string, error) {
+	if id != EnergyTokenID {
+		if _, err := e.GetCertificate(ctx, id); err != nil {
+			return "", err
+		}
+	}
+	metadataJSON, err := ctx.GetStub().GetState(multiTokenURIKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token URI: %v", err)
+	}
+	if metadataJSON == nil {
+		return "", fmt.Errorf("token URI has not been set")
+	}
+	var metadata TokenMetadataURI
+	if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+		return "", err
+	}
+	return metadata.URI, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestMultiTokenInterface(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "aggregator1", RoleAggregator)
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "seller1", 10))
+	require.NoError(t, e.MintTokens(tc, "buyer1", 1))
+	require.NoError(t, e.SetCertificateEnergy(tc, 1))
+	_, err := e.RegisterGenerator(tc.as("seller1", ""), meterID, "solar", 5)
+	require.NoError(t, err)
+	_, err = e.VerifyGenerator(tc.as("operator1", RoleOperator), meterID)
+	require.NoError(t, err)
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 0, 0, 0, time.UTC)), nil)
+	signature := tc.signReading(t, meterID, "2025-05-03T10:00:00Z", 2, 0)
+	require.NoError(t, e.SubmitMeterReading(tc.as("seller1", ""), meterID, "2025-05-03T10:00:00Z", 2, 0, signature))
+
+	balances, err := e.BalanceOfBatch(tc, []string{"seller1", "seller1", "buyer1"}, []string{EnergyTokenID, meterID + "-1", meterID + "-1"})
+	require.NoError(t, err)
+	require.Equal(t, []float64{10, 1, 0}, balances)
+
+	// An approved operator can move both kinds of token in one batch
+	err = e.SafeBatchTransferFrom(tc.as("aggregator1", ""), "seller1", "buyer1", []string{EnergyTokenID}, []float64{3})
+	require.EqualError(t, err, "caller aggregator1 is not approved to transfer tokens of seller1")
+	require.NoError(t, e.SetApprovalForAll(tc.as("seller1", ""), "aggregator1", true))
+	approved, err := e.IsApprovedForAll(tc, "seller1", "aggregator1")
+	require.NoError(t, err)
+	require.True(t, approved)
+	err = e.SafeBatchTransferFrom(tc.as("aggregator1", ""), "seller1", "buyer1", []string{meterID + "-1"}, []float64{2})
+	require.EqualError(t, err, "transfer 1 of 1 ("+meterID+"-1) rejected: amount of certificate "+meterID+"-1 must be 1")
+	err = e.SafeBatchTransferFrom(tc, "seller1", "buyer1", []string{EnergyTokenID, meterID + "-1", meterID + "-2"}, []float64{3, 1, 1})
+	require.NoError(t, err)
+	balances, err = e.BalanceOfBatch(tc, []string{"seller1", "buyer1", "buyer1"}, []string{EnergyTokenID, EnergyTokenID, meterID + "-2"})
+	require.NoError(t, err)
+	require.Equal(t, []float64{7, 4, 1}, balances)
+
+	// Revoking the approval stops the operator
+	require.NoError(t, e.SetApprovalForAll(tc.as("seller1", ""), "aggregator1", false))
+	err = e.SafeTransferFrom(tc.as("aggregator1", ""), "seller1", "buyer1", EnergyTokenID, 1)
+	require.Error(t, err)
+	require.NoError(t, e.SafeTransferFrom(tc.as("buyer1", ""), "buyer1", "seller1", meterID+"-1", 1))
+
+	_, err = e.URI(tc, EnergyTokenID)
+	require.EqualError(t, err, "token URI has not been set")
+	require.EqualError(t, e.SetTokenURI(tc.as("admin1", RoleAdmin), "https://example.org/tokens"), "token URI must contain the {id} placeholder")
+	require.NoError(t, e.SetTokenURI(tc, "https://example.org/tokens/{id}.json"))
+	uri, err := e.URI(tc, meterID+"-1")
+	require.NoError(t, err)
+	require.Equal(t, "https://example.org/tokens/{id}.json", uri)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// nettingConfigKey is the state key of the netting configuration
+const nettingConfigKey = "nettingconfig"
+
+// NettingConfig records whether trades settle through netting. While it is
+// enabled, ReconcileDelivery does not transfer the net amount between buyer
+// and seller but records it as an obligation in the time slot of the trade's
+// delivery start, to be cleared by NetSettlement.
+type NettingConfig struct {
+	Enabled   bool   `json:"enabled"`
+	UpdatedBy string `json:"updatedBy,omitempty"`
+	UpdatedAt string `json:"updatedAt,omitempty"`
+}
+
+// NetObligation is the amount one party of a settled trade owes the other,
+// awaiting netting. NettingTxID is set once it has been cleared.
+type NetObligation struct {
+	IntervalStart string  `json:"intervalStart"`
+	TokenID       string  `json:"tokenID"`
+	Payer         string  `json:"payer"`
+	Payee         string  `json:"payee"`
+	Amount        float64 `json:"amount"`
+	NettingTxID   string  `json:"nettingTxID,omitempty"`
+}
+
+// NetTransfer is one token transfer executed by a netting run
+type NetTransfer struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+}
+
+// NettingRun records the obligations of a time slot cleared in one
+// transaction and the transfers that replaced them
+type NettingRun struct {
+	IntervalStart string             `json:"intervalStart"`
+	Multilateral  bool               `json:"multilateral"`
+	TokenIDs      []string           `json:"tokenIDs"`
+	GrossVolume   float64            `json:"grossVolume"`
+	Positions     map[string]float64 `json:"positions"`
+	Transfers     []*NetTransfer     `json:"transfers"`
+	NetVolume     float64            `json:"netVolume"`
+	NettedBy      string             `json:"nettedBy"`
+	NettedAt      string             `json:"nettedAt"`
+	TxID          string             `json:"txID"`
+}
+
+func netObligationKey(ctx contractapi.TransactionContextInterface, intervalStart, tokenID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("netobligation", []string{intervalStart, tokenID})
+}
+
+func nettingRunKey(ctx contractapi.TransactionContextInterface, intervalStart, txID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("nettingrun", []string{intervalStart, txID})
+}
+
+// SetNettingEnabled turns netting of trade settlements on or off. Obligations
+// already recorded stay pending until they are netted.
+func (e *EnergyTradingContract) SetNettingEnabled(ctx contractapi.TransactionContextInterface, enabled bool) (*NettingConfig, error) {
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config := &NettingConfig{Enabled: enabled, UpdatedBy: caller, UpdatedAt: now}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(nettingConfigKey, configJSON); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// GetNettingConfig returns the netting configuration in force
+func (e *EnergyTradingContract) GetNettingConfig(ctx contractapi.TransactionContextInterface) (*NettingConfig, error) {
+	configJSON, err := ctx.GetStub().GetState(nettingConfigKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read netting config: %v", err)
+	}
+	if configJSON == nil {
+		return &NettingConfig{}, nil
+	}
+	var config NettingConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func putNetObligation(ctx contractapi.TransactionContextInterface, obligation *NetObligation) error {
+	obligationJSON, err := json.Marshal(obligation)
+	if err != nil {
+		return err
+	}
+	key, err := netObligationKey(ctx, obligation.IntervalStart, obligation.TokenID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, obligationJSON)
+}
+
+// settleNet pays the net amount of a trade from buyer to seller, or from
+// seller to buyer when negative. While netting is enabled it records the
+// amount as an obligation instead and reports that it was deferred.
+func settleNet(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, net float64) (bool, error) {
+	config, err := (&EnergyTradingContract{}).GetNettingConfig(ctx)
+	if err != nil {
+		return false, err
+	}
+	payer, payee := asset.BuyerAddress, asset.SellerAddress
+	if net < 0 {
+		payer, payee, net = payee, payer, -net
+	}
+	if net == 0 {
+		return false, nil
+	}
+	if !config.Enabled {
+		return false, transferTokens(ctx, payer, payee, net)
+	}
+	start, err := parseTimestamp(asset.DeliveryStart)
+	if err != nil {
+		return false, err
+	}
+	length, err := slotLength(ctx)
+	if err != nil {
+		return false, err
+	}
+	return true, putNetObligation(ctx, &NetObligation{
+		IntervalStart: start.Truncate(length).Format(time.RFC3339),
+		TokenID:       asset.TokenID,
+		Payer:         payer,
+		Payee:         payee,
+		Amount:        net,
+	})
+}
+
+// PaginatedNetObligationResult is a page of net obligations
+type PaginatedNetObligationResult struct {
+	Records             []*NetObligation `json:"records"`
+	FetchedRecordsCount int32            `json:"fetchedRecordsCount"`
+	Bookmark            string           `json:"bookmark"`
+}
+
+// GetNetObligations returns a page of the obligations recorded in a time
+// slot, both pending and netted
+func (e *EnergyTradingContract) GetNetObligations(ctx contractapi.TransactionContextInterface, intervalStart string, pageSize int32, bookmark string) (*PaginatedNetObligationResult, error) {
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedNetObligationResult{Records: []*NetObligation{}}
+	metadata, err := queryPage(ctx, "netobligation", []string{intervalStart}, pageSize, bookmark, func(value []byte) error {
+		var obligation NetObligation
+		if err := json.Unmarshal(value, &obligation); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &obligation)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// getNetObligations returns all the obligations recorded in a time slot
+func getNetObligations(ctx contractapi.TransactionContextInterface, intervalStart string) ([]*NetObligation, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("netobligation", []string{intervalStart})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	obligations := []*NetObligation{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var obligation NetObligation
+		if err := json.Unmarshal(queryResponse.Value, &obligation); err != nil {
+			return nil, err
+		}
+		obligations = append(obligations, &obligation)
+	}
+	return obligations, nil
+}
+
+// bilateralTransfers nets the obligations between each pair of participants
+// into at most one transfer per pair
+func bilateralTransfers(obligations []*NetObligation) []*NetTransfer {
+	owed := map[[2]string]float64{}
+	for _, obligation := range obligations {
+		if obligation.Payer < obligation.Payee {
+			owed[[2]string{obligation.Payer, obligation.Payee}] += obligation.Amount
+		} else {
+			owed[[2]string{obligation.Payee, obligation.Payer}] -= obligation.Amount
+		}
+	}
+	pairs := make([][2]string, 0, len(owed))
+	for pair := range owed {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i][0] < pairs[j][0] || pairs[i][0] == pairs[j][0] && pairs[i][1] < pairs[j][1]
+	})
+	transfers := []*NetTransfer{}
+	for _, pair := range pairs {
+		amount := owed[pair]
+		if amount > 0 {
+			transfers = append(transfers, &NetTransfer{From: pair[0], To: pair[1], Amount: amount})
+		} else if amount < 0 {
+			transfers = append(transfers, &NetTransfer{From: pair[1], To: pair[0], Amount: -amount})
+		}
+	}
+	return transfers
+}
+
+// multilateralTransfers settles net positions by repeatedly paying the
+// largest creditor from the largest debtor, which takes fewer transfers than
+// there are participants with a position
+func multilateralTransfers(positions map[string]float64) []*NetTransfer {
+	type position struct {
+		address string
+		amount  float64
+	}
+	var debtors, creditors []*position
+	for address, amount := range positions {
+		if amount < 0 {
+			debtors = append(debtors, &position{address, -amount})
+		} else if amount > 0 {
+			creditors = append(creditors, &position{address, amount})
+		}
+	}
+	byAmount := func(positions []*position) {
+		sort.Slice(positions, func(i, j int) bool {
+			if positions[i].amount != positions[j].amount {
+				return positions[i].amount > positions[j].amount
+			}
+			return positions[i].address < positions[j].address
+		})
+	}
+	byAmount(debtors)
+	byAmount(creditors)
+
+	transfers := []*NetTransfer{}
+	for i, j := 0, 0; i < len(debtors) && j < len(creditors); {
+		amount := math.Min(debtors[i].amount, creditors[j].amount)
+		transfers = append(transfers, &NetTransfer{From: debtors[i].address, To: creditors[j].address, Amount: amount})
+		debtors[i].amount -= amount
+		creditors[j].amount -= amount
+		if debtors[i].amount <= 1e-9 {
+			i++
+		}
+		if creditors[j].amount <= 1e-9 {
+			j++
+		}
+	}
+	return transfers
+}
+
+// NetSettlement clears the pending obligations of a time slot. Bilateral
+// netting replaces the obligations between each pair of participants with a
+// single transfer; multilateral netting computes each participant's net
+// position across all its counterparties and settles the positions with a
+// minimal set of transfers. Every transfer must clear for the run to commit.
+func (e *EnergyTradingContract) NetSettlement(ctx contractapi.TransactionContextInterface, intervalStart string, multilateral bool) (*NettingRun, error) {
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	obligations, err := getNetObligations(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	txID := ctx.GetStub().GetTxID()
+
+	run := &NettingRun{
+		IntervalStart: intervalStart,
+		Multilateral:  multilateral,
+		TokenIDs:      []string{},
+		Positions:     map[string]float64{},
+		NettedBy:      caller,
+		NettedAt:      now,
+		TxID:          txID,
+	}
+	pending := []*NetObligation{}
+	for _, obligation := range obligations {
+		if obligation.NettingTxID != "" {
+			continue
+		}
+		pending = append(pending, obligation)
+		run.TokenIDs = append(run.TokenIDs, obligation.TokenID)
+		run.GrossVolume += obligation.Amount
+		run.Positions[obligation.Payer] -= obligation.Amount
+		run.Positions[obligation.Payee] += obligation.Amount
+	}
+	if len(pending) == 0 {
+		return nil, fmt.Errorf("no pending obligations to net in interval %s", intervalStart)
+	}
+	if err := checkBatchSize(ctx, len(pending), "obligations"); err != nil {
+		return nil, err
+	}
+
+	if multilateral {
+		run.Transfers = multilateralTransfers(run.Positions)
+	} else {
+		run.Transfers = bilateralTransfers(pending)
+	}
+	for _, transfer := range run.Transfers {
+		if err := transferTokens(ctx, transfer.From, transfer.To, transfer.Amount); err != nil {
+			return nil, fmt.Errorf("failed to net %g from %s to %s: %v", transfer.Amount, transfer.From, transfer.To, err)
+		}
+		run.NetVolume += transfer.Amount
+	}
+	for _, obligation := range pending {
+		obligation.NettingTxID = txID
+		if err := putNetObligation(ctx, obligation); err != nil {
+			return nil, err
+		}
+	}
+
+	runJSON, err := json.Marshal(run)
+	if err != nil {
+		return nil, err
+	}
+	key, err := nettingRunKey(ctx, intervalStart, txID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, runJSON); err != nil {
+		return nil, err
+	}
+	txLog(ctx).Infof("netted %d obligations of %s: %g gross in %d transfers of %g", len(pending), intervalStart, run.GrossVolume, len(run.Transfers), run.NetVolume)
+	return run, emitEvent(ctx, EventNettingCompleted, run)
+}
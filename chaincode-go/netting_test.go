@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestNetSettlementMultilateral(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestParticipant(t, e, tc, "carol", RoleConsumer)
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	require.NoError(t, e.MintTokens(tc, "carol", 1))
+	_, err := e.SetNettingEnabled(tc, true)
+	require.NoError(t, err)
+
+	// The net amount of 1 owed by the buyer is deferred to netting
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	settlement, err := e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+	require.True(t, settlement.Netted)
+	seller, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 0.6, seller.Balance, 1e-9)
+
+	require.NoError(t, putNetObligation(tc, &NetObligation{IntervalStart: "2025-05-03T10:00:00Z", TokenID: "energy2", Payer: "seller1", Payee: "carol", Amount: 1}))
+	require.NoError(t, putNetObligation(tc, &NetObligation{IntervalStart: "2025-05-03T10:00:00Z", TokenID: "energy3", Payer: "carol", Payee: "buyer1", Amount: 0.5}))
+	obligations, err := e.GetNetObligations(tc, "2025-05-03T10:00:00Z", 2, "")
+	require.NoError(t, err)
+	require.Len(t, obligations.Records, 2)
+	require.Equal(t, &NetObligation{IntervalStart: "2025-05-03T10:00:00Z", TokenID: "energy1", Payer: "buyer1", Payee: "seller1", Amount: 1}, obligations.Records[0])
+	obligations, err = e.GetNetObligations(tc, "2025-05-03T10:00:00Z", 2, obligations.Bookmark)
+	require.NoError(t, err)
+	require.Len(t, obligations.Records, 1)
+
+	// Seller1 nets to zero, so one transfer replaces three
+	tc.stub.GetTxIDReturns("tx-net1")
+	run, err := e.NetSettlement(tc.as("operator1", RoleOperator), "2025-05-03T10:00:00Z", true)
+	require.NoError(t, err)
+	require.Equal(t, 2.5, run.GrossVolume)
+	require.Equal(t, []*NetTransfer{{From: "buyer1", To: "carol", Amount: 0.5}}, run.Transfers)
+	require.Equal(t, 0.0, run.Positions["seller1"])
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventNettingCompleted, name)
+
+	buyer, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 9.084, buyer.Balance, 1e-9)
+	carol, err := e.ReadTokenAccount(tc, "carol")
+	require.NoError(t, err)
+	require.InDelta(t, 1.5, carol.Balance, 1e-9)
+	obligations, err = e.GetNetObligations(tc, "2025-05-03T10:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Equal(t, "tx-net1", obligations.Records[2].NettingTxID)
+
+	_, err = e.NetSettlement(tc, "2025-05-03T10:00:00Z", true)
+	require.EqualError(t, err, "no pending obligations to net in interval 2025-05-03T10:00:00Z")
+	_, err = e.NetSettlement(tc, "2025-05-03T10:05:00Z", true)
+	require.EqualError(t, err, "interval start 2025-05-03T10:05:00Z is not aligned to 15m0s")
+}
+
+func TestBilateralTransfers(t *testing.T) {
+	transfers := bilateralTransfers([]*NetObligation{
+		{Payer: "buyer1", Payee: "seller1", Amount: 3},
+		{Payer: "seller1", Payee: "buyer1", Amount: 1},
+		{Payer: "seller1", Payee: "carol", Amount: 2},
+		{Payer: "carol", Payee: "seller1", Amount: 2},
+		{Payer: "carol", Payee: "buyer1", Amount: 0.5},
+	})
+	require.Equal(t, []*NetTransfer{
+		{From: "carol", To: "buyer1", Amount: 0.5},
+		{From: "buyer1", To: "seller1", Amount: 2},
+	}, transfers)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// NetworkTariff is the network usage fee, in tokens per kWh, for energy
+// traded between two zones. The grid operator sets it to reflect the
+// electrical distance between the zones, so the fee matrix is symmetric and
+// the diagonal holds the fee for trades within a zone. Zone pairs without a
+// tariff are charged nothing.
+type NetworkTariff struct {
+	ZoneA     string  `json:"zoneA"`
+	ZoneB     string  `json:"zoneB"`
+	FeePerKWh float64 `json:"feePerKWh"`
+	Operator  string  `json:"operator"`
+	UpdatedAt string  `json:"updatedAt"`
+}
+
+// networkTariffKey orders the zones so that both directions share one entry
+func networkTariffKey(ctx contractapi.TransactionContextInterface, zoneA, zoneB string) (string, error) {
+	if zoneB < zoneA {
+		zoneA, zoneB = zoneB, zoneA
+	}
+	return ctx.GetStub().CreateCompositeKey("networktariff", []string{zoneA, zoneB})
+}
+
+// SetNetworkTariff sets the network usage fee between two zones. The fee of a
+// trade is fixed when the trade is confirmed, so a change only applies to
+// trades confirmed afterwards.
+func (e *EnergyTradingContract) SetNetworkTariff(ctx contractapi.TransactionContextInterface, zoneA, zoneB string, feePerKWh float64) error {
+	if zoneA == "" || zoneB == "" {
+		return fmt.Errorf("zone must not be empty")
+	}
+	if feePerKWh < 0 {
+		return fmt.Errorf("network fee must not be negative")
+	}
+	if zoneB < zoneA {
+		zoneA, zoneB = zoneB, zoneA
+	}
+	operator, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	tariff := NetworkTariff{
+		ZoneA:     zoneA,
+		ZoneB:     zoneB,
+		FeePerKWh: feePerKWh,
+		Operator:  operator,
+		UpdatedAt: now,
+	}
+	tariffJSON, err := json.Marshal(tariff)
+	if err != nil {
+		return err
+	}
+	key, err := networkTariffKey(ctx, zoneA, zoneB)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, tariffJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventNetworkTariffSet, tariff)
+}
+
+// GetNetworkTariff returns the network usage fee between two zones
+func (e *EnergyTradingContract) GetNetworkTariff(ctx contractapi.TransactionContextInterface, zoneA, zoneB string) (*NetworkTariff, error) {
+	tariff, err := getNetworkTariff(ctx, zoneA, zoneB)
+	if err != nil {
+		return nil, err
+	}
+	if tariff == nil {
+		return nil, fmt.Errorf("no network tariff is set between %s and %s", zoneA, zoneB)
+	}
+	return tariff, nil
+}
+
+// getNetworkTariff returns the tariff between two zones, or nil if none is set
+func getNetworkTariff(ctx contractapi.TransactionContextInterface, zoneA, zoneB string) (*NetworkTariff, error) {
+	key, err := networkTariffKey(ctx, zoneA, zoneB)
+	if err != nil {
+		return nil, err
+	}
+	tariffJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network tariff: %v", err)
+	}
+	if tariffJSON == nil {
+		return nil, nil
+	}
+	var tariff NetworkTariff
+	if err := json.Unmarshal(tariffJSON, &tariff); err != nil {
+		return nil, err
+	}
+	return &tariff, nil
+}
+
+// networkFeeRate returns the fee per kWh between the zones of a trade's parties
+func networkFeeRate(ctx contractapi.TransactionContextInterface, asset *EnergyAsset) (float64, error) {
+	seller, err := getParticipant(ctx, asset.SellerAddress)
+	if err != nil {
+		return 0, err
+	}
+	buyer, err := getParticipant(ctx, asset.BuyerAddress)
+	if err != nil {
+		return 0, err
+	}
+	if seller == nil || buyer == nil {
+		return 0, fmt.Errorf("participants of asset %s are not registered", asset.TokenID)
+	}
+	tariff, err := getNetworkTariff(ctx, seller.Zone, buyer.Zone)
+	if err != nil {
+		return 0, err
+	}
+	if tariff == nil {
+		return 0, nil
+	}
+	return tariff.FeePerKWh, nil
+}
+
+// WithdrawFees pays fees collected in the grid operator's account, such as
+// network fees and imbalance charges, out to another account. Only a positive
+// balance can be withdrawn; the grid's credit line backs its settlements, not
+// withdrawals.
+func (e *EnergyTradingContract) WithdrawFees(ctx contractapi.TransactionContextInterface, to string, amount float64) error {
+	if err := transferTokens(ctx, GridOperatorAccount, to, amount); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventTokensTransferred, TokenEvent{From: GridOperatorAccount, To: to, Amount: amount})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestNetworkTariff(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+
+	tc.as("operator1", RoleOperator)
+	err := e.SetNetworkTariff(tc, "zone1", "zone2", -0.1)
+	require.EqualError(t, err, "network fee must not be negative")
+	require.NoError(t, e.SetNetworkTariff(tc, "zone2", "zone1", 0.08))
+	tariff, err := e.GetNetworkTariff(tc, "zone1", "zone2")
+	require.NoError(t, err)
+	require.Equal(t, "zone1", tariff.ZoneA)
+	require.Equal(t, 0.08, tariff.FeePerKWh)
+	_, err = e.GetNetworkTariff(tc, "zone1", "zone1")
+	require.EqualError(t, err, "no network tariff is set between zone1 and zone1")
+}
+
+func TestReconcileDeliveryCollectsNetworkFee(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	require.NoError(t, e.SetNetworkTariff(tc.as("operator1", RoleOperator), "zone1", "zone1", 0.05))
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	// The rate is fixed at confirmation
+	require.NoError(t, e.SetNetworkTariff(tc.as("operator1", RoleOperator), "zone1", "zone1", 1))
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, 0.05, asset.NetworkFeeRate)
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	settlement, err := e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+	require.InDelta(t, 0.4, settlement.NetworkFee, 1e-9)
+
+	buyer, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 8.184, buyer.Balance, 1e-9)
+	grid, err := e.ReadTokenAccount(tc, GridOperatorAccount)
+	require.NoError(t, err)
+	require.InDelta(t, 1.2, grid.Balance, 1e-9)
+	// Collected fees can be withdrawn, but not beyond the grid's balance
+	tc.as("admin1", RoleAdmin)
+	require.EqualError(t, e.WithdrawFees(tc, "seller1", 1.5), "account grid-operator has insufficient balance")
+	require.NoError(t, e.WithdrawFees(tc, "seller1", 1.2))
+	grid, err = e.ReadTokenAccount(tc, GridOperatorAccount)
+	require.NoError(t, err)
+	require.InDelta(t, 0, grid.Balance, 1e-9)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Option types. A call gives its holder the right to buy the underlying
+// energy from the writer at the strike price, a put the right to sell it to
+// the writer.
+const (
+	OptionCall = "CALL"
+	OptionPut  = "PUT"
+)
+
+// Option statuses
+const (
+	OptionForSale   = "FOR_SALE"
+	OptionHeld      = "HELD"
+	OptionExercised = "EXERCISED"
+	OptionLapsed    = "LAPSED"
+	OptionWithdrawn = "WITHDRAWN"
+)
+
+// EnergyOption is an option on Energy kWh delivered in the window
+// [DeliveryStart, DeliveryEnd) at StrikePrice tokens per kWh. The writer
+// offers it for Premium tokens; the buyer pays the premium to the writer and
+// may exercise until Expiry. Exercising creates the underlying trade, named
+// after the option, already confirmed by both sides.
+type EnergyOption struct {
+	OptionID      string  `json:"optionID"`
+	Type          string  `json:"type"`
+	Writer        string  `json:"writer"`
+	Holder        string  `json:"holder,omitempty"`
+	Energy        float64 `json:"energy"`
+	DeliveryStart string  `json:"deliveryStart"`
+	DeliveryEnd   string  `json:"deliveryEnd"`
+	StrikePrice   float64 `json:"strikePrice"`
+	Premium       float64 `json:"premium"`
+	Expiry        string  `json:"expiry"`
+	SourceType    string  `json:"sourceType"`
+	Status        string  `json:"status"`
+	WrittenAt     string  `json:"writtenAt"`
+	BoughtAt      string  `json:"boughtAt,omitempty"`
+	ClosedAt      string  `json:"closedAt,omitempty"`
+	Version       int64   `json:"version"`
+}
+
+// PaginatedOptionResult is a page of options
+type PaginatedOptionResult struct {
+	Records             []*EnergyOption `json:"records"`
+	FetchedRecordsCount int32           `json:"fetchedRecordsCount"`
+	Bookmark            string          `json:"bookmark"`
+}
+
+func optionKey(ctx contractapi.TransactionContextInterface, optionID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("option", []string{optionID})
+}
+
+func putOption(ctx contractapi.TransactionContextInterface, option *EnergyOption) error {
+	option.Version++
+	optionJSON, err := json.Marshal(option)
+	if err != nil {
+		return err
+	}
+	key, err := optionKey(ctx, option.OptionID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, optionJSON)
+}
+
+// getOption returns an option, or nil if there is none
+func getOption(ctx contractapi.TransactionContextInterface, optionID string) (*EnergyOption, error) {
+	key, err := optionKey(ctx, optionID)
+	if err != nil {
+		return nil, err
+	}
+	optionJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read option %s: %v", optionID, err)
+	}
+	if optionJSON == nil {
+		return nil, nil
+	}
+	var option EnergyOption
+	if err := json.Unmarshal(optionJSON, &option); err != nil {
+		return nil, err
+	}
+	return &option, nil
+}
+
+// GetEnergyOption returns an option on energy delivery
+func (e *EnergyTradingContract) GetEnergyOption(ctx contractapi.TransactionContextInterface, optionID string) (*EnergyOption, error) {
+	option, err := getOption(ctx, optionID)
+	if err != nil {
+		return nil, err
+	}
+	if option == nil {
+		return nil, fmt.Errorf("option %s does not exist", optionID)
+	}
+	return option, nil
+}
+
+// GetOptionsForSale returns a page of the options written and not yet
+// bought. Options in other statuses are skipped, so a page may hold fewer
+// than pageSize options.
+func (e *EnergyTradingContract) GetOptionsForSale(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedOptionResult, error) {
+	result := &PaginatedOptionResult{Records: []*EnergyOption{}}
+	metadata, err := queryPage(ctx, "option", []string{}, pageSize, bookmark, func(value []byte) error {
+		var option EnergyOption
+		if err := json.Unmarshal(value, &option); err != nil {
+			return err
+		}
+		if option.Status == OptionForSale {
+			result.Records = append(result.Records, &option)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// optionExpired reports whether an option has expired at the given time
+func optionExpired(option *EnergyOption, now time.Time) bool {
+	return now.Format(time.RFC3339) >= option.Expiry
+}
+
+// WriteOption offers an option on energy delivery for sale. The caller
+// writes it: the writer of a call is the seller of the underlying trade and
+// the writer of a put its buyer. The option must expire before delivery
+// starts and the strike price must lie in the band around the reference
+// price in effect; like any trade price, it may be zero or negative.
+func (e *EnergyTradingContract) WriteOption(ctx contractapi.TransactionContextInterface, optionID, optionType string, energy float64, deliveryStart, deliveryEnd string, strikePrice, premium float64, expiry, sourceType string) (*EnergyOption, error) {
+	if optionType != OptionCall && optionType != OptionPut {
+		return nil, fmt.Errorf("option type must be %s or %s", OptionCall, OptionPut)
+	}
+	if energy <= 0 || premium < 0 {
+		return nil, fmt.Errorf("energy must be positive and premium must not be negative")
+	}
+	writer, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := requireApprovedParticipant(ctx, writer); err != nil {
+		return nil, err
+	}
+	existing, err := getOption(ctx, optionID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("option %s already exists", optionID)
+	}
+	deliveryStart, deliveryEnd, err = validateDeliveryWindow(ctx, deliveryStart, deliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+	expiryTime, err := parseTimestamp(expiry)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !expiryTime.After(now) || expiryTime.Format(time.RFC3339) > deliveryStart {
+		return nil, fmt.Errorf("expiry %s must be after transaction time and no later than delivery start %s", expiry, deliveryStart)
+	}
+	if optionType == OptionCall {
+		if err := validateSourceType(ctx, writer, sourceType); err != nil {
+			return nil, err
+		}
+	}
+	if err := validatePriceBand(ctx, strikePrice); err != nil {
+		return nil, err
+	}
+
+	option := &EnergyOption{
+		OptionID:      optionID,
+		Type:          optionType,
+		Writer:        writer,
+		Energy:        energy,
+		DeliveryStart: deliveryStart,
+		DeliveryEnd:   deliveryEnd,
+		StrikePrice:   strikePrice,
+		Premium:       premium,
+		Expiry:        expiryTime.Format(time.RFC3339),
+		SourceType:    sourceType,
+		Status:        OptionForSale,
+		WrittenAt:     now.Format(time.RFC3339),
+	}
+	if err := putOption(ctx, option); err != nil {
+		return nil, err
+	}
+	return option, emitEvent(ctx, EventOptionChanged, option)
+}
+
+// BuyOption buys an option for sale; the premium is paid to the writer
+func (e *EnergyTradingContract) BuyOption(ctx contractapi.TransactionContextInterface, optionID string) (*EnergyOption, error) {
+	option, err := e.GetEnergyOption(ctx, optionID)
+	if err != nil {
+		return nil, err
+	}
+	if option.Status != OptionForSale {
+		return nil, fmt.Errorf("option %s cannot be bought in status %s", optionID, option.Status)
+	}
+	holder, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if holder == option.Writer {
+		return nil, fmt.Errorf("writer %s cannot buy its own option", holder)
+	}
+	if _, err := requireApprovedParticipant(ctx, holder); err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if optionExpired(option, now) {
+		return nil, fmt.Errorf("option %s expired at %s", optionID, option.Expiry)
+	}
+	if option.Premium > 0 {
+		if err := transferTokens(ctx, holder, option.Writer, option.Premium); err != nil {
+			return nil, fmt.Errorf("failed to pay the premium of option %s: %v", optionID, err)
+		}
+	}
+
+	option.Holder = holder
+	option.Status = OptionHeld
+	option.BoughtAt = now.Format(time.RFC3339)
+	if err := putOption(ctx, option); err != nil {
+		return nil, err
+	}
+	return option, emitEvent(ctx, EventOptionChanged, option)
+}
+
+// ExerciseOption exercises a held option before it expires, creating the
+// confirmed underlying trade at the strike price. The holder of a put sells
+// the energy, so its source type is checked against the holder's devices.
+func (e *EnergyTradingContract) ExerciseOption(ctx contractapi.TransactionContextInterface, optionID string) (*EnergyAsset, error) {
+	option, err := e.GetEnergyOption(ctx, optionID)
+	if err != nil {
+		return nil, err
+	}
+	if option.Status != OptionHeld {
+		return nil, fmt.Errorf("option %s cannot be exercised in status %s", optionID, option.Status)
+	}
+	if err := requireCaller(ctx, option.Holder); err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if optionExpired(option, now) {
+		return nil, fmt.Errorf("option %s expired at %s", optionID, option.Expiry)
+	}
+	buyer, seller := option.Holder, option.Writer
+	if option.Type == OptionPut {
+		buyer, seller = option.Writer, option.Holder
+		if err := validateSourceType(ctx, seller, option.SourceType); err != nil {
+			return nil, err
+		}
+	}
+	for _, address := range []string{buyer, seller} {
+		if _, err := requireApprovedParticipant(ctx, address); err != nil {
+			return nil, err
+		}
+	}
+	if err := requireNewTokenID(ctx, optionID); err != nil {
+		return nil, err
+	}
+	privateDetailsHash, err := putPrivateDetails(ctx, buyer, seller, &TradePrivateDetails{
+		TokenID:          optionID,
+		TransactionPrice: option.StrikePrice,
+		Salt:             ctx.GetStub().GetTxID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	asset := &EnergyAsset{
+		TokenID:            optionID,
+		BuyerAddress:       buyer,
+		SellerAddress:      seller,
+		EnergyAmount:       option.Energy,
+		SourceType:         option.SourceType,
+		Timestamp:          now.Format(time.RFC3339),
+		DeliveryStart:      option.DeliveryStart,
+		DeliveryEnd:        option.DeliveryEnd,
+		OptionID:           optionID,
+		PrivateDetailsHash: privateDetailsHash,
+	}
+	if err := confirmTrade(ctx, asset, option.StrikePrice); err != nil {
+		return nil, err
+	}
+	if err := recordTrade(ctx, asset); err != nil {
+		return nil, err
+	}
+	option.Status = OptionExercised
+	option.ClosedAt = now.Format(time.RFC3339)
+	if err := putOption(ctx, option); err != nil {
+		return nil, err
+	}
+	if err := emitEvent(ctx, EventOptionChanged, option); err != nil {
+		return nil, err
+	}
+	return asset, emitEvent(ctx, EventTradeConfirmed, newTradeEvent(asset))
+}
+
+// WithdrawOption takes an option that nobody has bought off sale; only its
+// writer may call it
+func (e *EnergyTradingContract) WithdrawOption(ctx contractapi.TransactionContextInterface, optionID string) (*EnergyOption, error) {
+	option, err := e.GetEnergyOption(ctx, optionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, option.Writer); err != nil {
+		return nil, err
+	}
+	if option.Status != OptionForSale {
+		return nil, fmt.Errorf("option %s cannot be withdrawn in status %s", optionID, option.Status)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	option.Status = OptionWithdrawn
+	option.ClosedAt = now
+	if err := putOption(ctx, option); err != nil {
+		return nil, err
+	}
+	return option, emitEvent(ctx, EventOptionChanged, option)
+}
+
+// LapseOption closes an option that expired without being exercised. The
+// writer keeps the premium.
+func (e *EnergyTradingContract) LapseOption(ctx contractapi.TransactionContextInterface, optionID string) (*EnergyOption, error) {
+	option, err := e.GetEnergyOption(ctx, optionID)
+	if err != nil {
+		return nil, err
+	}
+	if option.Status != OptionForSale && option.Status != OptionHeld {
+		return nil, fmt.Errorf("option %s cannot lapse in status %s", optionID, option.Status)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !optionExpired(option, now) {
+		return nil, fmt.Errorf("option %s does not expire until %s", optionID, option.Expiry)
+	}
+	option.Status = OptionLapsed
+	option.ClosedAt = now.Format(time.RFC3339)
+	if err := putOption(ctx, option); err != nil {
+		return nil, err
+	}
+	return option, emitEvent(ctx, EventOptionChanged, option)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCallOptionExercise(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	postTestReferencePrice(t, e, tc, 0.2)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 5))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	tc.as("seller1", "")
+	_, err := e.WriteOption(tc, "call1", "SWAP", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", 0.2, 1, "2025-05-03T09:00:00Z", SourceGrid)
+	require.EqualError(t, err, "option type must be CALL or PUT")
+	_, err = e.WriteOption(tc, "call1", OptionCall, 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", 0.2, 1, "2025-05-03T10:30:00Z", SourceGrid)
+	require.EqualError(t, err, "expiry 2025-05-03T10:30:00Z must be after transaction time and no later than delivery start 2025-05-03T10:00:00Z")
+	_, err = e.WriteOption(tc, "call1", OptionCall, 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", 0.4, 1, "2025-05-03T09:00:00Z", SourceGrid)
+	require.Error(t, err)
+	option, err := e.WriteOption(tc, "call1", OptionCall, 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", 0.2, 1, "2025-05-03T09:00:00Z", SourceGrid)
+	require.NoError(t, err)
+	require.Equal(t, OptionForSale, option.Status)
+	forSale, err := e.GetOptionsForSale(tc, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, forSale.Records, 1)
+
+	_, err = e.BuyOption(tc, "call1")
+	require.EqualError(t, err, "writer seller1 cannot buy its own option")
+	option, err = e.BuyOption(tc.as("buyer1", ""), "call1")
+	require.NoError(t, err)
+	require.Equal(t, "buyer1", option.Holder)
+	require.Equal(t, OptionHeld, option.Status)
+	balance, err := e.BalanceOf(tc, "seller1", EnergyTokenID)
+	require.NoError(t, err)
+	require.Equal(t, 2.0, balance)
+	_, err = e.BuyOption(tc, "call1")
+	require.EqualError(t, err, "option call1 cannot be bought in status HELD")
+	_, err = e.LapseOption(tc, "call1")
+	require.EqualError(t, err, "option call1 does not expire until 2025-05-03T09:00:00Z")
+
+	// Exercising creates the confirmed trade at the strike price
+	_, err = e.ExerciseOption(tc.as("seller1", ""), "call1")
+	require.EqualError(t, err, "caller seller1 is not authorized to act for buyer1")
+	asset, err := e.ExerciseOption(tc.as("buyer1", ""), "call1")
+	require.NoError(t, err)
+	require.Equal(t, StateConfirmed, asset.TransactionState)
+	require.Equal(t, "buyer1", asset.BuyerAddress)
+	require.Equal(t, "seller1", asset.SellerAddress)
+	require.Equal(t, "call1", asset.OptionID)
+	details, err := e.ReadTradePrivateDetails(tc, "call1")
+	require.NoError(t, err)
+	require.Equal(t, 0.2, details.TransactionPrice)
+	option, err = e.GetEnergyOption(tc, "call1")
+	require.NoError(t, err)
+	require.Equal(t, OptionExercised, option.Status)
+	_, err = e.ExerciseOption(tc, "call1")
+	require.EqualError(t, err, "option call1 cannot be exercised in status EXERCISED")
+}
+
+func TestNegativeStrikeOptionExercise(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	postTestReferencePrice(t, e, tc, -0.2)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 5))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	// The buyer of a surplus pays a premium for the right to be paid to take it
+	_, err := e.WriteOption(tc.as("seller1", ""), "call1", OptionCall, 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", -0.2, 1, "2025-05-03T09:00:00Z", SourceGrid)
+	require.NoError(t, err)
+	_, err = e.BuyOption(tc.as("buyer1", ""), "call1")
+	require.NoError(t, err)
+	asset, err := e.ExerciseOption(tc, "call1")
+	require.NoError(t, err)
+	require.Equal(t, StateConfirmed, asset.TransactionState)
+	details, err := e.ReadTradePrivateDetails(tc, "call1")
+	require.NoError(t, err)
+	require.Equal(t, -0.2, details.TransactionPrice)
+}
+
+func TestPutOptionLapseAndWithdraw(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 1))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	tc.as("buyer1", "")
+	_, err := e.WriteOption(tc, "put1", OptionPut, 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", 0.2, 0.5, "2025-05-03T09:00:00Z", SourceGrid)
+	require.NoError(t, err)
+	_, err = e.WriteOption(tc, "put2", OptionPut, 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", 0.2, 0.5, "2025-05-03T09:00:00Z", SourceGrid)
+	require.NoError(t, err)
+	_, err = e.BuyOption(tc.as("seller1", ""), "put1")
+	require.NoError(t, err)
+	_, err = e.WithdrawOption(tc, "put2")
+	require.EqualError(t, err, "caller seller1 is not authorized to act for buyer1")
+	_, err = e.WithdrawOption(tc.as("buyer1", ""), "put1")
+	require.EqualError(t, err, "option put1 cannot be withdrawn in status HELD")
+	option, err := e.WithdrawOption(tc, "put2")
+	require.NoError(t, err)
+	require.Equal(t, OptionWithdrawn, option.Status)
+
+	// An unexercised option lapses after expiry and the writer keeps the premium
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 9, 30, 0, 0, time.UTC)), nil)
+	_, err = e.ExerciseOption(tc.as("seller1", ""), "put1")
+	require.EqualError(t, err, "option put1 expired at 2025-05-03T09:00:00Z")
+	option, err = e.LapseOption(tc.as("operator1", RoleOperator), "put1")
+	require.NoError(t, err)
+	require.Equal(t, OptionLapsed, option.Status)
+	balance, err := e.BalanceOf(tc, "buyer1", EnergyTokenID)
+	require.NoError(t, err)
+	require.Equal(t, 1.5, balance)
+	_, err = e.LapseOption(tc, "put2")
+	require.EqualError(t, err, "option put2 cannot lapse in status WITHDRAWN")
+}
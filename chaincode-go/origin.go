@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Guarantee-of-origin labels a trade's energy may carry
+const (
+	SourceSolar   = "solar"
+	SourceWind    = "wind"
+	SourceBattery = "battery"
+	// SourceGrid attributes energy to the zone's grid mix. Any seller may
+	// label energy with it.
+	SourceGrid = "grid"
+)
+
+// SourceGreen selects the renewable labels when filtering trades
+const SourceGreen = "green"
+
+// greenBookmarkSeparator separates the label from the bookmark within the
+// label in bookmarks of the "green" selection
+const greenBookmarkSeparator = "|"
+
+var sourceTypes = []string{SourceSolar, SourceWind, SourceBattery, SourceGrid}
+
+// isGreenSource reports whether a label stands for renewable generation
+func isGreenSource(sourceType string) bool {
+	return sourceType == SourceSolar || sourceType == SourceWind
+}
+
+// validateSourceType checks that the seller has a device able to back the
+// label: a verified generator of that technology for solar and wind, and a
+// registered storage system for battery.
+func validateSourceType(ctx contractapi.TransactionContextInterface, sellerAddress, sourceType string) error {
+	switch sourceType {
+	case SourceGrid:
+		return nil
+	case SourceSolar, SourceWind:
+		seller, err := getParticipant(ctx, sellerAddress)
+		if err != nil {
+			return err
+		}
+		if seller == nil {
+			return fmt.Errorf("participant %s is not registered", sellerAddress)
+		}
+		for _, meterID := range seller.MeterIDs {
+			generator, err := getGenerator(ctx, meterID)
+			if err != nil {
+				return err
+			}
+			if generator != nil && generator.Status == GeneratorVerified && generator.Technology == sourceType {
+				return nil
+			}
+		}
+	case SourceBattery:
+		resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("storageowner", []string{sellerAddress})
+		if err != nil {
+			return err
+		}
+		found := resultsIterator.HasNext()
+		resultsIterator.Close()
+		if found {
+			return nil
+		}
+	default:
+		return fmt.Errorf("source type must be one of %v", sourceTypes)
+	}
+	return fmt.Errorf("seller %s has no registered device for source type %s", sellerAddress, sourceType)
+}
+
+func sourceTradeKey(ctx contractapi.TransactionContextInterface, sourceType, tokenID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("sourcetrade", []string{sourceType, tokenID})
+}
+
+func putSourceTradeIndex(ctx contractapi.TransactionContextInterface, sourceType, tokenID string) error {
+	key, err := sourceTradeKey(ctx, sourceType, tokenID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, []byte(tokenID))
+}
+
+// GetOpenTradesBySource returns a page of the trades awaiting signatures whose
+// energy carries a label, so that buyers can match only offers of a given
+// origin. Trades past the signing stage are skipped, so a page may hold fewer
+// than pageSize trades.
+//
+// The label "green" selects solar and wind. Its pages cover one label at a
+// time, and its bookmark names the label the next page reads from.
+func (e *EnergyTradingContract) GetOpenTradesBySource(ctx contractapi.TransactionContextInterface, sourceType string, pageSize int32, bookmark string) (*PaginatedTradeResult, error) {
+	labels := []string{sourceType}
+	if sourceType == SourceGreen {
+		labels = []string{SourceSolar, SourceWind}
+	}
+	labelIndex := 0
+	if sourceType == SourceGreen && bookmark != "" {
+		parts := strings.SplitN(bookmark, greenBookmarkSeparator, 2)
+		if len(parts) != 2 || (parts[0] != SourceSolar && parts[0] != SourceWind) {
+			return nil, fmt.Errorf("invalid bookmark %q", bookmark)
+		}
+		if parts[0] == SourceWind {
+			labelIndex = 1
+		}
+		bookmark = parts[1]
+	}
+	label := labels[labelIndex]
+
+	result := &PaginatedTradeResult{Records: []*EnergyAsset{}}
+	metadata, err := queryPage(ctx, "sourcetrade", []string{label}, pageSize, bookmark, func(value []byte) error {
+		asset, err := e.ReadEnergyAsset(ctx, string(value))
+		if err != nil {
+			return err
+		}
+		if asset.TransactionState == StateCreated {
+			result.Records = append(result.Records, asset)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	if sourceType == SourceGreen {
+		switch {
+		case metadata.Bookmark != "":
+			result.Bookmark = label + greenBookmarkSeparator + metadata.Bookmark
+		case labelIndex+1 < len(labels):
+			result.Bookmark = labels[labelIndex+1] + greenBookmarkSeparator
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceTypeLabels(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	create := func(tokenID, sourceType string) error {
+		return e.CreateEnergyAsset(tc.as("buyer1", ""), tokenID, "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", sourceType)
+	}
+
+	require.EqualError(t, create("energy1", "coal"), "source type must be one of [solar wind battery grid]")
+	require.EqualError(t, create("energy1", SourceSolar), "seller seller1 has no registered device for source type solar")
+	require.EqualError(t, create("energy1", SourceBattery), "seller seller1 has no registered device for source type battery")
+
+	// Solar needs a verified generator of that technology
+	_, err := e.RegisterGenerator(tc.as("seller1", ""), meterID, "solar", 10)
+	require.NoError(t, err)
+	require.Error(t, create("energy1", SourceSolar))
+	_, err = e.VerifyGenerator(tc.as("operator1", RoleOperator), meterID)
+	require.NoError(t, err)
+	require.NoError(t, create("energy1", SourceSolar))
+	require.EqualError(t, create("energy2", SourceWind), "seller seller1 has no registered device for source type wind")
+
+	_, err = e.RegisterStorage(tc.as("seller1", ""), "battery1", meterID, 10, 5, 5, 5)
+	require.NoError(t, err)
+	require.NoError(t, create("energy2", SourceBattery))
+	require.NoError(t, create("energy3", SourceGrid))
+
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, SourceSolar, asset.SourceType)
+	payload, err := e.GetSigningPayload(tc, "energy1")
+	require.NoError(t, err)
+	require.Contains(t, payload, `"sourceType":"solar"`)
+
+	// Buyers can match green offers only, and confirmed trades drop out
+	assets, err := e.GetOpenTradesBySource(tc, SourceGreen, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, assets.Records, 1)
+	require.Equal(t, "energy1", assets.Records[0].TokenID)
+	require.NoError(t, e.SignEnergyAsset(tc.as("buyer1", ""), "energy1", tc.sign(t, e, "buyer1", "energy1"), 0))
+	require.NoError(t, e.SignEnergyAsset(tc.as("seller1", ""), "energy1", tc.sign(t, e, "seller1", "energy1"), 0))
+	assets, err = e.GetOpenTradesBySource(tc, SourceGreen, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Empty(t, assets.Records)
+	assets, err = e.GetOpenTradesBySource(tc, SourceBattery, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, assets.Records, 1)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// DefaultMaxPageSize caps the page size of list queries until an admin sets
+// another limit. Every list query takes a page size and a bookmark, so no
+// single call can scan an unbounded part of the world state.
+const DefaultMaxPageSize int32 = 100
+
+// queryLimitsKey is the state key of the query limits
+const queryLimitsKey = "querylimits"
+
+// QueryLimits are the server-side limits on list queries
+type QueryLimits struct {
+	MaxPageSize int32  `json:"maxPageSize"`
+	UpdatedBy   string `json:"updatedBy,omitempty"`
+	UpdatedAt   string `json:"updatedAt,omitempty"`
+}
+
+// SetMaxPageSize sets the largest page size list queries accept
+func (e *EnergyTradingContract) SetMaxPageSize(ctx contractapi.TransactionContextInterface, maxPageSize int32) (*QueryLimits, error) {
+	if maxPageSize <= 0 {
+		return nil, fmt.Errorf("max page size must be positive")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	limits := &QueryLimits{MaxPageSize: maxPageSize, UpdatedBy: caller, UpdatedAt: now}
+	limitsJSON, err := json.Marshal(limits)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(queryLimitsKey, limitsJSON); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// GetQueryLimits returns the limits on list queries
+func (e *EnergyTradingContract) GetQueryLimits(ctx contractapi.TransactionContextInterface) (*QueryLimits, error) {
+	limitsJSON, err := ctx.GetStub().GetState(queryLimitsKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read query limits: %v", err)
+	}
+	if limitsJSON == nil {
+		return &QueryLimits{MaxPageSize: DefaultMaxPageSize}, nil
+	}
+	var limits QueryLimits
+	if err := json.Unmarshal(limitsJSON, &limits); err != nil {
+		return nil, err
+	}
+	return &limits, nil
+}
+
+// checkPageSize fails unless the page size is between 1 and the configured
+// maximum
+func checkPageSize(ctx contractapi.TransactionContextInterface, pageSize int32) error {
+	limits, err := (&EnergyTradingContract{}).GetQueryLimits(ctx)
+	if err != nil {
+		return err
+	}
+	if pageSize < 1 || pageSize > limits.MaxPageSize {
+		return fmt.Errorf("page size must be between 1 and %d", limits.MaxPageSize)
+	}
+	return nil
+}
+
+// queryPage reads one page of the entries under a partial composite key,
+// passing each value to add. A page may hold fewer records than pageSize
+// when add filters entries out; clients keep paging until the bookmark is
+// empty.
+func queryPage(ctx contractapi.TransactionContextInterface, objectType string, attributes []string, pageSize int32, bookmark string, add func(value []byte) error) (*peer.QueryResponseMetadata, error) {
+	if err := checkPageSize(ctx, pageSize); err != nil {
+		return nil, err
+	}
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(objectType, attributes, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if err := add(queryResponse.Value); err != nil {
+			return nil, err
+		}
+	}
+	if metadata == nil {
+		metadata = &peer.QueryResponseMetadata{}
+	}
+	return metadata, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxPageSize(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+
+	limits, err := e.GetQueryLimits(tc)
+	require.NoError(t, err)
+	require.Equal(t, DefaultMaxPageSize, limits.MaxPageSize)
+	_, err = e.GetLevySchedule(tc, 0, "")
+	require.EqualError(t, err, "page size must be between 1 and 100")
+	_, err = e.GetLevySchedule(tc, DefaultMaxPageSize+1, "")
+	require.EqualError(t, err, "page size must be between 1 and 100")
+
+	_, err = e.SetMaxPageSize(tc.as("admin1", RoleAdmin), 0)
+	require.EqualError(t, err, "max page size must be positive")
+	limits, err = e.SetMaxPageSize(tc, 2)
+	require.NoError(t, err)
+	require.Equal(t, "admin1", limits.UpdatedBy)
+	_, err = e.GetLevySchedule(tc, 3, "")
+	require.EqualError(t, err, "page size must be between 1 and 2")
+	_, err = e.BalanceOfBatch(tc, []string{"a", "b", "c"}, []string{EnergyTokenID, EnergyTokenID, EnergyTokenID})
+	require.EqualError(t, err, "batch may hold at most 2 balances")
+}
+
+func TestPaginationBookmarks(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.as("admin1", RoleAdmin)
+	for _, levyID := range []string{"a", "b", "c"} {
+		_, err := e.SetLevy(tc, levyID, "Levy "+levyID, LevyPercent, 0.01, "collector")
+		require.NoError(t, err)
+	}
+
+	page, err := e.GetLevySchedule(tc, 2, "")
+	require.NoError(t, err)
+	require.Len(t, page.Records, 2)
+	require.Equal(t, int32(2), page.FetchedRecordsCount)
+	require.NotEmpty(t, page.Bookmark)
+	page, err = e.GetLevySchedule(tc, 2, page.Bookmark)
+	require.NoError(t, err)
+	require.Len(t, page.Records, 1)
+	require.Equal(t, "c", page.Records[0].LevyID)
+	require.Empty(t, page.Bookmark)
+}
+
+func TestGreenTradesPageAcrossLabels(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	for seller, technology := range map[string]string{"seller1": SourceSolar, "seller2": SourceWind} {
+		registerTestParticipant(t, e, tc, seller, RoleProsumer)
+		meterID := registerTestMeter(t, e, tc, seller)
+		_, err := e.RegisterGenerator(tc.as(seller, ""), meterID, technology, 10)
+		require.NoError(t, err)
+		_, err = e.VerifyGenerator(tc.as("operator1", RoleOperator), meterID)
+		require.NoError(t, err)
+	}
+	create := func(tokenID, seller, sourceType string) {
+		require.NoError(t, e.CreateEnergyAsset(tc.as("buyer1", ""), tokenID, "buyer1", seller, 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", sourceType))
+	}
+	create("energy1", "seller1", SourceSolar)
+	create("energy2", "seller1", SourceSolar)
+	create("energy3", "seller2", SourceWind)
+
+	tokenIDs := []string{}
+	bookmark := ""
+	for pages := 0; pages < 5; pages++ {
+		page, err := e.GetOpenTradesBySource(tc, SourceGreen, 1, bookmark)
+		require.NoError(t, err)
+		for _, asset := range page.Records {
+			tokenIDs = append(tokenIDs, asset.TokenID)
+		}
+		bookmark = page.Bookmark
+		if bookmark == "" {
+			break
+		}
+	}
+	require.Empty(t, bookmark)
+	require.Equal(t, []string{"energy1", "energy2", "energy3"}, tokenIDs)
+
+	_, err := e.GetOpenTradesBySource(tc, SourceGreen, 1, "coal|")
+	require.EqualError(t, err, `invalid bookmark "coal|"`)
+}
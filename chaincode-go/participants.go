@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// KYC statuses
+const (
+	KYCPending  = "PENDING"
+	KYCApproved = "APPROVED"
+	KYCRejected = "REJECTED"
+)
+
+// Participant is the public, pseudonymous record of a market participant.
+// Personal data is kept in PersonalCollection and committed to by
+// PersonalDataHash.
+type Participant struct {
+	Address          string   `json:"address"`
+	MeterIDs         []string `json:"meterIDs"`
+	PublicKey        string   `json:"publicKey"`
+	Zone             string   `json:"zone"`
+	Role             string   `json:"role"`
+	MSPID            string   `json:"mspID"`
+	KYCStatus        string   `json:"kycStatus"`
+	RegisteredAt     string   `json:"registeredAt"`
+	ReviewedAt       string   `json:"reviewedAt,omitempty"`
+	PersonalDataHash string   `json:"personalDataHash"`
+	Erased           bool     `json:"erased,omitempty"`
+	ErasedAt         string   `json:"erasedAt,omitempty"`
+}
+
+func participantKey(ctx contractapi.TransactionContextInterface, address string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("participant", []string{address})
+}
+
+func putParticipant(ctx contractapi.TransactionContextInterface, participant *Participant) error {
+	participantJSON, err := json.Marshal(participant)
+	if err != nil {
+		return err
+	}
+	key, err := participantKey(ctx, participant.Address)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, participantJSON)
+}
+
+// getParticipant returns the participant with the given address, or nil if it is not registered
+func getParticipant(ctx contractapi.TransactionContextInterface, address string) (*Participant, error) {
+	key, err := participantKey(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	participantJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read participant %s: %v", address, err)
+	}
+	if participantJSON == nil {
+		return nil, nil
+	}
+	var participant Participant
+	if err := json.Unmarshal(participantJSON, &participant); err != nil {
+		return nil, err
+	}
+	return &participant, nil
+}
+
+// parsePublicKey decodes a PEM encoded PKIX ECDSA public key
+func parsePublicKey(publicKeyPEM string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an ECDSA key")
+	}
+	return publicKey, nil
+}
+
+// requireApprovedParticipant fails unless the address has passed KYC
+func requireApprovedParticipant(ctx contractapi.TransactionContextInterface, address string) (*Participant, error) {
+	participant, err := getParticipant(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if participant == nil {
+		return nil, fmt.Errorf("participant %s is not registered", address)
+	}
+	if participant.Erased {
+		return nil, fmt.Errorf("participant %s has been erased", address)
+	}
+	if participant.KYCStatus != KYCApproved {
+		return nil, fmt.Errorf("participant %s is not KYC approved", address)
+	}
+	return participant, nil
+}
+
+// RegisterParticipant registers the caller as a participant pending KYC review.
+// Personal data is read from the "participant_personal" transient entry. The
+// role comes from the caller's certificate and is recorded in the role
+// registry if it is not there yet.
+func (e *EnergyTradingContract) RegisterParticipant(ctx contractapi.TransactionContextInterface, meterIDs []string, publicKeyPEM, zone string) (*Participant, error) {
+	address, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getParticipant(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("participant %s is already registered", address)
+	}
+	if _, err := parsePublicKey(publicKeyPEM); err != nil {
+		return nil, err
+	}
+	personal, err := readTransientPersonalData(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := getRoleRecord(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		if record, err = e.RegisterRole(ctx); err != nil {
+			return nil, err
+		}
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	personalDataHash, err := putPersonalData(ctx, personal)
+	if err != nil {
+		return nil, err
+	}
+
+	participant := &Participant{
+		Address:          address,
+		MeterIDs:         meterIDs,
+		PublicKey:        publicKeyPEM,
+		Zone:             zone,
+		Role:             record.Role,
+		MSPID:            record.MSPID,
+		KYCStatus:        KYCPending,
+		RegisteredAt:     now,
+		PersonalDataHash: personalDataHash,
+	}
+	if err := putParticipant(ctx, participant); err != nil {
+		return nil, err
+	}
+	if err := emitEvent(ctx, EventParticipantRegistered, ParticipantEvent{Address: address, Status: KYCPending}); err != nil {
+		return nil, err
+	}
+	return participant, nil
+}
+
+// GetParticipant returns the participant registered under an address. Personal
+// fields are redacted unless the caller is the participant, an admin or the
+// regulator.
+func (e *EnergyTradingContract) GetParticipant(ctx contractapi.TransactionContextInterface, address string) (*Participant, error) {
+	participant, err := e.readParticipant(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := redactParticipant(ctx, participant); err != nil {
+		return nil, err
+	}
+	return participant, nil
+}
+
+func (e *EnergyTradingContract) readParticipant(ctx contractapi.TransactionContextInterface, address string) (*Participant, error) {
+	participant, err := getParticipant(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if participant == nil {
+		return nil, fmt.Errorf("participant %s is not registered", address)
+	}
+	return participant, nil
+}
+
+// ApproveParticipant marks a participant as having passed KYC
+func (e *EnergyTradingContract) ApproveParticipant(ctx contractapi.TransactionContextInterface, address string) error {
+	return e.setKYCStatus(ctx, address, KYCApproved)
+}
+
+// RejectParticipant marks a participant as having failed KYC
+func (e *EnergyTradingContract) RejectParticipant(ctx contractapi.TransactionContextInterface, address string) error {
+	return e.setKYCStatus(ctx, address, KYCRejected)
+}
+
+func (e *EnergyTradingContract) setKYCStatus(ctx contractapi.TransactionContextInterface, address, status string) error {
+	participant, err := e.readParticipant(ctx, address)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	participant.KYCStatus = status
+	participant.ReviewedAt = now
+	if err := putParticipant(ctx, participant); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventParticipantReviewed, ParticipantEvent{Address: address, Status: status})
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Pool distribution modes. A selling pool sells its pooled energy to the
+// grid operator at the reference price and pays the revenue out to its
+// members; a distributing pool credits the energy to its members' energy bank
+// accounts instead.
+const (
+	PoolSell       = "SELL"
+	PoolDistribute = "DISTRIBUTE"
+)
+
+// PoolSettlementInterval is the minimum time between two settlements of a pool
+const PoolSettlementInterval = 24 * time.Hour
+
+// Pool is a community energy pool. Members buy shares at SharePrice, which
+// adds to the pool's capital, and contribute the metered surplus of intervals
+// in which they did not trade to its Energy. Settlement sells or distributes
+// the pooled energy in proportion to shares. The pool's tokens are held in
+// the account named by poolAccount.
+type Pool struct {
+	PoolID        string  `json:"poolID"`
+	Name          string  `json:"name"`
+	Manager       string  `json:"manager"`
+	SharePrice    float64 `json:"sharePrice"`
+	Distribution  string  `json:"distribution"`
+	TotalShares   int     `json:"totalShares"`
+	MemberCount   int     `json:"memberCount"`
+	Capital       float64 `json:"capital"`
+	Energy        float64 `json:"energy"`
+	CreatedAt     string  `json:"createdAt"`
+	LastSettledAt string  `json:"lastSettledAt,omitempty"`
+	Version       int64   `json:"version"`
+}
+
+// PoolMember is a member's holding in a pool and its contributions
+type PoolMember struct {
+	PoolID            string  `json:"poolID"`
+	Member            string  `json:"member"`
+	Shares            int     `json:"shares"`
+	EnergyContributed float64 `json:"energyContributed"`
+	FundsContributed  float64 `json:"fundsContributed"`
+	JoinedAt          string  `json:"joinedAt"`
+}
+
+// PoolSettlement records one settlement of a pool. Payouts are tokens for a
+// selling pool and kWh of banked energy for a distributing pool.
+type PoolSettlement struct {
+	PoolID    string             `json:"poolID"`
+	Energy    float64            `json:"energy"`
+	Price     float64            `json:"price,omitempty"`
+	Revenue   float64            `json:"revenue,omitempty"`
+	Payouts   map[string]float64 `json:"payouts"`
+	SettledAt string             `json:"settledAt"`
+}
+
+// PaginatedPoolMemberResult is a page of pool members
+type PaginatedPoolMemberResult struct {
+	Records             []*PoolMember `json:"records"`
+	FetchedRecordsCount int32         `json:"fetchedRecordsCount"`
+	Bookmark            string        `json:"bookmark"`
+}
+
+// poolAccount names the token account of a pool
+func poolAccount(poolID string) string {
+	return "pool-" + poolID
+}
+
+func poolKey(ctx contractapi.TransactionContextInterface, poolID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("pool", []string{poolID})
+}
+
+func poolMemberKey(ctx contractapi.TransactionContextInterface, poolID, member string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("poolmember", []string{poolID, member})
+}
+
+func poolSettlementKey(ctx contractapi.TransactionContextInterface, poolID, settledAt string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("poolsettlement", []string{poolID, settledAt})
+}
+
+func putPool(ctx contractapi.TransactionContextInterface, pool *Pool) error {
+	pool.Version++
+	poolJSON, err := json.Marshal(pool)
+	if err != nil {
+		return err
+	}
+	key, err := poolKey(ctx, pool.PoolID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, poolJSON)
+}
+
+// GetPool returns a community energy pool
+func (e *EnergyTradingContract) GetPool(ctx contractapi.TransactionContextInterface, poolID string) (*Pool, error) {
+	key, err := poolKey(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	poolJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pool %s: %v", poolID, err)
+	}
+	if poolJSON == nil {
+		return nil, fmt.Errorf("pool %s does not exist", poolID)
+	}
+	var pool Pool
+	if err := json.Unmarshal(poolJSON, &pool); err != nil {
+		return nil, err
+	}
+	return &pool, nil
+}
+
+// getPoolMember returns a member's holding in a pool, or nil if the address
+// is not a member
+func getPoolMember(ctx contractapi.TransactionContextInterface, poolID, member string) (*PoolMember, error) {
+	key, err := poolMemberKey(ctx, poolID, member)
+	if err != nil {
+		return nil, err
+	}
+	memberJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read member %s of pool %s: %v", member, poolID, err)
+	}
+	if memberJSON == nil {
+		return nil, nil
+	}
+	var poolMember PoolMember
+	if err := json.Unmarshal(memberJSON, &poolMember); err != nil {
+		return nil, err
+	}
+	return &poolMember, nil
+}
+
+func putPoolMember(ctx contractapi.TransactionContextInterface, member *PoolMember) error {
+	memberJSON, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+	key, err := poolMemberKey(ctx, member.PoolID, member.Member)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, memberJSON)
+}
+
+func delPoolMember(ctx contractapi.TransactionContextInterface, poolID, member string) error {
+	key, err := poolMemberKey(ctx, poolID, member)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().DelState(key)
+}
+
+// requirePoolMember fails unless the caller is a member of the pool, and
+// returns its holding
+func requirePoolMember(ctx contractapi.TransactionContextInterface, poolID string) (*PoolMember, error) {
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	member, err := getPoolMember(ctx, poolID, caller)
+	if err != nil {
+		return nil, err
+	}
+	if member == nil {
+		return nil, fmt.Errorf("%s is not a member of pool %s", caller, poolID)
+	}
+	return member, nil
+}
+
+// GetPoolMembers returns a page of a pool's members
+func (e *EnergyTradingContract) GetPoolMembers(ctx contractapi.TransactionContextInterface, poolID string, pageSize int32, bookmark string) (*PaginatedPoolMemberResult, error) {
+	result := &PaginatedPoolMemberResult{Records: []*PoolMember{}}
+	metadata, err := queryPage(ctx, "poolmember", []string{poolID}, pageSize, bookmark, func(value []byte) error {
+		var member PoolMember
+		if err := json.Unmarshal(value, &member); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &member)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// addPoolMember admits a member holding no shares yet. Members need a token
+// account for payouts, and pools are settled in a single transaction, so
+// membership is capped at the batch size.
+func addPoolMember(ctx contractapi.TransactionContextInterface, pool *Pool, address string) (*PoolMember, error) {
+	if _, err := requireApprovedParticipant(ctx, address); err != nil {
+		return nil, err
+	}
+	exists, err := tokenAccountExists(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("account %s does not exist", address)
+	}
+	if err := checkBatchSize(ctx, pool.MemberCount+1, "pool members"); err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pool.MemberCount++
+	return &PoolMember{PoolID: pool.PoolID, Member: address, JoinedAt: now}, nil
+}
+
+// CreatePool creates a community energy pool managed by the caller
+func (e *EnergyTradingContract) CreatePool(ctx contractapi.TransactionContextInterface, poolID, name string, sharePrice float64, distribution string) (*Pool, error) {
+	if sharePrice <= 0 {
+		return nil, fmt.Errorf("share price must be positive")
+	}
+	if distribution != PoolSell && distribution != PoolDistribute {
+		return nil, fmt.Errorf("distribution must be %s or %s", PoolSell, PoolDistribute)
+	}
+	manager, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := requireApprovedParticipant(ctx, manager); err != nil {
+		return nil, err
+	}
+	key, err := poolKey(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pool %s: %v", poolID, err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("pool %s already exists", poolID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := putTokenAccount(ctx, &TokenAccount{AccountID: poolAccount(poolID)}); err != nil {
+		return nil, err
+	}
+	pool := &Pool{
+		PoolID:       poolID,
+		Name:         name,
+		Manager:      manager,
+		SharePrice:   sharePrice,
+		Distribution: distribution,
+		CreatedAt:    now,
+	}
+	if err := putPool(ctx, pool); err != nil {
+		return nil, err
+	}
+	return pool, emitEvent(ctx, EventPoolChanged, pool)
+}
+
+// JoinPool makes the caller a member holding the given number of shares,
+// paying the share price for each into the pool's capital
+func (e *EnergyTradingContract) JoinPool(ctx contractapi.TransactionContextInterface, poolID string, shares int) (*PoolMember, error) {
+	if shares <= 0 {
+		return nil, fmt.Errorf("shares must be positive")
+	}
+	pool, err := e.GetPool(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getPoolMember(ctx, poolID, caller)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("%s is already a member of pool %s", caller, poolID)
+	}
+	member, err := addPoolMember(ctx, pool, caller)
+	if err != nil {
+		return nil, err
+	}
+	price := float64(shares) * pool.SharePrice
+	if err := transferTokens(ctx, caller, poolAccount(poolID), price); err != nil {
+		return nil, fmt.Errorf("failed to pay for %d shares of pool %s: %v", shares, poolID, err)
+	}
+	member.Shares = shares
+	member.FundsContributed = price
+	pool.TotalShares += shares
+	pool.Capital += price
+	if err := putPoolMember(ctx, member); err != nil {
+		return nil, err
+	}
+	if err := putPool(ctx, pool); err != nil {
+		return nil, err
+	}
+	return member, emitEvent(ctx, EventPoolChanged, pool)
+}
+
+// LeavePool redeems the caller's shares for its part of the pool's capital.
+// Energy contributed since the last settlement stays with the pool.
+func (e *EnergyTradingContract) LeavePool(ctx contractapi.TransactionContextInterface, poolID string) (*Pool, error) {
+	pool, err := e.GetPool(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	member, err := requirePoolMember(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	if member.Shares > 0 {
+		redemption := pool.Capital * float64(member.Shares) / float64(pool.TotalShares)
+		if redemption > 0 {
+			if err := transferTokens(ctx, poolAccount(poolID), member.Member, redemption); err != nil {
+				return nil, err
+			}
+		}
+		pool.Capital -= redemption
+		pool.TotalShares -= member.Shares
+	}
+	pool.MemberCount--
+	if err := delPoolMember(ctx, poolID, member.Member); err != nil {
+		return nil, err
+	}
+	if err := putPool(ctx, pool); err != nil {
+		return nil, err
+	}
+	return pool, emitEvent(ctx, EventPoolChanged, pool)
+}
+
+// TransferPoolShares transfers some of the caller's shares to another
+// approved participant, who becomes a member if it is not one already. A
+// member left without shares leaves the pool.
+func (e *EnergyTradingContract) TransferPoolShares(ctx contractapi.TransactionContextInterface, poolID, to string, shares int) (*PoolMember, error) {
+	if shares <= 0 {
+		return nil, fmt.Errorf("shares must be positive")
+	}
+	pool, err := e.GetPool(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	from, err := requirePoolMember(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	if to == from.Member {
+		return nil, fmt.Errorf("cannot transfer shares to the same member")
+	}
+	if from.Shares < shares {
+		return nil, fmt.Errorf("%s holds only %d shares of pool %s", from.Member, from.Shares, poolID)
+	}
+	recipient, err := getPoolMember(ctx, poolID, to)
+	if err != nil {
+		return nil, err
+	}
+	if recipient == nil {
+		if recipient, err = addPoolMember(ctx, pool, to); err != nil {
+			return nil, err
+		}
+	}
+	from.Shares -= shares
+	recipient.Shares += shares
+	if from.Shares == 0 {
+		pool.MemberCount--
+		err = delPoolMember(ctx, poolID, from.Member)
+	} else {
+		err = putPoolMember(ctx, from)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := putPoolMember(ctx, recipient); err != nil {
+		return nil, err
+	}
+	if err := putPool(ctx, pool); err != nil {
+		return nil, err
+	}
+	return recipient, emitEvent(ctx, EventPoolChanged, pool)
+}
+
+// ContributePoolFunds adds tokens from the caller to the pool's capital
+func (e *EnergyTradingContract) ContributePoolFunds(ctx contractapi.TransactionContextInterface, poolID string, amount float64) (*PoolMember, error) {
+	pool, err := e.GetPool(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	member, err := requirePoolMember(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	if err := transferTokens(ctx, member.Member, poolAccount(poolID), amount); err != nil {
+		return nil, err
+	}
+	member.FundsContributed += amount
+	pool.Capital += amount
+	if err := putPoolMember(ctx, member); err != nil {
+		return nil, err
+	}
+	if err := putPool(ctx, pool); err != nil {
+		return nil, err
+	}
+	return member, emitEvent(ctx, EventPoolChanged, pool)
+}
+
+// ContributePoolEnergy adds the caller's metered surplus of an ended interval
+// in which it did not trade to the pool. The interval is recorded in the
+// caller's energy bank entries, so it can be neither banked nor contributed
+// again.
+func (e *EnergyTradingContract) ContributePoolEnergy(ctx contractapi.TransactionContextInterface, poolID, intervalStart string) (*PoolMember, error) {
+	pool, err := e.GetPool(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	member, err := requirePoolMember(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	entry, key, err := bankableInterval(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Metered <= 0 {
+		return nil, fmt.Errorf("participant %s has no surplus in interval %s", entry.Participant, entry.IntervalStart)
+	}
+	account, err := e.GetEnergyCreditAccount(ctx, entry.Participant)
+	if err != nil {
+		return nil, err
+	}
+	entry.Kind = BankPoolContribution
+	entry.PoolID = poolID
+	if err := putEnergyBankEntry(ctx, key, entry, account); err != nil {
+		return nil, err
+	}
+	member.EnergyContributed += entry.Metered
+	pool.Energy += entry.Metered
+	if err := putPoolMember(ctx, member); err != nil {
+		return nil, err
+	}
+	if err := putPool(ctx, pool); err != nil {
+		return nil, err
+	}
+	return member, emitEvent(ctx, EventPoolChanged, pool)
+}
+
+// SettlePool sells or distributes the pool's energy in proportion to shares;
+// only the manager may call it, at most once per PoolSettlementInterval. A
+// selling pool sells to the grid operator at the reference price in effect
+// and pays the revenue out, and keeps its energy while that price is not
+// positive; a distributing pool credits the energy to the members' energy
+// bank accounts, without round-trip loss.
+func (e *EnergyTradingContract) SettlePool(ctx contractapi.TransactionContextInterface, poolID string) (*PoolSettlement, error) {
+	pool, err := e.GetPool(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, pool.Manager); err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if pool.LastSettledAt != "" {
+		last, err := parseTimestamp(pool.LastSettledAt)
+		if err != nil {
+			return nil, err
+		}
+		if next := last.Add(PoolSettlementInterval); now.Before(next) {
+			return nil, fmt.Errorf("pool %s cannot be settled again before %s", poolID, next.Format(time.RFC3339))
+		}
+	}
+	if pool.Energy <= 0 || pool.TotalShares == 0 {
+		return nil, fmt.Errorf("pool %s has no energy to settle", poolID)
+	}
+
+	settlement := &PoolSettlement{PoolID: poolID, Energy: pool.Energy, Payouts: map[string]float64{}, SettledAt: now.Format(time.RFC3339)}
+	if pool.Distribution == PoolSell {
+		referencePrice, err := referencePriceAt(ctx, now)
+		if err != nil {
+			return nil, err
+		}
+		if referencePrice == nil {
+			return nil, fmt.Errorf("no reference price is in effect at %s", settlement.SettledAt)
+		}
+		if referencePrice.Price <= 0 {
+			return nil, fmt.Errorf("pool %s cannot sell at reference price %v", poolID, referencePrice.Price)
+		}
+		settlement.Price = referencePrice.Price
+		settlement.Revenue = pool.Energy * referencePrice.Price
+		if err := settleWithGrid(ctx, poolAccount(poolID), settlement.Revenue); err != nil {
+			return nil, err
+		}
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("poolmember", []string{poolID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var member PoolMember
+		if err := json.Unmarshal(queryResponse.Value, &member); err != nil {
+			return nil, err
+		}
+		if member.Shares == 0 {
+			continue
+		}
+		fraction := float64(member.Shares) / float64(pool.TotalShares)
+		if pool.Distribution == PoolSell {
+			payout := settlement.Revenue * fraction
+			if err := transferTokens(ctx, poolAccount(poolID), member.Member, payout); err != nil {
+				return nil, err
+			}
+			settlement.Payouts[member.Member] = payout
+			continue
+		}
+		account, err := e.GetEnergyCreditAccount(ctx, member.Member)
+		if err != nil {
+			return nil, err
+		}
+		credit := pool.Energy * fraction
+		account.Balance += credit
+		account.Deposited += credit
+		if err := putEnergyCreditAccount(ctx, account); err != nil {
+			return nil, err
+		}
+		settlement.Payouts[member.Member] = credit
+	}
+
+	settlementJSON, err := json.Marshal(settlement)
+	if err != nil {
+		return nil, err
+	}
+	key, err := poolSettlementKey(ctx, poolID, settlement.SettledAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, settlementJSON); err != nil {
+		return nil, err
+	}
+	pool.Energy = 0
+	pool.LastSettledAt = settlement.SettledAt
+	if err := putPool(ctx, pool); err != nil {
+		return nil, err
+	}
+	return settlement, emitEvent(ctx, EventPoolSettled, settlement)
+}
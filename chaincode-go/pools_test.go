@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSellingPool(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "seller2", RoleProsumer)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestMeter(t, e, tc, "seller1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "seller1", 3))
+	require.NoError(t, e.MintTokens(tc, "seller2", 1))
+
+	_, err := e.CreatePool(tc.as("seller1", ""), "pool1", "Street solar", 0.5, "HOLD")
+	require.EqualError(t, err, "distribution must be SELL or DISTRIBUTE")
+	_, err = e.CreatePool(tc, "pool1", "Street solar", 0.5, PoolSell)
+	require.NoError(t, err)
+	_, err = e.JoinPool(tc, "pool1", 3)
+	require.NoError(t, err)
+	_, err = e.JoinPool(tc, "pool1", 1)
+	require.EqualError(t, err, "seller1 is already a member of pool pool1")
+	_, err = e.JoinPool(tc.as("seller2", ""), "pool1", 4)
+	require.EqualError(t, err, "failed to pay for 4 shares of pool pool1: account seller2 has insufficient balance")
+	_, err = e.JoinPool(tc, "pool1", 1)
+	require.NoError(t, err)
+	_, err = e.ContributePoolFunds(tc.as("buyer1", ""), "pool1", 1)
+	require.EqualError(t, err, "buyer1 is not a member of pool pool1")
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	_, err = e.ContributePoolEnergy(tc.as("seller1", ""), "pool1", "2025-05-03T10:00:00Z")
+	require.NoError(t, err)
+	member, err := e.ContributePoolEnergy(tc, "pool1", "2025-05-03T10:15:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 4.0, member.EnergyContributed)
+	// A contributed interval cannot also be banked
+	_, err = e.DepositSurplusEnergy(tc, "2025-05-03T10:00:00Z")
+	require.EqualError(t, err, "participant seller1 has already banked interval 2025-05-03T10:00:00Z")
+
+	_, err = e.SettlePool(tc.as("seller2", ""), "pool1")
+	require.EqualError(t, err, "caller seller2 is not authorized to act for seller1")
+	settlement, err := e.SettlePool(tc.as("seller1", ""), "pool1")
+	require.NoError(t, err)
+	require.InDelta(t, 0.8, settlement.Revenue, 1e-9)
+	require.InDelta(t, 0.6, settlement.Payouts["seller1"], 1e-9)
+	require.InDelta(t, 0.2, settlement.Payouts["seller2"], 1e-9)
+	_, err = e.SettlePool(tc, "pool1")
+	require.EqualError(t, err, "pool pool1 cannot be settled again before 2025-05-04T11:30:00Z")
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventPoolSettled, name)
+
+	// Shares move between members and a member left without shares leaves
+	_, err = e.TransferPoolShares(tc.as("seller2", ""), "pool1", "buyer1", 2)
+	require.EqualError(t, err, "seller2 holds only 1 shares of pool pool1")
+	_, err = e.TransferPoolShares(tc, "pool1", "buyer1", 1)
+	require.EqualError(t, err, "account buyer1 does not exist")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 1))
+	tc.as("seller2", "")
+	recipient, err := e.TransferPoolShares(tc, "pool1", "buyer1", 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, recipient.Shares)
+	members, err := e.GetPoolMembers(tc, "pool1", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, members.Records, 2)
+
+	// Leaving redeems the member's part of the capital
+	pool, err := e.LeavePool(tc.as("buyer1", ""), "pool1")
+	require.NoError(t, err)
+	require.Equal(t, 3, pool.TotalShares)
+	require.Equal(t, 1, pool.MemberCount)
+	require.InDelta(t, 1.5, pool.Capital, 1e-9)
+	balance, err := e.BalanceOf(tc, "buyer1", EnergyTokenID)
+	require.NoError(t, err)
+	require.InDelta(t, 1.5, balance, 1e-9)
+}
+
+func TestDistributingPool(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestMeter(t, e, tc, "seller1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "seller1", 1))
+	require.NoError(t, e.MintTokens(tc, "buyer1", 1))
+
+	_, err := e.CreatePool(tc.as("seller1", ""), "pool1", "Street solar", 0.25, PoolDistribute)
+	require.NoError(t, err)
+	_, err = e.JoinPool(tc, "pool1", 1)
+	require.NoError(t, err)
+	_, err = e.JoinPool(tc.as("buyer1", ""), "pool1", 3)
+	require.NoError(t, err)
+	_, err = e.SettlePool(tc.as("seller1", ""), "pool1")
+	require.EqualError(t, err, "pool pool1 has no energy to settle")
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	_, err = e.ContributePoolEnergy(tc.as("seller1", ""), "pool1", "2025-05-03T10:00:00Z")
+	require.NoError(t, err)
+	settlement, err := e.SettlePool(tc, "pool1")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, settlement.Revenue)
+	require.Equal(t, 0.5, settlement.Payouts["seller1"])
+	require.Equal(t, 1.5, settlement.Payouts["buyer1"])
+	account, err := e.GetEnergyCreditAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, 1.5, account.Balance)
+	pool, err := e.GetPool(tc, "pool1")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, pool.Energy)
+	require.Equal(t, "2025-05-03T11:30:00Z", pool.LastSettledAt)
+}
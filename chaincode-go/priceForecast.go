@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// MinForecastInterval is the shortest interval a price forecast divides its
+// day into, matching the meter interval
+const MinForecastInterval = 15 * time.Minute
+
+// PriceForecastInterval is the forecast clearing price of one interval with
+// the bounds the forecaster expects it to fall within
+type PriceForecastInterval struct {
+	Period string  `json:"period"`
+	Price  float64 `json:"price"`
+	Low    float64 `json:"low"`
+	High   float64 `json:"high"`
+}
+
+// PriceForecast is an oracle's forecast of the clearing prices of one UTC
+// day. It is advisory: participants consult it when bidding, and nothing
+// on-chain enforces it.
+type PriceForecast struct {
+	Day       string                   `json:"day"`
+	Model     string                   `json:"model"`
+	Intervals []*PriceForecastInterval `json:"intervals"`
+	Oracle    string                   `json:"oracle"`
+	PostedAt  string                   `json:"postedAt"`
+}
+
+func priceForecastKey(ctx contractapi.TransactionContextInterface, day string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("priceforecast", []string{day})
+}
+
+// PostPriceForecast records the forecast clearing prices of a UTC day, given
+// as YYYY-MM-DD. The day is split into as many equal intervals as there are
+// prices, each with the low and high bound at the same index; like reference
+// prices, forecasts may be negative. Days that have begun cannot be forecast;
+// a later forecast for the same day replaces the earlier one.
+func (e *EnergyTradingContract) PostPriceForecast(ctx contractapi.TransactionContextInterface, day, model string, prices, lows, highs []float64) (*PriceForecast, error) {
+	start, err := time.Parse(rollupDayLayout, day)
+	if err != nil {
+		return nil, fmt.Errorf("day must be formatted as YYYY-MM-DD: %v", err)
+	}
+	if model == "" {
+		return nil, fmt.Errorf("model must not be empty")
+	}
+	if len(prices) != len(lows) || len(prices) != len(highs) {
+		return nil, fmt.Errorf("prices, lows and highs must have the same length")
+	}
+	if len(prices) == 0 || 24*time.Hour%time.Duration(len(prices)) != 0 || 24*time.Hour/time.Duration(len(prices)) < MinForecastInterval {
+		return nil, fmt.Errorf("%d prices do not split a day into equal intervals of at least %v", len(prices), MinForecastInterval)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !start.After(now) {
+		return nil, fmt.Errorf("day %s has already begun", day)
+	}
+	oracle, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := 24 * time.Hour / time.Duration(len(prices))
+	forecast := &PriceForecast{
+		Day:       day,
+		Model:     model,
+		Intervals: make([]*PriceForecastInterval, len(prices)),
+		Oracle:    oracle,
+		PostedAt:  now.Format(time.RFC3339),
+	}
+	for i, price := range prices {
+		if lows[i] > price || price > highs[i] {
+			return nil, fmt.Errorf("forecast %d of %v is outside its bounds [%v, %v]", i+1, price, lows[i], highs[i])
+		}
+		forecast.Intervals[i] = &PriceForecastInterval{
+			Period: start.Add(time.Duration(i) * interval).Format(time.RFC3339),
+			Price:  price,
+			Low:    lows[i],
+			High:   highs[i],
+		}
+	}
+	forecastJSON, err := json.Marshal(forecast)
+	if err != nil {
+		return nil, err
+	}
+	key, err := priceForecastKey(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, forecastJSON); err != nil {
+		return nil, err
+	}
+	return forecast, emitEvent(ctx, EventPriceForecastPosted, forecast)
+}
+
+// GetPriceForecast returns the latest price forecast for a UTC day
+func (e *EnergyTradingContract) GetPriceForecast(ctx contractapi.TransactionContextInterface, day string) (*PriceForecast, error) {
+	key, err := priceForecastKey(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	forecastJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read price forecast: %v", err)
+	}
+	if forecastJSON == nil {
+		return nil, fmt.Errorf("no price forecast has been posted for %s", day)
+	}
+	var forecast PriceForecast
+	if err := json.Unmarshal(forecastJSON, &forecast); err != nil {
+		return nil, err
+	}
+	return &forecast, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriceForecast(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.as("oracle1", RoleOracle)
+
+	prices := make([]float64, 24)
+	lows := make([]float64, 24)
+	highs := make([]float64, 24)
+	for i := range prices {
+		prices[i], lows[i], highs[i] = 0.2, 0.15, 0.25
+	}
+	_, err := e.PostPriceForecast(tc, "2025-05-01", "seasonal", prices, lows, highs)
+	require.EqualError(t, err, "day 2025-05-01 has already begun")
+	_, err = e.PostPriceForecast(tc, "2025-05-02", "seasonal", prices[:7], lows[:7], highs[:7])
+	require.EqualError(t, err, "7 prices do not split a day into equal intervals of at least 15m0s")
+	highs[3] = 0.1
+	_, err = e.PostPriceForecast(tc, "2025-05-02", "seasonal", prices, lows, highs)
+	require.EqualError(t, err, "forecast 4 of 0.2 is outside its bounds [0.15, 0.1]")
+	highs[3] = 0.25
+
+	_, err = e.GetPriceForecast(tc, "2025-05-02")
+	require.EqualError(t, err, "no price forecast has been posted for 2025-05-02")
+	_, err = e.PostPriceForecast(tc, "2025-05-02", "seasonal", prices, lows, highs)
+	require.NoError(t, err)
+	prices[10] = 0.3
+	highs[10] = 0.35
+	_, err = e.PostPriceForecast(tc, "2025-05-02", "seasonal", prices, lows, highs)
+	require.NoError(t, err)
+
+	forecast, err := e.GetPriceForecast(tc, "2025-05-02")
+	require.NoError(t, err)
+	require.Len(t, forecast.Intervals, 24)
+	require.Equal(t, "oracle1", forecast.Oracle)
+	require.Equal(t, &PriceForecastInterval{Period: "2025-05-02T10:00:00Z", Price: 0.3, Low: 0.15, High: 0.35}, forecast.Intervals[10])
+}
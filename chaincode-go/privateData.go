@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// TradeCollectionPrefix names the private data collections holding negotiated
+// prices and deposits. There is one collection for each pair of trading
+// organizations, named after their sorted MSP IDs, and one for each
+// organization's trades among its own participants, so an organization only
+// receives the terms of trades its participants are party to. Each collection
+// is also shared with the regulator and defined in collections_config.json.
+// Writes are not limited to member clients, since an operator of another
+// organization may clear a trade, but need the endorsement of a peer of each of
+// the collection's trading organizations.
+const TradeCollectionPrefix = "energyTradePrivate"
+
+// RegulatorMSPID is the MSP of the regulator organization until an admin sets
+// another with SetRegulator
+const RegulatorMSPID = "RegulatorMSP"
+
+// tradePrivateTransientKey is the transient map entry carrying TradePrivateDetails
+const tradePrivateTransientKey = "trade_private"
+
+// TradePrivateDetails are the commercially sensitive terms of a trade. The
+// salt makes the public hash resistant to guessing low-entropy prices.
+type TradePrivateDetails struct {
+	TokenID          string  `json:"tokenID"`
+	TransactionPrice float64 `json:"transactionPrice"`
+	BuyerDeposit     float64 `json:"buyerDeposit"`
+	SellerDeposit    float64 `json:"sellerDeposit"`
+	Salt             string  `json:"salt"`
+}
+
+// hashPrivateDetails returns the hex SHA-256 of the private details as stored
+func hashPrivateDetails(detailsJSON []byte) string {
+	digest := sha256.Sum256(detailsJSON)
+	return hex.EncodeToString(digest[:])
+}
+
+// readTransientPrivateDetails reads the trade's private terms from the
+// transient map so they never appear in the transaction proposal arguments.
+func readTransientPrivateDetails(ctx contractapi.TransactionContextInterface, tokenID string) (*TradePrivateDetails, error) {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transient map: %v", err)
+	}
+	detailsJSON, ok := transientMap[tradePrivateTransientKey]
+	if !ok {
+		return nil, fmt.Errorf("%s must be supplied in the transient map", tradePrivateTransientKey)
+	}
+	var details TradePrivateDetails
+	if err := json.Unmarshal(detailsJSON, &details); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", tradePrivateTransientKey, err)
+	}
+	if details.Salt == "" {
+		return nil, fmt.Errorf("%s must include a salt", tradePrivateTransientKey)
+	}
+	if details.BuyerDeposit < 0 || details.SellerDeposit < 0 {
+		return nil, fmt.Errorf("deposits must not be negative")
+	}
+	details.TokenID = tokenID
+	return &details, nil
+}
+
+// tradeCollection returns the collection shared by the organizations of the
+// given participants
+func tradeCollection(ctx contractapi.TransactionContextInterface, addresses ...string) (string, error) {
+	orgs, err := partyOrgs(ctx, addresses...)
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(orgs)
+	collection := TradeCollectionPrefix
+	for i, org := range orgs {
+		if i == 0 || org != orgs[i-1] {
+			collection += "_" + org
+		}
+	}
+	return collection, nil
+}
+
+// putPrivateDetails stores the private terms in the collection of the buyer's
+// and seller's organizations and returns their hash
+func putPrivateDetails(ctx contractapi.TransactionContextInterface, buyerAddress, sellerAddress string, details *TradePrivateDetails) (string, error) {
+	collection, err := tradeCollection(ctx, buyerAddress, sellerAddress)
+	if err != nil {
+		return "", err
+	}
+	detailsJSON, err := canonicalJSON(details)
+	if err != nil {
+		return "", err
+	}
+	if err := ctx.GetStub().PutPrivateData(collection, details.TokenID, detailsJSON); err != nil {
+		return "", fmt.Errorf("failed to put private details of %s: %v", details.TokenID, err)
+	}
+	return hashPrivateDetails(detailsJSON), nil
+}
+
+// getPrivateDetails reads the private terms of a trade and checks them against
+// the hash committed in public state.
+func getPrivateDetails(ctx contractapi.TransactionContextInterface, asset *EnergyAsset) (*TradePrivateDetails, error) {
+	collection, err := tradeCollection(ctx, asset.BuyerAddress, asset.SellerAddress)
+	if err != nil {
+		return nil, err
+	}
+	detailsJSON, err := ctx.GetStub().GetPrivateData(collection, asset.TokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private details of %s: %v", asset.TokenID, err)
+	}
+	if detailsJSON == nil {
+		return nil, fmt.Errorf("private details of %s are not available on this peer", asset.TokenID)
+	}
+	if hashPrivateDetails(detailsJSON) != asset.PrivateDetailsHash {
+		return nil, fmt.Errorf("private details of %s do not match the public hash", asset.TokenID)
+	}
+	var details TradePrivateDetails
+	if err := json.Unmarshal(detailsJSON, &details); err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
+
+// ReadTradePrivateDetails returns the price and deposits of a trade to one of
+// its parties or to the regulator.
+func (e *EnergyTradingContract) ReadTradePrivateDetails(ctx contractapi.TransactionContextInterface, tokenID string) (*TradePrivateDetails, error) {
+	asset, err := e.ReadEnergyAsset(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	regulator, err := isRegulator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !regulator {
+		if _, err := requireParty(ctx, asset.BuyerAddress, asset.SellerAddress); err != nil {
+			return nil, err
+		}
+	}
+	return getPrivateDetails(ctx, asset)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// recoveringChaincode wraps the contract chaincode so that a panic in a
+// transaction function, such as a nil dereference on missing state, fails
+// that transaction with an error response instead of crashing the chaincode
+// process and every transaction in flight with it. The stack is logged on
+// the peer; the client only sees the function, transaction ID and cause.
+// Every invocation and its outcome is logged with the transaction's fields.
+type recoveringChaincode struct {
+	shim.Chaincode
+}
+
+func (cc recoveringChaincode) Init(stub shim.ChaincodeStubInterface) (response peer.Response) {
+	logger := newTxLogger(stub)
+	defer logOutcome(logger, &response)
+	defer recoverTransaction(stub, logger, &response)
+	return cc.Chaincode.Init(stub)
+}
+
+func (cc recoveringChaincode) Invoke(stub shim.ChaincodeStubInterface) (response peer.Response) {
+	logger := newTxLogger(stub)
+	logger.Debugf("transaction started")
+	defer logOutcome(logger, &response)
+	defer recoverTransaction(stub, logger, &response)
+	return cc.Chaincode.Invoke(stub)
+}
+
+// recoverTransaction turns a panic into an error response
+func recoverTransaction(stub shim.ChaincodeStubInterface, logger *txLogger, response *peer.Response) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	logger.Errorf("recovered from panic: %v\n%s", r, debug.Stack())
+	*response = shim.Error(fmt.Sprintf("%s: internal error in transaction %s: %v", transactionFunction(stub), stub.GetTxID(), r))
+}
+
+// logOutcome logs whether the transaction succeeded
+func logOutcome(logger *txLogger, response *peer.Response) {
+	if response.Status >= shim.ERRORTHRESHOLD {
+		logger.Warningf("transaction failed: %s", response.Message)
+		return
+	}
+	logger.Debugf("transaction succeeded")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/hyperledger/fabric-samples/asset-transfer-basic/chaincode-go/chaincode/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// panickingChaincode dereferences a missing asset, as a transaction function
+// that skipped its existence check would
+type panickingChaincode struct{}
+
+func (panickingChaincode) Init(stub shim.ChaincodeStubInterface) peer.Response {
+	return shim.Success(nil)
+}
+
+func (panickingChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
+	var asset *EnergyAsset
+	return shim.Success([]byte(asset.TokenID))
+}
+
+func TestRecoveringChaincode(t *testing.T) {
+	stub := &mocks.ChaincodeStub{}
+	stub.GetFunctionAndParametersReturns("ReadEnergyAsset", []string{"energy1"})
+	stub.GetTxIDReturns("tx1")
+	cc := recoveringChaincode{panickingChaincode{}}
+
+	response := cc.Invoke(stub)
+	require.Equal(t, int32(shim.ERROR), response.Status)
+	require.Equal(t, "ReadEnergyAsset: internal error in transaction tx1: runtime error: invalid memory address or nil pointer dereference", response.Message)
+
+	response = cc.Init(stub)
+	require.Equal(t, int32(shim.OK), response.Status)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// PriceBandTolerance is how far, as a fraction of the reference price's
+// magnitude, a negotiated trade price may deviate from the reference price in
+// effect when the trade is created. This is the default; governance proposals can
+// change it.
+const PriceBandTolerance = 0.5
+
+// MinPriceBandWidth is the least distance, in tokens per kWh, the price band
+// extends on either side of the reference price, so that a reference price
+// at or near zero still leaves room to trade. This is the default;
+// governance proposals can change it.
+const MinPriceBandWidth = 0.05
+
+// ReferencePrice is a grid or utility reference price posted by an oracle. It
+// applies from Period until the next posted period.
+type ReferencePrice struct {
+	Period   string  `json:"period"`
+	Price    float64 `json:"price"`
+	Oracle   string  `json:"oracle"`
+	PostedAt string  `json:"postedAt"`
+}
+
+// referencePriceIndexKey holds the first posted period and the reference
+// price with the latest period, which is the one in effect from then on. The
+// prices are also indexed by the UTC day of their period, so a price in
+// effect in the past is found by scanning a day rather than the whole history.
+const referencePriceIndexKey = "refpriceindex"
+
+type referencePriceIndex struct {
+	First  string          `json:"first"`
+	Latest *ReferencePrice `json:"latest"`
+}
+
+func referencePriceKey(ctx contractapi.TransactionContextInterface, period string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("refprice", []string{period})
+}
+
+func referencePriceDayKey(ctx contractapi.TransactionContextInterface, period string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("refpriceday", []string{period[:len("2006-01-02")], period})
+}
+
+func getReferencePriceIndex(ctx contractapi.TransactionContextInterface) (*referencePriceIndex, error) {
+	indexJSON, err := ctx.GetStub().GetState(referencePriceIndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reference price index: %v", err)
+	}
+	if indexJSON == nil {
+		return nil, nil
+	}
+	var index referencePriceIndex
+	if err := json.Unmarshal(indexJSON, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// indexReferencePrice adds a newly posted price to the day index and to the
+// first and latest periods
+func indexReferencePrice(ctx contractapi.TransactionContextInterface, referencePrice *ReferencePrice, referencePriceJSON []byte) error {
+	dayKey, err := referencePriceDayKey(ctx, referencePrice.Period)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(dayKey, referencePriceJSON); err != nil {
+		return err
+	}
+	index, err := getReferencePriceIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if index == nil {
+		index = &referencePriceIndex{First: referencePrice.Period, Latest: referencePrice}
+	}
+	if referencePrice.Period < index.First {
+		index.First = referencePrice.Period
+	}
+	if referencePrice.Period > index.Latest.Period {
+		index.Latest = referencePrice
+	}
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(referencePriceIndexKey, indexJSON)
+}
+
+// PostReferencePrice records the reference price that applies from period
+// onwards. The price may be zero or negative, as it is when solar surpluses
+// exceed demand. Posted prices are never overwritten so that the history can
+// be audited.
+func (e *EnergyTradingContract) PostReferencePrice(ctx contractapi.TransactionContextInterface, period string, price float64) error {
+	period, err := normalizeTimestamp(period)
+	if err != nil {
+		return err
+	}
+	oracle, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := referencePriceKey(ctx, period)
+	if err != nil {
+		return err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read reference price: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("reference price for %s has already been posted", period)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	referencePrice := ReferencePrice{
+		Period:   period,
+		Price:    price,
+		Oracle:   oracle,
+		PostedAt: now,
+	}
+	referencePriceJSON, err := json.Marshal(referencePrice)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, referencePriceJSON); err != nil {
+		return err
+	}
+	if err := indexReferencePrice(ctx, &referencePrice, referencePriceJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventReferencePricePosted, referencePrice)
+}
+
+// GetReferencePrice returns the reference price in effect at the given time
+func (e *EnergyTradingContract) GetReferencePrice(ctx contractapi.TransactionContextInterface, at string) (*ReferencePrice, error) {
+	atTime, err := parseTimestamp(at)
+	if err != nil {
+		return nil, err
+	}
+	referencePrice, err := referencePriceAt(ctx, atTime)
+	if err != nil {
+		return nil, err
+	}
+	if referencePrice == nil {
+		return nil, fmt.Errorf("no reference price is in effect at %s", at)
+	}
+	return referencePrice, nil
+}
+
+// PaginatedReferencePriceResult is a page of reference prices
+type PaginatedReferencePriceResult struct {
+	Records             []*ReferencePrice `json:"records"`
+	FetchedRecordsCount int32             `json:"fetchedRecordsCount"`
+	Bookmark            string            `json:"bookmark"`
+}
+
+// GetReferencePriceHistory returns a page of the reference prices posted for
+// periods in the half-open window [from, to). Prices outside the window are
+// skipped, so a page may hold fewer than pageSize prices.
+func (e *EnergyTradingContract) GetReferencePriceHistory(ctx contractapi.TransactionContextInterface, from, to string, pageSize int32, bookmark string) (*PaginatedReferencePriceResult, error) {
+	fromTime, err := parseTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	toTime, err := parseTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedReferencePriceResult{Records: []*ReferencePrice{}}
+	metadata, err := queryPage(ctx, "refprice", []string{}, pageSize, bookmark, func(value []byte) error {
+		var referencePrice ReferencePrice
+		if err := json.Unmarshal(value, &referencePrice); err != nil {
+			return err
+		}
+		period, err := parseTimestamp(referencePrice.Period)
+		if err != nil {
+			return err
+		}
+		if !period.Before(fromTime) && period.Before(toTime) {
+			result.Records = append(result.Records, &referencePrice)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// referencePriceAt returns the latest reference price whose period starts at
+// or before t, or nil if none has been posted. The latest price answers for
+// any t after its period; otherwise the day index is scanned back from the
+// day of t, which stops at the first posted period.
+func referencePriceAt(ctx contractapi.TransactionContextInterface, t time.Time) (*ReferencePrice, error) {
+	index, err := getReferencePriceIndex(ctx)
+	if err != nil || index == nil {
+		return nil, err
+	}
+	at := t.UTC().Format(time.RFC3339)
+	if index.Latest.Period <= at {
+		return index.Latest, nil
+	}
+	if at < index.First {
+		return nil, nil
+	}
+	for day := t.UTC(); ; day = day.AddDate(0, 0, -1) {
+		referencePrice, err := latestReferencePriceOfDay(ctx, day.Format("2006-01-02"), at)
+		if err != nil || referencePrice != nil {
+			return referencePrice, err
+		}
+	}
+}
+
+// latestReferencePriceOfDay returns the latest reference price posted for a
+// period of the given UTC day that starts at or before at
+func latestReferencePriceOfDay(ctx contractapi.TransactionContextInterface, day, at string) (*ReferencePrice, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("refpriceday", []string{day})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var latest *ReferencePrice
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var referencePrice ReferencePrice
+		if err := json.Unmarshal(queryResponse.Value, &referencePrice); err != nil {
+			return nil, err
+		}
+		if referencePrice.Period > at {
+			break
+		}
+		latest = &referencePrice
+	}
+	return latest, nil
+}
+
+// validatePriceBand checks a negotiated price against the reference price in
+// effect at transaction time. The band is a share of the reference price's
+// magnitude on either side of it, so it keeps its width when the reference
+// price is negative, but never narrower than the minimum band width. Trades
+// are unrestricted until an oracle has posted a price.
+func validatePriceBand(ctx contractapi.TransactionContextInterface, price float64) error {
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	referencePrice, err := referencePriceAt(ctx, now)
+	if err != nil {
+		return err
+	}
+	if referencePrice == nil {
+		return nil
+	}
+	config, err := platformConfigAt(ctx, now)
+	if err != nil {
+		return err
+	}
+	width := math.Max(math.Abs(referencePrice.Price)*config.PriceBandTolerance, config.MinPriceBandWidth)
+	low, high := referencePrice.Price-width, referencePrice.Price+width
+	if price < low || price > high {
+		return fmt.Errorf("price %v is outside the band [%v, %v] around reference price %v", price, low, high, referencePrice.Price)
+	}
+	return nil
+}
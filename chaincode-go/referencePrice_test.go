@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferencePrice(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.as("oracle1", RoleOracle)
+
+	require.NoError(t, e.PostReferencePrice(tc, "2025-05-01T00:00:00Z", 0.1))
+	require.NoError(t, e.PostReferencePrice(tc, "2025-05-01T06:00:00+02:00", 0.5))
+	err := e.PostReferencePrice(tc, "2025-05-01T04:00:00Z", 0.2)
+	require.EqualError(t, err, "reference price for 2025-05-01T04:00:00Z has already been posted")
+
+	_, err = e.GetReferencePrice(tc, "2025-04-30T23:59:59Z")
+	require.EqualError(t, err, "no reference price is in effect at 2025-04-30T23:59:59Z")
+	price, err := e.GetReferencePrice(tc, "2025-05-01T03:59:59Z")
+	require.NoError(t, err)
+	require.Equal(t, 0.1, price.Price)
+	price, err = e.GetReferencePrice(tc, "2025-05-01T08:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 0.5, price.Price)
+	require.Equal(t, "oracle1", price.Oracle)
+
+	history, err := e.GetReferencePriceHistory(tc, "2025-05-01T00:00:00Z", "2025-05-02T00:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, history.Records, 2)
+
+	// The default test trade price of 0.2 is outside 0.5 +/- 50%.
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	err = e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "price 0.2 is outside the band [0.25, 0.75] around reference price 0.5")
+}
+
+func TestReferencePriceInEffectInThePast(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.as("oracle1", RoleOracle)
+
+	require.NoError(t, e.PostReferencePrice(tc, "2025-05-01T22:00:00Z", 0.1))
+	require.NoError(t, e.PostReferencePrice(tc, "2025-05-05T10:00:00Z", 0.3))
+	// Posted out of order, between the two
+	require.NoError(t, e.PostReferencePrice(tc, "2025-05-03T12:00:00Z", 0.2))
+
+	for at, want := range map[string]float64{
+		"2025-05-01T23:00:00Z": 0.1,
+		"2025-05-03T11:59:59Z": 0.1,
+		"2025-05-04T00:00:00Z": 0.2,
+		"2025-05-05T09:00:00Z": 0.2,
+		"2025-05-09T00:00:00Z": 0.3,
+	} {
+		price, err := e.GetReferencePrice(tc, at)
+		require.NoError(t, err)
+		require.Equal(t, want, price.Price, at)
+	}
+	_, err := e.GetReferencePrice(tc, "2025-05-01T21:00:00Z")
+	require.EqualError(t, err, "no reference price is in effect at 2025-05-01T21:00:00Z")
+}
+
+func TestPriceBandMinimumWidth(t *testing.T) {
+	e := &EnergyTradingContract{}
+	for _, reference := range []float64{0, 0.001, -0.001} {
+		tc := newTestContext()
+		require.NoError(t, e.PostReferencePrice(tc.as("oracle1", RoleOracle), "2025-05-01T00:00:00Z", reference))
+		require.NoError(t, validatePriceBand(tc, 0.03), "reference price %v", reference)
+		require.NoError(t, validatePriceBand(tc, -0.04), "reference price %v", reference)
+		require.Error(t, validatePriceBand(tc, 0.06), "reference price %v", reference)
+	}
+
+	// Far from zero the share of the reference price is wider than the minimum
+	tc := newTestContext()
+	require.NoError(t, e.PostReferencePrice(tc.as("oracle1", RoleOracle), "2025-05-01T00:00:00Z", 0.2))
+	require.NoError(t, validatePriceBand(tc, 0.29))
+}
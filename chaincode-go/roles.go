@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Participant roles, taken from the energy.role certificate attribute
+const (
+	RoleAdmin      = "admin"
+	RoleProsumer   = "prosumer"
+	RoleConsumer   = "consumer"
+	RoleAggregator = "aggregator"
+	RoleOperator   = "operator"
+	RoleArbiter    = "arbiter"
+	RoleOracle     = "oracle"
+	RoleRegulator  = "regulator"
+	RoleRelayer    = "relayer"
+)
+
+var registrableRoles = []string{RoleProsumer, RoleConsumer, RoleAggregator, RoleOperator, RoleArbiter, RoleOracle, RoleRegulator, RoleRelayer}
+
+var traderRoles = []string{RoleProsumer, RoleConsumer, RoleAggregator}
+
+// functionRoles lists the roles allowed to call each transaction function.
+// Functions not listed here are open to any identity. The admin role is
+// granted by certificate attribute alone; all other roles must have been
+// registered on-chain with RegisterRole.
+var functionRoles = map[string][]string{
+	"InitLedger":                  {RoleAdmin},
+	"SeedDemoData":                {RoleAdmin},
+	"CreateEnergyAsset":           traderRoles,
+	"SignEnergyAsset":             traderRoles,
+	"ConfirmDelivery":             {RoleProsumer, RoleAggregator},
+	"UpdateReputationScore":       {RoleAdmin, RoleArbiter},
+	"ArchiveSettledAssets":        {RoleAdmin, RoleOperator},
+	"MintTokens":                  {RoleAdmin},
+	"FreezeAccount":               {RoleAdmin},
+	"UnfreezeAccount":             {RoleAdmin},
+	"WithdrawFees":                {RoleAdmin},
+	"ApproveParticipant":          {RoleAdmin},
+	"RejectParticipant":           {RoleAdmin},
+	"CommitMeterHash":             traderRoles,
+	"GrantTradingAuthorization":   {RoleProsumer, RoleConsumer},
+	"RevokeTradingAuthorization":  {RoleProsumer, RoleConsumer},
+	"EraseParticipantData":        {RoleAdmin},
+	"TransferTokens":              traderRoles,
+	"EnrollDevice":                {RoleProsumer, RoleConsumer},
+	"RotateDeviceKey":             {RoleProsumer, RoleConsumer},
+	"RevokeDevice":                {RoleAdmin, RoleProsumer, RoleConsumer},
+	"SubmitMeterReading":          {RoleProsumer, RoleConsumer, RoleOperator},
+	"ReconcileDelivery":           {RoleProsumer, RoleConsumer, RoleAggregator, RoleOperator},
+	"PostReferencePrice":          {RoleOracle},
+	"PostWeatherForecast":         {RoleOracle},
+	"PostPriceForecast":           {RoleOracle},
+	"ChallengeMeterReading":       traderRoles,
+	"RequestReadingEvidence":      {RoleArbiter},
+	"SubmitReadingEvidence":       {RoleProsumer, RoleConsumer},
+	"GetReadingEvidence":          {RoleArbiter},
+	"ResolveMeterDispute":         {RoleArbiter},
+	"AcquireSchedulerLease":       {RoleOperator},
+	"SetGridCapacity":             {RoleOperator},
+	"SetTransformer":              {RoleOperator},
+	"SetNetworkTariff":            {RoleOperator},
+	"IssueCurtailmentOrder":       {RoleOperator},
+	"SetCurtailmentPolicy":        {RoleAdmin},
+	"RegisterStorage":             {RoleProsumer, RoleAggregator},
+	"CommitStorageSchedule":       {RoleProsumer, RoleAggregator},
+	"SettleStorageSchedule":       {RoleProsumer, RoleAggregator, RoleOperator},
+	"OpenChargingSession":         traderRoles,
+	"FillChargingSession":         {RoleProsumer, RoleAggregator},
+	"RecordChargingDelivery":      traderRoles,
+	"CloseChargingSession":        traderRoles,
+	"CreateDemandResponseEvent":   {RoleOperator},
+	"OptInDemandResponse":         traderRoles,
+	"SettleDemandResponse":        {RoleProsumer, RoleConsumer, RoleAggregator, RoleOperator},
+	"SetSlotLength":               {RoleAdmin},
+	"SetZoneIslanded":             {RoleOperator},
+	"SetLossFactor":               {RoleOperator},
+	"SubmitCapacityOffer":         traderRoles,
+	"ClearCapacityMarket":         {RoleOperator},
+	"ActivateCapacityReservation": {RoleOperator},
+	"SetCertificateEnergy":        {RoleAdmin},
+	"RegisterGenerator":           {RoleProsumer, RoleAggregator},
+	"VerifyGenerator":             {RoleOperator},
+	"TransferCertificate":         traderRoles,
+	"RetireCertificate":           traderRoles,
+	"SetGridCarbonIntensity":      {RoleOperator},
+	"GenerateComplianceReport":    {RoleRegulator},
+	"GetComplianceReportRecord":   {RoleRegulator},
+	"SetLevy":                     {RoleAdmin},
+	"RemoveLevy":                  {RoleAdmin},
+	"SetTariffSeason":             {RoleOperator},
+	"RemoveTariffSeason":          {RoleOperator},
+	"SettleUnmatchedEnergy":       {RoleOperator},
+	"CloseBillingPeriod":          {RoleProsumer, RoleConsumer, RoleAggregator, RoleOperator, RoleAdmin, RoleRegulator},
+	"PlaceCertificateOffer":       traderRoles,
+	"PlaceCertificateBid":         traderRoles,
+	"CancelCertificateOrder":      traderRoles,
+	"MatchCertificateBid":         traderRoles,
+	"CreateSubsidyProgram":        {RoleOperator, RoleAdmin},
+	"CloseSubsidyProgram":         {RoleOperator, RoleAdmin},
+	"RegisterBridgeNetwork":       {RoleAdmin},
+	"LockTokensForBridge":         traderRoles,
+	"LockCertificateForBridge":    traderRoles,
+	"ConfirmBridgeTransfer":       {RoleRelayer},
+	"RefundBridgeTransfer":        {RoleRelayer},
+	"ReceiveBridgeTransfer":       {RoleRelayer},
+	"SafeTransferFrom":            traderRoles,
+	"SafeBatchTransferFrom":       traderRoles,
+	"SetApprovalForAll":           traderRoles,
+	"SetTokenURI":                 {RoleAdmin},
+	"EnableDeltaAccount":          {RoleAdmin},
+	"DisableDeltaAccount":         {RoleAdmin},
+	"CompactAccount":              {RoleOperator, RoleAdmin},
+	"GetGridIssuance":             {RoleOperator, RoleAdmin, RoleRegulator},
+	"SetMaxPageSize":              {RoleAdmin},
+	"SetAccountReserve":           {RoleOperator, RoleAdmin},
+	"GetAccountsBelowReserve":     {RoleOperator, RoleAdmin},
+	"SetBatchLimits":              {RoleAdmin},
+	"CreateDailyRollup":           {RoleAdmin},
+	"PruneDailyTrades":            {RoleAdmin},
+	"SettleCapacityReservation":   {RoleProsumer, RoleConsumer, RoleAggregator, RoleOperator},
+	"ProposeForward":              traderRoles,
+	"AcceptForward":               traderRoles,
+	"CancelForwardProposal":       traderRoles,
+	"MarkForwardToMarket":         {RoleOperator, RoleOracle},
+	"PostForwardMargin":           traderRoles,
+	"DeliverForward":              traderRoles,
+	"WriteOption":                 traderRoles,
+	"BuyOption":                   traderRoles,
+	"ExerciseOption":              traderRoles,
+	"WithdrawOption":              traderRoles,
+	"LapseOption":                 {RoleProsumer, RoleConsumer, RoleAggregator, RoleOperator},
+	"SetEnergyBankLoss":           {RoleAdmin},
+	"DepositSurplusEnergy":        {RoleProsumer, RoleAggregator},
+	"WithdrawBankedEnergy":        traderRoles,
+	"CreatePool":                  traderRoles,
+	"JoinPool":                    traderRoles,
+	"LeavePool":                   traderRoles,
+	"TransferPoolShares":          traderRoles,
+	"ContributePoolFunds":         traderRoles,
+	"ContributePoolEnergy":        {RoleProsumer, RoleAggregator},
+	"SettlePool":                  traderRoles,
+	"SetInsuranceTerms":           {RoleAdmin},
+	"ClaimFromInsuranceFund":      traderRoles,
+	"ApproveInsuranceClaim":       {RoleArbiter},
+	"RejectInsuranceClaim":        {RoleArbiter},
+	"StartDutchAuction":           {RoleProsumer, RoleAggregator},
+	"AcceptDutchAuction":          traderRoles,
+	"CancelDutchAuction":          {RoleProsumer, RoleAggregator},
+	"SubmitCommunityOrder":        traderRoles,
+	"CancelCommunityOrder":        traderRoles,
+	"ClearIntraCommunity":         {RoleOperator},
+	"ClearInterCommunity":         {RoleOperator},
+	"AllocateDemandCharge":        {RoleOperator},
+	"PayDemandCharge":             traderRoles,
+	"SetBaselineMethodology":      {RoleOperator},
+	"ComputeBaseline":             {RoleOperator},
+	"CommitBaseline":              {RoleOracle, RoleOperator},
+	"VerifyBaseline":              {RoleOperator, RoleRegulator},
+	"ProposeIndexedForward":       traderRoles,
+	"SetCollateralTerms":          {RoleOperator},
+	"PostTradeCollateral":         traderRoles,
+	"RevalueTradeCollateral":      {RoleArbiter, RoleOperator},
+	"SetNettingEnabled":           {RoleAdmin},
+	"NetSettlement":               {RoleOperator},
+	"FundMilestoneEscrow":         traderRoles,
+	"ReleaseMilestones":           {RoleProsumer, RoleConsumer, RoleAggregator, RoleOperator},
+	"SetArbitrationTerms":         {RoleAdmin},
+	"RegisterArbitrator":          {RoleAdmin},
+	"RemoveArbitrator":            {RoleAdmin},
+	"ReferDisputeToPanel":         traderRoles,
+	"CastArbitrationVote":         {RoleArbiter},
+	"CloseArbitrationVote":        {RoleProsumer, RoleConsumer, RoleAggregator, RoleArbiter, RoleOperator},
+	"SubmitDisputeEvidence":       traderRoles,
+	"SetAdminPolicy":              {RoleAdmin},
+	"ProposeAdminAction":          {RoleAdmin},
+	"ApproveAdminAction":          {RoleAdmin},
+	"ExecuteAdminAction":          {RoleAdmin},
+	"ProposeConfigChange":         traderRoles,
+	"CastGovernanceVote":          traderRoles,
+	"ReleaseGovernanceStake":      traderRoles,
+	"PauseMarket":                 {RoleAdmin},
+	"ResumeMarket":                {RoleAdmin},
+	"SetRegulator":                {RoleAdmin},
+}
+
+// RoleRecord binds a trading address to the role it registered with
+type RoleRecord struct {
+	Address      string `json:"address"`
+	Role         string `json:"role"`
+	MSPID        string `json:"mspID"`
+	RegisteredAt string `json:"registeredAt"`
+}
+
+func roleKey(ctx contractapi.TransactionContextInterface, address string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("role", []string{address})
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// getRoleRecord returns the registered role of an address, or nil if it has none
+func getRoleRecord(ctx contractapi.TransactionContextInterface, address string) (*RoleRecord, error) {
+	key, err := roleKey(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	recordJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read role of %s: %v", address, err)
+	}
+	if recordJSON == nil {
+		return nil, nil
+	}
+	var record RoleRecord
+	if err := json.Unmarshal(recordJSON, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// RegisterRole records the caller's certificate role attribute on-chain
+func (e *EnergyTradingContract) RegisterRole(ctx contractapi.TransactionContextInterface) (*RoleRecord, error) {
+	address, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	role, err := callerRole(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !hasRole(registrableRoles, role) {
+		return nil, fmt.Errorf("certificate role %q cannot be registered", role)
+	}
+	existing, err := getRoleRecord(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("address %s is already registered as %s", address, existing.Role)
+	}
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client MSP ID: %v", err)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &RoleRecord{Address: address, Role: role, MSPID: mspID, RegisteredAt: now}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	key, err := roleKey(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, recordJSON); err != nil {
+		return nil, err
+	}
+	if err := emitEvent(ctx, EventRoleRegistered, ParticipantEvent{Address: address, Status: role}); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// GetRole returns the registered role of an address
+func (e *EnergyTradingContract) GetRole(ctx contractapi.TransactionContextInterface, address string) (*RoleRecord, error) {
+	record, err := getRoleRecord(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("address %s has no registered role", address)
+	}
+	return record, nil
+}
+
+// requireRole fails unless the caller holds one of the allowed roles
+func requireRole(ctx contractapi.TransactionContextInterface, allowed ...string) error {
+	certRole, err := callerRole(ctx)
+	if err != nil {
+		return err
+	}
+	if certRole == RoleAdmin && hasRole(allowed, RoleAdmin) {
+		return nil
+	}
+	address, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	record, err := getRoleRecord(ctx, address)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("caller %s has no registered role", address)
+	}
+	if !hasRole(allowed, record.Role) {
+		return fmt.Errorf("caller %s with role %s is not authorized", address, record.Role)
+	}
+	return nil
+}
+
+// transactionFunction returns the invoked function without its contract name
+func transactionFunction(stub shim.ChaincodeStubInterface) string {
+	fn, _ := stub.GetFunctionAndParameters()
+	if i := strings.LastIndex(fn, ":"); i >= 0 {
+		fn = fn[i+1:]
+	}
+	return fn
+}
+
+// authorizeTransaction enforces functionRoles, the admin approval policy and
+// the market pause
+func authorizeTransaction(ctx contractapi.TransactionContextInterface) error {
+	fn := transactionFunction(ctx.GetStub())
+	allowed, ok := functionRoles[fn]
+	if !ok {
+		return nil
+	}
+	if err := requireRole(ctx, allowed...); err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	if err := requireAdminApproval(ctx, fn); err != nil {
+		return err
+	}
+	return requireMarketOpen(ctx, fn)
+}
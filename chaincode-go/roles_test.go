@@ -0,0 +1,228 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/stretchr/testify/require"
+)
+
+// openFunctions are the transaction functions deliberately left out of
+// functionRoles: queries, which enforce their own visibility rules, and
+// self-registration.
+var openFunctions = []string{
+	"AuditGetAllReputations",
+	"AuditGetFeeLedger",
+	"AuditGetTrades",
+	"BalanceOf",
+	"BalanceOfBatch",
+	"CheckReputationPenalty",
+	"EnactGovernanceProposal",
+	"EnergyAssetExists",
+	"GetAccountFreeze",
+	"GetAccountReserve",
+	"GetAdminAction",
+	"GetAdminPolicy",
+	"GetArbitrationPanel",
+	"GetArbitrationTerms",
+	"GetArbitrators",
+	"GetArchivedTradesByDeliveryWindow",
+	"GetBaseline",
+	"GetBaselineMethodology",
+	"GetBatchLimits",
+	"GetBridgeNetwork",
+	"GetBridgeTransfer",
+	"GetCapacityClearing",
+	"GetCapacityOffers",
+	"GetCapacityReservation",
+	"GetCarbonReport",
+	"GetCertificate",
+	"GetCertificateConfig",
+	"GetCertificateFills",
+	"GetCertificateOrder",
+	"GetCertificatesByOwner",
+	"GetChargingDeliveries",
+	"GetChargingSession",
+	"GetClearingRound",
+	"GetClearingRounds",
+	"GetCollateralTerms",
+	"GetCommunityOrder",
+	"GetCommunityPeak",
+	"GetCurtailmentOrders",
+	"GetCurtailmentPolicy",
+	"GetCurtailments",
+	"GetDailyRollup",
+	"GetDailyRollups",
+	"GetDelegatedActions",
+	"GetDemandChargeAllocation",
+	"GetDemandResponseEnrollment",
+	"GetDemandResponseEnrollments",
+	"GetDemandResponseEvent",
+	"GetDevice",
+	"GetDisputeEvidence",
+	"GetDutchAuction",
+	"GetDutchAuctionPrice",
+	"GetEnergyBankConfig",
+	"GetEnergyBankEntries",
+	"GetEnergyCreditAccount",
+	"GetEnergyOption",
+	"GetFallbackSettlements",
+	"GetForwardContract",
+	"GetForwardsByDeliveryMonth",
+	"GetGenerator",
+	"GetGovernanceProposal",
+	"GetGridCapacity",
+	"GetGridCarbonIntensity",
+	"GetImbalanceRecords",
+	"GetInsuranceClaim",
+	"GetInsuranceTerms",
+	"GetInvoice",
+	"GetInvoices",
+	"GetLedgerInfo",
+	"GetLevySchedule",
+	"GetLossFactor",
+	"GetLossRecords",
+	"GetMarketConfig",
+	"GetMarketPause",
+	"GetMeterDispute",
+	"GetMeterHashCommitment",
+	"GetMeterReadings",
+	"GetMilestoneEscrow",
+	"GetNetObligations",
+	"GetNettingConfig",
+	"GetNetworkTariff",
+	"GetOpenCertificateOrders",
+	"GetOpenCommunityOrders",
+	"GetOpenDutchAuctions",
+	"GetOpenMeterDisputes",
+	"GetOpenTradesBySource",
+	"GetOptionsForSale",
+	"GetParticipant",
+	"GetParticipantPersonalData",
+	"GetPendingAdminActions",
+	"GetPlatformConfig",
+	"GetPool",
+	"GetPoolMembers",
+	"GetPriceForecast",
+	"GetQueryLimits",
+	"GetReferencePrice",
+	"GetReferencePriceHistory",
+	"GetRegulator",
+	"GetRole",
+	"GetSchedulerLease",
+	"GetSelfConsumption",
+	"GetSelfConsumptionRecords",
+	"GetSelfConsumptionSummary",
+	"GetSettlement",
+	"GetTradeCollateral",
+	"GetSigningPayload",
+	"GetStorage",
+	"GetStorageSchedule",
+	"GetStorageSchedules",
+	"GetSubsidyProgram",
+	"GetSubsidyPrograms",
+	"GetTOUTariff",
+	"GetTariffRate",
+	"GetTimeSlot",
+	"GetTradesBySlot",
+	"GetTradesByDeliveryWindow",
+	"GetTradingAuthorization",
+	"GetTransactionEvents",
+	"GetTransformer",
+	"GetTransformerLoad",
+	"GetWeatherForecasts",
+	"GetZoneFlow",
+	"GetZoneStatus",
+	"IsApprovedForAll",
+	"OpenTokenAccount",
+	"ReadEnergyAsset",
+	"ReadReputationScore",
+	"ReadTokenAccount",
+	"ReadTradePrivateDetails",
+	"RegisterParticipant",
+	"RegisterRole",
+	"URI",
+	"VerifyMeterReading",
+}
+
+// contractFunctions returns the transaction functions of the contract,
+// excluding those inherited from contractapi.Contract
+func contractFunctions() []string {
+	inherited := reflect.TypeOf(&contractapi.Contract{})
+	contract := reflect.TypeOf(&EnergyTradingContract{})
+	functions := []string{}
+	for i := 0; i < contract.NumMethod(); i++ {
+		name := contract.Method(i).Name
+		if _, ok := inherited.MethodByName(name); !ok {
+			functions = append(functions, name)
+		}
+	}
+	return functions
+}
+
+// TestFunctionRolesCoverContract fails when a transaction function is added
+// without deciding who may call it, or when functionRoles names a function
+// the contract no longer has.
+func TestFunctionRolesCoverContract(t *testing.T) {
+	functions := contractFunctions()
+	for _, fn := range functions {
+		_, guarded := functionRoles[fn]
+		require.Truef(t, guarded != hasRole(openFunctions, fn), "%s must be listed in exactly one of functionRoles and openFunctions", fn)
+	}
+	for fn := range functionRoles {
+		require.Containsf(t, functions, fn, "functionRoles lists unknown function %s", fn)
+	}
+	for _, fn := range openFunctions {
+		require.Containsf(t, functions, fn, "openFunctions lists unknown function %s", fn)
+	}
+}
+
+func TestFunctionRolesDenyOtherRoles(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	// Check the roles alone, without the default admin approvals
+	_, err := e.SetAdminPolicy(tc.as("admin1", RoleAdmin), 1, []string{}, 24)
+	require.NoError(t, err)
+	for _, role := range registrableRoles {
+		_, err := e.RegisterRole(tc.as(role+"1", role))
+		require.NoError(t, err)
+	}
+
+	for fn, allowed := range functionRoles {
+		for _, role := range registrableRoles {
+			err := tc.as(role+"1", role).authorize(fn)
+			if hasRole(allowed, role) {
+				require.NoErrorf(t, err, "%s should allow %s", fn, role)
+			} else {
+				require.EqualErrorf(t, err, fn+": caller "+role+"1 with role "+role+" is not authorized", "%s should deny %s", fn, role)
+			}
+		}
+
+		err := tc.as("admin1", RoleAdmin).authorize(fn)
+		if hasRole(allowed, RoleAdmin) {
+			require.NoErrorf(t, err, "%s should allow admin", fn)
+		} else {
+			require.EqualErrorf(t, err, fn+": caller admin1 has no registered role", "%s should deny admin", fn)
+		}
+
+		err = tc.as("stranger", RoleProsumer).authorize(fn)
+		require.EqualErrorf(t, err, fn+": caller stranger has no registered role", "%s should deny unregistered callers", fn)
+	}
+
+	for _, fn := range openFunctions {
+		require.NoErrorf(t, tc.as("stranger", "").authorize(fn), "%s should be open", fn)
+	}
+}
+
+func TestCertificateRoleDoesNotOverrideRegisteredRole(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	_, err := e.RegisterRole(tc.as("buyer1", RoleConsumer))
+	require.NoError(t, err)
+
+	err = tc.as("buyer1", RoleOracle).authorize("PostReferencePrice")
+	require.EqualError(t, err, "PostReferencePrice: caller buyer1 with role consumer is not authorized")
+	err = tc.as("buyer1", RoleAdmin).authorize("ConfirmDelivery")
+	require.EqualError(t, err, "ConfirmDelivery: caller buyer1 with role consumer is not authorized")
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// rollupDayLayout is the format of the UTC day a rollup covers
+const rollupDayLayout = "2006-01-02"
+
+// DailyRollup aggregates the settled trades whose delivery started on one UTC
+// day. Rollups stay on the ledger after PruneDailyTrades has removed the
+// day's per-trade detail, which the off-chain indexer keeps.
+type DailyRollup struct {
+	Day                string  `json:"day"`
+	TradeCount         int     `json:"tradeCount"`
+	ContractedEnergy   float64 `json:"contractedEnergy"`
+	DeliveredEnergy    float64 `json:"deliveredEnergy"`
+	TradedValue        float64 `json:"tradedValue"`
+	Levies             float64 `json:"levies"`
+	NetworkFees        float64 `json:"networkFees"`
+	Subsidies          float64 `json:"subsidies"`
+	Shortfall          float64 `json:"shortfall"`
+	ImbalancePenalties float64 `json:"imbalancePenalties"`
+	// GridImbalance is the net amount the grid operator paid the parties for
+	// their imbalances; it is negative when the parties paid the grid
+	GridImbalance float64 `json:"gridImbalance"`
+	PrunedTrades  int     `json:"prunedTrades"`
+	CreatedBy     string  `json:"createdBy"`
+	CreatedAt     string  `json:"createdAt"`
+	PrunedAt      string  `json:"prunedAt,omitempty"`
+}
+
+// TradesPruned is the payload of the TradesPruned event
+type TradesPruned struct {
+	Day      string   `json:"day"`
+	TokenIDs []string `json:"tokenIDs"`
+}
+
+func dailyRollupKey(ctx contractapi.TransactionContextInterface, day string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("dailyrollup", []string{day})
+}
+
+func putDailyRollup(ctx contractapi.TransactionContextInterface, rollup *DailyRollup) error {
+	key, err := dailyRollupKey(ctx, rollup.Day)
+	if err != nil {
+		return err
+	}
+	rollupJSON, err := json.Marshal(rollup)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, rollupJSON)
+}
+
+// getDailyRollup returns the rollup of a day, or nil if none has been created
+func getDailyRollup(ctx contractapi.TransactionContextInterface, day string) (*DailyRollup, error) {
+	key, err := dailyRollupKey(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	rollupJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rollup of %s: %v", day, err)
+	}
+	if rollupJSON == nil {
+		return nil, nil
+	}
+	var rollup DailyRollup
+	if err := json.Unmarshal(rollupJSON, &rollup); err != nil {
+		return nil, err
+	}
+	return &rollup, nil
+}
+
+// rollupDay parses a day and returns the start and end of its delivery window
+func rollupDay(day string) (string, string, error) {
+	start, err := time.Parse(rollupDayLayout, day)
+	if err != nil {
+		return "", "", fmt.Errorf("day %s must have the form YYYY-MM-DD", day)
+	}
+	return start.Format(time.RFC3339), start.AddDate(0, 0, 1).Format(time.RFC3339), nil
+}
+
+// forEachDayTrade visits the trades in a delivery or archive index whose
+// delivery starts in [start, end)
+func (e *EnergyTradingContract) forEachDayTrade(ctx contractapi.TransactionContextInterface, prefix, start, end string, visit func(indexKey string, asset *EnergyAsset) error) error {
+	resultsIterator, err := ctx.GetStub().GetStateByRange(prefix+start, prefix+end)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		asset, err := e.ReadEnergyAsset(ctx, string(queryResponse.Value))
+		if err != nil {
+			return err
+		}
+		if err := visit(queryResponse.Key, asset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateDailyRollup aggregates the traded volume, fees and imbalances of the
+// trades delivered on a past UTC day, given as YYYY-MM-DD. Every trade of the
+// day must be settled or cancelled; cancelled trades are not counted. A day
+// is rolled up once.
+func (e *EnergyTradingContract) CreateDailyRollup(ctx contractapi.TransactionContextInterface, day string) (*DailyRollup, error) {
+	start, end, err := rollupDay(day)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.Format(time.RFC3339) < end {
+		return nil, fmt.Errorf("day %s has not ended", day)
+	}
+	existing, err := getDailyRollup(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("rollup of %s already exists", day)
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rollup := &DailyRollup{Day: day, CreatedBy: caller, CreatedAt: now.Format(time.RFC3339)}
+	for _, prefix := range []string{deliveryIndexPrefix, archiveIndexPrefix} {
+		err := e.forEachDayTrade(ctx, prefix, start, end, func(_ string, asset *EnergyAsset) error {
+			switch asset.TransactionState {
+			case StateCancelled:
+				return nil
+			case StateSettled:
+			default:
+				return fmt.Errorf("trade %s delivered on %s has not been settled", asset.TokenID, day)
+			}
+			settlement, err := e.GetSettlement(ctx, asset.TokenID)
+			if err != nil {
+				return err
+			}
+			rollup.TradeCount++
+			rollup.ContractedEnergy += settlement.ContractedEnergy
+			rollup.DeliveredEnergy += settlement.DeliveredEnergy
+			rollup.TradedValue += settlement.Payment
+			rollup.Levies += settlement.TotalLevies
+			rollup.NetworkFees += settlement.NetworkFee
+			rollup.Subsidies += settlement.TotalSubsidies
+			rollup.Shortfall += settlement.Shortfall
+			rollup.ImbalancePenalties += settlement.ImbalancePenalty
+			rollup.GridImbalance += settlement.SellerGridAmount + settlement.BuyerGridAmount
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := putDailyRollup(ctx, rollup); err != nil {
+		return nil, err
+	}
+	return rollup, emitEvent(ctx, EventDailyRollupCreated, rollup)
+}
+
+// GetDailyRollup returns the rollup of a day
+func (e *EnergyTradingContract) GetDailyRollup(ctx contractapi.TransactionContextInterface, day string) (*DailyRollup, error) {
+	rollup, err := getDailyRollup(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	if rollup == nil {
+		return nil, fmt.Errorf("rollup of %s does not exist", day)
+	}
+	return rollup, nil
+}
+
+// PaginatedDailyRollupResult is a page of daily rollups
+type PaginatedDailyRollupResult struct {
+	Records             []*DailyRollup `json:"records"`
+	FetchedRecordsCount int32          `json:"fetchedRecordsCount"`
+	Bookmark            string         `json:"bookmark"`
+}
+
+// GetDailyRollups returns a page of the rollups of days in the half-open
+// window [from, to), oldest first. Rollups outside the window are skipped, so
+// a page may hold fewer than pageSize rollups.
+func (e *EnergyTradingContract) GetDailyRollups(ctx contractapi.TransactionContextInterface, from, to string, pageSize int32, bookmark string) (*PaginatedDailyRollupResult, error) {
+	if _, _, err := rollupDay(from); err != nil {
+		return nil, err
+	}
+	if _, _, err := rollupDay(to); err != nil {
+		return nil, err
+	}
+	result := &PaginatedDailyRollupResult{Records: []*DailyRollup{}}
+	metadata, err := queryPage(ctx, "dailyrollup", []string{}, pageSize, bookmark, func(value []byte) error {
+		var rollup DailyRollup
+		if err := json.Unmarshal(value, &rollup); err != nil {
+			return err
+		}
+		if rollup.Day >= from && rollup.Day < to {
+			result.Records = append(result.Records, &rollup)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// PruneDailyTrades deletes the ledger detail of the archived trades delivered
+// on a rolled-up day: the trades, their settlements, loss records,
+// curtailments, meter hash commitments and index entries. The TradesPruned
+// event lists the trades so that the indexer, which holds their history, can
+// mark them as archived off-chain. Imbalance and carbon records stay, as
+// invoices and reports are built from them; billing periods covering the day
+// should be closed before pruning. Settled trades not yet archived are left
+// for a later call. Each pruned trade leaves a tombstone that keeps its token
+// ID from being reused.
+func (e *EnergyTradingContract) PruneDailyTrades(ctx contractapi.TransactionContextInterface, day string) (*DailyRollup, error) {
+	rollup, err := e.GetDailyRollup(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := rollupDay(day)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := TradesPruned{Day: day, TokenIDs: []string{}}
+	err = e.forEachDayTrade(ctx, archiveIndexPrefix, start, end, func(indexKey string, asset *EnergyAsset) error {
+		if err := pruneTrade(ctx, asset); err != nil {
+			return err
+		}
+		if err := putPrunedTrade(ctx, &PrunedTrade{TokenID: asset.TokenID, Day: day, PrunedAt: now}); err != nil {
+			return err
+		}
+		if err := ctx.GetStub().DelState(indexKey); err != nil {
+			return err
+		}
+		pruned.TokenIDs = append(pruned.TokenIDs, asset.TokenID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rollup.PrunedTrades += len(pruned.TokenIDs)
+	rollup.PrunedAt = now
+	if err := putDailyRollup(ctx, rollup); err != nil {
+		return nil, err
+	}
+	return rollup, emitEvent(ctx, EventTradesPruned, pruned)
+}
+
+// PrunedTrade is the tombstone left for a pruned trade. Its token ID cannot
+// be reused, so rollups and events that name it stay unambiguous.
+type PrunedTrade struct {
+	TokenID  string `json:"tokenID"`
+	Day      string `json:"day"`
+	PrunedAt string `json:"prunedAt"`
+}
+
+func prunedTradeKey(ctx contractapi.TransactionContextInterface, tokenID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("prunedtrade", []string{tokenID})
+}
+
+func putPrunedTrade(ctx contractapi.TransactionContextInterface, pruned *PrunedTrade) error {
+	key, err := prunedTradeKey(ctx, pruned.TokenID)
+	if err != nil {
+		return err
+	}
+	prunedJSON, err := json.Marshal(pruned)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, prunedJSON)
+}
+
+// tradePruned reports whether a trade with the given token ID was pruned
+func tradePruned(ctx contractapi.TransactionContextInterface, tokenID string) (bool, error) {
+	key, err := prunedTradeKey(ctx, tokenID)
+	if err != nil {
+		return false, err
+	}
+	prunedJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read pruned trade %s: %v", tokenID, err)
+	}
+	return prunedJSON != nil, nil
+}
+
+// pruneTrade deletes a trade and the state kept under its token ID. Its slot
+// and zone index entries are deleted for every supported slot length, since
+// the slot length may have changed since the trade was scheduled.
+func pruneTrade(ctx contractapi.TransactionContextInterface, asset *EnergyAsset) error {
+	keys := []string{asset.TokenID}
+	key, err := settlementKey(ctx, asset.TokenID)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, key)
+	key, err = sourceTradeKey(ctx, asset.SourceType, asset.TokenID)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, key)
+	for _, objectType := range []string{"lossrecord", "curtailment", "meterhash"} {
+		resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(objectType, []string{asset.TokenID})
+		if err != nil {
+			return err
+		}
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return err
+			}
+			keys = append(keys, queryResponse.Key)
+		}
+		resultsIterator.Close()
+	}
+
+	zones := []string{}
+	for _, address := range []string{asset.SellerAddress, asset.BuyerAddress} {
+		participant, err := getParticipant(ctx, address)
+		if err != nil {
+			return err
+		}
+		if participant != nil {
+			zones = append(zones, participant.Zone)
+		}
+	}
+	start, err := parseTimestamp(asset.DeliveryStart)
+	if err != nil {
+		return err
+	}
+	end, err := parseTimestamp(asset.DeliveryEnd)
+	if err != nil {
+		return err
+	}
+	for _, length := range slotLengths {
+		for interval := start.Truncate(length); interval.Before(end); interval = interval.Add(length) {
+			intervalStart := interval.Format(time.RFC3339)
+			key, err := ctx.GetStub().CreateCompositeKey("slottrade", []string{intervalStart, asset.TokenID})
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			for _, zone := range zones {
+				key, err := zoneTradeKey(ctx, zone, intervalStart, asset.TokenID)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		if err := ctx.GetStub().DelState(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestDailyRollupAndPruning(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	require.NoError(t, e.CreateEnergyAsset(tc.as("buyer1", ""), "energy2", "buyer1", "seller1", 5, "2025-05-03T12:00:00Z", "2025-05-03T13:00:00Z", SourceGrid))
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	_, err := e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+
+	tc.as("admin1", RoleAdmin)
+	_, err = e.CreateDailyRollup(tc, "3 May")
+	require.EqualError(t, err, "day 3 May must have the form YYYY-MM-DD")
+	_, err = e.CreateDailyRollup(tc, "2025-05-03")
+	require.EqualError(t, err, "day 2025-05-03 has not ended")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 4, 0, 30, 0, 0, time.UTC)), nil)
+	_, err = e.CreateDailyRollup(tc, "2025-05-03")
+	require.EqualError(t, err, "trade energy2 delivered on 2025-05-03 has not been settled")
+
+	// Cancelled trades are left out of the rollup
+	asset, err := e.ReadEnergyAsset(tc, "energy2")
+	require.NoError(t, err)
+	asset.TransactionState = StateCancelled
+	require.NoError(t, putEnergyAsset(tc, asset))
+	rollup, err := e.CreateDailyRollup(tc, "2025-05-03")
+	require.NoError(t, err)
+	require.Equal(t, 1, rollup.TradeCount)
+	require.Equal(t, 10.0, rollup.ContractedEnergy)
+	require.Equal(t, 8.0, rollup.DeliveredEnergy)
+	require.InDelta(t, 1.6, rollup.TradedValue, 1e-9)
+	require.Equal(t, 2.0, rollup.Shortfall)
+	require.InDelta(t, 0.6, rollup.ImbalancePenalties, 1e-9)
+	require.InDelta(t, -0.8, rollup.GridImbalance, 1e-9)
+	require.Equal(t, "admin1", rollup.CreatedBy)
+	name, _ := tc.lastEvent(t)
+	require.Equal(t, EventDailyRollupCreated, name)
+	_, err = e.CreateDailyRollup(tc, "2025-05-03")
+	require.EqualError(t, err, "rollup of 2025-05-03 already exists")
+
+	// Only archived trades are pruned
+	_, err = e.PruneDailyTrades(tc, "2025-05-02")
+	require.EqualError(t, err, "rollup of 2025-05-02 does not exist")
+	rollup, err = e.PruneDailyTrades(tc, "2025-05-03")
+	require.NoError(t, err)
+	require.Equal(t, 0, rollup.PrunedTrades)
+	_, err = e.ArchiveSettledAssets(tc, "2025-05-04T00:00:00Z")
+	require.NoError(t, err)
+	rollup, err = e.PruneDailyTrades(tc, "2025-05-03")
+	require.NoError(t, err)
+	require.Equal(t, 1, rollup.PrunedTrades)
+	require.Equal(t, "2025-05-04T00:30:00Z", rollup.PrunedAt)
+	name, payload := tc.lastEvent(t)
+	require.Equal(t, EventTradesPruned, name)
+	var pruned TradesPruned
+	require.NoError(t, json.Unmarshal(payload, &pruned))
+	require.Equal(t, []string{"energy1"}, pruned.TokenIDs)
+
+	exists, err := e.EnergyAssetExists(tc, "energy1")
+	require.NoError(t, err)
+	require.False(t, exists)
+	err = e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller1", 5, "2025-05-05T12:00:00Z", "2025-05-05T13:00:00Z", SourceGrid)
+	require.EqualError(t, err, "token ID energy1 belonged to a pruned trade")
+	tc.as("admin1", RoleAdmin)
+	_, err = e.GetSettlement(tc, "energy1")
+	require.EqualError(t, err, "asset energy1 has not been settled")
+	slotTrades, err := e.GetTradesBySlot(tc, "2025-05-03T10:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Empty(t, slotTrades.Records)
+	archived, err := e.GetArchivedTradesByDeliveryWindow(tc, "2025-05-03T00:00:00Z", "2025-05-04T00:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Empty(t, archived.Records)
+
+	// The aggregates stay queryable
+	rollups, err := e.GetDailyRollups(tc, "2025-05-01", "2025-05-04", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, rollups.Records, 1)
+	require.Equal(t, 8.0, rollups.Records[0].DeliveredEnergy)
+	rollups, err = e.GetDailyRollups(tc, "2025-05-04", "2025-05-05", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Empty(t, rollups.Records)
+}
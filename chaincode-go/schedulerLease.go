@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// MaxLeaseDuration bounds how long a scheduler lease can be taken for, so a
+// crashed leader is replaced promptly.
+const MaxLeaseDuration = time.Hour
+
+// SchedulerLease elects the one instance of an off-chain job that may run.
+// Term increases each time the lease changes holder, so a former leader can
+// tell it has been replaced.
+type SchedulerLease struct {
+	Name      string `json:"name"`
+	Holder    string `json:"holder"`
+	Term      uint64 `json:"term"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+func schedulerLeaseKey(ctx contractapi.TransactionContextInterface, name string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("lease", []string{name})
+}
+
+// AcquireSchedulerLease takes or renews the named lease for holder until
+// ttlSeconds after the transaction time. It fails while another holder's
+// lease is unexpired. Concurrent acquisitions conflict on the lease key, so at
+// most one of them commits.
+func (e *EnergyTradingContract) AcquireSchedulerLease(ctx contractapi.TransactionContextInterface, name, holder string, ttlSeconds int) (*SchedulerLease, error) {
+	if name == "" || holder == "" {
+		return nil, fmt.Errorf("lease name and holder are required")
+	}
+	ttl := time.Duration(ttlSeconds) * time.Second
+	if ttl <= 0 || ttl > MaxLeaseDuration {
+		return nil, fmt.Errorf("lease duration must be positive and at most %v", MaxLeaseDuration)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lease, err := e.GetSchedulerLease(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if lease.Holder != holder {
+		if lease.Holder != "" {
+			expiresAt, err := parseTimestamp(lease.ExpiresAt)
+			if err != nil {
+				return nil, err
+			}
+			if now.Before(expiresAt) {
+				return nil, fmt.Errorf("lease %s is held by %s until %s", name, lease.Holder, lease.ExpiresAt)
+			}
+		}
+		lease.Holder = holder
+		lease.Term++
+	}
+	lease.ExpiresAt = now.Add(ttl).Format(time.RFC3339)
+
+	leaseJSON, err := json.Marshal(lease)
+	if err != nil {
+		return nil, err
+	}
+	key, err := schedulerLeaseKey(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, leaseJSON); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// GetSchedulerLease returns the named lease; a lease never taken has no holder
+func (e *EnergyTradingContract) GetSchedulerLease(ctx contractapi.TransactionContextInterface, name string) (*SchedulerLease, error) {
+	key, err := schedulerLeaseKey(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	leaseJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease %s: %v", name, err)
+	}
+	if leaseJSON == nil {
+		return &SchedulerLease{Name: name}, nil
+	}
+	var lease SchedulerLease
+	if err := json.Unmarshal(leaseJSON, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSchedulerLease(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.as("operator1", RoleOperator)
+
+	_, err := e.AcquireSchedulerLease(tc, "settlement", "worker-a", 0)
+	require.EqualError(t, err, "lease duration must be positive and at most 1h0m0s")
+	lease, err := e.AcquireSchedulerLease(tc, "settlement", "worker-a", 60)
+	require.NoError(t, err)
+	require.Equal(t, &SchedulerLease{Name: "settlement", Holder: "worker-a", Term: 1, ExpiresAt: "2025-05-01T08:01:00Z"}, lease)
+
+	_, err = e.AcquireSchedulerLease(tc, "settlement", "worker-b", 60)
+	require.EqualError(t, err, "lease settlement is held by worker-a until 2025-05-01T08:01:00Z")
+
+	// Renewal by the holder keeps the term.
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 1, 8, 0, 30, 0, time.UTC)), nil)
+	lease, err = e.AcquireSchedulerLease(tc, "settlement", "worker-a", 60)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lease.Term)
+	require.Equal(t, "2025-05-01T08:01:30Z", lease.ExpiresAt)
+
+	// Once expired, another instance takes over with a new term.
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 1, 8, 2, 0, 0, time.UTC)), nil)
+	lease, err = e.AcquireSchedulerLease(tc, "settlement", "worker-b", 60)
+	require.NoError(t, err)
+	require.Equal(t, "worker-b", lease.Holder)
+	require.Equal(t, uint64(2), lease.Term)
+
+	stored, err := e.GetSchedulerLease(tc, "settlement")
+	require.NoError(t, err)
+	require.Equal(t, lease, stored)
+}
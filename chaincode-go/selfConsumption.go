@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// SelfConsumption records how much of a participant's own generation in an
+// interval covered its own consumption, summed over its meters. Only the
+// residuals are traded: the market and the grid see the participant export
+// ResidualExport and import ResidualImport.
+type SelfConsumption struct {
+	Participant    string  `json:"participant"`
+	IntervalStart  string  `json:"intervalStart"`
+	IntervalEnd    string  `json:"intervalEnd"`
+	Generated      float64 `json:"generated"`
+	Consumed       float64 `json:"consumed"`
+	SelfConsumed   float64 `json:"selfConsumed"`
+	ResidualExport float64 `json:"residualExport"`
+	ResidualImport float64 `json:"residualImport"`
+	RecordedAt     string  `json:"recordedAt"`
+}
+
+// SelfConsumptionSummary totals a participant's self-consumption records over
+// a window. Ratio is the share of its generation it consumed itself.
+type SelfConsumptionSummary struct {
+	Participant  string  `json:"participant"`
+	From         string  `json:"from"`
+	To           string  `json:"to"`
+	Intervals    int     `json:"intervals"`
+	Generated    float64 `json:"generated"`
+	Consumed     float64 `json:"consumed"`
+	SelfConsumed float64 `json:"selfConsumed"`
+	Ratio        float64 `json:"ratio"`
+}
+
+func selfConsumptionKey(ctx contractapi.TransactionContextInterface, participant, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("selfconsumption", []string{participant, intervalStart})
+}
+
+// netSelfConsumption splits an interval's generation and consumption into
+// the energy consumed on site and the residual export and import
+func netSelfConsumption(generated, consumed float64) (selfConsumed, residualExport, residualImport float64) {
+	selfConsumed = math.Min(generated, consumed)
+	return selfConsumed, generated - selfConsumed, consumed - selfConsumed
+}
+
+// recordSelfConsumption nets a participant's readings for one interval and
+// stores the result. It runs whenever one of the participant's readings for
+// the interval is accepted or corrected, so the record always reflects every
+// reading received so far.
+func recordSelfConsumption(ctx contractapi.TransactionContextInterface, address, intervalStart, intervalEnd string) error {
+	participant, err := getParticipant(ctx, address)
+	if err != nil {
+		return err
+	}
+	if participant == nil {
+		return fmt.Errorf("participant %s is not registered", address)
+	}
+	var generated, consumed float64
+	for _, meterID := range participant.MeterIDs {
+		readings, err := getMeterReadings(ctx, meterID, intervalStart, intervalEnd)
+		if err != nil {
+			return err
+		}
+		for _, reading := range readings {
+			generated += reading.KWhInjected
+			consumed += reading.KWhConsumed
+		}
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	record := &SelfConsumption{
+		Participant:   address,
+		IntervalStart: intervalStart,
+		IntervalEnd:   intervalEnd,
+		Generated:     generated,
+		Consumed:      consumed,
+		RecordedAt:    now,
+	}
+	record.SelfConsumed, record.ResidualExport, record.ResidualImport = netSelfConsumption(generated, consumed)
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	key, err := selfConsumptionKey(ctx, address, intervalStart)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, recordJSON)
+}
+
+// GetSelfConsumption returns a participant's self-consumption record for an
+// interval
+func (e *EnergyTradingContract) GetSelfConsumption(ctx contractapi.TransactionContextInterface, participant, intervalStart string) (*SelfConsumption, error) {
+	intervalStart, err := normalizeTimestamp(intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	key, err := selfConsumptionKey(ctx, participant, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	recordJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read self-consumption record: %v", err)
+	}
+	if recordJSON == nil {
+		return nil, fmt.Errorf("participant %s has no self-consumption record for %s", participant, intervalStart)
+	}
+	var record SelfConsumption
+	if err := json.Unmarshal(recordJSON, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// PaginatedSelfConsumptionResult is a page of self-consumption records
+type PaginatedSelfConsumptionResult struct {
+	Records             []*SelfConsumption `json:"records"`
+	FetchedRecordsCount int32              `json:"fetchedRecordsCount"`
+	Bookmark            string             `json:"bookmark"`
+}
+
+// GetSelfConsumptionRecords returns a page of a participant's
+// self-consumption records for intervals starting in the half-open window
+// [from, to). Records outside the window are skipped, so a page may hold
+// fewer than pageSize records.
+func (e *EnergyTradingContract) GetSelfConsumptionRecords(ctx contractapi.TransactionContextInterface, participant, from, to string, pageSize int32, bookmark string) (*PaginatedSelfConsumptionResult, error) {
+	from, err := normalizeTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	to, err = normalizeTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedSelfConsumptionResult{Records: []*SelfConsumption{}}
+	metadata, err := queryPage(ctx, "selfconsumption", []string{participant}, pageSize, bookmark, func(value []byte) error {
+		var record SelfConsumption
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		if record.IntervalStart >= from && record.IntervalStart < to {
+			result.Records = append(result.Records, &record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// GetSelfConsumptionSummary totals a participant's self-consumption for
+// intervals starting in the half-open window [from, to), for incentive
+// schemes and reporting
+func (e *EnergyTradingContract) GetSelfConsumptionSummary(ctx contractapi.TransactionContextInterface, participant, from, to string) (*SelfConsumptionSummary, error) {
+	from, err := normalizeTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	to, err = normalizeTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("selfconsumption", []string{participant})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	summary := &SelfConsumptionSummary{Participant: participant, From: from, To: to}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var record SelfConsumption
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			return nil, err
+		}
+		if record.IntervalStart < from || record.IntervalStart >= to {
+			continue
+		}
+		summary.Intervals++
+		summary.Generated += record.Generated
+		summary.Consumed += record.Consumed
+		summary.SelfConsumed += record.SelfConsumed
+	}
+	if summary.Generated > 0 {
+		summary.Ratio = summary.SelfConsumed / summary.Generated
+	}
+	return summary, nil
+}
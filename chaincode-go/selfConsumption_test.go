@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSelfConsumption(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	confirmTestAsset(t, e, tc, "energy1")
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0.5)
+
+	record, err := e.GetSelfConsumption(tc, "seller1", "2025-05-03T10:15:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 0.5, record.SelfConsumed, 1e-9)
+	require.InDelta(t, 1.5, record.ResidualExport, 1e-9)
+	require.Zero(t, record.ResidualImport)
+	_, err = e.GetSelfConsumption(tc, "seller1", "2025-05-03T11:00:00Z")
+	require.EqualError(t, err, "participant seller1 has no self-consumption record for 2025-05-03T11:00:00Z")
+
+	// Only the residual export is seen by the market
+	injected, consumed, found, err := meteredEnergy(tc, "seller1", "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.InDelta(t, 6, injected, 1e-9)
+	require.Zero(t, consumed)
+
+	// A corrected reading is netted again
+	require.NoError(t, e.ChallengeMeterReading(tc.as("buyer1", ""), "energy1", meterID, "2025-05-03T10:15:00Z", "meter stuck"))
+	require.NoError(t, e.ResolveMeterDispute(tc.as("arbiter1", RoleArbiter), meterID, "2025-05-03T10:15:00Z", true, 1, 3))
+	record, err = e.GetSelfConsumption(tc, "seller1", "2025-05-03T10:15:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 1, record.SelfConsumed, 1e-9)
+	require.Zero(t, record.ResidualExport)
+	require.InDelta(t, 2, record.ResidualImport, 1e-9)
+	injected, consumed, _, err = meteredEnergy(tc, "seller1", "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 4.5, injected, 1e-9)
+	require.InDelta(t, 2, consumed, 1e-9)
+
+	records, err := e.GetSelfConsumptionRecords(tc, "seller1", "2025-05-03T10:00:00Z", "2025-05-03T10:30:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, records.Records, 2)
+	summary, err := e.GetSelfConsumptionSummary(tc, "seller1", "2025-05-03T00:00:00Z", "2025-05-04T00:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 4, summary.Intervals)
+	require.InDelta(t, 7, summary.Generated, 1e-9)
+	require.InDelta(t, 2.5, summary.SelfConsumed, 1e-9)
+	require.InDelta(t, 2.5/7, summary.Ratio, 1e-9)
+}
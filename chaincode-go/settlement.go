@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ImbalancePenaltyRate is the multiple of the imbalance price the seller pays
+// the buyer for each kWh it failed to deliver. The imbalance price is the
+// larger in magnitude of the trade price and the reference price at delivery
+// start, so that a shortfall is penalised at negative prices too, and the
+// penalty is capped at the seller's deposit and waived when the weather
+// forecast for the seller's zone makes the shortfall force majeure. This is
+// the default; governance can change the rate for deliveries from the time a
+// proposal takes effect.
+const ImbalancePenaltyRate = 1.5
+
+// Settlement records how a trade was settled from reconciled meter data
+type Settlement struct {
+	TokenID          string            `json:"tokenID"`
+	ContractedEnergy float64           `json:"contractedEnergy"`
+	InjectedEnergy   float64           `json:"injectedEnergy"`
+	ConsumedEnergy   float64           `json:"consumedEnergy"`
+	DeliveredEnergy  float64           `json:"deliveredEnergy"`
+	DeliveredAtMeter float64           `json:"deliveredAtMeter"`
+	LossEnergy       float64           `json:"lossEnergy"`
+	LossCompensation float64           `json:"lossCompensation"`
+	Shortfall        float64           `json:"shortfall"`
+	Price            float64           `json:"price"`
+	Payment          float64           `json:"payment"`
+	Levies           []*LevyCharge     `json:"levies"`
+	TotalLevies      float64           `json:"totalLevies"`
+	SellerNetPayment float64           `json:"sellerNetPayment"`
+	Subsidies        []*SubsidyPayment `json:"subsidies"`
+	TotalSubsidies   float64           `json:"totalSubsidies"`
+	ImbalancePenalty float64           `json:"imbalancePenalty"`
+	CollateralSeized float64           `json:"collateralSeized,omitempty"`
+	EscrowReleased   float64           `json:"escrowReleased,omitempty"`
+	UncoveredDamages float64           `json:"uncoveredDamages,omitempty"`
+	ForceMajeure     bool              `json:"forceMajeure"`
+	InsurancePremium float64           `json:"insurancePremium"`
+	Netted           bool              `json:"netted,omitempty"`
+	NetworkFee       float64           `json:"networkFee"`
+	SellerGridAmount float64           `json:"sellerGridAmount"`
+	BuyerGridAmount  float64           `json:"buyerGridAmount"`
+	SettledAt        string            `json:"settledAt"`
+}
+
+func settlementKey(ctx contractapi.TransactionContextInterface, tokenID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("settlement", []string{tokenID})
+}
+
+// meteredEnergy sums the residual injection and consumption of a
+// participant's registered meters over the half-open window [from, to), and
+// reports whether any reading was found. In each interval the participant's
+// own generation is first netted against its own consumption, so only the
+// residual is traded and settled.
+func meteredEnergy(ctx contractapi.TransactionContextInterface, address, from, to string) (float64, float64, bool, error) {
+	participant, err := getParticipant(ctx, address)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if participant == nil {
+		return 0, 0, false, fmt.Errorf("participant %s is not registered", address)
+	}
+	var intervals []string
+	generated := map[string]float64{}
+	used := map[string]float64{}
+	for _, meterID := range participant.MeterIDs {
+		readings, err := getMeterReadings(ctx, meterID, from, to)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		for _, reading := range readings {
+			if reading.Disputed {
+				return 0, 0, false, fmt.Errorf("reading of meter %s at %s is under dispute", reading.MeterID, reading.IntervalStart)
+			}
+			if _, ok := generated[reading.IntervalStart]; !ok {
+				intervals = append(intervals, reading.IntervalStart)
+			}
+			generated[reading.IntervalStart] += reading.KWhInjected
+			used[reading.IntervalStart] += reading.KWhConsumed
+		}
+	}
+	var injected, consumed float64
+	for _, interval := range intervals {
+		_, residualExport, residualImport := netSelfConsumption(generated[interval], used[interval])
+		injected += residualExport
+		consumed += residualImport
+	}
+	return injected, consumed, len(intervals) > 0, nil
+}
+
+// ReconcileDelivery settles a trade from meter data once its delivery window
+// has ended. Delivered energy is the smallest of the seller's injection, the
+// buyer's consumption grossed up for network losses and the contracted amount,
+// less any curtailment, over the window. The buyer pays pro rata for the
+// energy that reached its meter, or is paid for taking it when the price is
+// negative. The levies in the schedule are withheld from
+// that gross payment and paid to their collectors, and the seller pays an
+// imbalance penalty on the shortfall, seized first from any collateral it
+// posted; the seller's net payment and the rest of the penalty are netted
+// into a single token transfer, or into an obligation for NetSettlement while
+// netting is enabled. Milestone payments already released from escrow count
+// towards that transfer and the rest of the escrow is refunded to the buyer
+// first. Damages beyond the seller's deposit are recorded for a claim on the
+// insurance fund, to which the buyer pays a premium on the gross payment. The
+// grid operator credits the seller for the energy lost in the network, and
+// the buyer pays it the network fee on the energy that reached its meter,
+// both at the rates fixed when the trade was confirmed. Each party's remaining
+// deviation from the contracted profile is then settled against the grid
+// operator at the reference price. An indexed trade is priced by its clause
+// against the reference price at delivery start.
+func (e *EnergyTradingContract) ReconcileDelivery(ctx contractapi.TransactionContextInterface, tokenID string) (*Settlement, error) {
+	asset, err := e.ReadEnergyAsset(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	role, err := callerRole(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if role != RoleOperator {
+		if _, err := requireParty(ctx, asset.BuyerAddress, asset.SellerAddress); err != nil {
+			return nil, err
+		}
+	}
+	if asset.TransactionState != StateConfirmed && asset.TransactionState != StateDelivered {
+		return nil, fmt.Errorf("asset %s cannot be settled in state %s", tokenID, asset.TransactionState)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deliveryEnd, err := parseTimestamp(asset.DeliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(deliveryEnd) {
+		return nil, fmt.Errorf("delivery window of asset %s ends at %s", tokenID, asset.DeliveryEnd)
+	}
+
+	injected, _, found, err := meteredEnergy(ctx, asset.SellerAddress, asset.DeliveryStart, asset.DeliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("seller %s has no meter readings for asset %s", asset.SellerAddress, tokenID)
+	}
+	_, consumed, found, err := meteredEnergy(ctx, asset.BuyerAddress, asset.DeliveryStart, asset.DeliveryEnd)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("buyer %s has no meter readings for asset %s", asset.BuyerAddress, tokenID)
+	}
+	details, err := getPrivateDetails(ctx, asset)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveryStart, err := parseTimestamp(asset.DeliveryStart)
+	if err != nil {
+		return nil, err
+	}
+	referencePrice, err := referencePriceAt(ctx, deliveryStart)
+	if err != nil {
+		return nil, err
+	}
+	if asset.Indexation != nil {
+		if referencePrice == nil {
+			return nil, fmt.Errorf("no reference price is in effect at %s to index asset %s", asset.DeliveryStart, tokenID)
+		}
+		details.TransactionPrice = asset.Indexation.price(referencePrice.Price)
+	}
+	imbalancePrice := math.Abs(details.TransactionPrice)
+	if referencePrice != nil {
+		imbalancePrice = math.Max(imbalancePrice, math.Abs(referencePrice.Price))
+	}
+
+	contracted := scheduledEnergy(asset)
+	delivered := math.Min(contracted, math.Min(injected, consumed/(1-asset.LossFactor)))
+	deliveredAtMeter := delivered * (1 - asset.LossFactor)
+	shortfall := contracted - delivered
+	config, err := platformConfigAt(ctx, deliveryStart)
+	if err != nil {
+		return nil, err
+	}
+	damages := shortfall * imbalancePrice * config.ImbalancePenaltyRate
+	penalty := math.Min(damages, details.SellerDeposit)
+	forceMajeure := false
+	if shortfall > 0 {
+		seller, err := getParticipant(ctx, asset.SellerAddress)
+		if err != nil {
+			return nil, err
+		}
+		forceMajeure, err = isForceMajeure(ctx, seller.Zone, asset.DeliveryStart, asset.DeliveryEnd)
+		if err != nil {
+			return nil, err
+		}
+		if forceMajeure {
+			damages, penalty = 0, 0
+		}
+	}
+	settlement := &Settlement{
+		TokenID:          tokenID,
+		ContractedEnergy: contracted,
+		InjectedEnergy:   injected,
+		ConsumedEnergy:   consumed,
+		DeliveredEnergy:  delivered,
+		DeliveredAtMeter: deliveredAtMeter,
+		LossEnergy:       delivered - deliveredAtMeter,
+		LossCompensation: (delivered - deliveredAtMeter) * details.TransactionPrice,
+		Shortfall:        shortfall,
+		Price:            details.TransactionPrice,
+		Payment:          deliveredAtMeter * details.TransactionPrice,
+		ImbalancePenalty: penalty,
+		UncoveredDamages: damages - penalty,
+		ForceMajeure:     forceMajeure,
+		NetworkFee:       deliveredAtMeter * asset.NetworkFeeRate,
+		SettledAt:        now.Format(time.RFC3339),
+	}
+
+	settlement.EscrowReleased, err = settleMilestoneEscrow(ctx, asset, settlement.SettledAt)
+	if err != nil {
+		return nil, err
+	}
+	settlement.Levies, err = levyCharges(ctx, settlement)
+	if err != nil {
+		return nil, err
+	}
+	for _, charge := range settlement.Levies {
+		if err := transferTokens(ctx, asset.BuyerAddress, charge.Collector, charge.Amount); err != nil {
+			return nil, fmt.Errorf("failed to collect levy %s of asset %s: %v", charge.LevyID, tokenID, err)
+		}
+		settlement.TotalLevies += charge.Amount
+	}
+	settlement.SellerNetPayment = settlement.Payment - settlement.TotalLevies
+
+	settlement.CollateralSeized, err = settleTradeCollateral(ctx, asset, settlement.ImbalancePenalty)
+	if err != nil {
+		return nil, err
+	}
+	net := settlement.SellerNetPayment - (settlement.ImbalancePenalty - settlement.CollateralSeized) - settlement.EscrowReleased
+	settlement.Netted, err = settleNet(ctx, asset, net)
+	if err != nil {
+		return nil, fmt.Errorf("failed to settle asset %s: %v", tokenID, err)
+	}
+	settlement.InsurancePremium, err = collectInsurancePremium(ctx, asset, settlement.Payment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect insurance premium of asset %s: %v", tokenID, err)
+	}
+	settlement.Subsidies, err = paySubsidies(ctx, asset, settlement)
+	if err != nil {
+		return nil, err
+	}
+	for _, payment := range settlement.Subsidies {
+		settlement.TotalSubsidies += payment.Amount
+	}
+	if err := settleWithGrid(ctx, asset.SellerAddress, settlement.LossCompensation); err != nil {
+		return nil, fmt.Errorf("failed to compensate losses of asset %s: %v", tokenID, err)
+	}
+	if err := settleWithGrid(ctx, asset.BuyerAddress, -settlement.NetworkFee); err != nil {
+		return nil, fmt.Errorf("failed to collect network fee of asset %s: %v", tokenID, err)
+	}
+	if err := putLossRecords(ctx, asset, settlement); err != nil {
+		return nil, err
+	}
+	if err := putCarbonRecord(ctx, asset, settlement); err != nil {
+		return nil, err
+	}
+	settlement.SellerGridAmount, err = settleGridImbalance(ctx, asset, asset.SellerAddress, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to settle imbalance of %s: %v", asset.SellerAddress, err)
+	}
+	settlement.BuyerGridAmount, err = settleGridImbalance(ctx, asset, asset.BuyerAddress, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to settle imbalance of %s: %v", asset.BuyerAddress, err)
+	}
+
+	settlementJSON, err := json.Marshal(settlement)
+	if err != nil {
+		return nil, err
+	}
+	key, err := settlementKey(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, settlementJSON); err != nil {
+		return nil, err
+	}
+	asset.TransactionState = StateSettled
+	if err := putEnergyAsset(ctx, asset); err != nil {
+		return nil, err
+	}
+	txLog(ctx).Infof("settled trade %s: delivered %g of %g contracted", tokenID, settlement.DeliveredEnergy, settlement.ContractedEnergy)
+	return settlement, emitEvent(ctx, EventTradeSettled, settlement)
+}
+
+// GetSettlement returns the settlement record of a trade
+func (e *EnergyTradingContract) GetSettlement(ctx contractapi.TransactionContextInterface, tokenID string) (*Settlement, error) {
+	key, err := settlementKey(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	settlementJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read settlement of %s: %v", tokenID, err)
+	}
+	if settlementJSON == nil {
+		return nil, fmt.Errorf("asset %s has not been settled", tokenID)
+	}
+	var settlement Settlement
+	if err := json.Unmarshal(settlementJSON, &settlement); err != nil {
+		return nil, err
+	}
+	return &settlement, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// submitTestReadings submits one signed reading per interval of the test
+// delivery window for the address's meter.
+func submitTestReadings(t testing.TB, e *EnergyTradingContract, tc *testContext, address string, injected, consumed float64) {
+	meterID := "meter-" + address
+	start := time.Date(2025, 5, 3, 10, 0, 0, 0, time.UTC)
+	for interval := start; interval.Before(start.Add(time.Hour)); interval = interval.Add(DefaultSlotLength) {
+		intervalStart := interval.Format(time.RFC3339)
+		signature := tc.signReading(t, meterID, intervalStart, injected, consumed)
+		require.NoError(t, e.SubmitMeterReading(tc.as(address, ""), meterID, intervalStart, injected, consumed, signature))
+	}
+}
+
+// postTestReferencePrice posts a reference price in effect for the whole test period
+func postTestReferencePrice(t testing.TB, e *EnergyTradingContract, tc *testContext, price float64) {
+	require.NoError(t, e.PostReferencePrice(tc.as("oracle1", RoleOracle), "2025-05-01T00:00:00Z", price))
+}
+
+func TestReconcileDelivery(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	_, err := e.GetSettlement(tc, "energy1")
+	require.EqualError(t, err, "asset energy1 has not been settled")
+	_, err = e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.EqualError(t, err, "delivery window of asset energy1 ends at 2025-05-03T11:00:00Z")
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	_, err = e.ReconcileDelivery(tc, "energy1")
+	require.EqualError(t, err, "seller seller1 has no meter readings for asset energy1")
+
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	_, err = e.ReconcileDelivery(tc.as("outsider", ""), "energy1")
+	require.EqualError(t, err, "caller outsider is not a party to this trade")
+
+	settlement, err := e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+	require.Equal(t, 8.0, settlement.DeliveredEnergy)
+	require.Equal(t, 2.0, settlement.Shortfall)
+	require.InDelta(t, 1.6, settlement.Payment, 1e-9)
+	require.InDelta(t, 0.6, settlement.ImbalancePenalty, 1e-9)
+	// Both parties were 0.5 kWh short of the contracted 2.5 kWh per interval.
+	require.InDelta(t, -0.4, settlement.SellerGridAmount, 1e-9)
+	require.InDelta(t, -0.4, settlement.BuyerGridAmount, 1e-9)
+	require.InDelta(t, 0.016, settlement.InsurancePremium, 1e-9)
+
+	buyer, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 8.584, buyer.Balance, 1e-9)
+	seller, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 1.6, seller.Balance, 1e-9)
+	grid, err := e.ReadTokenAccount(tc, GridOperatorAccount)
+	require.NoError(t, err)
+	require.InDelta(t, 0.8, grid.Balance, 1e-9)
+
+	records, err := e.GetImbalanceRecords(tc, "seller1", "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, records.Records, 4)
+	require.Equal(t, 2.5, records.Records[0].ContractedEnergy)
+	require.Equal(t, -0.5, records.Records[0].Imbalance)
+
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, StateSettled, asset.TransactionState)
+	_, err = e.ReconcileDelivery(tc, "energy1")
+	require.EqualError(t, err, "asset energy1 cannot be settled in state SETTLED")
+
+	stored, err := e.GetSettlement(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, settlement, stored)
+}
+
+func TestReconcileDeliveryNegativePrice(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, -0.5)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	err := e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "price 0.2 is outside the band [-0.75, -0.25] around reference price -0.5")
+
+	tc.stub.GetTransientReturns(map[string][]byte{
+		tradePrivateTransientKey: []byte(`{"transactionPrice":-0.5,"buyerDeposit":1,"sellerDeposit":1,"salt":"s1"}`),
+	}, nil)
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 1))
+	require.NoError(t, e.MintTokens(tc, "seller1", 10))
+	_, err = e.FundMilestoneEscrow(tc.as("buyer1", ""), "energy1", 2)
+	require.EqualError(t, err, "asset energy1 at price -0.5 has no payment to escrow")
+	_, err = e.SetLevy(tc.as("admin1", RoleAdmin), "vat", "VAT", LevyPercent, 0.2, "tax-authority")
+	require.NoError(t, err)
+	_, err = e.SetLevy(tc, "grid", "Grid levy", LevyPerKWh, 0.01, "grid-levy")
+	require.NoError(t, err)
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2.5, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 2.5)
+	settlement, err := e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+	require.InDelta(t, -5, settlement.Payment, 1e-9)
+	// The percentage levy lapses, while the levy per kWh is still due
+	require.Len(t, settlement.Levies, 1)
+	require.Equal(t, "grid", settlement.Levies[0].LevyID)
+	require.InDelta(t, -5.1, settlement.SellerNetPayment, 1e-9)
+	require.Zero(t, settlement.InsurancePremium)
+
+	// The seller pays the buyer to take the energy
+	buyer, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.InDelta(t, 6, buyer.Balance, 1e-9)
+	seller, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 4.9, seller.Balance, 1e-9)
+}
+
+// settleableTestTrades confirms n trades between distinct pairs of parties,
+// each with a full set of meter readings for the test delivery window
+func settleableTestTrades(tb testing.TB, e *EnergyTradingContract, tc *testContext, n int) []string {
+	postTestReferencePrice(tb, e, tc, 0.2)
+	tokenIDs := make([]string, n)
+	for i := range tokenIDs {
+		tokenID := fmt.Sprintf("energy%d", i)
+		buyer, seller := fmt.Sprintf("buyer%d", i), fmt.Sprintf("seller%d", i)
+		registerTestParticipant(tb, e, tc, buyer, RoleConsumer)
+		registerTestParticipant(tb, e, tc, seller, RoleProsumer)
+		registerTestMeter(tb, e, tc, buyer)
+		registerTestMeter(tb, e, tc, seller)
+		require.NoError(tb, e.MintTokens(tc.as("admin1", RoleAdmin), buyer, 10))
+		require.NoError(tb, e.MintTokens(tc, seller, 1))
+		require.NoError(tb, e.CreateEnergyAsset(tc.as(buyer, ""), tokenID, buyer, seller, 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid))
+		require.NoError(tb, e.SignEnergyAsset(tc, tokenID, tc.sign(tb, e, buyer, tokenID), 0))
+		require.NoError(tb, e.SignEnergyAsset(tc.as(seller, ""), tokenID, tc.sign(tb, e, seller, tokenID), 0))
+		tokenIDs[i] = tokenID
+	}
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	for i := range tokenIDs {
+		submitTestReadings(tb, e, tc, fmt.Sprintf("seller%d", i), 2, 0)
+		submitTestReadings(tb, e, tc, fmt.Sprintf("buyer%d", i), 0, 3)
+	}
+	return tokenIDs
+}
+
+// BenchmarkReconcileDelivery settles a batch of trades, as the settlement
+// scheduler does after a delivery window closes
+func BenchmarkReconcileDelivery(b *testing.B) {
+	for _, n := range []int{10, 50} {
+		b.Run(fmt.Sprintf("trades=%d", n), func(b *testing.B) {
+			e := &EnergyTradingContract{}
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tc := newTestContext()
+				tokenIDs := settleableTestTrades(b, e, tc, n)
+				b.StartTimer()
+				for j, tokenID := range tokenIDs {
+					if _, err := e.ReconcileDelivery(tc.as(fmt.Sprintf("seller%d", j), ""), tokenID); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
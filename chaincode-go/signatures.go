@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// TradeTerms are the fields of a trade that both parties sign, serialized
+// with canonicalJSON. The price and deposits are covered through the hash of
+// the private details.
+type TradeTerms struct {
+	TokenID            string  `json:"tokenID"`
+	BuyerAddress       string  `json:"buyerAddress"`
+	SellerAddress      string  `json:"sellerAddress"`
+	EnergyAmount       float64 `json:"energyAmount"`
+	SourceType         string  `json:"sourceType"`
+	DeliveryStart      string  `json:"deliveryStart"`
+	DeliveryEnd        string  `json:"deliveryEnd"`
+	PrivateDetailsHash string  `json:"privateDetailsHash"`
+}
+
+// signingPayload returns the canonical serialization of the asset's trade terms
+func signingPayload(asset *EnergyAsset) ([]byte, error) {
+	return canonicalJSON(TradeTerms{
+		TokenID:            asset.TokenID,
+		BuyerAddress:       asset.BuyerAddress,
+		SellerAddress:      asset.SellerAddress,
+		EnergyAmount:       asset.EnergyAmount,
+		SourceType:         asset.SourceType,
+		DeliveryStart:      asset.DeliveryStart,
+		DeliveryEnd:        asset.DeliveryEnd,
+		PrivateDetailsHash: asset.PrivateDetailsHash,
+	})
+}
+
+// GetSigningPayload returns the exact bytes a party must sign for SignEnergyAsset
+func (e *EnergyTradingContract) GetSigningPayload(ctx contractapi.TransactionContextInterface, tokenID string) (string, error) {
+	asset, err := e.ReadEnergyAsset(ctx, tokenID)
+	if err != nil {
+		return "", err
+	}
+	payload, err := signingPayload(asset)
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// verifyTradeSignature checks an ASN.1 ECDSA signature over the SHA-256 digest
+// of the asset's signing payload.
+func verifyTradeSignature(publicKey *ecdsa.PublicKey, asset *EnergyAsset, signatureBase64 string) error {
+	signature, err := base64.StdEncoding.DecodeString(signatureBase64)
+	if err != nil {
+		return fmt.Errorf("signature is not valid base64: %v", err)
+	}
+	payload, err := signingPayload(asset)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+		return fmt.Errorf("signature does not match the trade terms of asset %s", asset.TokenID)
+	}
+	return nil
+}
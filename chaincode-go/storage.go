@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Storage schedule statuses
+const (
+	ScheduleCommitted = "COMMITTED"
+	ScheduleSettled   = "SETTLED"
+)
+
+// StorageSystem is a battery installed behind one of its owner's meters.
+// Capacity is in kWh and the power limits in kW. StateOfCharge is the charge
+// expected after the last scheduled interval; settlement corrects it by
+// whatever the battery failed to deliver.
+type StorageSystem struct {
+	StorageID             string  `json:"storageID"`
+	Owner                 string  `json:"owner"`
+	MeterID               string  `json:"meterID"`
+	Zone                  string  `json:"zone"`
+	Capacity              float64 `json:"capacity"`
+	MaxChargePower        float64 `json:"maxChargePower"`
+	MaxDischargePower     float64 `json:"maxDischargePower"`
+	StateOfCharge         float64 `json:"stateOfCharge"`
+	LastScheduledInterval string  `json:"lastScheduledInterval,omitempty"`
+	RegisteredAt          string  `json:"registeredAt"`
+	UpdatedAt             string  `json:"updatedAt"`
+}
+
+// StorageSchedule is the energy a storage system commits to the market in one
+// meter interval: positive Energy is discharged into the grid and negative
+// Energy is charged from it. Amount is settled against the grid operator and
+// is positive when the grid pays.
+type StorageSchedule struct {
+	StorageID       string  `json:"storageID"`
+	IntervalStart   string  `json:"intervalStart"`
+	Energy          float64 `json:"energy"`
+	Status          string  `json:"status"`
+	DeliveredEnergy float64 `json:"deliveredEnergy"`
+	Shortfall       float64 `json:"shortfall"`
+	ReferencePrice  float64 `json:"referencePrice"`
+	Penalty         float64 `json:"penalty"`
+	Amount          float64 `json:"amount"`
+	CommittedAt     string  `json:"committedAt"`
+	SettledAt       string  `json:"settledAt,omitempty"`
+}
+
+func storageKey(ctx contractapi.TransactionContextInterface, storageID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("storage", []string{storageID})
+}
+
+func storageScheduleKey(ctx contractapi.TransactionContextInterface, storageID, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("storageschedule", []string{storageID, intervalStart})
+}
+
+func putStorage(ctx contractapi.TransactionContextInterface, storage *StorageSystem) error {
+	storageJSON, err := json.Marshal(storage)
+	if err != nil {
+		return err
+	}
+	key, err := storageKey(ctx, storage.StorageID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, storageJSON)
+}
+
+func putStorageSchedule(ctx contractapi.TransactionContextInterface, schedule *StorageSchedule) error {
+	scheduleJSON, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	key, err := storageScheduleKey(ctx, schedule.StorageID, schedule.IntervalStart)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, scheduleJSON)
+}
+
+// RegisterStorage registers a battery behind one of the caller's enrolled
+// meters, starting at the given state of charge
+func (e *EnergyTradingContract) RegisterStorage(ctx contractapi.TransactionContextInterface, storageID, meterID string, capacity, maxChargePower, maxDischargePower, stateOfCharge float64) (*StorageSystem, error) {
+	if capacity <= 0 || maxChargePower <= 0 || maxDischargePower <= 0 {
+		return nil, fmt.Errorf("capacity and power limits must be positive")
+	}
+	if stateOfCharge < 0 || stateOfCharge > capacity {
+		return nil, fmt.Errorf("state of charge must be between 0 and the capacity")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	participant, err := requireApprovedParticipant(ctx, caller)
+	if err != nil {
+		return nil, err
+	}
+	meter, err := requireActiveDevice(ctx, meterID, DeviceMeter)
+	if err != nil {
+		return nil, err
+	}
+	if meter.Owner != caller {
+		return nil, fmt.Errorf("meter %s is not registered to %s", meterID, caller)
+	}
+	key, err := storageKey(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage %s: %v", storageID, err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("storage %s is already registered", storageID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := &StorageSystem{
+		StorageID:         storageID,
+		Owner:             caller,
+		MeterID:           meterID,
+		Zone:              participant.Zone,
+		Capacity:          capacity,
+		MaxChargePower:    maxChargePower,
+		MaxDischargePower: maxDischargePower,
+		StateOfCharge:     stateOfCharge,
+		RegisteredAt:      now,
+		UpdatedAt:         now,
+	}
+	if err := putStorage(ctx, storage); err != nil {
+		return nil, err
+	}
+	ownerKey, err := ctx.GetStub().CreateCompositeKey("storageowner", []string{caller, storageID})
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(ownerKey, []byte(storageID)); err != nil {
+		return nil, err
+	}
+	return storage, emitEvent(ctx, EventStorageRegistered, storage)
+}
+
+// GetStorage returns a registered storage system
+func (e *EnergyTradingContract) GetStorage(ctx contractapi.TransactionContextInterface, storageID string) (*StorageSystem, error) {
+	key, err := storageKey(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+	storageJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage %s: %v", storageID, err)
+	}
+	if storageJSON == nil {
+		return nil, fmt.Errorf("storage %s is not registered", storageID)
+	}
+	var storage StorageSystem
+	if err := json.Unmarshal(storageJSON, &storage); err != nil {
+		return nil, err
+	}
+	return &storage, nil
+}
+
+// CommitStorageSchedule commits the caller's battery to discharge (positive
+// energy) or charge (negative energy) in a meter interval that has not started.
+// Intervals are committed in time order so that the state of charge can be
+// checked against the capacity, and the energy must be within the power limit
+// over one interval.
+func (e *EnergyTradingContract) CommitStorageSchedule(ctx contractapi.TransactionContextInterface, storageID, intervalStart string, energy float64) (*StorageSchedule, error) {
+	if energy == 0 {
+		return nil, fmt.Errorf("scheduled energy must not be zero")
+	}
+	storage, err := e.GetStorage(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, storage.Owner); err != nil {
+		return nil, err
+	}
+	intervalStart, length, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseTimestamp(intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(start) {
+		return nil, fmt.Errorf("interval %s has already started", intervalStart)
+	}
+	if storage.LastScheduledInterval != "" && intervalStart <= storage.LastScheduledInterval {
+		return nil, fmt.Errorf("storage %s is already scheduled up to %s", storageID, storage.LastScheduledInterval)
+	}
+	limit := storage.MaxDischargePower
+	if energy < 0 {
+		limit = storage.MaxChargePower
+	}
+	if math.Abs(energy) > limit*length.Hours() {
+		return nil, fmt.Errorf("scheduled energy exceeds the power limit of storage %s", storageID)
+	}
+	stateOfCharge := storage.StateOfCharge - energy
+	if stateOfCharge < 0 || stateOfCharge > storage.Capacity {
+		return nil, fmt.Errorf("schedule would take storage %s outside its capacity", storageID)
+	}
+
+	schedule := &StorageSchedule{
+		StorageID:     storageID,
+		IntervalStart: intervalStart,
+		Energy:        energy,
+		Status:        ScheduleCommitted,
+		CommittedAt:   now.Format(time.RFC3339),
+	}
+	if err := putStorageSchedule(ctx, schedule); err != nil {
+		return nil, err
+	}
+	storage.StateOfCharge = stateOfCharge
+	storage.LastScheduledInterval = intervalStart
+	storage.UpdatedAt = schedule.CommittedAt
+	if err := putStorage(ctx, storage); err != nil {
+		return nil, err
+	}
+	return schedule, emitEvent(ctx, EventStorageScheduled, schedule)
+}
+
+// SettleStorageSchedule verifies a committed interval against the storage
+// meter's reading once the interval has ended. Delivered energy is the
+// scheduled injection or consumption the meter confirms. The grid operator
+// pays for discharged energy and charges for charged energy at the reference
+// price, and the owner pays an imbalance penalty on the shortfall.
+func (e *EnergyTradingContract) SettleStorageSchedule(ctx contractapi.TransactionContextInterface, storageID, intervalStart string) (*StorageSchedule, error) {
+	storage, err := e.GetStorage(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+	role, err := callerRole(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if role != RoleOperator {
+		if err := requireCaller(ctx, storage.Owner); err != nil {
+			return nil, err
+		}
+	}
+	schedule, err := e.GetStorageSchedule(ctx, storageID, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if schedule.Status != ScheduleCommitted {
+		return nil, fmt.Errorf("schedule of storage %s for %s has already been settled", storageID, schedule.IntervalStart)
+	}
+	start, err := parseTimestamp(schedule.IntervalStart)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	length, err := slotLength(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(start.Add(length)) {
+		return nil, fmt.Errorf("interval %s has not ended", schedule.IntervalStart)
+	}
+	reading, err := getMeterReading(ctx, storage.MeterID, schedule.IntervalStart)
+	if err != nil {
+		return nil, err
+	}
+	if reading.Disputed {
+		return nil, fmt.Errorf("reading of meter %s at %s is under dispute", reading.MeterID, reading.IntervalStart)
+	}
+	referencePrice, err := referencePriceAt(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+	if referencePrice == nil {
+		return nil, fmt.Errorf("no reference price is in effect at %s", schedule.IntervalStart)
+	}
+
+	sign := 1.0
+	metered := reading.KWhInjected
+	if schedule.Energy < 0 {
+		sign = -1
+		metered = reading.KWhConsumed
+	}
+	scheduled := math.Abs(schedule.Energy)
+	schedule.DeliveredEnergy = math.Min(scheduled, metered)
+	schedule.Shortfall = scheduled - schedule.DeliveredEnergy
+	schedule.ReferencePrice = referencePrice.Price
+	config, err := platformConfigAt(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+	schedule.Penalty = schedule.Shortfall * math.Abs(referencePrice.Price) * config.ImbalancePenaltyRate
+	schedule.Amount = sign*schedule.DeliveredEnergy*referencePrice.Price - schedule.Penalty
+	schedule.Status = ScheduleSettled
+	schedule.SettledAt = now.Format(time.RFC3339)
+	if err := settleWithGrid(ctx, storage.Owner, schedule.Amount); err != nil {
+		return nil, fmt.Errorf("failed to settle storage %s: %v", storageID, err)
+	}
+	if err := putStorageSchedule(ctx, schedule); err != nil {
+		return nil, err
+	}
+
+	// Energy not discharged is still stored and energy not charged is missing
+	storage.StateOfCharge = math.Max(0, math.Min(storage.Capacity, storage.StateOfCharge+sign*schedule.Shortfall))
+	storage.UpdatedAt = schedule.SettledAt
+	if err := putStorage(ctx, storage); err != nil {
+		return nil, err
+	}
+	return schedule, emitEvent(ctx, EventStorageSettled, schedule)
+}
+
+// GetStorageSchedule returns a storage system's schedule for one interval
+func (e *EnergyTradingContract) GetStorageSchedule(ctx contractapi.TransactionContextInterface, storageID, intervalStart string) (*StorageSchedule, error) {
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	key, err := storageScheduleKey(ctx, storageID, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	scheduleJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage schedule: %v", err)
+	}
+	if scheduleJSON == nil {
+		return nil, fmt.Errorf("storage %s has no schedule for %s", storageID, intervalStart)
+	}
+	var schedule StorageSchedule
+	if err := json.Unmarshal(scheduleJSON, &schedule); err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// PaginatedStorageScheduleResult is a page of storage schedules
+type PaginatedStorageScheduleResult struct {
+	Records             []*StorageSchedule `json:"records"`
+	FetchedRecordsCount int32              `json:"fetchedRecordsCount"`
+	Bookmark            string             `json:"bookmark"`
+}
+
+// GetStorageSchedules returns a page of a storage system's schedules for
+// intervals starting in [from, to). Schedules outside the window are skipped,
+// so a page may hold fewer than pageSize schedules.
+func (e *EnergyTradingContract) GetStorageSchedules(ctx contractapi.TransactionContextInterface, storageID, from, to string, pageSize int32, bookmark string) (*PaginatedStorageScheduleResult, error) {
+	from, err := normalizeTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	to, err = normalizeTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedStorageScheduleResult{Records: []*StorageSchedule{}}
+	metadata, err := queryPage(ctx, "storageschedule", []string{storageID}, pageSize, bookmark, func(value []byte) error {
+		var schedule StorageSchedule
+		if err := json.Unmarshal(value, &schedule); err != nil {
+			return err
+		}
+		if schedule.IntervalStart >= from && schedule.IntervalStart < to {
+			result.Records = append(result.Records, &schedule)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestStorageSchedule(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "seller1", 10))
+
+	tc.as("seller1", "")
+	_, err := e.RegisterStorage(tc, "battery1", meterID, 10, 8, 8, 11)
+	require.EqualError(t, err, "state of charge must be between 0 and the capacity")
+	storage, err := e.RegisterStorage(tc, "battery1", meterID, 10, 8, 8, 5)
+	require.NoError(t, err)
+	require.Equal(t, "zone1", storage.Zone)
+	_, err = e.RegisterStorage(tc, "battery1", meterID, 10, 8, 8, 5)
+	require.EqualError(t, err, "storage battery1 is already registered")
+
+	_, err = e.CommitStorageSchedule(tc, "battery1", "2025-05-01T07:45:00Z", 1)
+	require.EqualError(t, err, "interval 2025-05-01T07:45:00Z has already started")
+	_, err = e.CommitStorageSchedule(tc, "battery1", "2025-05-03T10:00:00Z", 2.5)
+	require.EqualError(t, err, "scheduled energy exceeds the power limit of storage battery1")
+	_, err = e.CommitStorageSchedule(tc, "battery1", "2025-05-03T10:00:00Z", -2)
+	require.NoError(t, err)
+	_, err = e.CommitStorageSchedule(tc, "battery1", "2025-05-03T10:00:00Z", 1)
+	require.EqualError(t, err, "storage battery1 is already scheduled up to 2025-05-03T10:00:00Z")
+	_, err = e.CommitStorageSchedule(tc, "battery1", "2025-05-03T10:15:00Z", -2)
+	require.NoError(t, err)
+	_, err = e.CommitStorageSchedule(tc, "battery1", "2025-05-03T10:30:00Z", -2)
+	require.EqualError(t, err, "schedule would take storage battery1 outside its capacity")
+	_, err = e.CommitStorageSchedule(tc, "battery1", "2025-05-03T10:30:00Z", 2)
+	require.NoError(t, err)
+	storage, err = e.GetStorage(tc, "battery1")
+	require.NoError(t, err)
+	require.Equal(t, 7.0, storage.StateOfCharge)
+	_, err = e.CommitStorageSchedule(tc.as("buyer1", ""), "battery1", "2025-05-03T10:45:00Z", 1)
+	require.Error(t, err)
+
+	tc.as("seller1", "")
+	_, err = e.SettleStorageSchedule(tc, "battery1", "2025-05-03T10:00:00Z")
+	require.EqualError(t, err, "interval 2025-05-03T10:00:00Z has not ended")
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 0, 0, 0, time.UTC)), nil)
+	for _, reading := range []struct {
+		interval           string
+		injected, consumed float64
+	}{
+		{"2025-05-03T10:00:00Z", 0, 2},
+		{"2025-05-03T10:15:00Z", 0, 1.5},
+		{"2025-05-03T10:30:00Z", 2, 0},
+	} {
+		signature := tc.signReading(t, meterID, reading.interval, reading.injected, reading.consumed)
+		require.NoError(t, e.SubmitMeterReading(tc, meterID, reading.interval, reading.injected, reading.consumed, signature))
+	}
+
+	// Charging in full pays the grid for the energy
+	schedule, err := e.SettleStorageSchedule(tc, "battery1", "2025-05-03T10:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, ScheduleSettled, schedule.Status)
+	require.InDelta(t, -0.4, schedule.Amount, 1e-9)
+	_, err = e.SettleStorageSchedule(tc, "battery1", "2025-05-03T10:00:00Z")
+	require.EqualError(t, err, "schedule of storage battery1 for 2025-05-03T10:00:00Z has already been settled")
+
+	// A charging shortfall is penalized and leaves the battery emptier
+	schedule, err = e.SettleStorageSchedule(tc.as("operator1", RoleOperator), "battery1", "2025-05-03T10:15:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 0.5, schedule.Shortfall, 1e-9)
+	require.InDelta(t, -0.3-0.15, schedule.Amount, 1e-9)
+	schedule, err = e.SettleStorageSchedule(tc, "battery1", "2025-05-03T10:30:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 0.4, schedule.Amount, 1e-9)
+
+	storage, err = e.GetStorage(tc, "battery1")
+	require.NoError(t, err)
+	require.InDelta(t, 6.5, storage.StateOfCharge, 1e-9)
+	account, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 9.55, account.Balance, 1e-9)
+	schedules, err := e.GetStorageSchedules(tc, "battery1", "2025-05-03T10:15:00Z", "2025-05-03T11:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, schedules.Records, 2)
+}
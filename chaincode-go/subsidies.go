@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Subsidy program statuses
+const (
+	SubsidyActive    = "ACTIVE"
+	SubsidyExhausted = "EXHAUSTED"
+	SubsidyClosed    = "CLOSED"
+)
+
+// SubsidyProgram is a feed-in premium paid to sellers per kWh of eligible
+// energy that reaches the buyer's meter. Its budget is escrowed from the
+// funder's account when the program is created, and payouts stop once it is
+// spent.
+type SubsidyProgram struct {
+	ProgramID       string   `json:"programID"`
+	Name            string   `json:"name"`
+	Funder          string   `json:"funder"`
+	Rate            float64  `json:"rate"`
+	EligibleSources []string `json:"eligibleSources"`
+	Budget          float64  `json:"budget"`
+	Disbursed       float64  `json:"disbursed"`
+	Status          string   `json:"status"`
+	CreatedAt       string   `json:"createdAt"`
+	ClosedAt        string   `json:"closedAt,omitempty"`
+}
+
+// SubsidyPayment is the premium one program paid on a trade's settlement
+type SubsidyPayment struct {
+	ProgramID string  `json:"programID"`
+	Energy    float64 `json:"energy"`
+	Rate      float64 `json:"rate"`
+	Amount    float64 `json:"amount"`
+}
+
+func subsidyProgramKey(ctx contractapi.TransactionContextInterface, programID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("subsidyprogram", []string{programID})
+}
+
+// subsidyAccount is the token account holding a program's unspent budget
+func subsidyAccount(programID string) string {
+	return "subsidy-" + programID
+}
+
+func putSubsidyProgram(ctx contractapi.TransactionContextInterface, program *SubsidyProgram) error {
+	programJSON, err := json.Marshal(program)
+	if err != nil {
+		return err
+	}
+	key, err := subsidyProgramKey(ctx, program.ProgramID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, programJSON)
+}
+
+// CreateSubsidyProgram opens a subsidy program funded by the caller, moving
+// the budget from the caller's account into the program's account
+func (e *EnergyTradingContract) CreateSubsidyProgram(ctx contractapi.TransactionContextInterface, programID, name string, rate float64, eligibleSources []string, budget float64) (*SubsidyProgram, error) {
+	if programID == "" || name == "" {
+		return nil, fmt.Errorf("program ID and name must not be empty")
+	}
+	if rate <= 0 || budget <= 0 {
+		return nil, fmt.Errorf("rate and budget must be positive")
+	}
+	if len(eligibleSources) == 0 {
+		return nil, fmt.Errorf("at least one eligible source type is required")
+	}
+	for _, sourceType := range eligibleSources {
+		valid := false
+		for _, t := range sourceTypes {
+			valid = valid || t == sourceType
+		}
+		if !valid {
+			return nil, fmt.Errorf("source type must be one of %v", sourceTypes)
+		}
+	}
+	existing, err := getSubsidyProgram(ctx, programID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("subsidy program %s already exists", programID)
+	}
+	funder, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := putTokenAccount(ctx, &TokenAccount{AccountID: subsidyAccount(programID)}); err != nil {
+		return nil, err
+	}
+	if err := transferTokens(ctx, funder, subsidyAccount(programID), budget); err != nil {
+		return nil, fmt.Errorf("failed to fund subsidy program %s: %v", programID, err)
+	}
+
+	program := &SubsidyProgram{
+		ProgramID:       programID,
+		Name:            name,
+		Funder:          funder,
+		Rate:            rate,
+		EligibleSources: eligibleSources,
+		Budget:          budget,
+		Status:          SubsidyActive,
+		CreatedAt:       now,
+	}
+	if err := putSubsidyProgram(ctx, program); err != nil {
+		return nil, err
+	}
+	return program, emitEvent(ctx, EventSubsidyProgramChanged, program)
+}
+
+// CloseSubsidyProgram stops a program's payouts and refunds its unspent
+// budget to the funder
+func (e *EnergyTradingContract) CloseSubsidyProgram(ctx contractapi.TransactionContextInterface, programID string) (*SubsidyProgram, error) {
+	program, err := e.GetSubsidyProgram(ctx, programID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireCaller(ctx, program.Funder); err != nil {
+		return nil, err
+	}
+	if program.Status == SubsidyClosed {
+		return nil, fmt.Errorf("subsidy program %s is already closed", programID)
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if remaining := program.Budget - program.Disbursed; remaining > 0 {
+		if err := transferTokens(ctx, subsidyAccount(programID), program.Funder, remaining); err != nil {
+			return nil, fmt.Errorf("failed to refund subsidy program %s: %v", programID, err)
+		}
+	}
+	program.Status = SubsidyClosed
+	program.ClosedAt = now
+	if err := putSubsidyProgram(ctx, program); err != nil {
+		return nil, err
+	}
+	return program, emitEvent(ctx, EventSubsidyProgramChanged, program)
+}
+
+// getSubsidyProgram returns a subsidy program, or nil if there is none
+func getSubsidyProgram(ctx contractapi.TransactionContextInterface, programID string) (*SubsidyProgram, error) {
+	key, err := subsidyProgramKey(ctx, programID)
+	if err != nil {
+		return nil, err
+	}
+	programJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subsidy program %s: %v", programID, err)
+	}
+	if programJSON == nil {
+		return nil, nil
+	}
+	var program SubsidyProgram
+	if err := json.Unmarshal(programJSON, &program); err != nil {
+		return nil, err
+	}
+	return &program, nil
+}
+
+// GetSubsidyProgram returns a subsidy program
+func (e *EnergyTradingContract) GetSubsidyProgram(ctx contractapi.TransactionContextInterface, programID string) (*SubsidyProgram, error) {
+	program, err := getSubsidyProgram(ctx, programID)
+	if err != nil {
+		return nil, err
+	}
+	if program == nil {
+		return nil, fmt.Errorf("subsidy program %s does not exist", programID)
+	}
+	return program, nil
+}
+
+// PaginatedSubsidyProgramResult is a page of subsidy programs
+type PaginatedSubsidyProgramResult struct {
+	Records             []*SubsidyProgram `json:"records"`
+	FetchedRecordsCount int32             `json:"fetchedRecordsCount"`
+	Bookmark            string            `json:"bookmark"`
+}
+
+// GetSubsidyPrograms returns a page of the subsidy programs, ordered by
+// program ID
+func (e *EnergyTradingContract) GetSubsidyPrograms(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedSubsidyProgramResult, error) {
+	result := &PaginatedSubsidyProgramResult{Records: []*SubsidyProgram{}}
+	metadata, err := queryPage(ctx, "subsidyprogram", []string{}, pageSize, bookmark, func(value []byte) error {
+		var program SubsidyProgram
+		if err := json.Unmarshal(value, &program); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &program)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// getSubsidyPrograms returns every subsidy program, ordered by program ID
+func getSubsidyPrograms(ctx contractapi.TransactionContextInterface) ([]*SubsidyProgram, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("subsidyprogram", []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	programs := []*SubsidyProgram{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var program SubsidyProgram
+		if err := json.Unmarshal(queryResponse.Value, &program); err != nil {
+			return nil, err
+		}
+		programs = append(programs, &program)
+	}
+	return programs, nil
+}
+
+// paySubsidies pays the seller the premium of every active program the
+// trade's source type is eligible for, each capped at the program's remaining
+// budget. A program whose budget runs out is marked exhausted.
+func paySubsidies(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, settlement *Settlement) ([]*SubsidyPayment, error) {
+	programs, err := getSubsidyPrograms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payments := []*SubsidyPayment{}
+	for _, program := range programs {
+		if program.Status != SubsidyActive {
+			continue
+		}
+		eligible := false
+		for _, sourceType := range program.EligibleSources {
+			eligible = eligible || sourceType == asset.SourceType
+		}
+		amount := math.Min(settlement.DeliveredAtMeter*program.Rate, program.Budget-program.Disbursed)
+		if !eligible || amount <= 0 {
+			continue
+		}
+		if err := transferTokens(ctx, subsidyAccount(program.ProgramID), asset.SellerAddress, amount); err != nil {
+			return nil, fmt.Errorf("failed to pay subsidy %s: %v", program.ProgramID, err)
+		}
+		program.Disbursed += amount
+		if program.Budget-program.Disbursed <= 1e-9 {
+			program.Status = SubsidyExhausted
+		}
+		if err := putSubsidyProgram(ctx, program); err != nil {
+			return nil, err
+		}
+		payments = append(payments, &SubsidyPayment{
+			ProgramID: program.ProgramID,
+			Energy:    settlement.DeliveredAtMeter,
+			Rate:      program.Rate,
+			Amount:    amount,
+		})
+	}
+	return payments, nil
+}
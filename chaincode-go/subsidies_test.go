@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSubsidyPrograms(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	meterID := registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	registerTestParticipant(t, e, tc, "operator1", RoleOperator)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	require.NoError(t, e.MintTokens(tc, "operator1", 5))
+	_, err := e.RegisterGenerator(tc.as("seller1", ""), meterID, "solar", 10)
+	require.NoError(t, err)
+	_, err = e.VerifyGenerator(tc.as("operator1", RoleOperator), meterID)
+	require.NoError(t, err)
+
+	_, err = e.CreateSubsidyProgram(tc, "fip", "Solar FiP", 0.1, []string{"coal"}, 0.5)
+	require.EqualError(t, err, "source type must be one of [solar wind battery grid]")
+	_, err = e.CreateSubsidyProgram(tc, "fip", "Solar FiP", 0.1, []string{SourceSolar}, 50)
+	require.EqualError(t, err, "failed to fund subsidy program fip: account operator1 has insufficient balance")
+	_, err = e.CreateSubsidyProgram(tc, "fip", "Solar FiP", 0.1, []string{SourceSolar}, 0.5)
+	require.NoError(t, err)
+	_, err = e.CreateSubsidyProgram(tc, "wind", "Wind FiP", 0.1, []string{SourceWind}, 1)
+	require.NoError(t, err)
+
+	require.NoError(t, e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceSolar))
+	require.NoError(t, e.SignEnergyAsset(tc, "energy1", tc.sign(t, e, "buyer1", "energy1"), 0))
+	require.NoError(t, e.SignEnergyAsset(tc.as("seller1", ""), "energy1", tc.sign(t, e, "seller1", "energy1"), 0))
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+
+	// The premium on 8 kWh is capped at the remaining budget
+	settlement, err := e.ReconcileDelivery(tc.as("seller1", ""), "energy1")
+	require.NoError(t, err)
+	require.Len(t, settlement.Subsidies, 1)
+	require.Equal(t, "fip", settlement.Subsidies[0].ProgramID)
+	require.InDelta(t, 0.5, settlement.TotalSubsidies, 1e-9)
+	seller, err := e.ReadTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.InDelta(t, 1.6+0.5, seller.Balance, 1e-9)
+	program, err := e.GetSubsidyProgram(tc, "fip")
+	require.NoError(t, err)
+	require.Equal(t, SubsidyExhausted, program.Status)
+
+	// Closing refunds the unspent budget to the funder
+	_, err = e.CloseSubsidyProgram(tc.as("admin1", RoleAdmin), "wind")
+	require.EqualError(t, err, "caller admin1 is not authorized to act for operator1")
+	program, err = e.CloseSubsidyProgram(tc.as("operator1", RoleOperator), "wind")
+	require.NoError(t, err)
+	require.Equal(t, SubsidyClosed, program.Status)
+	funder, err := e.ReadTokenAccount(tc, "operator1")
+	require.NoError(t, err)
+	require.InDelta(t, 4.5, funder.Balance, 1e-9)
+	programs, err := e.GetSubsidyPrograms(tc, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, programs.Records, 2)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// DefaultSlotLength is the market time slot length until an admin configures
+// another. Trade delivery windows, meter readings, grid limits and every
+// interval-based settlement are aligned to time slots.
+const DefaultSlotLength = 15 * time.Minute
+
+// slotLengths are the slot lengths the market may be configured with. Each
+// divides an hour so that slots always start on the hour.
+var slotLengths = []time.Duration{15 * time.Minute, 30 * time.Minute, time.Hour}
+
+const marketConfigKey = "marketconfig"
+
+// MarketConfig holds the market's time slot length
+type MarketConfig struct {
+	SlotMinutes int    `json:"slotMinutes"`
+	UpdatedBy   string `json:"updatedBy,omitempty"`
+	UpdatedAt   string `json:"updatedAt,omitempty"`
+}
+
+// TimeSlot is one market time slot. Index counts slots of the configured
+// length since the Unix epoch, so consecutive slots have consecutive indices.
+type TimeSlot struct {
+	Index int64  `json:"index"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func getMarketConfig(ctx contractapi.TransactionContextInterface) (*MarketConfig, error) {
+	configJSON, err := ctx.GetStub().GetState(marketConfigKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read market config: %v", err)
+	}
+	if configJSON == nil {
+		return &MarketConfig{SlotMinutes: int(DefaultSlotLength / time.Minute)}, nil
+	}
+	var config MarketConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// slotLength returns the configured time slot length
+func slotLength(ctx contractapi.TransactionContextInterface) (time.Duration, error) {
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(config.SlotMinutes) * time.Minute, nil
+}
+
+// alignedSlot normalizes a slot start, checks it is aligned to the configured
+// slot length and returns it with the slot length
+func alignedSlot(ctx contractapi.TransactionContextInterface, slotStart string) (string, time.Duration, error) {
+	length, err := slotLength(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	start, err := parseTimestamp(slotStart)
+	if err != nil {
+		return "", 0, err
+	}
+	if !start.Truncate(length).Equal(start) {
+		return "", 0, fmt.Errorf("interval start %s is not aligned to %s", slotStart, length)
+	}
+	return start.Format(time.RFC3339), length, nil
+}
+
+func newTimeSlot(start time.Time, length time.Duration) *TimeSlot {
+	return &TimeSlot{
+		Index: start.Unix() / int64(length/time.Second),
+		Start: start.Format(time.RFC3339),
+		End:   start.Add(length).Format(time.RFC3339),
+	}
+}
+
+// SetSlotLength sets the market time slot length in minutes. Because stored
+// trades, limits and schedules are aligned to the current length, it can only
+// change while no live trades are indexed; settled trades must be archived
+// first.
+func (e *EnergyTradingContract) SetSlotLength(ctx contractapi.TransactionContextInterface, minutes int) error {
+	length := time.Duration(minutes) * time.Minute
+	supported := false
+	for _, l := range slotLengths {
+		supported = supported || l == length
+	}
+	if !supported {
+		return fmt.Errorf("slot length must be one of %v", slotLengths)
+	}
+	resultsIterator, err := ctx.GetStub().GetStateByRange(deliveryIndexPrefix, deliveryIndexPrefix+"\xff")
+	if err != nil {
+		return err
+	}
+	live := resultsIterator.HasNext()
+	resultsIterator.Close()
+	if live {
+		return fmt.Errorf("slot length cannot change while live trades exist")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	config := MarketConfig{SlotMinutes: minutes, UpdatedBy: caller, UpdatedAt: now}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(marketConfigKey, configJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventMarketConfigSet, config)
+}
+
+// GetMarketConfig returns the market configuration in force
+func (e *EnergyTradingContract) GetMarketConfig(ctx contractapi.TransactionContextInterface) (*MarketConfig, error) {
+	return getMarketConfig(ctx)
+}
+
+// GetTimeSlot returns the time slot containing the given time
+func (e *EnergyTradingContract) GetTimeSlot(ctx contractapi.TransactionContextInterface, at string) (*TimeSlot, error) {
+	t, err := parseTimestamp(at)
+	if err != nil {
+		return nil, err
+	}
+	length, err := slotLength(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newTimeSlot(t.Truncate(length), length), nil
+}
+
+func putSlotTradeIndex(ctx contractapi.TransactionContextInterface, slotStart, tokenID string) error {
+	key, err := ctx.GetStub().CreateCompositeKey("slottrade", []string{slotStart, tokenID})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, []byte(tokenID))
+}
+
+// GetTradesBySlot returns a page of the confirmed trades delivering in a time
+// slot
+func (e *EnergyTradingContract) GetTradesBySlot(ctx contractapi.TransactionContextInterface, slotStart string, pageSize int32, bookmark string) (*PaginatedTradeResult, error) {
+	slotStart, _, err := alignedSlot(ctx, slotStart)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedTradeResult{Records: []*EnergyAsset{}}
+	metadata, err := queryPage(ctx, "slottrade", []string{slotStart}, pageSize, bookmark, func(value []byte) error {
+		asset, err := e.ReadEnergyAsset(ctx, string(value))
+		if err != nil {
+			return err
+		}
+		result.Records = append(result.Records, asset)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeSlots(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	config, err := e.GetMarketConfig(tc)
+	require.NoError(t, err)
+	require.Equal(t, 15, config.SlotMinutes)
+
+	tc.as("admin1", RoleAdmin)
+	err = e.SetSlotLength(tc, 20)
+	require.EqualError(t, err, "slot length must be one of [15m0s 30m0s 1h0m0s]")
+	require.NoError(t, e.SetSlotLength(tc, 60))
+	slot, err := e.GetTimeSlot(tc, "2025-05-03T10:20:00Z")
+	require.NoError(t, err)
+	require.Equal(t, &TimeSlot{Index: 485074, Start: "2025-05-03T10:00:00Z", End: "2025-05-03T11:00:00Z"}, slot)
+
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	err = e.CreateEnergyAsset(tc.as("buyer1", ""), "energy1", "buyer1", "seller1", 10, "2025-05-03T10:30:00Z", "2025-05-03T11:00:00Z", SourceGrid)
+	require.EqualError(t, err, "delivery window must start and end on 1h0m0s time slot boundaries")
+	_, err = e.GetGridCapacity(tc, "zone1", "2025-05-03T10:15:00Z")
+	require.EqualError(t, err, "interval start 2025-05-03T10:15:00Z is not aligned to 1h0m0s")
+
+	confirmTestAsset(t, e, tc, "energy1")
+	trades, err := e.GetTradesBySlot(tc, "2025-05-03T10:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, trades.Records, 1)
+	require.Equal(t, "energy1", trades.Records[0].TokenID)
+	trades, err = e.GetTradesBySlot(tc, "2025-05-03T11:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Empty(t, trades.Records)
+
+	err = e.SetSlotLength(tc.as("admin1", RoleAdmin), 15)
+	require.EqualError(t, err, "slot length cannot change while live trades exist")
+}
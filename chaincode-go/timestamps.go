@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// txTime returns the transaction timestamp chosen by the client and signed in
+// the proposal. Every endorsing peer sees the same value, unlike time.Now().
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	ts, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	return ts.AsTime().UTC(), nil
+}
+
+// txTimestamp returns the transaction timestamp formatted as RFC3339 UTC
+func txTimestamp(ctx contractapi.TransactionContextInterface) (string, error) {
+	t, err := txTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(time.RFC3339), nil
+}
+
+// parseTimestamp parses an RFC3339 timestamp and converts it to UTC
+func parseTimestamp(timestamp string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid RFC3339 timestamp %q: %v", timestamp, err)
+	}
+	return t.UTC(), nil
+}
+
+// normalizeTimestamp parses an RFC3339 timestamp and returns it in UTC so that
+// stored values and index keys sort chronologically.
+func normalizeTimestamp(timestamp string) (string, error) {
+	t, err := parseTimestamp(timestamp)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(time.RFC3339), nil
+}
+
+// validateDeliveryWindow checks that a caller-supplied delivery window is well
+// formed, covers whole time slots and does not start before the current
+// transaction time. It returns the normalized start and end.
+func validateDeliveryWindow(ctx contractapi.TransactionContextInterface, deliveryStart, deliveryEnd string) (string, string, error) {
+	start, err := parseTimestamp(deliveryStart)
+	if err != nil {
+		return "", "", err
+	}
+	end, err := parseTimestamp(deliveryEnd)
+	if err != nil {
+		return "", "", err
+	}
+	length, err := slotLength(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if !start.Truncate(length).Equal(start) || !end.Truncate(length).Equal(end) {
+		return "", "", fmt.Errorf("delivery window must start and end on %s time slot boundaries", length)
+	}
+	if !end.After(start) {
+		return "", "", fmt.Errorf("delivery end %s must be after delivery start %s", deliveryEnd, deliveryStart)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if start.Before(now) {
+		return "", "", fmt.Errorf("delivery start %s is before transaction time %s", deliveryStart, now.Format(time.RFC3339))
+	}
+	return start.Format(time.RFC3339), end.Format(time.RFC3339), nil
+}
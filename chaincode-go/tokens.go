@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func accountKey(ctx contractapi.TransactionContextInterface, accountID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("account", []string{accountID})
+}
+
+func putTokenAccount(ctx contractapi.TransactionContextInterface, account *TokenAccount) error {
+	account.Version++
+	accountJSON, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	key, err := accountKey(ctx, account.AccountID)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, accountJSON)
+}
+
+// getTokenAccount returns the account with the given ID, or nil if it does
+// not exist. The balance of a delta account includes its pending deltas.
+func getTokenAccount(ctx contractapi.TransactionContextInterface, accountID string) (*TokenAccount, error) {
+	key, err := accountKey(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	accountJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account %s: %v", accountID, err)
+	}
+	if accountJSON == nil {
+		return nil, nil
+	}
+	var account TokenAccount
+	if err := json.Unmarshal(accountJSON, &account); err != nil {
+		return nil, err
+	}
+	deltaAccount, err := isDeltaAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if deltaAccount {
+		pending, _, err := pendingDeltas(ctx, accountID)
+		if err != nil {
+			return nil, err
+		}
+		account.Balance += pending
+	}
+	return &account, nil
+}
+
+// ReadTokenAccount returns the token account with the given ID
+func (e *EnergyTradingContract) ReadTokenAccount(ctx contractapi.TransactionContextInterface, accountID string) (*TokenAccount, error) {
+	account, err := getTokenAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, fmt.Errorf("account %s does not exist", accountID)
+	}
+	return account, nil
+}
+
+// OpenTokenAccount opens the caller's empty token account, so that it can
+// receive transfers before any tokens are minted to it. Only KYC approved
+// participants may hold an account.
+func (e *EnergyTradingContract) OpenTokenAccount(ctx contractapi.TransactionContextInterface) (*TokenAccount, error) {
+	address, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := requireApprovedParticipant(ctx, address); err != nil {
+		return nil, err
+	}
+	exists, err := tokenAccountExists(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("account %s already exists", address)
+	}
+	account := &TokenAccount{AccountID: address}
+	if err := putTokenAccount(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// MintTokens credits newly issued tokens to an account, creating it if needed.
+// Only admins may mint, and only to KYC approved participants.
+func (e *EnergyTradingContract) MintTokens(ctx contractapi.TransactionContextInterface, accountID string, amount float64) error {
+	if amount <= 0 {
+		return fmt.Errorf("mint amount must be positive")
+	}
+	account, err := getTokenAccount(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	participant, err := getParticipant(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	// An account's participant may have been rejected since it was approved
+	if account == nil || participant != nil {
+		if _, err := requireApprovedParticipant(ctx, accountID); err != nil {
+			return err
+		}
+	}
+	if account == nil {
+		if err := putTokenAccount(ctx, &TokenAccount{AccountID: accountID}); err != nil {
+			return err
+		}
+	}
+	if err := adjustBalance(ctx, accountID, amount); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventTokensMinted, TokenEvent{To: accountID, Amount: amount})
+}
+
+// TransferTokens moves tokens from the caller's account to another account.
+// expectedVersion, if not 0, is checked against the caller's account.
+func (e *EnergyTradingContract) TransferTokens(ctx contractapi.TransactionContextInterface, to string, amount float64, expectedVersion int64) error {
+	from, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	if expectedVersion != 0 {
+		source, err := getTokenAccount(ctx, from)
+		if err != nil {
+			return err
+		}
+		if source == nil {
+			return fmt.Errorf("account %s does not exist", from)
+		}
+		if err := checkVersion("account", from, source.Version, expectedVersion); err != nil {
+			return err
+		}
+	}
+	if err := transferTokens(ctx, from, to, amount); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventTokensTransferred, TokenEvent{From: from, To: to, Amount: amount})
+}
+
+// transferTokens debits from and credits to, failing on insufficient balance
+// or a frozen source account
+func transferTokens(ctx contractapi.TransactionContextInterface, from, to string, amount float64) error {
+	if amount <= 0 {
+		return fmt.Errorf("transfer amount must be positive")
+	}
+	if from == to {
+		return fmt.Errorf("cannot transfer to the same account")
+	}
+	source, err := getTokenAccount(ctx, from)
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		return fmt.Errorf("account %s does not exist", from)
+	}
+	if source.Balance < amount {
+		return fmt.Errorf("account %s has insufficient balance", from)
+	}
+	freeze, err := getAccountFreeze(ctx, from)
+	if err != nil {
+		return err
+	}
+	if freeze != nil {
+		return fmt.Errorf("account %s is frozen: %s", from, freeze.Reason)
+	}
+	exists, err := tokenAccountExists(ctx, to)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("account %s does not exist", to)
+	}
+	if err := adjustBalance(ctx, from, -amount); err != nil {
+		return err
+	}
+	return adjustBalance(ctx, to, amount)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// TariffSeason is one season of the utility's time-of-use tariff: the months
+// it covers and its import and export rates, in tokens per kWh, in the peak
+// hours and in the rest of the day. Months are 1 to 12 and hours 0 to 23 in
+// UTC. The import rate is what a participant pays the utility for energy it
+// consumes; the export rate is what the utility pays for energy it injects.
+type TariffSeason struct {
+	Season            string  `json:"season"`
+	Months            []int   `json:"months"`
+	PeakHours         []int   `json:"peakHours"`
+	PeakImportRate    float64 `json:"peakImportRate"`
+	OffPeakImportRate float64 `json:"offPeakImportRate"`
+	PeakExportRate    float64 `json:"peakExportRate"`
+	OffPeakExportRate float64 `json:"offPeakExportRate"`
+	UpdatedBy         string  `json:"updatedBy"`
+	UpdatedAt         string  `json:"updatedAt"`
+}
+
+// TariffRate is the time-of-use rate in effect at one time
+type TariffRate struct {
+	Season     string  `json:"season"`
+	Peak       bool    `json:"peak"`
+	ImportRate float64 `json:"importRate"`
+	ExportRate float64 `json:"exportRate"`
+}
+
+// FallbackSettlement is the settlement of a participant's metered energy in
+// an interval in which it had no trade, against the utility at the
+// time-of-use tariff. Amount is positive when the grid operator paid.
+type FallbackSettlement struct {
+	Participant   string  `json:"participant"`
+	IntervalStart string  `json:"intervalStart"`
+	Season        string  `json:"season"`
+	Peak          bool    `json:"peak"`
+	Injected      float64 `json:"injected"`
+	Consumed      float64 `json:"consumed"`
+	ExportRate    float64 `json:"exportRate"`
+	ImportRate    float64 `json:"importRate"`
+	Amount        float64 `json:"amount"`
+	SettledAt     string  `json:"settledAt"`
+}
+
+// FallbackFailure names a participant whose unmatched energy could not be
+// settled, and why
+type FallbackFailure struct {
+	Participant string `json:"participant"`
+	Reason      string `json:"reason"`
+}
+
+// FallbackSettlementBatch is the outcome of one SettleUnmatchedEnergy call.
+// Next is the participant to continue after, empty when every participant
+// has been considered.
+type FallbackSettlementBatch struct {
+	IntervalStart string                `json:"intervalStart"`
+	Settlements   []*FallbackSettlement `json:"settlements"`
+	Failures      []*FallbackFailure    `json:"failures"`
+	Next          string                `json:"next"`
+}
+
+func tariffSeasonKey(ctx contractapi.TransactionContextInterface, season string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("tariffseason", []string{season})
+}
+
+func fallbackSettlementKey(ctx contractapi.TransactionContextInterface, participant, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("fallbacksettlement", []string{participant, intervalStart})
+}
+
+// SetTariffSeason adds a season to the time-of-use tariff or replaces it. A
+// month may belong to one season only. Changes apply to intervals settled
+// afterwards.
+func (e *EnergyTradingContract) SetTariffSeason(ctx contractapi.TransactionContextInterface, season string, months, peakHours []int, peakImportRate, offPeakImportRate, peakExportRate, offPeakExportRate float64) (*TariffSeason, error) {
+	if season == "" {
+		return nil, fmt.Errorf("season must not be empty")
+	}
+	if len(months) == 0 {
+		return nil, fmt.Errorf("season %s must cover at least one month", season)
+	}
+	if err := checkDistinct(months, 1, 12, "month"); err != nil {
+		return nil, err
+	}
+	if err := checkDistinct(peakHours, 0, 23, "peak hour"); err != nil {
+		return nil, err
+	}
+	if peakImportRate < 0 || offPeakImportRate < 0 || peakExportRate < 0 || offPeakExportRate < 0 {
+		return nil, fmt.Errorf("tariff rates must not be negative")
+	}
+	seasons, err := getTariffSeasons(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range seasons {
+		if other.Season == season {
+			continue
+		}
+		for _, month := range months {
+			if containsInt(other.Months, month) {
+				return nil, fmt.Errorf("month %d already belongs to season %s", month, other.Season)
+			}
+		}
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tariff := &TariffSeason{
+		Season:            season,
+		Months:            months,
+		PeakHours:         peakHours,
+		PeakImportRate:    peakImportRate,
+		OffPeakImportRate: offPeakImportRate,
+		PeakExportRate:    peakExportRate,
+		OffPeakExportRate: offPeakExportRate,
+		UpdatedBy:         caller,
+		UpdatedAt:         now,
+	}
+	tariffJSON, err := json.Marshal(tariff)
+	if err != nil {
+		return nil, err
+	}
+	key, err := tariffSeasonKey(ctx, season)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, tariffJSON); err != nil {
+		return nil, err
+	}
+	return tariff, emitEvent(ctx, EventTariffSeasonChanged, tariff)
+}
+
+// checkDistinct fails unless every value is in [min, max] and appears once
+func checkDistinct(values []int, min, max int, noun string) error {
+	seen := map[int]bool{}
+	for _, value := range values {
+		if value < min || value > max {
+			return fmt.Errorf("%s %d must be between %d and %d", noun, value, min, max)
+		}
+		if seen[value] {
+			return fmt.Errorf("%s %d is listed twice", noun, value)
+		}
+		seen[value] = true
+	}
+	return nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveTariffSeason removes a season from the time-of-use tariff
+func (e *EnergyTradingContract) RemoveTariffSeason(ctx contractapi.TransactionContextInterface, season string) error {
+	key, err := tariffSeasonKey(ctx, season)
+	if err != nil {
+		return err
+	}
+	tariffJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read tariff season %s: %v", season, err)
+	}
+	if tariffJSON == nil {
+		return fmt.Errorf("tariff season %s does not exist", season)
+	}
+	if err := ctx.GetStub().DelState(key); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventTariffSeasonChanged, TariffSeason{Season: season})
+}
+
+// PaginatedTariffSeasonResult is a page of tariff seasons
+type PaginatedTariffSeasonResult struct {
+	Records             []*TariffSeason `json:"records"`
+	FetchedRecordsCount int32           `json:"fetchedRecordsCount"`
+	Bookmark            string          `json:"bookmark"`
+}
+
+// GetTOUTariff returns a page of the seasons of the time-of-use tariff,
+// ordered by name
+func (e *EnergyTradingContract) GetTOUTariff(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*PaginatedTariffSeasonResult, error) {
+	result := &PaginatedTariffSeasonResult{Records: []*TariffSeason{}}
+	metadata, err := queryPage(ctx, "tariffseason", []string{}, pageSize, bookmark, func(value []byte) error {
+		var season TariffSeason
+		if err := json.Unmarshal(value, &season); err != nil {
+			return err
+		}
+		result.Records = append(result.Records, &season)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+func getTariffSeasons(ctx contractapi.TransactionContextInterface) ([]*TariffSeason, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("tariffseason", []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	seasons := []*TariffSeason{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var season TariffSeason
+		if err := json.Unmarshal(queryResponse.Value, &season); err != nil {
+			return nil, err
+		}
+		seasons = append(seasons, &season)
+	}
+	return seasons, nil
+}
+
+// GetTariffRate returns the time-of-use rate in effect at a time
+func (e *EnergyTradingContract) GetTariffRate(ctx contractapi.TransactionContextInterface, at string) (*TariffRate, error) {
+	t, err := parseTimestamp(at)
+	if err != nil {
+		return nil, err
+	}
+	return tariffRateAt(ctx, t)
+}
+
+// tariffRateAt returns the rate of the season covering t's month, at its
+// peak rates if t's hour is a peak hour
+func tariffRateAt(ctx contractapi.TransactionContextInterface, t time.Time) (*TariffRate, error) {
+	seasons, err := getTariffSeasons(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t = t.UTC()
+	for _, season := range seasons {
+		if !containsInt(season.Months, int(t.Month())) {
+			continue
+		}
+		if containsInt(season.PeakHours, t.Hour()) {
+			return &TariffRate{Season: season.Season, Peak: true, ImportRate: season.PeakImportRate, ExportRate: season.PeakExportRate}, nil
+		}
+		return &TariffRate{Season: season.Season, ImportRate: season.OffPeakImportRate, ExportRate: season.OffPeakExportRate}, nil
+	}
+	return nil, fmt.Errorf("no tariff season covers %s", t.Format(time.RFC3339))
+}
+
+// SettleUnmatchedEnergy settles, against the grid operator at the
+// time-of-use tariff, the metered energy of participants that had no trade
+// in an interval that has ended: the operator pays the export rate for the
+// energy they injected and charges the import rate for the energy they
+// consumed. Participants with a confirmed trade in the interval are skipped,
+// since their deviations are settled as imbalances, as are those without
+// readings and those already settled. A call considers at most the batch
+// limit of participants, in address order after startAfter, and callers
+// repeat it from the returned Next until it is empty. A participant who
+// cannot pay its charge, or has no account, is listed in Failures and
+// settled by a later call.
+func (e *EnergyTradingContract) SettleUnmatchedEnergy(ctx contractapi.TransactionContextInterface, intervalStart, startAfter string) (*FallbackSettlementBatch, error) {
+	intervalStart, length, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseTimestamp(intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	intervalEnd := start.Add(length)
+	if now.Before(intervalEnd) {
+		return nil, fmt.Errorf("interval %s has not ended", intervalStart)
+	}
+	rate, err := tariffRateAt(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := e.GetBatchLimits(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &FallbackSettlementBatch{IntervalStart: intervalStart, Settlements: []*FallbackSettlement{}, Failures: []*FallbackFailure{}}
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("participant", []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	considered, last := 0, ""
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var participant Participant
+		if err := json.Unmarshal(queryResponse.Value, &participant); err != nil {
+			return nil, err
+		}
+		if participant.Address <= startAfter {
+			continue
+		}
+		if considered == int(limits.MaxBatchSize) {
+			batch.Next = last
+			break
+		}
+		considered, last = considered+1, participant.Address
+
+		settlement, err := e.unmatchedSettlement(ctx, &participant, intervalStart, intervalEnd, rate, now)
+		if err != nil {
+			return nil, err
+		}
+		if settlement == nil {
+			continue
+		}
+		if err := settleWithGrid(ctx, participant.Address, settlement.Amount); err != nil {
+			if strings.Contains(err.Error(), "insufficient balance") || strings.Contains(err.Error(), "does not exist") {
+				batch.Failures = append(batch.Failures, &FallbackFailure{Participant: participant.Address, Reason: err.Error()})
+				continue
+			}
+			return nil, err
+		}
+		settlementJSON, err := json.Marshal(settlement)
+		if err != nil {
+			return nil, err
+		}
+		key, err := fallbackSettlementKey(ctx, participant.Address, intervalStart)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.GetStub().PutState(key, settlementJSON); err != nil {
+			return nil, err
+		}
+		batch.Settlements = append(batch.Settlements, settlement)
+	}
+	return batch, emitEvent(ctx, EventUnmatchedEnergySettled, batch)
+}
+
+// unmatchedSettlement prices a participant's metered energy in an interval
+// at the tariff rate, or returns nil if the participant is not due a
+// fallback settlement for the interval
+func (e *EnergyTradingContract) unmatchedSettlement(ctx contractapi.TransactionContextInterface, participant *Participant, intervalStart string, intervalEnd time.Time, rate *TariffRate, now time.Time) (*FallbackSettlement, error) {
+	if participant.Erased {
+		return nil, nil
+	}
+	key, err := fallbackSettlementKey(ctx, participant.Address, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fallback settlement of %s: %v", participant.Address, err)
+	}
+	if existing != nil {
+		return nil, nil
+	}
+	traded, err := e.tradedInInterval(ctx, participant, intervalStart)
+	if err != nil || traded {
+		return nil, err
+	}
+	injected, consumed, found, err := meteredEnergy(ctx, participant.Address, intervalStart, intervalEnd.Format(time.RFC3339))
+	if err != nil || !found {
+		return nil, err
+	}
+	return &FallbackSettlement{
+		Participant:   participant.Address,
+		IntervalStart: intervalStart,
+		Season:        rate.Season,
+		Peak:          rate.Peak,
+		Injected:      injected,
+		Consumed:      consumed,
+		ExportRate:    rate.ExportRate,
+		ImportRate:    rate.ImportRate,
+		Amount:        injected*rate.ExportRate - consumed*rate.ImportRate,
+		SettledAt:     now.Format(time.RFC3339),
+	}, nil
+}
+
+// tradedInInterval reports whether a participant is a party to a confirmed
+// trade delivering in an interval, settled or not
+func (e *EnergyTradingContract) tradedInInterval(ctx contractapi.TransactionContextInterface, participant *Participant, intervalStart string) (bool, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("zonetrade", []string{participant.Zone, intervalStart})
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return false, err
+		}
+		asset, err := e.ReadEnergyAsset(ctx, string(queryResponse.Value))
+		if err != nil {
+			return false, err
+		}
+		if asset.TransactionState == StateCancelled {
+			continue
+		}
+		if asset.BuyerAddress == participant.Address || asset.SellerAddress == participant.Address {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// PaginatedFallbackSettlementResult is a page of fallback settlements
+type PaginatedFallbackSettlementResult struct {
+	Records             []*FallbackSettlement `json:"records"`
+	FetchedRecordsCount int32                 `json:"fetchedRecordsCount"`
+	Bookmark            string                `json:"bookmark"`
+}
+
+// GetFallbackSettlements returns a page of a participant's fallback
+// settlements for intervals starting in the half-open window [from, to).
+// Settlements outside the window are skipped, so a page may hold fewer than
+// pageSize settlements.
+func (e *EnergyTradingContract) GetFallbackSettlements(ctx contractapi.TransactionContextInterface, participant, from, to string, pageSize int32, bookmark string) (*PaginatedFallbackSettlementResult, error) {
+	from, err := normalizeTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	to, err = normalizeTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedFallbackSettlementResult{Records: []*FallbackSettlement{}}
+	metadata, err := queryPage(ctx, "fallbacksettlement", []string{participant}, pageSize, bookmark, func(value []byte) error {
+		var settlement FallbackSettlement
+		if err := json.Unmarshal(value, &settlement); err != nil {
+			return err
+		}
+		if settlement.IntervalStart >= from && settlement.IntervalStart < to {
+			result.Records = append(result.Records, &settlement)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// getFallbackSettlements returns all of a participant's fallback settlements
+// for intervals starting in the half-open window [from, to)
+func getFallbackSettlements(ctx contractapi.TransactionContextInterface, participant, from, to string) ([]*FallbackSettlement, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("fallbacksettlement", []string{participant})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	settlements := []*FallbackSettlement{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var settlement FallbackSettlement
+		if err := json.Unmarshal(queryResponse.Value, &settlement); err != nil {
+			return nil, err
+		}
+		if settlement.IntervalStart < from || settlement.IntervalStart >= to {
+			continue
+		}
+		settlements = append(settlements, &settlement)
+	}
+	return settlements, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSetTariffSeason(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.as("operator1", RoleOperator)
+
+	_, err := e.SetTariffSeason(tc, "summer", nil, nil, 0.3, 0.2, 0.1, 0.05)
+	require.EqualError(t, err, "season summer must cover at least one month")
+	_, err = e.SetTariffSeason(tc, "summer", []int{4, 13}, nil, 0.3, 0.2, 0.1, 0.05)
+	require.EqualError(t, err, "month 13 must be between 1 and 12")
+	_, err = e.SetTariffSeason(tc, "summer", []int{4, 5}, []int{17, 17}, 0.3, 0.2, 0.1, 0.05)
+	require.EqualError(t, err, "peak hour 17 is listed twice")
+	_, err = e.SetTariffSeason(tc, "summer", []int{4, 5}, []int{17}, 0.3, -0.2, 0.1, 0.05)
+	require.EqualError(t, err, "tariff rates must not be negative")
+	season, err := e.SetTariffSeason(tc, "summer", []int{4, 5, 6, 7, 8, 9}, []int{10, 11, 17, 18}, 0.3, 0.2, 0.1, 0.05)
+	require.NoError(t, err)
+	require.Equal(t, "operator1", season.UpdatedBy)
+	_, err = e.SetTariffSeason(tc, "winter", []int{9, 10, 11, 12, 1, 2, 3}, []int{17, 18}, 0.35, 0.25, 0.08, 0.04)
+	require.EqualError(t, err, "month 9 already belongs to season summer")
+	_, err = e.SetTariffSeason(tc, "winter", []int{10, 11, 12, 1, 2, 3}, []int{17, 18}, 0.35, 0.25, 0.08, 0.04)
+	require.NoError(t, err)
+
+	rate, err := e.GetTariffRate(tc, "2025-05-03T10:15:00Z")
+	require.NoError(t, err)
+	require.Equal(t, &TariffRate{Season: "summer", Peak: true, ImportRate: 0.3, ExportRate: 0.1}, rate)
+	rate, err = e.GetTariffRate(tc, "2025-12-03T10:15:00Z")
+	require.NoError(t, err)
+	require.Equal(t, &TariffRate{Season: "winter", ImportRate: 0.25, ExportRate: 0.04}, rate)
+
+	require.NoError(t, e.RemoveTariffSeason(tc, "winter"))
+	require.EqualError(t, e.RemoveTariffSeason(tc, "winter"), "tariff season winter does not exist")
+	_, err = e.GetTariffRate(tc, "2025-12-03T10:15:00Z")
+	require.EqualError(t, err, "no tariff season covers 2025-12-03T10:15:00Z")
+	seasons, err := e.GetTOUTariff(tc, DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, seasons.Records, 1)
+	require.Equal(t, "summer", seasons.Records[0].Season)
+}
+
+func TestSettleUnmatchedEnergy(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	registerTestParticipant(t, e, tc, "prosumer3", RoleProsumer)
+	registerTestMeter(t, e, tc, "prosumer3")
+	registerTestParticipant(t, e, tc, "consumer4", RoleConsumer)
+	registerTestMeter(t, e, tc, "consumer4")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "prosumer3", 1))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	_, err := e.SetTariffSeason(tc.as("operator1", RoleOperator), "summer", []int{4, 5, 6, 7, 8, 9}, []int{10, 11}, 0.3, 0.2, 0.1, 0.05)
+	require.NoError(t, err)
+
+	_, err = e.SettleUnmatchedEnergy(tc, "2025-05-03T10:00:00Z", "")
+	require.EqualError(t, err, "interval 2025-05-03T10:00:00Z has not ended")
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 2, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+	submitTestReadings(t, e, tc, "prosumer3", 2, 0.5)
+	submitTestReadings(t, e, tc, "consumer4", 0, 1)
+
+	// The trade parties are left to imbalance settlement, and consumer4 has
+	// no tokens to pay for its consumption
+	batch, err := e.SettleUnmatchedEnergy(tc.as("operator1", RoleOperator), "2025-05-03T10:00:00Z", "")
+	require.NoError(t, err)
+	require.Empty(t, batch.Next)
+	require.Len(t, batch.Settlements, 1)
+	settlement := batch.Settlements[0]
+	require.Equal(t, "prosumer3", settlement.Participant)
+	require.True(t, settlement.Peak)
+	require.InDelta(t, 1.5, settlement.Injected, 1e-9)
+	require.Zero(t, settlement.Consumed)
+	require.InDelta(t, 0.15, settlement.Amount, 1e-9)
+	require.Len(t, batch.Failures, 1)
+	require.Equal(t, "consumer4", batch.Failures[0].Participant)
+	account, err := e.ReadTokenAccount(tc, "prosumer3")
+	require.NoError(t, err)
+	require.InDelta(t, 1.15, account.Balance, 1e-9)
+
+	// A participant is settled once per interval; failures are retried
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "consumer4", 1))
+	_, err = e.SetBatchLimits(tc, 2, DefaultMaxFillsPerOrder)
+	require.NoError(t, err)
+	batch, err = e.SettleUnmatchedEnergy(tc.as("operator1", RoleOperator), "2025-05-03T10:00:00Z", "")
+	require.NoError(t, err)
+	require.Equal(t, "consumer4", batch.Next)
+	require.Len(t, batch.Settlements, 1)
+	require.InDelta(t, -0.3, batch.Settlements[0].Amount, 1e-9)
+	batch, err = e.SettleUnmatchedEnergy(tc, "2025-05-03T10:00:00Z", batch.Next)
+	require.NoError(t, err)
+	require.Empty(t, batch.Next)
+	require.Empty(t, batch.Settlements)
+
+	settlements, err := e.GetFallbackSettlements(tc, "prosumer3", "2025-05-01T00:00:00Z", "2025-06-01T00:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, settlements.Records, 1)
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)), nil)
+	invoice, err := e.CloseBillingPeriod(tc.as("prosumer3", ""), "prosumer3", "2025-05")
+	require.NoError(t, err)
+	require.Len(t, invoice.Lines, 1)
+	require.Equal(t, LineUtilityExport, invoice.Lines[0].Type)
+	require.InDelta(t, 0.15, invoice.Lines[0].Amount, 1e-9)
+	invoice, err = e.CloseBillingPeriod(tc.as("consumer4", ""), "consumer4", "2025-05")
+	require.NoError(t, err)
+	require.Len(t, invoice.Lines, 1)
+	require.Equal(t, LineUtilityImport, invoice.Lines[0].Type)
+	require.InDelta(t, -0.3, invoice.Lines[0].Amount, 1e-9)
+}
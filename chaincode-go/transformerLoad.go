@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Transformer load levels
+const (
+	LoadNormal   = "NORMAL"
+	LoadWarning  = "WARNING"
+	LoadOverload = "OVERLOAD"
+)
+
+// Transformer is the rating of the transformer feeding a zone, in kWh per
+// meter interval, and the share of it at which scheduled load raises a
+// warning
+type Transformer struct {
+	Zone             string  `json:"zone"`
+	Rating           float64 `json:"rating"`
+	WarningThreshold float64 `json:"warningThreshold"`
+	UpdatedBy        string  `json:"updatedBy"`
+	UpdatedAt        string  `json:"updatedAt"`
+}
+
+// TransformerLoad is the energy confirmed trades schedule for a zone's
+// members in one meter interval, whether traded within the zone or across
+// its boundary. A trade within the zone counts once. Level compares the load
+// with the zone's transformer, if one is registered, and LastTradeID is the
+// trade that last changed the load.
+type TransformerLoad struct {
+	Zone          string  `json:"zone"`
+	IntervalStart string  `json:"intervalStart"`
+	ScheduledLoad float64 `json:"scheduledLoad"`
+	Rating        float64 `json:"rating,omitempty"`
+	Utilization   float64 `json:"utilization,omitempty"`
+	Level         string  `json:"level"`
+	LastTradeID   string  `json:"lastTradeID,omitempty"`
+}
+
+func transformerKey(ctx contractapi.TransactionContextInterface, zone string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("transformer", []string{zone})
+}
+
+func transformerLoadKey(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("transformerload", []string{zone, intervalStart})
+}
+
+// SetTransformer registers the rating and warning threshold of a zone's
+// transformer, replacing any set before. Warnings for loads already
+// scheduled are raised when their next trade is confirmed.
+func (e *EnergyTradingContract) SetTransformer(ctx contractapi.TransactionContextInterface, zone string, rating, warningThreshold float64) (*Transformer, error) {
+	if zone == "" {
+		return nil, fmt.Errorf("zone must not be empty")
+	}
+	if rating <= 0 {
+		return nil, fmt.Errorf("transformer rating must be positive")
+	}
+	if warningThreshold <= 0 || warningThreshold > 1 {
+		return nil, fmt.Errorf("warning threshold must be above 0 and at most 1")
+	}
+	caller, err := callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	transformer := &Transformer{Zone: zone, Rating: rating, WarningThreshold: warningThreshold, UpdatedBy: caller, UpdatedAt: now}
+	transformerJSON, err := json.Marshal(transformer)
+	if err != nil {
+		return nil, err
+	}
+	key, err := transformerKey(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(key, transformerJSON); err != nil {
+		return nil, err
+	}
+	return transformer, emitEvent(ctx, EventTransformerSet, transformer)
+}
+
+// getTransformer returns a zone's transformer, or nil if none is registered
+func getTransformer(ctx contractapi.TransactionContextInterface, zone string) (*Transformer, error) {
+	key, err := transformerKey(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	transformerJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transformer: %v", err)
+	}
+	if transformerJSON == nil {
+		return nil, nil
+	}
+	var transformer Transformer
+	if err := json.Unmarshal(transformerJSON, &transformer); err != nil {
+		return nil, err
+	}
+	return &transformer, nil
+}
+
+// GetTransformer returns the transformer registered for a zone
+func (e *EnergyTradingContract) GetTransformer(ctx contractapi.TransactionContextInterface, zone string) (*Transformer, error) {
+	transformer, err := getTransformer(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	if transformer == nil {
+		return nil, fmt.Errorf("zone %s has no transformer", zone)
+	}
+	return transformer, nil
+}
+
+// GetTransformerLoad returns the load scheduled on a zone's transformer in
+// one meter interval, graded against the transformer's current rating
+func (e *EnergyTradingContract) GetTransformerLoad(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (*TransformerLoad, error) {
+	intervalStart, _, err := alignedSlot(ctx, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	load, err := getTransformerLoad(ctx, zone, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	transformer, err := getTransformer(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	gradeLoad(load, transformer)
+	return load, nil
+}
+
+// getTransformerLoad returns a zone's load in an interval, zero if nothing
+// is scheduled
+func getTransformerLoad(ctx contractapi.TransactionContextInterface, zone, intervalStart string) (*TransformerLoad, error) {
+	key, err := transformerLoadKey(ctx, zone, intervalStart)
+	if err != nil {
+		return nil, err
+	}
+	loadJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transformer load: %v", err)
+	}
+	if loadJSON == nil {
+		return &TransformerLoad{Zone: zone, IntervalStart: intervalStart, Level: LoadNormal}, nil
+	}
+	var load TransformerLoad
+	if err := json.Unmarshal(loadJSON, &load); err != nil {
+		return nil, err
+	}
+	return &load, nil
+}
+
+func putTransformerLoad(ctx contractapi.TransactionContextInterface, load *TransformerLoad) error {
+	loadJSON, err := json.Marshal(load)
+	if err != nil {
+		return err
+	}
+	key, err := transformerLoadKey(ctx, load.Zone, load.IntervalStart)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, loadJSON)
+}
+
+// gradeLoad compares a scheduled load with a zone's transformer
+func gradeLoad(load *TransformerLoad, transformer *Transformer) {
+	load.Rating, load.Utilization, load.Level = 0, 0, LoadNormal
+	if transformer == nil {
+		return
+	}
+	load.Rating, load.Utilization = transformer.Rating, load.ScheduledLoad/transformer.Rating
+	switch {
+	case load.ScheduledLoad > transformer.Rating:
+		load.Level = LoadOverload
+	case load.ScheduledLoad >= transformer.Rating*transformer.WarningThreshold:
+		load.Level = LoadWarning
+	}
+}
+
+// addTransformerLoad adds energy to a zone's scheduled load in one interval
+// and emits TransformerLoadWarning when the load rises to a higher level
+// than it had, so that the operator hears of it once per crossing. A
+// negative energy releases load, lowering the level without an event.
+func addTransformerLoad(ctx contractapi.TransactionContextInterface, zone, intervalStart, tokenID string, energy float64) error {
+	load, err := getTransformerLoad(ctx, zone, intervalStart)
+	if err != nil {
+		return err
+	}
+	transformer, err := getTransformer(ctx, zone)
+	if err != nil {
+		return err
+	}
+	previous := load.Level
+	load.ScheduledLoad = math.Max(0, load.ScheduledLoad+energy)
+	load.LastTradeID = tokenID
+	gradeLoad(load, transformer)
+	if err := putTransformerLoad(ctx, load); err != nil {
+		return err
+	}
+	if levelRank(load.Level) > levelRank(previous) {
+		return emitEvent(ctx, EventTransformerLoadWarning, load)
+	}
+	return nil
+}
+
+func levelRank(level string) int {
+	switch level {
+	case LoadWarning:
+		return 1
+	case LoadOverload:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// trackTransformerLoads adds a confirmed trade's scheduled energy in each of
+// its intervals to the loads of its parties' zones, once if they share one
+func trackTransformerLoads(ctx contractapi.TransactionContextInterface, asset *EnergyAsset, sellerZone, buyerZone string, intervals []deliveryInterval) error {
+	zones := []string{sellerZone}
+	if buyerZone != sellerZone {
+		zones = append(zones, buyerZone)
+	}
+	for _, interval := range intervals {
+		for _, zone := range zones {
+			if err := addTransformerLoad(ctx, zone, interval.start, asset.TokenID, scheduledEnergy(asset)*interval.share); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// loadWarnings counts the TransformerLoadWarning events emitted so far
+func (tc *testContext) loadWarnings() int {
+	warnings := 0
+	for i := 0; i < tc.stub.SetEventCallCount(); i++ {
+		if name, _ := tc.stub.SetEventArgsForCall(i); name == EventTransformerLoadWarning {
+			warnings++
+		}
+	}
+	return warnings
+}
+
+func TestTransformerLoad(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerZoneParticipant(t, e, tc, "seller2", RoleProsumer, "zone2")
+
+	tc.as("operator1", RoleOperator)
+	_, err := e.SetTransformer(tc, "zone1", 0, 0.8)
+	require.EqualError(t, err, "transformer rating must be positive")
+	_, err = e.SetTransformer(tc, "zone1", 5, 1.5)
+	require.EqualError(t, err, "warning threshold must be above 0 and at most 1")
+	_, err = e.SetTransformer(tc, "zone1", 5, 0.8)
+	require.NoError(t, err)
+	_, err = e.GetTransformer(tc, "zone2")
+	require.EqualError(t, err, "zone zone2 has no transformer")
+
+	// 2.5 kWh per interval within zone1 stays below the 4 kWh warning level
+	confirmTestAsset(t, e, tc, "energy1")
+	load, err := e.GetTransformerLoad(tc, "zone1", "2025-05-03T10:00:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 2.5, load.ScheduledLoad, 1e-9)
+	require.Equal(t, LoadNormal, load.Level)
+	require.Zero(t, tc.loadWarnings())
+
+	// A trade from zone2 loads both zones and takes zone1 to its warning
+	// level in each of its four intervals
+	require.NoError(t, signZoneTrade(t, e, tc, "energy2"))
+	require.Equal(t, 4, tc.loadWarnings())
+	load, err = e.GetTransformerLoad(tc, "zone1", "2025-05-03T10:45:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 5, load.ScheduledLoad, 1e-9)
+	require.Equal(t, LoadWarning, load.Level)
+	load, err = e.GetTransformerLoad(tc, "zone2", "2025-05-03T10:45:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 2.5, load.ScheduledLoad, 1e-9)
+	require.Equal(t, LoadNormal, load.Level)
+
+	// Crossing the rating warns again, once per interval
+	require.NoError(t, e.CreateEnergyAsset(tc.as("buyer1", ""), "energy3", "buyer1", "seller1", 10, "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", SourceGrid))
+	require.NoError(t, e.SignEnergyAsset(tc, "energy3", tc.sign(t, e, "buyer1", "energy3"), 0))
+	require.NoError(t, e.SignEnergyAsset(tc.as("seller1", ""), "energy3", tc.sign(t, e, "seller1", "energy3"), 0))
+	require.Equal(t, 8, tc.loadWarnings())
+	load, err = e.GetTransformerLoad(tc, "zone1", "2025-05-03T10:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, LoadOverload, load.Level)
+	require.InDelta(t, 1.5, load.Utilization, 1e-9)
+	require.Equal(t, "energy3", load.LastTradeID)
+
+	// A curtailment order releases the load it removes
+	_, err = e.IssueCurtailmentOrder(tc.as("operator1", RoleOperator), "zone1", "2025-05-03T10:00:00Z", 3)
+	require.NoError(t, err)
+	load, err = e.GetTransformerLoad(tc, "zone1", "2025-05-03T10:00:00Z")
+	require.NoError(t, err)
+	require.InDelta(t, 4.5, load.ScheduledLoad, 1e-9)
+	require.Equal(t, LoadWarning, load.Level)
+}
@@ -0,0 +1,18 @@
+package main
+
+import "fmt"
+
+// Energy assets, token accounts and certificate orders carry a Version that
+// every write increments, starting at 1 when they are created. A client that
+// reads a document, decides on a change and submits it can pass the version
+// it read as expectedVersion; the transaction then fails if another one
+// updated the document in between, instead of silently acting on stale state.
+// An expectedVersion of 0 skips the check.
+
+// checkVersion fails unless expectedVersion is 0 or the current version
+func checkVersion(kind, id string, version, expectedVersion int64) error {
+	if expectedVersion != 0 && expectedVersion != version {
+		return fmt.Errorf("%s %s is at version %d, not %d", kind, id, version, expectedVersion)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpectedVersion(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	createTestAsset(t, e, tc, "energy1")
+
+	// Two clients read the same version; the second update is rejected
+	asset, err := e.ReadEnergyAsset(tc, "energy1")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), asset.Version)
+	require.NoError(t, e.SignEnergyAsset(tc.as("buyer1", ""), "energy1", tc.sign(t, e, "buyer1", "energy1"), asset.Version))
+	err = e.SignEnergyAsset(tc.as("seller1", ""), "energy1", tc.sign(t, e, "seller1", "energy1"), asset.Version)
+	require.EqualError(t, err, "asset energy1 is at version 2, not 1")
+	require.NoError(t, e.SignEnergyAsset(tc, "energy1", tc.sign(t, e, "seller1", "energy1"), 2))
+	err = e.ConfirmDelivery(tc, "energy1", 2)
+	require.EqualError(t, err, "asset energy1 is at version 3, not 2")
+	require.NoError(t, e.ConfirmDelivery(tc, "energy1", 0))
+
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	account, err := e.ReadTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), account.Version)
+	require.NoError(t, e.TransferTokens(tc.as("buyer1", ""), "seller1", 1, account.Version))
+	err = e.TransferTokens(tc, "seller1", 1, account.Version)
+	require.EqualError(t, err, "account buyer1 is at version 3, not 2")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ForceMajeureIrradiance is the average forecast irradiance, in W/m², below
+// which a seller's delivery shortfall is treated as force majeure and the
+// imbalance penalty is waived.
+const ForceMajeureIrradiance = 100.0
+
+// WeatherForecast is an oracle-posted forecast for one zone and period
+type WeatherForecast struct {
+	Zone         string  `json:"zone"`
+	Period       string  `json:"period"`
+	Irradiance   float64 `json:"irradiance"`
+	CloudCover   float64 `json:"cloudCover"`
+	TemperatureC float64 `json:"temperatureC"`
+	Oracle       string  `json:"oracle"`
+	PostedAt     string  `json:"postedAt"`
+}
+
+func weatherForecastKey(ctx contractapi.TransactionContextInterface, zone, period string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("forecast", []string{zone, period})
+}
+
+// PostWeatherForecast records the irradiance (W/m²), cloud cover (0 to 1) and
+// temperature forecast for a zone and period. A later forecast for the same
+// zone and period replaces the earlier one.
+func (e *EnergyTradingContract) PostWeatherForecast(ctx contractapi.TransactionContextInterface, zone, period string, irradiance, cloudCover, temperatureC float64) error {
+	if zone == "" {
+		return fmt.Errorf("zone must not be empty")
+	}
+	if irradiance < 0 {
+		return fmt.Errorf("irradiance must not be negative")
+	}
+	if cloudCover < 0 || cloudCover > 1 {
+		return fmt.Errorf("cloud cover must be between 0 and 1")
+	}
+	period, err := normalizeTimestamp(period)
+	if err != nil {
+		return err
+	}
+	oracle, err := callerAddress(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	forecast := WeatherForecast{
+		Zone:         zone,
+		Period:       period,
+		Irradiance:   irradiance,
+		CloudCover:   cloudCover,
+		TemperatureC: temperatureC,
+		Oracle:       oracle,
+		PostedAt:     now,
+	}
+	forecastJSON, err := json.Marshal(forecast)
+	if err != nil {
+		return err
+	}
+	key, err := weatherForecastKey(ctx, zone, period)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(key, forecastJSON); err != nil {
+		return err
+	}
+	return emitEvent(ctx, EventWeatherForecastPosted, forecast)
+}
+
+// PaginatedWeatherForecastResult is a page of weather forecasts
+type PaginatedWeatherForecastResult struct {
+	Records             []*WeatherForecast `json:"records"`
+	FetchedRecordsCount int32              `json:"fetchedRecordsCount"`
+	Bookmark            string             `json:"bookmark"`
+}
+
+// GetWeatherForecasts returns a page of a zone's forecasts for periods in the
+// half-open window [from, to). Forecasts outside the window are skipped, so a
+// page may hold fewer than pageSize forecasts.
+func (e *EnergyTradingContract) GetWeatherForecasts(ctx contractapi.TransactionContextInterface, zone, from, to string, pageSize int32, bookmark string) (*PaginatedWeatherForecastResult, error) {
+	fromTime, err := parseTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	toTime, err := parseTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	result := &PaginatedWeatherForecastResult{Records: []*WeatherForecast{}}
+	metadata, err := queryPage(ctx, "forecast", []string{zone}, pageSize, bookmark, func(value []byte) error {
+		var forecast WeatherForecast
+		if err := json.Unmarshal(value, &forecast); err != nil {
+			return err
+		}
+		period, err := parseTimestamp(forecast.Period)
+		if err != nil {
+			return err
+		}
+		if !period.Before(fromTime) && period.Before(toTime) {
+			result.Records = append(result.Records, &forecast)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.FetchedRecordsCount = metadata.FetchedRecordsCount
+	result.Bookmark = metadata.Bookmark
+	return result, nil
+}
+
+// getWeatherForecasts returns every forecast of a zone for periods in the
+// half-open window [from, to)
+func getWeatherForecasts(ctx contractapi.TransactionContextInterface, zone, from, to string) ([]*WeatherForecast, error) {
+	fromTime, err := parseTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	toTime, err := parseTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("forecast", []string{zone})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	forecasts := []*WeatherForecast{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var forecast WeatherForecast
+		if err := json.Unmarshal(queryResponse.Value, &forecast); err != nil {
+			return nil, err
+		}
+		period, err := parseTimestamp(forecast.Period)
+		if err != nil {
+			return nil, err
+		}
+		if period.Before(fromTime) || !period.Before(toTime) {
+			continue
+		}
+		forecasts = append(forecasts, &forecast)
+	}
+	return forecasts, nil
+}
+
+// isForceMajeure reports whether the forecasts for a zone over a delivery
+// window average below ForceMajeureIrradiance. Without forecasts a shortfall
+// is never force majeure.
+func isForceMajeure(ctx contractapi.TransactionContextInterface, zone, from, to string) (bool, error) {
+	forecasts, err := getWeatherForecasts(ctx, zone, from, to)
+	if err != nil {
+		return false, err
+	}
+	if len(forecasts) == 0 {
+		return false, nil
+	}
+	var total float64
+	for _, forecast := range forecasts {
+		total += forecast.Irradiance
+	}
+	return total/float64(len(forecasts)) < ForceMajeureIrradiance, nil
+}
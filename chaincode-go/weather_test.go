@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestWeatherForecast(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	tc.as("oracle1", RoleOracle)
+
+	err := e.PostWeatherForecast(tc, "zone1", "2025-05-03T10:00:00Z", 500, 1.5, 20)
+	require.EqualError(t, err, "cloud cover must be between 0 and 1")
+	require.NoError(t, e.PostWeatherForecast(tc, "zone1", "2025-05-03T10:00:00Z", 500, 0.2, 20))
+	require.NoError(t, e.PostWeatherForecast(tc, "zone1", "2025-05-03T10:00:00Z", 450, 0.3, 19))
+	require.NoError(t, e.PostWeatherForecast(tc, "zone1", "2025-05-03T11:00:00Z", 300, 0.5, 18))
+	require.NoError(t, e.PostWeatherForecast(tc, "zone2", "2025-05-03T10:00:00Z", 50, 1, 12))
+
+	forecasts, err := e.GetWeatherForecasts(tc, "zone1", "2025-05-03T10:00:00Z", "2025-05-03T11:00:00Z", DefaultMaxPageSize, "")
+	require.NoError(t, err)
+	require.Len(t, forecasts.Records, 1)
+	require.Equal(t, 450.0, forecasts.Records[0].Irradiance)
+}
+
+func TestReconcileDeliveryForceMajeure(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	postTestReferencePrice(t, e, tc, 0.2)
+	confirmTestAsset(t, e, tc, "energy1")
+	registerTestMeter(t, e, tc, "seller1")
+	registerTestMeter(t, e, tc, "buyer1")
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+	require.NoError(t, e.PostWeatherForecast(tc.as("oracle1", RoleOracle), "zone1", "2025-05-03T10:00:00Z", 40, 1, 12))
+
+	tc.stub.GetTxTimestampReturns(timestamppb.New(time.Date(2025, 5, 3, 11, 30, 0, 0, time.UTC)), nil)
+	submitTestReadings(t, e, tc, "seller1", 1, 0)
+	submitTestReadings(t, e, tc, "buyer1", 0, 3)
+
+	settlement, err := e.ReconcileDelivery(tc.as("buyer1", ""), "energy1")
+	require.NoError(t, err)
+	require.True(t, settlement.ForceMajeure)
+	require.Equal(t, 6.0, settlement.Shortfall)
+	require.Zero(t, settlement.ImbalancePenalty)
+}
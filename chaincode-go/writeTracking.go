@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Fabric simulates a transaction against the committed world state: GetState
+// does not see a PutState or DelState made earlier in the same transaction.
+// Composed operations, such as paying several levies from the buyer's account
+// or filling a bid against several offers, would therefore read a stale
+// balance on their second step and silently overwrite the first.
+// writeTrackingStub remembers the transaction's own writes and serves point
+// reads from them, so every helper sees the state as the transaction left it.
+// Range and composite key queries still return committed state, as Fabric
+// does; flows must not depend on finding keys they wrote themselves.
+type writeTrackingStub struct {
+	shim.ChaincodeStubInterface
+	writes        map[string][]byte
+	privateWrites map[string]map[string][]byte
+}
+
+// deletedValue is the tracked value of a key deleted in this transaction
+var deletedValue = []byte(nil)
+
+func newWriteTrackingStub(stub shim.ChaincodeStubInterface) *writeTrackingStub {
+	if tracking, ok := stub.(*writeTrackingStub); ok {
+		return tracking
+	}
+	return &writeTrackingStub{
+		ChaincodeStubInterface: stub,
+		writes:                 map[string][]byte{},
+		privateWrites:          map[string]map[string][]byte{},
+	}
+}
+
+// GetState returns the value written in this transaction, if any, and the
+// committed value otherwise
+func (s *writeTrackingStub) GetState(key string) ([]byte, error) {
+	if value, ok := s.writes[key]; ok {
+		return value, nil
+	}
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+// PutState writes the value and remembers it for later reads
+func (s *writeTrackingStub) PutState(key string, value []byte) error {
+	if err := s.ChaincodeStubInterface.PutState(key, value); err != nil {
+		return err
+	}
+	s.writes[key] = value
+	return nil
+}
+
+// DelState deletes the key and remembers the deletion for later reads
+func (s *writeTrackingStub) DelState(key string) error {
+	if err := s.ChaincodeStubInterface.DelState(key); err != nil {
+		return err
+	}
+	s.writes[key] = deletedValue
+	return nil
+}
+
+// GetPrivateData returns the private value written in this transaction, if
+// any, and the committed value otherwise
+func (s *writeTrackingStub) GetPrivateData(collection, key string) ([]byte, error) {
+	if value, ok := s.privateWrites[collection][key]; ok {
+		return value, nil
+	}
+	return s.ChaincodeStubInterface.GetPrivateData(collection, key)
+}
+
+// PutPrivateData writes the private value and remembers it for later reads
+func (s *writeTrackingStub) PutPrivateData(collection, key string, value []byte) error {
+	if err := s.ChaincodeStubInterface.PutPrivateData(collection, key, value); err != nil {
+		return err
+	}
+	s.privateWrite(collection, key, value)
+	return nil
+}
+
+// DelPrivateData deletes the private key and remembers the deletion
+func (s *writeTrackingStub) DelPrivateData(collection, key string) error {
+	if err := s.ChaincodeStubInterface.DelPrivateData(collection, key); err != nil {
+		return err
+	}
+	s.privateWrite(collection, key, deletedValue)
+	return nil
+}
+
+// PurgePrivateData purges the private key and remembers the deletion
+func (s *writeTrackingStub) PurgePrivateData(collection, key string) error {
+	if err := s.ChaincodeStubInterface.PurgePrivateData(collection, key); err != nil {
+		return err
+	}
+	s.privateWrite(collection, key, deletedValue)
+	return nil
+}
+
+func (s *writeTrackingStub) privateWrite(collection, key string, value []byte) {
+	if s.privateWrites[collection] == nil {
+		s.privateWrites[collection] = map[string][]byte{}
+	}
+	s.privateWrites[collection][key] = value
+}
+
+// TransactionContext is the transaction context of the energy trading
+// contract. It wraps the stub of every transaction in a writeTrackingStub.
+type TransactionContext struct {
+	contractapi.TransactionContext
+}
+
+// SetStub stores the transaction's stub, wrapped to track its writes
+func (ctx *TransactionContext) SetStub(stub shim.ChaincodeStubInterface) {
+	ctx.TransactionContext.SetStub(newWriteTrackingStub(stub))
+}
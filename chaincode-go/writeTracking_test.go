@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTrackingStubReadsOwnWrites(t *testing.T) {
+	e := &EnergyTradingContract{}
+	tc := newTestContext()
+	registerTestParticipant(t, e, tc, "buyer1", RoleConsumer)
+	registerTestParticipant(t, e, tc, "seller1", RoleProsumer)
+	require.NoError(t, e.MintTokens(tc.as("admin1", RoleAdmin), "buyer1", 10))
+	require.NoError(t, e.MintTokens(tc, "seller1", 1))
+
+	// Like Fabric, buffer writes until commit so reads see committed state
+	pending := map[string][]byte{}
+	tc.stub.PutStateStub = func(key string, value []byte) error {
+		pending[key] = value
+		return nil
+	}
+	commit := func() {
+		for key, value := range pending {
+			tc.state[key] = value
+		}
+		pending = map[string][]byte{}
+	}
+
+	// Without tracking the second transfer overwrites the first
+	require.NoError(t, transferTokens(tc, "buyer1", "seller1", 2))
+	require.NoError(t, transferTokens(tc, "buyer1", "seller1", 3))
+	commit()
+	buyer, err := getTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, 7.0, buyer.Balance)
+
+	tc.GetStubReturns(newWriteTrackingStub(tc.stub))
+	require.NoError(t, transferTokens(tc, "buyer1", "seller1", 2))
+	require.NoError(t, transferTokens(tc, "buyer1", "seller1", 3))
+	buyer, err = getTokenAccount(tc, "buyer1")
+	require.NoError(t, err)
+	require.Equal(t, 2.0, buyer.Balance)
+	commit()
+	seller, err := getTokenAccount(tc, "seller1")
+	require.NoError(t, err)
+	require.Equal(t, 9.0, seller.Balance)
+
+	// Deletions are tracked too
+	stub := newWriteTrackingStub(tc.stub)
+	require.NoError(t, stub.DelState("missing"))
+	require.NoError(t, stub.PutState("k", []byte("v")))
+	require.NoError(t, stub.DelState("k"))
+	value, err := stub.GetState("k")
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.Same(t, stub, newWriteTrackingStub(stub))
+}